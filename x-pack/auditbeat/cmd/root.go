@@ -62,6 +62,12 @@ func init() {
 	settings := auditbeatcmd.AuditbeatSettings(globalProcs)
 	settings.ElasticLicensed = true
 	RootCmd = auditbeatcmd.Initialize(settings)
+	if preflight := genShowSocketPreflightCmd(settings); preflight != nil {
+		auditbeatcmd.ShowCmd.AddCommand(preflight)
+	}
+	if export := genExportSocketGuessesCmd(settings); export != nil {
+		RootCmd.ExportCmd.AddCommand(export)
+	}
 }
 
 func defaultProcessors() []mapstr.M {
@@ -0,0 +1,108 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket"
+	conf "github.com/elastic/elastic-agent-libs/config"
+)
+
+// genShowSocketPreflightCmd returns the command that shows which kprobes the
+// system/socket dataset would install in the running kernel.
+func genShowSocketPreflightCmd(settings instance.Settings) *cobra.Command {
+	var traceFSPath string
+	cmd := &cobra.Command{
+		Use:     "socket-preflight",
+		Short:   "Show which kprobes the system/socket dataset would install in the running kernel",
+		Aliases: []string{"socket_preflight"},
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := socketModuleConfig(settings)
+			if err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Failed to read the system/socket configuration: %v\n", err)
+				os.Exit(1)
+			}
+			compatible, err := socket.Preflight(cmd.OutOrStdout(), cfg, traceFSPath)
+			if err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Failed to run socket preflight: %v\n", err)
+				os.Exit(1)
+			}
+			if !compatible {
+				os.Exit(2)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&traceFSPath, "tracefs-path", "", "Path to tracefs/debugfs tracing directory (default: from the configuration, or autodetect)")
+	return cmd
+}
+
+// genExportSocketGuessesCmd returns the command that runs the guesses of the
+// system/socket dataset and exports their results, to be loaded with
+// socket.guess_artifact_path on hosts running the same kernel.
+func genExportSocketGuessesCmd(settings instance.Settings) *cobra.Command {
+	var traceFSPath string
+	cmd := &cobra.Command{
+		Use:     "socket-guesses",
+		Short:   "Export the guess results of the system/socket dataset for the running kernel",
+		Aliases: []string{"socket_guesses"},
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := socketModuleConfig(settings)
+			if err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Failed to read the system/socket configuration: %v\n", err)
+				os.Exit(1)
+			}
+			if err = socket.ExportGuesses(cmd.OutOrStdout(), cfg, traceFSPath); err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Failed to export socket guesses: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&traceFSPath, "tracefs-path", "", "Path to tracefs/debugfs tracing directory (default: from the configuration, or autodetect)")
+	return cmd
+}
+
+// socketModuleConfig returns the configuration of the first system module in
+// auditbeat.modules that runs the socket dataset, or nil when there is none.
+func socketModuleConfig(settings instance.Settings) (*conf.C, error) {
+	b, err := instance.NewInitializedBeat(settings)
+	if err != nil {
+		return nil, err
+	}
+	beatCfg, err := b.BeatConfig()
+	if err != nil {
+		return nil, err
+	}
+	var modules struct {
+		Modules []*conf.C `config:"modules"`
+	}
+	if err = beatCfg.Unpack(&modules); err != nil {
+		return nil, err
+	}
+	for _, cfg := range modules.Modules {
+		var module struct {
+			Module   string   `config:"module"`
+			Datasets []string `config:"datasets"`
+		}
+		if err = cfg.Unpack(&module); err != nil {
+			return nil, err
+		}
+		if module.Module != "system" {
+			continue
+		}
+		for _, dataset := range module.Datasets {
+			if dataset == "socket" {
+				return cfg, nil
+			}
+		}
+	}
+	return nil, nil
+}
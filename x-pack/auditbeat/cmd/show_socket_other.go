@@ -0,0 +1,25 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !((linux && 386) || (linux && amd64))
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+)
+
+// genShowSocketPreflightCmd returns nil, as the system/socket dataset is not
+// supported on this platform.
+func genShowSocketPreflightCmd(instance.Settings) *cobra.Command {
+	return nil
+}
+
+// genExportSocketGuessesCmd returns nil, as the system/socket dataset is not
+// supported on this platform.
+func genExportSocketGuessesCmd(instance.Settings) *cobra.Command {
+	return nil
+}
@@ -7,7 +7,9 @@ package system
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"hash"
+	"time"
 )
 
 // EntityHash calculates a standard entity hash.
@@ -29,3 +31,14 @@ func (h *EntityHash) Sum() string {
 	}
 	return base64.RawStdEncoding.EncodeToString(hash)
 }
+
+// ProcessEntityID returns the process.entity_id of a process, which uniquely
+// identifies it across machines. All the datasets reporting processes use it,
+// so that their events can be correlated.
+func ProcessEntityID(hostID string, pid int, startTime time.Time) string {
+	h := NewEntityHash()
+	h.Write([]byte(hostID))
+	binary.Write(h, binary.LittleEndian, int64(pid))
+	binary.Write(h, binary.LittleEndian, startTime.UnixNano())
+	return h.Sum()
+}
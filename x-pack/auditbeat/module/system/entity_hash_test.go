@@ -0,0 +1,24 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package system
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessEntityID(t *testing.T) {
+	const hostID = "f0a8d5c0f3e74b2e9bb8c6c6e5f6a7b8"
+	start := time.Date(2019, 1, 1, 0, 0, 1, 500, time.UTC)
+
+	// The IDs are persisted in events, so they must not change.
+	assert.Equal(t, "qeNY0tGSDtgpshJI", ProcessEntityID(hostID, 1234, start))
+	assert.Equal(t, ProcessEntityID(hostID, 1234, start), ProcessEntityID(hostID, 1234, start.In(time.Local)))
+	assert.NotEqual(t, ProcessEntityID(hostID, 1234, start), ProcessEntityID(hostID, 1234, start.Add(time.Minute)))
+	assert.NotEqual(t, ProcessEntityID(hostID, 1234, start), ProcessEntityID(hostID, 1235, start))
+	assert.NotEqual(t, ProcessEntityID(hostID, 1234, start), ProcessEntityID("other-host", 1234, start))
+}
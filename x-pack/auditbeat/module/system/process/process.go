@@ -5,7 +5,6 @@
 package process
 
 import (
-	"encoding/binary"
 	"fmt"
 	"os"
 	"os/user"
@@ -134,11 +133,7 @@ func (p Process) toMapStr() mapstr.M {
 
 // entityID creates an ID that uniquely identifies this process across machines.
 func (p Process) entityID(hostID string) string {
-	h := system.NewEntityHash()
-	h.Write([]byte(hostID))
-	binary.Write(h, binary.LittleEndian, int64(p.Info.PID))
-	binary.Write(h, binary.LittleEndian, int64(p.Info.StartTime.Nanosecond()))
-	return h.Sum()
+	return system.ProcessEntityID(hostID, p.Info.PID, p.Info.StartTime)
 }
 
 // New constructs a new MetricSet.
@@ -137,6 +137,16 @@ func testProcess() *Process {
 	}
 }
 
+func TestEntityID(t *testing.T) {
+	const hostID = "f0a8d5c0f3e74b2e9bb8c6c6e5f6a7b8"
+	p := testProcess()
+	restarted := testProcess()
+	restarted.Info.StartTime = p.Info.StartTime.Add(time.Minute)
+
+	assert.Equal(t, p.entityID(hostID), testProcess().entityID(hostID))
+	assert.NotEqual(t, p.entityID(hostID), restarted.entityID(hostID))
+}
+
 func TestPutIfNotEmpty(t *testing.T) {
 	mapstr := mapstr.M{}
 
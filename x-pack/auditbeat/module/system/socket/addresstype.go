@@ -0,0 +1,166 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Types of destination addresses reported in network.destination.address_type.
+const (
+	addressBroadcast = "broadcast"
+	addressMulticast = "multicast"
+)
+
+// How long the broadcast addresses of the local subnets are cached. Addresses
+// can be added or removed without any link change.
+const subnetCacheTTL = 30 * time.Second
+
+// wellKnownGroups are the names of the multicast groups used by common
+// discovery and routing protocols.
+var wellKnownGroups = map[string]string{
+	"224.0.0.1":       "all-hosts",
+	"224.0.0.2":       "all-routers",
+	"224.0.0.5":       "OSPF",
+	"224.0.0.6":       "OSPF-DR",
+	"224.0.0.9":       "RIPv2",
+	"224.0.0.13":      "PIM",
+	"224.0.0.18":      "VRRP",
+	"224.0.0.22":      "IGMPv3",
+	"224.0.0.102":     "HSRPv2",
+	"224.0.0.251":     "mDNS",
+	"224.0.0.252":     "LLMNR",
+	"224.0.1.1":       "NTP",
+	"239.255.255.250": "SSDP",
+	"ff02::1":         "all-nodes",
+	"ff02::2":         "all-routers",
+	"ff02::5":         "OSPF",
+	"ff02::6":         "OSPF-DR",
+	"ff02::9":         "RIPng",
+	"ff02::c":         "SSDP",
+	"ff02::d":         "PIM",
+	"ff02::12":        "VRRP",
+	"ff02::16":        "MLDv2",
+	"ff02::fb":        "mDNS",
+	"ff02::1:2":       "DHCPv6",
+	"ff02::1:3":       "LLMNR",
+	"ff05::1:3":       "DHCPv6-servers",
+}
+
+// addressTypeClassifier classifies the destination addresses of flows as
+// broadcast or multicast. Subnet broadcast addresses are those of the
+// interfaces in the Beat's network namespace, so they're only recognized for
+// flows in the same or an unknown namespace.
+type addressTypeClassifier struct {
+	sync.Mutex
+	netns      uint64
+	groupNames bool
+	// broadcast address of the subnet of each local IPv4 address.
+	broadcasts map[string]net.IP
+	expires    time.Time
+
+	// Decoupled for testing.
+	clock       func() time.Time
+	listSubnets func() ([]*net.IPNet, error)
+}
+
+func newAddressTypeClassifier(groupNames bool) *addressTypeClassifier {
+	netns, _ := readNetNS(uint32(os.Getpid()))
+	return &addressTypeClassifier{
+		netns:       netns,
+		groupNames:  groupNames,
+		clock:       time.Now,
+		listSubnets: listSubnets,
+	}
+}
+
+// Classify returns the type of the destination address of a flow sent from
+// local, and the name of its multicast group when group names are enabled
+// and it's a well-known one. The type is empty for unicast addresses.
+func (c *addressTypeClassifier) Classify(netns uint64, local, dst net.IP) (addrType, group string) {
+	if c == nil || dst == nil {
+		return "", ""
+	}
+	if dst.IsMulticast() {
+		if c.groupNames {
+			group = wellKnownGroups[dst.String()]
+		}
+		return addressMulticast, group
+	}
+	dst4 := dst.To4()
+	if dst4 == nil {
+		// IPv6 has no broadcast.
+		return "", ""
+	}
+	if dst4.Equal(net.IPv4bcast) {
+		return addressBroadcast, ""
+	}
+	if local == nil || (netns != 0 && netns != c.netns) {
+		return "", ""
+	}
+	if broadcast := c.subnetBroadcast(local); broadcast != nil && broadcast.Equal(dst4) {
+		return addressBroadcast, ""
+	}
+	return "", ""
+}
+
+// subnetBroadcast returns the broadcast address of the subnet of a local IPv4
+// address, or nil if it's not the address of a local interface.
+func (c *addressTypeClassifier) subnetBroadcast(local net.IP) net.IP {
+	c.Lock()
+	defer c.Unlock()
+	if now := c.clock(); c.broadcasts == nil || now.After(c.expires) {
+		c.broadcasts = make(map[string]net.IP)
+		c.expires = now.Add(subnetCacheTTL)
+		subnets, err := c.listSubnets()
+		if err != nil {
+			return nil
+		}
+		for _, subnet := range subnets {
+			if broadcast := broadcastAddress(subnet); broadcast != nil {
+				c.broadcasts[subnet.IP.String()] = broadcast
+			}
+		}
+	}
+	return c.broadcasts[local.String()]
+}
+
+// broadcastAddress returns the broadcast address of an IPv4 subnet, given by
+// an address and its mask, or nil for IPv6 and for /31 and /32 subnets, which
+// have none.
+func broadcastAddress(subnet *net.IPNet) net.IP {
+	ip, mask := subnet.IP.To4(), subnet.Mask
+	if ip == nil || len(mask) != net.IPv4len {
+		return nil
+	}
+	if ones, _ := mask.Size(); ones > 30 {
+		return nil
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range ip {
+		broadcast[i] = ip[i] | ^mask[i]
+	}
+	return broadcast
+}
+
+// listSubnets returns the addresses of the local interfaces, with their mask.
+func listSubnets() ([]*net.IPNet, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	subnets := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if subnet, ok := addr.(*net.IPNet); ok {
+			subnets = append(subnets, subnet)
+		}
+	}
+	return subnets, nil
+}
@@ -0,0 +1,121 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressTypeClassifier(t *testing.T) {
+	const netns = 4026531992
+	now := time.Now()
+	var numLists int
+	c := newAddressTypeClassifier(true)
+	c.netns = netns
+	c.clock = func() time.Time { return now }
+	c.listSubnets = func() ([]*net.IPNet, error) {
+		numLists++
+		return []*net.IPNet{
+			{IP: net.ParseIP("192.168.33.10"), Mask: net.CIDRMask(24, 32)},
+			{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(32, 32)},
+			{IP: net.ParseIP("fd00::10"), Mask: net.CIDRMask(64, 128)},
+		}, nil
+	}
+	local := net.ParseIP("192.168.33.10")
+	for _, tc := range []struct {
+		netns    uint64
+		local    net.IP
+		dst      string
+		addrType string
+		group    string
+	}{
+		{netns, local, "172.19.12.13", "", ""},
+		{netns, local, "255.255.255.255", addressBroadcast, ""},
+		{netns, local, "192.168.33.255", addressBroadcast, ""},
+		{0, local, "192.168.33.255", addressBroadcast, ""},
+		// The subnet of another network namespace is unknown.
+		{4026532281, local, "192.168.33.255", "", ""},
+		{netns, net.ParseIP("10.1.2.3"), "10.1.2.255", "", ""},
+		{netns, local, "224.0.0.251", addressMulticast, "mDNS"},
+		{netns, local, "239.255.255.250", addressMulticast, "SSDP"},
+		{netns, local, "239.1.2.3", addressMulticast, ""},
+		{netns, net.ParseIP("fd00::10"), "ff02::fb", addressMulticast, "mDNS"},
+		{netns, net.ParseIP("fd00::10"), "fd00::ffff", "", ""},
+	} {
+		addrType, group := c.Classify(tc.netns, tc.local, net.ParseIP(tc.dst))
+		assert.Equal(t, tc.addrType, addrType, tc.dst)
+		assert.Equal(t, tc.group, group, tc.dst)
+	}
+	assert.Equal(t, 1, numLists)
+
+	// Subnets are refreshed.
+	now = now.Add(subnetCacheTTL + time.Second)
+	c.Classify(netns, local, net.ParseIP("192.168.33.255"))
+	assert.Equal(t, 2, numLists)
+
+	// Group names disabled.
+	c.groupNames = false
+	_, group := c.Classify(netns, local, net.ParseIP("224.0.0.251"))
+	assert.Empty(t, group)
+
+	var disabled *addressTypeClassifier
+	addrType, _ := disabled.Classify(netns, local, net.ParseIP("255.255.255.255"))
+	assert.Empty(t, addrType)
+}
+
+func TestBroadcastAddress(t *testing.T) {
+	for cidr, expected := range map[string]string{
+		"192.168.33.10/24": "192.168.33.255",
+		"10.1.2.3/8":       "10.255.255.255",
+		"172.16.5.1/30":    "172.16.5.3",
+		"172.16.5.1/31":    "<nil>",
+		"fd00::10/64":      "<nil>",
+	} {
+		ip, subnet, err := net.ParseCIDR(cidr)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		subnet.IP = ip
+		assert.Equal(t, expected, broadcastAddress(subnet).String(), cidr)
+	}
+}
+
+func TestFlowAddressType(t *testing.T) {
+	const sock uintptr = 0xff1000
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	c := newAddressTypeClassifier(true)
+	c.listSubnets = func() ([]*net.IPNet, error) { return nil, nil }
+	withAddressTypes(c)(&st.state)
+	st.feedEvents([]event{
+		callExecve(meta(1234, 1234, 1), []string{"/usr/sbin/avahi-daemon"}),
+		&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+		&inetCreate{Meta: meta(1234, 1234, 3), Proto: 0},
+		&sockInitData{Meta: meta(1234, 1234, 3), Sock: sock},
+		&udpSendMsgCall{
+			Meta:     meta(1234, 1234, 4),
+			Sock:     sock,
+			Size:     40,
+			LAddr:    ipv4(testLocalIP),
+			AltRAddr: ipv4("224.0.0.251"),
+			LPort:    be16(5353),
+			AltRPort: be16(5353),
+		},
+		&inetReleaseCall{Meta: meta(1234, 1234, 5), Sock: sock},
+	})
+	st.ExpireFlows()
+	flows := st.getFlows()
+	if !assert.Len(t, flows, 1) {
+		t.FailNow()
+	}
+	assertValue(t, flows[0], "224.0.0.251", "destination.ip")
+	assertValue(t, flows[0], addressMulticast, "network.destination.address_type")
+	assertValue(t, flows[0], "mDNS", "network.destination.multicast_group")
+}
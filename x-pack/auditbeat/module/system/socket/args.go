@@ -0,0 +1,43 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import "unicode/utf8"
+
+// Appended to the last argument kept when the arguments are truncated.
+const truncatedArgsMarker = "...truncated"
+
+// withMaxArgsLength limits the total length of the arguments reported for
+// processes. Zero disables the limit.
+func withMaxArgsLength(max int) stateOption {
+	return func(s *state) {
+		s.maxArgsLength = max
+	}
+}
+
+// truncateArgs limits the total length in bytes of args to max, not counting
+// the marker appended to the last argument kept. Arguments are cut on a rune
+// boundary so that they remain valid UTF-8. It returns whether args was
+// truncated. The given slice isn't modified.
+func truncateArgs(args []string, max int) ([]string, bool) {
+	total := 0
+	for i, arg := range args {
+		if total+len(arg) <= max {
+			total += len(arg)
+			continue
+		}
+		cut := max - total
+		for cut > 0 && !utf8.RuneStart(arg[cut]) {
+			cut--
+		}
+		out := make([]string, i+1)
+		copy(out, args[:i])
+		out[i] = arg[:cut] + truncatedArgsMarker
+		return out, true
+	}
+	return args, false
+}
@@ -0,0 +1,84 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		args      []string
+		max       int
+		expected  []string
+		truncated bool
+	}{
+		{
+			name:     "within limit",
+			args:     []string{"java", "-jar", "app.jar"},
+			max:      15,
+			expected: []string{"java", "-jar", "app.jar"},
+		},
+		{
+			name:      "cut argument",
+			args:      []string{"java", "-cp", "/a.jar:/b.jar", "Main"},
+			max:       13,
+			expected:  []string{"java", "-cp", "/a.jar" + truncatedArgsMarker},
+			truncated: true,
+		},
+		{
+			name:      "cut at argument boundary",
+			args:      []string{"java", "-cp", "/a.jar"},
+			max:       7,
+			expected:  []string{"java", "-cp", truncatedArgsMarker},
+			truncated: true,
+		},
+		{
+			// "é" takes two bytes, which must not be split.
+			name:      "rune boundary",
+			args:      []string{"echo", "café"},
+			max:       8,
+			expected:  []string{"echo", "caf" + truncatedArgsMarker},
+			truncated: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := append([]string(nil), tc.args...)
+			result, truncated := truncateArgs(args, tc.max)
+			assert.Equal(t, tc.expected, result)
+			assert.Equal(t, tc.truncated, truncated)
+			assert.Equal(t, tc.args, args, "input was modified")
+			for _, arg := range result {
+				assert.True(t, utf8.ValidString(arg), arg)
+			}
+		})
+	}
+}
+
+func TestMaxArgsLength(t *testing.T) {
+	classPath := strings.Repeat("/opt/app/lib/dependency.jar:", 1000)
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withMaxArgsLength(64)(&st.state)
+	if err := st.CreateProcess(&process{pid: 1234, name: "java", args: []string{"/usr/bin/java", "-cp", classPath, "Main"}}); err != nil {
+		t.Fatal(err)
+	}
+	st.feedEvents(append(tcpConnectEvents(1234, 5, 8),
+		&inetReleaseCall{Meta: meta(1234, 1234, 15), Sock: testSock}))
+	st.ExpireFlows()
+	flows := st.getFlows()
+	if !assert.Len(t, flows, 1) {
+		t.FailNow()
+	}
+	assertValue(t, flows[0], []string{"/usr/bin/java", "-cp", classPath[:48] + truncatedArgsMarker}, "process.args")
+	assertValue(t, flows[0], true, "process.args_truncated")
+}
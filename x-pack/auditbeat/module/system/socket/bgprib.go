@@ -0,0 +1,505 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+)
+
+// How often the modification time of the RIB dump is checked. Dumps of a
+// full table take seconds to load, so they're reloaded in the background.
+const bgpRIBCheckInterval = time.Minute
+
+// MRT types and subtypes (RFC 6396) of the RIB entries that are loaded.
+const (
+	mrtTableDumpV2 = 13
+
+	mrtRIBIPv4Unicast        = 2
+	mrtRIBIPv6Unicast        = 4
+	mrtRIBIPv4UnicastAddPath = 8
+	mrtRIBIPv6UnicastAddPath = 10
+)
+
+// BGP path attributes (RFC 4271).
+const (
+	bgpAttrFlagExtendedLength = 0x10
+	bgpAttrASPath             = 2
+
+	bgpASSet      = 1
+	bgpASSequence = 2
+)
+
+// asRoute is the AS path of a route.
+type asRoute struct {
+	// path is the list of ASes traversed, from the neighbour to the origin.
+	// The members of AS_SET segments are included in order.
+	path []uint32
+	// origin is the AS that originated the route. Zero when the path ends
+	// with an AS_SET, as the origin is ambiguous then.
+	origin uint32
+}
+
+// ribTable finds the longest prefix that contains an address. Prefixes are
+// kept in a map per prefix length, as a binary trie of a full Internet table
+// would take millions of nodes.
+type ribTable struct {
+	v4 [8*net.IPv4len + 1]map[uint32]*asRoute
+	v6 [8*net.IPv6len + 1]map[[net.IPv6len]byte]*asRoute
+	// Prefix lengths present in each map, longest first.
+	v4Lens, v6Lens []int
+	size           int
+}
+
+func maskIPv4(ip net.IP, ones int) uint32 {
+	addr := binary.BigEndian.Uint32(ip)
+	if ones == 0 {
+		return 0
+	}
+	return addr &^ (1<<(32-ones) - 1)
+}
+
+func maskIPv6(ip net.IP, ones int) (key [net.IPv6len]byte) {
+	copy(key[:], ip.Mask(net.CIDRMask(ones, 8*net.IPv6len)))
+	return key
+}
+
+// insert adds a route for the given network. Only the first route for each
+// network is kept, as dumps list the route learnt from each peer.
+func (t *ribTable) insert(n *net.IPNet, r *asRoute) {
+	ones, bits := n.Mask.Size()
+	if ip4 := n.IP.To4(); ip4 != nil && bits == 8*net.IPv4len {
+		if t.v4[ones] == nil {
+			t.v4[ones] = make(map[uint32]*asRoute)
+		}
+		key := maskIPv4(ip4, ones)
+		if _, found := t.v4[ones][key]; !found {
+			t.v4[ones][key] = r
+			t.size++
+		}
+		return
+	}
+	if bits != 8*net.IPv6len {
+		return
+	}
+	if t.v6[ones] == nil {
+		t.v6[ones] = make(map[[net.IPv6len]byte]*asRoute)
+	}
+	key := maskIPv6(n.IP, ones)
+	if _, found := t.v6[ones][key]; !found {
+		t.v6[ones][key] = r
+		t.size++
+	}
+}
+
+// index computes the prefix lengths present once all the routes are loaded.
+func (t *ribTable) index() {
+	t.v4Lens, t.v6Lens = nil, nil
+	for ones := len(t.v4) - 1; ones >= 0; ones-- {
+		if len(t.v4[ones]) > 0 {
+			t.v4Lens = append(t.v4Lens, ones)
+		}
+	}
+	for ones := len(t.v6) - 1; ones >= 0; ones-- {
+		if len(t.v6[ones]) > 0 {
+			t.v6Lens = append(t.v6Lens, ones)
+		}
+	}
+}
+
+// lookup returns the route of the longest prefix that contains the address,
+// or nil when there is none.
+func (t *ribTable) lookup(ip net.IP) *asRoute {
+	if t == nil || ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		for _, ones := range t.v4Lens {
+			if r, found := t.v4[ones][maskIPv4(ip4, ones)]; found {
+				return r
+			}
+		}
+		return nil
+	}
+	if len(ip) != net.IPv6len {
+		return nil
+	}
+	for _, ones := range t.v6Lens {
+		if r, found := t.v6[ones][maskIPv6(ip, ones)]; found {
+			return r
+		}
+	}
+	return nil
+}
+
+// bgpRIB resolves destination addresses to the AS path of the route that
+// covers them, from a dump of a BGP RIB which is reloaded when it's modified.
+type bgpRIB struct {
+	sync.Mutex
+	path      string
+	table     *ribTable
+	modTime   time.Time
+	nextCheck time.Time
+	loading   bool
+	log       helper.Logger
+
+	// Decoupled for testing.
+	clock func() time.Time
+}
+
+// newBGPRIB loads the RIB dump at the given path. It returns nil when no path
+// is configured.
+func newBGPRIB(path string, log helper.Logger) (*bgpRIB, error) {
+	if path == "" {
+		return nil, nil
+	}
+	r := &bgpRIB{
+		path:  path,
+		log:   log,
+		clock: time.Now,
+	}
+	table, modTime, err := loadRIB(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load BGP RIB from %s: %w", path, err)
+	}
+	r.table, r.modTime = table, modTime
+	r.nextCheck = r.clock().Add(bgpRIBCheckInterval)
+	log.Infof("Loaded %d prefixes from BGP RIB %s", table.size, path)
+	return r, nil
+}
+
+// Lookup returns the route for the given address, or nil when the address
+// isn't covered by any prefix in the RIB.
+func (r *bgpRIB) Lookup(ip net.IP) *asRoute {
+	if r == nil || ip == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	if now := r.clock(); !now.Before(r.nextCheck) && !r.loading {
+		r.nextCheck = now.Add(bgpRIBCheckInterval)
+		if info, err := os.Stat(r.path); err == nil && !info.ModTime().Equal(r.modTime) {
+			r.loading = true
+			go r.reload()
+		}
+	}
+	return r.table.lookup(ip)
+}
+
+// reload loads the RIB dump again. The previous routes are kept if it can't
+// be loaded.
+func (r *bgpRIB) reload() {
+	table, modTime, err := loadRIB(r.path)
+	r.Lock()
+	defer r.Unlock()
+	r.loading = false
+	if err != nil {
+		// Not retried until the file changes again.
+		if info, statErr := os.Stat(r.path); statErr == nil {
+			r.modTime = info.ModTime()
+		}
+		r.log.Warnf("Failed to reload BGP RIB from %s, keeping the previous routes: %v", r.path, err)
+		return
+	}
+	r.table, r.modTime = table, modTime
+	r.log.Infof("Reloaded %d prefixes from BGP RIB %s", table.size, r.path)
+}
+
+// loadRIB reads a RIB dump, returning it along with the modification time of
+// the file.
+func loadRIB(path string) (*ribTable, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	table, err := parseRIB(f)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return table, info.ModTime(), nil
+}
+
+// parseRIB parses a RIB dump in MRT TABLE_DUMP_V2 format or in text format,
+// optionally compressed with gzip or bzip2.
+func parseRIB(rd io.Reader) (*ribTable, error) {
+	br := bufio.NewReader(rd)
+	magic, _ := br.Peek(3)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	case bytes.Equal(magic, []byte("BZh")):
+		br = bufio.NewReader(bzip2.NewReader(br))
+	}
+	table := &ribTable{}
+	var err error
+	// Bytes 4-5 of an MRT header are the type, which in a text file would
+	// have to be a NUL and a CR.
+	if header, _ := br.Peek(6); len(header) == 6 && binary.BigEndian.Uint16(header[4:]) == mrtTableDumpV2 {
+		err = parseMRT(br, table)
+	} else {
+		err = parseTextRIB(br, table)
+	}
+	if err != nil {
+		return nil, err
+	}
+	table.index()
+	return table, nil
+}
+
+var errShortMRT = errors.New("truncated MRT record")
+
+// parseMRT loads the unicast RIB entries of an MRT TABLE_DUMP_V2 dump. Other
+// records are skipped. The first entry of each prefix is used.
+func parseMRT(rd io.Reader, table *ribTable) error {
+	var (
+		header [12]byte
+		body   []byte
+		paths  = make(map[string]*asRoute)
+	)
+	for {
+		if _, err := io.ReadFull(rd, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errShortMRT
+		}
+		typ := binary.BigEndian.Uint16(header[4:])
+		subtype := binary.BigEndian.Uint16(header[6:])
+		length := binary.BigEndian.Uint32(header[8:])
+		if uint32(cap(body)) < length {
+			body = make([]byte, length)
+		}
+		body = body[:length]
+		if _, err := io.ReadFull(rd, body); err != nil {
+			return errShortMRT
+		}
+		if typ != mrtTableDumpV2 {
+			continue
+		}
+		var (
+			bits    int
+			addPath bool
+		)
+		switch subtype {
+		case mrtRIBIPv4Unicast:
+			bits = 8 * net.IPv4len
+		case mrtRIBIPv4UnicastAddPath:
+			bits, addPath = 8*net.IPv4len, true
+		case mrtRIBIPv6Unicast:
+			bits = 8 * net.IPv6len
+		case mrtRIBIPv6UnicastAddPath:
+			bits, addPath = 8*net.IPv6len, true
+		default:
+			continue
+		}
+		n, r, err := parseMRTRIBEntry(body, bits, addPath, paths)
+		if err != nil {
+			return err
+		}
+		if r != nil {
+			table.insert(n, r)
+		}
+	}
+}
+
+// parseMRTRIBEntry parses a RIB_IPV4_UNICAST or RIB_IPV6_UNICAST record,
+// returning the route of its first entry, or nil when it has no AS_PATH.
+// Routes are shared by all the prefixes with the same AS path.
+func parseMRTRIBEntry(body []byte, bits int, addPath bool, paths map[string]*asRoute) (*net.IPNet, *asRoute, error) {
+	// Sequence number (4), prefix length (1).
+	if len(body) < 5 {
+		return nil, nil, errShortMRT
+	}
+	ones := int(body[4])
+	if ones > bits {
+		return nil, nil, fmt.Errorf("invalid MRT prefix length %d", ones)
+	}
+	body = body[5:]
+	prefixLen := (ones + 7) / 8
+	if len(body) < prefixLen+2 {
+		return nil, nil, errShortMRT
+	}
+	ip := make(net.IP, bits/8)
+	copy(ip, body[:prefixLen])
+	n := &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}
+	count := binary.BigEndian.Uint16(body[prefixLen:])
+	body = body[prefixLen+2:]
+	if count == 0 {
+		return n, nil, nil
+	}
+	// Peer index (2), originated time (4), path identifier (4) for ADD-PATH.
+	skip := 6
+	if addPath {
+		skip += 4
+	}
+	if len(body) < skip+2 {
+		return nil, nil, errShortMRT
+	}
+	attrLen := int(binary.BigEndian.Uint16(body[skip:]))
+	body = body[skip+2:]
+	if len(body) < attrLen {
+		return nil, nil, errShortMRT
+	}
+	asPath, err := findASPathAttr(body[:attrLen])
+	if err != nil || asPath == nil {
+		return n, nil, err
+	}
+	if r, found := paths[string(asPath)]; found {
+		return n, r, nil
+	}
+	r, err := parseASPathAttr(asPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	paths[string(asPath)] = r
+	return n, r, nil
+}
+
+// findASPathAttr returns the value of the AS_PATH attribute, or nil when it's
+// missing.
+func findASPathAttr(attrs []byte) ([]byte, error) {
+	for len(attrs) > 0 {
+		if len(attrs) < 3 {
+			return nil, errShortMRT
+		}
+		flags, code := attrs[0], attrs[1]
+		length, hdr := int(attrs[2]), 3
+		if flags&bgpAttrFlagExtendedLength != 0 {
+			if len(attrs) < 4 {
+				return nil, errShortMRT
+			}
+			length, hdr = int(binary.BigEndian.Uint16(attrs[2:])), 4
+		}
+		if len(attrs) < hdr+length {
+			return nil, errShortMRT
+		}
+		if code == bgpAttrASPath {
+			return attrs[hdr : hdr+length], nil
+		}
+		attrs = attrs[hdr+length:]
+	}
+	return nil, nil
+}
+
+// parseASPathAttr parses an AS_PATH attribute. TABLE_DUMP_V2 always encodes
+// AS numbers in 4 bytes.
+func parseASPathAttr(value []byte) (*asRoute, error) {
+	r := &asRoute{}
+	for len(value) > 0 {
+		if len(value) < 2 {
+			return nil, errShortMRT
+		}
+		segType, count := value[0], int(value[1])
+		value = value[2:]
+		if len(value) < 4*count {
+			return nil, errShortMRT
+		}
+		for i := 0; i < count; i++ {
+			r.path = append(r.path, binary.BigEndian.Uint32(value[4*i:]))
+		}
+		value = value[4*count:]
+		r.origin = 0
+		if segType == bgpASSequence && count > 0 {
+			r.origin = r.path[len(r.path)-1]
+		}
+	}
+	return r, nil
+}
+
+// parseTextRIB loads a RIB in text format, one route per line. Lines are
+// either the output of `bgpdump -m`:
+//
+//	TABLE_DUMP2|1700000000|B|192.0.2.1|64496|198.51.100.0/24|64496 64511 {64512,64513}|IGP
+//
+// or a prefix followed by its AS path:
+//
+//	198.51.100.0/24 64496 64511
+//
+// Empty lines, comments starting with # and invalid lines are skipped.
+func parseTextRIB(rd io.Reader, table *ribTable) error {
+	paths := make(map[string]*asRoute)
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if pos := strings.IndexByte(line, '#'); pos != -1 {
+			line = line[:pos]
+		}
+		var prefix, path string
+		if fields := strings.Split(line, "|"); len(fields) >= 7 && strings.HasPrefix(fields[0], "TABLE_DUMP") {
+			prefix, path = fields[5], fields[6]
+		} else if fields := strings.Fields(line); len(fields) >= 2 {
+			prefix, path = fields[0], strings.Join(fields[1:], " ")
+		} else {
+			continue
+		}
+		_, n, err := net.ParseCIDR(strings.TrimSpace(prefix))
+		if err != nil {
+			continue
+		}
+		r, found := paths[path]
+		if !found {
+			if r = parseTextASPath(path); r == nil {
+				continue
+			}
+			paths[path] = r
+		}
+		table.insert(n, r)
+	}
+	return scanner.Err()
+}
+
+// parseTextASPath parses an AS path such as "64496 64511 {64512,64513}",
+// returning nil when it's invalid or empty.
+func parseTextASPath(s string) *asRoute {
+	r := &asRoute{}
+	for _, token := range strings.Fields(s) {
+		isSet := strings.HasPrefix(token, "{")
+		for _, member := range strings.Split(strings.Trim(token, "{}"), ",") {
+			if member == "" {
+				continue
+			}
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(member), "AS"), 10, 32)
+			if err != nil {
+				return nil
+			}
+			r.path = append(r.path, uint32(asn))
+		}
+		r.origin = 0
+		if !isSet && len(r.path) > 0 {
+			r.origin = r.path[len(r.path)-1]
+		}
+	}
+	if len(r.path) == 0 {
+		return nil
+	}
+	return r
+}
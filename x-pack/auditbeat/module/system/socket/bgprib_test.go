@@ -0,0 +1,201 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+const testTextRIB = `# prefix as_path
+10.0.0.0/8 64500 64501
+10.1.0.0/16 64500 64502 64510
+10.1.0.0/16 64999 64510
+2001:db8::/32 64500 {64520,64521}
+TABLE_DUMP2|1700000000|B|192.0.2.1|64496|198.51.100.0/24|64496 64511|IGP|192.0.2.1|0|0||NAG||
+bogus line
+192.0.2.0/24 not-an-asn
+`
+
+func TestParseTextRIB(t *testing.T) {
+	table, err := parseRIB(strings.NewReader(testTextRIB))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 4, table.size)
+	for _, tc := range []struct {
+		ip       string
+		expected *asRoute
+	}{
+		{"10.1.2.3", &asRoute{path: []uint32{64500, 64502, 64510}, origin: 64510}},
+		{"10.2.0.1", &asRoute{path: []uint32{64500, 64501}, origin: 64501}},
+		{"198.51.100.7", &asRoute{path: []uint32{64496, 64511}, origin: 64511}},
+		{"2001:db8::1", &asRoute{path: []uint32{64500, 64520, 64521}}},
+		{"192.0.2.1", nil},
+		{"2001:db9::1", nil},
+	} {
+		assert.Equal(t, tc.expected, table.lookup(net.ParseIP(tc.ip)), tc.ip)
+	}
+}
+
+// mrtRecord encodes an MRT record.
+func mrtRecord(typ, subtype uint16, body []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(1700000000))
+	binary.Write(&buf, binary.BigEndian, typ)
+	binary.Write(&buf, binary.BigEndian, subtype)
+	binary.Write(&buf, binary.BigEndian, uint32(len(body)))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// mrtRIBEntry encodes a RIB_IPV4_UNICAST body with a single entry that has
+// an ORIGIN and an AS_PATH attribute.
+func mrtRIBEntry(prefix []byte, ones uint8, path []uint32) []byte {
+	var asPath bytes.Buffer
+	asPath.Write([]byte{bgpASSequence, byte(len(path))})
+	for _, asn := range path {
+		binary.Write(&asPath, binary.BigEndian, asn)
+	}
+	var attrs bytes.Buffer
+	attrs.Write([]byte{0x40, 1, 1, 0})
+	attrs.Write([]byte{0x50, bgpAttrASPath})
+	binary.Write(&attrs, binary.BigEndian, uint16(asPath.Len()))
+	attrs.Write(asPath.Bytes())
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, uint32(0))
+	body.WriteByte(ones)
+	body.Write(prefix)
+	binary.Write(&body, binary.BigEndian, uint16(1))
+	binary.Write(&body, binary.BigEndian, uint16(0))
+	binary.Write(&body, binary.BigEndian, uint32(1700000000))
+	binary.Write(&body, binary.BigEndian, uint16(attrs.Len()))
+	body.Write(attrs.Bytes())
+	return body.Bytes()
+}
+
+func TestParseMRTRIB(t *testing.T) {
+	var dump bytes.Buffer
+	// PEER_INDEX_TABLE, skipped.
+	dump.Write(mrtRecord(mrtTableDumpV2, 1, []byte{1, 2, 3, 4, 0, 0, 0, 0}))
+	dump.Write(mrtRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, mrtRIBEntry([]byte{203, 0, 113}, 24, []uint32{64496, 4200000000})))
+	dump.Write(mrtRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, mrtRIBEntry([]byte{203}, 8, []uint32{64497})))
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(dump.Bytes())
+	gz.Close()
+
+	for name, data := range map[string][]byte{
+		"plain": dump.Bytes(),
+		"gzip":  compressed.Bytes(),
+	} {
+		table, err := parseRIB(bytes.NewReader(data))
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		assert.Equal(t, 2, table.size, name)
+		assert.Equal(t, &asRoute{path: []uint32{64496, 4200000000}, origin: 4200000000}, table.lookup(net.ParseIP("203.0.113.5")), name)
+		assert.Equal(t, &asRoute{path: []uint32{64497}, origin: 64497}, table.lookup(net.ParseIP("203.1.1.1")), name)
+		assert.Nil(t, table.lookup(net.ParseIP("198.51.100.1")), name)
+	}
+
+	_, err := parseRIB(bytes.NewReader(dump.Bytes()[:dump.Len()-3]))
+	assert.Error(t, err)
+}
+
+func TestBGPRIBReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rib.txt")
+	if !assert.NoError(t, os.WriteFile(path, []byte(testTextRIB), 0o644)) {
+		return
+	}
+	r, err := newBGPRIB(path, logp.NewLogger("test"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Now()
+	r.clock = func() time.Time { return now }
+	assert.Equal(t, uint32(64510), r.Lookup(net.ParseIP("10.1.2.3")).origin)
+	assert.Nil(t, r.Lookup(net.ParseIP("192.0.2.1")))
+
+	if !assert.NoError(t, os.WriteFile(path, []byte("192.0.2.0/24 64501 64502\n"), 0o644)) {
+		return
+	}
+	modTime := r.modTime.Add(time.Second)
+	if !assert.NoError(t, os.Chtimes(path, modTime, modTime)) {
+		return
+	}
+	r.reload()
+	assert.Equal(t, uint32(64502), r.Lookup(net.ParseIP("192.0.2.1")).origin)
+	assert.Nil(t, r.Lookup(net.ParseIP("10.1.2.3")))
+
+	// An unreadable dump keeps the previous routes.
+	if !assert.NoError(t, os.WriteFile(path, []byte{0x1f, 0x8b, 0}, 0o644)) {
+		return
+	}
+	r.reload()
+	assert.NotNil(t, r.Lookup(net.ParseIP("192.0.2.1")))
+
+	_, err = newBGPRIB(filepath.Join(t.TempDir(), "missing"), logp.NewLogger("test"))
+	assert.Error(t, err)
+}
+
+func TestBGPRIBFlowFields(t *testing.T) {
+	table, err := parseRIB(strings.NewReader(testTextRIB))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, tc := range []struct {
+		dst      string
+		path     []uint32
+		asNumber interface{}
+	}{
+		{"10.1.2.3", []uint32{64500, 64502, 64510}, uint32(64510)},
+		{"2001:db8::1", []uint32{64500, 64520, 64521}, nil},
+		{"192.0.2.1", nil, nil},
+	} {
+		t.Run(tc.dst, func(t *testing.T) {
+			dst := net.ParseIP(tc.dst)
+			f := &flow{
+				inetType: inetTypeIPv4,
+				proto:    protoTCP,
+				dir:      directionEgress,
+				local:    endpoint{addr: net.TCPAddr{IP: net.ParseIP("192.168.33.10"), Port: 38842}},
+				remote:   endpoint{addr: net.TCPAddr{IP: dst, Port: 443}},
+				dstAS:    table.lookup(dst),
+			}
+			ev, err := f.toEvent(true)
+			if !assert.NoError(t, err) {
+				return
+			}
+			path, err := ev.RootFields.GetValue("destination.as.path")
+			if tc.path == nil {
+				assert.Error(t, err)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.path, path)
+			}
+			number, err := ev.RootFields.GetValue("destination.as.number")
+			if tc.asNumber == nil {
+				assert.Error(t, err)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.asNumber, number)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapabilitiesFromMask(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		mask     string
+		expected []string
+		err      bool
+	}{
+		{"none", "0000000000000000", []string{}, false},
+		{"net", "0000000000003000", []string{"net_admin", "net_raw"}, false},
+		{"unknown bit", "0000080000000001", []string{"chown", "43"}, false},
+		{"invalid", "nothex", nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			caps, err := capabilitiesFromMask(tc.mask)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.expected, caps)
+			}
+		})
+	}
+}
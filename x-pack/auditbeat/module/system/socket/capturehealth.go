@@ -0,0 +1,176 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+const netDevPath = "/proc/net/dev"
+
+// captureHealthy is false while the kernel events have stopped despite the
+// host having network activity. Exposed through the monitoring endpoint as
+// system.socket.capture_healthy.
+var captureHealthy = monitoring.NewBool(monitoringRegistry, "capture_healthy")
+
+// captureEventCount counts the events received from the perf channel, except
+// for the clock synchronization events, which the dataset triggers itself and
+// keep arriving while the network probes are detached.
+var captureEventCount uint64
+
+func init() {
+	captureHealthy.Set(true)
+}
+
+// captureHealth detects when the capture silently stopped working: no kernel
+// event was received for the idle timeout while the network interfaces of the
+// host sent or received at least a minimum number of packets.
+type captureHealth struct {
+	log         helper.Logger
+	idleTimeout time.Duration
+	minPackets  uint64
+
+	healthy bool
+	// events seen at the last check, and the time and packet count of the
+	// last check where they changed.
+	events, packets uint64
+	since           time.Time
+	hasPackets      bool
+
+	// Decoupled for testing.
+	readPackets func() (uint64, error)
+}
+
+func newCaptureHealth(log helper.Logger, idleTimeout time.Duration, minPackets uint64) *captureHealth {
+	return &captureHealth{
+		log:         log,
+		idleTimeout: idleTimeout,
+		minPackets:  minPackets,
+		healthy:     true,
+		readPackets: func() (uint64, error) { return readNetDevPackets(netDevPath) },
+	}
+}
+
+// check updates the health with the number of events received so far and
+// returns it.
+func (h *captureHealth) check(now time.Time, events uint64) bool {
+	if h.since.IsZero() || events != h.events {
+		if !h.healthy {
+			h.log.Infof("Capture is healthy again: kernel events are being received.")
+		}
+		h.healthy = true
+		h.events, h.since = events, now
+		h.packets, h.hasPackets = h.samplePackets()
+		return h.healthy
+	}
+	idle := now.Sub(h.since)
+	if idle < h.idleTimeout {
+		return h.healthy
+	}
+	packets, ok := h.samplePackets()
+	if !ok {
+		// Without a packet count the host could be idle.
+		return h.healthy
+	}
+	if !h.hasPackets {
+		h.packets, h.hasPackets = packets, true
+		return h.healthy
+	}
+	// Counters are reset when interfaces go away.
+	active := packets >= h.packets && packets-h.packets >= h.minPackets
+	if active && h.healthy {
+		h.log.Warnf("Capture looks broken: no kernel events received for %v while the host "+
+			"transferred %d packets. Are the kprobes still installed?", idle.Round(time.Second), packets-h.packets)
+	}
+	if active {
+		h.healthy = false
+	} else {
+		// An idle host restarts the period.
+		h.packets, h.since = packets, now
+	}
+	return h.healthy
+}
+
+func (h *captureHealth) samplePackets() (uint64, bool) {
+	packets, err := h.readPackets()
+	if err != nil {
+		h.log.Debugf("Unable to read the packet counters of the host: %v", err)
+		return 0, false
+	}
+	return packets, true
+}
+
+// captureHealthLoop checks the capture periodically until done is closed.
+func (m *MetricSet) captureHealthLoop(h *captureHealth, done <-chan struct{}) {
+	defer captureHealthy.Set(true)
+	ticker := time.NewTicker(h.idleTimeout / 4)
+	defer ticker.Stop()
+	h.check(time.Now(), atomic.LoadUint64(&captureEventCount))
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			captureHealthy.Set(h.check(now, atomic.LoadUint64(&captureEventCount)))
+		}
+	}
+}
+
+// readNetDevPackets returns the total packets received and transmitted by the
+// network interfaces, except loopback, from /proc/net/dev.
+func readNetDevPackets(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseNetDevPackets(f)
+}
+
+// parseNetDevPackets parses the format of /proc/net/dev, two header lines
+// followed by an interface per line:
+//
+//	eth0: 1234 10 0 0 0 0 0 0 5678 20 0 0 0 0 0 0
+//
+// with the receive and transmit packets in the 2nd and 10th columns.
+func parseNetDevPackets(rd io.Reader) (total uint64, err error) {
+	scanner := bufio.NewScanner(rd)
+	for line := 0; scanner.Scan(); line++ {
+		if line < 2 {
+			continue
+		}
+		pos := strings.IndexByte(scanner.Text(), ':')
+		if pos == -1 {
+			return 0, fmt.Errorf("invalid line %d of %s", line+1, netDevPath)
+		}
+		if strings.TrimSpace(scanner.Text()[:pos]) == "lo" {
+			continue
+		}
+		fields := strings.Fields(scanner.Text()[pos+1:])
+		if len(fields) < 10 {
+			return 0, fmt.Errorf("invalid line %d of %s", line+1, netDevPath)
+		}
+		for _, idx := range []int{1, 9} {
+			n, err := strconv.ParseUint(fields[idx], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid line %d of %s: %w", line+1, netDevPath, err)
+			}
+			total += n
+		}
+	}
+	return total, scanner.Err()
+}
@@ -0,0 +1,68 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+const testNetDev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo: 9876543   54321    0    0    0     0          0         0  9876543   54321    0    0    0     0       0          0
+  eth0: 123456789  1000    0    0    0     0          0         0 98765432     500    0    0    0     0       0          0
+docker0:       0       7    0    0    0     0          0         0        0       3    0    0    0     0       0          0
+`
+
+func TestParseNetDevPackets(t *testing.T) {
+	packets, err := parseNetDevPackets(strings.NewReader(testNetDev))
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(1510), packets)
+	}
+	_, err = parseNetDevPackets(strings.NewReader(testNetDev + "  eth1: 1 2 3\n"))
+	assert.Error(t, err)
+}
+
+func TestCaptureHealth(t *testing.T) {
+	var (
+		packets uint64
+		readErr error
+	)
+	h := newCaptureHealth(logp.NewLogger("test"), time.Minute, 100)
+	h.readPackets = func() (uint64, error) { return packets, readErr }
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	assert.True(t, h.check(at(0), 10))
+	// Events keep arriving.
+	packets = 500
+	assert.True(t, h.check(at(2*time.Minute), 20))
+
+	// No events, but the host is idle.
+	packets = 550
+	assert.True(t, h.check(at(3*time.Minute), 20))
+	assert.True(t, h.check(at(4*time.Minute), 20))
+
+	// No events while the host is busy.
+	packets = 700
+	assert.True(t, h.check(at(4*time.Minute+30*time.Second), 20), "before the idle timeout")
+	assert.False(t, h.check(at(5*time.Minute), 20))
+
+	// Unknown packet counts keep the previous health.
+	readErr = errors.New("no /proc")
+	assert.False(t, h.check(at(6*time.Minute), 20))
+	readErr = nil
+
+	// Events are received again.
+	assert.True(t, h.check(at(7*time.Minute), 21))
+}
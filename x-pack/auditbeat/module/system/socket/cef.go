@@ -0,0 +1,151 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/version"
+	"github.com/elastic/beats/v7/metricbeat/mb"
+)
+
+// Fixed header fields of the CEF flows.
+const (
+	cefVendor      = "Elastic"
+	cefProduct     = "Auditbeat"
+	cefSignatureID = "network_flow"
+	cefName        = "Network flow"
+	cefSeverity    = "1"
+)
+
+// cefExtension maps a field of the flow event to a CEF extension key.
+type cefExtension struct {
+	key   string
+	field string
+	// label of a custom key.
+	label string
+}
+
+// Extensions in the order they're rendered. The addresses are rendered
+// separately, as IPv6 addresses use custom keys.
+var cefExtensions = []cefExtension{
+	{key: "externalId", field: "flow.id"},
+	{key: "start", field: "event.start"},
+	{key: "end", field: "event.end"},
+	{key: "spt", field: "source.port"},
+	{key: "dpt", field: "destination.port"},
+	{key: "proto", field: "network.transport"},
+	{key: "app", field: "network.protocol"},
+	// Bytes sent from source to destination, and the other way round.
+	{key: "in", field: "source.bytes"},
+	{key: "out", field: "destination.bytes"},
+	{key: "cn1", field: "source.packets", label: "sourcePackets"},
+	{key: "cn2", field: "destination.packets", label: "destinationPackets"},
+	{key: "spid", field: "process.pid"},
+	{key: "sproc", field: "process.name"},
+	{key: "suid", field: "user.id"},
+	{key: "suser", field: "user.name"},
+	{key: "cs1", field: "process.executable", label: "processExecutable"},
+	{key: "cs2", field: "process.entity_id", label: "processEntityId"},
+	{key: "cs3", field: "network.community_id", label: "communityId"},
+}
+
+// marshalCEF renders a flow event in ArcSight Common Event Format. Fields
+// missing from the event are omitted.
+func marshalCEF(event mb.Event) ([]byte, error) {
+	var b strings.Builder
+	for i, field := range []string{"CEF:0", cefVendor, cefProduct, version.GetDefaultVersion(), cefSignatureID, cefName, cefSeverity} {
+		if i > 0 {
+			b.WriteByte('|')
+			field = escapeCEFHeader(field)
+		}
+		b.WriteString(field)
+	}
+	b.WriteByte('|')
+
+	sep := ""
+	put := func(key, value string) {
+		b.WriteString(sep)
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(escapeCEFValue(value))
+		sep = " "
+	}
+	if dir := cefDirection(event); dir != "" {
+		put("deviceDirection", dir)
+	}
+	for _, end := range []struct {
+		field, v4, v6, label string
+	}{
+		{"source.ip", "src", "c6a2", "Source IPv6 Address"},
+		{"destination.ip", "dst", "c6a3", "Destination IPv6 Address"},
+	} {
+		value, err := event.RootFields.GetValue(end.field)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(fmt.Sprint(value))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid %s: %v", end.field, value)
+		}
+		if ip.To4() != nil {
+			put(end.v4, ip.String())
+			continue
+		}
+		put(end.v6, ip.String())
+		put(end.v6+"Label", end.label)
+	}
+	for _, ext := range cefExtensions {
+		value, err := event.RootFields.GetValue(ext.field)
+		if err != nil {
+			continue
+		}
+		switch v := value.(type) {
+		case time.Time:
+			// Milliseconds since the epoch.
+			put(ext.key, fmt.Sprint(v.UnixNano()/int64(time.Millisecond)))
+		default:
+			put(ext.key, fmt.Sprint(v))
+		}
+		if ext.label != "" {
+			put(ext.key+"Label", ext.label)
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+// cefDirection returns the CEF direction of the flow, 0 for inbound and 1
+// for outbound, or an empty string when it's unknown.
+func cefDirection(event mb.Event) string {
+	dir, _ := event.RootFields.GetValue("network.direction")
+	switch dir {
+	case directionIngress.String():
+		return "0"
+	case directionEgress.String():
+		return "1"
+	}
+	return ""
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r\n", `\n`, "\n", `\n`, "\r", `\r`)
+)
+
+// escapeCEFHeader escapes the backslashes and pipes of a header field.
+func escapeCEFHeader(s string) string {
+	return cefHeaderEscaper.Replace(s)
+}
+
+// escapeCEFValue escapes the backslashes, equal signs and line breaks of an
+// extension value. Pipes don't need escaping in extensions.
+func escapeCEFValue(s string) string {
+	return cefValueEscaper.Replace(s)
+}
@@ -0,0 +1,137 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/version"
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// parseCEF splits a CEF record into its unescaped header fields and
+// extensions.
+func parseCEF(t *testing.T, record string) (header []string, ext map[string]string) {
+	var field strings.Builder
+	i := 0
+	for ; i < len(record) && len(header) < 7; i++ {
+		switch c := record[i]; {
+		case c == '\\' && i+1 < len(record):
+			i++
+			field.WriteByte(record[i])
+		case c == '|':
+			header = append(header, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(c)
+		}
+	}
+	require.Len(t, header, 7, "incomplete header")
+
+	// Each unescaped equal sign ends the key that follows the last space.
+	ext = make(map[string]string)
+	rest := record[i:]
+	var key string
+	var value strings.Builder
+	for i = 0; i < len(rest); i++ {
+		switch c := rest[i]; {
+		case c == '\\' && i+1 < len(rest):
+			i++
+			switch rest[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			default:
+				value.WriteByte(rest[i])
+			}
+		case c == '=':
+			v := value.String()
+			next := v[strings.LastIndexByte(v, ' ')+1:]
+			if key != "" {
+				ext[key] = strings.TrimSuffix(v[:len(v)-len(next)], " ")
+			}
+			key = next
+			value.Reset()
+		default:
+			value.WriteByte(c)
+		}
+	}
+	if key != "" {
+		ext[key] = value.String()
+	}
+	return header, ext
+}
+
+func TestMarshalCEF(t *testing.T) {
+	start := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	ev := mb.Event{
+		RootFields: mapstr.M{
+			"source":      mapstr.M{"ip": "192.168.33.10", "port": 38842, "bytes": uint64(151), "packets": uint64(2)},
+			"destination": mapstr.M{"ip": "2001:db8::1", "port": 443, "bytes": uint64(4096), "packets": uint64(3)},
+			"network":     mapstr.M{"direction": "egress", "transport": "tcp", "community_id": "1:abc="},
+			"event":       mapstr.M{"start": start, "end": start.Add(1500 * time.Millisecond)},
+			"flow":        mapstr.M{"id": "EQIA"},
+			"process": mapstr.M{
+				"pid":        1234,
+				"name":       "curl|wget",
+				"executable": `C:\bin\a=b`,
+			},
+			"user": mapstr.M{"id": "1000"},
+		},
+	}
+	record, err := marshalCEF(ev)
+	require.NoError(t, err)
+	assert.NotContains(t, string(record), "\n")
+
+	header, ext := parseCEF(t, string(record))
+	assert.Equal(t, []string{"CEF:0", "Elastic", "Auditbeat", version.GetDefaultVersion(), "network_flow", "Network flow", "1"}, header)
+	assert.Equal(t, map[string]string{
+		"deviceDirection": "1",
+		"src":             "192.168.33.10",
+		"c6a3":            "2001:db8::1",
+		"c6a3Label":       "Destination IPv6 Address",
+		"externalId":      "EQIA",
+		"start":           "1677664800000",
+		"end":             "1677664801500",
+		"spt":             "38842",
+		"dpt":             "443",
+		"proto":           "tcp",
+		"in":              "151",
+		"out":             "4096",
+		"cn1":             "2",
+		"cn1Label":        "sourcePackets",
+		"cn2":             "3",
+		"cn2Label":        "destinationPackets",
+		"spid":            "1234",
+		"sproc":           "curl|wget",
+		"suid":            "1000",
+		"cs1":             `C:\bin\a=b`,
+		"cs1Label":        "processExecutable",
+		"cs3":             "1:abc=",
+		"cs3Label":        "communityId",
+	}, ext)
+}
+
+func TestCEFEscaping(t *testing.T) {
+	assert.Equal(t, `a\|b\\c=d`, escapeCEFHeader(`a|b\c=d`))
+	assert.Equal(t, `a|b\\c\=d\ne`, escapeCEFValue("a|b\\c=d\ne"))
+
+	for _, value := range []string{`\`, `=`, `|`, "a=b c=d", `\=`, "line\nbreak", `trailing\`} {
+		ev := mb.Event{RootFields: mapstr.M{"process": mapstr.M{"name": value}}}
+		record, err := marshalCEF(ev)
+		require.NoError(t, err)
+		_, ext := parseCEF(t, string(record))
+		assert.Equal(t, map[string]string{"sproc": value}, ext, value)
+	}
+}
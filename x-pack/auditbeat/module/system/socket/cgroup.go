@@ -0,0 +1,107 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// cgroupFilter selects flows by the cgroup of their process.
+type cgroupFilter struct {
+	prefix        string
+	reportUnknown bool
+	// read returns the cgroup path of a process. Decoupled for testing.
+	read func(pid uint32) (string, error)
+}
+
+// readProcessCGroup returns the cgroup path of the given process.
+func readProcessCGroup(pid uint32) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return parseCGroup(f)
+}
+
+// parseCGroup parses the contents of /proc/<pid>/cgroup and returns the path
+// in the unified (cgroup v2) hierarchy. In cgroup v1 hosts, the path in the
+// systemd hierarchy is used, or the first hierarchy if there is none.
+func parseCGroup(r io.Reader) (path string, err error) {
+	var first, systemd string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Format is hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		switch {
+		case fields[0] == "0" && fields[1] == "":
+			return fields[2], nil
+		case fields[1] == "name=systemd":
+			systemd = fields[2]
+		case first == "":
+			first = fields[2]
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	if systemd != "" {
+		return systemd, nil
+	}
+	if first != "" {
+		return first, nil
+	}
+	return "", errors.New("no cgroup found")
+}
+
+// cgroupHasPrefix returns if the cgroup path is the prefix path or one of its
+// descendants.
+func cgroupHasPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// resolve stores the cgroup of the process, if not already done. It's called
+// when processes are created, outside the state lock, so that reporting their
+// flows doesn't need to read it. Processes created by fork inherit the cgroup
+// of their parent.
+func (c *cgroupFilter) resolve(p *process) {
+	p.Lock()
+	defer p.Unlock()
+	if p.cgroupResolved {
+		return
+	}
+	p.cgroupResolved = true
+	if cgroup, err := c.read(p.pid); err == nil {
+		p.cgroup = cgroup
+	}
+}
+
+// matches returns if a flow for the given process must be reported.
+func (c *cgroupFilter) matches(p *process) bool {
+	if p == nil {
+		return c.reportUnknown
+	}
+	c.resolve(p)
+	p.RLock()
+	defer p.RUnlock()
+	if p.cgroup == "" {
+		return c.reportUnknown
+	}
+	return cgroupHasPrefix(p.cgroup, c.prefix)
+}
@@ -0,0 +1,139 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseCGroup(t *testing.T) {
+	for _, tc := range []struct {
+		name, content, expected string
+	}{
+		{
+			name:     "unified",
+			content:  "0::/system.slice/docker-1234.scope\n",
+			expected: "/system.slice/docker-1234.scope",
+		},
+		{
+			name: "hybrid",
+			content: "12:pids:/user.slice\n" +
+				"1:name=systemd:/user.slice/session-1.scope\n" +
+				"0::/user.slice/session-1.scope\n",
+			expected: "/user.slice/session-1.scope",
+		},
+		{
+			name: "legacy",
+			content: "12:pids:/kubepods/pod1/abcd\n" +
+				"1:name=systemd:/kubepods/pod1/abcd\n",
+			expected: "/kubepods/pod1/abcd",
+		},
+		{
+			name:     "legacy without systemd",
+			content:  "4:memory:/lxc/web\n3:cpu,cpuacct:/lxc/web\n",
+			expected: "/lxc/web",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path, err := parseCGroup(strings.NewReader(tc.content))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, path)
+		})
+	}
+	_, err := parseCGroup(strings.NewReader(""))
+	assert.Error(t, err)
+}
+
+func TestCGroupHasPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		path, prefix string
+		expected     bool
+	}{
+		{"/system.slice/docker-1234.scope", "/system.slice", true},
+		{"/system.slice", "/system.slice/", true},
+		{"/system.slice/docker-1234.scope", "/system.slice/docker-1234.scope", true},
+		{"/system.slice/docker-12345.scope", "/system.slice/docker-1234", false},
+		{"/user.slice", "/system.slice", false},
+		{"/user.slice", "/", true},
+	} {
+		assert.Equal(t, tc.expected, cgroupHasPrefix(tc.path, tc.prefix), "path=%s prefix=%s", tc.path, tc.prefix)
+	}
+}
+
+func TestCGroupFilter(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	for _, tc := range []struct {
+		name          string
+		cgroup        string
+		reportUnknown bool
+		reported      bool
+	}{
+		{"matching", "/system.slice/web.service", false, true},
+		{"not matching", "/user.slice/session-1.scope", true, false},
+		{"unknown reported", "", true, true},
+		{"unknown ignored", "", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withCGroupFilter("/system.slice", tc.reportUnknown)(&st.state)
+			reads := 0
+			st.cgroups.read = func(pid uint32) (string, error) {
+				reads++
+				if tc.cgroup == "" {
+					return "", errors.New("no such process")
+				}
+				return tc.cgroup, nil
+			}
+			st.feedEvents([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl"}),
+				&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+			})
+			// The cgroup is read when the process is created.
+			assert.Equal(t, 1, reads)
+			st.feedEvents([]event{
+				&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+				&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock},
+				&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, LAddr: lAddr, LPort: lPort, RAddr: rAddr, RPort: rPort},
+				&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+				&tcpSendMsgCall4{
+					Meta:  meta(1234, 1235, 10),
+					Sock:  sock,
+					Size:  10,
+					LAddr: lAddr,
+					LPort: lPort,
+					RAddr: rAddr,
+					RPort: rPort,
+					Af:    unix.AF_INET,
+				},
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if tc.reported {
+				assert.Len(t, flows, 1)
+			} else {
+				assert.Empty(t, flows)
+			}
+			// The cgroup is read once per process.
+			assert.Equal(t, 1, reads)
+		})
+	}
+}
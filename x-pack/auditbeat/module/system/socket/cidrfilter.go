@@ -0,0 +1,115 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package socket
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Maximum number of excluded addresses that are filtered in the kernel, for
+// the same reason as maxKernelExcludedPorts.
+const maxKernelExcludedAddrs = 8
+
+// CIDRFilterConfig is the configuration of a filter of flows by address.
+type CIDRFilterConfig struct {
+	// Include restricts the flows reported to those whose address is in one
+	// of the given networks.
+	Include []string `config:"include"`
+
+	// Exclude drops the flows whose address is in one of the given
+	// networks. It takes precedence over Include.
+	Exclude []string `config:"exclude"`
+}
+
+// cidrFilter selects flows by their remote address.
+type cidrFilter struct {
+	include, exclude []*net.IPNet
+}
+
+// parseCIDRs parses a list of networks ("10.0.0.0/8") or single addresses,
+// which are taken as a network of their own.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network '%s'", s)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// newCIDRFilter returns a filter for the given configuration, or nil if both
+// lists are empty.
+func newCIDRFilter(c CIDRFilterConfig) (*cidrFilter, error) {
+	if len(c.Include) == 0 && len(c.Exclude) == 0 {
+		return nil, nil
+	}
+	var (
+		f   cidrFilter
+		err error
+	)
+	if f.include, err = parseCIDRs(c.Include); err != nil {
+		return nil, fmt.Errorf("invalid socket.remote_cidr_filter.include: %w", err)
+	}
+	if f.exclude, err = parseCIDRs(c.Exclude); err != nil {
+		return nil, fmt.Errorf("invalid socket.remote_cidr_filter.exclude: %w", err)
+	}
+	return &f, nil
+}
+
+// matches returns if a flow with the given remote address must be reported.
+// An unknown address (nil) doesn't belong to any network.
+func (f *cidrFilter) matches(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.include) > 0 && !anyNetContains(f.include, ip) {
+		return false
+	}
+	return !anyNetContains(f.exclude, ip)
+}
+
+func anyNetContains(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// kernelExcludedAddrs returns the excluded addresses that can be filtered in
+// the kernel. IPv4 addresses are fetched as a single integer in network byte
+// order, so a network isn't a range of values and only single IPv4
+// addresses are returned. IPv6 addresses are fetched in two halves and aren't
+// filtered.
+func (f *cidrFilter) kernelExcludedAddrs() (addrs []net.IP) {
+	if f == nil {
+		return nil
+	}
+	for _, n := range f.exclude {
+		ones, bits := n.Mask.Size()
+		if ip4 := n.IP.To4(); ip4 != nil && ones == bits && bits == 8*net.IPv4len && len(addrs) < maxKernelExcludedAddrs {
+			addrs = append(addrs, ip4)
+		}
+	}
+	return addrs
+}
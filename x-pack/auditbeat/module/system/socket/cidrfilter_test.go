@@ -0,0 +1,56 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package socket
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCIDRFilter(t *testing.T) {
+	f, err := newCIDRFilter(CIDRFilterConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+	assert.True(t, f.matches(net.ParseIP("10.0.0.1")))
+	assert.Empty(t, f.kernelExcludedAddrs())
+
+	_, err = newCIDRFilter(CIDRFilterConfig{Include: []string{"10.0.0.0/8", "x"}})
+	assert.Error(t, err)
+
+	f, err = newCIDRFilter(CIDRFilterConfig{
+		Include: []string{"10.0.0.0/8", "2001:db8::/32"},
+		Exclude: []string{"10.1.0.0/16", " 10.2.3.4 ", "2001:db8::1"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, tc := range []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"2001:db8::2", true},
+		{"192.168.1.1", false},
+		{"10.1.2.3", false},
+		{"10.2.3.4", false},
+		{"10.2.3.5", true},
+		{"2001:db8::1", false},
+		{"", false},
+	} {
+		assert.Equal(t, tc.expected, f.matches(net.ParseIP(tc.ip)), tc.ip)
+	}
+	// Networks and IPv6 addresses can't be filtered in the kernel.
+	assert.Equal(t, []net.IP{net.ParseIP("10.2.3.4").To4()}, f.kernelExcludedAddrs())
+
+	f, err = newCIDRFilter(CIDRFilterConfig{Exclude: []string{"192.168.0.0/16"}})
+	if assert.NoError(t, err) {
+		assert.True(t, f.matches(net.ParseIP("10.0.0.1")))
+		assert.True(t, f.matches(nil))
+		assert.False(t, f.matches(net.ParseIP("192.168.33.10")))
+	}
+}
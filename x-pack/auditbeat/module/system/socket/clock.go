@@ -0,0 +1,35 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// bootTime estimates the time the system booted from CLOCK_MONOTONIC, the
+// clock used to timestamp tracing events. It's used as a fixed kernel epoch
+// when clock synchronization is disabled. Like the tracing timestamps, this
+// clock doesn't advance while the system is suspended.
+func bootTime(now time.Time) (time.Time, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return time.Time{}, fmt.Errorf("clock_gettime(CLOCK_MONOTONIC) failed: %w", err)
+	}
+	return now.Add(-time.Duration(ts.Nano())), nil
+}
+
+// withKernelEpoch sets a fixed time for the kernel's clock origin, used when
+// the clock is not synchronized with clock-sync events. A zero epoch is set
+// from the first event received.
+func withKernelEpoch(epoch time.Time) stateOption {
+	return func(s *state) {
+		s.kernelEpoch = epoch
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBootTime(t *testing.T) {
+	now := time.Now()
+	boot, err := bootTime(now)
+	if assert.NoError(t, err) {
+		assert.True(t, boot.Before(now))
+	}
+}
+
+func TestKernelEpoch(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	epoch := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	withKernelEpoch(epoch)(&st.state)
+	assert.Equal(t, epoch.Add(time.Minute), st.kernTimestampToTime(kernelTime(time.Minute)))
+}
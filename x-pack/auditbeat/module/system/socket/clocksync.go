@@ -0,0 +1,146 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// clockSyncPeriodMs is the period between clock synchronizations currently
+// in effect, in milliseconds. Exposed through the monitoring endpoint as
+// system.socket.clock_sync_period_ms.
+var clockSyncPeriodMs = monitoring.NewInt(monitoringRegistry, "clock_sync_period_ms")
+
+const (
+	// The period is halved when the drift accumulated during a period
+	// reaches this fraction of the max drift.
+	clockSyncTightenRatio = 2
+	// The period is doubled when the drift accumulated during a period has
+	// been below this fraction of the max drift for clockSyncStableSyncs
+	// consecutive synchronizations.
+	clockSyncLoosenRatio = 10
+	clockSyncStableSyncs = 5
+)
+
+// adaptiveClockSync adjusts the clock synchronization period to the drift
+// observed between the kernel clock and the reference time. A drift that
+// grows by half of the max drift between two synchronizations could exceed
+// it before the next one, so the period is tightened. On hosts where the
+// drift is consistently small, the period is loosened to make fewer uname()
+// calls.
+type adaptiveClockSync struct {
+	sync.Mutex
+	log                  helper.Logger
+	maxDrift             time.Duration
+	minPeriod, maxPeriod time.Duration
+
+	period    time.Duration
+	lastDrift time.Duration
+	primed    bool
+	stable    int
+}
+
+func newAdaptiveClockSync(log helper.Logger, maxDrift, period, minPeriod, maxPeriod time.Duration) *adaptiveClockSync {
+	return &adaptiveClockSync{
+		log:       log,
+		maxDrift:  maxDrift,
+		minPeriod: minPeriod,
+		maxPeriod: maxPeriod,
+		period:    period,
+	}
+}
+
+// withClockSyncObserver sets a function called with the drift measured by
+// every clock synchronization and whether the reference time was adjusted.
+func withClockSyncObserver(observe func(drift time.Duration, adjusted bool)) stateOption {
+	return func(s *state) {
+		s.onClockSync = observe
+	}
+}
+
+// Period returns the current synchronization period.
+func (a *adaptiveClockSync) Period() time.Duration {
+	a.Lock()
+	defer a.Unlock()
+	return a.period
+}
+
+// Observe updates the period with the drift measured by a synchronization.
+// The drift is relative to the reference time, which is reset when adjusted.
+func (a *adaptiveClockSync) Observe(drift time.Duration, adjusted bool) {
+	a.Lock()
+	defer a.Unlock()
+	delta := drift - a.lastDrift
+	if delta < 0 {
+		delta = -delta
+	}
+	a.lastDrift = drift
+	if adjusted {
+		a.lastDrift = 0
+	}
+	if !a.primed {
+		// The reference time can be taken from the first event instead
+		// of a synchronization, so the first drift is not per period.
+		a.primed = true
+		return
+	}
+	switch {
+	case delta >= a.maxDrift/clockSyncTightenRatio:
+		a.stable = 0
+		if a.period > a.minPeriod {
+			a.setPeriod(a.period/2, delta)
+		}
+	case delta < a.maxDrift/clockSyncLoosenRatio:
+		if a.stable++; a.stable >= clockSyncStableSyncs {
+			a.stable = 0
+			if a.period < a.maxPeriod {
+				a.setPeriod(a.period*2, delta)
+			}
+		}
+	default:
+		a.stable = 0
+	}
+}
+
+func (a *adaptiveClockSync) setPeriod(period, delta time.Duration) {
+	if period < a.minPeriod {
+		period = a.minPeriod
+	}
+	if period > a.maxPeriod {
+		period = a.maxPeriod
+	}
+	a.log.Debugf("clock sync period changed from %v to %v (drift=%v in a period, max=%v)",
+		a.period, period, delta, a.maxDrift)
+	a.period = period
+}
+
+// clockSyncLoop triggers clock synchronizations until done is closed. The
+// interval is taken from adaptive after every synchronization when not nil.
+func (m *MetricSet) clockSyncLoop(interval time.Duration, adaptive *adaptiveClockSync, done <-chan struct{}) {
+	defer clockSyncPeriodMs.Set(0)
+	clockSyncPeriodMs.Set(interval.Milliseconds())
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	triggerClockSync()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			triggerClockSync()
+			if adaptive != nil {
+				interval = adaptive.Period()
+				clockSyncPeriodMs.Set(interval.Milliseconds())
+			}
+			timer.Reset(interval)
+		}
+	}
+}
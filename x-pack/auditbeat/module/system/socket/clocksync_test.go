@@ -0,0 +1,89 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+func TestAdaptiveClockSync(t *testing.T) {
+	a := newAdaptiveClockSync(logp.NewLogger("test"), 100*time.Millisecond, 10*time.Second, 2*time.Second, 40*time.Second)
+	assert.Equal(t, 10*time.Second, a.Period())
+
+	// The first drift is ignored.
+	a.Observe(90*time.Millisecond, false)
+	assert.Equal(t, 10*time.Second, a.Period())
+
+	// Large drifts between synchronizations tighten the period down to
+	// the minimum.
+	a.Observe(-60*time.Millisecond, false)
+	assert.Equal(t, 5*time.Second, a.Period())
+	a.Observe(-120*time.Millisecond, true)
+	assert.Equal(t, 2500*time.Millisecond, a.Period())
+	a.Observe(50*time.Millisecond, false)
+	assert.Equal(t, 2*time.Second, a.Period())
+	a.Observe(110*time.Millisecond, true)
+	assert.Equal(t, 2*time.Second, a.Period())
+
+	// Small drifts loosen it after enough synchronizations.
+	drift := time.Duration(0)
+	for i := 0; i < clockSyncStableSyncs-1; i++ {
+		drift += time.Millisecond
+		a.Observe(drift, false)
+	}
+	assert.Equal(t, 2*time.Second, a.Period())
+	drift += time.Millisecond
+	a.Observe(drift, false)
+	assert.Equal(t, 4*time.Second, a.Period())
+
+	// Medium drifts restart the count.
+	for i := 0; i < clockSyncStableSyncs-1; i++ {
+		drift += time.Millisecond
+		a.Observe(drift, false)
+	}
+	drift += 20 * time.Millisecond
+	a.Observe(drift, false)
+	drift += time.Millisecond
+	a.Observe(drift, false)
+	assert.Equal(t, 4*time.Second, a.Period())
+
+	// Up to the maximum.
+	for i := 0; i < 4*clockSyncStableSyncs; i++ {
+		drift += time.Millisecond
+		a.Observe(drift, false)
+	}
+	assert.Equal(t, 40*time.Second, a.Period())
+}
+
+func TestClockSyncObserver(t *testing.T) {
+	type observation struct {
+		drift    time.Duration
+		adjusted bool
+	}
+	var syncs []observation
+	st := makeTestingState(t, time.Second, time.Second, 0, 100*time.Millisecond)
+	withClockSyncObserver(func(drift time.Duration, adjusted bool) {
+		syncs = append(syncs, observation{drift, adjusted})
+	})(&st.state)
+
+	user := uint64(time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC).UnixNano())
+	kernel := uint64(time.Hour)
+	for _, step := range []time.Duration{0, 10 * time.Millisecond, 200 * time.Millisecond} {
+		user += uint64(10*time.Second - step)
+		kernel += uint64(10 * time.Second)
+		assert.NoError(t, st.SyncClocks(kernel, user))
+	}
+	assert.Equal(t, []observation{
+		{10 * time.Millisecond, false},
+		{210 * time.Millisecond, true},
+	}, syncs)
+}
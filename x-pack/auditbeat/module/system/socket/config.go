@@ -5,8 +5,18 @@
 package socket
 
 import (
+	"fmt"
+	"math/bits"
+	"os"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/joeshaw/multierror"
+
+	"github.com/elastic/beats/v7/libbeat/common/cfgtype"
 )
 
 // Config defines this metricset's configuration options.
@@ -17,19 +27,28 @@ type Config struct {
 	//		- /sys/kernel/debug/tracing (debugfs, 2.6+)
 	TraceFSPath *string `config:"socket.tracefs_path"`
 
+	// TraceFSInstanceName is the name of a tracing instance, created under
+	// instances/ in tracefs, through which the events of the probes are
+	// accessed. It's removed at exit. If unset (default), or when instances
+	// aren't supported, the global instance is used.
+	TraceFSInstanceName string `config:"socket.tracefs_instance_name"`
+
 	// PerfQueueSize defines how many tracing events can be queued.
 	PerfQueueSize int `config:"socket.perf_queue_size,min=1"`
 
 	// LostQueueSize specifies how many lost-event notifications can be queued.
 	LostQueueSize int `config:"socket.lost_queue_size,min=1"`
 
-	// ErrQueueSize defines the size of the error queue. A single error is fatal.
+	// ErrQueueSize defines the size of the error queue. An error causes the
+	// perf channel to be reopened, up to PerfReopenRetries times in a row.
 	ErrQueueSize int `config:"socket.err_queue_size,min=1"`
 
 	// RingSizeExp configures the exponent size for the per-cpu ring buffer used
 	// by the kernel to pass tracing events.
 	// The actual size is 2**exponent memory pages, per CPU.
-	RingSizeExp int `config:"socket.ring_size_exponent,min=1"`
+	// It can't be set together with RingBufferBytes. If none is set, the
+	// exponent is defaultRingSizeExp.
+	RingSizeExp *int `config:"socket.ring_size_exponent"`
 
 	// FlowInactiveTimeout determines how long a flow has to be inactive to be
 	// considered closed.
@@ -55,21 +74,669 @@ type Config struct {
 	// generated to measure the drift between the kernel clock and our reference
 	ClockSyncPeriod time.Duration `config:"socket.clock_sync_period,positive"`
 
+	// AdaptiveClockSync enables adjusting the clock synchronization period
+	// to the measured drift, starting from ClockSyncPeriod. It's tightened
+	// when the drift approaches ClockMaxDrift between synchronizations and
+	// loosened when it stays small.
+	AdaptiveClockSync bool `config:"socket.adaptive_clock_sync"`
+
+	// ClockSyncMinPeriod and ClockSyncMaxPeriod bound the clock
+	// synchronization period when AdaptiveClockSync is enabled.
+	ClockSyncMinPeriod time.Duration `config:"socket.clock_sync_min_period"`
+	ClockSyncMaxPeriod time.Duration `config:"socket.clock_sync_max_period"`
+
+	// SymbolMapPath is the path to a list of kernel functions that replaces
+	// the functions available for tracing read from tracefs, for hosts where
+	// it's restricted or doesn't describe the running kernel.
+	SymbolMapPath string `config:"socket.symbol_map_path"`
+
+	// GuessArtifactPath is the path to the guess results exported on a host
+	// with the same kernel by "export socket-guesses". When compatible, the
+	// guesses aren't run at startup.
+	GuessArtifactPath string `config:"socket.guess_artifact_path"`
+
 	// GuessTimeout is the maximum time an individual guess is allowed to run.
 	GuessTimeout time.Duration `config:"socket.guess_timeout,positive"`
 
+	// MaxKProbes limits the number of kprobes installed. The optional ones
+	// are skipped, lowest priority first, to stay within the limit. Zero
+	// means no limit.
+	MaxKProbes int `config:"socket.max_kprobes"`
+
+	// ProbeInstallRetries is how many times the installation of a kprobe is
+	// retried after a transient error, such as EBUSY when the kprobe_events
+	// file is in use.
+	ProbeInstallRetries int `config:"socket.probe_install_retries"`
+
+	// ProbeInstallBackoff is the time to wait before the first retry of a
+	// kprobe installation. It's doubled for every subsequent retry.
+	ProbeInstallBackoff time.Duration `config:"socket.probe_install_backoff"`
+
+	// PerfReopenRetries is how many times in a row the perf channel is
+	// reopened after an error before the dataset terminates. The count is
+	// reset once the reopened channel delivers events.
+	PerfReopenRetries int `config:"socket.perf_reopen_retries"`
+
+	// PerfReopenBackoff is the time to wait before the first attempt to
+	// reopen the perf channel. It's doubled for every subsequent attempt.
+	PerfReopenBackoff time.Duration `config:"socket.perf_reopen_backoff"`
+
+	// CaptureIdleTimeout is how long no kernel events can be received while
+	// the host has network activity before the capture is reported as
+	// unhealthy. Zero disables the check.
+	CaptureIdleTimeout time.Duration `config:"socket.capture_idle_timeout"`
+
+	// CaptureIdleMinPackets is the number of packets the host must send or
+	// receive during CaptureIdleTimeout for the lack of events to be
+	// considered a failure.
+	CaptureIdleMinPackets uint64 `config:"socket.capture_idle_min_packets"`
+
 	// DevelopmentMode is an undocumented flag to ignore SSH traffic so that the
 	// dataset can be run with debug output without creating a feedback loop.
 	DevelopmentMode bool `config:"socket.development_mode"`
 
+	// DebugEventFile is an undocumented, development-only option to write the
+	// flow events as NDJSON to a local file, in addition to publishing them.
+	// The file name is the given path with the date and an .ndjson extension
+	// appended, and it's rotated when it grows too large.
+	DebugEventFile string `config:"socket.debug_event_file"`
+
+	// DetailedSampleRate is the fraction of the events that are logged when
+	// the socketdetailed debug selector is enabled. Events are sampled by
+	// socket, so that all the events of a sampled flow are logged.
+	DetailedSampleRate float64 `config:"socket.detailed_sample_rate"`
+
 	// EnableIPv6 allows to control IPv6 support. When unset (default) IPv6
 	// will be automatically detected on runtime.
 	EnableIPv6 *bool `config:"socket.enable_ipv6"`
+
+	// IPv6Only skips the probes for IPv4 sockets on hosts without IPv4
+	// connectivity. It requires IPv6 support.
+	IPv6Only bool `config:"socket.ipv6_only"`
+
+	// PortServiceOverrides maps destination ports to custom service names,
+	// taking precedence over the system's services database. Useful for
+	// internal services running on non-standard ports.
+	PortServiceOverrides map[string]string `config:"socket.port_service_overrides"`
+
+	// SpecialDestinations maps names to lists of CIDRs whose addresses are
+	// reported in network.destination.special when they're the destination
+	// of a flow, in addition to the built-in link_local, metadata and
+	// multicast ranges.
+	SpecialDestinations map[string][]string `config:"socket.special_destinations"`
+
+	// MulticastGroupNames enables reporting the name of well-known multicast
+	// groups, such as mDNS for 224.0.0.251, for flows sent to them.
+	MulticastGroupNames bool `config:"socket.multicast_group_names"`
+
+	// NetworkZones maps zone names to lists of CIDRs. The zones of the source
+	// and destination of flows are reported, and flows between different
+	// zones are flagged.
+	NetworkZones map[string][]string `config:"socket.network_zones"`
+
+	// FlowProcessAttribution determines which process is reported for a flow
+	// whose socket is shared between processes. One of:
+	//		- active: the process that performed the most recent I/O.
+	//		- first_seen: the process that was first seen using the flow (default).
+	FlowProcessAttribution string `config:"socket.flow_process_attribution"`
+
+	// FlowKey determines how flows are identified. One of:
+	//		- socket: each socket has its own flows (default).
+	//		- connection: the flows of different sockets with the same
+	//		  network namespace, transport and addresses are coalesced.
+	FlowKey string `config:"socket.flow_key"`
+
+	// FlowTupleHash enables reporting flow.tuple_hash, a hash of the network
+	// namespace, transport and addresses of flows, the same for both ends.
+	FlowTupleHash bool `config:"socket.flow_tuple_hash"`
+
+	// FlowTupleHashKey makes flow.tuple_hash an HMAC-SHA256 with this key.
+	// Empty (default) for a plain SHA-256.
+	FlowTupleHashKey string `config:"socket.flow_tuple_hash_key"`
+
+	// HashOnlyMode removes the addresses from all events, leaving
+	// flow.tuple_hash to join flows. Requires FlowTupleHash.
+	HashOnlyMode bool `config:"socket.hash_only_mode"`
+
+	// IncludeInterfaceName enables reporting the name of the network interface
+	// used to reach the remote address of a flow.
+	IncludeInterfaceName bool `config:"socket.include_interface_name"`
+
+	// CGroupFilter restricts the flows reported to those of processes in
+	// the given cgroup path or its descendants.
+	CGroupFilter string `config:"socket.cgroup_filter"`
+
+	// ReportUnknownCGroup determines if flows are reported when CGroupFilter
+	// is set and the cgroup of the process can't be determined.
+	ReportUnknownCGroup bool `config:"socket.report_unknown_cgroup"`
+
+	// EnableSCTP enables monitoring of SCTP associations.
+	EnableSCTP bool `config:"socket.enable_sctp"`
+
+	// IncludePorts restricts the flows reported to those whose local or
+	// remote port is in one of the given ports or ranges ("8000-9000").
+	IncludePorts []string `config:"socket.include_ports"`
+
+	// ExcludePorts drops the flows whose local or remote port is in one of
+	// the given ports or ranges.
+	ExcludePorts []string `config:"socket.exclude_ports"`
+
+	// RemoteCIDRFilter restricts the flows reported by their remote address.
+	RemoteCIDRFilter CIDRFilterConfig `config:"socket.remote_cidr_filter"`
+
+	// CoalesceDNSQueries merges the answers of concurrent A and AAAA queries
+	// for the same name, so that flows are enriched with the name regardless
+	// of which query the process' socket was used for.
+	CoalesceDNSQueries bool `config:"socket.coalesce_dns_queries"`
+
+	// EmitDNSEvents enables reporting every captured DNS transaction as its
+	// own event, with the process that sent the query when it's known.
+	EmitDNSEvents bool `config:"socket.emit_dns_events"`
+
+	// EmitProcessEvents enables reporting an event when a process is created
+	// by execve and when it exits. The processes found at startup are only
+	// reported when they exit.
+	EmitProcessEvents bool `config:"socket.emit_process_events"`
+
+	// MaxDNSAnswers limits the number of answers in DNS events. The answers
+	// for the addresses the querying process connected to are kept first.
+	// Zero disables the limit.
+	MaxDNSAnswers int `config:"socket.max_dns_answers"`
+
+	// ProcessCredFields are the process credential fields captured, among
+	// uid, euid, gid and egid. Reading them from /proc when bootstrapping
+	// the process table is skipped when it's empty.
+	ProcessCredFields []string `config:"socket.process_cred_fields"`
+
+	// TopProcessesCount is the number of processes with the most open flows
+	// reported in the periodic state log and the monitoring endpoint. Zero
+	// disables it.
+	TopProcessesCount int `config:"socket.top_processes_count"`
+
+	// DedupLocalFlows merges the flows for both ends of a connection between
+	// local processes into a single event.
+	DedupLocalFlows bool `config:"socket.dedup_local_flows"`
+
+	// LocalFlowHoldTime is how long the flow for one end of a connection
+	// between local processes is held waiting for the flow for the other end.
+	LocalFlowHoldTime time.Duration `config:"socket.dedup_local_flows_hold_time"`
+
+	// IncludeProcessCapabilities enables reporting the effective capabilities
+	// of the process of a flow.
+	IncludeProcessCapabilities bool `config:"socket.include_process_capabilities"`
+
+	// IncludeProcessWorkingDirectory enables reporting the working directory
+	// of processes, read from /proc when they're created.
+	IncludeProcessWorkingDirectory bool `config:"socket.include_process_working_directory"`
+
+	// EnableClockSync enables the periodic uname() calls used to synchronize
+	// the kernel clock with the reference time. When disabled, timestamps are
+	// derived from a boot time estimated once at startup.
+	EnableClockSync bool `config:"socket.enable_clock_sync"`
+
+	// TrackZeroWindow enables counting the zero-window probes sent for each
+	// TCP flow. It installs an additional kprobe in the TCP send path.
+	TrackZeroWindow bool `config:"socket.track_zero_window"`
+
+	// ZeroWindowThreshold is how long a flow has to be in zero-window for a
+	// dedicated event to be sent. Zero (default) disables these events.
+	ZeroWindowThreshold time.Duration `config:"socket.zero_window_threshold"`
+
+	// TrackUrgentData enables flagging the TCP flows that receive urgent
+	// (out-of-band) data. It installs an additional kprobe in the TCP
+	// receive path.
+	TrackUrgentData bool `config:"socket.track_urgent_data"`
+
+	// ReportCloseInitiator enables reporting which side initiated the close
+	// of TCP flows. It installs additional kprobes on the FIN and reset paths.
+	ReportCloseInitiator bool `config:"socket.report_close_initiator"`
+
+	// IncludeSocketInode enables reporting the inode number of the socket
+	// file of flows, to join them with /proc/net and ss output.
+	IncludeSocketInode bool `config:"socket.include_socket_inode"`
+
+	// ReportOnEstablish enables sending an event when a TCP flow is
+	// established, in addition to the event sent when it terminates.
+	ReportOnEstablish bool `config:"socket.report_on_establish"`
+
+	// InterimByteRates enables the average byte rates in events sent for
+	// flows that haven't terminated yet. They are always included in the
+	// final event of a flow.
+	InterimByteRates bool `config:"socket.interim_byte_rates"`
+
+	// RingBufferBytes configures the size of the per-cpu ring buffer in
+	// bytes, as an alternative to RingSizeExp. Must be a power-of-two number
+	// of memory pages.
+	RingBufferBytes cfgtype.ByteSize `config:"socket.ring_buffer_bytes"`
+
+	// PeerCountWindow enables reporting, every window, the number of distinct
+	// remote IPs seen by each local service within that window. Zero (default)
+	// disables it.
+	PeerCountWindow time.Duration `config:"socket.peer_count_window"`
+
+	// PeerCountMaxPeers is the maximum number of distinct remote IPs tracked
+	// per local service.
+	PeerCountMaxPeers int `config:"socket.peer_count_max_peers"`
+
+	// ReportEmptyFlows enables reporting failed connection attempts and marks
+	// the flows that terminated without transferring any data with flow.empty.
+	ReportEmptyFlows bool `config:"socket.report_empty_flows"`
+
+	// ReportConnectFailures enables reporting how long failed TCP connection
+	// attempts lasted and their error. It installs an additional kprobe on
+	// tcp_done.
+	ReportConnectFailures bool `config:"socket.report_connect_failures"`
+
+	// InferListenerProcess enables attributing inbound TCP flows whose accept
+	// wasn't seen to the process listening on their local port. It installs
+	// an additional kprobe on inet_listen.
+	InferListenerProcess bool `config:"socket.infer_listener_process"`
+
+	// IncludeNamespacedPID enables reporting the PID of processes in their
+	// innermost PID namespace, as seen from inside a container.
+	IncludeNamespacedPID bool `config:"socket.include_namespaced_pid"`
+
+	// ProcessEnvLabels is the allowlist of environment variables of processes
+	// reported as labels on their flows.
+	ProcessEnvLabels []string `config:"socket.process_env_labels"`
+
+	// ProcessMaxArgsLength limits the total length in bytes of the
+	// process.args of flows. Zero disables the limit.
+	ProcessMaxArgsLength int `config:"socket.process_max_args_length"`
+
+	// ProcessRetention is how long exited processes are kept, so that the
+	// events that arrive after the exit are still attributed to them. Zero
+	// (default) removes them as soon as they exit.
+	ProcessRetention time.Duration `config:"socket.process_retention"`
+
+	// ProcessRetentionMaxEntries is the maximum number of exited processes
+	// kept. The oldest ones are removed first.
+	ProcessRetentionMaxEntries int `config:"socket.process_retention_max_entries"`
+
+	// ProcessTableSyncPeriod is how often the process table is cross-checked
+	// against /proc to remove the processes whose exit was missed. Zero
+	// (default) disables it.
+	ProcessTableSyncPeriod time.Duration `config:"socket.process_table_sync_period"`
+
+	// EnableMPTCP enables correlating the subflows of MPTCP connections.
+	EnableMPTCP bool `config:"socket.enable_mptcp"`
+
+	// EnableTunnels enables reporting the active GRE, IPIP and SIT tunnels
+	// with the traffic they carried.
+	EnableTunnels bool `config:"socket.enable_tunnels"`
+
+	// EnableNetlink enables reporting the netlink sockets created and the
+	// messages sent by processes, by netlink family.
+	EnableNetlink bool `config:"socket.enable_netlink"`
+
+	// EnableQUIC enables tagging UDP flows with the server name and ALPN
+	// protocols sent in the Initial packets of QUIC connections. The capture
+	// itself is configured by the quic package, under socket.quic.
+	EnableQUIC bool `config:"socket.quic.enabled"`
+
+	// ResolveHostsFile enables setting the destination domain from
+	// /etc/hosts when no DNS name was captured for the destination address.
+	ResolveHostsFile bool `config:"socket.resolve_hosts_file"`
+
+	// BGPRIBPath is the path to a BGP RIB dump, in MRT TABLE_DUMP_V2 or text
+	// format, used to report the AS path to the destination of flows. It's
+	// loaded at startup and reloaded when it changes.
+	BGPRIBPath string `config:"socket.bgp_rib_path"`
+
+	// DetectDeletedExecutable enables reporting processes whose executable
+	// has been unlinked, as happens when malware deletes itself after being
+	// launched.
+	DetectDeletedExecutable bool `config:"socket.detect_deleted_executable"`
+
+	// ReportProcessFDCount enables reporting the number of file descriptors
+	// open by the process of flows, read from /proc/<pid>/fd.
+	ReportProcessFDCount bool `config:"socket.report_process_fd_count"`
+
+	// ReportMainThreadID enables reporting process.thread.id for flows
+	// connected or accepted by the main thread of their process.
+	ReportMainThreadID bool `config:"socket.report_main_thread_id"`
+
+	// DetectPortScans enables reporting the inbound half-open flows from a
+	// remote address that attempted connections to many local ports as a
+	// single suspected port scan.
+	DetectPortScans bool `config:"socket.detect_port_scans"`
+
+	// PortScanWindow is how long inbound half-open flows are held, counting
+	// the distinct local ports attempted by their remote address.
+	PortScanWindow time.Duration `config:"socket.port_scan_window"`
+
+	// PortScanMinPorts is the number of distinct local ports a remote address
+	// has to attempt within the window to be considered a port scan.
+	PortScanMinPorts int `config:"socket.port_scan_min_ports"`
+
+	// PortScanMaxSources is the maximum number of remote addresses tracked
+	// for port scan detection. Attempts from other addresses are reported
+	// right away.
+	PortScanMaxSources int `config:"socket.port_scan_max_sources"`
+
+	// PortScanMaxHeldFlows is the maximum number of inbound half-open flows
+	// held for port scan detection. Flows beyond it are reported right away.
+	PortScanMaxHeldFlows int `config:"socket.port_scan_max_held_flows"`
+
+	// MinFlowBytes drops the flows that transferred fewer bytes, in both
+	// directions, when they terminate. Flows ended by a TCP reset are always
+	// reported.
+	MinFlowBytes cfgtype.ByteSize `config:"socket.min_flow_bytes"`
+
+	// FlowExportSocket is the path of a Unix datagram socket to which each
+	// completed flow is written as a length-prefixed JSON document, in
+	// addition to being published. Flows are dropped when nothing is
+	// listening or the consumer is too slow.
+	FlowExportSocket string `config:"socket.flow_export_socket"`
+
+	// FlowExportFormat is the format of the flows written to
+	// FlowExportSocket, json (default) or cef.
+	FlowExportFormat string `config:"socket.flow_export_format"`
+
+	// SharedProbeGroup is the name of a group of kprobes installed by another
+	// process. When set, the dataset attaches to these kprobes instead of
+	// installing its own. Guesses still install their own kprobes.
+	SharedProbeGroup string `config:"socket.shared_probe_group"`
+}
+
+const (
+	attributionActive    = "active"
+	attributionFirstSeen = "first_seen"
+)
+
+const (
+	flowKeySocket     = "socket"
+	flowKeyConnection = "connection"
+)
+
+// Formats of the flows written to socket.flow_export_socket.
+const (
+	exportFormatJSON = "json"
+	exportFormatCEF  = "cef"
+)
+
+// Valid names for a group of kprobes.
+var probeGroupRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Maximum length of the path of a Unix socket, as the kernel reserves 108
+// bytes for it including the terminating NUL.
+const maxUnixSocketPath = 107
+
+// Maximum value for socket.ring_size_exponent, as accepted by the perf
+// channel.
+const maxRingSizeExp = 18
+
+// Minimum value for socket.ring_size_exponent. A ring buffer of a single page
+// per CPU can't absorb bursts of events.
+const minRingSizeExp = 1
+
+// Larger values for socket.ring_size_exponent are allowed, but a warning is
+// logged. With 4KiB pages, this is a 256MiB ring buffer per CPU.
+const warnRingSizeExp = 16
+
+// Ring buffer exponent used when neither socket.ring_size_exponent nor
+// socket.ring_buffer_bytes is set. With 4KiB pages, this is a 512KiB ring
+// buffer per CPU.
+const defaultRingSizeExp = 7
+
+// ringSizeExponent returns the exponent for the size of the ring buffer, in
+// pages, from either socket.ring_size_exponent or socket.ring_buffer_bytes.
+func (c *Config) ringSizeExponent() int {
+	if c.RingSizeExp != nil {
+		return *c.RingSizeExp
+	}
+	if c.RingBufferBytes != 0 {
+		if exp, err := ringBytesToExponent(int64(c.RingBufferBytes), int64(os.Getpagesize())); err == nil {
+			return exp
+		}
+	}
+	return defaultRingSizeExp
+}
+
+// ringBytesToExponent converts a ring buffer size in bytes to the exponent of
+// its size in pages. The size must be a power-of-two number of pages.
+func ringBytesToExponent(size, pageSize int64) (int, error) {
+	if size <= 0 || size%pageSize != 0 {
+		return 0, fmt.Errorf("must be a multiple of the page size (%d bytes)", pageSize)
+	}
+	pages := size / pageSize
+	if pages&(pages-1) != 0 {
+		return 0, fmt.Errorf("must be a power-of-two number of pages of %d bytes", pageSize)
+	}
+	return bits.TrailingZeros64(uint64(pages)), nil
 }
 
-// Validate validates the socket metricset config.
+// Validate validates the socket metricset config. It's called when the config
+// is unpacked in New, so that misconfigurations are reported before Setup
+// installs any kprobe. All the problems found are reported at once.
 func (c *Config) Validate() error {
-	return nil
+	var errs multierror.Errors
+	addErr := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch {
+	case c.RingSizeExp != nil && c.RingBufferBytes != 0:
+		addErr("socket.ring_size_exponent and socket.ring_buffer_bytes can't be set at the same time")
+	case c.RingSizeExp != nil:
+		if exp := *c.RingSizeExp; exp < minRingSizeExp || exp > maxRingSizeExp {
+			addErr("socket.ring_size_exponent (%d) must be between %d and %d: the ring buffer size is 2^exponent pages per CPU",
+				exp, minRingSizeExp, maxRingSizeExp)
+		}
+	case c.RingBufferBytes != 0:
+		pageSize := int64(os.Getpagesize())
+		if exp, err := ringBytesToExponent(int64(c.RingBufferBytes), pageSize); err != nil {
+			addErr("invalid socket.ring_buffer_bytes (%d): %v", c.RingBufferBytes, err)
+		} else if exp < minRingSizeExp {
+			addErr("socket.ring_buffer_bytes (%d) must be at least %d bytes",
+				c.RingBufferBytes, pageSize<<minRingSizeExp)
+		} else if exp > maxRingSizeExp {
+			addErr("socket.ring_buffer_bytes (%d) must be at most %d bytes",
+				c.RingBufferBytes, pageSize<<maxRingSizeExp)
+		}
+	}
+	if c.DetailedSampleRate <= 0 || c.DetailedSampleRate > 1 {
+		addErr("socket.detailed_sample_rate (%v) must be greater than 0 and at most 1", c.DetailedSampleRate)
+	}
+	if c.IPv6Only && c.EnableIPv6 != nil && !*c.EnableIPv6 {
+		addErr("socket.ipv6_only can't be set with socket.enable_ipv6 disabled")
+	}
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"socket.flow_inactive_timeout", c.FlowInactiveTimeout},
+		{"socket.socket_inactive_timeout", c.SocketInactiveTimeout},
+		{"socket.flow_termination_timeout", c.FlowTerminationTimeout},
+	} {
+		if timeout.value <= 0 {
+			addErr("%s (%v) must be positive", timeout.name, timeout.value)
+		}
+	}
+	if c.MaxKProbes < 0 {
+		addErr("socket.max_kprobes (%d) must not be negative", c.MaxKProbes)
+	}
+	if c.ProbeInstallRetries < 0 {
+		addErr("socket.probe_install_retries (%d) must not be negative", c.ProbeInstallRetries)
+	}
+	if c.ProbeInstallRetries > 0 && c.ProbeInstallBackoff <= 0 {
+		addErr("socket.probe_install_backoff (%v) must be positive", c.ProbeInstallBackoff)
+	}
+	if c.PerfReopenRetries < 0 {
+		addErr("socket.perf_reopen_retries (%d) must not be negative", c.PerfReopenRetries)
+	}
+	if c.AdaptiveClockSync {
+		if c.ClockSyncMinPeriod <= 0 {
+			addErr("socket.clock_sync_min_period (%v) must be positive", c.ClockSyncMinPeriod)
+		} else if c.ClockSyncMinPeriod > c.ClockSyncPeriod {
+			addErr("socket.clock_sync_min_period (%v) can't be greater than socket.clock_sync_period (%v)",
+				c.ClockSyncMinPeriod, c.ClockSyncPeriod)
+		}
+		if c.ClockSyncMaxPeriod < c.ClockSyncPeriod {
+			addErr("socket.clock_sync_max_period (%v) can't be lower than socket.clock_sync_period (%v)",
+				c.ClockSyncMaxPeriod, c.ClockSyncPeriod)
+		}
+	}
+	if c.CaptureIdleTimeout < 0 {
+		addErr("socket.capture_idle_timeout (%v) must not be negative", c.CaptureIdleTimeout)
+	}
+	if c.PerfReopenRetries > 0 && c.PerfReopenBackoff <= 0 {
+		addErr("socket.perf_reopen_backoff (%v) must be positive", c.PerfReopenBackoff)
+	}
+
+	if c.DetectPortScans {
+		if c.PortScanWindow <= 0 {
+			addErr("socket.port_scan_window (%v) must be positive", c.PortScanWindow)
+		}
+		if c.PortScanMinPorts < 2 {
+			addErr("socket.port_scan_min_ports (%d) must be at least 2", c.PortScanMinPorts)
+		}
+		if c.PortScanMaxSources <= 0 {
+			addErr("socket.port_scan_max_sources (%d) must be positive", c.PortScanMaxSources)
+		}
+		if c.PortScanMaxHeldFlows <= 0 {
+			addErr("socket.port_scan_max_held_flows (%d) must be positive", c.PortScanMaxHeldFlows)
+		}
+	}
+	if c.DedupLocalFlows && c.LocalFlowHoldTime <= 0 {
+		addErr("socket.dedup_local_flows_hold_time (%v) must be positive", c.LocalFlowHoldTime)
+	}
+	if c.PeerCountWindow < 0 {
+		addErr("socket.peer_count_window (%v) must not be negative", c.PeerCountWindow)
+	}
+	if c.PeerCountWindow > 0 && c.PeerCountMaxPeers <= 0 {
+		addErr("socket.peer_count_max_peers (%d) must be positive", c.PeerCountMaxPeers)
+	}
+	if c.ZeroWindowThreshold < 0 {
+		addErr("socket.zero_window_threshold (%v) must not be negative", c.ZeroWindowThreshold)
+	}
+	if c.ZeroWindowThreshold > 0 && !c.TrackZeroWindow {
+		addErr("socket.zero_window_threshold requires socket.track_zero_window to be enabled")
+	}
+
+	for port, name := range c.PortServiceOverrides {
+		if num, err := strconv.ParseUint(port, 10, 16); err != nil || num == 0 {
+			addErr("invalid port '%s' in socket.port_service_overrides: must be a number between 1 and 65535", port)
+		}
+		if name == "" {
+			addErr("empty service name for port %s in socket.port_service_overrides", port)
+		}
+	}
+	if _, err := newPortFilter(c.IncludePorts, c.ExcludePorts); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newCIDRFilter(c.RemoteCIDRFilter); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newSpecialAddrClassifier(c.SpecialDestinations); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newZoneClassifier(c.NetworkZones); err != nil {
+		errs = append(errs, err)
+	}
+	if c.SharedProbeGroup != "" && !probeGroupRegexp.MatchString(c.SharedProbeGroup) {
+		addErr("invalid socket.shared_probe_group '%s': must only contain letters, digits and underscores", c.SharedProbeGroup)
+	}
+	if c.TraceFSInstanceName != "" && !probeGroupRegexp.MatchString(c.TraceFSInstanceName) {
+		addErr("invalid socket.tracefs_instance_name '%s': must only contain letters, digits and underscores", c.TraceFSInstanceName)
+	}
+	if len(c.FlowExportSocket) > maxUnixSocketPath {
+		addErr("socket.flow_export_socket must be at most %d bytes long", maxUnixSocketPath)
+	}
+	if c.HashOnlyMode && !c.FlowTupleHash {
+		addErr("socket.hash_only_mode requires socket.flow_tuple_hash")
+	}
+	switch c.FlowExportFormat {
+	case exportFormatJSON:
+	case exportFormatCEF:
+		// The format only applies to the export socket, not to the events.
+		if c.FlowExportSocket == "" {
+			addErr("socket.flow_export_format '%s' requires socket.flow_export_socket", c.FlowExportFormat)
+		}
+	default:
+		addErr("invalid socket.flow_export_format '%s': must be one of '%s' or '%s'",
+			c.FlowExportFormat, exportFormatJSON, exportFormatCEF)
+	}
+	if c.ProcessMaxArgsLength < 0 {
+		addErr("socket.process_max_args_length (%d) must not be negative", c.ProcessMaxArgsLength)
+	}
+	if c.MaxDNSAnswers < 0 {
+		addErr("socket.max_dns_answers (%d) must not be negative", c.MaxDNSAnswers)
+	}
+	for _, name := range c.ProcessCredFields {
+		switch name {
+		case "uid", "euid", "gid", "egid":
+		default:
+			addErr("invalid socket.process_cred_fields '%s': must be one of 'uid', 'euid', 'gid' or 'egid'", name)
+		}
+	}
+	if c.TopProcessesCount < 0 {
+		addErr("socket.top_processes_count (%d) must not be negative", c.TopProcessesCount)
+	}
+	if c.ProcessRetention < 0 {
+		addErr("socket.process_retention (%v) must not be negative", c.ProcessRetention)
+	}
+	if c.ProcessRetention > 0 && c.ProcessRetentionMaxEntries <= 0 {
+		addErr("socket.process_retention_max_entries (%d) must be positive", c.ProcessRetentionMaxEntries)
+	}
+	if c.ProcessTableSyncPeriod < 0 {
+		addErr("socket.process_table_sync_period (%v) must not be negative", c.ProcessTableSyncPeriod)
+	}
+	for _, name := range c.ProcessEnvLabels {
+		// Label names can't contain dots, as they'd be expanded into objects.
+		if name == "" || strings.ContainsAny(name, "=.\x00") {
+			addErr("invalid environment variable name '%s' in socket.process_env_labels", name)
+		}
+	}
+	if c.CGroupFilter != "" && !strings.HasPrefix(c.CGroupFilter, "/") {
+		addErr("invalid socket.cgroup_filter '%s': must be an absolute cgroup path, as in /proc/<pid>/cgroup", c.CGroupFilter)
+	}
+	switch c.FlowProcessAttribution {
+	case attributionActive, attributionFirstSeen:
+	default:
+		addErr("invalid socket.flow_process_attribution '%s': must be one of '%s' or '%s'",
+			c.FlowProcessAttribution, attributionActive, attributionFirstSeen)
+	}
+	switch c.FlowKey {
+	case flowKeySocket, flowKeyConnection:
+	default:
+		addErr("invalid socket.flow_key '%s': must be one of '%s' or '%s'",
+			c.FlowKey, flowKeySocket, flowKeyConnection)
+	}
+	return errs.Err()
+}
+
+// Warnings returns the problems found in a valid config. They are settings
+// that used to be accepted and are still allowed, but are likely to cause
+// issues. They are logged when the dataset is created.
+func (c *Config) Warnings() []string {
+	var warns []string
+	addWarn := func(format string, args ...interface{}) {
+		warns = append(warns, fmt.Sprintf(format, args...))
+	}
+	if exp := c.ringSizeExponent(); exp > warnRingSizeExp {
+		name := "socket.ring_size_exponent"
+		if c.RingSizeExp == nil {
+			name = "socket.ring_buffer_bytes"
+		}
+		addWarn("%s sets a ring buffer of 2^%d pages per CPU, above the recommended 2^%d: "+
+			"this uses a large amount of memory", name, exp, warnRingSizeExp)
+	}
+	if c.FlowInactiveTimeout > 0 && c.SocketInactiveTimeout < c.FlowInactiveTimeout {
+		addWarn("socket.socket_inactive_timeout (%v) is lower than socket.flow_inactive_timeout (%v): "+
+			"sockets can be expired while their flows are still active", c.SocketInactiveTimeout, c.FlowInactiveTimeout)
+	}
+	if c.EnableClockSync {
+		name, period := "socket.clock_sync_period", c.ClockSyncPeriod
+		if c.AdaptiveClockSync {
+			name, period = "socket.clock_sync_min_period", c.ClockSyncMinPeriod
+		}
+		if c.ClockMaxDrift >= period {
+			addWarn("socket.clock_max_drift (%v) is not lower than %s (%v): "+
+				"the clock drift can exceed it between synchronizations", c.ClockMaxDrift, name, period)
+		}
+	}
+	return warns
 }
 
 // Equals compares two Config objects
@@ -80,8 +747,11 @@ func (c *Config) Equals(other Config) bool {
 	for idx := range simpler {
 		simpler[idx].EnableIPv6 = nil
 		simpler[idx].TraceFSPath = nil
+		simpler[idx].RingSizeExp = nil
 	}
 	return reflect.DeepEqual(simpler[0], simpler[1]) &&
+		(c.RingSizeExp == nil) == (other.RingSizeExp == nil) &&
+		(c.RingSizeExp == nil || *c.RingSizeExp == *other.RingSizeExp) &&
 		(c.EnableIPv6 == nil) == (other.EnableIPv6 == nil) &&
 		(c.EnableIPv6 == nil || *c.EnableIPv6 == *other.EnableIPv6) &&
 		(c.TraceFSPath == nil) == (other.TraceFSPath == nil) &&
@@ -90,13 +760,37 @@ func (c *Config) Equals(other Config) bool {
 
 var defaultConfig = Config{
 	PerfQueueSize:          4096,
+	DetailedSampleRate:     1,
 	LostQueueSize:          128,
 	ErrQueueSize:           1,
-	RingSizeExp:            7,
 	FlowInactiveTimeout:    30 * time.Second,
 	SocketInactiveTimeout:  60 * time.Second,
 	FlowTerminationTimeout: 5 * time.Second,
 	ClockMaxDrift:          100 * time.Millisecond,
 	ClockSyncPeriod:        10 * time.Second,
+	ClockSyncMinPeriod:     time.Second,
+	ClockSyncMaxPeriod:     time.Minute,
 	GuessTimeout:           15 * time.Second,
+	ProbeInstallRetries:    5,
+	ProbeInstallBackoff:    50 * time.Millisecond,
+	PerfReopenRetries:      3,
+	PerfReopenBackoff:      time.Second,
+	CaptureIdleTimeout:     5 * time.Minute,
+	CaptureIdleMinPackets:  1000,
+	FlowProcessAttribution: attributionFirstSeen,
+	FlowKey:                flowKeySocket,
+	FlowExportFormat:       exportFormatJSON,
+	ReportUnknownCGroup:    true,
+	EnableClockSync:        true,
+	PeerCountMaxPeers:      10000,
+	LocalFlowHoldTime:      defaultLocalFlowHoldTime,
+	PortScanWindow:         10 * time.Second,
+	PortScanMinPorts:       5,
+	PortScanMaxSources:     10000,
+	PortScanMaxHeldFlows:   10000,
+
+	ProcessRetentionMaxEntries: 1024,
+	MaxDNSAnswers:              32,
+	TopProcessesCount:          10,
+	ProcessCredFields:          []string{"uid", "euid", "gid", "egid"},
 }
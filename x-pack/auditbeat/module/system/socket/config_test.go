@@ -0,0 +1,566 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joeshaw/multierror"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/libbeat/common/cfgtype"
+	conf "github.com/elastic/elastic-agent-libs/config"
+)
+
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		modify   func(*Config)
+		errors   []string
+		warnings []string
+	}{
+		{
+			name:   "default",
+			modify: func(*Config) {},
+		},
+		{
+			name: "ring size",
+			modify: func(c *Config) {
+				exp := 20
+				c.RingSizeExp = &exp
+			},
+			errors: []string{"socket.ring_size_exponent (20) must be between 1 and 18"},
+		},
+		{
+			name: "negative ring size",
+			modify: func(c *Config) {
+				exp := -1
+				c.RingSizeExp = &exp
+			},
+			errors: []string{"socket.ring_size_exponent (-1) must be between 1 and 18"},
+		},
+		{
+			name: "zero ring size",
+			modify: func(c *Config) {
+				exp := 0
+				c.RingSizeExp = &exp
+			},
+			errors: []string{"socket.ring_size_exponent (0) must be between 1 and 18"},
+		},
+		{
+			name: "minimum ring size",
+			modify: func(c *Config) {
+				exp := 1
+				c.RingSizeExp = &exp
+			},
+		},
+		{
+			name: "large ring size",
+			modify: func(c *Config) {
+				exp := 17
+				c.RingSizeExp = &exp
+			},
+			warnings: []string{"socket.ring_size_exponent sets a ring buffer of 2^17 pages per CPU"},
+		},
+		{
+			name: "ring buffer bytes",
+			modify: func(c *Config) {
+				c.RingBufferBytes = cfgtype.ByteSize(os.Getpagesize() * 64)
+			},
+		},
+		{
+			name: "ring buffer bytes not a power of two",
+			modify: func(c *Config) {
+				c.RingBufferBytes = cfgtype.ByteSize(os.Getpagesize() * 3)
+			},
+			errors: []string{"must be a power-of-two number of pages"},
+		},
+		{
+			name: "ring buffer bytes not a multiple of the page size",
+			modify: func(c *Config) {
+				c.RingBufferBytes = 1000
+			},
+			errors: []string{"must be a multiple of the page size"},
+		},
+		{
+			name: "ring buffer bytes too small",
+			modify: func(c *Config) {
+				c.RingBufferBytes = cfgtype.ByteSize(os.Getpagesize())
+			},
+			errors: []string{"socket.ring_buffer_bytes"},
+		},
+		{
+			name: "ring buffer bytes too large",
+			modify: func(c *Config) {
+				c.RingBufferBytes = cfgtype.ByteSize(os.Getpagesize() << 20)
+			},
+			errors: []string{"socket.ring_buffer_bytes"},
+		},
+		{
+			name: "large ring buffer bytes",
+			modify: func(c *Config) {
+				c.RingBufferBytes = cfgtype.ByteSize(os.Getpagesize() << 17)
+			},
+			warnings: []string{"socket.ring_buffer_bytes sets a ring buffer of 2^17 pages per CPU"},
+		},
+		{
+			name: "ring size exponent and bytes",
+			modify: func(c *Config) {
+				exp := 7
+				c.RingSizeExp = &exp
+				c.RingBufferBytes = cfgtype.ByteSize(os.Getpagesize() * 64)
+			},
+			errors: []string{"socket.ring_size_exponent and socket.ring_buffer_bytes can't be set at the same time"},
+		},
+		{
+			name: "socket timeout lower than flow timeout",
+			modify: func(c *Config) {
+				c.SocketInactiveTimeout = 10 * time.Second
+			},
+			warnings: []string{"socket.socket_inactive_timeout (10s) is lower than socket.flow_inactive_timeout (30s)"},
+		},
+		{
+			name: "probe install retries",
+			modify: func(c *Config) {
+				c.ProbeInstallRetries = -1
+			},
+			errors: []string{"socket.probe_install_retries (-1) must not be negative"},
+		},
+		{
+			name: "probe install backoff",
+			modify: func(c *Config) {
+				c.ProbeInstallBackoff = 0
+			},
+			errors: []string{"socket.probe_install_backoff (0s) must be positive"},
+		},
+		{
+			name: "perf reopen retries",
+			modify: func(c *Config) {
+				c.PerfReopenRetries = -1
+			},
+			errors: []string{"socket.perf_reopen_retries (-1) must not be negative"},
+		},
+		{
+			name: "perf reopen backoff",
+			modify: func(c *Config) {
+				c.PerfReopenBackoff = 0
+			},
+			errors: []string{"socket.perf_reopen_backoff (0s) must be positive"},
+		},
+		{
+			name: "negative capture idle timeout",
+			modify: func(c *Config) {
+				c.CaptureIdleTimeout = -time.Second
+			},
+			errors: []string{"socket.capture_idle_timeout (-1s) must not be negative"},
+		},
+		{
+			name: "no probe install retries",
+			modify: func(c *Config) {
+				c.ProbeInstallRetries = 0
+				c.ProbeInstallBackoff = 0
+			},
+		},
+		{
+			name: "clock max drift",
+			modify: func(c *Config) {
+				c.ClockMaxDrift = time.Minute
+			},
+			warnings: []string{"socket.clock_max_drift (1m0s) is not lower than socket.clock_sync_period (10s)"},
+		},
+		{
+			name: "adaptive clock sync",
+			modify: func(c *Config) {
+				c.AdaptiveClockSync = true
+			},
+		},
+		{
+			name: "adaptive clock sync bounds",
+			modify: func(c *Config) {
+				c.AdaptiveClockSync = true
+				c.ClockSyncMinPeriod = time.Minute
+				c.ClockSyncMaxPeriod = time.Second
+			},
+			errors: []string{
+				"socket.clock_sync_min_period (1m0s) can't be greater than socket.clock_sync_period (10s)",
+				"socket.clock_sync_max_period (1s) can't be lower than socket.clock_sync_period (10s)",
+			},
+		},
+		{
+			name: "adaptive clock sync min period",
+			modify: func(c *Config) {
+				c.AdaptiveClockSync = true
+				c.ClockSyncMinPeriod = 50 * time.Millisecond
+			},
+			warnings: []string{"socket.clock_max_drift (100ms) is not lower than socket.clock_sync_min_period (50ms)"},
+		},
+		{
+			name: "clock sync disabled",
+			modify: func(c *Config) {
+				c.EnableClockSync = false
+				c.ClockMaxDrift = time.Minute
+			},
+		},
+		{
+			name: "zero window threshold",
+			modify: func(c *Config) {
+				c.ZeroWindowThreshold = -time.Second
+			},
+			errors: []string{"socket.zero_window_threshold (-1s) must not be negative"},
+		},
+		{
+			name: "zero window threshold without tracking",
+			modify: func(c *Config) {
+				c.ZeroWindowThreshold = time.Minute
+			},
+			errors: []string{"socket.zero_window_threshold requires socket.track_zero_window"},
+		},
+		{
+			name: "peer count window",
+			modify: func(c *Config) {
+				c.PeerCountWindow = -time.Minute
+			},
+			errors: []string{"socket.peer_count_window (-1m0s) must not be negative"},
+		},
+		{
+			name: "peer count max peers",
+			modify: func(c *Config) {
+				c.PeerCountWindow = time.Minute
+				c.PeerCountMaxPeers = 0
+			},
+			errors: []string{"socket.peer_count_max_peers (0) must be positive"},
+		},
+		{
+			name: "local flow hold time",
+			modify: func(c *Config) {
+				c.DedupLocalFlows = true
+				c.LocalFlowHoldTime = 0
+			},
+			errors: []string{"socket.dedup_local_flows_hold_time (0s) must be positive"},
+		},
+		{
+			name: "port scan thresholds",
+			modify: func(c *Config) {
+				c.DetectPortScans = true
+				c.PortScanWindow = 0
+				c.PortScanMinPorts = 1
+			},
+			errors: []string{
+				"socket.port_scan_window (0s) must be positive",
+				"socket.port_scan_min_ports (1) must be at least 2",
+			},
+		},
+		{
+			name: "port scan thresholds unused",
+			modify: func(c *Config) {
+				c.PortScanWindow = 0
+			},
+		},
+		{
+			name: "shared probe group",
+			modify: func(c *Config) {
+				c.SharedProbeGroup = "auditbeat_1234"
+			},
+		},
+		{
+			name: "invalid shared probe group",
+			modify: func(c *Config) {
+				c.SharedProbeGroup = "auditbeat/1234"
+			},
+			errors: []string{"invalid socket.shared_probe_group 'auditbeat/1234'"},
+		},
+		{
+			name: "negative max args length",
+			modify: func(c *Config) {
+				c.ProcessMaxArgsLength = -1
+			},
+			errors: []string{"socket.process_max_args_length (-1) must not be negative"},
+		},
+		{
+			name: "negative max DNS answers",
+			modify: func(c *Config) {
+				c.MaxDNSAnswers = -1
+			},
+			errors: []string{"socket.max_dns_answers (-1) must not be negative"},
+		},
+		{
+			name: "invalid process cred field",
+			modify: func(c *Config) {
+				c.ProcessCredFields = []string{"uid", "suid"}
+			},
+			errors: []string{"invalid socket.process_cred_fields 'suid'"},
+		},
+		{
+			name: "negative max kprobes",
+			modify: func(c *Config) {
+				c.MaxKProbes = -1
+			},
+			errors: []string{"socket.max_kprobes (-1) must not be negative"},
+		},
+		{
+			name: "negative top processes count",
+			modify: func(c *Config) {
+				c.TopProcessesCount = -1
+			},
+			errors: []string{"socket.top_processes_count (-1) must not be negative"},
+		},
+		{
+			name: "negative process retention",
+			modify: func(c *Config) {
+				c.ProcessRetention = -time.Second
+			},
+			errors: []string{"socket.process_retention (-1s) must not be negative"},
+		},
+		{
+			name: "process retention without entries",
+			modify: func(c *Config) {
+				c.ProcessRetention = time.Second
+				c.ProcessRetentionMaxEntries = 0
+			},
+			errors: []string{"socket.process_retention_max_entries (0) must be positive"},
+		},
+		{
+			name: "negative process table sync period",
+			modify: func(c *Config) {
+				c.ProcessTableSyncPeriod = -time.Minute
+			},
+			errors: []string{"socket.process_table_sync_period (-1m0s) must not be negative"},
+		},
+		{
+			name: "hash only mode without tuple hash",
+			modify: func(c *Config) {
+				c.HashOnlyMode = true
+			},
+			errors: []string{"socket.hash_only_mode requires socket.flow_tuple_hash"},
+		},
+		{
+			name: "invalid flow export format",
+			modify: func(c *Config) {
+				c.FlowExportFormat = "leef"
+			},
+			errors: []string{"invalid socket.flow_export_format 'leef'"},
+		},
+		{
+			name: "cef flow export format without socket",
+			modify: func(c *Config) {
+				c.FlowExportFormat = exportFormatCEF
+			},
+			errors: []string{"socket.flow_export_format 'cef' requires socket.flow_export_socket"},
+		},
+		{
+			name: "cef flow export format",
+			modify: func(c *Config) {
+				c.FlowExportFormat = exportFormatCEF
+				c.FlowExportSocket = "/run/flows.sock"
+			},
+		},
+		{
+			name: "invalid flow key",
+			modify: func(c *Config) {
+				c.FlowKey = "tuple"
+			},
+			errors: []string{"invalid socket.flow_key 'tuple'"},
+		},
+		{
+			name: "invalid tracefs instance name",
+			modify: func(c *Config) {
+				c.TraceFSInstanceName = "../auditbeat"
+			},
+			errors: []string{"invalid socket.tracefs_instance_name '../auditbeat'"},
+		},
+		{
+			name: "flow export socket path too long",
+			modify: func(c *Config) {
+				c.FlowExportSocket = "/run/" + strings.Repeat("x", maxUnixSocketPath)
+			},
+			errors: []string{"socket.flow_export_socket must be at most 107 bytes long"},
+		},
+		{
+			name: "process env labels",
+			modify: func(c *Config) {
+				c.ProcessEnvLabels = []string{"OTEL_SERVICE_NAME", "APP_ENV"}
+			},
+		},
+		{
+			name: "invalid process env labels",
+			modify: func(c *Config) {
+				c.ProcessEnvLabels = []string{"", "service.name"}
+			},
+			errors: []string{
+				"invalid environment variable name '' in socket.process_env_labels",
+				"invalid environment variable name 'service.name' in socket.process_env_labels",
+			},
+		},
+		{
+			name: "overlapping network zones",
+			modify: func(c *Config) {
+				c.NetworkZones = map[string][]string{
+					"prod": {"10.0.0.0/8"},
+					"dev":  {"10.20.0.0/16"},
+				}
+			},
+		},
+		{
+			name: "invalid network zones",
+			modify: func(c *Config) {
+				c.NetworkZones = map[string][]string{"prod": {"10.0.0.0"}}
+			},
+			errors: []string{"invalid socket.network_zones: zone 'prod'"},
+		},
+		{
+			name: "remote CIDR filter",
+			modify: func(c *Config) {
+				c.RemoteCIDRFilter = CIDRFilterConfig{
+					Include: []string{"10.0.0.0/8", "2001:db8::/32"},
+					Exclude: []string{"10.1.2.3"},
+				}
+			},
+		},
+		{
+			name: "invalid remote CIDR filter",
+			modify: func(c *Config) {
+				c.RemoteCIDRFilter.Exclude = []string{"10.0.0.0/33"}
+			},
+			errors: []string{"invalid socket.remote_cidr_filter.exclude: invalid network '10.0.0.0/33'"},
+		},
+		{
+			name: "IPv6 only",
+			modify: func(c *Config) {
+				c.IPv6Only = true
+			},
+		},
+		{
+			name: "IPv6 only with IPv6 disabled",
+			modify: func(c *Config) {
+				disabled := false
+				c.IPv6Only = true
+				c.EnableIPv6 = &disabled
+			},
+			errors: []string{"socket.ipv6_only can't be set with socket.enable_ipv6 disabled"},
+		},
+		{
+			name: "detailed sample rate",
+			modify: func(c *Config) {
+				c.DetailedSampleRate = 0.01
+			},
+		},
+		{
+			name: "zero detailed sample rate",
+			modify: func(c *Config) {
+				c.DetailedSampleRate = 0
+			},
+			errors: []string{"socket.detailed_sample_rate (0) must be greater than 0 and at most 1"},
+		},
+		{
+			name: "detailed sample rate above 1",
+			modify: func(c *Config) {
+				c.DetailedSampleRate = 1.5
+			},
+			errors: []string{"socket.detailed_sample_rate (1.5) must be greater than 0 and at most 1"},
+		},
+		{
+			name: "multiple errors",
+			modify: func(c *Config) {
+				c.FlowTerminationTimeout = 0
+				c.ProbeInstallRetries = -1
+				c.CGroupFilter = "system.slice"
+				c.FlowProcessAttribution = "last"
+				c.PortServiceOverrides = map[string]string{"http": "web"}
+			},
+			errors: []string{
+				"socket.flow_termination_timeout (0s) must be positive",
+				"socket.probe_install_retries (-1) must not be negative",
+				"invalid port 'http'",
+				"invalid socket.cgroup_filter 'system.slice'",
+				"invalid socket.flow_process_attribution 'last'",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := defaultConfig
+			tc.modify(&c)
+			err := c.Validate()
+			if len(tc.errors) == 0 {
+				assert.NoError(t, err)
+			} else {
+				var merr *multierror.MultiError
+				if assert.True(t, errors.As(err, &merr), err) && assert.Len(t, merr.Errors, len(tc.errors), err.Error()) {
+					for i, expected := range tc.errors {
+						assert.Contains(t, merr.Errors[i].Error(), expected)
+					}
+				}
+			}
+			warnings := c.Warnings()
+			if assert.Len(t, warnings, len(tc.warnings), warnings) {
+				for i, expected := range tc.warnings {
+					assert.True(t, strings.HasPrefix(warnings[i], expected), warnings[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRingSizeExponent(t *testing.T) {
+	pageSize := os.Getpagesize()
+	for _, tc := range []struct {
+		config   map[string]interface{}
+		expected int
+	}{
+		{map[string]interface{}{}, defaultRingSizeExp},
+		{map[string]interface{}{"socket.ring_size_exponent": 10}, 10},
+		{map[string]interface{}{"socket.ring_buffer_bytes": fmt.Sprintf("%dKiB", pageSize/1024*256)}, 8},
+		{map[string]interface{}{"socket.ring_buffer_bytes": fmt.Sprint(pageSize * 2)}, 1},
+	} {
+		c := defaultConfig
+		if !assert.NoError(t, conf.MustNewConfigFrom(tc.config).Unpack(&c), tc.config) {
+			continue
+		}
+		assert.Equal(t, tc.expected, c.ringSizeExponent(), tc.config)
+	}
+}
+
+func TestRingBytesToExponent(t *testing.T) {
+	for _, tc := range []struct {
+		size     int64
+		expected int
+		err      bool
+	}{
+		{4096, 0, false},
+		{8192, 1, false},
+		{4 << 20, 10, false},
+		{0, 0, true},
+		{-4096, 0, true},
+		{6000, 0, true},
+		{3 * 4096, 0, true},
+	} {
+		exp, err := ringBytesToExponent(tc.size, 4096)
+		if tc.err {
+			assert.Error(t, err, tc.size)
+			continue
+		}
+		if assert.NoError(t, err, tc.size) {
+			assert.Equal(t, tc.expected, exp, tc.size)
+		}
+	}
+}
+
+func TestConfigValidatedOnUnpack(t *testing.T) {
+	cfg := conf.MustNewConfigFrom(map[string]interface{}{
+		"socket.flow_inactive_timeout":   "2m",
+		"socket.socket_inactive_timeout": "1m",
+		"socket.cgroup_filter":           "system.slice",
+	})
+	c := defaultConfig
+	err := cfg.Unpack(&c)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "socket.cgroup_filter")
+		assert.NotContains(t, err.Error(), "socket.socket_inactive_timeout")
+	}
+}
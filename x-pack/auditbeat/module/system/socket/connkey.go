@@ -0,0 +1,115 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+// withFlowKey sets how flows are identified. With flowKeyConnection, the
+// flows of different socks for the same connection, as identified by their
+// network namespace, transport and addresses, are coalesced into one. The
+// network namespace of processes is read to tell apart the connections of
+// different namespaces.
+func withFlowKey(key string) stateOption {
+	return func(s *state) {
+		if key == flowKeyConnection {
+			s.connections = make(map[string]*flow)
+			s.readNetNS = readNetNS
+		}
+	}
+}
+
+// connectionKey returns the identity of the connection of a TCP or UDP flow.
+// It's empty until both its addresses are known.
+func (f *flow) connectionKey() string {
+	if (f.proto != protoTCP && f.proto != protoUDP) || !f.hasCompleteTuple() {
+		return ""
+	}
+	return localFlowKey(f.netNS(), f.proto, f.local.addr.String(), f.remote.addr.String())
+}
+
+// indexConnection records the connection of a flow once its addresses are
+// known, so that the flows of other socks for the same connection are
+// coalesced into it.
+func (s *state) indexConnection(f *flow) {
+	if s.connections == nil || f.connKey != "" {
+		return
+	}
+	if f.connKey = f.connectionKey(); f.connKey == "" {
+		return
+	}
+	if _, found := s.connections[f.connKey]; !found {
+		s.connections[f.connKey] = f
+	}
+}
+
+// coalesceConnection attaches the new flow of a sock to the active flow of
+// another sock for the same connection. It returns false when there's none.
+func (s *state) coalesceConnection(sock *socket, ref *flow) bool {
+	if s.connections == nil {
+		return false
+	}
+	key := ref.connectionKey()
+	if key == "" {
+		return false
+	}
+	existing, found := s.connections[key]
+	if !found || existing.done || existing.heldBy(sock.sock) {
+		return false
+	}
+	existing.updateWith(*ref, s)
+	existing.otherSocks = append(existing.otherSocks, sock.sock)
+	sock.flows[ref.remote.addr.String()] = existing
+	s.flowLRU.Remove(existing)
+	s.flowLRU.Add(existing)
+	return true
+}
+
+// heldBy returns whether the given sock is one of the socks of the flow.
+func (f *flow) heldBy(ptr uintptr) bool {
+	if f.sock == ptr {
+		return true
+	}
+	for _, other := range f.otherSocks {
+		if other == ptr {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseConnection detaches a terminated sock from a flow shared with other
+// socks. It returns whether the flow is still held by another sock, in which
+// case it must not be terminated yet.
+func (s *state) releaseConnection(f *flow, ptr uintptr) bool {
+	if len(f.otherSocks) == 0 || !f.heldBy(ptr) {
+		return false
+	}
+	if f.sock == ptr {
+		f.sock = f.otherSocks[0]
+		f.otherSocks = f.otherSocks[1:]
+		return true
+	}
+	for i, other := range f.otherSocks {
+		if other == ptr {
+			f.otherSocks = append(f.otherSocks[:i], f.otherSocks[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// unindexConnection removes a terminated flow from the socks that shared it
+// and from the index of connections.
+func (s *state) unindexConnection(f *flow) {
+	for _, ptr := range f.otherSocks {
+		if parent, found := s.socks[ptr]; found && parent.flows[f.remote.addr.String()] == f {
+			delete(parent.flows, f.remote.addr.String())
+		}
+	}
+	f.otherSocks = nil
+	if f.connKey != "" && s.connections[f.connKey] == f {
+		delete(s.connections, f.connKey)
+	}
+}
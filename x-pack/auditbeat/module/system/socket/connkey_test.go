@@ -0,0 +1,120 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func udpSendEvents(tid uint32, sock uintptr, ts uint64, size uint32) []event {
+	return []event{
+		&inetCreate{Meta: meta(1234, tid, ts), Proto: 0},
+		&sockInitData{Meta: meta(1234, tid, ts), Sock: sock},
+		&udpSendMsgCall{
+			Meta:     meta(1234, tid, ts+1),
+			Sock:     sock,
+			Size:     size,
+			LAddr:    ipv4(testLocalIP),
+			AltRAddr: ipv4(testRemoteIP),
+			LPort:    be16(testLocalPort),
+			AltRPort: be16(testRemotePort),
+		},
+	}
+}
+
+func TestFlowKey(t *testing.T) {
+	const otherSock = testSock + 0x1000
+	release := func(sock uintptr, ts uint64) event {
+		return &inetReleaseCall{Meta: meta(1234, 1235, ts), Sock: sock}
+	}
+	for _, tc := range []struct {
+		name string
+		key  string
+		evs  []event
+		// bytes sent by each reported flow.
+		bytes []uint64
+	}{
+		{
+			// A sock shared by duplicated file descriptors is always a
+			// single flow, as dup() doesn't create a new sock.
+			name: "dup socket",
+			key:  flowKeySocket,
+			evs: append(udpSendEvents(1235, testSock, 5, 100),
+				&udpSendMsgCall{Meta: meta(1234, 1236, 7), Sock: testSock, Size: 100, LAddr: ipv4(testLocalIP), AltRAddr: ipv4(testRemoteIP), LPort: be16(testLocalPort), AltRPort: be16(testRemotePort)},
+				release(testSock, 10)),
+			bytes: []uint64{256},
+		},
+		{
+			name: "dup connection",
+			key:  flowKeyConnection,
+			evs: append(udpSendEvents(1235, testSock, 5, 100),
+				&udpSendMsgCall{Meta: meta(1234, 1236, 7), Sock: testSock, Size: 100, LAddr: ipv4(testLocalIP), AltRAddr: ipv4(testRemoteIP), LPort: be16(testLocalPort), AltRPort: be16(testRemotePort)},
+				release(testSock, 10)),
+			bytes: []uint64{256},
+		},
+		{
+			// Two socks with the same addresses, as with SO_REUSEPORT.
+			name: "two socks by socket",
+			key:  flowKeySocket,
+			evs: append(append(udpSendEvents(1235, testSock, 5, 100), udpSendEvents(1236, otherSock, 7, 200)...),
+				release(testSock, 10), release(otherSock, 11)),
+			bytes: []uint64{128, 228},
+		},
+		{
+			name: "two socks by connection",
+			key:  flowKeyConnection,
+			evs: append(append(udpSendEvents(1235, testSock, 5, 100), udpSendEvents(1236, otherSock, 7, 200)...),
+				release(testSock, 10), release(otherSock, 11)),
+			bytes: []uint64{356},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withFlowKey(tc.key)(&st.state)
+			st.readNetNS = func(uint32) (uint64, error) { return 4026531992, nil }
+			st.feedEvents(tc.evs)
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, len(tc.bytes)) {
+				t.FailNow()
+			}
+			var bytes []uint64
+			for _, f := range flows {
+				v, err := f.GetValue("source.bytes")
+				if assert.NoError(t, err) {
+					bytes = append(bytes, v.(uint64))
+				}
+			}
+			assert.ElementsMatch(t, tc.bytes, bytes)
+		})
+	}
+}
+
+func TestFlowKeyConnectionOutlivesSock(t *testing.T) {
+	const otherSock = testSock + 0x1000
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withFlowKey(flowKeyConnection)(&st.state)
+	st.readNetNS = func(uint32) (uint64, error) { return 4026531992, nil }
+
+	st.feedEvents(append(udpSendEvents(1235, testSock, 5, 100), udpSendEvents(1236, otherSock, 7, 200)...))
+	// The flow is still held by the other sock.
+	st.feedEvents([]event{&inetReleaseCall{Meta: meta(1234, 1235, 10), Sock: testSock}})
+	st.ExpireFlows()
+	assert.Empty(t, st.getFlows())
+	assert.Len(t, st.connections, 1)
+
+	st.feedEvents([]event{&inetReleaseCall{Meta: meta(1234, 1236, 11), Sock: otherSock}})
+	st.ExpireFlows()
+	if flows := st.getFlows(); assert.Len(t, flows, 1) {
+		assertValue(t, flows[0], uint64(2), "source.packets")
+		assertValue(t, flows[0], uint64(356), "source.bytes")
+	}
+	assert.Empty(t, st.connections)
+}
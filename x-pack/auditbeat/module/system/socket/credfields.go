@@ -0,0 +1,101 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"strconv"
+
+	"github.com/elastic/go-sysinfo/types"
+)
+
+// credFields is a set of process credential fields.
+type credFields uint8
+
+const (
+	credUID credFields = 1 << iota
+	credEUID
+	credGID
+	credEGID
+
+	allCredFields = credUID | credEUID | credGID | credEGID
+)
+
+var credFieldsByName = map[string]credFields{
+	"uid":  credUID,
+	"euid": credEUID,
+	"gid":  credGID,
+	"egid": credEGID,
+}
+
+// newCredFields returns the set of the given field names, which are already
+// validated by the config.
+func newCredFields(names []string) (fields credFields) {
+	for _, name := range names {
+		fields |= credFieldsByName[name]
+	}
+	return fields
+}
+
+func (c credFields) has(field credFields) bool {
+	return c&field != 0
+}
+
+// withProcessCredFields sets the credential fields captured for processes.
+// All of them are captured by default.
+func withProcessCredFields(fields credFields) stateOption {
+	return func(s *state) {
+		s.credFields = fields
+	}
+}
+
+// setCreds sets the credentials of a process, keeping only the given fields.
+func (p *process) setCreds(fields credFields, uid, gid, euid, egid uint32) {
+	p.credFields = fields
+	p.hasCreds = fields != 0
+	p.uid, p.gid, p.euid, p.egid = 0, 0, 0, 0
+	if fields.has(credUID) {
+		p.uid = uid
+	}
+	if fields.has(credGID) {
+		p.gid = gid
+	}
+	if fields.has(credEUID) {
+		p.euid = euid
+	}
+	if fields.has(credEGID) {
+		p.egid = egid
+	}
+}
+
+// maskCreds drops the credentials of a process not in the given fields.
+func (p *process) maskCreds(fields credFields) {
+	if p.hasCreds {
+		p.setCreds(p.credFields&fields, p.uid, p.gid, p.euid, p.egid)
+	}
+}
+
+// userInfoReader reads the credentials of a process from /proc.
+type userInfoReader interface {
+	User() (types.UserInfo, error)
+}
+
+// readProcessCreds sets the given credential fields of a process from /proc.
+// Nothing is read when no field is wanted.
+func readProcessCreds(r userInfoReader, fields credFields, p *process) {
+	if fields == 0 {
+		return
+	}
+	user, err := r.User()
+	if err != nil {
+		return
+	}
+	toUint32 := func(id string) uint32 {
+		num, _ := strconv.Atoi(id)
+		return uint32(num)
+	}
+	p.setCreds(fields, toUint32(user.UID), toUint32(user.GID), toUint32(user.EUID), toUint32(user.EGID))
+}
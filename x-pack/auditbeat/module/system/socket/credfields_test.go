@@ -0,0 +1,87 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/go-sysinfo/types"
+)
+
+// countingUserReader counts the reads of the credentials of a process.
+type countingUserReader struct {
+	reads int
+}
+
+func (r *countingUserReader) User() (types.UserInfo, error) {
+	r.reads++
+	return types.UserInfo{UID: "501", EUID: "0", GID: "20", EGID: "30"}, nil
+}
+
+func TestReadProcessCreds(t *testing.T) {
+	r := &countingUserReader{}
+	p := &process{pid: 1234}
+	readProcessCreds(r, 0, p)
+	assert.Zero(t, r.reads, "creds were read with no field selected")
+	assert.False(t, p.hasCreds)
+
+	readProcessCreds(r, newCredFields([]string{"uid", "egid"}), p)
+	assert.Equal(t, 1, r.reads)
+	assert.True(t, p.hasCreds)
+	assert.Equal(t, credUID|credEGID, p.credFields)
+	assert.EqualValues(t, 501, p.uid)
+	assert.EqualValues(t, 30, p.egid)
+	assert.Zero(t, p.euid)
+	assert.Zero(t, p.gid)
+
+	readProcessCreds(r, allCredFields, p)
+	assert.EqualValues(t, []uint32{501, 0, 20, 30}, []uint32{p.uid, p.euid, p.gid, p.egid})
+}
+
+func TestProcessCredFields(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		fields  []string
+		present []string
+		absent  []string
+	}{
+		{name: "all", fields: []string{"uid", "euid", "gid", "egid"}, present: []string{"user.id", "group.id"}},
+		{name: "uid", fields: []string{"uid"}, present: []string{"user.id"}, absent: []string{"group.id"}},
+		{name: "none", absent: []string{"user.id", "group.id"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withProcessCredFields(newCredFields(tc.fields))(&st.state)
+			st.feedEvents(append([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl", "https://example.net/"}),
+				&commitCreds{Meta: meta(1234, 1234, 2), UID: 501, GID: 20, EUID: 501, EGID: 20},
+				&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+			}, tcpConnectEvents(1234, 3, 4)...))
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			for _, field := range tc.present {
+				_, err := flows[0].GetValue(field)
+				assert.NoError(t, err, field)
+			}
+			for _, field := range tc.absent {
+				_, err := flows[0].GetValue(field)
+				assert.Error(t, err, field)
+			}
+			proc := st.getProcess(1234)
+			assert.Equal(t, newCredFields(tc.fields), proc.credFields)
+			if tc.name == "uid" {
+				assert.Zero(t, proc.gid)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"encoding/json"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/elastic-agent-libs/file"
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+const (
+	// Size at which the debug event file is rotated.
+	debugEventFileMaxSize = 32 * 1024 * 1024
+	// Number of rotated debug event files to keep.
+	debugEventFileMaxBackups = 2
+)
+
+// debugEventFile is a reporter that writes every event as NDJSON to a local
+// file before passing it to the wrapped reporter. It's a development aid to
+// inspect the dataset's output without an output pipeline.
+type debugEventFile struct {
+	mb.PushReporterV2
+	rotator *file.Rotator
+	log     *logp.Logger
+}
+
+func newDebugEventFile(r mb.PushReporterV2, path string, log *logp.Logger) (*debugEventFile, error) {
+	rotator, err := file.NewFileRotator(path,
+		file.MaxSizeBytes(debugEventFileMaxSize),
+		file.MaxBackups(debugEventFileMaxBackups),
+		file.RotateOnStartup(true),
+		file.WithLogger(logp.NewLogger("rotator").With(logp.Namespace("rotator"))),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &debugEventFile{
+		PushReporterV2: r,
+		rotator:        rotator,
+		log:            log,
+	}, nil
+}
+
+// marshalEvent returns the JSON document of an event as it's published.
+func marshalEvent(event mb.Event) ([]byte, error) {
+	// BeatEvent modifies the event, so render a copy using the same namespace
+	// as the metricset's reporter.
+	rendered := event
+	rendered.RootFields = event.RootFields.Clone()
+	rendered.ModuleFields = event.ModuleFields.Clone()
+	rendered.MetricSetFields = event.MetricSetFields.Clone()
+	rendered.Namespace = namespace
+	ev := rendered.BeatEvent(moduleName, metricsetName)
+	ev.Fields["@timestamp"] = ev.Timestamp
+	return json.Marshal(ev.Fields)
+}
+
+// Event writes the event to the file and then reports it.
+func (d *debugEventFile) Event(event mb.Event) bool {
+	if line, err := marshalEvent(event); err != nil {
+		d.log.Warnf("Failed to serialize event for debug event file: %v", err)
+	} else if _, err = d.rotator.Write(append(line, '\n')); err != nil {
+		d.log.Warnf("Failed to write to debug event file: %v", err)
+	}
+	return d.PushReporterV2.Event(event)
+}
+
+// Close closes the file.
+func (d *debugEventFile) Close() error {
+	return d.rotator.Close()
+}
@@ -0,0 +1,80 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+func TestDebugEventFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events")
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	debugFile, err := newDebugEventFile(st, path, logp.NewLogger(metricsetName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range []int{80, 443} {
+		debugFile.Event(mb.Event{
+			RootFields:      mapstr.M{"destination": mapstr.M{"port": port}},
+			MetricSetFields: mapstr.M{"kernel_sock_address": "0x1234"},
+		})
+	}
+	if err = debugFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events are passed unmodified to the wrapped reporter.
+	flows := st.getFlows()
+	if !assert.Len(t, flows, 2) {
+		t.FailNow()
+	}
+	assertValue(t, flows[1], 443, "destination.port")
+
+	// The rotator appends the date and the ndjson extension.
+	files, err := filepath.Glob(path + "-*.ndjson")
+	if err != nil || !assert.Len(t, files, 1) {
+		t.FailNow()
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []mapstr.M
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var doc mapstr.M
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			t.Fatalf("invalid line '%s': %v", scanner.Text(), err)
+		}
+		lines = append(lines, doc)
+	}
+	if !assert.Len(t, lines, 2) {
+		t.FailNow()
+	}
+	for idx, port := range []float64{80, 443} {
+		for key, expected := range map[string]interface{}{
+			"destination.port":                        port,
+			"system.audit.socket.kernel_sock_address": "0x1234",
+		} {
+			value, err := lines[idx].GetValue(key)
+			assert.NoError(t, err, key)
+			assert.Equal(t, expected, value, key)
+		}
+		assert.Contains(t, lines[idx], "@timestamp")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"reflect"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+)
+
+// detailSampler selects the events logged by the detailed debug selector, so
+// that only a fraction of them is logged. The selection is deterministic: all
+// the events for the same socket are either logged or not, so that the
+// sampled flows can be followed. Events without a socket, such as those of
+// processes, are selected by thread.
+//
+// It isn't safe for concurrent use, as it's only used by the dispatch loop.
+type detailSampler struct {
+	// threshold is compared with the upper 32 bits of the hash of the key of
+	// an event.
+	threshold uint64
+	// fields caches where the key is found in each type of event.
+	fields map[reflect.Type]detailKeyFields
+}
+
+// detailKeyFields holds the indexes of the fields of an event struct that
+// hold its socket and metadata, or -1 when it has none.
+type detailKeyFields struct {
+	sock, meta int
+}
+
+func newDetailSampler(rate float64) *detailSampler {
+	return &detailSampler{
+		threshold: uint64(rate * (1 << 32)),
+		fields:    make(map[reflect.Type]detailKeyFields),
+	}
+}
+
+// sampled returns whether the event must be logged.
+func (d *detailSampler) sampled(ev event) bool {
+	if d.threshold >= 1<<32 {
+		return true
+	}
+	return mixKey(d.key(ev))>>32 < d.threshold
+}
+
+// key returns the socket of an event, or its thread when it has none.
+func (d *detailSampler) key(ev event) uint64 {
+	v := reflect.ValueOf(ev)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return 0
+	}
+	fields, found := d.fields[v.Type()]
+	if !found {
+		fields = detailKeyFields{sock: -1, meta: -1}
+		if f, ok := v.Type().FieldByName("Sock"); ok && len(f.Index) == 1 && f.Type.Kind() == reflect.Uintptr {
+			fields.sock = f.Index[0]
+		}
+		if f, ok := v.Type().FieldByName("Meta"); ok && len(f.Index) == 1 && f.Type == reflect.TypeOf(tracing.Metadata{}) {
+			fields.meta = f.Index[0]
+		}
+		d.fields[v.Type()] = fields
+	}
+	switch {
+	case fields.sock != -1:
+		return uint64(v.Field(fields.sock).Uint())
+	case fields.meta != -1:
+		return uint64(v.Field(fields.meta).Interface().(tracing.Metadata).TID)
+	}
+	return 0
+}
+
+// mixKey spreads the bits of a key, so that sockets allocated close to each
+// other aren't sampled together. It's the finalizer of splitmix64.
+func mixKey(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,41 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetailSampler(t *testing.T) {
+	all := newDetailSampler(1)
+	for sock := uintptr(1); sock <= 1000; sock++ {
+		assert.True(t, all.sampled(&tcpReset{Meta: meta(1, 1, 1), Sock: sock}))
+	}
+
+	const numSocks = 10000
+	d := newDetailSampler(0.1)
+	sampled := 0
+	for sock := uintptr(0xffff9f1ddc5eb000); sock < 0xffff9f1ddc5eb000+numSocks*64; sock += 64 {
+		s := d.sampled(&tcpReset{Meta: meta(1, 1, 1), Sock: sock})
+		if s {
+			sampled++
+		}
+		// All the events of a socket are sampled alike, whatever their
+		// thread or type.
+		assert.Equal(t, s, d.sampled(&tcpReset{Meta: meta(2, 2, 2), Sock: sock}))
+		assert.Equal(t, s, d.sampled(&tcpFastOpen{Meta: meta(3, 3, 3), Sock: sock}))
+	}
+	assert.InDelta(t, numSocks/10, sampled, numSocks/50)
+
+	// Events without a socket are sampled by thread.
+	for tid := uint32(1); tid <= 100; tid++ {
+		s := d.sampled(&execveRet{Meta: meta(tid, tid, 1)})
+		assert.Equal(t, s, d.sampled(&forkRet{Meta: meta(tid, tid, 2)}))
+	}
+}
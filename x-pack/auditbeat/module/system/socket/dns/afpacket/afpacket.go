@@ -11,13 +11,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net"
 	"os"
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/miekg/dns"
-	"golang.org/x/net/bpf"
 
 	"github.com/elastic/beats/v7/metricbeat/mb"
 
@@ -29,25 +26,6 @@ import (
 	"github.com/elastic/elastic-agent-libs/logp"
 )
 
-var udpSrcPort53Filter = []bpf.RawInstruction{
-	{Op: 0x28, Jt: 0x0, Jf: 0x0, K: 0xc},
-	{Op: 0x15, Jt: 0x0, Jf: 0x4, K: 0x86dd},
-	{Op: 0x30, Jt: 0x0, Jf: 0x0, K: 0x14},
-	{Op: 0x15, Jt: 0x0, Jf: 0xb, K: 0x11},
-	{Op: 0x28, Jt: 0x0, Jf: 0x0, K: 0x36},
-	{Op: 0x15, Jt: 0x8, Jf: 0x9, K: 0x35},
-	{Op: 0x15, Jt: 0x0, Jf: 0x8, K: 0x800},
-	{Op: 0x30, Jt: 0x0, Jf: 0x0, K: 0x17},
-	{Op: 0x15, Jt: 0x0, Jf: 0x6, K: 0x11},
-	{Op: 0x28, Jt: 0x0, Jf: 0x0, K: 0x14},
-	{Op: 0x45, Jt: 0x4, Jf: 0x0, K: 0x1fff},
-	{Op: 0xb1, Jt: 0x0, Jf: 0x0, K: 0xe},
-	{Op: 0x48, Jt: 0x0, Jf: 0x0, K: 0xe},
-	{Op: 0x15, Jt: 0x0, Jf: 0x1, K: 0x35},
-	{Op: 0x6, Jt: 0x0, Jf: 0x0, K: 0xffff},
-	{Op: 0x6, Jt: 0x0, Jf: 0x0, K: 0x0},
-}
-
 type dnsCapture struct {
 	tPacket *afpacket.TPacket
 	log     *logp.Logger
@@ -62,7 +40,10 @@ func newAFPacketSniffer(base mb.BaseMetricSet, log *logp.Logger) (parent.Sniffer
 	if err := base.Module().UnpackConfig(&config); err != nil {
 		return nil, fmt.Errorf("failed to unpack af_packet config: %w", err)
 	}
+	return newDNSCapture(config, log)
+}
 
+func newDNSCapture(config config, log *logp.Logger) (*dnsCapture, error) {
 	frameSize, blockSize, numBlocks, err := afpacketComputeSize(8*humanize.MiByte, config.Snaplen, os.Getpagesize())
 	if err != nil {
 		return nil, err
@@ -87,7 +68,7 @@ func newAFPacketSniffer(base mb.BaseMetricSet, log *logp.Logger) (parent.Sniffer
 		return nil, fmt.Errorf("failed creating af_packet sniffer: %w", err)
 	}
 
-	if err = tPacket.SetBPF(udpSrcPort53Filter); err != nil {
+	if err = tPacket.SetBPF(parent.UDPSrcPort53Filter); err != nil {
 		tPacket.Close()
 		return nil, fmt.Errorf("failed setting BPF filter: %w", err)
 	}
@@ -106,46 +87,6 @@ func (c *dnsCapture) Monitor(ctx context.Context, consumer parent.Consumer) erro
 	return nil
 }
 
-var (
-	errNotIP  = errors.New("network is not IP")
-	errNotUDP = errors.New("transport is not UDP")
-)
-
-func dupSlice(in []byte) []byte {
-	out := make([]byte, len(in))
-	copy(out, in)
-	return out
-}
-
-func getEndpoints(pkt gopacket.Packet) (src net.UDPAddr, dst net.UDPAddr, err error) {
-	netLayer := pkt.NetworkLayer()
-	if netLayer == nil {
-		return src, dst, errNotIP
-	}
-	switch v := netLayer.(type) {
-	case *layers.IPv4:
-		src.IP = dupSlice(v.SrcIP)
-		dst.IP = dupSlice(v.DstIP)
-	case *layers.IPv6:
-		src.IP = dupSlice(v.SrcIP)
-		dst.IP = dupSlice(v.DstIP)
-	default:
-		return src, dst, errNotIP
-	}
-	transLayer := pkt.TransportLayer()
-	if transLayer == nil ||
-		transLayer.LayerType() != layers.LayerTypeUDP {
-		return src, dst, errNotUDP
-	}
-	udp, ok := transLayer.(*layers.UDP)
-	if !ok {
-		return src, dst, errNotUDP
-	}
-	src.Port = int(udp.SrcPort)
-	dst.Port = int(udp.DstPort)
-	return src, dst, nil
-}
-
 func (c *dnsCapture) run(ctx context.Context, consumer parent.Consumer) {
 	defer c.tPacket.Close()
 	source := gopacket.ZeroCopyPacketDataSource(c.tPacket)
@@ -166,48 +107,12 @@ func (c *dnsCapture) run(ctx context.Context, consumer parent.Consumer) {
 			return
 		}
 
-		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.NoCopy)
-		src, dst, err := getEndpoints(pkt)
+		tr, ok, err := parent.ParseResponse(data, layers.LayerTypeEthernet)
 		if err != nil {
-			c.log.Warn("Failed to decode UDP packet.", err)
+			c.log.Warn("Failed to decode DNS response.", err)
 			continue
 		}
-		msg := &dns.Msg{}
-		if err = msg.Unpack(pkt.TransportLayer().LayerPayload()); err != nil {
-			c.log.Warn("Failed to unpack UDP payload from port 53.", err)
-			continue
-		}
-
-		if len(msg.Question) == 0 || (msg.Question[0].Qtype != dns.TypeA && msg.Question[0].Qtype != dns.TypeAAAA) {
-			continue
-		}
-		questionName := trimRightDot(msg.Question[0].Name)
-		tr := parent.Transaction{
-			TXID:      msg.Id,
-			Client:    dst,
-			Server:    src,
-			Domain:    questionName,
-			Addresses: make([]net.IP, 0, len(msg.Answer)),
-		}
-		for _, ans := range msg.Answer {
-			switch ans.Header().Rrtype {
-			case dns.TypeA:
-				if a, ok := ans.(*dns.A); ok {
-					tr.Addresses = append(tr.Addresses, a.A)
-				} else {
-					c.log.Debug("Unexpected type for DNS A response")
-				}
-			case dns.TypeAAAA:
-				if a, ok := ans.(*dns.AAAA); ok {
-					tr.Addresses = append(tr.Addresses, a.AAAA)
-				} else {
-					c.log.Debug("Unexpected type for DNS AAAA response")
-				}
-			default:
-				continue
-			}
-		}
-		if len(tr.Addresses) > 0 {
+		if ok {
 			if c.log.IsDebug() {
 				c.log.Debugf("Got DNS transaction client=%s server=%s domain=%s addresses=%v",
 					tr.Client.String(),
@@ -245,10 +150,3 @@ func afpacketComputeSize(targetSize int, snaplen int, pageSize int) (
 
 	return frameSize, blockSize, numBlocks, nil
 }
-
-func trimRightDot(name string) string {
-	if len(name) == 0 || name == "." || name[len(name)-1] != '.' {
-		return name
-	}
-	return name[:len(name)-1]
-}
@@ -4,16 +4,62 @@
 
 package dns
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+)
+
 type config struct {
 	// Enabled toggles the DNS monitoring feature.
 	Enabled bool `config:"socket.dns.enabled"`
 	// Type is the dns monitoring implementation used.
 	Type string `config:"socket.dns.type"`
+	// RecordTypes are the types of the queries whose transactions are
+	// delivered, A and/or AAAA.
+	RecordTypes []string `config:"socket.dns.record_types"`
 }
 
 func defaultConfig() config {
 	return config{
-		Enabled: true,
-		Type:    "af_packet",
+		Enabled:     true,
+		Type:        "af_packet",
+		RecordTypes: []string{"A", "AAAA"},
+	}
+}
+
+// Validate validates the config.
+func (c *config) Validate() error {
+	if len(c.RecordTypes) == 0 {
+		return errors.New("socket.dns.record_types must not be empty")
+	}
+	for _, name := range c.RecordTypes {
+		if _, err := parseRecordType(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordTypes returns the query types to deliver.
+func (c *config) recordTypes() map[uint16]bool {
+	types := make(map[uint16]bool, len(c.RecordTypes))
+	for _, name := range c.RecordTypes {
+		// Already validated.
+		qtype, _ := parseRecordType(name)
+		types[qtype] = true
+	}
+	return types
+}
+
+func parseRecordType(name string) (uint16, error) {
+	switch strings.ToUpper(name) {
+	case "A":
+		return mdns.TypeA, nil
+	case "AAAA":
+		return mdns.TypeAAAA, nil
 	}
+	return 0, fmt.Errorf("invalid socket.dns.record_types '%s': must be 'A' or 'AAAA'", name)
 }
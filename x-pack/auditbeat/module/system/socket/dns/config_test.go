@@ -0,0 +1,53 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dns
+
+import (
+	"context"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigRecordTypes(t *testing.T) {
+	c := defaultConfig()
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, map[uint16]bool{mdns.TypeA: true, mdns.TypeAAAA: true}, c.recordTypes())
+
+	c.RecordTypes = []string{"a"}
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, map[uint16]bool{mdns.TypeA: true}, c.recordTypes())
+
+	c.RecordTypes = []string{"AAAA", "MX"}
+	assert.EqualError(t, c.Validate(), "invalid socket.dns.record_types 'MX': must be 'A' or 'AAAA'")
+
+	c.RecordTypes = nil
+	assert.Error(t, c.Validate())
+}
+
+type fakeSniffer []Transaction
+
+func (s fakeSniffer) Monitor(_ context.Context, consumer Consumer) error {
+	for _, tr := range s {
+		consumer(tr)
+	}
+	return nil
+}
+
+func TestTypeFilter(t *testing.T) {
+	sniffer := typeFilter{
+		sniffer: fakeSniffer{
+			{Domain: "v4.example.net", Type: mdns.TypeA},
+			{Domain: "v6.example.net", Type: mdns.TypeAAAA},
+		},
+		types: map[uint16]bool{mdns.TypeA: true},
+	}
+	var domains []string
+	assert.NoError(t, sniffer.Monitor(context.Background(), func(tr Transaction) {
+		domains = append(domains, tr.Domain)
+	}))
+	assert.Equal(t, []string{"v4.example.net"}, domains)
+}
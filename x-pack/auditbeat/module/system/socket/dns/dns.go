@@ -8,17 +8,23 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strconv"
+
+	mdns "github.com/miekg/dns"
 
 	"github.com/elastic/beats/v7/metricbeat/mb"
 	"github.com/elastic/elastic-agent-libs/logp"
 )
 
-// Transaction represents a DNS transaction of A or AAAA type.
+// Transaction represents a DNS transaction of A or AAAA type. Sniffers only
+// report transactions that received a response.
 type Transaction struct {
 	// TXID is the transaction ID.
 	TXID uint16
 
-	// Client is the address of the client side of the transaction
+	// Client is the address of the client side of the transaction, that is,
+	// the local endpoint the query was sent from. It's used to correlate the
+	// transaction with the process that owns the socket.
 	Client net.UDPAddr
 
 	// Server if the address of the DNS server.
@@ -27,16 +33,45 @@ type Transaction struct {
 	// Domain is the name queried by the client.
 	Domain string
 
+	// Type is the type of the query, mdns.TypeA or mdns.TypeAAAA.
+	Type uint16
+
 	// Addresses is the list of A or AAAA addresses in the response.
 	Addresses []net.IP
+
+	// ResponseCode is the RCODE of the response, such as mdns.RcodeSuccess or
+	// mdns.RcodeNameError for NXDOMAIN.
+	ResponseCode int
+
+	// PID is the process that made the query, for the backends that observe
+	// the resolver instead of the network. The Client and Server addresses
+	// are unset in this case. It's zero when unknown.
+	PID uint32
+}
+
+// ResponseCodeName returns the mnemonic of a response code, such as NXDOMAIN.
+func ResponseCodeName(code int) string {
+	if name, found := mdns.RcodeToString[code]; found {
+		return name
+	}
+	return strconv.Itoa(code)
+}
+
+// RecordTypeName returns the mnemonic of a record type, such as AAAA.
+func RecordTypeName(qtype uint16) string {
+	return mdns.Type(qtype).String()
 }
 
-// Consumer is a function that consumes DNS transactions.
+// Consumer is a function that consumes DNS transactions. It's safe to call
+// from any goroutine.
 type Consumer func(Transaction)
 
 // Sniffer is the interface implemented by DNS transaction sniffers.
 type Sniffer interface {
-	// Monitor starts monitoring for DNS transactions in the background.
+	// Monitor starts monitoring for DNS transactions in the background. It
+	// must return once monitoring has started, with an error if it couldn't
+	// be started. Transactions are passed to the consumer until the context
+	// is cancelled, after which the sniffer must release its resources.
 	Monitor(ctx context.Context, consumer Consumer) error
 }
 
@@ -47,7 +82,8 @@ func (noopSniffer) Monitor(context.Context, Consumer) error {
 	return nil
 }
 
-// NewSniffer creates a new sniffer based on the metricset's config.
+// NewSniffer creates a new sniffer based on the metricset's config, using the
+// implementation selected by socket.dns.type.
 func NewSniffer(base mb.BaseMetricSet, log *logp.Logger) (Sniffer, error) {
 	config := defaultConfig()
 	if err := base.Module().UnpackConfig(&config); err != nil {
@@ -60,5 +96,29 @@ func NewSniffer(base mb.BaseMetricSet, log *logp.Logger) (Sniffer, error) {
 	if err != nil {
 		return nil, err
 	}
-	return factory(base, log)
+	sniffer, err := factory(base, log)
+	if err != nil {
+		return nil, err
+	}
+	if types := config.recordTypes(); len(types) == 1 {
+		// Only filter when a type is excluded.
+		sniffer = typeFilter{sniffer: sniffer, types: types}
+	}
+	return sniffer, nil
+}
+
+// typeFilter is a Sniffer that only delivers the transactions of the given
+// query types.
+type typeFilter struct {
+	sniffer Sniffer
+	types   map[uint16]bool
+}
+
+// Monitor starts the filtered sniffer.
+func (f typeFilter) Monitor(ctx context.Context, consumer Consumer) error {
+	return f.sniffer.Monitor(ctx, func(tr Transaction) {
+		if f.types[tr.Type] {
+			consumer(tr)
+		}
+	})
 }
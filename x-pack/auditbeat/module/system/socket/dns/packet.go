@@ -0,0 +1,142 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	mdns "github.com/miekg/dns"
+	"golang.org/x/net/bpf"
+)
+
+// UDPSrcPort53Filter is a classic BPF program that only accepts Ethernet
+// frames with an IPv4 or IPv6 UDP packet from port 53. Packet sniffers attach
+// it to their socket so that the kernel drops other packets.
+var UDPSrcPort53Filter = []bpf.RawInstruction{
+	{Op: 0x28, Jt: 0x0, Jf: 0x0, K: 0xc},
+	{Op: 0x15, Jt: 0x0, Jf: 0x4, K: 0x86dd},
+	{Op: 0x30, Jt: 0x0, Jf: 0x0, K: 0x14},
+	{Op: 0x15, Jt: 0x0, Jf: 0xb, K: 0x11},
+	{Op: 0x28, Jt: 0x0, Jf: 0x0, K: 0x36},
+	{Op: 0x15, Jt: 0x8, Jf: 0x9, K: 0x35},
+	{Op: 0x15, Jt: 0x0, Jf: 0x8, K: 0x800},
+	{Op: 0x30, Jt: 0x0, Jf: 0x0, K: 0x17},
+	{Op: 0x15, Jt: 0x0, Jf: 0x6, K: 0x11},
+	{Op: 0x28, Jt: 0x0, Jf: 0x0, K: 0x14},
+	{Op: 0x45, Jt: 0x4, Jf: 0x0, K: 0x1fff},
+	{Op: 0xb1, Jt: 0x0, Jf: 0x0, K: 0xe},
+	{Op: 0x48, Jt: 0x0, Jf: 0x0, K: 0xe},
+	{Op: 0x15, Jt: 0x0, Jf: 0x1, K: 0x35},
+	{Op: 0x6, Jt: 0x0, Jf: 0x0, K: 0xffff},
+	{Op: 0x6, Jt: 0x0, Jf: 0x0, K: 0x0},
+}
+
+var (
+	errNotIP  = errors.New("network is not IP")
+	errNotUDP = errors.New("transport is not UDP")
+)
+
+// ParseResponse decodes a DNS response from port 53 in a captured packet. The
+// first layer is the packet's link type, such as layers.LayerTypeEthernet for
+// Ethernet frames, or layers.LayerTypeIPv4 or layers.LayerTypeIPv6 for
+// packets captured without their link-layer header. It returns false when the
+// packet isn't the response to an A or AAAA query with at least one address
+// or an error response code, such as NXDOMAIN or SERVFAIL, and an error when
+// it can't be decoded. The packet isn't referenced by the
+// returned transaction, so that sniffers can reuse their buffers.
+//
+// All the packet sniffer backends use it, so that they report the same
+// transactions.
+func ParseResponse(data []byte, first gopacket.LayerType) (tr Transaction, ok bool, err error) {
+	pkt := gopacket.NewPacket(data, first, gopacket.NoCopy)
+	src, dst, err := getEndpoints(pkt)
+	if err != nil {
+		return tr, false, fmt.Errorf("failed to decode UDP packet: %w", err)
+	}
+	tr, ok, err = ParseMessage(pkt.TransportLayer().LayerPayload())
+	if err != nil {
+		return tr, false, fmt.Errorf("failed to unpack UDP payload from port 53: %w", err)
+	}
+	tr.Client, tr.Server = dst, src
+	return tr, ok, nil
+}
+
+// ParseMessage decodes a DNS response message, without its transport. It's
+// used by ParseResponse, and by the backends that get the message from the
+// resolver rather than from the network, which must set the transaction's
+// endpoints or PID themselves. It reports the same transactions as
+// ParseResponse.
+func ParseMessage(payload []byte) (tr Transaction, ok bool, err error) {
+	msg := &mdns.Msg{}
+	if err = msg.Unpack(payload); err != nil {
+		return tr, false, err
+	}
+	if len(msg.Question) == 0 || (msg.Question[0].Qtype != mdns.TypeA && msg.Question[0].Qtype != mdns.TypeAAAA) {
+		return tr, false, nil
+	}
+	tr = Transaction{
+		TXID:         msg.Id,
+		Domain:       trimRightDot(msg.Question[0].Name),
+		Type:         msg.Question[0].Qtype,
+		Addresses:    make([]net.IP, 0, len(msg.Answer)),
+		ResponseCode: msg.Rcode,
+	}
+	for _, ans := range msg.Answer {
+		// Unpack copies the addresses out of the message.
+		switch a := ans.(type) {
+		case *mdns.A:
+			tr.Addresses = append(tr.Addresses, a.A)
+		case *mdns.AAAA:
+			tr.Addresses = append(tr.Addresses, a.AAAA)
+		}
+	}
+	return tr, len(tr.Addresses) > 0 || tr.ResponseCode != mdns.RcodeSuccess, nil
+}
+
+func dupSlice(in []byte) []byte {
+	out := make([]byte, len(in))
+	copy(out, in)
+	return out
+}
+
+func getEndpoints(pkt gopacket.Packet) (src net.UDPAddr, dst net.UDPAddr, err error) {
+	netLayer := pkt.NetworkLayer()
+	if netLayer == nil {
+		return src, dst, errNotIP
+	}
+	switch v := netLayer.(type) {
+	case *layers.IPv4:
+		src.IP = dupSlice(v.SrcIP)
+		dst.IP = dupSlice(v.DstIP)
+	case *layers.IPv6:
+		src.IP = dupSlice(v.SrcIP)
+		dst.IP = dupSlice(v.DstIP)
+	default:
+		return src, dst, errNotIP
+	}
+	transLayer := pkt.TransportLayer()
+	if transLayer == nil ||
+		transLayer.LayerType() != layers.LayerTypeUDP {
+		return src, dst, errNotUDP
+	}
+	udp, ok := transLayer.(*layers.UDP)
+	if !ok {
+		return src, dst, errNotUDP
+	}
+	src.Port = int(udp.SrcPort)
+	dst.Port = int(udp.DstPort)
+	return src, dst, nil
+}
+
+func trimRightDot(name string) string {
+	if len(name) == 0 || name == "." || name[len(name)-1] != '.' {
+		return name
+	}
+	return name[:len(name)-1]
+}
@@ -0,0 +1,133 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeResponse(t testing.TB, qtype uint16, answers ...mdns.RR) []byte {
+	return makeResponseWithCode(t, qtype, mdns.RcodeSuccess, answers...)
+}
+
+func makeResponseWithCode(t testing.TB, qtype uint16, rcode int, answers ...mdns.RR) []byte {
+	msg := new(mdns.Msg)
+	msg.SetQuestion("example.net.", qtype)
+	msg.Id = 0x1234
+	msg.Response = true
+	msg.Rcode = rcode
+	msg.Answer = answers
+	payload, err := msg.Pack()
+	require.NoError(t, err)
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(192, 168, 0, 1).To4(),
+		DstIP:    net.IPv4(192, 168, 0, 2).To4(),
+	}
+	udp := &layers.UDP{SrcPort: 53, DstPort: 34567}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(payload)))
+	return buf.Bytes()
+}
+
+func TestParseResponse(t *testing.T) {
+	hdr := mdns.RR_Header{Name: "example.net.", Class: mdns.ClassINET, Ttl: 60}
+	a := hdr
+	a.Rrtype = mdns.TypeA
+	aaaa := hdr
+	aaaa.Rrtype = mdns.TypeAAAA
+	cname := hdr
+	cname.Rrtype = mdns.TypeCNAME
+
+	frame := makeResponse(t, mdns.TypeA,
+		&mdns.CNAME{Hdr: cname, Target: "www.example.net."},
+		&mdns.A{Hdr: a, A: net.IPv4(10, 0, 0, 1)},
+	)
+	tr, ok, err := ParseResponse(frame, layers.LayerTypeEthernet)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	// The transaction mustn't reference the frame.
+	for i := range frame {
+		frame[i] = 0
+	}
+	assert.Equal(t, uint16(0x1234), tr.TXID)
+	assert.Equal(t, "example.net", tr.Domain)
+	assert.Equal(t, mdns.TypeA, tr.Type)
+	assert.Equal(t, "192.168.0.2:34567", tr.Client.String())
+	assert.Equal(t, "192.168.0.1:53", tr.Server.String())
+	require.Len(t, tr.Addresses, 1)
+	assert.Equal(t, "10.0.0.1", tr.Addresses[0].String())
+	assert.Equal(t, mdns.RcodeSuccess, tr.ResponseCode)
+
+	tr, ok, err = ParseResponse(makeResponse(t, mdns.TypeAAAA,
+		&mdns.AAAA{Hdr: aaaa, AAAA: net.ParseIP("2001:db8::1")},
+	), layers.LayerTypeEthernet)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, mdns.TypeAAAA, tr.Type)
+	assert.Equal(t, []net.IP{net.ParseIP("2001:db8::1")}, tr.Addresses)
+
+	// Not an address query.
+	_, ok, err = ParseResponse(makeResponse(t, mdns.TypeMX), layers.LayerTypeEthernet)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// No addresses in the response.
+	_, ok, err = ParseResponse(makeResponse(t, mdns.TypeA), layers.LayerTypeEthernet)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Error responses are reported without addresses.
+	for _, rcode := range []int{mdns.RcodeNameError, mdns.RcodeServerFailure} {
+		tr, ok, err = ParseResponse(makeResponseWithCode(t, mdns.TypeA, rcode), layers.LayerTypeEthernet)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, rcode, tr.ResponseCode)
+		assert.Empty(t, tr.Addresses)
+	}
+
+	_, _, err = ParseResponse([]byte{1, 2, 3}, layers.LayerTypeEthernet)
+	assert.Error(t, err)
+
+	// Cooked packets, captured without their link-layer header.
+	frame = makeResponse(t, mdns.TypeA, &mdns.A{Hdr: a, A: net.IPv4(10, 0, 0, 1)})
+	tr, ok, err = ParseResponse(frame[14:], layers.LayerTypeIPv4)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "192.168.0.2:34567", tr.Client.String())
+	assert.Equal(t, []net.IP{net.IPv4(10, 0, 0, 1).To4()}, tr.Addresses)
+}
+
+func BenchmarkParseResponse(b *testing.B) {
+	hdr := mdns.RR_Header{Name: "example.net.", Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 60}
+	frame := makeResponse(b, mdns.TypeA,
+		&mdns.A{Hdr: hdr, A: net.IPv4(10, 0, 0, 1)},
+		&mdns.A{Hdr: hdr, A: net.IPv4(10, 0, 0, 2)},
+	)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok, err := ParseResponse(frame, layers.LayerTypeEthernet); err != nil || !ok {
+			b.Fatal(ok, err)
+		}
+	}
+}
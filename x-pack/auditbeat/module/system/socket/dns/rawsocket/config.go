@@ -0,0 +1,25 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build linux
+// +build linux
+
+package rawsocket
+
+type config struct {
+	// Interface to listen on. Defaults to "any".
+	Interface string `config:"socket.dns.raw_socket.interface"`
+	// Snaplen is the packet snapshot size.
+	Snaplen int `config:"socket.dns.raw_socket.snaplen"`
+	// ReceiveBuffer is the size of the socket's receive buffer. The kernel's
+	// default is used when zero.
+	ReceiveBuffer int `config:"socket.dns.raw_socket.receive_buffer"`
+}
+
+func defaultConfig() config {
+	return config{
+		Interface: "any",
+		Snaplen:   1024,
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build linux
+// +build linux
+
+// Package rawsocket implements a DNS sniffer that reads packets from an
+// AF_PACKET socket with a classic BPF filter attached, one recvfrom call per
+// packet. Unlike the af_packet backend, it doesn't allocate a memory-mapped
+// ring buffer.
+//
+// The socket is in cooked mode (SOCK_DGRAM): the kernel strips the link-layer
+// header, so that packets from any link type, including when capturing on all
+// interfaces, start at the IP header. The network protocol of each packet is
+// read from its link-layer address.
+package rawsocket
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+
+	parent "github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns"
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+// Timeout of the reads from the socket, so that the capture goroutine wakes
+// up periodically to check for termination.
+const readTimeout = 500 * time.Millisecond
+
+// udpSrcPort53Filter is the cooked-mode equivalent of parent.UDPSrcPort53Filter.
+// Offsets are relative to the network header and the protocol is loaded from
+// the packet's metadata, as there is no link-layer header.
+var udpSrcPort53Filter = mustAssemble([]bpf.Instruction{
+	/*  0 */ bpf.LoadExtension{Num: bpf.ExtProto},
+	/*  1 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.ETH_P_IPV6, SkipTrue: 4},
+	// IPv6: next header is UDP and source port is 53.
+	/*  2 */ bpf.LoadAbsolute{Off: 6, Size: 1},
+	/*  3 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.IPPROTO_UDP, SkipTrue: 11},
+	/*  4 */ bpf.LoadAbsolute{Off: 40, Size: 2},
+	/*  5 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 53, SkipTrue: 8, SkipFalse: 9},
+	// IPv4: protocol is UDP, first fragment, and source port is 53.
+	/*  6 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.ETH_P_IP, SkipTrue: 8},
+	/*  7 */ bpf.LoadAbsolute{Off: 9, Size: 1},
+	/*  8 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.IPPROTO_UDP, SkipTrue: 6},
+	/*  9 */ bpf.LoadAbsolute{Off: 6, Size: 2},
+	/* 10 */ bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+	/* 11 */ bpf.LoadMemShift{Off: 0},
+	/* 12 */ bpf.LoadIndirect{Off: 0, Size: 2},
+	/* 13 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 53, SkipTrue: 1},
+	/* 14 */ bpf.RetConstant{Val: 0xffff},
+	/* 15 */ bpf.RetConstant{Val: 0},
+})
+
+func mustAssemble(insns []bpf.Instruction) []bpf.RawInstruction {
+	filter, err := bpf.Assemble(insns)
+	if err != nil {
+		panic(err)
+	}
+	return filter
+}
+
+type dnsCapture struct {
+	fd      int
+	snaplen int
+	log     *logp.Logger
+}
+
+func init() {
+	parent.Registry.MustRegister("raw_socket", newRawSocketSniffer)
+}
+
+func newRawSocketSniffer(base mb.BaseMetricSet, log *logp.Logger) (parent.Sniffer, error) {
+	config := defaultConfig()
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, fmt.Errorf("failed to unpack raw_socket config: %w", err)
+	}
+	return newDNSCapture(config, log)
+}
+
+func newDNSCapture(config config, log *logp.Logger) (c *dnsCapture, err error) {
+	if config.Snaplen <= 0 {
+		return nil, fmt.Errorf("invalid snaplen %d", config.Snaplen)
+	}
+	// The socket doesn't receive packets until it's bound, so that none
+	// gets through before the filter is attached.
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating raw socket: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			unix.Close(fd)
+		}
+	}()
+	if err = attachFilter(fd, udpSrcPort53Filter); err != nil {
+		return nil, fmt.Errorf("failed setting BPF filter: %w", err)
+	}
+	tv := unix.NsecToTimeval(readTimeout.Nanoseconds())
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return nil, fmt.Errorf("failed setting read timeout: %w", err)
+	}
+	if config.ReceiveBuffer > 0 {
+		if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, config.ReceiveBuffer); err != nil {
+			return nil, fmt.Errorf("failed setting receive buffer size: %w", err)
+		}
+	}
+	addr := unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL)}
+	if config.Interface != "any" {
+		iface, err := net.InterfaceByName(config.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find interface '%s': %w", config.Interface, err)
+		}
+		addr.Ifindex = iface.Index
+	}
+	if err = unix.Bind(fd, &addr); err != nil {
+		return nil, fmt.Errorf("failed binding raw socket: %w", err)
+	}
+	return &dnsCapture{
+		fd:      fd,
+		snaplen: config.Snaplen,
+		log:     log,
+	}, nil
+}
+
+func attachFilter(fd int, filter []bpf.RawInstruction) error {
+	prog := make([]unix.SockFilter, len(filter))
+	for i, ins := range filter {
+		prog[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	})
+}
+
+// htons converts a short from host to network byte order.
+func htons(v uint16) uint16 {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	return *(*uint16)(unsafe.Pointer(&buf[0]))
+}
+
+// ntohs converts a short from network to host byte order.
+func ntohs(v uint16) uint16 {
+	return binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&v))[:])
+}
+
+// networkLayerType returns the layer type that a cooked packet starts with,
+// from the link-layer address it was received from.
+func networkLayerType(from unix.Sockaddr) (gopacket.LayerType, bool) {
+	ll, ok := from.(*unix.SockaddrLinklayer)
+	if !ok {
+		return 0, false
+	}
+	switch ntohs(ll.Protocol) {
+	case unix.ETH_P_IP:
+		return layers.LayerTypeIPv4, true
+	case unix.ETH_P_IPV6:
+		return layers.LayerTypeIPv6, true
+	}
+	return 0, false
+}
+
+// Monitor starts monitoring for DNS transactions in the background.
+func (c *dnsCapture) Monitor(ctx context.Context, consumer parent.Consumer) error {
+	go c.run(ctx, consumer)
+	return nil
+}
+
+func (c *dnsCapture) run(ctx context.Context, consumer parent.Consumer) {
+	defer unix.Close(c.fd)
+	buf := make([]byte, c.snaplen)
+	c.log.Info("Starting DNS capture.")
+	defer c.log.Info("Stopping DNS capture.")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		// Packets larger than the buffer are truncated, as with the snaplen
+		// of the af_packet backend.
+		n, from, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+			c.log.Error("DNS capture error", err)
+			return
+		}
+		first, ok := networkLayerType(from)
+		if !ok {
+			continue
+		}
+
+		tr, ok, err := parent.ParseResponse(buf[:n], first)
+		if err != nil {
+			c.log.Warn("Failed to decode DNS response.", err)
+			continue
+		}
+		if ok {
+			if c.log.IsDebug() {
+				c.log.Debugf("Got DNS transaction client=%s server=%s domain=%s addresses=%v",
+					tr.Client.String(),
+					tr.Server.String(),
+					tr.Domain,
+					tr.Addresses)
+			}
+			consumer(tr)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build linux
+// +build linux
+
+package rawsocket
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+
+	parent "github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns"
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+// BenchmarkCapture measures the cost of capturing DNS responses sent over the
+// loopback interface. Compare it with the af_packet backend's benchmark. It
+// requires CAP_NET_RAW and CAP_NET_BIND_SERVICE.
+func BenchmarkCapture(b *testing.B) {
+	config := defaultConfig()
+	config.Interface = "lo"
+	c, err := newDNSCapture(config, logp.NewLogger("dns"))
+	if err != nil {
+		b.Skip("can't create raw socket:", err)
+	}
+	benchmarkCapture(b, c)
+}
+
+func benchmarkCapture(b *testing.B, sniffer parent.Sniffer) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53})
+	if err != nil {
+		b.Skip("can't listen on port 53:", err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	msg := new(mdns.Msg)
+	msg.SetQuestion("example.net.", mdns.TypeA)
+	msg.Response = true
+	msg.Answer = []mdns.RR{&mdns.A{
+		Hdr: mdns.RR_Header{Name: "example.net.", Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 60},
+		A:   net.IPv4(10, 0, 0, 1),
+	}}
+	resp, err := msg.Pack()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var received int64
+	if err = sniffer.Monitor(ctx, func(parent.Transaction) {
+		atomic.AddInt64(&received, 1)
+	}); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = server.WriteTo(resp, client.LocalAddr()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&received) < int64(b.N) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&received))/float64(b.N), "captured/op")
+}
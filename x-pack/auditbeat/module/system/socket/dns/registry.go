@@ -5,24 +5,42 @@
 package dns
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/elastic/beats/v7/metricbeat/mb"
 	"github.com/elastic/elastic-agent-libs/logp"
 )
 
-// ImplFactory is a factory method for DNS monitoring implementations.
+// ImplFactory is a factory method for DNS monitoring implementations. It
+// receives the metricset so that the implementation can unpack its own
+// settings from the module configuration, conventionally under
+// socket.dns.<name>.
 type ImplFactory func(mb.BaseMetricSet, *logp.Logger) (Sniffer, error)
 
 type implRegistry struct {
+	lock   sync.RWMutex
 	byName map[string]ImplFactory
 }
 
-// Registry contains the registry of dns monitoring implementations
+// Registry contains the registry of dns monitoring implementations, also
+// known as sniffer backends. Backends register themselves from an init
+// function, so they are available when their package is imported.
 var Registry implRegistry
 
 // Register registers a new DNS monitoring implementation.
 func (r *implRegistry) Register(name string, factory ImplFactory) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if name == "" {
+		return errors.New("dns monitoring implementation name is required")
+	}
+	if factory == nil {
+		return fmt.Errorf("dns monitoring implementation '%s' has a nil factory", name)
+	}
 	if _, found := r.byName[name]; found {
 		return fmt.Errorf("dns monitoring implementation '%s' already registered", name)
 	}
@@ -42,9 +60,23 @@ func (r *implRegistry) MustRegister(name string, factory ImplFactory) {
 
 // Get returns a dns monitoring implementation by name.
 func (r *implRegistry) Get(name string) (ImplFactory, error) {
+	r.lock.RLock()
 	factory, found := r.byName[name]
+	r.lock.RUnlock()
 	if !found {
-		return nil, fmt.Errorf("no such dns monitoring implementation: '%s'", name)
+		return nil, fmt.Errorf("no such dns monitoring implementation: '%s' (available: %s)", name, strings.Join(r.Names(), ", "))
 	}
 	return factory, nil
 }
+
+// Names returns the sorted names of the registered implementations.
+func (r *implRegistry) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	names := make([]string, 0, len(r.byName))
+	for name := range r.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
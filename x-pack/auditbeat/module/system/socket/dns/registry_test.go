@@ -0,0 +1,34 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+func TestRegistry(t *testing.T) {
+	var r implRegistry
+	factory := func(mb.BaseMetricSet, *logp.Logger) (Sniffer, error) {
+		return noopSniffer{}, nil
+	}
+	assert.NoError(t, r.Register("pcap", factory))
+	assert.NoError(t, r.Register("af_packet", factory))
+	assert.Error(t, r.Register("pcap", factory))
+	assert.Error(t, r.Register("", factory))
+	assert.Error(t, r.Register("ebpf", nil))
+	assert.Equal(t, []string{"af_packet", "pcap"}, r.Names())
+
+	f, err := r.Get("pcap")
+	assert.NoError(t, err)
+	assert.NotNil(t, f)
+
+	_, err = r.Get("ebpf")
+	assert.EqualError(t, err, "no such dns monitoring implementation: 'ebpf' (available: af_packet, pcap)")
+}
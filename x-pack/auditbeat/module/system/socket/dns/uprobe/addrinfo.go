@@ -0,0 +1,112 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package uprobe
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+)
+
+// Layout of struct addrinfo, whose pointers are the size of the machine's:
+//
+//	int ai_flags, ai_family, ai_socktype, ai_protocol;
+//	socklen_t ai_addrlen;
+//	struct sockaddr *ai_addr;
+//	char *ai_canonname;
+//	struct addrinfo *ai_next;
+const (
+	ptrSize         = int(unsafe.Sizeof(uintptr(0)))
+	aiFamilyOffset  = 4
+	aiAddrLenOffset = 16
+	aiAddrOffset    = (20 + ptrSize - 1) / ptrSize * ptrSize
+	aiNextOffset    = aiAddrOffset + 2*ptrSize
+	aiSize          = aiNextOffset + ptrSize
+
+	sockaddrInLen  = 16
+	sockaddrIn6Len = 28
+)
+
+// Maximum number of entries read from an addrinfo list, to protect against
+// reading a corrupt list.
+const maxAddrInfo = 64
+
+// openMemory opens the memory of a process for reading.
+func openMemory(pid uint32) (*os.File, error) {
+	return os.Open(fmt.Sprintf("/proc/%d/mem", pid))
+}
+
+// readPointer reads a pointer at the given address.
+func readPointer(mem io.ReaderAt, addr uintptr) (uintptr, error) {
+	var buf [8]byte
+	if _, err := mem.ReadAt(buf[:ptrSize], int64(addr)); err != nil {
+		return 0, err
+	}
+	return pointerAt(buf[:], 0), nil
+}
+
+// readAddrInfo returns the distinct IPv4 and IPv6 addresses of the addrinfo
+// list returned by getaddrinfo, given the address of its res argument. The
+// list is read from the process' memory after the call returned, so it can
+// have been freed and reused already. Entries that don't look like an
+// address are ignored.
+func readAddrInfo(mem io.ReaderAt, res uintptr) ([]net.IP, error) {
+	ai, err := readPointer(mem, res)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading addrinfo list: %w", err)
+	}
+	var (
+		addrs []net.IP
+		seen  = make(map[string]struct{})
+		entry = make([]byte, aiSize)
+		sa    = make([]byte, sockaddrIn6Len)
+	)
+	for n := 0; ai != 0 && n < maxAddrInfo; n++ {
+		if _, err = mem.ReadAt(entry, int64(ai)); err != nil {
+			return addrs, fmt.Errorf("failed reading addrinfo: %w", err)
+		}
+		family := tracing.MachineEndian.Uint32(entry[aiFamilyOffset:])
+		addrLen := tracing.MachineEndian.Uint32(entry[aiAddrLenOffset:])
+		addrPtr := pointerAt(entry, aiAddrOffset)
+		ai = pointerAt(entry, aiNextOffset)
+
+		var ip net.IP
+		switch {
+		case family == unix.AF_INET && addrLen == sockaddrInLen:
+			if _, err = mem.ReadAt(sa[:sockaddrInLen], int64(addrPtr)); err == nil {
+				ip = net.IP(append([]byte(nil), sa[4:8]...))
+			}
+		case family == unix.AF_INET6 && addrLen == sockaddrIn6Len:
+			if _, err = mem.ReadAt(sa[:sockaddrIn6Len], int64(addrPtr)); err == nil {
+				ip = net.IP(append([]byte(nil), sa[8:24]...))
+			}
+		}
+		if ip == nil {
+			continue
+		}
+		// There's an entry per socket type for each address.
+		if _, found := seen[ip.String()]; !found {
+			seen[ip.String()] = struct{}{}
+			addrs = append(addrs, ip)
+		}
+	}
+	return addrs, nil
+}
+
+func pointerAt(buf []byte, offset int) uintptr {
+	if ptrSize == 4 {
+		return uintptr(tracing.MachineEndian.Uint32(buf[offset:]))
+	}
+	return uintptr(tracing.MachineEndian.Uint64(buf[offset:]))
+}
@@ -0,0 +1,106 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package uprobe
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+)
+
+// fakeMemory is the memory of a process, as regions by start address.
+type fakeMemory map[uintptr][]byte
+
+func (m fakeMemory) ReadAt(p []byte, off int64) (int, error) {
+	for start, region := range m {
+		if uintptr(off) >= start && uintptr(off)+uintptr(len(p)) <= start+uintptr(len(region)) {
+			return copy(p, region[uintptr(off)-start:]), nil
+		}
+	}
+	return 0, io.EOF
+}
+
+func putPointer(buf []byte, ptr uintptr) {
+	if ptrSize == 4 {
+		tracing.MachineEndian.PutUint32(buf, uint32(ptr))
+	} else {
+		tracing.MachineEndian.PutUint64(buf, uint64(ptr))
+	}
+}
+
+// addAddrInfo adds an addrinfo entry at the given address, with its sockaddr
+// following it.
+func (m fakeMemory) addAddrInfo(at uintptr, ip net.IP, next uintptr) {
+	entry := make([]byte, aiSize+sockaddrIn6Len)
+	sa := entry[aiSize:]
+	if ip4 := ip.To4(); ip4 != nil {
+		tracing.MachineEndian.PutUint32(entry[aiFamilyOffset:], unix.AF_INET)
+		tracing.MachineEndian.PutUint32(entry[aiAddrLenOffset:], sockaddrInLen)
+		copy(sa[4:], ip4)
+	} else {
+		tracing.MachineEndian.PutUint32(entry[aiFamilyOffset:], unix.AF_INET6)
+		tracing.MachineEndian.PutUint32(entry[aiAddrLenOffset:], sockaddrIn6Len)
+		copy(sa[8:], ip.To16())
+	}
+	putPointer(entry[aiAddrOffset:], at+uintptr(aiSize))
+	putPointer(entry[aiNextOffset:], next)
+	m[at] = entry
+}
+
+func (m fakeMemory) addPointer(at, ptr uintptr) {
+	buf := make([]byte, ptrSize)
+	putPointer(buf, ptr)
+	m[at] = buf
+}
+
+func TestReadAddrInfo(t *testing.T) {
+	mem := fakeMemory{}
+	mem.addPointer(0x1000, 0x2000)
+	// An entry per socket type for each address.
+	mem.addAddrInfo(0x2000, net.ParseIP("10.0.0.1"), 0x2100)
+	mem.addAddrInfo(0x2100, net.ParseIP("10.0.0.1"), 0x2200)
+	mem.addAddrInfo(0x2200, net.ParseIP("2001:db8::1"), 0x2300)
+	mem.addAddrInfo(0x2300, net.ParseIP("10.0.0.2"), 0)
+
+	addrs, err := readAddrInfo(mem, 0x1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []net.IP{
+		net.ParseIP("10.0.0.1").To4(),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("10.0.0.2").To4(),
+	}, addrs)
+}
+
+func TestReadAddrInfoFreed(t *testing.T) {
+	mem := fakeMemory{}
+	mem.addPointer(0x1000, 0x2000)
+	mem.addAddrInfo(0x2000, net.ParseIP("10.0.0.1"), 0x3000)
+
+	// The addresses read before the list became unreadable are kept.
+	addrs, err := readAddrInfo(mem, 0x1000)
+	assert.Error(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1").To4()}, addrs)
+
+	_, err = readAddrInfo(mem, 0x4000)
+	assert.Error(t, err)
+}
+
+func TestReadAddrInfoCycle(t *testing.T) {
+	mem := fakeMemory{}
+	mem.addPointer(0x1000, 0x2000)
+	mem.addAddrInfo(0x2000, net.ParseIP("10.0.0.1"), 0x2000)
+
+	addrs, err := readAddrInfo(mem, 0x1000)
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 1)
+}
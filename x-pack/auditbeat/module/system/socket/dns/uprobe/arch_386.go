@@ -0,0 +1,19 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build linux && 386
+// +build linux,386
+
+package uprobe
+
+// Fetchargs for the cdecl calling convention used by userspace, which passes
+// all the arguments on the stack.
+const (
+	argP1   = "$stack1"
+	argP3   = "$stack3"
+	argP4   = "$stack4"
+	argP5   = "$stack5"
+	argRet  = "%ax"
+	ptrType = "u32"
+)
@@ -0,0 +1,18 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build linux && amd64
+// +build linux,amd64
+
+package uprobe
+
+// Fetchargs for the System V calling convention used by userspace.
+const (
+	argP1   = "%di"
+	argP3   = "%dx"
+	argP4   = "%cx"
+	argP5   = "%r8"
+	argRet  = "%ax"
+	ptrType = "u64"
+)
@@ -0,0 +1,30 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package uprobe
+
+type config struct {
+	// Libraries are the paths of the shared libraries whose resolver
+	// functions are probed. Only the processes that load one of these files
+	// are observed. Defaults to the system's libc.
+	Libraries []string `config:"socket.dns.uprobe.libraries"`
+}
+
+func defaultConfig() config {
+	return config{}
+}
+
+// libcPaths are the usual locations of the system's libc, probed in order
+// when no library is configured.
+var libcPaths = []string{
+	"/lib/x86_64-linux-gnu/libc.so.6",
+	"/lib/i386-linux-gnu/libc.so.6",
+	"/lib64/libc.so.6",
+	"/usr/lib64/libc.so.6",
+	"/usr/lib/libc.so.6",
+	"/lib/libc.so.6",
+}
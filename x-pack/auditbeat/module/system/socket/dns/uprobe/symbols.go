@@ -0,0 +1,70 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package uprobe
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errSymbolNotFound = errors.New("symbol not found")
+
+// findLibc returns the first of the usual libc paths that exists.
+func findLibc() (string, error) {
+	for _, path := range libcPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("libc not found, set socket.dns.uprobe.libraries")
+}
+
+// symbolOffset returns the file offset of the first of the given functions
+// defined in an ELF file, which is where a uprobe for it is attached, and the
+// name it was found as.
+func symbolOffset(path string, names ...string) (name string, offset uint64, err error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	// Shared libraries export their functions as dynamic symbols, while
+	// executables and unstripped files can also have them in .symtab.
+	var symbols []elf.Symbol
+	if dyn, err := f.DynamicSymbols(); err == nil {
+		symbols = dyn
+	}
+	if syms, err := f.Symbols(); err == nil {
+		symbols = append(symbols, syms...)
+	}
+	for _, name := range names {
+		for _, sym := range symbols {
+			if sym.Name != name || elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Value == 0 {
+				continue
+			}
+			if offset, err = fileOffset(f.Progs, sym.Value); err != nil {
+				return "", 0, fmt.Errorf("%s in %s: %w", name, path, err)
+			}
+			return name, offset, nil
+		}
+	}
+	return "", 0, fmt.Errorf("%v in %s: %w", names, path, errSymbolNotFound)
+}
+
+// fileOffset converts a virtual address into the offset in the file of the
+// loadable segment that contains it.
+func fileOffset(progs []*elf.Prog, addr uint64) (uint64, error) {
+	for _, prog := range progs {
+		if prog.Type == elf.PT_LOAD && addr >= prog.Vaddr && addr < prog.Vaddr+prog.Memsz {
+			return addr - prog.Vaddr + prog.Off, nil
+		}
+	}
+	return 0, fmt.Errorf("address 0x%x isn't in a loadable segment", addr)
+}
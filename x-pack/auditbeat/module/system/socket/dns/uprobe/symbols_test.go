@@ -0,0 +1,50 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package uprobe
+
+import (
+	"debug/elf"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileOffset(t *testing.T) {
+	progs := []*elf.Prog{
+		{ProgHeader: elf.ProgHeader{Type: elf.PT_LOAD, Off: 0, Vaddr: 0, Memsz: 0x1000}},
+		{ProgHeader: elf.ProgHeader{Type: elf.PT_DYNAMIC, Off: 0x1800, Vaddr: 0x2800, Memsz: 0x100}},
+		{ProgHeader: elf.ProgHeader{Type: elf.PT_LOAD, Off: 0x1000, Vaddr: 0x2000, Memsz: 0x1000}},
+	}
+	off, err := fileOffset(progs, 0x800)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0x800, off)
+
+	off, err = fileOffset(progs, 0x2810)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0x1810, off)
+
+	_, err = fileOffset(progs, 0x1800)
+	assert.Error(t, err)
+}
+
+func TestSymbolOffset(t *testing.T) {
+	libc, err := findLibc()
+	if err != nil {
+		t.Skip(err)
+	}
+	// The first name that is defined is used.
+	name, off, err := symbolOffset(libc, "no_such_function", "getaddrinfo")
+	require.NoError(t, err)
+	assert.Equal(t, "getaddrinfo", name)
+	assert.NotZero(t, off)
+
+	_, _, err = symbolOffset(libc, "no_such_function")
+	assert.True(t, errors.Is(err, errSymbolNotFound))
+}
@@ -0,0 +1,406 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+// Package uprobe implements a DNS monitoring backend that attaches uprobes to
+// the resolver functions of libc, getaddrinfo and res_query, instead of
+// capturing packets. Resolutions are reported with the PID of the process that
+// made them, but only for the processes that resolve names through one of the
+// probed libraries.
+package uprobe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	parent "github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+// getaddrinfo error codes, from glibc's netdb.h.
+const (
+	eaiNoName = -2
+	eaiAgain  = -3
+)
+
+// Maximum number of bytes read from the answer buffer of a failed res_query,
+// whose length isn't returned. It's enough for the header and question.
+const maxFailedAnswer = 512
+
+var probeGroup = fmt.Sprintf("auditbeat_dns_%d", os.Getpid())
+
+// gaiCall is a call to getaddrinfo(node, service, hints, res).
+type gaiCall struct {
+	Meta tracing.Metadata `kprobe:"metadata"`
+	Node string           `kprobe:"node"`
+	Res  uintptr          `kprobe:"res"`
+}
+
+type gaiReturn struct {
+	Meta tracing.Metadata `kprobe:"metadata"`
+	Ret  int32            `kprobe:"ret"`
+}
+
+// resQueryCall is a call to res_query(dname, class, type, answer, anslen).
+type resQueryCall struct {
+	Meta   tracing.Metadata `kprobe:"metadata"`
+	Name   string           `kprobe:"dname"`
+	Answer uintptr          `kprobe:"answer"`
+	AnsLen int32            `kprobe:"anslen"`
+}
+
+type resQueryReturn struct {
+	Meta tracing.Metadata `kprobe:"metadata"`
+	Ret  int32            `kprobe:"ret"`
+}
+
+// resolverFunc is a probed resolver function.
+type resolverFunc struct {
+	// names the function can be exported as. res_query is __res_query in
+	// older libraries.
+	names []string
+	// probe name prefix.
+	probe string
+	// fetchargs of the call and the return.
+	callArgs, returnArgs string
+	// allocators of the call and return events.
+	allocCall, allocReturn tracing.AllocateFn
+}
+
+var resolverFuncs = []resolverFunc{
+	{
+		names:       []string{"getaddrinfo"},
+		probe:       "getaddrinfo",
+		callArgs:    "node=+0(" + argP1 + "):string res=" + argP4 + ":" + ptrType,
+		returnArgs:  "ret=" + argRet + ":s32",
+		allocCall:   func() interface{} { return new(gaiCall) },
+		allocReturn: func() interface{} { return new(gaiReturn) },
+	},
+	{
+		names:       []string{"res_query", "__res_query"},
+		probe:       "res_query",
+		callArgs:    "dname=+0(" + argP1 + "):string answer=" + argP4 + ":" + ptrType + " anslen=" + argP5 + ":s32",
+		returnArgs:  "ret=" + argRet + ":s32",
+		allocCall:   func() interface{} { return new(resQueryCall) },
+		allocReturn: func() interface{} { return new(resQueryReturn) },
+	},
+}
+
+type resolverProbes struct {
+	traceFS *tracing.TraceFS
+	channel *tracing.PerfChannel
+	probes  []tracing.Probe
+	log     *logp.Logger
+
+	// calls in progress, by thread. Either a *gaiCall or a *resQueryCall.
+	calls map[uint32]interface{}
+}
+
+func init() {
+	parent.Registry.MustRegister("uprobe", newUProbeSniffer)
+}
+
+func newUProbeSniffer(base mb.BaseMetricSet, log *logp.Logger) (parent.Sniffer, error) {
+	config := defaultConfig()
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, fmt.Errorf("failed to unpack uprobe config: %w", err)
+	}
+	return newResolverProbes(config, log)
+}
+
+func newResolverProbes(config config, log *logp.Logger) (*resolverProbes, error) {
+	libraries := config.Libraries
+	if len(libraries) == 0 {
+		libc, err := findLibc()
+		if err != nil {
+			return nil, err
+		}
+		libraries = []string{libc}
+	}
+	traceFS, err := tracing.NewTraceFS()
+	if err != nil {
+		return nil, fmt.Errorf("tracefs is not available for uprobes: %w", err)
+	}
+	channel, err := tracing.NewPerfChannel(
+		tracing.WithBufferSize(256),
+		tracing.WithTimestamp(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating perf channel: %w", err)
+	}
+	p := &resolverProbes{
+		traceFS: traceFS,
+		channel: channel,
+		log:     log,
+		calls:   make(map[uint32]interface{}),
+	}
+	p.removeProbes()
+	for idx, library := range libraries {
+		for _, fn := range resolverFuncs {
+			name, offset, err := symbolOffset(library, fn.names...)
+			if errors.Is(err, errSymbolNotFound) {
+				log.Infof("%s is not defined in %s, its resolutions won't be captured.", fn.probe, library)
+				continue
+			}
+			if err != nil {
+				p.close()
+				return nil, err
+			}
+			address := fmt.Sprintf("%s:0x%x", library, offset)
+			if err = p.install(fmt.Sprintf("%s_%d", fn.probe, idx), address, fn); err != nil {
+				p.close()
+				return nil, fmt.Errorf("failed attaching to %s in %s: %w", name, library, err)
+			}
+		}
+	}
+	if len(p.probes) == 0 {
+		p.close()
+		return nil, fmt.Errorf("no resolver function found in %s", strings.Join(libraries, ", "))
+	}
+	return p, nil
+}
+
+// install attaches a uprobe to the call of a function and a uretprobe to its
+// return.
+func (p *resolverProbes) install(name, address string, fn resolverFunc) error {
+	probes := []struct {
+		probe tracing.Probe
+		alloc tracing.AllocateFn
+	}{
+		{
+			probe: tracing.Probe{Type: tracing.TypeUProbe, Group: probeGroup, Name: name + "_call", Address: address, Fetchargs: fn.callArgs},
+			alloc: fn.allocCall,
+		},
+		{
+			probe: tracing.Probe{Type: tracing.TypeURetProbe, Group: probeGroup, Name: name + "_return", Address: address, Fetchargs: fn.returnArgs},
+			alloc: fn.allocReturn,
+		},
+	}
+	for _, def := range probes {
+		if err := p.traceFS.AddUProbe(def.probe); err != nil {
+			return fmt.Errorf("failed adding uprobe %s: %w", def.probe.String(), err)
+		}
+		p.probes = append(p.probes, def.probe)
+		format, err := p.traceFS.LoadProbeFormat(def.probe)
+		if err != nil {
+			return fmt.Errorf("failed loading format of uprobe %s: %w", def.probe.Name, err)
+		}
+		decoder, err := tracing.NewStructDecoder(format, def.alloc)
+		if err != nil {
+			return fmt.Errorf("failed creating decoder for uprobe %s: %w", def.probe.Name, err)
+		}
+		if err = p.channel.MonitorProbe(format, decoder); err != nil {
+			return fmt.Errorf("failed monitoring uprobe %s: %w", def.probe.Name, err)
+		}
+	}
+	return nil
+}
+
+// removeProbes removes the uprobes of this group, installed by a previous
+// run or by this one.
+func (p *resolverProbes) removeProbes() {
+	installed, err := p.traceFS.ListUProbes()
+	if err != nil {
+		p.log.Warnf("Failed listing uprobes: %v", err)
+		return
+	}
+	for _, probe := range installed {
+		if probe.Group != probeGroup {
+			continue
+		}
+		if err = p.traceFS.RemoveUProbe(probe); err != nil {
+			p.log.Warnf("Failed removing uprobe %s: %v", probe.Name, err)
+		}
+	}
+	p.probes = nil
+}
+
+func (p *resolverProbes) close() {
+	if err := p.channel.Close(); err != nil {
+		p.log.Warnf("Failed to close perf channel: %v", err)
+	}
+	p.removeProbes()
+}
+
+// Monitor starts monitoring for DNS transactions in the background.
+func (p *resolverProbes) Monitor(ctx context.Context, consumer parent.Consumer) error {
+	if err := p.channel.Run(); err != nil {
+		p.close()
+		return fmt.Errorf("failed starting perf channel: %w", err)
+	}
+	go p.run(ctx, consumer)
+	return nil
+}
+
+func (p *resolverProbes) run(ctx context.Context, consumer parent.Consumer) {
+	defer p.close()
+	p.log.Infof("Starting DNS capture with %d uprobes.", len(p.probes))
+	defer p.log.Info("Stopping DNS capture.")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case ev, ok := <-p.channel.C():
+			if !ok {
+				return
+			}
+			for _, tr := range p.handle(ev) {
+				if p.log.IsDebug() {
+					p.log.Debugf("Got DNS transaction pid=%d domain=%s addresses=%v rcode=%s",
+						tr.PID, tr.Domain, tr.Addresses, parent.ResponseCodeName(tr.ResponseCode))
+				}
+				consumer(tr)
+			}
+
+		case err := <-p.channel.ErrC():
+			p.log.Errorf("Error from perf channel: %v", err)
+
+		case numLost := <-p.channel.LostC():
+			p.log.Warnf("DNS capture lost %d events.", numLost)
+		}
+	}
+}
+
+// handle processes a probe event, returning the transactions of a completed
+// call.
+func (p *resolverProbes) handle(ev interface{}) []parent.Transaction {
+	switch v := ev.(type) {
+	case *gaiCall:
+		p.calls[v.Meta.TID] = v
+	case *resQueryCall:
+		p.calls[v.Meta.TID] = v
+	case *gaiReturn:
+		call, ok := p.calls[v.Meta.TID].(*gaiCall)
+		if !ok {
+			return nil
+		}
+		delete(p.calls, v.Meta.TID)
+		txs, err := withMemory(call.Meta.PID, func(mem io.ReaderAt) ([]parent.Transaction, error) {
+			return getaddrinfoTransactions(call, v.Ret, mem)
+		})
+		if err != nil {
+			p.log.Debugf("Failed reading getaddrinfo result of pid %d: %v", call.Meta.PID, err)
+		}
+		return txs
+	case *resQueryReturn:
+		call, ok := p.calls[v.Meta.TID].(*resQueryCall)
+		if !ok {
+			return nil
+		}
+		delete(p.calls, v.Meta.TID)
+		txs, err := withMemory(call.Meta.PID, func(mem io.ReaderAt) ([]parent.Transaction, error) {
+			return resQueryTransactions(call, v.Ret, mem)
+		})
+		if err != nil {
+			p.log.Debugf("Failed reading res_query answer of pid %d: %v", call.Meta.PID, err)
+		}
+		return txs
+	}
+	return nil
+}
+
+// withMemory calls fn with the memory of a process.
+func withMemory(pid uint32, fn func(io.ReaderAt) ([]parent.Transaction, error)) ([]parent.Transaction, error) {
+	mem, err := openMemory(pid)
+	if err != nil {
+		return nil, err
+	}
+	defer mem.Close()
+	return fn(mem)
+}
+
+// getaddrinfoTransactions returns the transactions for a completed
+// getaddrinfo call, one for each address family in the result. Calls for
+// numeric addresses are ignored, as they're not resolved.
+func getaddrinfoTransactions(call *gaiCall, ret int32, mem io.ReaderAt) ([]parent.Transaction, error) {
+	domain := strings.TrimSuffix(call.Node, ".")
+	if domain == "" || net.ParseIP(domain) != nil {
+		return nil, nil
+	}
+	base := parent.Transaction{
+		Domain: domain,
+		Type:   mdns.TypeA,
+		PID:    call.Meta.PID,
+	}
+	switch ret {
+	case 0:
+	case eaiNoName:
+		base.ResponseCode = mdns.RcodeNameError
+		return []parent.Transaction{base}, nil
+	case eaiAgain:
+		base.ResponseCode = mdns.RcodeServerFailure
+		return []parent.Transaction{base}, nil
+	default:
+		return nil, nil
+	}
+	addrs, err := readAddrInfo(mem, call.Res)
+	var v4, v6 []net.IP
+	for _, addr := range addrs {
+		if addr.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	var txs []parent.Transaction
+	if len(v4) > 0 {
+		tr := base
+		tr.Addresses = v4
+		txs = append(txs, tr)
+	}
+	if len(v6) > 0 {
+		tr := base
+		tr.Type = mdns.TypeAAAA
+		tr.Addresses = v6
+		txs = append(txs, tr)
+	}
+	return txs, err
+}
+
+// resQueryTransactions returns the transaction for a completed res_query
+// call, from the response copied to its answer buffer. A failed call doesn't
+// return the length of the response, but the buffer holds the error response
+// when the server sent one. A buffer that doesn't hold the response to the
+// question, as when the call failed before a response was received, is
+// ignored.
+func resQueryTransactions(call *resQueryCall, ret int32, mem io.ReaderAt) ([]parent.Transaction, error) {
+	length := ret
+	if ret < 0 {
+		length = call.AnsLen
+		if length > maxFailedAnswer {
+			length = maxFailedAnswer
+		}
+	}
+	if length <= 0 || length > call.AnsLen {
+		return nil, nil
+	}
+	buf := make([]byte, length)
+	if _, err := mem.ReadAt(buf, int64(call.Answer)); err != nil {
+		return nil, err
+	}
+	tr, ok, err := parent.ParseMessage(buf)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if !strings.EqualFold(tr.Domain, strings.TrimSuffix(call.Name, ".")) {
+		return nil, nil
+	}
+	if ret < 0 && tr.ResponseCode == mdns.RcodeSuccess {
+		return nil, nil
+	}
+	tr.PID = call.Meta.PID
+	return []parent.Transaction{tr}, nil
+}
@@ -0,0 +1,109 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package uprobe
+
+import (
+	"net"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+)
+
+func TestGetaddrinfoTransactions(t *testing.T) {
+	mem := fakeMemory{}
+	mem.addPointer(0x1000, 0x2000)
+	mem.addAddrInfo(0x2000, net.ParseIP("10.0.0.1"), 0x2100)
+	mem.addAddrInfo(0x2100, net.ParseIP("2001:db8::1"), 0)
+	call := &gaiCall{Meta: tracing.Metadata{PID: 1234, TID: 1235}, Node: "example.net.", Res: 0x1000}
+
+	txs, err := getaddrinfoTransactions(call, 0, mem)
+	require.NoError(t, err)
+	require.Len(t, txs, 2)
+	assert.Equal(t, "example.net", txs[0].Domain)
+	assert.Equal(t, mdns.TypeA, txs[0].Type)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1").To4()}, txs[0].Addresses)
+	assert.EqualValues(t, 1234, txs[0].PID)
+	assert.Equal(t, mdns.TypeAAAA, txs[1].Type)
+	assert.Equal(t, []net.IP{net.ParseIP("2001:db8::1")}, txs[1].Addresses)
+
+	txs, err = getaddrinfoTransactions(call, eaiNoName, mem)
+	require.NoError(t, err)
+	require.Len(t, txs, 1)
+	assert.Equal(t, mdns.RcodeNameError, txs[0].ResponseCode)
+	assert.Empty(t, txs[0].Addresses)
+
+	txs, err = getaddrinfoTransactions(call, eaiAgain, mem)
+	require.NoError(t, err)
+	require.Len(t, txs, 1)
+	assert.Equal(t, mdns.RcodeServerFailure, txs[0].ResponseCode)
+
+	// Other errors, such as EAI_SERVICE, aren't about the name.
+	txs, err = getaddrinfoTransactions(call, -8, mem)
+	assert.NoError(t, err)
+	assert.Empty(t, txs)
+
+	// Numeric hosts aren't resolved.
+	call.Node = "10.0.0.1"
+	txs, err = getaddrinfoTransactions(call, 0, mem)
+	assert.NoError(t, err)
+	assert.Empty(t, txs)
+}
+
+func packResponse(t *testing.T, name string, rcode int, answers ...net.IP) []byte {
+	msg := new(mdns.Msg)
+	msg.SetQuestion(name, mdns.TypeA)
+	msg.Response = true
+	msg.Rcode = rcode
+	for _, ip := range answers {
+		msg.Answer = append(msg.Answer, &mdns.A{
+			Hdr: mdns.RR_Header{Name: name, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 60},
+			A:   ip,
+		})
+	}
+	raw, err := msg.Pack()
+	require.NoError(t, err)
+	return raw
+}
+
+func TestResQueryTransactions(t *testing.T) {
+	answer := packResponse(t, "example.net.", mdns.RcodeSuccess, net.ParseIP("10.0.0.1"))
+	buf := make([]byte, 1024)
+	copy(buf, answer)
+	mem := fakeMemory{0x1000: buf}
+	call := &resQueryCall{Meta: tracing.Metadata{PID: 1234}, Name: "example.net", Answer: 0x1000, AnsLen: int32(len(buf))}
+
+	txs, err := resQueryTransactions(call, int32(len(answer)), mem)
+	require.NoError(t, err)
+	require.Len(t, txs, 1)
+	assert.Equal(t, "example.net", txs[0].Domain)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1").To4()}, txs[0].Addresses)
+	assert.EqualValues(t, 1234, txs[0].PID)
+
+	// A failed call with a successful response in the buffer is a leftover.
+	txs, err = resQueryTransactions(call, -1, mem)
+	assert.NoError(t, err)
+	assert.Empty(t, txs)
+
+	// The response of another question is a leftover too.
+	call.Name = "other.example.net"
+	txs, err = resQueryTransactions(call, int32(len(answer)), mem)
+	assert.NoError(t, err)
+	assert.Empty(t, txs)
+
+	// A failed call reports the error response.
+	copy(buf, packResponse(t, "missing.example.net.", mdns.RcodeNameError))
+	call.Name = "missing.example.net"
+	txs, err = resQueryTransactions(call, -1, mem)
+	require.NoError(t, err)
+	require.Len(t, txs, 1)
+	assert.Equal(t, mdns.RcodeNameError, txs[0].ResponseCode)
+}
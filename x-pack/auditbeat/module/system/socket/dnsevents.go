@@ -0,0 +1,274 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	mdns "github.com/miekg/dns"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Time a DNS transaction waits for the flow of its query, which identifies
+// the querying process, before its event is sent without a process.
+const dnsEventWait = 2 * time.Second
+
+// dnsEvent is a DNS transaction to report as a standalone event.
+type dnsEvent struct {
+	tr      dns.Transaction
+	seen    time.Time
+	process *process
+	// number of answers left out of the event by the answers limit.
+	omitted int
+}
+
+// dnsEventQueue holds the DNS transactions to report until their process is
+// known, or they have waited for it for dnsEventWait.
+type dnsEventQueue struct {
+	// pending transactions without a process, by client address.
+	pending map[string][]dnsEvent
+	// ready transactions, in the order they were resolved.
+	ready []dnsEvent
+	// maximum number of answers in an event. Zero for no limit.
+	maxAnswers int
+}
+
+func newDNSEventQueue(maxAnswers int) *dnsEventQueue {
+	return &dnsEventQueue{pending: make(map[string][]dnsEvent), maxAnswers: maxAnswers}
+}
+
+// withDNSEvents enables reporting every DNS transaction as its own event, in
+// addition to enriching flows with it. At most maxAnswers answers are kept
+// in an event, unless it's zero.
+func withDNSEvents(enabled bool, maxAnswers int) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.dnsEvents = newDNSEventQueue(maxAnswers)
+		}
+	}
+}
+
+// add queues a transaction. The process is nil when it's not known yet, or
+// when it's not tracked but the transaction has its PID.
+func (q *dnsEventQueue) add(tr dns.Transaction, proc *process, now time.Time) {
+	ev := dnsEvent{tr: tr, seen: now, process: proc}
+	if proc != nil || tr.PID != 0 {
+		q.ready = append(q.ready, ev)
+		return
+	}
+	key := tr.Client.String()
+	q.pending[key] = append(q.pending[key], ev)
+}
+
+// resolve sets the process of the pending transactions of the given client
+// address.
+func (q *dnsEventQueue) resolve(client string, proc *process) {
+	evs, found := q.pending[client]
+	if !found {
+		return
+	}
+	delete(q.pending, client)
+	for _, ev := range evs {
+		ev.process = proc
+		q.ready = append(q.ready, ev)
+	}
+}
+
+// drain returns the events for the transactions whose process is known and
+// for those that waited too long for it. remoteIPs returns the remote
+// addresses of the flows of a process, whose answers are kept first when
+// there are too many.
+func (q *dnsEventQueue) drain(now time.Time, remoteIPs func(pid uint32) map[string]struct{}) []mb.Event {
+	var events []mb.Event
+	for _, ev := range q.ready {
+		events = append(events, q.toEvent(ev, remoteIPs))
+	}
+	q.ready = nil
+	for key, evs := range q.pending {
+		kept := evs[:0]
+		for _, ev := range evs {
+			if now.Sub(ev.seen) < dnsEventWait {
+				kept = append(kept, ev)
+				continue
+			}
+			events = append(events, q.toEvent(ev, remoteIPs))
+		}
+		if len(kept) == 0 {
+			delete(q.pending, key)
+		} else {
+			q.pending[key] = kept
+		}
+	}
+	return events
+}
+
+// toEvent returns the event for a transaction, with its answers limited.
+func (q *dnsEventQueue) toEvent(ev dnsEvent, remoteIPs func(pid uint32) map[string]struct{}) mb.Event {
+	if q.maxAnswers > 0 && len(ev.tr.Addresses) > q.maxAnswers {
+		var preferred map[string]struct{}
+		if ev.process != nil {
+			preferred = remoteIPs(ev.process.pid)
+		}
+		ev.tr.Addresses, ev.omitted = limitAnswers(ev.tr.Addresses, q.maxAnswers, preferred)
+	}
+	return ev.toEvent()
+}
+
+// limitAnswers returns at most max of the given addresses, those in preferred
+// first, and otherwise in the order of the response, with the number of
+// addresses left out.
+func limitAnswers(addrs []net.IP, max int, preferred map[string]struct{}) (kept []net.IP, omitted int) {
+	kept = make([]net.IP, 0, max)
+	for _, addr := range addrs {
+		if _, found := preferred[addr.String()]; found && len(kept) < max {
+			kept = append(kept, addr)
+		}
+	}
+	for _, addr := range addrs {
+		if _, found := preferred[addr.String()]; !found && len(kept) < max {
+			kept = append(kept, addr)
+		}
+	}
+	return kept, len(addrs) - len(kept)
+}
+
+// remoteIPs returns the remote addresses of the known flows of a process.
+func (s *state) remoteIPs(pid uint32) map[string]struct{} {
+	ips := make(map[string]struct{})
+	for _, sock := range s.socksByPID[pid] {
+		for _, f := range sock.flows {
+			if f.remote.addr.IP != nil {
+				ips[f.remote.addr.IP.String()] = struct{}{}
+			}
+		}
+	}
+	return ips
+}
+
+// reportDNSEvents sends the events for the queued DNS transactions that are
+// ready. It returns the number of events sent.
+func (s *state) reportDNSEvents() (count int) {
+	s.Lock()
+	events := s.dnsEvents.drain(s.clock(), s.remoteIPs)
+	s.Unlock()
+	for _, ev := range events {
+		if s.reporter.Event(ev) {
+			count++
+		}
+	}
+	return count
+}
+
+func (e dnsEvent) toEvent() mb.Event {
+	tr := e.tr
+	var related []string
+	network := mapstr.M{
+		"direction": directionEgress.String(),
+		"transport": protoUDP.String(),
+		"protocol":  "dns",
+	}
+	answers := make([]mapstr.M, 0, len(tr.Addresses))
+	resolved := make([]string, 0, len(tr.Addresses))
+	for _, addr := range tr.Addresses {
+		answerType := "AAAA"
+		if addr.To4() != nil {
+			answerType = "A"
+		}
+		answers = append(answers, mapstr.M{
+			"name": tr.Domain,
+			"type": answerType,
+			"data": addr.String(),
+		})
+		resolved = append(resolved, addr.String())
+		related = append(related, addr.String())
+	}
+
+	dnsFields := mapstr.M{
+		"type": "answer",
+		"id":   strconv.Itoa(int(tr.TXID)),
+		"question": mapstr.M{
+			"name": tr.Domain,
+			"type": dns.RecordTypeName(tr.Type),
+		},
+		"response_code": dns.ResponseCodeName(tr.ResponseCode),
+	}
+	if len(answers) > 0 {
+		dnsFields["answers"] = answers
+		dnsFields["resolved_ip"] = resolved
+	}
+	if e.omitted > 0 {
+		dnsFields["answers_omitted"] = e.omitted
+	}
+	event := mapstr.M{
+		"kind":     "event",
+		"action":   "dns_transaction",
+		"category": []string{"network"},
+		"type":     []string{"protocol", "info"},
+		"outcome":  "success",
+	}
+	root := mapstr.M{
+		"event":   event,
+		"dns":     dnsFields,
+		"network": network,
+	}
+	// The endpoints are unknown to the backends that observe the resolver.
+	if tr.Client.IP != nil {
+		client, server := tr.Client.IP.String(), tr.Server.IP.String()
+		root["source"] = mapstr.M{
+			"ip":   client,
+			"port": tr.Client.Port,
+		}
+		root["destination"] = mapstr.M{
+			"ip":   server,
+			"port": tr.Server.Port,
+		}
+		network["type"] = "ipv6"
+		if tr.Client.IP.To4() != nil {
+			network["type"] = "ipv4"
+		}
+		related = append([]string{client, server}, related...)
+	}
+	if len(related) > 0 {
+		root["related"] = mapstr.M{"ip": related}
+	}
+	// Error responses have no answers. NXDOMAIN and SERVFAIL, the most
+	// common ones, are described as they tell a name that doesn't exist
+	// from a resolver that couldn't resolve it.
+	if tr.ResponseCode != mdns.RcodeSuccess {
+		event["outcome"] = "failure"
+	}
+	switch tr.ResponseCode {
+	case mdns.RcodeNameError:
+		root["error"] = mapstr.M{"message": "name does not exist (NXDOMAIN)"}
+	case mdns.RcodeServerFailure:
+		root["error"] = mapstr.M{"message": "server failed to resolve the name (SERVFAIL)"}
+	}
+
+	if e.process == nil && tr.PID != 0 {
+		f := flow{pid: tr.PID}
+		root["process"] = f.processFields()
+	}
+	if e.process != nil {
+		f := flow{pid: e.process.pid, process: e.process}
+		root["process"] = f.processFields()
+		if e.process.credFields.has(credUID) {
+			root["user"] = mapstr.M{"id": strconv.Itoa(int(e.process.uid))}
+		}
+		if e.process.credFields.has(credGID) {
+			root["group"] = mapstr.M{"id": strconv.Itoa(int(e.process.gid))}
+		}
+	}
+	return mb.Event{
+		Timestamp:  e.seen,
+		RootFields: root,
+	}
+}
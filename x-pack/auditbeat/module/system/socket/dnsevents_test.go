@@ -0,0 +1,257 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// dnsEvents returns the DNS transaction events among the given events.
+func dnsEvents(evs []beat.Event) (out []beat.Event) {
+	for _, ev := range evs {
+		if action, _ := ev.GetValue("event.action"); action == "dns_transaction" {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+func TestDNSEvents(t *testing.T) {
+	const udpSock uintptr = 0xff1000
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withDNSEvents(true, 0)(&st.state)
+	st.feedEvents([]event{
+		callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl", "https://example.net/"}),
+		&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+		&inetCreate{Meta: meta(1234, 1234, 3), Proto: 0},
+		&sockInitData{Meta: meta(1234, 1234, 3), Sock: udpSock},
+		&udpSendMsgCall{
+			Meta:     meta(1234, 1234, 4),
+			Sock:     udpSock,
+			Size:     40,
+			LAddr:    ipv4(testLocalIP),
+			AltRAddr: ipv4("192.168.33.1"),
+			LPort:    be16(40000),
+			AltRPort: be16(53),
+		},
+	})
+	if err := st.OnDNSTransaction(dns.Transaction{
+		TXID:         1234,
+		Client:       net.UDPAddr{IP: net.ParseIP(testLocalIP), Port: 40000},
+		Server:       net.UDPAddr{IP: net.ParseIP("192.168.33.1"), Port: 53},
+		Domain:       "example.net",
+		Type:         mdns.TypeA,
+		Addresses:    []net.IP{net.ParseIP(testRemoteIP)},
+		ResponseCode: mdns.RcodeSuccess,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	st.ExpireFlows()
+	evs := dnsEvents(st.getFlows())
+	if !assert.Len(t, evs, 1) {
+		t.FailNow()
+	}
+	for field, expected := range map[string]interface{}{
+		"event.kind":        "event",
+		"event.category":    []string{"network"},
+		"event.type":        []string{"protocol", "info"},
+		"event.outcome":     "success",
+		"dns.type":          "answer",
+		"dns.id":            "1234",
+		"dns.question.name": "example.net",
+		"dns.question.type": "A",
+		"dns.response_code": "NOERROR",
+		"dns.answers": []mapstr.M{
+			{"name": "example.net", "type": "A", "data": testRemoteIP},
+		},
+		"dns.resolved_ip":   []string{testRemoteIP},
+		"source.ip":         testLocalIP,
+		"source.port":       40000,
+		"destination.ip":    "192.168.33.1",
+		"destination.port":  53,
+		"network.direction": "egress",
+		"network.transport": "udp",
+		"network.protocol":  "dns",
+		"network.type":      "ipv4",
+		"process.pid":       1234,
+		"process.name":      "curl",
+		"related.ip":        []string{testLocalIP, "192.168.33.1", testRemoteIP},
+	} {
+		assertValue(t, evs[0], expected, field)
+	}
+}
+
+func TestDNSEventsFailedResolution(t *testing.T) {
+	for _, tc := range []struct {
+		rcode   int
+		code    string
+		message string
+	}{
+		{mdns.RcodeNameError, "NXDOMAIN", "name does not exist (NXDOMAIN)"},
+		{mdns.RcodeServerFailure, "SERVFAIL", "server failed to resolve the name (SERVFAIL)"},
+	} {
+		t.Run(tc.code, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withDNSEvents(true, 0)(&st.state)
+			now := time.Now()
+			st.clock = func() time.Time { return now }
+			if err := st.OnDNSTransaction(dns.Transaction{
+				TXID:         1,
+				Client:       net.UDPAddr{IP: net.ParseIP("fd00::10"), Port: 40000},
+				Server:       net.UDPAddr{IP: net.ParseIP("fd00::53"), Port: 53},
+				Domain:       "missing.example.net",
+				Type:         mdns.TypeAAAA,
+				ResponseCode: tc.rcode,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			// The event waits for the flow of the query.
+			st.ExpireFlows()
+			assert.Empty(t, dnsEvents(st.getFlows()))
+
+			now = now.Add(dnsEventWait)
+			st.ExpireFlows()
+			evs := dnsEvents(st.getFlows())
+			if !assert.Len(t, evs, 1) {
+				t.FailNow()
+			}
+			for field, expected := range map[string]interface{}{
+				"dns.question.type": "AAAA",
+				"dns.response_code": tc.code,
+				"event.outcome":     "failure",
+				"error.message":     tc.message,
+				"network.type":      "ipv6",
+			} {
+				assertValue(t, evs[0], expected, field)
+			}
+			for _, field := range []string{"dns.answers", "dns.resolved_ip", "process"} {
+				_, err := evs[0].GetValue(field)
+				assert.Error(t, err, field)
+			}
+		})
+	}
+}
+
+func TestDNSEventsWithPID(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withDNSEvents(true, 0)(&st.state)
+	st.feedEvents([]event{
+		callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl", "https://example.net/"}),
+		&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+	})
+	for _, pid := range []uint32{1234, 5678} {
+		if err := st.OnDNSTransaction(dns.Transaction{
+			Domain:    "example.net",
+			Type:      mdns.TypeA,
+			Addresses: []net.IP{net.ParseIP(testRemoteIP)},
+			PID:       pid,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The transaction is attributed without waiting for a flow.
+	st.ExpireFlows()
+	evs := dnsEvents(st.getFlows())
+	if !assert.Len(t, evs, 2) {
+		t.FailNow()
+	}
+	assertValue(t, evs[0], 1234, "process.pid")
+	assertValue(t, evs[0], "curl", "process.name")
+	assertValue(t, evs[0], []string{testRemoteIP}, "related.ip")
+	assertValue(t, evs[1], 5678, "process.pid")
+	for _, field := range []string{"source", "destination", "network.type", "process.name"} {
+		_, err := evs[1].GetValue(field)
+		assert.Error(t, err, field)
+	}
+
+	domain, found := st.getProcess(1234).ResolveIP(net.ParseIP(testRemoteIP))
+	assert.True(t, found)
+	assert.Equal(t, "example.net", domain)
+}
+
+func TestDNSEventQueueResolve(t *testing.T) {
+	q := newDNSEventQueue(0)
+	now := time.Now()
+	client := net.UDPAddr{IP: net.ParseIP(testLocalIP), Port: 40000}
+	q.add(dns.Transaction{Client: client, Domain: "example.net"}, nil, now)
+	assert.Empty(t, q.drain(now, nil))
+
+	proc := &process{pid: 1234, name: "curl"}
+	q.resolve(client.String(), proc)
+	evs := q.drain(now, nil)
+	if !assert.Len(t, evs, 1) {
+		t.FailNow()
+	}
+	name, err := evs[0].RootFields.GetValue("process.name")
+	assert.NoError(t, err)
+	assert.Equal(t, "curl", name)
+	assert.Empty(t, q.pending)
+}
+
+func TestLimitAnswers(t *testing.T) {
+	addrs := []net.IP{
+		net.ParseIP("10.0.0.1"),
+		net.ParseIP("10.0.0.2"),
+		net.ParseIP("10.0.0.3"),
+		net.ParseIP("10.0.0.4"),
+	}
+	kept, omitted := limitAnswers(addrs, 2, nil)
+	assert.Equal(t, addrs[:2], kept)
+	assert.Equal(t, 2, omitted)
+
+	// The addresses the process connected to come first.
+	kept, omitted = limitAnswers(addrs, 2, map[string]struct{}{"10.0.0.3": {}})
+	assert.Equal(t, []net.IP{addrs[2], addrs[0]}, kept)
+	assert.Equal(t, 2, omitted)
+
+	kept, omitted = limitAnswers(addrs, 4, nil)
+	assert.Equal(t, addrs, kept)
+	assert.Zero(t, omitted)
+}
+
+func TestDNSEventsMaxAnswers(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withDNSEvents(true, 2)(&st.state)
+	st.feedEvents([]event{
+		callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl"}),
+		&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+	})
+	// The process connected to the last address of the response.
+	st.feedEvents(tcpConnectEvents(1234, 5, 8))
+	client := net.UDPAddr{IP: net.ParseIP(testLocalIP), Port: 40000}
+	st.dns.RegisterEndpoint(client, st.getProcess(1234))
+	if err := st.OnDNSTransaction(dns.Transaction{
+		TXID:   1,
+		Client: client,
+		Server: net.UDPAddr{IP: net.ParseIP("192.168.33.1"), Port: 53},
+		Domain: "example.net",
+		Type:   mdns.TypeA,
+		Addresses: []net.IP{
+			net.ParseIP("10.0.0.1"),
+			net.ParseIP("10.0.0.2"),
+			net.ParseIP(testRemoteIP),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	st.ExpireFlows()
+	evs := dnsEvents(st.getFlows())
+	if !assert.Len(t, evs, 1) {
+		t.FailNow()
+	}
+	assertValue(t, evs[0], []string{testRemoteIP, "10.0.0.1"}, "dns.resolved_ip")
+	assertValue(t, evs[0], 1, "dns.answers_omitted")
+}
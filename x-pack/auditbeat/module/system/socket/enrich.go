@@ -0,0 +1,211 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/mapstr"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// Time an enricher has to return before its fields are dropped. A variable
+// so that tests don't have to wait.
+var flowEnricherTimeout = 50 * time.Millisecond
+
+// Flows that an enricher failed to enrich, because it returned an error,
+// panicked, timed out or was still busy with a previous flow. Exposed through
+// the monitoring endpoint.
+var flowEnricherFailures = monitoring.NewUint(monitoringRegistry, "flow_enricher_failures")
+
+// FlowEnricher adds fields to the events of completed flows, for custom
+// builds that need to add their own labels. Enrich receives a copy of the
+// flow and returns the fields to add to its event. Fields already set by the
+// dataset are never replaced.
+//
+// Enrich is called from the reporting path of the dataset, one flow at a
+// time. A call that doesn't return within 50ms is abandoned and its fields
+// dropped, and the enricher is skipped until it returns. A panic is recovered
+// and handled as an error.
+type FlowEnricher interface {
+	Enrich(flow FlowInfo) (mapstr.M, error)
+}
+
+// FlowEnricherFunc is a function used as a FlowEnricher.
+type FlowEnricherFunc func(flow FlowInfo) (mapstr.M, error)
+
+// Enrich calls the function.
+func (fn FlowEnricherFunc) Enrich(flow FlowInfo) (mapstr.M, error) {
+	return fn(flow)
+}
+
+// FlowInfo describes a completed flow to the enrichers.
+type FlowInfo struct {
+	// ID is the flow.id of the flow.
+	ID string
+	// Transport is tcp, udp or sctp.
+	Transport string
+	// Direction is ingress, egress or unknown.
+	Direction string
+	// Local and Remote addresses of the flow. The IP is nil when unknown.
+	Local, Remote net.TCPAddr
+	// Start and End are the times the flow was first and last seen.
+	Start, End time.Time
+	// Process of the flow, nil when unknown.
+	Process *ProcessInfo
+}
+
+// ProcessInfo describes the process of a flow to the enrichers.
+type ProcessInfo struct {
+	PID        uint32
+	Name       string
+	Executable string
+	Args       []string
+	EntityID   string
+	// Creds are only set when HasCreds is.
+	UID, GID, EUID, EGID uint32
+	HasCreds             bool
+}
+
+// registeredEnricher is a FlowEnricher registered with RegisterFlowEnricher.
+type registeredEnricher struct {
+	name     string
+	enricher FlowEnricher
+	// busy is set while a call is running, so that an enricher that timed out
+	// isn't called again until it returns.
+	busy int32
+}
+
+var flowEnrichers struct {
+	sync.Mutex
+	list []*registeredEnricher
+}
+
+// RegisterFlowEnricher registers an enricher called for every flow reported
+// by the datasets started afterwards. It's meant to be called from the init
+// function of a package included in a custom build. Names must be unique.
+func RegisterFlowEnricher(name string, enricher FlowEnricher) error {
+	if name == "" || enricher == nil {
+		return errors.New("flow enricher must have a name and be non-nil")
+	}
+	flowEnrichers.Lock()
+	defer flowEnrichers.Unlock()
+	for _, r := range flowEnrichers.list {
+		if r.name == name {
+			return fmt.Errorf("flow enricher %s already registered", name)
+		}
+	}
+	flowEnrichers.list = append(flowEnrichers.list, &registeredEnricher{name: name, enricher: enricher})
+	return nil
+}
+
+// registeredFlowEnrichers returns the enrichers registered so far.
+func registeredFlowEnrichers() []*registeredEnricher {
+	flowEnrichers.Lock()
+	defer flowEnrichers.Unlock()
+	return append([]*registeredEnricher(nil), flowEnrichers.list...)
+}
+
+// withFlowEnrichers sets the enrichers called for every reported flow.
+func withFlowEnrichers(enrichers []*registeredEnricher) stateOption {
+	return func(s *state) {
+		s.enrichers = enrichers
+	}
+}
+
+// enrichFlow adds the fields returned by the enrichers to the event of a
+// flow.
+func (s *state) enrichFlow(f *flow, fields mapstr.M) {
+	if len(s.enrichers) == 0 {
+		return
+	}
+	info := f.info()
+	for _, r := range s.enrichers {
+		extra, err := r.call(info)
+		if err != nil {
+			flowEnricherFailures.Inc()
+			s.log.Debugf("Flow enricher %s failed for flow=%v: %v", r.name, f, err)
+			continue
+		}
+		fields.DeepUpdateNoOverwrite(extra)
+	}
+}
+
+type enrichResult struct {
+	fields mapstr.M
+	err    error
+}
+
+// call runs the enricher in its own goroutine, so that it can be abandoned
+// when it takes too long.
+func (r *registeredEnricher) call(info FlowInfo) (mapstr.M, error) {
+	if !atomic.CompareAndSwapInt32(&r.busy, 0, 1) {
+		return nil, errors.New("still busy with a previous flow")
+	}
+	// Buffered so that an abandoned call can return.
+	done := make(chan enrichResult, 1)
+	go func() {
+		defer atomic.StoreInt32(&r.busy, 0)
+		defer func() {
+			if p := recover(); p != nil {
+				done <- enrichResult{err: fmt.Errorf("panic: %v", p)}
+			}
+		}()
+		fields, err := r.enricher.Enrich(info)
+		done <- enrichResult{fields: fields, err: err}
+	}()
+	timer := time.NewTimer(flowEnricherTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.fields, res.err
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out after %v", flowEnricherTimeout)
+	}
+}
+
+// info returns a copy of the flow for the enrichers.
+func (f *flow) info() FlowInfo {
+	info := FlowInfo{
+		ID:        f.id,
+		Transport: f.proto.String(),
+		Direction: f.dir.String(),
+		Local:     copyTCPAddr(f.local.addr),
+		Remote:    copyTCPAddr(f.remote.addr),
+		Start:     f.createdTime,
+		End:       f.lastSeenTime,
+	}
+	if p := f.process; p != nil {
+		info.Process = &ProcessInfo{
+			PID:        p.pid,
+			Name:       p.name,
+			Executable: p.path,
+			Args:       append([]string(nil), p.args...),
+			EntityID:   p.entityID,
+			UID:        p.uid,
+			GID:        p.gid,
+			EUID:       p.euid,
+			EGID:       p.egid,
+			HasCreds:   p.hasCreds,
+		}
+	} else if f.pid != 0 {
+		info.Process = &ProcessInfo{PID: f.pid}
+	}
+	return info
+}
+
+func copyTCPAddr(addr net.TCPAddr) net.TCPAddr {
+	if addr.IP != nil {
+		addr.IP = append(net.IP(nil), addr.IP...)
+	}
+	return addr
+}
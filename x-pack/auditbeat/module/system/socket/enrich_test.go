@@ -0,0 +1,110 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+func TestRegisterFlowEnricher(t *testing.T) {
+	defer func(prev []*registeredEnricher) {
+		flowEnrichers.list = prev
+	}(flowEnrichers.list)
+	noop := FlowEnricherFunc(func(FlowInfo) (mapstr.M, error) { return nil, nil })
+
+	assert.NoError(t, RegisterFlowEnricher("assets", noop))
+	assert.Error(t, RegisterFlowEnricher("assets", noop))
+	assert.Error(t, RegisterFlowEnricher("", noop))
+	assert.Error(t, RegisterFlowEnricher("nil", nil))
+	if list := registeredFlowEnrichers(); assert.Len(t, list, 1) {
+		assert.Equal(t, "assets", list[0].name)
+	}
+}
+
+func TestFlowEnrichers(t *testing.T) {
+	defer func(prev time.Duration) {
+		flowEnricherTimeout = prev
+	}(flowEnricherTimeout)
+	flowEnricherTimeout = 10 * time.Millisecond
+
+	var infos []FlowInfo
+	release := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	enrichers := []*registeredEnricher{
+		{name: "labels", enricher: FlowEnricherFunc(func(flow FlowInfo) (mapstr.M, error) {
+			infos = append(infos, flow)
+			return mapstr.M{
+				"labels":         mapstr.M{"business_unit": "payments"},
+				"destination.ip": "10.0.0.1",
+			}, nil
+		})},
+		{name: "failing", enricher: FlowEnricherFunc(func(FlowInfo) (mapstr.M, error) {
+			return mapstr.M{"failing": true}, errors.New("lookup failed")
+		})},
+		{name: "panicking", enricher: FlowEnricherFunc(func(FlowInfo) (mapstr.M, error) {
+			panic("boom")
+		})},
+		{name: "slow", enricher: FlowEnricherFunc(func(FlowInfo) (mapstr.M, error) {
+			blocked <- struct{}{}
+			<-release
+			return mapstr.M{"slow": true}, nil
+		})},
+	}
+
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withFlowEnrichers(enrichers)(&st.state)
+	report := func() beat.Event {
+		st.feedEvents(append(tcpConnectEvents(1235, 5, 8),
+			&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: testSock}))
+		st.ExpireFlows()
+		flows := st.getFlows()
+		if !assert.Len(t, flows, 1) {
+			t.FailNow()
+		}
+		return flows[0]
+	}
+
+	ev := report()
+	assertValue(t, ev, "payments", "labels.business_unit")
+	// Fields set by the dataset aren't replaced.
+	assertValue(t, ev, testRemoteIP, "destination.ip")
+	for _, key := range []string{"failing", "slow"} {
+		_, err := ev.GetValue(key)
+		assert.Error(t, err, key)
+	}
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, "tcp", infos[0].Transport)
+		assert.Equal(t, "egress", infos[0].Direction)
+		assert.Equal(t, testRemoteIP, infos[0].Remote.IP.String())
+		assert.Equal(t, testRemotePort, infos[0].Remote.Port)
+		assert.NotEmpty(t, infos[0].ID)
+		if assert.NotNil(t, infos[0].Process) {
+			assert.EqualValues(t, 1234, infos[0].Process.PID)
+		}
+	}
+
+	// The slow enricher is skipped while its previous call is running.
+	<-blocked
+	assertValue(t, report(), "payments", "labels.business_unit")
+	select {
+	case <-blocked:
+		t.Fatal("busy enricher was called again")
+	default:
+	}
+	close(release)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&enrichers[3].busy) == 0
+	}, time.Second, time.Millisecond)
+}
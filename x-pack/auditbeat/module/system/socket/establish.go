@@ -0,0 +1,89 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import "sync"
+
+// openEvents holds snapshots of newly established flows until their events
+// are built and published by the expire goroutine, so that neither a slow
+// output nor the enrichment of the flows blocks the processing of kernel
+// events. Publishing is serialized with the reporting of terminated flows so
+// that the open event of a flow is always sent before its final event.
+type openEvents struct {
+	// reporting serializes the publishing of events.
+	reporting sync.Mutex
+	// pending flow snapshots. Protected by the state's mutex.
+	pending []*flow
+}
+
+// withReportOnEstablish enables sending an event when a TCP flow is
+// established, in addition to the event sent when it terminates.
+func withReportOnEstablish(enabled bool) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.opens = new(openEvents)
+		}
+	}
+}
+
+// OnTCPEstablished is called when the TCP connection of the given sock is
+// established, either because it was accepted or because the handshake of
+// an outgoing connection completed. A snapshot of the flows is queued, and
+// their open events are sent by ExpireFlows.
+func (s *state) OnTCPEstablished(ptr uintptr) error {
+	if s.opens == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	sock, found := s.socks[ptr]
+	if !found {
+		return nil
+	}
+	for _, f := range sock.flows {
+		if f.proto != protoTCP || f.opened || !f.isValid() || int(f.pid) == s.currentPID || s.isFiltered(f) {
+			continue
+		}
+		f.opened = true
+		snapshot := *f
+		s.opens.pending = append(s.opens.pending, &snapshot)
+	}
+	return nil
+}
+
+// publishOpenEvents sends the pending open events.
+func (s *state) publishOpenEvents() {
+	s.opens.reporting.Lock()
+	defer s.opens.reporting.Unlock()
+	s.flushOpenEvents()
+}
+
+// flushOpenEvents enriches the pending flow snapshots and sends their open
+// events. Must be called with opens.reporting held. As with reportFlow, the
+// enrichment can block on syscalls and file I/O, so it's done without the
+// state's lock.
+func (s *state) flushOpenEvents() {
+	s.Lock()
+	pending := s.opens.pending
+	s.opens.pending = nil
+	s.Unlock()
+	for _, f := range pending {
+		f.service = s.services.Lookup(f.proto, f.destination().addr.Port)
+		f.iface = s.interfaces.Lookup(f.netNS(), f.local.addr.IP, f.remote.addr.IP)
+		f.hostsDomain = s.hosts.Lookup(f.destination().addr.IP)
+		ev, err := s.interimEvent(f)
+		if err != nil {
+			s.log.Errorf("Failed to convert established flow=%v err=%v", f, err)
+			continue
+		}
+		if _, err = ev.RootFields.Put("flow.event", "open"); err != nil {
+			s.log.Errorf("Failed to convert established flow=%v err=%v", f, err)
+			continue
+		}
+		s.reporter.Event(ev)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestReportOnEstablish(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	process := []event{
+		callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl"}),
+		&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+	}
+	connect := []event{
+		&inetCreate{Meta: meta(1234, 1234, 5), Proto: 0},
+		&sockInitData{Meta: meta(1234, 1234, 5), Sock: sock},
+		&tcpIPv4ConnectCall{Meta: meta(1234, 1234, 8), Sock: sock, LAddr: lAddr, LPort: lPort, RAddr: rAddr, RPort: rPort},
+		&tcpConnectResult{Meta: meta(1234, 1234, 9), Retval: 0},
+		&tcpFinishConnect{Meta: meta(0, 0, 10), Sock: sock},
+		&inetReleaseCall{Meta: meta(1234, 1234, 15), Sock: sock},
+	}
+	accept := []event{
+		&tcpAcceptResult4{
+			Meta:  meta(1234, 1234, 10),
+			Sock:  sock,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+			Af:    unix.AF_INET,
+		},
+		&inetReleaseCall{Meta: meta(1234, 1234, 15), Sock: sock},
+	}
+	for _, tc := range []struct {
+		name    string
+		evs     []event
+		enabled bool
+	}{
+		{"connect", connect, true},
+		{"accept", accept, true},
+		{"disabled", connect, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withReportOnEstablish(tc.enabled)(&st.state)
+			st.feedEvents(process)
+			st.feedEvents(tc.evs)
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !tc.enabled {
+				if assert.Len(t, flows, 1) {
+					id, err := flows[0].GetValue("flow.id")
+					assert.NoError(t, err)
+					assert.NotEmpty(t, id)
+					_, err = flows[0].GetValue("flow.event")
+					assert.Error(t, err)
+				}
+				return
+			}
+			if !assert.Len(t, flows, 2) {
+				t.FailNow()
+			}
+			open, closed := flows[0], flows[1]
+			assertValue(t, open, "open", "flow.event")
+			assertValue(t, open, false, "flow.final")
+			assertValue(t, open, "curl", "process.name")
+			assertValue(t, open, "tcp", "network.transport")
+			assertValue(t, open, 1234, "process.pid")
+			assertValue(t, closed, "close", "flow.event")
+			assertValue(t, closed, true, "flow.final")
+			id, err := open.GetValue("flow.id")
+			if assert.NoError(t, err) {
+				assert.NotEmpty(t, id)
+				assertValue(t, closed, id, "flow.id")
+			}
+		})
+	}
+}
+
+func TestOpenEventsSentBeforeFinal(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withReportOnEstablish(true)(&st.state)
+	st.feedEvents([]event{
+		&inetCreate{Meta: meta(1234, 1234, 5), Proto: 0},
+		&sockInitData{Meta: meta(1234, 1234, 5), Sock: sock},
+		&tcpIPv4ConnectCall{Meta: meta(1234, 1234, 8), Sock: sock, LAddr: lAddr, LPort: lPort, RAddr: rAddr, RPort: rPort},
+		&tcpConnectResult{Meta: meta(1234, 1234, 9), Retval: 0},
+	})
+	// An open event that's been queued but not sent yet, as when the flow is
+	// terminated concurrently, must be sent before the final event.
+	st.Lock()
+	for _, f := range st.socks[sock].flows {
+		snapshot := *f
+		st.opens.pending = append(st.opens.pending, &snapshot)
+	}
+	st.Unlock()
+	st.feedEvents([]event{
+		&inetReleaseCall{Meta: meta(1234, 1234, 15), Sock: sock},
+	})
+	st.ExpireFlows()
+	flows := st.getFlows()
+	if !assert.Len(t, flows, 2) {
+		t.FailNow()
+	}
+	assertValue(t, flows[0], "open", "flow.event")
+	assertValue(t, flows[1], true, "flow.final")
+	assert.Empty(t, st.opens.pending)
+}
+
+func TestOpenEventsQueued(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withReportOnEstablish(true)(&st.state)
+	st.feedEvents(append(tcpConnectEvents(1234, 5, 8),
+		&tcpFinishConnect{Meta: meta(0, 0, 10), Sock: testSock},
+	))
+	// Open events aren't sent from the event processing path.
+	assert.Empty(t, st.getFlows())
+	if !assert.Len(t, st.opens.pending, 1) {
+		t.FailNow()
+	}
+	// Nor are they enriched, as it happens outside the state's lock.
+	st.services = &serviceTable{byProto: map[flowProto]map[uint16]string{protoTCP: {testRemotePort: "http"}}}
+	assert.Empty(t, st.opens.pending[0].service)
+
+	st.ExpireFlows()
+	flows := st.getFlows()
+	if !assert.Len(t, flows, 1) {
+		t.FailNow()
+	}
+	assertValue(t, flows[0], "open", "flow.event")
+	assertValue(t, flows[0], "http", "network.protocol")
+	assert.Empty(t, st.opens.pending)
+}
+
+func TestFlowID(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withReportOnEstablish(true)(&st.state)
+	connect := func(ts uint64) string {
+		st.feedEvents(append(tcpConnectEvents(1234, ts, ts+1),
+			&tcpFinishConnect{Meta: meta(0, 0, ts+2), Sock: testSock},
+			&inetReleaseCall{Meta: meta(1234, 1234, ts+3), Sock: testSock},
+		))
+		st.ExpireFlows()
+		flows := st.getFlows()
+		if !assert.Len(t, flows, 2) {
+			t.FailNow()
+		}
+		id, err := flows[0].GetValue("flow.id")
+		if assert.NoError(t, err) {
+			assertValue(t, flows[1], id, "flow.id")
+		}
+		return id.(string)
+	}
+	// The sock is reused for the same tuple.
+	first, second := connect(5), connect(50)
+	assert.NotEqual(t, first, second)
+
+	// The same flow in different network namespaces.
+	f := flow{
+		sock:        testSock,
+		proto:       protoTCP,
+		local:       newEndpointIPv4(ipv4(testLocalIP), be16(testLocalPort), 0, 0),
+		remote:      newEndpointIPv4(ipv4(testRemoteIP), be16(testRemotePort), 0, 0),
+		createdTime: time.Unix(1700000000, 0),
+		process:     &process{pid: 1234, netns: 4026531840},
+	}
+	other := f
+	other.process = &process{pid: 1234, netns: 4026532000}
+	assert.Equal(t, f.computeID(), f.computeID())
+	assert.NotEqual(t, f.computeID(), other.computeID())
+}
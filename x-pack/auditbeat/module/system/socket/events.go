@@ -13,6 +13,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -125,38 +126,63 @@ func (e *tcpConnectResult) String() string {
 // Update the state with the contents of this event.
 func (e *tcpConnectResult) Update(s *state) error {
 	ev, found := s.ThreadLeave(e.Meta.TID)
-	if !found || e.Retval != 0 {
+	if !found {
+		return nil
+	}
+	// A failed connect leaves a socket without data nor flow. It's only
+	// recorded when empty flows are reported, using the addresses from the
+	// connect arguments, so that refused flows carry the best-known tuple.
+	if e.Retval != 0 && !s.reportEmptyFlows {
 		return nil
 	}
 	switch call := ev.(type) {
 	case *tcpIPv4ConnectCall:
 		return s.UpdateFlow(flow{
-			sock:     call.Sock,
-			pid:      e.Meta.PID,
-			inetType: inetTypeIPv4,
-			proto:    protoTCP,
-			dir:      directionEgress,
-			complete: true,
-			lastSeen: kernelTime(call.Meta.Timestamp),
-			local:    newEndpointIPv4(call.LAddr, call.LPort, 0, 0),
-			remote:   newEndpointIPv4(call.RAddr, call.RPort, 0, 0),
+			sock:           call.Sock,
+			pid:            e.Meta.PID,
+			tid:            e.Meta.TID,
+			inetType:       inetTypeIPv4,
+			proto:          protoTCP,
+			dir:            directionEgress,
+			complete:       true,
+			connectAttempt: true,
+			lastSeen:       kernelTime(call.Meta.Timestamp),
+			local:          newEndpointIPv4(call.LAddr, call.LPort, 0, 0),
+			remote:         newEndpointIPv4(call.RAddr, call.RPort, 0, 0),
+			tcp:            e.connectStats(s, call.Meta),
 		})
 	case *tcpIPv6ConnectCall:
 		return s.UpdateFlow(flow{
-			sock:     call.Sock,
-			pid:      e.Meta.PID,
-			inetType: inetTypeIPv6,
-			proto:    protoTCP,
-			dir:      directionEgress,
-			complete: true,
-			lastSeen: kernelTime(call.Meta.Timestamp),
-			local:    newEndpointIPv6(call.LAddrA, call.LAddrB, call.LPort, 0, 0),
-			remote:   newEndpointIPv6(call.RAddrA, call.RAddrB, call.RPort, 0, 0),
+			sock:           call.Sock,
+			pid:            e.Meta.PID,
+			tid:            e.Meta.TID,
+			inetType:       inetTypeIPv6,
+			proto:          protoTCP,
+			dir:            directionEgress,
+			complete:       true,
+			connectAttempt: true,
+			lastSeen:       kernelTime(call.Meta.Timestamp),
+			local:          newEndpointIPv6(call.LAddrA, call.LAddrB, call.LPort, 0, 0),
+			remote:         newEndpointIPv6(call.RAddrA, call.RAddrB, call.RPort, 0, 0),
+			tcp:            e.connectStats(s, call.Meta),
 		})
 	}
 	return fmt.Errorf("stored thread event has unexpected type %T", ev)
 }
 
+// connectStats returns the TCP stats of the flow of a connect call, with the
+// time of the call and the failure of a connect that failed immediately.
+func (e *tcpConnectResult) connectStats(s *state, call tracing.Metadata) (tcp tcpStats) {
+	if !s.connectFailures {
+		return tcp
+	}
+	tcp.connectStart = kernelTime(call.Timestamp)
+	if e.Retval < 0 {
+		tcp.setConnectFailure(kernelTime(e.Meta.Timestamp)-tcp.connectStart, -e.Retval)
+	}
+	return tcp
+}
+
 var tcpStates = []string{
 	"(zero)",
 	"TCP_ESTABLISHED",
@@ -173,6 +199,167 @@ var tcpStates = []string{
 	"TCP_NEW_SYN_RECV",
 }
 
+// States of a TCP sock used to tell the initiator of a close, and whether a
+// connection attempt failed.
+const (
+	tcpStateSynSent  = 2
+	tcpStateFinWait1 = 4
+	tcpStateLastAck  = 9
+)
+
+// tcpStateName returns the name of a TCP sock state.
+func tcpStateName(st uint8) string {
+	if int(st) < len(tcpStates) {
+		return tcpStates[st]
+	}
+	return strconv.Itoa(int(st))
+}
+
+// socketFamilyName returns the name of the address family of a socket.
+func socketFamilyName(family uint16) string {
+	switch family {
+	case unix.AF_INET:
+		return "AF_INET"
+	case unix.AF_INET6:
+		return "AF_INET6"
+	}
+	return strconv.Itoa(int(family))
+}
+
+var socketTypes = map[uint16]string{
+	unix.SOCK_STREAM:    "SOCK_STREAM",
+	unix.SOCK_DGRAM:     "SOCK_DGRAM",
+	unix.SOCK_RAW:       "SOCK_RAW",
+	unix.SOCK_RDM:       "SOCK_RDM",
+	unix.SOCK_SEQPACKET: "SOCK_SEQPACKET",
+	unix.SOCK_DCCP:      "SOCK_DCCP",
+	unix.SOCK_PACKET:    "SOCK_PACKET",
+}
+
+// socketTypeName returns the name of the type of a socket.
+func socketTypeName(typ uint16) string {
+	if name, found := socketTypes[typ]; found {
+		return name
+	}
+	return strconv.Itoa(int(typ))
+}
+
+type tcpAcceptCall struct {
+	Meta    tracing.Metadata `kprobe:"metadata"`
+	Sock    uintptr          `kprobe:"sock"`
+	LAddr   uint32           `kprobe:"laddr"`
+	LPort   uint16           `kprobe:"lport"`
+	LAddr6a uint64           `kprobe:"laddr6a"`
+	LAddr6b uint64           `kprobe:"laddr6b"`
+	Af      uint16           `kprobe:"family"`
+}
+
+// listenAddress returns the address the listening socket is bound to. Unlike
+// flow endpoints, it can be the wildcard address.
+func (e *tcpAcceptCall) listenAddress() net.TCPAddr {
+	if e.Af == unix.AF_INET {
+		return (&tcpAcceptCall4{LAddr: e.LAddr, LPort: e.LPort}).listenAddress()
+	}
+	var buf [16]byte
+	tracing.MachineEndian.PutUint16(buf[:], e.LPort)
+	port := binary.BigEndian.Uint16(buf[:])
+	tracing.MachineEndian.PutUint64(buf[:], e.LAddr6a)
+	tracing.MachineEndian.PutUint64(buf[8:], e.LAddr6b)
+	return net.TCPAddr{IP: net.IP(buf[:]), Port: int(port)}
+}
+
+// String returns a representation of the event.
+func (e *tcpAcceptCall) String() string {
+	addr := e.listenAddress()
+	return fmt.Sprintf("%s accept(listen=0x%x, %s)", header(e.Meta), e.Sock, addr.String())
+}
+
+// Update the state with the contents of this event.
+func (e *tcpAcceptCall) Update(s *state) error {
+	return s.ThreadEnter(e.Meta.TID, e)
+}
+
+type tcpAcceptCall4 struct {
+	Meta  tracing.Metadata `kprobe:"metadata"`
+	Sock  uintptr          `kprobe:"sock"`
+	LAddr uint32           `kprobe:"laddr"`
+	LPort uint16           `kprobe:"lport"`
+	Af    uint16           `kprobe:"family"`
+}
+
+// listenAddress returns the address the listening socket is bound to. Unlike
+// flow endpoints, it can be the wildcard address.
+func (e *tcpAcceptCall4) listenAddress() net.TCPAddr {
+	var buf [4]byte
+	tracing.MachineEndian.PutUint16(buf[:], e.LPort)
+	port := binary.BigEndian.Uint16(buf[:])
+	tracing.MachineEndian.PutUint32(buf[:], e.LAddr)
+	return net.TCPAddr{IP: net.IPv4(buf[0], buf[1], buf[2], buf[3]), Port: int(port)}
+}
+
+// String returns a representation of the event.
+func (e *tcpAcceptCall4) String() string {
+	addr := e.listenAddress()
+	return fmt.Sprintf("%s accept(listen=0x%x, %s)", header(e.Meta), e.Sock, addr.String())
+}
+
+// Update the state with the contents of this event.
+func (e *tcpAcceptCall4) Update(s *state) error {
+	return s.ThreadEnter(e.Meta.TID, e)
+}
+
+// acceptListenAddress returns the listen address captured by the accept call
+// that's pending for the given thread, if any. The listening sock is recorded
+// as such.
+func acceptListenAddress(s *state, tid uint32) (addr net.IP) {
+	ev, found := s.ThreadLeave(tid)
+	if !found {
+		return nil
+	}
+	var listen net.TCPAddr
+	switch call := ev.(type) {
+	case *tcpAcceptCall:
+		listen = call.listenAddress()
+		s.OnListenerSeen(call.Sock, listen, call.Meta.PID)
+	case *tcpAcceptCall4:
+		listen = call.listenAddress()
+		s.OnListenerSeen(call.Sock, listen, call.Meta.PID)
+	}
+	return listen.IP
+}
+
+// inetListenCall is a call to listen() on a TCP socket. It's decoded like an
+// accept call, from the listening sock.
+type inetListenCall tcpAcceptCall
+
+// String returns a representation of the event.
+func (e *inetListenCall) String() string {
+	addr := (*tcpAcceptCall)(e).listenAddress()
+	return fmt.Sprintf("%s listen(sock=0x%x, %s)", header(e.Meta), e.Sock, addr.String())
+}
+
+// Update the state with the contents of this event.
+func (e *inetListenCall) Update(s *state) error {
+	s.OnListenerSeen(e.Sock, (*tcpAcceptCall)(e).listenAddress(), e.Meta.PID)
+	return nil
+}
+
+// inetListenCall4 is a call to listen() on a TCP socket when IPv6 is
+// disabled.
+type inetListenCall4 tcpAcceptCall4
+
+// String returns a representation of the event.
+func (e *inetListenCall4) String() string {
+	addr := (*tcpAcceptCall4)(e).listenAddress()
+	return fmt.Sprintf("%s listen(sock=0x%x, %s)", header(e.Meta), e.Sock, addr.String())
+}
+
+// Update the state with the contents of this event.
+func (e *inetListenCall4) Update(s *state) error {
+	s.OnListenerSeen(e.Sock, (*tcpAcceptCall4)(e).listenAddress(), e.Meta.PID)
+	return nil
+}
+
 type tcpAcceptResult struct {
 	Meta    tracing.Metadata `kprobe:"metadata"`
 	Sock    uintptr          `kprobe:"sock"`
@@ -192,12 +379,17 @@ func (e *tcpAcceptResult) asFlow() flow {
 	f := flow{
 		sock:     e.Sock,
 		pid:      e.Meta.PID,
+		tid:      e.Meta.TID,
 		inetType: inetType(e.Af),
 		proto:    protoTCP,
 		dir:      directionIngress,
 		complete: true,
+		accepted: true,
 		lastSeen: evTime,
 		created:  evTime,
+		// Accepted sockets aren't created by inet_create.
+		socketFamily: e.Af,
+		socketType:   unix.SOCK_STREAM,
 	}
 	if e.Af == unix.AF_INET {
 		f.local = newEndpointIPv4(e.LAddr, e.LPort, 0, 0)
@@ -217,8 +409,14 @@ func (e *tcpAcceptResult) String() string {
 
 // Update the state with the contents of this event.
 func (e *tcpAcceptResult) Update(s *state) error {
+	listen := acceptListenAddress(s, e.Meta.TID)
 	if e.Sock != 0 {
-		return s.CreateSocket(e.asFlow())
+		f := e.asFlow()
+		f.listenAddr = listen
+		if err := s.CreateSocket(f); err != nil {
+			return err
+		}
+		return s.OnTCPEstablished(e.Sock)
 	}
 	return nil
 }
@@ -238,12 +436,17 @@ func (e *tcpAcceptResult4) asFlow() flow {
 	f := flow{
 		sock:     e.Sock,
 		pid:      e.Meta.PID,
+		tid:      e.Meta.TID,
 		inetType: inetType(e.Af),
 		proto:    protoTCP,
 		dir:      directionIngress,
 		complete: true,
+		accepted: true,
 		lastSeen: evTime,
 		created:  evTime,
+		// Accepted sockets aren't created by inet_create.
+		socketFamily: e.Af,
+		socketType:   unix.SOCK_STREAM,
 	}
 	f.local = newEndpointIPv4(e.LAddr, e.LPort, 0, 0)
 	f.remote = newEndpointIPv4(e.RAddr, e.RPort, 0, 0)
@@ -258,8 +461,14 @@ func (e *tcpAcceptResult4) String() string {
 
 // Update the state with the contents of this event.
 func (e *tcpAcceptResult4) Update(s *state) error {
+	listen := acceptListenAddress(s, e.Meta.TID)
 	if e.Sock != 0 {
-		return s.CreateSocket(e.asFlow())
+		f := e.asFlow()
+		f.listenAddr = listen
+		if err := s.CreateSocket(f); err != nil {
+			return err
+		}
+		return s.OnTCPEstablished(e.Sock)
 	}
 	return nil
 }
@@ -795,27 +1004,40 @@ type sockInitData struct {
 	Meta   tracing.Metadata `kprobe:"metadata"`
 	Socket uintptr          `kprobe:"socket"`
 	Sock   uintptr          `kprobe:"sock"`
+	// Inode is only fetched when the socket inode is reported.
+	Inode uintptr `kprobe:"ino,optional"`
 }
 
 // String returns a representation of the event.
 func (e *sockInitData) String() string {
-	return fmt.Sprintf("%s sock_init_data(sock=0x%x)", header(e.Meta), e.Sock)
+	return fmt.Sprintf("%s sock_init_data(sock=0x%x, ino=%d)", header(e.Meta), e.Sock, e.Inode)
 }
 
 // Update the state with the contents of this event.
 func (e *sockInitData) Update(s *state) error {
 	if ev, found := s.ThreadLeave(e.Meta.TID); found {
 		// Only track socks created by inet_create / inet6_create
-		if iCreate, ok := ev.(*inetCreate); ok {
-			return s.CreateSocket(flow{
-				sock:     e.Sock,
-				pid:      e.Meta.PID,
-				proto:    flowProto(iCreate.Proto),
-				created:  kernelTime(e.Meta.Timestamp),
-				lastSeen: kernelTime(e.Meta.Timestamp),
-				complete: true,
-			})
+		var iCreate *inetCreate
+		family := uint16(unix.AF_INET)
+		switch call := ev.(type) {
+		case *inetCreate:
+			iCreate = call
+		case *inet6Create:
+			iCreate, family = (*inetCreate)(call), unix.AF_INET6
+		default:
+			return nil
 		}
+		return s.CreateSocket(flow{
+			sock:         e.Sock,
+			inode:        uint64(e.Inode),
+			pid:          e.Meta.PID,
+			proto:        flowProto(iCreate.Proto),
+			socketFamily: family,
+			socketType:   uint16(iCreate.Type),
+			created:      kernelTime(e.Meta.Timestamp),
+			lastSeen:     kernelTime(e.Meta.Timestamp),
+			complete:     true,
+		})
 	}
 	return nil
 }
@@ -823,21 +1045,62 @@ func (e *sockInitData) Update(s *state) error {
 type inetCreate struct {
 	Meta  tracing.Metadata `kprobe:"metadata"`
 	Proto int32            `kprobe:"proto"`
+	Type  int16            `kprobe:"type"`
 }
 
 // String returns a representation of the event.
 func (e *inetCreate) String() string {
-	return fmt.Sprintf("%s inet_create(proto=%d)", header(e.Meta), e.Proto)
+	return fmt.Sprintf("%s inet_create(proto=%d, type=%d)", header(e.Meta), e.Proto, e.Type)
 }
 
 // Update the state with the contents of this event.
 func (e *inetCreate) Update(s *state) error {
-	if proto := flowProto(e.Proto); proto == protoUnknown || proto == protoTCP || proto == protoUDP {
+	if e.tracked() {
 		return s.ThreadEnter(e.Meta.TID, e)
 	}
 	return nil
 }
 
+// tracked returns whether the socket being created is a TCP or UDP socket.
+func (e *inetCreate) tracked() bool {
+	proto := flowProto(e.Proto)
+	return proto == protoUnknown || proto == protoTCP || proto == protoUDP
+}
+
+// inet6Create is an IPv6 socket being created.
+type inet6Create inetCreate
+
+// String returns a representation of the event.
+func (e *inet6Create) String() string {
+	return fmt.Sprintf("%s inet6_create(proto=%d, type=%d)", header(e.Meta), e.Proto, e.Type)
+}
+
+// Update the state with the contents of this event.
+func (e *inet6Create) Update(s *state) error {
+	if (*inetCreate)(e).tracked() {
+		return s.ThreadEnter(e.Meta.TID, e)
+	}
+	return nil
+}
+
+// sockGraft is the struct sock of an accepted connection being attached to
+// the struct socket returned by accept.
+type sockGraft struct {
+	Meta  tracing.Metadata `kprobe:"metadata"`
+	Sock  uintptr          `kprobe:"sock"`
+	Inode uintptr          `kprobe:"ino"`
+}
+
+// String returns a representation of the event.
+func (e *sockGraft) String() string {
+	return fmt.Sprintf("%s sock_graft(sock=0x%x, ino=%d)", header(e.Meta), e.Sock, e.Inode)
+}
+
+// Update the state with the contents of this event.
+func (e *sockGraft) Update(s *state) error {
+	return s.OnSocketInode(e.Sock, uint64(e.Inode))
+}
+
 type inetReleaseCall struct {
 	Meta tracing.Metadata `kprobe:"metadata"`
 	Sock uintptr          `kprobe:"sock"`
@@ -853,6 +1116,588 @@ func (e *inetReleaseCall) Update(s *state) error {
 	return s.OnSockDestroyed(e.Sock, e.Meta.PID)
 }
 
+// tcpCloseFields tells which of the optional values of a tcpCloseCall were
+// fetched by the probe.
+type tcpCloseFields uint8
+
+const (
+	tcpCloseRTT tcpCloseFields = 1 << iota
+	tcpCloseDSACKDups
+	tcpClosePathMTU
+	tcpCloseBuffers
+	tcpCloseCwnd
+)
+
+type tcpCloseCall struct {
+	Meta   tracing.Metadata `kprobe:"metadata"`
+	Sock   uintptr          `kprobe:"sock"`
+	SRTT   uint32           `kprobe:"srtt,optional"`
+	RTO    uint32           `kprobe:"rto,optional"`
+	DSACK  uint32           `kprobe:"dsack,optional"`
+	PMTU   uint32           `kprobe:"pmtu,optional"`
+	SndBuf uint32           `kprobe:"sndbuf,optional"`
+	RcvBuf uint32           `kprobe:"rcvbuf,optional"`
+	Cwnd   uint32           `kprobe:"cwnd,optional"`
+	fields tcpCloseFields
+}
+
+// String returns a representation of the event.
+func (e *tcpCloseCall) String() string {
+	return fmt.Sprintf("%s tcp_close(sock=0x%x, srtt=%d, rto=%d, dsack_dups=%d, pmtu=%d, sndbuf=%d, rcvbuf=%d, cwnd=%d)",
+		header(e.Meta), e.Sock, e.SRTT, e.RTO, e.DSACK, e.PMTU, e.SndBuf, e.RcvBuf, e.Cwnd)
+}
+
+// Update the state with the contents of this event.
+func (e *tcpCloseCall) Update(s *state) error {
+	return s.OnTCPClose(e.Sock, e.fields, e.SRTT, e.RTO, e.DSACK, e.PMTU, e.SndBuf, e.RcvBuf, e.Cwnd)
+}
+
+type tcpFinishConnect struct {
+	Meta tracing.Metadata `kprobe:"metadata"`
+	Sock uintptr          `kprobe:"sock"`
+}
+
+// String returns a representation of the event.
+func (e *tcpFinishConnect) String() string {
+	return fmt.Sprintf("%s tcp_finish_connect(sock=0x%x)", header(e.Meta), e.Sock)
+}
+
+// Update the state with the contents of this event.
+func (e *tcpFinishConnect) Update(s *state) error {
+	return s.OnTCPEstablished(e.Sock)
+}
+
+type tcpZeroWindowProbe struct {
+	Meta tracing.Metadata `kprobe:"metadata"`
+	Sock uintptr          `kprobe:"sock"`
+}
+
+// String returns a representation of the event.
+func (e *tcpZeroWindowProbe) String() string {
+	return fmt.Sprintf("%s tcp_send_probe0(sock=0x%x)", header(e.Meta), e.Sock)
+}
+
+// Update the state with the contents of this event.
+func (e *tcpZeroWindowProbe) Update(s *state) error {
+	return s.OnTCPZeroWindowProbe(e.Sock, kernelTime(e.Meta.Timestamp))
+}
+
+type tcpUrgentData struct {
+	Meta tracing.Metadata `kprobe:"metadata"`
+	Sock uintptr          `kprobe:"sock"`
+}
+
+// String returns a representation of the event.
+func (e *tcpUrgentData) String() string {
+	return fmt.Sprintf("%s sk_send_sigurg(sock=0x%x)", header(e.Meta), e.Sock)
+}
+
+// Update the state with the contents of this event.
+func (e *tcpUrgentData) Update(s *state) error {
+	return s.OnTCPUrgentData(e.Sock)
+}
+
+type mptcpCloseSubflow struct {
+	Meta    tracing.Metadata `kprobe:"metadata"`
+	Sock    uintptr          `kprobe:"sock"`
+	Subflow uintptr          `kprobe:"subflow"`
+	Token   uint32           `kprobe:"token"`
+}
+
+// String returns a representation of the event.
+func (e *mptcpCloseSubflow) String() string {
+	return fmt.Sprintf("%s __mptcp_close_ssk(sock=0x%x, subflow=0x%x, token=0x%08x)", header(e.Meta), e.Sock, e.Subflow, e.Token)
+}
+
+// Update the state with the contents of this event.
+func (e *mptcpCloseSubflow) Update(s *state) error {
+	return s.OnMPTCPSubflow(e.Sock, e.Subflow, e.Token)
+}
+
+type tcpReset struct {
+	Meta tracing.Metadata `kprobe:"metadata"`
+	Sock uintptr          `kprobe:"sock"`
+	// set by the decoder of the probe on the send path.
+	sent bool
+}
+
+// String returns a representation of the event.
+func (e *tcpReset) String() string {
+	if e.sent {
+		return fmt.Sprintf("%s tcp_send_active_reset(sock=0x%x)", header(e.Meta), e.Sock)
+	}
+	return fmt.Sprintf("%s tcp_reset(sock=0x%x)", header(e.Meta), e.Sock)
+}
+
+// Update the state with the contents of this event.
+func (e *tcpReset) Update(s *state) error {
+	return s.OnTCPReset(e.Sock, e.sent)
+}
+
+type tcpFin struct {
+	Meta  tracing.Metadata `kprobe:"metadata"`
+	Sock  uintptr          `kprobe:"sock"`
+	State uint8            `kprobe:"state"`
+	// set by the decoder of the probe on the send path.
+	sent bool
+}
+
+// String returns a representation of the event.
+func (e *tcpFin) String() string {
+	if e.sent {
+		return fmt.Sprintf("%s tcp_send_fin(sock=0x%x, state=%s)", header(e.Meta), e.Sock, tcpStateName(e.State))
+	}
+	return fmt.Sprintf("%s tcp_fin(sock=0x%x, state=%s)", header(e.Meta), e.Sock, tcpStateName(e.State))
+}
+
+// Update the state with the contents of this event.
+func (e *tcpFin) Update(s *state) error {
+	return s.OnTCPFin(e.Sock, e.sent, e.State)
+}
+
+type tcpDone struct {
+	Meta  tracing.Metadata `kprobe:"metadata"`
+	Sock  uintptr          `kprobe:"sock"`
+	State uint8            `kprobe:"state"`
+	// Err is only fetched once the offset of sk_err has been guessed.
+	Err int32 `kprobe:"err,optional"`
+}
+
+// String returns a representation of the event.
+func (e *tcpDone) String() string {
+	return fmt.Sprintf("%s tcp_done(sock=0x%x, state=%s, err=%d)", header(e.Meta), e.Sock, tcpStateName(e.State), e.Err)
+}
+
+// Update the state with the contents of this event.
+func (e *tcpDone) Update(s *state) error {
+	if e.State != tcpStateSynSent {
+		return nil
+	}
+	return s.OnTCPConnectFailed(e.Sock, e.Err, kernelTime(e.Meta.Timestamp))
+}
+
+type mptcpEvent struct {
+	Meta    tracing.Metadata `kprobe:"metadata"`
+	Type    int32            `kprobe:"type"`
+	Sock    uintptr          `kprobe:"sock"`
+	Subflow uintptr          `kprobe:"subflow"`
+	Token   uint32           `kprobe:"token"`
+}
+
+// String returns a representation of the event.
+func (e *mptcpEvent) String() string {
+	return fmt.Sprintf("%s mptcp_event(type=%d, sock=0x%x, subflow=0x%x, token=0x%08x)", header(e.Meta), e.Type, e.Sock, e.Subflow, e.Token)
+}
+
+// Update the state with the contents of this event.
+func (e *mptcpEvent) Update(s *state) error {
+	return s.OnMPTCPEvent(e.Type, e.Sock, e.Subflow, e.Token)
+}
+
+type tcpFastOpen struct {
+	Meta tracing.Metadata `kprobe:"metadata"`
+	Sock uintptr          `kprobe:"sock"`
+}
+
+// String returns a representation of the event.
+func (e *tcpFastOpen) String() string {
+	return fmt.Sprintf("%s tcp_fastopen(sock=0x%x)", header(e.Meta), e.Sock)
+}
+
+// Update the state with the contents of this event.
+func (e *tcpFastOpen) Update(s *state) error {
+	return s.OnTCPFastOpen(e.Sock)
+}
+
+// Bit of tcp_options_received.tstamp_ok in the byte fetched at
+// TCP_SOCK_TSTAMP_OK.
+const rxOptTstampOK = 0x02
+
+type tcpInitTransfer struct {
+	Meta  tracing.Metadata `kprobe:"metadata"`
+	Sock  uintptr          `kprobe:"sock"`
+	RxOpt uint8            `kprobe:"rxopt"`
+}
+
+func (e *tcpInitTransfer) timestamps() bool {
+	return e.RxOpt&rxOptTstampOK != 0
+}
+
+// String returns a representation of the event.
+func (e *tcpInitTransfer) String() string {
+	return fmt.Sprintf("%s tcp_init_transfer(sock=0x%x, timestamps=%t)", header(e.Meta), e.Sock, e.timestamps())
+}
+
+// Update the state with the contents of this event.
+func (e *tcpInitTransfer) Update(s *state) error {
+	return s.OnTCPEstablishedOptions(e.Sock, e.timestamps())
+}
+
+type ipTunnelXmit struct {
+	Meta  tracing.Metadata `kprobe:"metadata"`
+	SAddr uint32           `kprobe:"saddr"`
+	DAddr uint32           `kprobe:"daddr"`
+	Proto uint8            `kprobe:"proto"`
+	Size  uint32           `kprobe:"size"`
+}
+
+// String returns a representation of the event.
+func (e *ipTunnelXmit) String() string {
+	return fmt.Sprintf("%s ip_tunnel_xmit(%s -> %s, proto=%d, size=%d)",
+		header(e.Meta),
+		kernelIPv4(e.SAddr),
+		kernelIPv4(e.DAddr),
+		e.Proto,
+		e.Size)
+}
+
+// Update the state with the contents of this event.
+func (e *ipTunnelXmit) Update(s *state) error {
+	return s.OnTunnelPacket(kernelTime(e.Meta.Timestamp), e.SAddr, e.DAddr, e.Proto, directionEgress, e.Size)
+}
+
+type ipTunnelRcv struct {
+	Meta   tracing.Metadata          `kprobe:"metadata"`
+	Size   uint32                    `kprobe:"size"`
+	IPHdr  uint16                    `kprobe:"iphdr"`
+	Base   uintptr                   `kprobe:"base"`
+	Packet [skBuffDataDumpBytes]byte `kprobe:"packet,greedy"`
+}
+
+func validOuterIPv4Header(ipHdr uint16, _ uint16, data []byte) bool {
+	return ipHdr != 0 &&
+		int(ipHdr)+20 <= len(data) &&
+		data[ipHdr]&0xF0 == 0x40
+}
+
+// outerHeader returns the local and remote addresses and the protocol of the
+// outer IPv4 header of the decapsulated packet.
+func (e *ipTunnelRcv) outerHeader() (local, remote uint32, proto uint8, ok bool) {
+	ipHdr, _, ok := packetHeaderOffsets(e.IPHdr, e.IPHdr, e.Base, e.Packet[:], validOuterIPv4Header)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	// the remote is this packet's source
+	remote = tracing.MachineEndian.Uint32(e.Packet[ipHdr+12:])
+	local = tracing.MachineEndian.Uint32(e.Packet[ipHdr+16:])
+	return local, remote, e.Packet[ipHdr+9], true
+}
+
+// String returns a representation of the event.
+func (e *ipTunnelRcv) String() string {
+	local, remote, proto, _ := e.outerHeader()
+	return fmt.Sprintf("%s ip_tunnel_rcv(%s <- %s, proto=%d, size=%d)",
+		header(e.Meta),
+		kernelIPv4(local),
+		kernelIPv4(remote),
+		proto,
+		e.Size)
+}
+
+// Update the state with the contents of this event.
+func (e *ipTunnelRcv) Update(s *state) error {
+	if local, remote, proto, ok := e.outerHeader(); ok {
+		return s.OnTunnelPacket(kernelTime(e.Meta.Timestamp), local, remote, proto, directionIngress, e.Size)
+	}
+	return nil
+}
+
+type netlinkCreate struct {
+	Meta     tracing.Metadata `kprobe:"metadata"`
+	Sock     uintptr          `kprobe:"sock"`
+	Protocol int32            `kprobe:"protocol"`
+}
+
+// String returns a representation of the event.
+func (e *netlinkCreate) String() string {
+	return fmt.Sprintf("%s netlink_create(sock=0x%x, protocol=%s)", header(e.Meta), e.Sock, netlinkFamilyName(e.Protocol))
+}
+
+// Update the state with the contents of this event.
+func (e *netlinkCreate) Update(s *state) error {
+	return s.OnNetlinkCreate(e.Sock, e.Protocol, e.Meta.PID, kernelTime(e.Meta.Timestamp))
+}
+
+type netlinkSendMsg struct {
+	Meta tracing.Metadata `kprobe:"metadata"`
+	Sock uintptr          `kprobe:"sock"`
+	Size uintptr          `kprobe:"size"`
+}
+
+// String returns a representation of the event.
+func (e *netlinkSendMsg) String() string {
+	return fmt.Sprintf("%s netlink_sendmsg(sock=0x%x, size=%d)", header(e.Meta), e.Sock, e.Size)
+}
+
+// Update the state with the contents of this event.
+func (e *netlinkSendMsg) Update(s *state) error {
+	return s.OnNetlinkSend(e.Sock, uint64(e.Size), e.Meta.PID, kernelTime(e.Meta.Timestamp))
+}
+
+type netlinkRelease struct {
+	Meta tracing.Metadata `kprobe:"metadata"`
+	Sock uintptr          `kprobe:"sock"`
+}
+
+// String returns a representation of the event.
+func (e *netlinkRelease) String() string {
+	return fmt.Sprintf("%s netlink_release(sock=0x%x)", header(e.Meta), e.Sock)
+}
+
+// Update the state with the contents of this event.
+func (e *netlinkRelease) Update(s *state) error {
+	return s.OnNetlinkRelease(e.Sock)
+}
+
+// packetHeaderOffsets returns the offsets of the network and transport
+// headers within the dump of a packet. Depending on the kernel, sk_buff
+// holds them as offsets from its head or as pointers, in which case only
+// their lower 16 bits are fetched.
+func packetHeaderOffsets(ipHdr, l4Hdr uint16, base uintptr, data []byte, valid func(uint16, uint16, []byte) bool) (uint16, uint16, bool) {
+	if valid(ipHdr, l4Hdr, data) {
+		return ipHdr, l4Hdr, true
+	}
+	// Same little-endian only logic as in udpQueueRcvSkb.
+	b := uint16(base)
+	if ipHdr > b && l4Hdr > b && valid(ipHdr-b, l4Hdr-b, data) {
+		return ipHdr - b, l4Hdr - b, true
+	}
+	return 0, 0, false
+}
+
+type tcpV4ConnRequest struct {
+	Meta   tracing.Metadata          `kprobe:"metadata"`
+	Sock   uintptr                   `kprobe:"sock"`
+	IPHdr  uint16                    `kprobe:"iphdr"`
+	TCPHdr uint16                    `kprobe:"tcphdr"`
+	Base   uintptr                   `kprobe:"base"`
+	Packet [skBuffDataDumpBytes]byte `kprobe:"packet,greedy"`
+}
+
+// endpoints returns the local and remote endpoints of the connection
+// request, from the destination and source of the SYN.
+func (e *tcpV4ConnRequest) endpoints() (local, remote endpoint, ok bool) {
+	ipHdr, tcpHdr, ok := packetHeaderOffsets(e.IPHdr, e.TCPHdr, e.Base, e.Packet[:], validIPv4Headers)
+	if !ok {
+		return local, remote, false
+	}
+	remote = newEndpointIPv4(tracing.MachineEndian.Uint32(e.Packet[ipHdr+12:]),
+		tracing.MachineEndian.Uint16(e.Packet[tcpHdr:]), 0, 0)
+	local = newEndpointIPv4(tracing.MachineEndian.Uint32(e.Packet[ipHdr+16:]),
+		tracing.MachineEndian.Uint16(e.Packet[tcpHdr+2:]), 0, 0)
+	return local, remote, true
+}
+
+// String returns a representation of the event.
+func (e *tcpV4ConnRequest) String() string {
+	local, remote, _ := e.endpoints()
+	return fmt.Sprintf("%s tcp_v4_conn_request(sock=0x%x, %s <- %s)", header(e.Meta), e.Sock, local.String(), remote.String())
+}
+
+// Update the state with the contents of this event.
+func (e *tcpV4ConnRequest) Update(s *state) error {
+	if local, remote, ok := e.endpoints(); ok {
+		return s.OnConnRequest(local, remote)
+	}
+	return nil
+}
+
+type tcpV6ConnRequest tcpV4ConnRequest
+
+// endpoints returns the local and remote endpoints of the connection
+// request, from the destination and source of the SYN.
+func (e *tcpV6ConnRequest) endpoints() (local, remote endpoint, ok bool) {
+	ipHdr, tcpHdr, ok := packetHeaderOffsets(e.IPHdr, e.TCPHdr, e.Base, e.Packet[:], validIPv6Headers)
+	if !ok {
+		return local, remote, false
+	}
+	remote = newEndpointIPv6(tracing.MachineEndian.Uint64(e.Packet[ipHdr+8:]),
+		tracing.MachineEndian.Uint64(e.Packet[ipHdr+16:]),
+		tracing.MachineEndian.Uint16(e.Packet[tcpHdr:]), 0, 0)
+	local = newEndpointIPv6(tracing.MachineEndian.Uint64(e.Packet[ipHdr+24:]),
+		tracing.MachineEndian.Uint64(e.Packet[ipHdr+32:]),
+		tracing.MachineEndian.Uint16(e.Packet[tcpHdr+2:]), 0, 0)
+	return local, remote, true
+}
+
+// String returns a representation of the event.
+func (e *tcpV6ConnRequest) String() string {
+	local, remote, _ := e.endpoints()
+	return fmt.Sprintf("%s tcp_v6_conn_request(sock=0x%x, %s <- %s)", header(e.Meta), e.Sock, local.String(), remote.String())
+}
+
+// Update the state with the contents of this event.
+func (e *tcpV6ConnRequest) Update(s *state) error {
+	if local, remote, ok := e.endpoints(); ok {
+		return s.OnConnRequest(local, remote)
+	}
+	return nil
+}
+
+type sctpIPv4ConnectCall tcpIPv4ConnectCall
+
+func (e *sctpIPv4ConnectCall) asFlow() flow {
+	evTime := kernelTime(e.Meta.Timestamp)
+	return flow{
+		sock:     e.Sock,
+		pid:      e.Meta.PID,
+		tid:      e.Meta.TID,
+		inetType: inetTypeIPv4,
+		proto:    protoSCTP,
+		dir:      directionEgress,
+		complete: true,
+		lastSeen: evTime,
+		created:  evTime,
+		local:    newEndpointIPv4(e.LAddr, e.LPort, 0, 0),
+		remote:   newEndpointIPv4(e.RAddr, e.RPort, 0, 0),
+		// The local address is only known once the association is
+		// established.
+		connectAttempt: true,
+	}
+}
+
+// String returns a representation of the event.
+func (e *sctpIPv4ConnectCall) String() string {
+	f := e.asFlow()
+	return fmt.Sprintf("%s sctp_connect(sock=0x%x, %s -> %s)", header(e.Meta), e.Sock, f.local.String(), f.remote.String())
+}
+
+// Update the state with the contents of this event.
+func (e *sctpIPv4ConnectCall) Update(s *state) error {
+	return s.ThreadEnter(e.Meta.TID, e)
+}
+
+type sctpIPv6ConnectCall tcpIPv6ConnectCall
+
+func (e *sctpIPv6ConnectCall) asFlow() flow {
+	evTime := kernelTime(e.Meta.Timestamp)
+	return flow{
+		sock:     e.Sock,
+		pid:      e.Meta.PID,
+		tid:      e.Meta.TID,
+		inetType: inetTypeIPv6,
+		proto:    protoSCTP,
+		dir:      directionEgress,
+		complete: true,
+		lastSeen: evTime,
+		created:  evTime,
+		local:    newEndpointIPv6(e.LAddrA, e.LAddrB, e.LPort, 0, 0),
+		remote:   newEndpointIPv6(e.RAddrA, e.RAddrB, e.RPort, 0, 0),
+		// The local address is only known once the association is
+		// established.
+		connectAttempt: true,
+	}
+}
+
+// String returns a representation of the event.
+func (e *sctpIPv6ConnectCall) String() string {
+	f := e.asFlow()
+	return fmt.Sprintf("%s sctp_connect6(sock=0x%x, %s -> %s)", header(e.Meta), e.Sock, f.local.String(), f.remote.String())
+}
+
+// Update the state with the contents of this event.
+func (e *sctpIPv6ConnectCall) Update(s *state) error {
+	return s.ThreadEnter(e.Meta.TID, e)
+}
+
+type sctpConnectResult struct {
+	Meta   tracing.Metadata `kprobe:"metadata"`
+	Retval int32            `kprobe:"retval"`
+}
+
+// String returns a representation of the event.
+func (e *sctpConnectResult) String() string {
+	return fmt.Sprintf("%s <- sctp_connect %s", header(e.Meta), kernErrorDesc(e.Retval))
+}
+
+// Update the state with the contents of this event.
+func (e *sctpConnectResult) Update(s *state) error {
+	ev, found := s.ThreadLeave(e.Meta.TID)
+	if !found {
+		return nil
+	}
+	// As with TCP, failed associations are also recorded.
+	switch call := ev.(type) {
+	case *sctpIPv4ConnectCall:
+		return s.OnSCTPAssociation(call.asFlow())
+	case *sctpIPv6ConnectCall:
+		return s.OnSCTPAssociation(call.asFlow())
+	}
+	return fmt.Errorf("stored thread event has unexpected type %T", ev)
+}
+
+type sctpAcceptResult tcpAcceptResult
+
+func (e *sctpAcceptResult) asFlow() flow {
+	f := (*tcpAcceptResult)(e).asFlow()
+	f.proto = protoSCTP
+	return f
+}
+
+// String returns a representation of the event.
+func (e *sctpAcceptResult) String() string {
+	f := e.asFlow()
+	return fmt.Sprintf("%s <- sctp_accept(sock=0x%x, af=%s, %s <- %s)", header(e.Meta), e.Sock, inetType(e.Af), f.local.String(), f.remote.String())
+}
+
+// Update the state with the contents of this event.
+func (e *sctpAcceptResult) Update(s *state) error {
+	if e.Sock != 0 {
+		return s.OnSCTPAssociation(e.asFlow())
+	}
+	return nil
+}
+
+type sctpAcceptResult4 tcpAcceptResult4
+
+func (e *sctpAcceptResult4) asFlow() flow {
+	f := (*tcpAcceptResult4)(e).asFlow()
+	f.proto = protoSCTP
+	return f
+}
+
+// String returns a representation of the event.
+func (e *sctpAcceptResult4) String() string {
+	f := e.asFlow()
+	return fmt.Sprintf("%s <- sctp_accept(sock=0x%x, af=%s, %s <- %s)", header(e.Meta), e.Sock, inetType(e.Af), f.local.String(), f.remote.String())
+}
+
+// Update the state with the contents of this event.
+func (e *sctpAcceptResult4) Update(s *state) error {
+	if e.Sock != 0 {
+		return s.OnSCTPAssociation(e.asFlow())
+	}
+	return nil
+}
+
+type sctpAssociationFree struct {
+	Meta     tracing.Metadata `kprobe:"metadata"`
+	Sock     uintptr          `kprobe:"sock"`
+	MyVTag   uint32           `kprobe:"my_vtag"`
+	PeerVTag uint32           `kprobe:"peer_vtag"`
+	OStreams uint16           `kprobe:"ostreams"`
+	IStreams uint16           `kprobe:"istreams"`
+	LAddr    uint32           `kprobe:"laddr"`
+	LPort    uint16           `kprobe:"lport"`
+}
+
+// String returns a representation of the event.
+func (e *sctpAssociationFree) String() string {
+	local := newEndpointIPv4(e.LAddr, e.LPort, 0, 0)
+	return fmt.Sprintf("%s sctp_association_free(sock=0x%x, vtag=0x%08x/0x%08x, streams=%d/%d, local=%s)",
+		header(e.Meta), e.Sock, e.MyVTag, e.PeerVTag, e.OStreams, e.IStreams, local.String())
+}
+
+// Update the state with the contents of this event.
+func (e *sctpAssociationFree) Update(s *state) error {
+	return s.OnSCTPAssociationFree(e.Sock, sctpAssocInfo{
+		localVTag:  e.MyVTag,
+		remoteVTag: e.PeerVTag,
+		outStreams: e.OStreams,
+		inStreams:  e.IStreams,
+	}, newEndpointIPv4(e.LAddr, e.LPort, 0, 0))
+}
+
 // Fetching data from execve is complicated as support for strings or arrays
 // in Kprobes appeared in recent kernels (~2018). To be compatible with older
 // kernels it needs to dump fixed-size arrays in 8-byte chunks. As the total
@@ -894,11 +1739,11 @@ func (e *execveCall) getProcess() *process {
 		var err error
 		p.path, err = filepath.EvalSymlinks(fmt.Sprintf("/proc/%d/exe", e.Meta.PID))
 		if err != nil {
-			if pe, ok := err.(*os.PathError); ok && strings.Contains(pe.Path, "(deleted)") {
-				// Keep the deleted path from the PathError.
-				p.path = pe.Path
+			if pe, ok := err.(*os.PathError); ok && strings.HasSuffix(pe.Path, deletedSuffix) {
+				// Keep the deleted path from the PathError, without the suffix.
+				p.path, p.exeDeleted = splitDeletedPath(pe.Path)
 				// Keep the basename in case we can't get the process name.
-				p.name = filepath.Base(strings.TrimSuffix(p.path, " (deleted)"))
+				p.name = filepath.Base(p.path)
 			} else {
 				// Fallback to the truncated path.
 				p.path = string(e.Path[:]) + " ..."
@@ -968,11 +1813,8 @@ func (e *execveCall) getProcess() *process {
 	}
 
 	if e.creds != nil {
-		p.hasCreds = true
-		p.uid = e.creds.UID
-		p.gid = e.creds.GID
-		p.euid = e.creds.EUID
-		p.egid = e.creds.EGID
+		// Masked with the captured fields by the state.
+		p.setCreds(allCredFields, e.creds.UID, e.creds.GID, e.creds.EUID, e.creds.EGID)
 	}
 
 	return p
@@ -1050,7 +1892,7 @@ func (e *doExit) String() string {
 func (e *doExit) Update(s *state) (err error) {
 	// Only report exits of the main thread, a.k.a process exit
 	if e.Meta.PID == e.Meta.TID {
-		err = s.TerminateProcess(e.Meta.PID)
+		err = s.TerminateProcess(e.Meta.PID, kernelTime(e.Meta.Timestamp))
 	}
 	// Cleanup any saved thread state
 	s.ThreadLeave(e.Meta.TID)
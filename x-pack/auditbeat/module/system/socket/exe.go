@@ -0,0 +1,78 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Suffix the kernel appends to the /proc/<pid>/exe link of a process
+	// whose executable was unlinked.
+	deletedSuffix = " (deleted)"
+
+	// How often the executable of a process is checked again for deletion
+	// when its flows are reported.
+	exeCheckInterval = 10 * time.Second
+)
+
+// splitDeletedPath removes the suffix of unlinked executables from a path,
+// returning whether it was present.
+func splitDeletedPath(path string) (clean string, deleted bool) {
+	if clean = strings.TrimSuffix(path, deletedSuffix); clean != path {
+		return clean, true
+	}
+	return path, false
+}
+
+// isExecutableDeleted returns whether the executable of the given process
+// has been unlinked, as reported by /proc/<pid>/exe.
+func isExecutableDeleted(pid uint32) (bool, error) {
+	link, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return false, err
+	}
+	_, deleted := splitDeletedPath(link)
+	return deleted, nil
+}
+
+// withDeletedExecutableCheck enables checking whether the executable of
+// processes has been unlinked when their flows are reported.
+func withDeletedExecutableCheck(enabled bool) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.isExeDeleted = isExecutableDeleted
+		}
+	}
+}
+
+// checkExecutableDeleted returns whether the executable of the process has
+// been unlinked. It's usually deleted after the process started, so it's
+// checked again, at most once every exeCheckInterval, until it is. Flows are
+// reported without the state locked, so it doesn't block event processing.
+func (s *state) checkExecutableDeleted(p *process) bool {
+	if p == nil || s.isExeDeleted == nil {
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.exeDeleted {
+		return true
+	}
+	now := s.clock()
+	if !p.exeCheckedAt.IsZero() && now.Sub(p.exeCheckedAt) < exeCheckInterval {
+		return false
+	}
+	p.exeCheckedAt = now
+	if deleted, err := s.isExeDeleted(p.pid); err == nil && deleted {
+		p.exeDeleted = true
+	}
+	return p.exeDeleted
+}
@@ -0,0 +1,146 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitDeletedPath(t *testing.T) {
+	for _, tc := range []struct {
+		path, clean string
+		deleted     bool
+	}{
+		{"/usr/bin/curl", "/usr/bin/curl", false},
+		{"/tmp/.x/payload (deleted)", "/tmp/.x/payload", true},
+		{"/tmp/(deleted)", "/tmp/(deleted)", false},
+	} {
+		clean, deleted := splitDeletedPath(tc.path)
+		assert.Equal(t, tc.clean, clean, tc.path)
+		assert.Equal(t, tc.deleted, deleted, tc.path)
+	}
+}
+
+func TestExecutableDeleted(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not available:", err)
+	}
+	path := filepath.Join(t.TempDir(), "payload")
+	if err := copyExecutable(sleep, path); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(path, "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := uint32(cmd.Process.Pid)
+
+	deleted, err := isExecutableDeleted(pid)
+	if assert.NoError(t, err) {
+		assert.False(t, deleted)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err = isExecutableDeleted(pid)
+	if assert.NoError(t, err) {
+		assert.True(t, deleted)
+	}
+}
+
+func copyExecutable(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0o755)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func TestFlowExecutableDeleted(t *testing.T) {
+	const sock uintptr = 0xff1234
+	lPort, rPort := be16(38842), be16(443)
+	lAddr, rAddr := ipv4("192.168.33.10"), ipv4("172.19.12.13")
+	flowEvents := func(sock uintptr, ts uint64) []event {
+		return []event{
+			&inetCreate{Meta: meta(1234, 1234, ts), Proto: 0},
+			&sockInitData{Meta: meta(1234, 1234, ts), Sock: sock},
+			&tcpIPv4ConnectCall{Meta: meta(1234, 1234, ts+1), Sock: sock, LAddr: lAddr, LPort: lPort, RAddr: rAddr, RPort: rPort},
+			&tcpConnectResult{Meta: meta(1234, 1234, ts+2), Retval: 0},
+			&inetReleaseCall{Meta: meta(1234, 1234, ts+3), Sock: sock},
+		}
+	}
+	for _, enabled := range []bool{true, false} {
+		st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+		withDeletedExecutableCheck(enabled)(&st.state)
+		now := time.Now()
+		st.clock = func() time.Time { return now }
+		deleted, checks := false, 0
+		if enabled {
+			st.isExeDeleted = func(pid uint32) (bool, error) {
+				assert.EqualValues(t, 1234, pid)
+				checks++
+				return deleted, nil
+			}
+		}
+		st.feedEvents([]event{
+			callExecve(meta(1234, 1234, 1), []string{"/tmp/payload"}),
+			&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+		})
+		report := func(sock uintptr, ts uint64) {
+			st.feedEvents(flowEvents(sock, ts))
+			now = now.Add(time.Second)
+			st.ExpireFlows()
+		}
+		// The executable is deleted after the first flow is reported.
+		report(sock, 10)
+		deleted = true
+		report(sock+1, 20)
+		now = now.Add(exeCheckInterval)
+		report(sock+2, 30)
+		report(sock+3, 40)
+		flows := st.getFlows()
+		if !assert.Len(t, flows, 4) {
+			t.FailNow()
+		}
+		reported := 0
+		for _, f := range flows {
+			if v, err := f.GetValue("process.executable_deleted"); err == nil {
+				assert.Equal(t, true, v)
+				reported++
+			}
+			assertValue(t, f, "/tmp/payload", "process.executable")
+		}
+		if enabled {
+			// Only checked again after exeCheckInterval, then remembered.
+			assert.Equal(t, 2, checks)
+			assert.Equal(t, 2, reported)
+		} else {
+			assert.Zero(t, reported)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// How long the number of open file descriptors of a process is reused for
+// its flows before /proc/<pid>/fd is read again.
+const fdCountTTL = 5 * time.Second
+
+// countOpenFDs returns the number of file descriptors open by the given
+// process, as listed in /proc/<pid>/fd.
+func countOpenFDs(pid uint32) (int, error) {
+	dir, err := os.Open(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return 0, err
+	}
+	return len(names), nil
+}
+
+// withProcessFDCount enables reporting the number of file descriptors open
+// by the process of flows.
+func withProcessFDCount(enabled bool) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.countFDs = countOpenFDs
+		}
+	}
+}
+
+// processFDCount returns the number of file descriptors open by the process,
+// and false when it's unknown, as happens when /proc/<pid>/fd can't be read.
+// The count is cached for fdCountTTL, so that processes with many flows
+// don't list their descriptors for each of them.
+func (s *state) processFDCount(p *process) (int, bool) {
+	if p == nil || s.countFDs == nil {
+		return 0, false
+	}
+	p.Lock()
+	defer p.Unlock()
+	now := s.clock()
+	if !p.fdCountedAt.IsZero() && now.Sub(p.fdCountedAt) < fdCountTTL {
+		return p.fdCount, p.hasFDCount
+	}
+	p.fdCountedAt = now
+	count, err := s.countFDs(p.pid)
+	p.fdCount, p.hasFDCount = count, err == nil
+	return p.fdCount, p.hasFDCount
+}
@@ -0,0 +1,102 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountOpenFDs(t *testing.T) {
+	before, err := countOpenFDs(uint32(os.Getpid()))
+	if err != nil {
+		t.Skip("/proc not available:", err)
+	}
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	after, err := countOpenFDs(uint32(os.Getpid()))
+	if assert.NoError(t, err) {
+		assert.Equal(t, before+1, after)
+	}
+}
+
+func TestFlowProcessFDCount(t *testing.T) {
+	flowEvents := func(sock uintptr, ts uint64) []event {
+		return []event{
+			&inetCreate{Meta: meta(1234, 1234, ts), Proto: 0},
+			&sockInitData{Meta: meta(1234, 1234, ts), Sock: sock},
+			&tcpIPv4ConnectCall{
+				Meta:  meta(1234, 1234, ts+1),
+				Sock:  sock,
+				LAddr: ipv4(testLocalIP),
+				LPort: be16(testLocalPort),
+				RAddr: ipv4(testRemoteIP),
+				RPort: be16(testRemotePort),
+			},
+			&tcpConnectResult{Meta: meta(1234, 1234, ts+2), Retval: 0},
+			&inetReleaseCall{Meta: meta(1234, 1234, ts+3), Sock: sock},
+		}
+	}
+	for _, enabled := range []bool{true, false} {
+		st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+		withProcessFDCount(enabled)(&st.state)
+		now := time.Now()
+		st.clock = func() time.Time { return now }
+		count, reads := 10, 0
+		var readErr error
+		if enabled {
+			st.countFDs = func(pid uint32) (int, error) {
+				assert.EqualValues(t, 1234, pid)
+				reads++
+				return count, readErr
+			}
+		}
+		st.feedEvents([]event{
+			callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl"}),
+			&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+		})
+		report := func(sock uintptr, ts uint64) {
+			st.feedEvents(flowEvents(sock, ts))
+			now = now.Add(time.Second)
+			st.ExpireFlows()
+		}
+		report(testSock, 10)
+		// Cached until fdCountTTL has elapsed.
+		count = 20
+		report(testSock+1, 20)
+		now = now.Add(fdCountTTL)
+		report(testSock+2, 30)
+		// The process has exited.
+		now = now.Add(fdCountTTL)
+		readErr = errors.New("no such file or directory")
+		report(testSock+3, 40)
+		flows := st.getFlows()
+		if !assert.Len(t, flows, 4) {
+			t.FailNow()
+		}
+		if !enabled {
+			for _, f := range flows {
+				_, err := f.GetValue("process.fd_count")
+				assert.Error(t, err)
+			}
+			continue
+		}
+		assert.Equal(t, 3, reads)
+		assertValue(t, flows[0], 10, "process.fd_count")
+		assertValue(t, flows[1], 10, "process.fd_count")
+		assertValue(t, flows[2], 20, "process.fd_count")
+		_, err := flows[3].GetValue("process.fd_count")
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Extended attribute holding the capabilities granted to an executable by
+// setcap.
+const fileCapabilitiesXattr = "security.capability"
+
+// readFileCapabilities returns whether the executable of the given process
+// has file capabilities. It's read through /proc/<pid>/exe, so that it's the
+// file being run even in another mount namespace. Filesystems without support
+// for extended attributes can't hold file capabilities.
+func readFileCapabilities(pid uint32) (bool, error) {
+	_, err := unix.Getxattr(fmt.Sprintf("/proc/%d/exe", pid), fileCapabilitiesXattr, nil)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, unix.ENODATA), errors.Is(err, unix.ENOTSUP):
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,95 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadFileCapabilities(t *testing.T) {
+	// The test binary is built without file capabilities, on a filesystem
+	// that may or may not support extended attributes.
+	hasFileCaps, err := readFileCapabilities(uint32(os.Getpid()))
+	if assert.NoError(t, err) {
+		assert.False(t, hasFileCaps)
+	}
+}
+
+func TestFileCapabilities(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		caps     bool
+		err      error
+		expected bool
+	}{
+		{name: "with file capabilities", caps: true, expected: true},
+		{name: "without file capabilities", caps: false},
+		{name: "unreadable", caps: true, err: errors.New("permission denied")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withProcessCapabilities(true)(&st.state)
+			st.readProcStatus = func(pid uint32) (procStatus, error) {
+				return procStatus{}, nil
+			}
+			reads := 0
+			st.readFileCaps = func(pid uint32) (bool, error) {
+				reads++
+				assert.EqualValues(t, 1234, pid)
+				return tc.caps, tc.err
+			}
+			st.feedEvents([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/bin/ping"}),
+				&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+			})
+			st.feedEvents(tcpConnectEvents(1234, 5, 8))
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1234, 20), Sock: testSock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			assert.Equal(t, 1, reads)
+			if !tc.expected {
+				_, err := flows[0].GetValue("process.executable_has_file_capabilities")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], true, "process.executable_has_file_capabilities")
+		})
+	}
+}
+
+func TestFileCapabilitiesInheritedByFork(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withProcessCapabilities(true)(&st.state)
+	st.readProcStatus = func(pid uint32) (procStatus, error) {
+		return procStatus{}, nil
+	}
+	st.readFileCaps = func(pid uint32) (bool, error) {
+		return true, nil
+	}
+	if err := st.CreateProcess(&process{pid: 1234, name: "ping"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.ForkProcess(1234, 1240, 10); err != nil {
+		t.Fatal(err)
+	}
+	child := st.getProcess(1240)
+	if !assert.NotNil(t, child) {
+		t.FailNow()
+	}
+	assert.True(t, child.hasFileCaps)
+	assert.True(t, child.hasFileCapsKnown)
+}
@@ -0,0 +1,119 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// Flows that couldn't be written to the flow export socket, exposed through
+// the monitoring endpoint.
+var flowExportDropped = monitoring.NewUint(monitoringRegistry, "flow_export_dropped")
+
+// flowExporter writes completed flows to a Unix datagram socket for local
+// consumers, independently of the output pipeline. Each datagram contains a
+// single flow as a JSON document, or a CEF record, preceded by its length as a
+// 32-bit big-endian integer.
+//
+// Writes never block: when the consumer isn't listening or can't keep up,
+// the flow is dropped and counted.
+type flowExporter struct {
+	// Flows dropped by this exporter. First field to be 64-bit aligned on
+	// 386, as required by atomic operations.
+	dropped uint64
+
+	addr    unix.SockaddrUnix
+	log     *logp.Logger
+	marshal func(mb.Event) ([]byte, error)
+
+	mu sync.Mutex
+	fd int
+}
+
+func newFlowExporter(path, format string, log *logp.Logger) (*flowExporter, error) {
+	marshal := marshalEvent
+	if format == exportFormatCEF {
+		marshal = marshalCEF
+	}
+	// The socket isn't connected so that the consumer can be started, or
+	// restarted, after the dataset.
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create flow export socket: %w", err)
+	}
+	return &flowExporter{
+		addr:    unix.SockaddrUnix{Name: path},
+		log:     log,
+		marshal: marshal,
+		fd:      fd,
+	}, nil
+}
+
+// Export writes a flow event to the socket. It returns false when the flow
+// was dropped.
+func (e *flowExporter) Export(event mb.Event) bool {
+	doc, err := e.marshal(event)
+	if err != nil {
+		e.log.Warnf("Failed to serialize flow for export: %v", err)
+		e.drop()
+		return false
+	}
+	msg := make([]byte, 4+len(doc))
+	binary.BigEndian.PutUint32(msg, uint32(len(doc)))
+	copy(msg[4:], doc)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fd == -1 {
+		e.drop()
+		return false
+	}
+	if err = unix.Sendto(e.fd, msg, unix.MSG_DONTWAIT, &e.addr); err != nil {
+		// EAGAIN when the consumer is slow, ECONNREFUSED or ENOENT when it's
+		// not running. Only unexpected errors are logged, as the others
+		// would flood the log.
+		switch err {
+		case unix.EAGAIN, unix.ECONNREFUSED, unix.ENOENT, unix.ENOBUFS:
+		default:
+			e.log.Debugf("Failed to export flow to %s: %v", e.addr.Name, err)
+		}
+		e.drop()
+		return false
+	}
+	return true
+}
+
+func (e *flowExporter) drop() {
+	atomic.AddUint64(&e.dropped, 1)
+	flowExportDropped.Inc()
+}
+
+// Dropped returns the number of flows dropped by this exporter.
+func (e *flowExporter) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+// Close closes the socket. Flows exported afterwards are dropped.
+func (e *flowExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fd == -1 {
+		return nil
+	}
+	err := unix.Close(e.fd)
+	e.fd = -1
+	return err
+}
@@ -0,0 +1,89 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+func TestFlowExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.sock")
+	exporter, err := newFlowExporter(path, exportFormatJSON, logp.NewLogger(metricsetName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.Close()
+	ev := mb.Event{
+		RootFields:      mapstr.M{"destination": mapstr.M{"port": 443}},
+		MetricSetFields: mapstr.M{"kernel_sock_address": "0x1234"},
+	}
+
+	// Nothing is listening yet.
+	assert.False(t, exporter.Export(ev))
+	assert.EqualValues(t, 1, exporter.Dropped())
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.True(t, exporter.Export(ev))
+
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.GreaterOrEqual(t, n, 4) {
+		t.FailNow()
+	}
+	length := binary.BigEndian.Uint32(buf)
+	if !assert.EqualValues(t, n-4, length) {
+		t.FailNow()
+	}
+	var doc mapstr.M
+	if err = json.Unmarshal(buf[4:n], &doc); err != nil {
+		t.Fatal(err)
+	}
+	port, _ := doc.GetValue("destination.port")
+	assert.EqualValues(t, 443, port)
+	sock, _ := doc.GetValue("system.audit.socket.kernel_sock_address")
+	assert.Equal(t, "0x1234", sock)
+
+	// Writes don't block when the consumer doesn't read.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10000; i++ {
+			exporter.Export(ev)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("export blocked on a slow consumer")
+	}
+	assert.Greater(t, exporter.Dropped(), uint64(1))
+
+	// Flows exported after Close are dropped.
+	assert.NoError(t, exporter.Close())
+	dropped := exporter.Dropped()
+	assert.False(t, exporter.Export(ev))
+	assert.Equal(t, dropped+1, exporter.Dropped())
+}
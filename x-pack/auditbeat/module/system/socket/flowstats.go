@@ -0,0 +1,85 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// flowDurationBuckets are the buckets of the flow duration histogram. Each
+// bucket counts the flows shorter than its limit and not counted by the
+// previous one. The last bucket has no limit.
+var flowDurationBuckets = [...]struct {
+	name  string
+	limit time.Duration
+}{
+	{"lt_1ms", time.Millisecond},
+	{"lt_10ms", 10 * time.Millisecond},
+	{"lt_100ms", 100 * time.Millisecond},
+	{"lt_1s", time.Second},
+	{"lt_10s", 10 * time.Second},
+	{"ge_10s", 0},
+}
+
+// durationHistogram counts completed flows by duration.
+type durationHistogram [len(flowDurationBuckets)]uint64
+
+func (h *durationHistogram) add(d time.Duration) {
+	last := len(flowDurationBuckets) - 1
+	for i := 0; i < last; i++ {
+		if d < flowDurationBuckets[i].limit {
+			h[i]++
+			return
+		}
+	}
+	h[last]++
+}
+
+func (h *durationHistogram) String() string {
+	var sb strings.Builder
+	for i, b := range flowDurationBuckets {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(b.name)
+		sb.WriteByte(':')
+		sb.WriteString(strconv.FormatUint(h[i], 10))
+	}
+	return sb.String()
+}
+
+// Flow duration histogram for the last log interval, exposed through the
+// monitoring endpoint as system.socket.flow_durations.
+var publishedFlowDurations struct {
+	sync.RWMutex
+	hist durationHistogram
+}
+
+func init() {
+	monitoring.NewFunc(monitoringRegistry, "flow_durations", reportFlowDurations)
+}
+
+func reportFlowDurations(_ monitoring.Mode, V monitoring.Visitor) {
+	publishedFlowDurations.RLock()
+	defer publishedFlowDurations.RUnlock()
+	V.OnRegistryStart()
+	defer V.OnRegistryFinished()
+	for i, b := range flowDurationBuckets {
+		monitoring.ReportInt(V, b.name, int64(publishedFlowDurations.hist[i]))
+	}
+}
+
+func publishFlowDurations(h durationHistogram) {
+	publishedFlowDurations.Lock()
+	defer publishedFlowDurations.Unlock()
+	publishedFlowDurations.hist = h
+}
@@ -0,0 +1,75 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestDurationHistogram(t *testing.T) {
+	var h durationHistogram
+	for _, d := range []time.Duration{
+		0,
+		999 * time.Microsecond,
+		time.Millisecond,
+		50 * time.Millisecond,
+		100 * time.Millisecond,
+		time.Second,
+		9 * time.Second,
+		10 * time.Second,
+		time.Hour,
+	} {
+		h.add(d)
+	}
+	assert.Equal(t, durationHistogram{2, 1, 1, 1, 2, 2}, h)
+	assert.Equal(t, "lt_1ms:2 lt_10ms:1 lt_100ms:1 lt_1s:1 lt_10s:2 ge_10s:2", h.String())
+}
+
+func TestFlowDurations(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	st.feedEvents([]event{
+		&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+		&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock},
+		&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, LAddr: lAddr, LPort: lPort, RAddr: rAddr, RPort: rPort},
+		&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+		&tcpSendMsgCall4{
+			Meta:  meta(1234, 1235, 2*uint64(time.Second)),
+			Sock:  sock,
+			Size:  10,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+			Af:    unix.AF_INET,
+		},
+		&inetReleaseCall{Meta: meta(1234, 1235, 2*uint64(time.Second)), Sock: sock},
+	})
+	st.ExpireFlows()
+	if !assert.Len(t, st.getFlows(), 1) {
+		t.FailNow()
+	}
+	assert.Equal(t, durationHistogram{0, 0, 0, 0, 1, 0}, st.flowDurations)
+
+	st.logState()
+	assert.Equal(t, durationHistogram{}, st.flowDurations)
+	publishedFlowDurations.RLock()
+	defer publishedFlowDurations.RUnlock()
+	assert.Equal(t, durationHistogram{0, 0, 0, 0, 1, 0}, publishedFlowDurations.hist)
+}
@@ -10,6 +10,8 @@ package guess
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
@@ -25,6 +27,74 @@ type Context struct {
 	Vars mapstr.M
 	// Timeout is the maximum time allowed to wait for a guess to complete.
 	Timeout time.Duration
+	// Stats, if set, receives the outcome of every guess run by GuessAll.
+	Stats *Stats
+}
+
+// Stats collects the outcome of guesses.
+type Stats struct {
+	Results []Result
+}
+
+// Result describes the outcome of a single guess.
+type Result struct {
+	// Name of the guess.
+	Name string
+	// Duration is the time it took to run the guess, including repetitions.
+	Duration time.Duration
+	// Attempts is the number of runs that an EventualGuesser needed to
+	// succeed. It's 1 for other guesses.
+	Attempts int
+	// Err is the error returned by the guess, nil if it succeeded.
+	Err error
+}
+
+// Error is returned when a guess fails. It tells which guess failed, the
+// variables it didn't provide and the results of its runs, to help diagnose
+// the failure on a specific kernel.
+type Error struct {
+	// Guess is the name of the guess.
+	Guess string
+	// Variables are the variables that the guess didn't provide.
+	Variables []string
+	// Attempts is the number of times the guess ran, including repetitions.
+	// It's 0 when the guess couldn't run.
+	Attempts int
+	// Results holds the results of the runs that completed, if any. For a
+	// RepeatGuesser that failed to reduce them, these are the values that
+	// didn't match.
+	Results []mapstr.M
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *Error) Error() string {
+	vars := strings.Join(e.Variables, ", ")
+	if e.Attempts > 1 {
+		return fmt.Sprintf("%s failed after %d attempts (variables %s): %v", e.Guess, e.Attempts, vars, e.Err)
+	}
+	return fmt.Sprintf("%s failed (variables %s): %v", e.Guess, vars, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(guesser Guesser, attempts int, results []mapstr.M, err error) *Error {
+	return &Error{
+		Guess:     guesser.Name(),
+		Variables: guesser.Provides(),
+		Attempts:  attempts,
+		Results:   results,
+		Err:       err,
+	}
+}
+
+func (s *Stats) add(r Result) {
+	if s != nil {
+		s.Results = append(s.Results, r)
+	}
 }
 
 // Guesser is the interface that must be fulfilled to perform guesses using
@@ -82,51 +152,78 @@ type ConditionalGuesser interface {
 	Condition(ctx Context) (bool, error)
 }
 
+// OptionalGuesser is a guess whose failure is not fatal. When it fails, the
+// variables it provides are left undefined and the features depending on them
+// are disabled.
+type OptionalGuesser interface {
+	Guesser
+	// Optional returns if a failure of this guess can be ignored.
+	Optional() bool
+}
+
 // Guess is a helper function to easily determine memory layouts of kernel
 // structs and similar tasks. It installs the guesser's Probe, starts a perf
 // channel and executes the Trigger function. Each record received through the
 // channel is passed to the Extract function. Terminates once Extract succeeds
 // or the timeout expires.
 func Guess(guesser Guesser, installer helper.ProbeInstaller, ctx Context) (result mapstr.M, err error) {
+	result, _, err = guessWithAttempts(guesser, installer, ctx)
+	return result, err
+}
+
+// guessWithAttempts runs a guess. The attempts returned are the number of
+// runs that an EventualGuesser needed, and 1 for other guesses. On failure,
+// the error is an *Error.
+func guessWithAttempts(guesser Guesser, installer helper.ProbeInstaller, ctx Context) (result mapstr.M, attempts int, err error) {
+	attempts = 1
+	runs := 1
+	var results []mapstr.M
 	switch v := guesser.(type) {
 	case RepeatGuesser:
-		result, err = guessMultiple(v, installer, ctx)
+		result, results, err = guessMultiple(v, installer, ctx)
+		if runs = len(results); err != nil && runs < v.NumRepeats() {
+			// The last run failed.
+			runs++
+		}
 	case EventualGuesser:
-		result, err = guessEventually(v, installer, ctx)
+		result, attempts, err = guessEventually(v, installer, ctx)
+		runs = attempts
 	default:
 		result, err = guessOnce(guesser, installer, ctx)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("%s failed: %w", guesser.Name(), err)
+		return nil, attempts, newError(guesser, runs, results, err)
 	}
-	return result, nil
+	return result, attempts, nil
 }
 
-func guessMultiple(guess RepeatGuesser, installer helper.ProbeInstaller, ctx Context) (result mapstr.M, err error) {
-	var results []mapstr.M
+// guessMultiple runs a guess the required number of times and reduces the
+// results. It also returns the results of the runs that completed.
+func guessMultiple(guess RepeatGuesser, installer helper.ProbeInstaller, ctx Context) (result mapstr.M, results []mapstr.M, err error) {
 	for idx := 1; idx <= guess.NumRepeats(); idx++ {
 		r, err := guessOnce(guess, installer, ctx)
 		if err != nil {
-			return nil, err
+			return nil, results, err
 		}
 		ctx.Log.Debugf(" --- result of %s run #%d: %+v", guess.Name(), idx, r)
 		results = append(results, r)
 	}
-	return guess.Reduce(results)
+	result, err = guess.Reduce(results)
+	return result, results, err
 }
 
-func guessEventually(guess EventualGuesser, installer helper.ProbeInstaller, ctx Context) (result mapstr.M, err error) {
+func guessEventually(guess EventualGuesser, installer helper.ProbeInstaller, ctx Context) (result mapstr.M, attempts int, err error) {
 	limit := guess.MaxRepeats()
 	for i := 0; i < limit; i++ {
 		ctx.Log.Debugf(" --- %s run #%d", guess.Name(), i)
 		if result, err = guessOnce(guess, installer, ctx); err != nil {
-			return nil, err
+			return nil, i + 1, err
 		}
 		if len(result) != 0 {
-			return result, nil
+			return result, i + 1, nil
 		}
 	}
-	return nil, fmt.Errorf("guess %s didn't succeed after %d tries", guess.Name(), limit)
+	return nil, limit, fmt.Errorf("guess %s didn't succeed after %d tries", guess.Name(), limit)
 }
 
 func guessOnce(guesser Guesser, installer helper.ProbeInstaller, ctx Context) (result mapstr.M, err error) {
@@ -251,9 +348,16 @@ func containsAll(requirements []string, dict mapstr.M) bool {
 }
 
 // GuessAll will run all the registered guesses, taking care of doing so in an
-// order so that a probe dependencies are available before it runs.
+// order so that a probe dependencies are available before it runs. When a
+// required guess fails, the error is an *Error.
 func GuessAll(installer helper.ProbeInstaller, ctx Context) (err error) {
 	list := Registry.GetList()
+	sources, err := checkCollisions(list, ctx.Vars)
+	if err != nil {
+		return err
+	}
+	// Variables left undefined by failed optional guesses.
+	failed := make(map[string]bool)
 	start := time.Now()
 	ctx.Log.Infof("Running %d guesses ...", len(list))
 	// This simple O(N^2) topological sort is enough for the small
@@ -264,26 +368,61 @@ func GuessAll(installer helper.ProbeInstaller, ctx Context) (err error) {
 			if cond, isCond := guesser.(ConditionalGuesser); isCond {
 				mustRun, err := cond.Condition(ctx)
 				if err != nil {
-					return fmt.Errorf("condition failed for %s: %w", cond.Name(), err)
+					return newError(cond, 0, nil, fmt.Errorf("condition failed: %w", err))
 				}
 				if !mustRun {
 					ctx.Log.Debugf("Guess %s skipped.", cond.Name())
 					continue
 				}
 			}
+			if missing := requiresAny(guesser.Requires(), failed); missing != "" {
+				err := fmt.Errorf("required variable %s is not available", missing)
+				if opt, isOpt := guesser.(OptionalGuesser); !isOpt || !opt.Optional() {
+					return newError(guesser, 0, nil, fmt.Errorf("can't run: %w", err))
+				}
+				ctx.Stats.add(Result{Name: guesser.Name(), Err: err})
+				ctx.Log.Warnf("Optional guess %s skipped: %v", guesser.Name(), err)
+				for _, v := range guesser.Provides() {
+					failed[v] = true
+				}
+				continue
+			}
 			if !containsAll(guesser.Requires(), ctx.Vars) {
 				next = append(next, guesser)
 				continue
 			}
-			result, err := Guess(guesser, installer, ctx)
+			guessStart := time.Now()
+			result, attempts, err := guessWithAttempts(guesser, installer, ctx)
+			ctx.Stats.add(Result{
+				Name:     guesser.Name(),
+				Duration: time.Since(guessStart),
+				Attempts: attempts,
+				Err:      err,
+			})
 			if err != nil {
+				if opt, isOpt := guesser.(OptionalGuesser); isOpt && opt.Optional() {
+					ctx.Log.Warnf("Optional guess %s failed: %v", guesser.Name(), err)
+					for _, v := range guesser.Provides() {
+						failed[v] = true
+					}
+					continue
+				}
 				return err
 			}
 			if !containsAll(guesser.Provides(), result) {
 				ctx.Log.Errorf("Guesser '%s' promised %+v but provided %+v", guesser.Name(), guesser.Provides(), result)
-				return errors.New("guesser did not provide all promised variables")
+				gerr := newError(guesser, attempts, []mapstr.M{result}, errors.New("guesser did not provide all promised variables"))
+				gerr.Variables = nil
+				for _, v := range guesser.Provides() {
+					if _, found := result[v]; !found {
+						gerr.Variables = append(gerr.Variables, v)
+					}
+				}
+				return gerr
+			}
+			if err = mergeResult(ctx.Vars, sources, guesser, result); err != nil {
+				return newError(guesser, attempts, []mapstr.M{result}, err)
 			}
-			ctx.Vars.Update(result)
 			ctx.Log.Debugf("Guess %s completed: %v", guesser.Name(), result)
 		}
 		if len(next) == len(list) {
@@ -306,6 +445,72 @@ func GuessAll(installer helper.ProbeInstaller, ctx Context) (err error) {
 	return nil
 }
 
+// Source of the variables defined before the guesses run, such as the base,
+// architecture and kernel function variables.
+const baseVariables = "the base template variables"
+
+// checkCollisions makes sure that no variable is provided by two guesses, or
+// by a guess and the variables defined before the guesses run, as one would
+// silently overwrite the other. It returns the source of each variable.
+func checkCollisions(list []Guesser, vars mapstr.M) (sources map[string]string, err error) {
+	sources = make(map[string]string, len(vars))
+	for name := range vars {
+		sources[name] = baseVariables
+	}
+	// Sorted so that the error doesn't depend on the order of the registry.
+	sorted := append([]Guesser(nil), list...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name() < sorted[j].Name()
+	})
+	for _, guesser := range sorted {
+		source := guessSource(guesser)
+		for _, name := range guesser.Provides() {
+			if prev, found := sources[name]; found {
+				return nil, fmt.Errorf("variable %s provided by %s collides with %s", name, source, prev)
+			}
+			sources[name] = source
+		}
+	}
+	return sources, nil
+}
+
+// mergeResult adds the result of a guess to the variables. Results can hold
+// variables that the guess doesn't declare in Provides, so they are checked
+// for collisions too.
+func mergeResult(vars mapstr.M, sources map[string]string, guesser Guesser, result mapstr.M) error {
+	source := guessSource(guesser)
+	names := make([]string, 0, len(result))
+	for name := range result {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if prev, found := sources[name]; found && prev != source {
+			return fmt.Errorf("variable %s provided by %s collides with %s", name, source, prev)
+		}
+	}
+	for _, name := range names {
+		sources[name] = source
+	}
+	vars.Update(result)
+	return nil
+}
+
+func guessSource(guesser Guesser) string {
+	return "guess " + guesser.Name()
+}
+
+// requiresAny returns the first of the required variables that is in the
+// given set, or an empty string.
+func requiresAny(requires []string, set map[string]bool) string {
+	for _, v := range requires {
+		if set[v] {
+			return v
+		}
+	}
+	return ""
+}
+
 func isIPv6Enabled(vars mapstr.M) (bool, error) {
 	iface, err := vars.GetValue("HAS_IPV6")
 	if err != nil {
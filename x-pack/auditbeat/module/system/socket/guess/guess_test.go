@@ -0,0 +1,98 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+type fakeGuess struct {
+	name     string
+	provides []string
+}
+
+func (g *fakeGuess) Name() string                         { return g.name }
+func (g *fakeGuess) Probes() ([]helper.ProbeDef, error)   { return nil, nil }
+func (g *fakeGuess) Provides() []string                   { return g.provides }
+func (g *fakeGuess) Requires() []string                   { return nil }
+func (g *fakeGuess) Prepare(ctx Context) error            { return nil }
+func (g *fakeGuess) Trigger() error                       { return nil }
+func (g *fakeGuess) Extract(interface{}) (mapstr.M, bool) { return nil, true }
+func (g *fakeGuess) Terminate() error                     { return nil }
+
+func TestCheckCollisions(t *testing.T) {
+	base := mapstr.M{"PTR_SIZE": 8, "P1": "%di"}
+	first := &fakeGuess{name: "guess_first", provides: []string{"FIRST_OFFSET"}}
+	second := &fakeGuess{name: "guess_second", provides: []string{"SECOND_OFFSET"}}
+
+	sources, err := checkCollisions([]Guesser{first, second}, base)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{
+			"PTR_SIZE":      baseVariables,
+			"P1":            baseVariables,
+			"FIRST_OFFSET":  "guess guess_first",
+			"SECOND_OFFSET": "guess guess_second",
+		}, sources)
+	}
+
+	// Two guesses providing the same variable.
+	clash := &fakeGuess{name: "guess_clash", provides: []string{"FIRST_OFFSET"}}
+	_, err = checkCollisions([]Guesser{first, clash}, base)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "FIRST_OFFSET")
+		assert.Contains(t, err.Error(), "guess_first")
+		assert.Contains(t, err.Error(), "guess_clash")
+	}
+
+	// A guess providing a base variable.
+	override := &fakeGuess{name: "guess_override", provides: []string{"PTR_SIZE"}}
+	_, err = checkCollisions([]Guesser{first, override}, base)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "PTR_SIZE")
+		assert.Contains(t, err.Error(), "guess_override")
+		assert.Contains(t, err.Error(), baseVariables)
+	}
+}
+
+func TestMergeResult(t *testing.T) {
+	vars := mapstr.M{"PTR_SIZE": 8}
+	first := &fakeGuess{name: "guess_first", provides: []string{"FIRST_OFFSET"}}
+	second := &fakeGuess{name: "guess_second", provides: []string{"SECOND_OFFSET"}}
+	sources, err := checkCollisions([]Guesser{first, second}, vars)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// Results can hold undeclared variables.
+	assert.NoError(t, mergeResult(vars, sources, first, mapstr.M{
+		"FIRST_OFFSET": 16,
+		"FIRST_EXTRA":  true,
+	}))
+	assert.Equal(t, mapstr.M{"PTR_SIZE": 8, "FIRST_OFFSET": 16, "FIRST_EXTRA": true}, vars)
+
+	// Undeclared variables that collide aren't merged.
+	err = mergeResult(vars, sources, second, mapstr.M{
+		"SECOND_OFFSET": 24,
+		"FIRST_EXTRA":   false,
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "FIRST_EXTRA")
+		assert.Contains(t, err.Error(), "guess_first")
+		assert.Contains(t, err.Error(), "guess_second")
+	}
+	err = mergeResult(vars, sources, second, mapstr.M{"PTR_SIZE": 4})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), baseVariables)
+	}
+	assert.Equal(t, mapstr.M{"PTR_SIZE": 8, "FIRST_OFFSET": 16, "FIRST_EXTRA": true}, vars)
+}
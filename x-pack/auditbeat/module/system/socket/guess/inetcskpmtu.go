@@ -0,0 +1,177 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Guess the offset of the path MTU within a struct inet_connection_sock:
+//
+//	struct inet_connection_sock {
+//		...
+//		__u32			  icsk_rto;
+//		__u32			  icsk_rto_min;	   /* 5.10+ */
+//		__u32			  icsk_delack_max; /* 5.10+ */
+//		__u32			  icsk_pmtu_cookie;
+//		...
+//	}
+//
+// icsk_pmtu_cookie is the last path MTU seen by the socket, exported as
+// tcpi_pmtu by getsockopt(TCP_INFO). For a loopback connection it's the MTU of
+// the loopback interface, which can't be made distinct enough to be searched
+// for on its own. Instead, it's checked at the two positions that it can
+// occupy relative to icsk_rto, whose offset is known from guess_tcp_sock_rtt.
+//
+// This guess is optional. When it fails, path MTU reporting is disabled.
+//
+// Output:
+//  INET_CSK_PMTU : 1196
+
+// Possible distances between icsk_rto and icsk_pmtu_cookie, for kernels
+// before and since 5.10.
+var pmtuDistances = []int{4, 12}
+
+func init() {
+	if err := Registry.AddGuess(func() Guesser { return &guessInetCSKPMTU{} }); err != nil {
+		panic(err)
+	}
+}
+
+type guessInetCSKPMTU struct {
+	ctx  Context
+	cs   inetClientServer
+	rto  int
+	info *unix.TCPInfo
+}
+
+// Name of this guess.
+func (g *guessInetCSKPMTU) Name() string {
+	return "guess_inet_csk_pmtu"
+}
+
+// Provides returns the list of variables discovered.
+func (g *guessInetCSKPMTU) Provides() []string {
+	return []string{
+		"INET_CSK_PMTU",
+	}
+}
+
+// Requires declares the variables required to run this guess.
+func (g *guessInetCSKPMTU) Requires() []string {
+	return []string{
+		"TCP_SENDMSG_SOCK",
+		"INET_CSK_RTO",
+		"KERNEL_HZ",
+	}
+}
+
+// Optional makes failures of this guess non-fatal.
+func (g *guessInetCSKPMTU) Optional() bool {
+	return true
+}
+
+// Probes returns a kprobe on tcp_sendmsg that dumps the struct sock*.
+func (g *guessInetCSKPMTU) Probes() ([]helper.ProbeDef, error) {
+	return []helper.ProbeDef{
+		{
+			Probe: tracing.Probe{
+				Name:      "inet_csk_pmtu_guess",
+				Address:   "tcp_sendmsg",
+				Fetchargs: helper.MakeMemoryDump("{{.TCP_SENDMSG_SOCK}}", 0, tcpSockDumpSize),
+			},
+			Decoder: tracing.NewDumpDecoder,
+		},
+	}, nil
+}
+
+// Prepare creates a TCP client-server and exchanges some data so that the
+// path MTU is set for the connection.
+func (g *guessInetCSKPMTU) Prepare(ctx Context) error {
+	g.ctx = ctx
+	var ok bool
+	if g.rto, ok = ctx.Vars["INET_CSK_RTO"].(int); !ok {
+		return errors.New("INET_CSK_RTO is not an int")
+	}
+	if err := g.cs.SetupTCP(); err != nil {
+		return err
+	}
+	buf := make([]byte, 16)
+	if _, err := unix.Write(g.cs.client, []byte("Hello World!\n")); err != nil {
+		return fmt.Errorf("write failed: %w", err)
+	}
+	if _, err := unix.Read(g.cs.accepted, buf); err != nil {
+		return fmt.Errorf("read failed: %w", err)
+	}
+	return nil
+}
+
+// Terminate cleans up the client-server.
+func (g *guessInetCSKPMTU) Terminate() error {
+	return g.cs.Cleanup()
+}
+
+// Trigger fetches the path MTU via TCP_INFO and then writes to the
+// connection, causing a tcp_sendmsg call.
+func (g *guessInetCSKPMTU) Trigger() (err error) {
+	if g.info, err = unix.GetsockoptTCPInfo(g.cs.client, unix.IPPROTO_TCP, unix.TCP_INFO); err != nil {
+		return fmt.Errorf("getsockopt(TCP_INFO) failed: %w", err)
+	}
+	_, err = unix.Write(g.cs.client, []byte("Hello World!\n"))
+	return err
+}
+
+// Extract checks the positions where the path MTU can be found after the
+// RTO.
+func (g *guessInetCSKPMTU) Extract(ev interface{}) (mapstr.M, bool) {
+	data := ev.([]byte)
+	if g.info == nil || g.info.Pmtu == 0 {
+		return nil, false
+	}
+	var hits []int
+	for _, dist := range pmtuDistances {
+		off := g.rto + dist
+		if off+4 <= len(data) && tracing.MachineEndian.Uint32(data[off:]) == g.info.Pmtu {
+			hits = append(hits, off)
+		}
+	}
+	return mapstr.M{
+		"INET_CSK_PMTU": hits,
+	}, true
+}
+
+// NumRepeats makes this guess to be repeated to avoid collisions.
+func (g *guessInetCSKPMTU) NumRepeats() int {
+	return 4
+}
+
+// Reduce takes the offset that matched in all the runs. Both positions
+// matching means that the layout can't be told apart.
+func (g *guessInetCSKPMTU) Reduce(results []mapstr.M) (mapstr.M, error) {
+	result, err := consolidate(results)
+	if err != nil {
+		return nil, err
+	}
+	list, err := getListField(result, "INET_CSK_PMTU")
+	if err != nil {
+		return nil, err
+	}
+	if len(list) > 1 {
+		return nil, fmt.Errorf("ambiguous offsets found: %v", list)
+	}
+	return mapstr.M{
+		"INET_CSK_PMTU": list[0],
+	}, nil
+}
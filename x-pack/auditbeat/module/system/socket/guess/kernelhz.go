@@ -0,0 +1,147 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Valid values for the kernel's CONFIG_HZ.
+var kernelHZValues = []int{100, 250, 300, 1000}
+
+// Interval between the two readings of the jiffies counter used to measure
+// the kernel's HZ.
+const hzMeasureInterval = 200 * time.Millisecond
+
+// kernelHZ returns the frequency of the kernel's timer interrupt. It's read
+// from the kernel configuration and, when it isn't available, measured from
+// the jiffies counter exported in /proc/timer_list.
+func kernelHZ() (int, error) {
+	hz, cfgErr := configHZ()
+	if cfgErr == nil {
+		return hz, nil
+	}
+	hz, err := measureHZ(hzMeasureInterval)
+	if err != nil {
+		return 0, fmt.Errorf("unable to determine kernel HZ: %v; %w", cfgErr, err)
+	}
+	return hz, nil
+}
+
+// configHZ reads CONFIG_HZ from /proc/config.gz or from the configuration
+// file of the running kernel in /boot.
+func configHZ() (int, error) {
+	if f, err := os.Open("/proc/config.gz"); err == nil {
+		defer f.Close()
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, fmt.Errorf("reading /proc/config.gz: %w", err)
+		}
+		return parseConfigHZ(r)
+	}
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return 0, fmt.Errorf("uname failed: %w", err)
+	}
+	path := "/boot/config-" + unix.ByteSliceToString(uts.Release[:])
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseConfigHZ(f)
+}
+
+// parseConfigHZ returns the value of CONFIG_HZ in a kernel configuration.
+func parseConfigHZ(r io.Reader) (int, error) {
+	const prefix = "CONFIG_HZ="
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		hz, err := strconv.Atoi(line[len(prefix):])
+		if err != nil || !isKernelHZValue(hz) {
+			return 0, fmt.Errorf("invalid %s", line)
+		}
+		return hz, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("CONFIG_HZ not found in kernel configuration")
+}
+
+// measureHZ reads the jiffies counter twice and returns the valid HZ value
+// that is closest to the measured rate.
+func measureHZ(interval time.Duration) (int, error) {
+	j0, err := readJiffies()
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	time.Sleep(interval)
+	j1, err := readJiffies()
+	if err != nil {
+		return 0, err
+	}
+	rate := float64(j1-j0) / time.Since(start).Seconds()
+	best, bestDiff := 0, math.Inf(1)
+	for _, hz := range kernelHZValues {
+		if diff := math.Abs(rate - float64(hz)); diff < bestDiff {
+			best, bestDiff = hz, diff
+		}
+	}
+	// Allow for the time spent reading /proc/timer_list.
+	if bestDiff > float64(best)/10 {
+		return 0, fmt.Errorf("measured jiffies rate %.1f/s doesn't match any HZ value", rate)
+	}
+	return best, nil
+}
+
+// readJiffies returns the current value of the jiffies counter.
+func readJiffies() (uint64, error) {
+	f, err := os.Open("/proc/timer_list")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	const prefix = "jiffies: "
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, prefix) {
+			return strconv.ParseUint(line[len(prefix):], 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("jiffies not found in /proc/timer_list")
+}
+
+func isKernelHZValue(hz int) bool {
+	for _, v := range kernelHZValues {
+		if v == hz {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Guess the offset of the token within a struct mptcp_sock:
+//
+//	struct mptcp_sock {
+//		struct inet_connection_sock sk;
+//		u64	local_key;
+//		u64	remote_key;
+//		...
+//		u32	token;
+//		...
+//	}
+//
+// The token identifies an MPTCP connection on a host, and is the value shown
+// by ip mptcp monitor and ss -M. It's derived from the connection's local key
+// (RFC 8684 section 3.2): it's the most significant 32 bits of the SHA-256 of
+// the key. An MPTCP connection is set up over loopback and the struct sock*
+// passed to mptcp_sendmsg, which is the struct mptcp_sock*, is dumped. The
+// token is found as the field holding the token of one of the 64-bit values
+// in the dump, which doesn't depend on the position of local_key.
+//
+// This guess only runs when MPTCP monitoring is enabled. It's optional, and
+// when it fails, MPTCP subflows aren't correlated.
+//
+// Output:
+//  MPTCP_SOCK_TOKEN : 1528
+
+const (
+	// The dump starts after struct sock, which precedes the fields of
+	// interest, so that it covers them with a smaller dump.
+	mptcpSockDumpStart = 512
+	mptcpSockDumpEnd   = 2560
+)
+
+func init() {
+	if err := Registry.AddGuess(func() Guesser { return &guessMPTCPSockToken{} }); err != nil {
+		panic(err)
+	}
+}
+
+type guessMPTCPSockToken struct {
+	ctx                      Context
+	client, server, accepted int
+}
+
+// Name of this guess.
+func (g *guessMPTCPSockToken) Name() string {
+	return "guess_mptcp_sock_token"
+}
+
+// Provides returns the list of variables discovered.
+func (g *guessMPTCPSockToken) Provides() []string {
+	return []string{
+		"MPTCP_SOCK_TOKEN",
+	}
+}
+
+// Requires declares the variables required to run this guess.
+func (g *guessMPTCPSockToken) Requires() []string {
+	return []string{
+		"P1",
+	}
+}
+
+// Optional makes failures of this guess non-fatal.
+func (g *guessMPTCPSockToken) Optional() bool {
+	return true
+}
+
+// Condition runs this guess only when MPTCP monitoring is enabled.
+func (g *guessMPTCPSockToken) Condition(ctx Context) (bool, error) {
+	enabled, _ := ctx.Vars["ENABLE_MPTCP"].(bool)
+	return enabled, nil
+}
+
+// Probes returns a kprobe on mptcp_sendmsg that dumps the struct sock*.
+func (g *guessMPTCPSockToken) Probes() ([]helper.ProbeDef, error) {
+	return []helper.ProbeDef{
+		{
+			Probe: tracing.Probe{
+				Name:      "mptcp_sock_token_guess",
+				Address:   "mptcp_sendmsg",
+				Fetchargs: helper.MakeMemoryDump("{{.P1}}", mptcpSockDumpStart, mptcpSockDumpEnd),
+			},
+			Decoder: tracing.NewDumpDecoder,
+		},
+	}, nil
+}
+
+// Prepare sets up an MPTCP connection between a client and a server. It
+// fails when the kernel lacks MPTCP support or it's disabled by the
+// net.mptcp.enabled sysctl.
+func (g *guessMPTCPSockToken) Prepare(ctx Context) (err error) {
+	g.ctx = ctx
+	g.client, g.server, g.accepted = -1, -1, -1
+	defer func() {
+		if err != nil {
+			g.Terminate()
+		}
+	}()
+	if g.server, err = unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_MPTCP); err != nil {
+		return fmt.Errorf("unable to create MPTCP socket: %w", err)
+	}
+	if err = unix.Bind(g.server, &unix.SockaddrInet4{Addr: randomLocalIP()}); err != nil {
+		return fmt.Errorf("bind failed: %w", err)
+	}
+	if err = unix.Listen(g.server, 1); err != nil {
+		return fmt.Errorf("listen failed: %w", err)
+	}
+	sa, err := unix.Getsockname(g.server)
+	if err != nil {
+		return fmt.Errorf("getsockname failed: %w", err)
+	}
+	srvAddr, ok := sa.(*unix.SockaddrInet4)
+	if !ok {
+		return errors.New("getsockname didn't return a struct sockaddr_in")
+	}
+	if g.client, err = unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_MPTCP); err != nil {
+		return fmt.Errorf("unable to create MPTCP socket: %w", err)
+	}
+	if err = unix.Connect(g.client, srvAddr); err != nil {
+		return fmt.Errorf("connect failed: %w", err)
+	}
+	if g.accepted, _, err = unix.Accept(g.server); err != nil {
+		return fmt.Errorf("accept failed: %w", err)
+	}
+	return nil
+}
+
+// Terminate closes the sockets.
+func (g *guessMPTCPSockToken) Terminate() error {
+	for _, fd := range []int{g.accepted, g.client, g.server} {
+		if fd != -1 {
+			unix.Close(fd)
+		}
+	}
+	g.client, g.server, g.accepted = -1, -1, -1
+	return nil
+}
+
+// Trigger sends data from the client.
+func (g *guessMPTCPSockToken) Trigger() error {
+	if _, err := unix.Write(g.client, []byte("Hello World!\n")); err != nil {
+		return fmt.Errorf("write failed: %w", err)
+	}
+	return nil
+}
+
+// Extract scans the struct mptcp_sock* dump for the token of any of the
+// 64-bit values in it.
+func (g *guessMPTCPSockToken) Extract(ev interface{}) (mapstr.M, bool) {
+	data := ev.([]byte)
+	tokens := make(map[uint32]struct{})
+	// u64 fields are only 4-byte aligned in 32-bit kernels.
+	for off := 0; off+8 <= len(data); off += 4 {
+		if key := tracing.MachineEndian.Uint64(data[off:]); key != 0 {
+			tokens[mptcpKeyToken(key)] = struct{}{}
+		}
+	}
+	var hits []int
+	for off := 0; off+4 <= len(data); off += 4 {
+		value := tracing.MachineEndian.Uint32(data[off:])
+		if _, found := tokens[value]; found && value != 0 {
+			hits = append(hits, mptcpSockDumpStart+off)
+		}
+	}
+	return mapstr.M{
+		"MPTCP_SOCK_TOKEN": hits,
+	}, true
+}
+
+// mptcpKeyToken returns the token of an MPTCP key, as computed by the kernel's
+// mptcp_crypto_key_sha.
+func mptcpKeyToken(key uint64) uint32 {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], key)
+	hash := sha256.Sum256(buf[:])
+	return binary.BigEndian.Uint32(hash[:4])
+}
+
+// NumRepeats makes this guess to be repeated to avoid collisions.
+func (g *guessMPTCPSockToken) NumRepeats() int {
+	return 4
+}
+
+// Reduce takes the offset that matched in all the runs.
+func (g *guessMPTCPSockToken) Reduce(results []mapstr.M) (mapstr.M, error) {
+	result, err := consolidate(results)
+	if err != nil {
+		return nil, err
+	}
+	list, err := getListField(result, "MPTCP_SOCK_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if len(list) != 1 {
+		return nil, fmt.Errorf("ambiguous offsets for the MPTCP token: %v", list)
+	}
+	return mapstr.M{
+		"MPTCP_SOCK_TOKEN": list[0],
+	}, nil
+}
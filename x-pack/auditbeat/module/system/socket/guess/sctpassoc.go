@@ -0,0 +1,334 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Guess the offsets of the sock and of the verification tags within a
+// struct sctp_association:
+//
+//	struct sctp_association {
+//		struct sctp_ep_common base;	/* base.sk is the struct sock* */
+//		...
+//		struct sctp_cookie c;
+//		...
+//	}
+//
+//	struct sctp_cookie {
+//		__u32 my_vtag;
+//		__u32 peer_vtag;
+//		__u32 my_ttag;
+//		__u32 peer_ttag;
+//		ktime_t expiration;
+//		__u16 sinit_num_ostreams;
+//		__u16 sinit_max_instreams;
+//		...
+//	}
+//
+// An SCTP association is set up over loopback, and data is sent from both
+// ends. sctp_sendmsg receives the struct sock* and sctp_primitive_SEND the
+// struct sctp_association* of the sending end, which is dumped. base.sk is
+// found by searching for the sock, and c.my_vtag as the offset where the
+// verification tags of both ends are swapped. Both ends request a different
+// number of streams, so the streams negotiated, which are stored in the
+// cookie, are used to validate it.
+//
+// This guess only runs when SCTP monitoring is enabled. It's optional, and
+// when it fails, SCTP associations are reported without these details.
+//
+// Output:
+//  SCTP_ASSOC_SK        : 32
+//  SCTP_ASSOC_VTAG      : 168
+//  SCTP_ASSOC_PEER_VTAG : 172
+//  SCTP_ASSOC_OSTREAMS  : 192
+//  SCTP_ASSOC_ISTREAMS  : 194
+
+const (
+	sctpAssocDumpSize = 1024
+
+	// SCTP_INITMSG socket option, from linux/sctp.h.
+	sctpInitMsgOpt = 2
+
+	// Distance from c.my_vtag to c.sinit_num_ostreams and
+	// c.sinit_max_instreams.
+	sctpCookieStreamsDistance = 24
+)
+
+// Streams requested by the client and server in their struct sctp_initmsg.
+var (
+	sctpClientInit = sctpInitMsg{numOStreams: 11, maxInStreams: 13}
+	sctpServerInit = sctpInitMsg{numOStreams: 7, maxInStreams: 9}
+)
+
+type sctpInitMsg struct {
+	numOStreams, maxInStreams uint16
+}
+
+// negotiated returns the outbound and inbound streams of an end of the
+// association after exchanging INIT chunks with the peer.
+func (m sctpInitMsg) negotiated(peer sctpInitMsg) (out, in uint16) {
+	out, in = m.numOStreams, m.maxInStreams
+	if peer.maxInStreams < out {
+		out = peer.maxInStreams
+	}
+	if peer.numOStreams < in {
+		in = peer.numOStreams
+	}
+	return out, in
+}
+
+// bytes returns a struct sctp_initmsg, leaving the remaining fields at
+// their default value.
+func (m sctpInitMsg) bytes() []byte {
+	var buf [8]byte
+	tracing.MachineEndian.PutUint16(buf[0:], m.numOStreams)
+	tracing.MachineEndian.PutUint16(buf[2:], m.maxInStreams)
+	return buf[:]
+}
+
+func init() {
+	if err := Registry.AddGuess(func() Guesser { return &guessSCTPAssoc{} }); err != nil {
+		panic(err)
+	}
+}
+
+type guessSCTPAssoc struct {
+	ctx                      Context
+	client, server, accepted int
+	socks                    []uintptr
+	dumps                    [][]byte
+}
+
+// Name of this guess.
+func (g *guessSCTPAssoc) Name() string {
+	return "guess_sctp_association"
+}
+
+// Provides returns the list of variables discovered.
+func (g *guessSCTPAssoc) Provides() []string {
+	return []string{
+		"SCTP_ASSOC_SK",
+		"SCTP_ASSOC_VTAG",
+		"SCTP_ASSOC_PEER_VTAG",
+		"SCTP_ASSOC_OSTREAMS",
+		"SCTP_ASSOC_ISTREAMS",
+	}
+}
+
+// Requires declares the variables required to run this guess.
+func (g *guessSCTPAssoc) Requires() []string {
+	return []string{
+		"P1",
+		"P2",
+	}
+}
+
+// Optional makes failures of this guess non-fatal.
+func (g *guessSCTPAssoc) Optional() bool {
+	return true
+}
+
+// Condition runs this guess only when SCTP monitoring is enabled.
+func (g *guessSCTPAssoc) Condition(ctx Context) (bool, error) {
+	enabled, _ := ctx.Vars["ENABLE_SCTP"].(bool)
+	return enabled, nil
+}
+
+// Probes returns a kprobe on sctp_sendmsg that fetches the struct sock* and
+// another on sctp_primitive_SEND that dumps the struct sctp_association*.
+func (g *guessSCTPAssoc) Probes() ([]helper.ProbeDef, error) {
+	return []helper.ProbeDef{
+		{
+			Probe: tracing.Probe{
+				Name:      "sctp_assoc_sk_guess",
+				Address:   "sctp_sendmsg",
+				Fetchargs: "sock={{.P1}}",
+			},
+			Decoder: helper.NewStructDecoder(func() interface{} { return new(sockEvent) }),
+		},
+		{
+			Probe: tracing.Probe{
+				Name:      "sctp_assoc_guess",
+				Address:   "sctp_primitive_SEND",
+				Fetchargs: helper.MakeMemoryDump("{{.P2}}", 0, sctpAssocDumpSize),
+			},
+			Decoder: tracing.NewDumpDecoder,
+		},
+	}, nil
+}
+
+// Prepare sets up an SCTP association between a client and a server. This
+// loads the sctp kernel module if needed.
+func (g *guessSCTPAssoc) Prepare(ctx Context) (err error) {
+	g.ctx = ctx
+	g.client, g.server, g.accepted = -1, -1, -1
+	g.socks, g.dumps = nil, nil
+	defer func() {
+		if err != nil {
+			g.Terminate()
+		}
+	}()
+	var srvAddr unix.SockaddrInet4
+	if g.server, srvAddr, err = createSCTPSocket(sctpServerInit); err != nil {
+		return err
+	}
+	if err = unix.Listen(g.server, 1); err != nil {
+		return fmt.Errorf("listen failed: %w", err)
+	}
+	if g.client, _, err = createSCTPSocket(sctpClientInit); err != nil {
+		return err
+	}
+	if err = unix.Connect(g.client, &srvAddr); err != nil {
+		return fmt.Errorf("connect failed: %w", err)
+	}
+	if g.accepted, _, err = unix.Accept(g.server); err != nil {
+		return fmt.Errorf("accept failed: %w", err)
+	}
+	return nil
+}
+
+func createSCTPSocket(init sctpInitMsg) (fd int, addr unix.SockaddrInet4, err error) {
+	if fd, err = unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_SCTP); err != nil {
+		return -1, addr, fmt.Errorf("unable to create SCTP socket: %w", err)
+	}
+	if err = unix.SetsockoptString(fd, unix.IPPROTO_SCTP, sctpInitMsgOpt, string(init.bytes())); err != nil {
+		unix.Close(fd)
+		return -1, addr, fmt.Errorf("setsockopt(SCTP_INITMSG) failed: %w", err)
+	}
+	if err = unix.Bind(fd, &unix.SockaddrInet4{Addr: randomLocalIP()}); err != nil {
+		unix.Close(fd)
+		return -1, addr, fmt.Errorf("bind failed: %w", err)
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		unix.Close(fd)
+		return -1, addr, fmt.Errorf("getsockname failed: %w", err)
+	}
+	addrptr, ok := sa.(*unix.SockaddrInet4)
+	if !ok {
+		unix.Close(fd)
+		return -1, addr, errors.New("getsockname didn't return a struct sockaddr_in")
+	}
+	return fd, *addrptr, nil
+}
+
+// Terminate closes the sockets.
+func (g *guessSCTPAssoc) Terminate() error {
+	for _, fd := range []int{g.accepted, g.client, g.server} {
+		if fd != -1 {
+			unix.Close(fd)
+		}
+	}
+	g.client, g.server, g.accepted = -1, -1, -1
+	return nil
+}
+
+// Trigger sends data from the client and then from the server.
+func (g *guessSCTPAssoc) Trigger() error {
+	for _, fd := range []int{g.client, g.accepted} {
+		if _, err := unix.Write(fd, []byte("Hello World!\n")); err != nil {
+			return fmt.Errorf("write failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// Extract collects the sock and association dump of both ends, then scans
+// the dumps.
+func (g *guessSCTPAssoc) Extract(ev interface{}) (mapstr.M, bool) {
+	switch v := ev.(type) {
+	case *sockEvent:
+		if len(g.socks) == len(g.dumps) {
+			g.socks = append(g.socks, v.Sock)
+		}
+		return nil, false
+	case []byte:
+		if len(g.dumps) < len(g.socks) {
+			g.dumps = append(g.dumps, v)
+		}
+	}
+	if len(g.dumps) < 2 {
+		return nil, false
+	}
+	client, server := g.dumps[0], g.dumps[1]
+
+	var skHits []int
+	const ptrLen = int(sizeOfPtr)
+	for off := 0; off+ptrLen <= len(client) && off+ptrLen <= len(server); off += ptrLen {
+		if g.socks[0] != 0 && g.socks[1] != 0 &&
+			pointerAt(client[off:]) == g.socks[0] && pointerAt(server[off:]) == g.socks[1] {
+			skHits = append(skHits, off)
+		}
+	}
+
+	cliOut, cliIn := sctpClientInit.negotiated(sctpServerInit)
+	srvOut, srvIn := sctpServerInit.negotiated(sctpClientInit)
+	u32 := tracing.MachineEndian.Uint32
+	u16 := tracing.MachineEndian.Uint16
+	var vtagHits []int
+	for off := 0; off+sctpCookieStreamsDistance+4 <= len(client); off += 4 {
+		myVTag, peerVTag := u32(client[off:]), u32(client[off+4:])
+		if myVTag == 0 || peerVTag == 0 || myVTag == peerVTag {
+			continue
+		}
+		if u32(server[off:]) != peerVTag || u32(server[off+4:]) != myVTag {
+			continue
+		}
+		streams := off + sctpCookieStreamsDistance
+		if u16(client[streams:]) == cliOut && u16(client[streams+2:]) == cliIn &&
+			u16(server[streams:]) == srvOut && u16(server[streams+2:]) == srvIn {
+			vtagHits = append(vtagHits, off)
+		}
+	}
+	return mapstr.M{
+		"SCTP_ASSOC_SK":   skHits,
+		"SCTP_ASSOC_VTAG": vtagHits,
+	}, true
+}
+
+// NumRepeats makes this guess to be repeated to avoid collisions.
+func (g *guessSCTPAssoc) NumRepeats() int {
+	return 4
+}
+
+// Reduce takes the offsets that matched in all the runs, and derives the
+// offsets of the other fields of struct sctp_cookie from c.my_vtag.
+func (g *guessSCTPAssoc) Reduce(results []mapstr.M) (mapstr.M, error) {
+	result, err := consolidate(results)
+	if err != nil {
+		return nil, err
+	}
+	var offsets [2]int
+	for i, key := range []string{"SCTP_ASSOC_SK", "SCTP_ASSOC_VTAG"} {
+		list, err := getListField(result, key)
+		if err != nil {
+			return nil, err
+		}
+		if len(list) != 1 {
+			return nil, fmt.Errorf("ambiguous offsets for %s: %v", key, list)
+		}
+		offsets[i] = list[0]
+	}
+	vtag := offsets[1]
+	return mapstr.M{
+		"SCTP_ASSOC_SK":        offsets[0],
+		"SCTP_ASSOC_VTAG":      vtag,
+		"SCTP_ASSOC_PEER_VTAG": vtag + 4,
+		"SCTP_ASSOC_OSTREAMS":  vtag + sctpCookieStreamsDistance,
+		"SCTP_ASSOC_ISTREAMS":  vtag + sctpCookieStreamsDistance + 2,
+	}, nil
+}
@@ -0,0 +1,193 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Guess the offsets of the buffer sizes within a struct sock:
+//
+//	struct sock {
+//		...
+//		int			sk_rcvbuf;
+//		...
+//		int			sk_sndbuf;
+//		...
+//	}
+//
+// sk_sndbuf and sk_rcvbuf are the sizes set with the SO_SNDBUF and SO_RCVBUF
+// socket options, doubled by the kernel to account for its bookkeeping
+// overhead, and returned by getsockopt. A TCP client-server is set up with
+// random buffer sizes on the client, and the values read back with getsockopt
+// are searched for in a dump of the struct sock* passed to tcp_sendmsg.
+// Setting the sizes disables their autotuning, so that they don't change
+// before the dump.
+//
+// This guess is optional. When it fails, buffer sizes aren't reported.
+//
+// Output:
+//  SOCK_SNDBUF : 284
+//  SOCK_RCVBUF : 244
+
+const (
+	// Range of the buffer sizes set, below the default net.core.wmem_max
+	// and net.core.rmem_max, so that they aren't capped.
+	sockBufMinSize = 4096
+	sockBufMaxSize = 65536
+)
+
+func init() {
+	if err := Registry.AddGuess(func() Guesser { return &guessSockBuf{} }); err != nil {
+		panic(err)
+	}
+}
+
+type guessSockBuf struct {
+	ctx            Context
+	cs             inetClientServer
+	sndbuf, rcvbuf uint32
+}
+
+// Name of this guess.
+func (g *guessSockBuf) Name() string {
+	return "guess_sock_buf"
+}
+
+// Provides returns the list of variables discovered.
+func (g *guessSockBuf) Provides() []string {
+	return []string{
+		"SOCK_SNDBUF",
+		"SOCK_RCVBUF",
+	}
+}
+
+// Requires declares the variables required to run this guess.
+func (g *guessSockBuf) Requires() []string {
+	return []string{
+		"TCP_SENDMSG_SOCK",
+	}
+}
+
+// Optional makes failures of this guess non-fatal.
+func (g *guessSockBuf) Optional() bool {
+	return true
+}
+
+// Probes returns a kprobe on tcp_sendmsg that dumps the struct sock*.
+func (g *guessSockBuf) Probes() ([]helper.ProbeDef, error) {
+	return []helper.ProbeDef{
+		{
+			Probe: tracing.Probe{
+				Name:      "sock_buf_guess",
+				Address:   "tcp_sendmsg",
+				Fetchargs: helper.MakeMemoryDump("{{.TCP_SENDMSG_SOCK}}", 0, tcpSockDumpSize),
+			},
+			Decoder: tracing.NewDumpDecoder,
+		},
+	}, nil
+}
+
+// Prepare creates a TCP client-server and sets random, distinct buffer sizes
+// on the client.
+func (g *guessSockBuf) Prepare(ctx Context) (err error) {
+	g.ctx = ctx
+	if err = g.cs.SetupTCP(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			g.cs.Cleanup()
+		}
+	}()
+	sndbuf := sockBufMinSize + rand.Intn(sockBufMaxSize-sockBufMinSize)
+	rcvbuf := sockBufMinSize + rand.Intn(sockBufMaxSize-sockBufMinSize)
+	if rcvbuf == sndbuf {
+		rcvbuf++
+	}
+	if err = unix.SetsockoptInt(g.cs.client, unix.SOL_SOCKET, unix.SO_SNDBUF, sndbuf); err != nil {
+		return fmt.Errorf("setsockopt(SO_SNDBUF) failed: %w", err)
+	}
+	if err = unix.SetsockoptInt(g.cs.client, unix.SOL_SOCKET, unix.SO_RCVBUF, rcvbuf); err != nil {
+		return fmt.Errorf("setsockopt(SO_RCVBUF) failed: %w", err)
+	}
+	// The kernel adjusts the values set, so the actual sizes are read back.
+	if sndbuf, err = unix.GetsockoptInt(g.cs.client, unix.SOL_SOCKET, unix.SO_SNDBUF); err != nil {
+		return fmt.Errorf("getsockopt(SO_SNDBUF) failed: %w", err)
+	}
+	if rcvbuf, err = unix.GetsockoptInt(g.cs.client, unix.SOL_SOCKET, unix.SO_RCVBUF); err != nil {
+		return fmt.Errorf("getsockopt(SO_RCVBUF) failed: %w", err)
+	}
+	if sndbuf == rcvbuf {
+		return errors.New("send and receive buffer sizes are the same")
+	}
+	g.sndbuf, g.rcvbuf = uint32(sndbuf), uint32(rcvbuf)
+	return nil
+}
+
+// Terminate cleans up the client-server.
+func (g *guessSockBuf) Terminate() error {
+	return g.cs.Cleanup()
+}
+
+// Trigger writes to the connection, causing a tcp_sendmsg call.
+func (g *guessSockBuf) Trigger() error {
+	_, err := unix.Write(g.cs.client, []byte("Hello World!\n"))
+	return err
+}
+
+// Extract scans the struct sock* dump for the buffer sizes.
+func (g *guessSockBuf) Extract(ev interface{}) (mapstr.M, bool) {
+	data := ev.([]byte)
+	var sndbuf, rcvbuf []int
+	for off := 0; off+4 <= len(data); off += 4 {
+		switch tracing.MachineEndian.Uint32(data[off:]) {
+		case g.sndbuf:
+			sndbuf = append(sndbuf, off)
+		case g.rcvbuf:
+			rcvbuf = append(rcvbuf, off)
+		}
+	}
+	return mapstr.M{
+		"SOCK_SNDBUF": sndbuf,
+		"SOCK_RCVBUF": rcvbuf,
+	}, true
+}
+
+// NumRepeats makes this guess to be repeated to avoid collisions.
+func (g *guessSockBuf) NumRepeats() int {
+	return 4
+}
+
+// Reduce takes the offsets that matched in all the runs.
+func (g *guessSockBuf) Reduce(results []mapstr.M) (mapstr.M, error) {
+	result, err := consolidate(results)
+	if err != nil {
+		return nil, err
+	}
+	output := make(mapstr.M, 2)
+	for _, key := range []string{"SOCK_SNDBUF", "SOCK_RCVBUF"} {
+		list, err := getListField(result, key)
+		if err != nil {
+			return nil, err
+		}
+		if len(list) != 1 {
+			return nil, fmt.Errorf("ambiguous offsets for %s: %v", key, list)
+		}
+		output[key] = list[0]
+	}
+	return output, nil
+}
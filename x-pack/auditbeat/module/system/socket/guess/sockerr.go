@@ -0,0 +1,154 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Guess the offset of the pending error of a socket within a struct sock:
+//
+//	struct sock {
+//		...
+//		int			sk_err,
+//					sk_err_soft;
+//		...
+//	}
+//
+// A TCP socket connects to a local port that is bound but not listening. The
+// reset received in SYN_SENT sets sk_err to ECONNREFUSED and calls tcp_done,
+// where the struct sock* is dumped and searched for the error.
+//
+// This guess is optional. When it fails, the error of failed connection
+// attempts isn't reported.
+//
+// Output:
+//  SOCK_ERR : 380
+
+func init() {
+	if err := Registry.AddGuess(func() Guesser { return &guessSockErr{} }); err != nil {
+		panic(err)
+	}
+}
+
+type guessSockErr struct {
+	ctx    Context
+	closed int
+	addr   unix.SockaddrInet4
+}
+
+// Name of this guess.
+func (g *guessSockErr) Name() string {
+	return "guess_sock_err"
+}
+
+// Provides returns the list of variables discovered.
+func (g *guessSockErr) Provides() []string {
+	return []string{
+		"SOCK_ERR",
+	}
+}
+
+// Requires declares the variables required to run this guess.
+func (g *guessSockErr) Requires() []string {
+	return []string{
+		"P1",
+	}
+}
+
+// Optional makes failures of this guess non-fatal.
+func (g *guessSockErr) Optional() bool {
+	return true
+}
+
+// Probes returns a kprobe on tcp_done that dumps the struct sock*.
+func (g *guessSockErr) Probes() ([]helper.ProbeDef, error) {
+	return []helper.ProbeDef{
+		{
+			Probe: tracing.Probe{
+				Name:      "sock_err_guess",
+				Address:   "tcp_done",
+				Fetchargs: helper.MakeMemoryDump("{{.P1}}", 0, tcpSockDumpSize),
+			},
+			Decoder: tracing.NewDumpDecoder,
+		},
+	}, nil
+}
+
+// Prepare binds a socket to a local port without listening, so that
+// connections to it are refused.
+func (g *guessSockErr) Prepare(ctx Context) (err error) {
+	g.ctx = ctx
+	g.closed, g.addr, err = createSocket(unix.SockaddrInet4{Addr: randomLocalIP()})
+	return err
+}
+
+// Terminate closes the bound socket.
+func (g *guessSockErr) Terminate() error {
+	return unix.Close(g.closed)
+}
+
+// Trigger connects to the bound port, which is refused.
+func (g *guessSockErr) Trigger() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err = unix.Connect(fd, &g.addr); !errors.Is(err, unix.ECONNREFUSED) {
+		return fmt.Errorf("connect to a closed port didn't fail with ECONNREFUSED: %v", err)
+	}
+	return nil
+}
+
+// Extract scans the struct sock* dump for ECONNREFUSED.
+func (g *guessSockErr) Extract(ev interface{}) (mapstr.M, bool) {
+	data := ev.([]byte)
+	var hits []int
+	for off := 0; off+4 <= len(data); off += 4 {
+		if tracing.MachineEndian.Uint32(data[off:]) == uint32(unix.ECONNREFUSED) {
+			hits = append(hits, off)
+		}
+	}
+	if len(hits) == 0 {
+		return nil, false
+	}
+	return mapstr.M{
+		"SOCK_ERR": hits,
+	}, true
+}
+
+// NumRepeats makes this guess to be repeated to avoid collisions.
+func (g *guessSockErr) NumRepeats() int {
+	return 4
+}
+
+// Reduce takes the offset that matched in all the runs.
+func (g *guessSockErr) Reduce(results []mapstr.M) (mapstr.M, error) {
+	result, err := consolidate(results)
+	if err != nil {
+		return nil, err
+	}
+	list, err := getListField(result, "SOCK_ERR")
+	if err != nil {
+		return nil, err
+	}
+	if len(list) != 1 {
+		return nil, fmt.Errorf("ambiguous offsets for SOCK_ERR: %v", list)
+	}
+	return mapstr.M{
+		"SOCK_ERR": list[0],
+	}, nil
+}
@@ -0,0 +1,26 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSockErrTrigger(t *testing.T) {
+	var g guessSockErr
+	if !assert.NoError(t, g.Prepare(Context{})) {
+		return
+	}
+	defer g.Terminate()
+	// Connections to the bound port are refused, every time.
+	for i := 0; i < g.NumRepeats(); i++ {
+		assert.NoError(t, g.Trigger())
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Guess the offset of the inode number of a socket relative to its struct
+// socket*:
+//
+//	struct socket_alloc {
+//		struct socket socket;
+//		struct inode vfs_inode;
+//	};
+//
+//	struct inode {
+//		...
+//		unsigned long	i_ino;
+//		...
+//	}
+//
+// A socket is created and its inode number is read with fstat(). The struct
+// socket* passed to inet_release when it's closed is dumped, including the
+// inode that follows it, and searched for the inode number.
+//
+// This guess is optional. When it fails, the inode of sockets isn't reported.
+//
+// Output:
+//  SOCKET_INODE_INO : 192
+
+const socketInodeDumpSize = 512
+
+func init() {
+	if err := Registry.AddGuess(func() Guesser { return &guessSocketInode{} }); err != nil {
+		panic(err)
+	}
+}
+
+type guessSocketInode struct {
+	ctx Context
+	ino uint64
+}
+
+// Name of this guess.
+func (g *guessSocketInode) Name() string {
+	return "guess_socket_inode"
+}
+
+// Provides returns the list of variables discovered.
+func (g *guessSocketInode) Provides() []string {
+	return []string{
+		"SOCKET_INODE_INO",
+	}
+}
+
+// Requires declares the variables required to run this guess.
+func (g *guessSocketInode) Requires() []string {
+	return []string{
+		"P1",
+	}
+}
+
+// Optional makes failures of this guess non-fatal.
+func (g *guessSocketInode) Optional() bool {
+	return true
+}
+
+// Probes returns a kprobe on inet_release that dumps the struct socket*.
+func (g *guessSocketInode) Probes() ([]helper.ProbeDef, error) {
+	return []helper.ProbeDef{
+		{
+			Probe: tracing.Probe{
+				Name:      "socket_inode_guess",
+				Address:   "inet_release",
+				Fetchargs: helper.MakeMemoryDump("{{.P1}}", 0, socketInodeDumpSize),
+			},
+			Decoder: tracing.NewDumpDecoder,
+		},
+	}, nil
+}
+
+// Prepare is a no-op.
+func (g *guessSocketInode) Prepare(ctx Context) error {
+	g.ctx = ctx
+	return nil
+}
+
+// Terminate is a no-op.
+func (g *guessSocketInode) Terminate() error {
+	return nil
+}
+
+// Trigger creates a socket, reads its inode number and closes it.
+func (g *guessSocketInode) Trigger() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	g.ino, err = socketInode(fd)
+	return err
+}
+
+// socketInode returns the inode number of a socket, the one that appears in
+// the socket:[<inode>] links of /proc/<pid>/fd.
+func socketInode(fd int) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return 0, fmt.Errorf("fstat failed: %w", err)
+	}
+	return st.Ino, nil
+}
+
+// Extract scans the struct socket* dump for the inode number.
+func (g *guessSocketInode) Extract(ev interface{}) (mapstr.M, bool) {
+	hits := inodeOffsets(ev.([]byte), g.ino)
+	if len(hits) == 0 {
+		return nil, false
+	}
+	return mapstr.M{
+		"SOCKET_INODE_INO": hits,
+	}, true
+}
+
+// inodeOffsets returns the offsets of the inode number in the dump. It's an
+// unsigned long, so its size is that of a pointer.
+func inodeOffsets(dump []byte, ino uint64) (hits []int) {
+	if ino == 0 {
+		return nil
+	}
+	value := uintptr(ino)
+	if uint64(value) != ino {
+		return nil
+	}
+	const ptrLen = int(sizeOfPtr)
+	needle := (*[ptrLen]byte)(unsafe.Pointer(&value))[:]
+	for off := indexAligned(dump, needle, 0, ptrLen); off != -1; off = indexAligned(dump, needle, off+ptrLen, ptrLen) {
+		hits = append(hits, off)
+	}
+	return hits
+}
+
+// NumRepeats makes this guess to be repeated to avoid collisions.
+func (g *guessSocketInode) NumRepeats() int {
+	return 4
+}
+
+// Reduce takes the offset that matched in all the runs.
+func (g *guessSocketInode) Reduce(results []mapstr.M) (mapstr.M, error) {
+	result, err := consolidate(results)
+	if err != nil {
+		return nil, err
+	}
+	list, err := getListField(result, "SOCKET_INODE_INO")
+	if err != nil {
+		return nil, err
+	}
+	if len(list) != 1 {
+		return nil, errors.New("ambiguous offset for the socket inode")
+	}
+	return mapstr.M{
+		"SOCKET_INODE_INO": list[0],
+	}, nil
+}
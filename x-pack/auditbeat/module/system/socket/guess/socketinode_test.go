@@ -0,0 +1,45 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketInode(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	ino, err := socketInode(fd)
+	if !assert.NoError(t, err) {
+		return
+	}
+	link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), fd))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, fmt.Sprintf("socket:[%d]", ino), link)
+}
+
+func TestInodeOffsets(t *testing.T) {
+	const ino = 0x1234567
+	dump := make([]byte, socketInodeDumpSize)
+	value := uintptr(ino)
+	copy(dump[192:], (*[sizeOfPtr]byte)(unsafe.Pointer(&value))[:])
+	assert.Equal(t, []int{192}, inodeOffsets(dump, ino))
+	assert.Empty(t, inodeOffsets(dump, ino+1))
+	assert.Empty(t, inodeOffsets(dump, 0))
+}
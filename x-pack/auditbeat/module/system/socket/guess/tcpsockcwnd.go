@@ -0,0 +1,174 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Guess the offset of the congestion window within a struct tcp_sock:
+//
+//	struct tcp_sock {
+//		...
+//		u32	snd_ssthresh;	/* Slow start size threshold		*/
+//		u32	snd_cwnd;	/* Sending congestion window		*/
+//		...
+//	}
+//
+// snd_cwnd is exported as tcpi_snd_cwnd by getsockopt(TCP_INFO), but it's a
+// small number, usually the initial window of 10 segments for a new
+// connection, which is found in many places. Instead, it's searched in a dump
+// of the struct sock* passed to tcp_sendmsg as the field that follows
+// snd_ssthresh, which is usually the much more distinctive "infinite" value
+// of 0x7fffffff until the connection sees a loss.
+//
+// This only holds for kernels older than 6.8. Kernel 6.8 regrouped the fields
+// of struct tcp_sock by cache line, and snd_cwnd no longer follows
+// snd_ssthresh, so this guess doesn't run in other versions. It's optional,
+// and when it doesn't run or fails, the congestion window isn't reported.
+//
+// Output:
+//  TCP_SOCK_SND_CWND : 1612
+
+// First kernel version where snd_cwnd doesn't follow snd_ssthresh.
+var cwndMaxKernel = [2]int{6, 8}
+
+func init() {
+	if err := Registry.AddGuess(func() Guesser { return &guessTCPSockCwnd{} }); err != nil {
+		panic(err)
+	}
+}
+
+type guessTCPSockCwnd struct {
+	ctx  Context
+	cs   inetClientServer
+	info *unix.TCPInfo
+}
+
+// Name of this guess.
+func (g *guessTCPSockCwnd) Name() string {
+	return "guess_tcp_sock_cwnd"
+}
+
+// Provides returns the list of variables discovered.
+func (g *guessTCPSockCwnd) Provides() []string {
+	return []string{
+		"TCP_SOCK_SND_CWND",
+	}
+}
+
+// Requires declares the variables required to run this guess.
+func (g *guessTCPSockCwnd) Requires() []string {
+	return []string{
+		"TCP_SENDMSG_SOCK",
+	}
+}
+
+// Optional makes failures of this guess non-fatal.
+func (g *guessTCPSockCwnd) Optional() bool {
+	return true
+}
+
+// Condition runs this guess only for the kernel versions where snd_cwnd
+// follows snd_ssthresh.
+func (g *guessTCPSockCwnd) Condition(ctx Context) (bool, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return false, fmt.Errorf("uname failed: %w", err)
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(unix.ByteSliceToString(uts.Release[:]), "%d.%d", &major, &minor); err != nil {
+		ctx.Log.Debugf("Unable to parse kernel version: %v", err)
+		return false, nil
+	}
+	return major < cwndMaxKernel[0] || (major == cwndMaxKernel[0] && minor < cwndMaxKernel[1]), nil
+}
+
+// Probes returns a kprobe on tcp_sendmsg that dumps the struct sock*.
+func (g *guessTCPSockCwnd) Probes() ([]helper.ProbeDef, error) {
+	return []helper.ProbeDef{
+		{
+			Probe: tracing.Probe{
+				Name:      "tcp_sock_cwnd_guess",
+				Address:   "tcp_sendmsg",
+				Fetchargs: helper.MakeMemoryDump("{{.TCP_SENDMSG_SOCK}}", 0, tcpSockDumpSize),
+			},
+			Decoder: tracing.NewDumpDecoder,
+		},
+	}, nil
+}
+
+// Prepare creates a TCP client-server.
+func (g *guessTCPSockCwnd) Prepare(ctx Context) error {
+	g.ctx = ctx
+	return g.cs.SetupTCP()
+}
+
+// Terminate cleans up the client-server.
+func (g *guessTCPSockCwnd) Terminate() error {
+	return g.cs.Cleanup()
+}
+
+// Trigger fetches the current congestion state via TCP_INFO and then writes
+// to the connection, causing a tcp_sendmsg call.
+func (g *guessTCPSockCwnd) Trigger() (err error) {
+	if g.info, err = unix.GetsockoptTCPInfo(g.cs.client, unix.IPPROTO_TCP, unix.TCP_INFO); err != nil {
+		return fmt.Errorf("getsockopt(TCP_INFO) failed: %w", err)
+	}
+	_, err = unix.Write(g.cs.client, []byte("Hello World!\n"))
+	return err
+}
+
+// Extract scans the struct sock* dump for snd_ssthresh followed by
+// snd_cwnd.
+func (g *guessTCPSockCwnd) Extract(ev interface{}) (mapstr.M, bool) {
+	data := ev.([]byte)
+	if g.info == nil || g.info.Snd_cwnd == 0 {
+		return nil, false
+	}
+	var hits []int
+	for off := 0; off+8 <= len(data); off += 4 {
+		if tracing.MachineEndian.Uint32(data[off:]) == g.info.Snd_ssthresh &&
+			tracing.MachineEndian.Uint32(data[off+4:]) == g.info.Snd_cwnd {
+			hits = append(hits, off+4)
+		}
+	}
+	return mapstr.M{
+		"TCP_SOCK_SND_CWND": hits,
+	}, true
+}
+
+// NumRepeats makes this guess to be repeated to avoid collisions.
+func (g *guessTCPSockCwnd) NumRepeats() int {
+	return 4
+}
+
+// Reduce takes the offset that matched in all the runs.
+func (g *guessTCPSockCwnd) Reduce(results []mapstr.M) (mapstr.M, error) {
+	result, err := consolidate(results)
+	if err != nil {
+		return nil, err
+	}
+	list, err := getListField(result, "TCP_SOCK_SND_CWND")
+	if err != nil {
+		return nil, err
+	}
+	if len(list) != 1 {
+		return nil, errors.New("ambiguous offset for snd_cwnd")
+	}
+	return mapstr.M{
+		"TCP_SOCK_SND_CWND": list[0],
+	}, nil
+}
@@ -0,0 +1,210 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Guess the offset of the DSACK counter within a struct tcp_sock:
+//
+//	struct tcp_sock {
+//		...
+//		u64	bytes_acked;	/* RFC4019 tcpEStatsAppHCThruOctetsAcked */
+//		u32	dsack_dups;	/* RFC4898 tcpEStatsStackDSACKDups */
+//		...
+//	}
+//
+// dsack_dups counts the duplicate segments reported by the peer using
+// duplicate SACK blocks. It is exported as tcpi_dsack_dups by
+// getsockopt(TCP_INFO), but it's zero for a healthy connection and can't be
+// searched for directly. Instead, the offset of bytes_acked, which is known
+// from TCP_INFO, is searched in a dump of the struct sock* passed to
+// tcp_sendmsg, and dsack_dups is the field that follows it.
+//
+// This only holds for kernels 4.19 (which introduced dsack_dups) to 6.7.
+// Kernel 6.8 regrouped the fields of struct tcp_sock by cache line, so this
+// guess doesn't run in other versions. It's optional, and when it doesn't
+// run or fails, DSACK reporting is disabled.
+//
+// Output:
+//  TCP_SOCK_DSACK_DUPS : 1664
+
+// Maximum amount of data sent before the DSACK guess.
+const dsackGuessMaxPayload = 4096
+
+var (
+	// First kernel version with tcp_sock.dsack_dups.
+	dsackMinKernel = [2]int{4, 19}
+	// First kernel version where dsack_dups doesn't follow bytes_acked.
+	dsackMaxKernel = [2]int{6, 8}
+)
+
+func init() {
+	if err := Registry.AddGuess(func() Guesser { return &guessTCPSockDSACK{} }); err != nil {
+		panic(err)
+	}
+}
+
+type guessTCPSockDSACK struct {
+	ctx  Context
+	cs   inetClientServer
+	info *unix.TCPInfo
+}
+
+// Name of this guess.
+func (g *guessTCPSockDSACK) Name() string {
+	return "guess_tcp_sock_dsack"
+}
+
+// Provides returns the list of variables discovered.
+func (g *guessTCPSockDSACK) Provides() []string {
+	return []string{
+		"TCP_SOCK_DSACK_DUPS",
+	}
+}
+
+// Requires declares the variables required to run this guess.
+func (g *guessTCPSockDSACK) Requires() []string {
+	return []string{
+		"TCP_SENDMSG_SOCK",
+	}
+}
+
+// Optional makes failures of this guess non-fatal.
+func (g *guessTCPSockDSACK) Optional() bool {
+	return true
+}
+
+// Condition runs this guess only for the kernel versions where the layout of
+// struct tcp_sock is known to be compatible.
+func (g *guessTCPSockDSACK) Condition(ctx Context) (bool, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return false, fmt.Errorf("uname failed: %w", err)
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(unix.ByteSliceToString(uts.Release[:]), "%d.%d", &major, &minor); err != nil {
+		ctx.Log.Debugf("Unable to parse kernel version: %v", err)
+		return false, nil
+	}
+	return dsackSupported(major, minor), nil
+}
+
+func dsackSupported(major, minor int) bool {
+	v := [2]int{major, minor}
+	less := func(a, b [2]int) bool {
+		return a[0] < b[0] || (a[0] == b[0] && a[1] < b[1])
+	}
+	return !less(v, dsackMinKernel) && less(v, dsackMaxKernel)
+}
+
+// Probes returns a kprobe on tcp_sendmsg that dumps the struct sock*.
+func (g *guessTCPSockDSACK) Probes() ([]helper.ProbeDef, error) {
+	return []helper.ProbeDef{
+		{
+			Probe: tracing.Probe{
+				Name:      "tcp_sock_dsack_guess",
+				Address:   "tcp_sendmsg",
+				Fetchargs: helper.MakeMemoryDump("{{.TCP_SENDMSG_SOCK}}", 0, tcpSockDumpSize),
+			},
+			Decoder: tracing.NewDumpDecoder,
+		},
+	}, nil
+}
+
+// Prepare creates a TCP client-server and sends a random amount of data so
+// that bytes_acked has a distinct value in each run.
+func (g *guessTCPSockDSACK) Prepare(ctx Context) error {
+	g.ctx = ctx
+	if err := g.cs.SetupTCP(); err != nil {
+		return err
+	}
+	payload := make([]byte, 1+rand.Intn(dsackGuessMaxPayload))
+	if _, err := unix.Write(g.cs.client, payload); err != nil {
+		return fmt.Errorf("write failed: %w", err)
+	}
+	buf := make([]byte, len(payload))
+	for read := 0; read < len(payload); {
+		n, err := unix.Read(g.cs.accepted, buf)
+		if err != nil {
+			return fmt.Errorf("read failed: %w", err)
+		}
+		read += n
+	}
+	// Allow for the ACKs to be processed.
+	time.Sleep(10 * time.Millisecond)
+	return nil
+}
+
+// Terminate cleans up the client-server.
+func (g *guessTCPSockDSACK) Terminate() error {
+	return g.cs.Cleanup()
+}
+
+// Trigger fetches the current counters via TCP_INFO and then writes to the
+// connection, causing a tcp_sendmsg call.
+func (g *guessTCPSockDSACK) Trigger() (err error) {
+	if g.info, err = unix.GetsockoptTCPInfo(g.cs.client, unix.IPPROTO_TCP, unix.TCP_INFO); err != nil {
+		return fmt.Errorf("getsockopt(TCP_INFO) failed: %w", err)
+	}
+	_, err = unix.Write(g.cs.client, []byte("Hello World!\n"))
+	return err
+}
+
+// Extract scans the struct sock* dump for bytes_acked followed by the
+// current value of dsack_dups.
+func (g *guessTCPSockDSACK) Extract(ev interface{}) (mapstr.M, bool) {
+	data := ev.([]byte)
+	if g.info == nil || g.info.Bytes_acked == 0 {
+		return nil, false
+	}
+	var hits []int
+	// u64 fields are only 4-byte aligned in 32-bit kernels.
+	for off := 0; off+12 <= len(data); off += 4 {
+		if tracing.MachineEndian.Uint64(data[off:]) == g.info.Bytes_acked &&
+			tracing.MachineEndian.Uint32(data[off+8:]) == g.info.Dsack_dups {
+			hits = append(hits, off+8)
+		}
+	}
+	return mapstr.M{
+		"TCP_SOCK_DSACK_DUPS": hits,
+	}, true
+}
+
+// NumRepeats makes this guess to be repeated to avoid collisions.
+func (g *guessTCPSockDSACK) NumRepeats() int {
+	return 4
+}
+
+// Reduce takes the offset that matched in all the runs.
+func (g *guessTCPSockDSACK) Reduce(results []mapstr.M) (mapstr.M, error) {
+	result, err := consolidate(results)
+	if err != nil {
+		return nil, err
+	}
+	list, err := getListField(result, "TCP_SOCK_DSACK_DUPS")
+	if err != nil {
+		return nil, err
+	}
+	if len(list) != 1 {
+		return nil, errors.New("ambiguous offset for dsack_dups")
+	}
+	return mapstr.M{
+		"TCP_SOCK_DSACK_DUPS": list[0],
+	}, nil
+}
@@ -0,0 +1,260 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Guess the offsets of the RTT estimator state within a struct tcp_sock:
+//
+//	struct inet_connection_sock {
+//		...
+//		__u32			  icsk_rto;
+//		...			  /* 0 or 2 fields */
+//		__u32			  icsk_pmtu_cookie;
+//		...
+//	}
+//
+//	struct tcp_sock {
+//		struct inet_connection_sock	inet_conn;
+//		...
+//		u32	srtt_us;	/* smoothed round trip time << 3 in usecs */
+//		u32	mdev_us;	/* medium deviation */
+//		...
+//	}
+//
+// The values exported by getsockopt(TCP_INFO) for an established loopback
+// connection are searched in a dump of the struct sock* passed to
+// tcp_sendmsg. tcpi_rtt is srtt_us >> 3, tcpi_rttvar is mdev_us >> 2 and
+// tcpi_rto is icsk_rto converted from jiffies to microseconds using the
+// kernel's HZ, which is read from the kernel configuration or measured.
+//
+// An RTO candidate is only accepted when the path MTU (tcpi_pmtu) is found at
+// one of the positions that icsk_pmtu_cookie can occupy after icsk_rto. The
+// RTO is the same for all loopback connections, so without this check an
+// unrelated field with the same value could be taken for it.
+//
+// The smoothed RTT varies between connections, so the candidates found in all
+// the runs are usually unique. When they aren't, the one followed by the
+// medium deviation is preferred, as srtt_us and mdev_us are adjacent before
+// kernel 6.8. Since 6.8, struct tcp_sock is grouped by cache line and they
+// aren't, so the smoothed RTT is guessed on its own.
+//
+// This guess is optional. Kernels older than 3.15 store the smoothed RTT in
+// jiffies and won't match. In that case RTT reporting is disabled.
+//
+// Output:
+//  TCP_SOCK_SRTT : 1628
+//  INET_CSK_RTO  : 1184
+//  KERNEL_HZ     : 250
+
+const tcpSockDumpSize = 2048
+
+func init() {
+	if err := Registry.AddGuess(func() Guesser { return &guessTCPSockRTT{} }); err != nil {
+		panic(err)
+	}
+}
+
+type guessTCPSockRTT struct {
+	ctx  Context
+	cs   inetClientServer
+	hz   int
+	info *unix.TCPInfo
+}
+
+// Name of this guess.
+func (g *guessTCPSockRTT) Name() string {
+	return "guess_tcp_sock_rtt"
+}
+
+// Provides returns the list of variables discovered.
+func (g *guessTCPSockRTT) Provides() []string {
+	return []string{
+		"TCP_SOCK_SRTT",
+		"INET_CSK_RTO",
+		"KERNEL_HZ",
+	}
+}
+
+// Requires declares the variables required to run this guess.
+func (g *guessTCPSockRTT) Requires() []string {
+	return []string{
+		"TCP_SENDMSG_SOCK",
+	}
+}
+
+// Optional makes failures of this guess non-fatal.
+func (g *guessTCPSockRTT) Optional() bool {
+	return true
+}
+
+// Probes returns a kprobe on tcp_sendmsg that dumps the struct sock*.
+func (g *guessTCPSockRTT) Probes() ([]helper.ProbeDef, error) {
+	return []helper.ProbeDef{
+		{
+			Probe: tracing.Probe{
+				Name:      "tcp_sock_rtt_guess",
+				Address:   "tcp_sendmsg",
+				Fetchargs: helper.MakeMemoryDump("{{.TCP_SENDMSG_SOCK}}", 0, tcpSockDumpSize),
+			},
+			Decoder: tracing.NewDumpDecoder,
+		},
+	}, nil
+}
+
+// Prepare creates a TCP client-server and exchanges some data so that the
+// kernel has RTT samples for the connection.
+func (g *guessTCPSockRTT) Prepare(ctx Context) (err error) {
+	g.ctx = ctx
+	if g.hz == 0 {
+		if g.hz, err = kernelHZ(); err != nil {
+			return err
+		}
+	}
+	if err := g.cs.SetupTCP(); err != nil {
+		return err
+	}
+	buf := make([]byte, 16)
+	for _, pair := range [][2]int{{g.cs.client, g.cs.accepted}, {g.cs.accepted, g.cs.client}} {
+		if _, err := unix.Write(pair[0], []byte("Hello World!\n")); err != nil {
+			return fmt.Errorf("write failed: %w", err)
+		}
+		if _, err := unix.Read(pair[1], buf); err != nil {
+			return fmt.Errorf("read failed: %w", err)
+		}
+	}
+	// Allow for the ACKs to be processed.
+	time.Sleep(10 * time.Millisecond)
+	return nil
+}
+
+// Terminate cleans up the client-server.
+func (g *guessTCPSockRTT) Terminate() error {
+	return g.cs.Cleanup()
+}
+
+// Trigger fetches the current estimator state via TCP_INFO and then writes
+// to the connection, causing a tcp_sendmsg call.
+func (g *guessTCPSockRTT) Trigger() (err error) {
+	if g.info, err = unix.GetsockoptTCPInfo(g.cs.client, unix.IPPROTO_TCP, unix.TCP_INFO); err != nil {
+		return fmt.Errorf("getsockopt(TCP_INFO) failed: %w", err)
+	}
+	_, err = unix.Write(g.cs.client, []byte("Hello World!\n"))
+	return err
+}
+
+// Extract scans the struct sock* dump for the smoothed RTT and the RTO.
+func (g *guessTCPSockRTT) Extract(ev interface{}) (mapstr.M, bool) {
+	data := ev.([]byte)
+	if g.info == nil || g.info.Rtt == 0 || g.info.Rto == 0 || g.info.Pmtu == 0 {
+		return nil, false
+	}
+	srttHits := findUint32(data, func(v uint32) bool {
+		return v>>3 == g.info.Rtt
+	})
+	var adjacentHits []int
+	for _, off := range srttHits {
+		if off+8 <= len(data) && tracing.MachineEndian.Uint32(data[off+4:])>>2 == g.info.Rttvar {
+			adjacentHits = append(adjacentHits, off)
+		}
+	}
+	var rtoHits []int
+	// tcpi_rto is jiffies_to_usecs(icsk_rto).
+	jiffies := uint32(uint64(g.info.Rto) * uint64(g.hz) / 1000000)
+	if uint32(uint64(jiffies)*1000000/uint64(g.hz)) == g.info.Rto {
+		for _, off := range findUint32(data, func(v uint32) bool { return v == jiffies }) {
+			for _, dist := range pmtuDistances {
+				if pmtu := off + dist; pmtu+4 <= len(data) && tracing.MachineEndian.Uint32(data[pmtu:]) == g.info.Pmtu {
+					rtoHits = append(rtoHits, off)
+					break
+				}
+			}
+		}
+	}
+	return mapstr.M{
+		"TCP_SOCK_SRTT":      srttHits,
+		"TCP_SOCK_SRTT_MDEV": adjacentHits,
+		"INET_CSK_RTO":       rtoHits,
+	}, true
+}
+
+// NumRepeats makes this guess to be repeated to avoid collisions. It's higher
+// than for other guesses, as the smoothed RTT is matched by value alone.
+func (g *guessTCPSockRTT) NumRepeats() int {
+	return 8
+}
+
+// Reduce takes the offsets that matched in all the runs. The RTO must be
+// unique, and the smoothed RTT must come after it, as struct tcp_sock fields
+// follow the ones in struct inet_connection_sock. When several smoothed RTT
+// candidates remain, the one followed by the medium deviation is taken.
+func (g *guessTCPSockRTT) Reduce(results []mapstr.M) (mapstr.M, error) {
+	result, err := consolidate(results)
+	if err != nil {
+		return nil, err
+	}
+	rtoList, err := getListField(result, "INET_CSK_RTO")
+	if err != nil {
+		return nil, err
+	}
+	if len(rtoList) > 1 {
+		return nil, fmt.Errorf("ambiguous offsets found (rto: %v)", rtoList)
+	}
+	rto := rtoList[0]
+	srttList, err := getListField(result, "TCP_SOCK_SRTT")
+	if err != nil {
+		return nil, err
+	}
+	srttList = offsetsAfter(srttList, rto)
+	if len(srttList) > 1 {
+		adjacent, _ := result["TCP_SOCK_SRTT_MDEV"].([]int)
+		if adjacent = offsetsAfter(adjacent, rto); len(adjacent) == 1 {
+			srttList = adjacent
+		}
+	}
+	switch len(srttList) {
+	case 0:
+		return nil, fmt.Errorf("no srtt offset found after rto (rto: %d)", rto)
+	case 1:
+	default:
+		return nil, fmt.Errorf("ambiguous offsets found (srtt: %v, rto: %d)", srttList, rto)
+	}
+	return mapstr.M{
+		"TCP_SOCK_SRTT": srttList[0],
+		"INET_CSK_RTO":  rto,
+		"KERNEL_HZ":     g.hz,
+	}, nil
+}
+
+// offsetsAfter returns the offsets in the list that are greater than min.
+func offsetsAfter(list []int, min int) (after []int) {
+	for _, off := range list {
+		if off > min {
+			after = append(after, off)
+		}
+	}
+	return after
+}
+
+func findUint32(data []byte, match func(uint32) bool) (hits []int) {
+	for off := 0; off+4 <= len(data); off += 4 {
+		if match(tracing.MachineEndian.Uint32(data[off:])) {
+			hits = append(hits, off)
+		}
+	}
+	return hits
+}
@@ -0,0 +1,205 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+// +build linux,386 linux,amd64
+
+package guess
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Guess the offset of the negotiated TCP options within a struct tcp_sock:
+//
+//	struct tcp_options_received {
+//		...
+//		u16	saw_tstamp : 1,	/* Saw TIMESTAMP on last packet		*/
+//			tstamp_ok : 1,	/* TIMESTAMP seen on SYN packet		*/
+//			dsack : 1,	/* D-SACK is scheduled			*/
+//			wscale_ok : 1,	/* Wscale seen on SYN packet		*/
+//			sack_ok : 3,	/* SACK seen on SYN packet		*/
+//			...
+//		u8	num_sacks;	/* Number of SACK blocks		*/
+//		u16	user_mss;	/* mss requested by user in ioctl	*/
+//		u16	mss_clamp;	/* Maximal mss, negotiated at connection setup */
+//	};
+//
+//	struct tcp_sock {
+//		...
+//		struct tcp_options_received rx_opt;
+//		...
+//	}
+//
+// A random MSS is set with setsockopt(TCP_MAXSEG), which stores it in
+// rx_opt.user_mss, and the dump of the struct sock* passed to tcp_sendmsg is
+// searched for it. The flags that precede it must agree with the options
+// reported by getsockopt(TCP_INFO) for the connection. Kernel 5.10 added a
+// u8 before num_sacks, which didn't move user_mss.
+//
+// The output is the offset of the byte that holds tstamp_ok, in its second
+// least significant bit, as bitfields are allocated from the least
+// significant bit in little-endian architectures.
+//
+// This guess is optional. When it fails, the status of TCP timestamps isn't
+// reported.
+//
+// Output:
+//  TCP_SOCK_TSTAMP_OK : 1588
+
+// Flags in tcpi_options.
+const (
+	tcpiOptTimestamps = 1
+	tcpiOptSACK       = 2
+	tcpiOptWScale     = 4
+)
+
+// Bits in the first byte of the tcp_options_received bitfield.
+const (
+	rxOptTstampOK = 0x02
+	rxOptWScaleOK = 0x08
+	rxOptSACKOK   = 0x70
+)
+
+// Range of values accepted by setsockopt(TCP_MAXSEG).
+const (
+	tcpMinMSS = 88
+	tcpMaxMSS = 1400
+)
+
+func init() {
+	if err := Registry.AddGuess(func() Guesser { return &guessTCPSockTstamp{} }); err != nil {
+		panic(err)
+	}
+}
+
+type guessTCPSockTstamp struct {
+	ctx  Context
+	cs   inetClientServer
+	mss  uint16
+	info *unix.TCPInfo
+}
+
+// Name of this guess.
+func (g *guessTCPSockTstamp) Name() string {
+	return "guess_tcp_sock_tstamp"
+}
+
+// Provides returns the list of variables discovered.
+func (g *guessTCPSockTstamp) Provides() []string {
+	return []string{
+		"TCP_SOCK_TSTAMP_OK",
+	}
+}
+
+// Requires declares the variables required to run this guess.
+func (g *guessTCPSockTstamp) Requires() []string {
+	return []string{
+		"TCP_SENDMSG_SOCK",
+	}
+}
+
+// Optional makes failures of this guess non-fatal.
+func (g *guessTCPSockTstamp) Optional() bool {
+	return true
+}
+
+// Probes returns a kprobe on tcp_sendmsg that dumps the struct sock*.
+func (g *guessTCPSockTstamp) Probes() ([]helper.ProbeDef, error) {
+	return []helper.ProbeDef{
+		{
+			Probe: tracing.Probe{
+				Name:      "tcp_sock_tstamp_guess",
+				Address:   "tcp_sendmsg",
+				Fetchargs: helper.MakeMemoryDump("{{.TCP_SENDMSG_SOCK}}", 0, tcpSockDumpSize),
+			},
+			Decoder: tracing.NewDumpDecoder,
+		},
+	}, nil
+}
+
+// Prepare creates a TCP client-server and sets a random MSS on the client.
+func (g *guessTCPSockTstamp) Prepare(ctx Context) error {
+	g.ctx = ctx
+	if err := g.cs.SetupTCP(); err != nil {
+		return err
+	}
+	g.mss = uint16(tcpMinMSS + rand.Intn(tcpMaxMSS-tcpMinMSS+1))
+	if err := unix.SetsockoptInt(g.cs.client, unix.IPPROTO_TCP, unix.TCP_MAXSEG, int(g.mss)); err != nil {
+		return fmt.Errorf("setsockopt(TCP_MAXSEG) failed: %w", err)
+	}
+	return nil
+}
+
+// Terminate cleans up the client-server.
+func (g *guessTCPSockTstamp) Terminate() error {
+	return g.cs.Cleanup()
+}
+
+// Trigger fetches the negotiated options via TCP_INFO and then writes to the
+// connection, causing a tcp_sendmsg call.
+func (g *guessTCPSockTstamp) Trigger() (err error) {
+	if g.info, err = unix.GetsockoptTCPInfo(g.cs.client, unix.IPPROTO_TCP, unix.TCP_INFO); err != nil {
+		return fmt.Errorf("getsockopt(TCP_INFO) failed: %w", err)
+	}
+	_, err = unix.Write(g.cs.client, []byte("Hello World!\n"))
+	return err
+}
+
+// Extract scans the struct sock* dump for user_mss preceded by flags that
+// match the negotiated options.
+func (g *guessTCPSockTstamp) Extract(ev interface{}) (mapstr.M, bool) {
+	data := ev.([]byte)
+	if g.info == nil {
+		return nil, false
+	}
+	var hits []int
+	for off := 0; off+6 <= len(data); off += 2 {
+		if tracing.MachineEndian.Uint16(data[off+4:]) == g.mss && rxOptMatches(data[off], g.info.Options) {
+			hits = append(hits, off)
+		}
+	}
+	return mapstr.M{
+		"TCP_SOCK_TSTAMP_OK": hits,
+	}, true
+}
+
+// rxOptMatches returns whether the first byte of the tcp_options_received
+// bitfield agrees with the options in tcpi_options.
+func rxOptMatches(flags, options uint8) bool {
+	return (flags&rxOptTstampOK != 0) == (options&tcpiOptTimestamps != 0) &&
+		(flags&rxOptWScaleOK != 0) == (options&tcpiOptWScale != 0) &&
+		(flags&rxOptSACKOK != 0) == (options&tcpiOptSACK != 0)
+}
+
+// NumRepeats makes this guess to be repeated to avoid collisions.
+func (g *guessTCPSockTstamp) NumRepeats() int {
+	return 4
+}
+
+// Reduce takes the offset that matched in all the runs.
+func (g *guessTCPSockTstamp) Reduce(results []mapstr.M) (mapstr.M, error) {
+	result, err := consolidate(results)
+	if err != nil {
+		return nil, err
+	}
+	list, err := getListField(result, "TCP_SOCK_TSTAMP_OK")
+	if err != nil {
+		return nil, err
+	}
+	if len(list) != 1 {
+		return nil, errors.New("ambiguous offset for tcp_options_received")
+	}
+	return mapstr.M{
+		"TCP_SOCK_TSTAMP_OK": list[0],
+	}, nil
+}
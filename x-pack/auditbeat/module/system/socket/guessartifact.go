@@ -0,0 +1,275 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	conf "github.com/elastic/elastic-agent-libs/config"
+	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Version of the guess artifact format.
+const guessArtifactVersion = 1
+
+// guessArtifact holds the function selections and guessed variables of a host,
+// so that hosts running the same kernel with the same configuration can skip
+// the guesses at startup. It's written as JSON by ExportGuesses and loaded from
+// socket.guess_artifact_path.
+type guessArtifact struct {
+	Version int `json:"version"`
+	// Kernel is the kernel release and KernelBuild its build, from uname.
+	// Kernels with the same release can have different struct layouts.
+	Kernel      string `json:"kernel"`
+	KernelBuild string `json:"kernel_build"`
+	Arch        string `json:"arch"`
+	// ConfigHash is a hash of the template variables that determine which
+	// guesses run, see guessInputsHash.
+	ConfigHash string                 `json:"config_hash"`
+	Created    time.Time              `json:"created"`
+	Functions  map[string]string      `json:"functions"`
+	Variables  map[string]artifactVar `json:"variables"`
+}
+
+// artifactVar is a guessed variable. Its type is kept, as the variables are
+// also read by the dataset and not only used in the probe templates.
+type artifactVar struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// ExportGuesses runs the guesses for the running kernel and writes their
+// results as a guess artifact that can be loaded with
+// socket.guess_artifact_path. The configuration is the one of the system
+// module running the dataset, and can be nil to use the defaults. A non-empty
+// traceFSPath overrides socket.tracefs_path.
+func ExportGuesses(out io.Writer, cfg *conf.C, traceFSPath string) error {
+	config := defaultConfig
+	if cfg != nil {
+		if err := cfg.Unpack(&config); err != nil {
+			return fmt.Errorf("failed to unpack the %s config: %w", fullName, err)
+		}
+	}
+	if traceFSPath != "" {
+		config.TraceFSPath = &traceFSPath
+	}
+	// The guesses are always run.
+	config.GuessArtifactPath = ""
+
+	var traceFS *tracing.TraceFS
+	var err error
+	if config.TraceFSPath == nil {
+		traceFS, err = tracing.NewTraceFS()
+	} else {
+		traceFS, err = tracing.NewTraceFSWithPath(*config.TraceFSPath)
+	}
+	if err != nil {
+		return fmt.Errorf("tracefs/debugfs is not mounted or not writeable: %w", err)
+	}
+	symbols, err := loadSymbolMap(config.SymbolMapPath)
+	if err != nil {
+		return err
+	}
+	m := &MetricSet{
+		config:       config,
+		templateVars: make(mapstr.M),
+		log:          logp.NewLogger(metricsetName),
+		symbols:      symbols,
+	}
+	m.templateVars.Update(baseTemplateVars)
+	m.templateVars.Update(archVariables)
+	hasIPv6, err := m.hasIPv6()
+	if err != nil {
+		return err
+	}
+	m.templateVars.Update(configTemplateVars(&m.config, hasIPv6))
+	m.installer = newProbeInstaller(traceFS,
+		WithGroup(groupName),
+		WithTemplates(m.templateVars))
+	defer m.installer.UninstallInstalled()
+	if _, err = m.resolveTemplateVars(traceFS, hasIPv6); err != nil {
+		return err
+	}
+
+	build, err := kernelBuild()
+	if err != nil {
+		return err
+	}
+	artifact, err := newGuessArtifact(m.templateVars, kernelVersion, build, runtime.GOARCH)
+	if err != nil {
+		return err
+	}
+	artifact.Created = time.Now().UTC()
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(artifact)
+}
+
+// loadGuessArtifact reads socket.guess_artifact_path and returns its guessed
+// variables, or an error when it's not compatible with the running kernel,
+// the configuration or the selected functions.
+func (m *MetricSet) loadGuessArtifact(selected map[string]string) (mapstr.M, error) {
+	data, err := os.ReadFile(m.config.GuessArtifactPath)
+	if err != nil {
+		return nil, err
+	}
+	var artifact guessArtifact
+	if err = json.Unmarshal(data, &artifact); err != nil {
+		return nil, fmt.Errorf("invalid guess artifact: %w", err)
+	}
+	build, err := kernelBuild()
+	if err != nil {
+		return nil, err
+	}
+	if err = artifact.check(kernelVersion, build, runtime.GOARCH, guessInputsHash(m.templateVars), selected); err != nil {
+		return nil, err
+	}
+	return artifact.variables()
+}
+
+// newGuessArtifact returns the artifact of the resolved template variables.
+func newGuessArtifact(vars mapstr.M, kernel, build, arch string) (*guessArtifact, error) {
+	artifact := &guessArtifact{
+		Version:     guessArtifactVersion,
+		Kernel:      kernel,
+		KernelBuild: build,
+		Arch:        arch,
+		ConfigHash:  guessInputsHash(vars),
+		Functions:   make(map[string]string),
+		Variables:   make(map[string]artifactVar),
+	}
+	for name, value := range vars {
+		if _, isFunction := functionAlternatives[name]; isFunction {
+			artifact.Functions[name], _ = value.(string)
+			continue
+		}
+		if isGuessInput(name) {
+			continue
+		}
+		var v artifactVar
+		switch value := value.(type) {
+		case int:
+			v = artifactVar{Type: "int", Value: strconv.Itoa(value)}
+		case string:
+			v = artifactVar{Type: "string", Value: value}
+		case bool:
+			v = artifactVar{Type: "bool", Value: strconv.FormatBool(value)}
+		default:
+			return nil, fmt.Errorf("guessed variable %s has unsupported type %T", name, value)
+		}
+		artifact.Variables[name] = v
+	}
+	return artifact, nil
+}
+
+// check returns an error when the artifact can't be used on this host.
+func (a *guessArtifact) check(kernel, build, arch, hash string, functions map[string]string) error {
+	switch {
+	case a.Version != guessArtifactVersion:
+		return fmt.Errorf("unsupported guess artifact version %d", a.Version)
+	case a.Kernel != kernel:
+		return fmt.Errorf("created for kernel %s, running %s", a.Kernel, kernel)
+	case a.KernelBuild != build:
+		return fmt.Errorf("created for kernel build %q, running %q", a.KernelBuild, build)
+	case a.Arch != arch:
+		return fmt.Errorf("created for architecture %s, running %s", a.Arch, arch)
+	case a.ConfigHash != hash:
+		return errors.New("created with a different configuration, IPv6, SCTP and MPTCP must match")
+	}
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	for name := range a.Functions {
+		if _, found := functions[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if a.Functions[name] != functions[name] {
+			return fmt.Errorf("created with %q for %s, selected %q", a.Functions[name], name, functions[name])
+		}
+	}
+	return nil
+}
+
+// variables returns the guessed variables of the artifact.
+func (a *guessArtifact) variables() (mapstr.M, error) {
+	vars := make(mapstr.M, len(a.Variables))
+	for name, v := range a.Variables {
+		var err error
+		switch v.Type {
+		case "int":
+			vars[name], err = strconv.Atoi(v.Value)
+		case "string":
+			vars[name] = v.Value
+		case "bool":
+			vars[name], err = strconv.ParseBool(v.Value)
+		default:
+			err = fmt.Errorf("unknown type %q", v.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid guessed variable %s: %w", name, err)
+		}
+	}
+	return vars, nil
+}
+
+// isGuessInput returns whether a template variable is defined before the
+// guesses run, other than the selected functions.
+func isGuessInput(name string) bool {
+	if _, found := baseTemplateVars[name]; found {
+		return true
+	}
+	if _, found := archVariables[name]; found {
+		return true
+	}
+	_, found := configTemplateVars(&Config{}, false)[name]
+	return found
+}
+
+// guessInputsHash returns a hash of the template variables that determine
+// which guesses run and how, like HAS_IPV6 or ENABLE_SCTP.
+func guessInputsHash(vars mapstr.M) string {
+	names := make([]string, 0, len(vars))
+	for name, value := range vars {
+		if isGuessInput(name) && value != nil && reflect.TypeOf(value).Kind() != reflect.Func {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%v\n", name, vars[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// kernelBuild returns the build of the running kernel, as in uname -v.
+func kernelBuild() (string, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return "", fmt.Errorf("uname failed: %w", err)
+	}
+	return unix.ByteSliceToString(uts.Version[:]), nil
+}
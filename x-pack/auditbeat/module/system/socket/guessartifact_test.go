@@ -0,0 +1,84 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+func TestGuessArtifact(t *testing.T) {
+	inputs := func(sctp bool) mapstr.M {
+		vars := make(mapstr.M)
+		vars.Update(baseTemplateVars)
+		vars.Update(archVariables)
+		vars.Update(configTemplateVars(&Config{EnableSCTP: sctp}, true))
+		vars["IP_LOCAL_OUT"] = "__ip_local_out"
+		vars["SYS_UNAME"] = "__x64_sys_newuname"
+		return vars
+	}
+	functions := map[string]string{
+		"IP_LOCAL_OUT": "__ip_local_out",
+		"SYS_UNAME":    "__x64_sys_newuname",
+	}
+	guessed := mapstr.M{
+		"INET_SOCK_LADDR":   600,
+		"INET_SOCK_V6_TERM": ":u64",
+		"SYS_P1":            "%di",
+		"KERNEL_HZ":         250,
+		"HAS_TSTAMP":        true,
+	}
+	vars := inputs(false)
+	vars.Update(guessed)
+
+	artifact, err := newGuessArtifact(vars, "6.1.0-13-amd64", "#1 SMP Debian 6.1.55-1", "amd64")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, functions, artifact.Functions)
+	assert.Len(t, artifact.Variables, len(guessed))
+	data, err := json.Marshal(artifact)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var loaded guessArtifact
+	if !assert.NoError(t, json.Unmarshal(data, &loaded)) {
+		return
+	}
+
+	hash := guessInputsHash(inputs(false))
+	assert.NoError(t, loaded.check("6.1.0-13-amd64", "#1 SMP Debian 6.1.55-1", "amd64", hash, functions))
+	loadedVars, err := loaded.variables()
+	assert.NoError(t, err)
+	assert.Equal(t, guessed, loadedVars)
+
+	for title, err := range map[string]error{
+		"kernel":         loaded.check("6.1.0-18-amd64", "#1 SMP Debian 6.1.55-1", "amd64", hash, functions),
+		"build":          loaded.check("6.1.0-13-amd64", "#1 SMP Debian 6.1.76-1", "amd64", hash, functions),
+		"arch":           loaded.check("6.1.0-13-amd64", "#1 SMP Debian 6.1.55-1", "386", hash, functions),
+		"config":         loaded.check("6.1.0-13-amd64", "#1 SMP Debian 6.1.55-1", "amd64", guessInputsHash(inputs(true)), functions),
+		"function":       loaded.check("6.1.0-13-amd64", "#1 SMP Debian 6.1.55-1", "amd64", hash, map[string]string{"IP_LOCAL_OUT": "ip_local_out", "SYS_UNAME": "__x64_sys_newuname"}),
+		"extra function": loaded.check("6.1.0-13-amd64", "#1 SMP Debian 6.1.55-1", "amd64", hash, map[string]string{"IP_LOCAL_OUT": "__ip_local_out"}),
+	} {
+		assert.Error(t, err, title)
+	}
+
+	loaded.Version++
+	assert.Error(t, loaded.check("6.1.0-13-amd64", "#1 SMP Debian 6.1.55-1", "amd64", hash, functions))
+
+	loaded.Variables["KERNEL_HZ"] = artifactVar{Type: "int", Value: "fast"}
+	_, err = loaded.variables()
+	assert.Error(t, err)
+
+	vars["UNSUPPORTED"] = 1.5
+	_, err = newGuessArtifact(vars, "6.1.0-13-amd64", "#1 SMP Debian 6.1.55-1", "amd64")
+	assert.Error(t, err)
+}
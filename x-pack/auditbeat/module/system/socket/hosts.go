@@ -0,0 +1,108 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hostsPath = "/etc/hosts"
+
+	// How often the modification time of the hosts file is checked.
+	hostsCheckInterval = 10 * time.Second
+)
+
+// hostsResolver resolves IP addresses to names using a cached parse of the
+// hosts file, which is reloaded when it's modified.
+type hostsResolver struct {
+	sync.Mutex
+	path      string
+	names     map[string]string
+	modTime   time.Time
+	nextCheck time.Time
+
+	// Decoupled for testing.
+	clock func() time.Time
+}
+
+func newHostsResolver(path string) *hostsResolver {
+	return &hostsResolver{
+		path:  path,
+		clock: time.Now,
+	}
+}
+
+// Lookup returns the name for the given IP in the hosts file, or an empty
+// string when there is none.
+func (r *hostsResolver) Lookup(ip net.IP) string {
+	if r == nil || ip == nil {
+		return ""
+	}
+	r.Lock()
+	defer r.Unlock()
+	if now := r.clock(); !now.Before(r.nextCheck) {
+		r.nextCheck = now.Add(hostsCheckInterval)
+		r.reload()
+	}
+	return r.names[ip.String()]
+}
+
+// reload parses the hosts file again if its modification time changed. The
+// previous names are kept if it can't be read.
+func (r *hostsResolver) reload() {
+	info, err := os.Stat(r.path)
+	if err != nil || info.ModTime().Equal(r.modTime) {
+		return
+	}
+	f, err := os.Open(r.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	names, err := parseHosts(f)
+	if err != nil {
+		return
+	}
+	r.names, r.modTime = names, info.ModTime()
+}
+
+// parseHosts parses a hosts(5) file, returning the name of each IP. When an IP
+// has multiple names, the canonical name of its first entry is used.
+func parseHosts(rd io.Reader) (map[string]string, error) {
+	names := make(map[string]string)
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if pos := strings.IndexByte(line, '#'); pos != -1 {
+			line = line[:pos]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr := fields[0]
+		// Scoped IPv6 addresses can't be matched with flow addresses.
+		if strings.IndexByte(addr, '%') != -1 {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if _, exists := names[ip.String()]; !exists {
+			names[ip.String()] = fields[1]
+		}
+	}
+	return names, scanner.Err()
+}
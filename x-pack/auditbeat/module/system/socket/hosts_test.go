@@ -0,0 +1,112 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns"
+)
+
+const testHosts = `# Static names
+127.0.0.1	localhost
+10.1.2.3	db.internal db  # primary
+10.1.2.3	database.internal
+fe80::1%eth0	router.local
+2001:db8::10	cache.internal cache
+not-an-ip	bogus
+10.1.2.4
+`
+
+func TestParseHosts(t *testing.T) {
+	names, err := parseHosts(strings.NewReader(testHosts))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]string{
+		"127.0.0.1":    "localhost",
+		"10.1.2.3":     "db.internal",
+		"2001:db8::10": "cache.internal",
+	}, names)
+}
+
+func TestHostsResolverReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if !assert.NoError(t, os.WriteFile(path, []byte(testHosts), 0o644)) {
+		return
+	}
+	now := time.Now()
+	r := newHostsResolver(path)
+	r.clock = func() time.Time { return now }
+	assert.Equal(t, "db.internal", r.Lookup(net.ParseIP("10.1.2.3")))
+	assert.Equal(t, "cache.internal", r.Lookup(net.ParseIP("2001:db8::10")))
+	assert.Empty(t, r.Lookup(net.ParseIP("10.9.9.9")))
+
+	if !assert.NoError(t, os.WriteFile(path, []byte("10.9.9.9 new.internal\n"), 0o644)) {
+		return
+	}
+	modTime := r.modTime.Add(time.Second)
+	if !assert.NoError(t, os.Chtimes(path, modTime, modTime)) {
+		return
+	}
+	// Not reloaded until the next check.
+	assert.Empty(t, r.Lookup(net.ParseIP("10.9.9.9")))
+	now = now.Add(hostsCheckInterval)
+	assert.Equal(t, "new.internal", r.Lookup(net.ParseIP("10.9.9.9")))
+	assert.Empty(t, r.Lookup(net.ParseIP("10.1.2.3")))
+
+	// The last names are kept when the file is removed.
+	assert.NoError(t, os.Remove(path))
+	now = now.Add(hostsCheckInterval)
+	assert.Equal(t, "new.internal", r.Lookup(net.ParseIP("10.9.9.9")))
+}
+
+func TestHostsDomain(t *testing.T) {
+	dst := net.ParseIP("10.1.2.3")
+	for _, tc := range []struct {
+		name     string
+		dnsName  string
+		expected string
+	}{
+		{"hosts file", "", "db.internal"},
+		{"dns first", "db.example.net", "db.example.net"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &process{pid: 1234, name: "psql"}
+			if tc.dnsName != "" {
+				p.addTransaction(dns.Transaction{Domain: tc.dnsName, Addresses: []net.IP{dst}})
+			}
+			f := &flow{
+				inetType:    inetTypeIPv4,
+				proto:       protoTCP,
+				dir:         directionEgress,
+				pid:         p.pid,
+				process:     p,
+				local:       endpoint{addr: net.TCPAddr{IP: net.ParseIP("192.168.33.10"), Port: 38842}},
+				remote:      endpoint{addr: net.TCPAddr{IP: dst, Port: 5432}},
+				hostsDomain: "db.internal",
+			}
+			ev, err := f.toEvent(true)
+			if !assert.NoError(t, err) {
+				return
+			}
+			domain, err := ev.RootFields.GetValue("destination.domain")
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.expected, domain)
+			}
+			_, err = ev.RootFields.GetValue("source.domain")
+			assert.Error(t, err)
+		})
+	}
+}
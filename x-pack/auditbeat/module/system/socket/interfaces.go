@@ -0,0 +1,308 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+)
+
+const (
+	// How long a route lookup is cached. Routes can change without any
+	// link change.
+	routeCacheTTL = 30 * time.Second
+	// Maximum number of cached route lookups. The cache is reset when full.
+	routeCacheSize = 4096
+)
+
+type routeEntry struct {
+	ifindex int
+	expires time.Time
+}
+
+// interfaceResolver determines the interface used to reach a remote address
+// by querying the kernel's routing table, and resolves it to a name or MTU.
+// Routes and interfaces are those of the Beat's network namespace, so only
+// flows of processes in the same namespace are resolved.
+type interfaceResolver struct {
+	sync.Mutex
+	netns  uint64
+	names  map[int]string
+	mtus   map[int]int
+	routes map[string]routeEntry
+
+	// Decoupled for testing.
+	clock          func() time.Time
+	lookupRoute    func(src, dst net.IP) (ifindex int, err error)
+	listInterfaces func() (map[int]string, error)
+	interfaceMTU   func(ifindex int) (int, error)
+}
+
+func newInterfaceResolver() *interfaceResolver {
+	// Without it, no flow is resolved.
+	netns, _ := readNetNS(uint32(os.Getpid()))
+	return &interfaceResolver{
+		netns:          netns,
+		routes:         make(map[string]routeEntry),
+		mtus:           make(map[int]int),
+		clock:          time.Now,
+		lookupRoute:    routeGetInterface,
+		listInterfaces: listInterfaces,
+		interfaceMTU:   interfaceMTU,
+	}
+}
+
+// Lookup returns the name of the interface used to send packets from src to
+// dst in the given network namespace, or an empty string if it can't be
+// determined.
+func (r *interfaceResolver) Lookup(netns uint64, src, dst net.IP) string {
+	if !r.canResolve(netns, src, dst) {
+		return ""
+	}
+	r.Lock()
+	defer r.Unlock()
+	ifindex := r.routeLocked(src, dst)
+	if ifindex == 0 {
+		return ""
+	}
+	if r.names == nil {
+		r.refreshLocked()
+	}
+	return r.names[ifindex]
+}
+
+// LookupMTU returns the MTU of the interface used to send packets from src to
+// dst in the given network namespace, or zero if it can't be determined.
+func (r *interfaceResolver) LookupMTU(netns uint64, src, dst net.IP) int {
+	if !r.canResolve(netns, src, dst) {
+		return 0
+	}
+	r.Lock()
+	defer r.Unlock()
+	ifindex := r.routeLocked(src, dst)
+	if ifindex == 0 {
+		return 0
+	}
+	mtu, found := r.mtus[ifindex]
+	if !found {
+		var err error
+		if mtu, err = r.interfaceMTU(ifindex); err != nil {
+			mtu = 0
+		}
+		r.mtus[ifindex] = mtu
+	}
+	return mtu
+}
+
+// canResolve returns whether a route lookup in the Beat's network namespace
+// is valid for a flow in netns.
+func (r *interfaceResolver) canResolve(netns uint64, src, dst net.IP) bool {
+	return r != nil && src != nil && dst != nil && netns != 0 && netns == r.netns
+}
+
+// routeLocked returns the index of the output interface for packets sent from
+// src to dst, or zero if it can't be determined.
+func (r *interfaceResolver) routeLocked(src, dst net.IP) int {
+	key := src.String() + "|" + dst.String()
+	now := r.clock()
+	entry, found := r.routes[key]
+	if !found || now.After(entry.expires) {
+		ifindex, err := r.lookupRoute(src, dst)
+		if err != nil {
+			ifindex = 0
+		}
+		if len(r.routes) >= routeCacheSize {
+			r.routes = make(map[string]routeEntry)
+		}
+		entry = routeEntry{ifindex: ifindex, expires: now.Add(routeCacheTTL)}
+		r.routes[key] = entry
+	}
+	return entry.ifindex
+}
+
+// Invalidate discards the cached interface names, MTUs and routes. Called
+// when interfaces change, so that renamed interfaces are reported correctly.
+func (r *interfaceResolver) Invalidate() {
+	r.Lock()
+	defer r.Unlock()
+	r.names = nil
+	r.mtus = make(map[int]int)
+	r.routes = make(map[string]routeEntry)
+}
+
+func (r *interfaceResolver) refreshLocked() {
+	names, err := r.listInterfaces()
+	if err != nil {
+		names = map[int]string{}
+	}
+	r.names = names
+}
+
+// MonitorLinks invalidates the resolver every time a network interface is
+// added, removed or modified, until done is closed.
+func (r *interfaceResolver) MonitorLinks(done <-chan struct{}, log helper.Logger) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		log.Warnf("Unable to monitor network interface changes: %v", err)
+		return
+	}
+	defer unix.Close(fd)
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: unix.RTMGRP_LINK}); err != nil {
+		log.Warnf("Unable to monitor network interface changes: %v", err)
+		return
+	}
+	// Wake up periodically to check for termination.
+	timeout := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		log.Warnf("Unable to monitor network interface changes: %v", err)
+		return
+	}
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+			log.Warnf("Stopped monitoring network interface changes: %v", err)
+			return
+		}
+		if n > 0 {
+			r.Invalidate()
+		}
+	}
+}
+
+// listInterfaces returns the names of the network interfaces by index.
+func listInterfaces() (map[int]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int]string, len(ifaces))
+	for _, iface := range ifaces {
+		names[iface.Index] = iface.Name
+	}
+	return names, nil
+}
+
+// interfaceMTU returns the MTU of the network interface with the given index.
+func interfaceMTU(ifindex int) (int, error) {
+	iface, err := net.InterfaceByIndex(ifindex)
+	if err != nil {
+		return 0, err
+	}
+	return iface.MTU, nil
+}
+
+// routeGetInterface returns the output interface index for packets sent from
+// src to dst, the same as `ip route get <dst> from <src>`.
+func routeGetInterface(src, dst net.IP) (ifindex int, err error) {
+	family := unix.AF_INET6
+	if dst4, src4 := dst.To4(), src.To4(); dst4 != nil && src4 != nil {
+		family, dst, src = unix.AF_INET, dst4, src4
+	} else {
+		dst, src = dst.To16(), src.To16()
+	}
+	if dst == nil || src == nil {
+		return 0, errors.New("invalid address")
+	}
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return 0, err
+	}
+	if err = unix.Sendto(fd, newRouteGetRequest(family, src, dst), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, unix.Getpagesize())
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return 0, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return 0, err
+	}
+	for idx := range msgs {
+		msg := &msgs[idx]
+		switch msg.Header.Type {
+		case unix.NLMSG_ERROR:
+			if len(msg.Data) >= 4 {
+				if errno := int32(tracing.MachineEndian.Uint32(msg.Data)); errno != 0 {
+					return 0, syscall.Errno(-errno)
+				}
+			}
+		case unix.RTM_NEWROUTE:
+			attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+			if err != nil {
+				return 0, err
+			}
+			for _, attr := range attrs {
+				if attr.Attr.Type == unix.RTA_OIF && len(attr.Value) >= 4 {
+					return int(tracing.MachineEndian.Uint32(attr.Value)), nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("no output interface in route to %s", dst)
+}
+
+// newRouteGetRequest builds an RTM_GETROUTE netlink request.
+func newRouteGetRequest(family int, src, dst net.IP) []byte {
+	addrAttrLen := unix.SizeofRtAttr + len(dst)
+	size := unix.NLMSG_HDRLEN + unix.SizeofRtMsg + 2*rtaAlign(addrAttrLen)
+	msg := make([]byte, size)
+	order := tracing.MachineEndian
+	// struct nlmsghdr
+	order.PutUint32(msg[0:], uint32(size))
+	order.PutUint16(msg[4:], unix.RTM_GETROUTE)
+	order.PutUint16(msg[6:], unix.NLM_F_REQUEST)
+	order.PutUint32(msg[8:], 1) // sequence number
+	// struct rtmsg
+	rtm := msg[unix.NLMSG_HDRLEN:]
+	rtm[0] = byte(family)
+	rtm[1] = byte(len(dst) * 8) // rtm_dst_len
+	rtm[2] = byte(len(src) * 8) // rtm_src_len
+	// route attributes
+	off := unix.NLMSG_HDRLEN + unix.SizeofRtMsg
+	for _, attr := range []struct {
+		typ  uint16
+		addr net.IP
+	}{
+		{unix.RTA_DST, dst},
+		{unix.RTA_SRC, src},
+	} {
+		order.PutUint16(msg[off:], uint16(addrAttrLen))
+		order.PutUint16(msg[off+2:], attr.typ)
+		copy(msg[off+unix.SizeofRtAttr:], attr.addr)
+		off += rtaAlign(addrAttrLen)
+	}
+	return msg
+}
+
+func rtaAlign(n int) int {
+	return (n + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+}
@@ -0,0 +1,79 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterfaceResolver(t *testing.T) {
+	now := time.Now()
+	routes := map[string]int{
+		"10.0.0.1":  2,
+		"127.0.0.1": 1,
+	}
+	names := map[int]string{1: "lo", 2: "eth0"}
+	var numRoutes, numLists int
+	const netns = 4026531992
+	r := newInterfaceResolver()
+	r.netns = netns
+	r.clock = func() time.Time {
+		return now
+	}
+	r.lookupRoute = func(src, dst net.IP) (int, error) {
+		numRoutes++
+		if ifindex, found := routes[dst.String()]; found {
+			return ifindex, nil
+		}
+		return 0, errors.New("network is unreachable")
+	}
+	r.listInterfaces = func() (map[int]string, error) {
+		numLists++
+		copied := make(map[int]string, len(names))
+		for k, v := range names {
+			copied[k] = v
+		}
+		return copied, nil
+	}
+	local := net.ParseIP("192.168.33.10")
+
+	assert.Equal(t, "eth0", r.Lookup(netns, local, net.ParseIP("10.0.0.1")))
+	assert.Equal(t, "lo", r.Lookup(netns, local, net.ParseIP("127.0.0.1")))
+	assert.Equal(t, "", r.Lookup(netns, local, net.ParseIP("172.16.0.1")))
+	assert.Equal(t, "", r.Lookup(netns, nil, net.ParseIP("10.0.0.1")))
+
+	// Flows in other or unknown network namespaces.
+	assert.Equal(t, "", r.Lookup(4026532281, local, net.ParseIP("10.0.0.1")))
+	assert.Equal(t, "", r.Lookup(0, local, net.ParseIP("10.0.0.1")))
+
+	// Cached lookups.
+	assert.Equal(t, "eth0", r.Lookup(netns, local, net.ParseIP("10.0.0.1")))
+	assert.Equal(t, 3, numRoutes)
+	assert.Equal(t, 1, numLists)
+
+	// Routes expire.
+	routes["10.0.0.1"] = 1
+	now = now.Add(routeCacheTTL + time.Second)
+	assert.Equal(t, "lo", r.Lookup(netns, local, net.ParseIP("10.0.0.1")))
+	assert.Equal(t, 4, numRoutes)
+
+	// Renamed interface.
+	names[1] = "loopback"
+	assert.Equal(t, "lo", r.Lookup(netns, local, net.ParseIP("10.0.0.1")))
+	r.Invalidate()
+	assert.Equal(t, "loopback", r.Lookup(netns, local, net.ParseIP("10.0.0.1")))
+	assert.Equal(t, 2, numLists)
+
+	// Disabled.
+	var disabled *interfaceResolver
+	assert.Equal(t, "", disabled.Lookup(netns, local, net.ParseIP("10.0.0.1")))
+}
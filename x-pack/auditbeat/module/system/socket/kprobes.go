@@ -7,8 +7,10 @@
 package socket
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"unsafe"
 
@@ -91,6 +93,101 @@ func (p *probeInstaller) UninstallIf(condition helper.ProbeCondition) error {
 	return errs.Err()
 }
 
+// sharedProbeInstaller attaches to the probes of a group installed by another
+// process instead of installing them. The probes are looked up by name, and
+// their format is validated against the expected probe definition. They're
+// never uninstalled, as they're owned by the other process.
+type sharedProbeInstaller struct {
+	traceFS    *tracing.TraceFS
+	group      string
+	transforms []ProbeTransform
+	// probes of the shared group, by name. Loaded on the first install.
+	probes map[string]tracing.Probe
+}
+
+func newSharedProbeInstaller(tfs *tracing.TraceFS, group string, transforms ...ProbeTransform) helper.ProbeInstaller {
+	return &sharedProbeInstaller{
+		traceFS:    tfs,
+		group:      group,
+		transforms: transforms,
+	}
+}
+
+// Install attaches to the given probe in the shared group.
+func (p *sharedProbeInstaller) Install(pdef helper.ProbeDef) (format tracing.ProbeFormat, decoder tracing.Decoder, err error) {
+	for _, d := range p.transforms {
+		pdef = d(pdef)
+	}
+	if pdef.Decoder == nil {
+		return format, decoder, errors.New("nil decoder in probe definition")
+	}
+	if p.probes == nil {
+		kprobes, err := p.traceFS.ListKProbes()
+		if err != nil {
+			return format, decoder, fmt.Errorf("failed to list installed kprobes: %w", err)
+		}
+		p.probes = make(map[string]tracing.Probe)
+		for _, probe := range kprobes {
+			if probe.Group == p.group {
+				p.probes[probe.Name] = probe
+			}
+		}
+	}
+	installed, found := p.probes[pdef.Probe.Name]
+	if !found {
+		return format, decoder, fmt.Errorf("probe '%s' not found in shared group %s", pdef.Probe.Name, p.group)
+	}
+	if format, err = p.traceFS.LoadProbeFormat(installed); err != nil {
+		return format, decoder, fmt.Errorf("failed to load probe format: %w", err)
+	}
+	if err = checkSharedProbe(pdef.Probe, format); err != nil {
+		return format, decoder, fmt.Errorf("probe '%s' in shared group %s doesn't match: %w", pdef.Probe.Name, p.group, err)
+	}
+	if decoder, err = pdef.Decoder(format); err != nil {
+		return format, decoder, fmt.Errorf("failed to create decoder: %w", err)
+	}
+	return format, decoder, nil
+}
+
+// UninstallInstalled does nothing, as shared probes are owned by another
+// process.
+func (p *sharedProbeInstaller) UninstallInstalled() error {
+	return nil
+}
+
+// UninstallIf does nothing, as shared probes are owned by another process.
+func (p *sharedProbeInstaller) UninstallIf(helper.ProbeCondition) error {
+	return nil
+}
+
+// checkSharedProbe checks that a probe installed by another process is
+// installed on the same function as the expected one, and has all the fields
+// that it fetches.
+func checkSharedProbe(expected tracing.Probe, installed tracing.ProbeFormat) error {
+	if installed.Probe.Type != expected.Type {
+		return errors.New("probe type doesn't match")
+	}
+	if installed.Probe.Address != expected.Address {
+		return fmt.Errorf("installed on %s instead of %s", installed.Probe.Address, expected.Address)
+	}
+	for _, name := range fetchargNames(expected.Fetchargs) {
+		if _, found := installed.Fields[name]; !found {
+			return fmt.Errorf("field %s is missing", name)
+		}
+	}
+	return nil
+}
+
+// fetchargNames returns the names of the fields fetched by a probe.
+func fetchargNames(fetchargs string) (names []string) {
+	for _, arg := range strings.Fields(fetchargs) {
+		if idx := strings.IndexByte(arg, '='); idx > 0 {
+			names = append(names, arg[:idx])
+		}
+	}
+	return names
+}
+
 // WithGroup sets a custom group to probes before they are installed.
 func WithGroup(name string) ProbeTransform {
 	return func(probe helper.ProbeDef) helper.ProbeDef {
@@ -113,6 +210,30 @@ func WithNoOp() ProbeTransform {
 	}
 }
 
+// WithSocketInode fetches the inode number of the socket in sock_init_data,
+// once its offset has been guessed. It must be applied before the templates,
+// as the installer is created before the guesses are run.
+func WithSocketInode(vars mapstr.M) ProbeTransform {
+	return func(probe helper.ProbeDef) helper.ProbeDef {
+		if probe.Probe.Name == "sock_init_data" && hasAllVars(vars, []string{"SOCKET_INODE_INO"}) {
+			probe.Probe.Fetchargs += " ino=+{{.SOCKET_INODE_INO}}({{.P1}})"
+		}
+		return probe
+	}
+}
+
+// WithConnectError fetches the pending error of the sock in tcp_done, once
+// the offset of sk_err has been guessed. It must be applied before the
+// templates, as the installer is created before the guesses are run.
+func WithConnectError(vars mapstr.M) ProbeTransform {
+	return func(probe helper.ProbeDef) helper.ProbeDef {
+		if probe.Probe.Name == "tcp_done_call" && hasAllVars(vars, []string{"SOCK_ERR"}) {
+			probe.Probe.Fetchargs += " err=+{{.SOCK_ERR}}({{.P1}}):s32"
+		}
+		return probe
+	}
+}
+
 // WithFilterPort is used for filtering port 22 traffic when debugging over
 // an SSH connection. Otherwise there is a feedback loop when tracing events
 // printed on the terminal are transmitted over SSH, which causes more tracing
@@ -134,6 +255,71 @@ func WithFilterPort(portnum uint16) ProbeTransform {
 	}
 }
 
+// WithExcludePorts filters out, in the kernel, the events for the given local
+// or remote ports. It only applies to probes that fetch ports from the sock
+// or from connect arguments. The remote port of UDP sendmsg probes is not
+// filtered, as it's only valid for unconnected sockets.
+func WithExcludePorts(ports []uint16) ProbeTransform {
+	return func(probe helper.ProbeDef) helper.ProbeDef {
+		var conds []string
+		for _, field := range []string{"lport", "rport", "port"} {
+			if !hasFetcharg(probe.Probe.Fetchargs, field) ||
+				(field == "rport" && hasFetcharg(probe.Probe.Fetchargs, "altrport")) {
+				continue
+			}
+			for _, port := range ports {
+				var buf [2]byte
+				binary.BigEndian.PutUint16(buf[:], port)
+				conds = append(conds, fmt.Sprintf("%s!=0x%x", field, tracing.MachineEndian.Uint16(buf[:])))
+			}
+		}
+		if len(conds) == 0 {
+			return probe
+		}
+		filter := strings.Join(conds, " && ")
+		if probe.Probe.Filter == "" {
+			probe.Probe.Filter = filter
+		} else {
+			probe.Probe.Filter = fmt.Sprintf("%s && (%s)", filter, probe.Probe.Filter)
+		}
+		return probe
+	}
+}
+
+// WithExcludeRemoteAddrs filters out, in the kernel, the events for the given
+// remote IPv4 addresses. It only applies to probes that fetch the IPv4 remote
+// address from the sock or from connect arguments. As with ports, the remote
+// address of UDP sendmsg probes is not filtered.
+func WithExcludeRemoteAddrs(addrs []net.IP) ProbeTransform {
+	return func(probe helper.ProbeDef) helper.ProbeDef {
+		var conds []string
+		for _, field := range []string{"raddr", "addr"} {
+			if !hasFetcharg(probe.Probe.Fetchargs, field) ||
+				(field == "raddr" && hasFetcharg(probe.Probe.Fetchargs, "altraddr")) {
+				continue
+			}
+			for _, addr := range addrs {
+				conds = append(conds, fmt.Sprintf("%s!=0x%x", field, tracing.MachineEndian.Uint32(addr.To4())))
+			}
+		}
+		if len(conds) == 0 {
+			return probe
+		}
+		filter := strings.Join(conds, " && ")
+		if probe.Probe.Filter == "" {
+			probe.Probe.Filter = filter
+		} else {
+			probe.Probe.Filter = fmt.Sprintf("%s && (%s)", filter, probe.Probe.Filter)
+		}
+		return probe
+	}
+}
+
+// hasFetcharg returns if the fetchargs define the given field.
+func hasFetcharg(fetchargs, name string) bool {
+	return strings.HasPrefix(fetchargs, name+"=") || strings.Contains(fetchargs, " "+name+"=")
+}
+
 // KProbes shared with IPv4 and IPv6.
 var sharedKProbes = []helper.ProbeDef{
 	//***************************************************************************
@@ -194,7 +380,7 @@ var sharedKProbes = []helper.ProbeDef{
 		Decoder: helper.NewStructDecoder(func() interface{} { return new(forkRet) }),
 	},
 	/***************************************************************************
-	 * IPv4
+	 * IPv4 and IPv6 sockets
 	 **************************************************************************/
 
 	{
@@ -206,31 +392,51 @@ var sharedKProbes = []helper.ProbeDef{
 		Decoder: helper.NewStructDecoder(func() interface{} { return new(sockInitData) }),
 	},
 
+	// TCP/UDP socket released. inet6_release also calls it for IPv6 sockets.
+	// Good for associating sockets with pids.
+	{
+		Probe: tracing.Probe{
+			Name:      "inet_release",
+			Address:   "inet_release",
+			Fetchargs: "sock=+{{.SOCKET_SOCK}}({{.P1}})",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(inetReleaseCall) }),
+	},
+
+	/***************************************************************************
+	 * Clock Sync
+	 **************************************************************************/
+
+	/* This probe is used as a clock synchronization signal
+	 */
+	{
+		Probe: tracing.Probe{
+			Name:      "clock_sync_probe",
+			Address:   "{{.SYS_UNAME}}",
+			Fetchargs: "magic=+0({{.SYS_P1}}):u64 timestamp=+8({{.SYS_P1}}):u64",
+			Filter:    fmt.Sprintf("magic==0x%x", clockSyncMagic),
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(clockSyncCall) }),
+	},
+}
+
+// KProbes for IPv4 sockets. They're skipped in IPv6-only mode.
+var ipv4KProbes = []helper.ProbeDef{
 	// IPv4/TCP/UDP socket created. Good for associating sockets with pids.
 	// ** This is a struct socket* not a struct sock* **
 	//
-	//  " inet_create(socket=0xffff9f1ddadb8080, proto=17) "
+	//  " inet_create(proto=17, type=2) "
 	{
 		Probe: tracing.Probe{
 			Name:      "inet_create",
 			Address:   "inet_create",
-			Fetchargs: "proto={{.P3}}:s32",
+			Fetchargs: "proto={{.P3}}:s32 type=+{{.SOCKET_TYPE}}({{.P2}}):s16",
 			// proto=0 will select the protocol by looking at socket type (STREAM|DGRAM)
 			Filter: "proto==0 || proto=={{.IPPROTO_TCP}} || proto=={{.IPPROTO_UDP}}",
 		},
 		Decoder: helper.NewStructDecoder(func() interface{} { return new(inetCreate) }),
 	},
 
-	// IPv4/TCP/UDP socket released. Good for associating sockets with pids.
-	{
-		Probe: tracing.Probe{
-			Name:      "inet_release",
-			Address:   "inet_release",
-			Fetchargs: "sock=+{{.SOCKET_SOCK}}({{.P1}})",
-		},
-		Decoder: helper.NewStructDecoder(func() interface{} { return new(inetReleaseCall) }),
-	},
-
 	/***************************************************************************
 	 * IPv4 / TCP
 	 **************************************************************************/
@@ -314,26 +520,24 @@ var sharedKProbes = []helper.ProbeDef{
 		},
 		Decoder: helper.NewStructDecoder(func() interface{} { return new(udpQueueRcvSkb) }),
 	},
+}
 
-	/***************************************************************************
-	 * Clock Sync
-	 **************************************************************************/
-
-	/* This probe is used as a clock synchronization signal
-	 */
+// KProbes used only when IPv6 is disabled.
+var ipv4OnlyKProbes = []helper.ProbeDef{
+	// Call to accept(). Captures the address the listening socket is bound
+	// to, which can be a wildcard address.
+	//
+	//  " accept(listen=0xffff9f1ddc5eb000, 0.0.0.0:22) "
 	{
 		Probe: tracing.Probe{
-			Name:      "clock_sync_probe",
-			Address:   "{{.SYS_UNAME}}",
-			Fetchargs: "magic=+0({{.SYS_P1}}):u64 timestamp=+8({{.SYS_P1}}):u64",
-			Filter:    fmt.Sprintf("magic==0x%x", clockSyncMagic),
+			Name:      "inet_csk_accept_call4",
+			Address:   "inet_csk_accept",
+			Fetchargs: "sock={{.P1}} laddr=+{{.INET_SOCK_LADDR}}({{.P1}}):u32 lport=+{{.INET_SOCK_LPORT}}({{.P1}}):u16 family=+{{.INET_SOCK_AF}}({{.P1}}):u16",
+			Filter:    "family=={{.AF_INET}}",
 		},
-		Decoder: helper.NewStructDecoder(func() interface{} { return new(clockSyncCall) }),
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpAcceptCall4) }),
 	},
-}
 
-// KProbes used only when IPv6 is disabled.
-var ipv4OnlyKProbes = []helper.ProbeDef{
 	// Return of accept(). Local side is usually zero so not fetched. Needs
 	// further I/O to populate source.Good for marking a connection as inbound.
 	//
@@ -377,16 +581,16 @@ var ipv6KProbes = []helper.ProbeDef{
 	//
 	// inet6_create() is handled the same as inet_create()
 	//
-	//  " inet_create(socket=0xffff9f1ddadb8080, proto=17) "
+	//  " inet6_create(proto=17, type=2) "
 	{
 		Probe: tracing.Probe{
 			Name:      "inet6_create",
 			Address:   "inet6_create",
-			Fetchargs: "proto={{.P3}}:s32",
+			Fetchargs: "proto={{.P3}}:s32 type=+{{.SOCKET_TYPE}}({{.P2}}):s16",
 			// proto=0 will select the protocol by looking at socket type (STREAM|DGRAM)
 			Filter: "proto==0 || proto=={{.IPPROTO_TCP}} || proto=={{.IPPROTO_UDP}}",
 		},
-		Decoder: helper.NewStructDecoder(func() interface{} { return new(inetCreate) }),
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(inet6Create) }),
 	},
 
 	/***************************************************************************
@@ -497,6 +701,22 @@ var ipv6KProbes = []helper.ProbeDef{
 		Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpSendMsgCall) }),
 	},
 
+	// Call to accept(). Captures the address the listening socket is bound
+	// to, which can be a wildcard address. A wildcard IPv6 listener also
+	// accepts IPv4 connections.
+	//
+	//  " accept(listen=0xffff9f1ddc5eb000, [::]:22) "
+	{
+		Probe: tracing.Probe{
+			Name:    "inet_csk_accept_call",
+			Address: "inet_csk_accept",
+			Fetchargs: "sock={{.P1}} laddr=+{{.INET_SOCK_LADDR}}({{.P1}}):u32 lport=+{{.INET_SOCK_LPORT}}({{.P1}}):u16 " +
+				"family=+{{.INET_SOCK_AF}}({{.P1}}):u16 laddr6a={{.INET_SOCK_V6_LADDR_A}}({{.P1}}){{.INET_SOCK_V6_TERM}} laddr6b={{.INET_SOCK_V6_LADDR_B}}({{.P1}}){{.INET_SOCK_V6_TERM}}",
+			Filter: "family=={{.AF_INET}} || family=={{.AF_INET6}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpAcceptCall) }),
+	},
+
 	// Return of accept(). Local side is usually zero so not fetched. Needs
 	// further I/O to populate source.Good for marking a connection as inbound.
 	//
@@ -514,8 +734,592 @@ var ipv6KProbes = []helper.ProbeDef{
 	},
 }
 
-func getKProbes(hasIPv6 bool) (list []helper.ProbeDef) {
+// KProbes for SCTP associations, used when socket.enable_sctp is set. SCTP is
+// usually built as a kernel module, so each probe is only installed when its
+// function is available for tracing.
+var sctpKProbes = []helper.ProbeDef{
+	// Result of SCTP connect:
+	//
+	//  " <- sctp_connect ok (retval==0 or retval==-ERRNO) "
+	{
+		Probe: tracing.Probe{
+			Type:      tracing.TypeKRetProbe,
+			Name:      "sctp_connect_out",
+			Address:   "sctp_connect",
+			Fetchargs: "retval={{.RET}}:s32",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(sctpConnectResult) }),
+	},
+}
+
+// SCTP KProbes for IPv4 sockets. They're skipped in IPv6-only mode.
+var sctpIPv4KProbes = []helper.ProbeDef{
+	// An SCTP association is initiated with connect().
+	//
+	//  " sctp_connect(sock=0xffff9f1ddd216040, 0.0.0.0:0 -> 10.0.2.20:38412) "
+	{
+		Probe: tracing.Probe{
+			Name:      "sctp4_connect_in",
+			Address:   "sctp_connect",
+			Fetchargs: "sock={{.P1}} laddr=+{{.INET_SOCK_LADDR}}({{.P1}}):u32 lport=+{{.INET_SOCK_LPORT}}({{.P1}}):u16 af=+{{.SOCKADDR_IN_AF}}({{.P2}}):u16 addr=+{{.SOCKADDR_IN_ADDR}}({{.P2}}):u32 port=+{{.SOCKADDR_IN_PORT}}({{.P2}}):u16",
+			Filter:    "af=={{.AF_INET}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(sctpIPv4ConnectCall) }),
+	},
+}
+
+// SCTP KProbes used only when IPv6 is disabled.
+var sctpIPv4OnlyKProbes = []helper.ProbeDef{
+	// Return of accept() on an SCTP socket. Returns the sock for the
+	// accepted association.
+	//
+	//  " <- sctp_accept(sock=0xffff9f1ddc5eb780, 10.0.2.15:38412 <- 10.0.2.20:41234) "
+	{
+		Probe: tracing.Probe{
+			Type:    tracing.TypeKRetProbe,
+			Name:    "sctp_accept_ret4",
+			Address: "sctp_accept",
+			Fetchargs: "sock={{.RET}} laddr=+{{.INET_SOCK_LADDR}}({{.RET}}):u32 lport=+{{.INET_SOCK_LPORT}}({{.RET}}):u16 raddr=+{{.INET_SOCK_RADDR}}({{.RET}}):u32 rport=+{{.INET_SOCK_RPORT}}({{.RET}}):u16 " +
+				"family=+{{.INET_SOCK_AF}}({{.RET}}):u16",
+			Filter: "family=={{.AF_INET}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(sctpAcceptResult4) }),
+	},
+}
+
+// SCTP KProbes used when IPv6 is enabled.
+var sctpIPv6KProbes = []helper.ProbeDef{
+	// An SCTP association is initiated with connect() on an IPv6 socket.
+	//
+	//  " sctp_connect6(sock=0xffff9f1ddd216040, [::]:0 -> [fd00::20]:38412) "
+	{
+		Probe: tracing.Probe{
+			Name:      "sctp6_connect_in",
+			Address:   "sctp_connect",
+			Fetchargs: "sock={{.P1}} laddra={{.INET_SOCK_V6_LADDR_A}}({{.P1}}){{.INET_SOCK_V6_TERM}} laddrb={{.INET_SOCK_V6_LADDR_B}}({{.P1}}){{.INET_SOCK_V6_TERM}} lport=+{{.INET_SOCK_LPORT}}({{.P1}}):u16 af=+{{.SOCKADDR_IN6_AF}}({{.P2}}):u16 addra=+{{.SOCKADDR_IN6_ADDRA}}({{.P2}}):u64 addrb=+{{.SOCKADDR_IN6_ADDRB}}({{.P2}}):u64 port=+{{.SOCKADDR_IN6_PORT}}({{.P2}}):u16",
+			Filter:    "af=={{.AF_INET6}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(sctpIPv6ConnectCall) }),
+	},
+
+	// Return of accept() on an SCTP socket, IPv4 or IPv6.
+	//
+	//  " <- sctp_accept(sock=0xffff9f1ddc5eb780, [fd00::15]:38412 <- [fd00::20]:41234) "
+	{
+		Probe: tracing.Probe{
+			Type:    tracing.TypeKRetProbe,
+			Name:    "sctp_accept_ret",
+			Address: "sctp_accept",
+			Fetchargs: "sock={{.RET}} laddr=+{{.INET_SOCK_LADDR}}({{.RET}}):u32 lport=+{{.INET_SOCK_LPORT}}({{.RET}}):u16 raddr=+{{.INET_SOCK_RADDR}}({{.RET}}):u32 rport=+{{.INET_SOCK_RPORT}}({{.RET}}):u16 " +
+				"family=+{{.INET_SOCK_AF}}({{.RET}}):u16 laddr6a={{.INET_SOCK_V6_LADDR_A}}({{.RET}}){{.INET_SOCK_V6_TERM}} laddr6b={{.INET_SOCK_V6_LADDR_B}}({{.RET}}){{.INET_SOCK_V6_TERM}} raddr6a={{.INET_SOCK_V6_RADDR_A}}({{.RET}}){{.INET_SOCK_V6_TERM}} raddr6b={{.INET_SOCK_V6_RADDR_B}}({{.RET}}){{.INET_SOCK_V6_TERM}}",
+			Filter: "family=={{.AF_INET}} || family=={{.AF_INET6}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(sctpAcceptResult) }),
+	},
+}
+
+// KProbes used to capture the details of SCTP associations, installed when
+// socket.enable_sctp is set and the offsets within struct sctp_association
+// have been guessed. sctp_association_free is called when the association
+// terminates, after accept() has moved it to its own sock, and fetches the
+// verification tags, the streams negotiated and the local endpoint once it's
+// bound.
+var sctpAssocKProbes = []helper.ProbeDef{
+	// An SCTP association is freed.
+	//
+	//  " sctp_association_free(sock=0xffff9f1ddd216040, vtag=0x1f2e3d4c/0x5a6b7c8d, streams=10/10, local=10.0.2.15:41234) "
+	{
+		Probe: tracing.Probe{
+			Name:    "sctp_association_free",
+			Address: "sctp_association_free",
+			Fetchargs: "sock=+{{.SCTP_ASSOC_SK}}({{.P1}}) my_vtag=+{{.SCTP_ASSOC_VTAG}}({{.P1}}):u32 peer_vtag=+{{.SCTP_ASSOC_PEER_VTAG}}({{.P1}}):u32 " +
+				"ostreams=+{{.SCTP_ASSOC_OSTREAMS}}({{.P1}}):u16 istreams=+{{.SCTP_ASSOC_ISTREAMS}}({{.P1}}):u16 " +
+				"laddr=+{{.INET_SOCK_LADDR}}(+{{.SCTP_ASSOC_SK}}({{.P1}})):u32 lport=+{{.INET_SOCK_LPORT}}(+{{.SCTP_ASSOC_SK}}({{.P1}})):u16",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(sctpAssociationFree) }),
+	},
+}
+
+// Variables required by sctpAssocKProbes, provided by guess_sctp_association.
+var sctpAssocVars = []string{
+	"SCTP_ASSOC_SK",
+	"SCTP_ASSOC_VTAG",
+	"SCTP_ASSOC_PEER_VTAG",
+	"SCTP_ASSOC_OSTREAMS",
+	"SCTP_ASSOC_ISTREAMS",
+}
+
+// KProbes used to detect when outgoing TCP connections are established,
+// installed when socket.report_on_establish is set. Incoming connections are
+// established when accepted.
+var establishKProbes = []helper.ProbeDef{
+	// The handshake of an outgoing connection completes.
+	//
+	//  " tcp_finish_connect(sock=0xffff9f1ddc5eb780) "
+	{
+		Probe: tracing.Probe{
+			Name:      "tcp_finish_connect_call",
+			Address:   "tcp_finish_connect",
+			Fetchargs: "sock={{.P1}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpFinishConnect) }),
+	},
+}
+
+// KProbes used to detect port scans, installed when socket.detect_port_scans
+// is set. tcp_v4_conn_request and tcp_v6_conn_request are called with the
+// listening sock for each SYN received for a local port with a listener,
+// including when the SYN is dropped because the accept queue is full. The
+// addresses and ports are read from the headers of the SYN.
+var portScanKProbes = []helper.ProbeDef{
+	// An IPv4 SYN is received.
+	//
+	//  " tcp_v4_conn_request(sock=0xffff9f1ddc5eb000, 192.168.33.10:22 <- 10.0.0.66:51234) "
+	{
+		Probe: tracing.Probe{
+			Name:      "tcp_v4_conn_request_call",
+			Address:   "tcp_v4_conn_request",
+			Fetchargs: "sock={{.P1}} iphdr=+{{.SK_BUFF_NETWORK}}({{.P2}}):u16 tcphdr=+{{.SK_BUFF_TRANSPORT}}({{.P2}}):u16 base=+{{.SK_BUFF_HEAD}}({{.P2}}) packet=" + helper.MakeMemoryDump("+{{.SK_BUFF_HEAD}}({{.P2}})", 0, skBuffDataDumpBytes),
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpV4ConnRequest) }),
+	},
+}
+
+// KProbes used to detect port scans over IPv6, installed along with
+// portScanKProbes when IPv6 is enabled.
+var portScanIPv6KProbes = []helper.ProbeDef{
+	// An IPv6 SYN is received.
+	//
+	//  " tcp_v6_conn_request(sock=0xffff9f1ddc5eb000, [fd00::10]:22 <- [fd00::66]:51234) "
+	{
+		Probe: tracing.Probe{
+			Name:      "tcp_v6_conn_request_call",
+			Address:   "tcp_v6_conn_request",
+			Fetchargs: "sock={{.P1}} iphdr=+{{.SK_BUFF_NETWORK}}({{.P2}}):u16 tcphdr=+{{.SK_BUFF_TRANSPORT}}({{.P2}}):u16 base=+{{.SK_BUFF_HEAD}}({{.P2}}) packet=" + helper.MakeMemoryDump("+{{.SK_BUFF_HEAD}}({{.P2}})", 0, skBuffDataDumpBytes),
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpV6ConnRequest) }),
+	},
+}
+
+// KProbes used to track zero-window episodes, installed when
+// socket.track_zero_window is set. tcp_send_probe0 is called every time a
+// zero-window probe is sent, which happens while the peer advertises a zero
+// receive window.
+var zeroWindowKProbes = []helper.ProbeDef{
+	// A zero-window probe is sent.
+	//
+	//  " tcp_send_probe0(sock=0xffff9f1ddc5eb780) "
+	{
+		Probe: tracing.Probe{
+			Name:      "tcp_send_probe0_call",
+			Address:   "tcp_send_probe0",
+			Fetchargs: "sock={{.P1}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpZeroWindowProbe) }),
+	},
+}
+
+// KProbes used to detect TCP urgent data, installed when
+// socket.track_urgent_data is set. sk_send_sigurg is called by the TCP input
+// path when a segment carries a new urgent pointer, before the owner of the
+// socket is sent SIGURG, if any.
+var urgentDataKProbes = []helper.ProbeDef{
+	// Urgent data is received.
+	//
+	//  " sk_send_sigurg(sock=0xffff9f1ddc5eb780) "
+	{
+		Probe: tracing.Probe{
+			Name:      "sk_send_sigurg_call",
+			Address:   "sk_send_sigurg",
+			Fetchargs: "sock={{.P1}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpUrgentData) }),
+	},
+}
+
+// KProbes used to record the process that listens on a TCP socket, installed
+// when socket.infer_listener_process is set. The struct sock* is taken from
+// the struct socket* argument, and the address it's bound to is fetched like
+// in the accept probes. Sockets that are listened on without being bound
+// first have no port yet.
+var inetListenKProbes = []helper.ProbeDef{
+	// Call to listen().
+	//
+	//  " listen(sock=0xffff9f1ddc5eb000, [::]:22) "
+	{
+		Probe: tracing.Probe{
+			Name:    "inet_listen_call",
+			Address: "inet_listen",
+			Fetchargs: "sock=+{{.SOCKET_SOCK}}({{.P1}}) laddr=+{{.INET_SOCK_LADDR}}(+{{.SOCKET_SOCK}}({{.P1}})):u32 " +
+				"lport=+{{.INET_SOCK_LPORT}}(+{{.SOCKET_SOCK}}({{.P1}})):u16 family=+{{.INET_SOCK_AF}}(+{{.SOCKET_SOCK}}({{.P1}})):u16 " +
+				"laddr6a={{.INET_SOCK_V6_LADDR_A}}(+{{.SOCKET_SOCK}}({{.P1}})){{.INET_SOCK_V6_TERM}} " +
+				"laddr6b={{.INET_SOCK_V6_LADDR_B}}(+{{.SOCKET_SOCK}}({{.P1}})){{.INET_SOCK_V6_TERM}}",
+			Filter: "family=={{.AF_INET}} || family=={{.AF_INET6}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(inetListenCall) }),
+	},
+}
+
+// inetListenIPv4KProbes replace inetListenKProbes when IPv6 is disabled.
+var inetListenIPv4KProbes = []helper.ProbeDef{
+	{
+		Probe: tracing.Probe{
+			Name:    "inet_listen_call4",
+			Address: "inet_listen",
+			Fetchargs: "sock=+{{.SOCKET_SOCK}}({{.P1}}) laddr=+{{.INET_SOCK_LADDR}}(+{{.SOCKET_SOCK}}({{.P1}})):u32 " +
+				"lport=+{{.INET_SOCK_LPORT}}(+{{.SOCKET_SOCK}}({{.P1}})):u16 family=+{{.INET_SOCK_AF}}(+{{.SOCKET_SOCK}}({{.P1}})):u16",
+			Filter: "family=={{.AF_INET}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(inetListenCall4) }),
+	},
+}
+
+// KProbes used to detect failed connection attempts, installed when
+// socket.report_connect_failures is set. tcp_done is called when a sock is
+// done, which happens in SYN_SENT when the connection attempt times out, is
+// reset or gets an ICMP error. The error is added by WithConnectError.
+var connectFailureKProbes = []helper.ProbeDef{
+	// A sock is done.
+	//
+	//  " tcp_done(sock=0xffff9f1ddc5eb780, state=2, err=110) "
+	{
+		Probe: tracing.Probe{
+			Name:      "tcp_done_call",
+			Address:   "tcp_done",
+			Fetchargs: "sock={{.P1}} state=+{{.SOCK_COMMON_STATE}}({{.P1}}):u8",
+			Filter:    fmt.Sprintf("state==%d", tcpStateSynSent),
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpDone) }),
+	},
+}
+
+// KProbes used to detect TCP resets, installed when socket.min_flow_bytes is
+// set so that flows ended by a reset are always reported, and when
+// socket.report_close_initiator is set. tcp_reset is called when a reset is
+// received, and tcp_send_active_reset when one is sent.
+var tcpResetKProbes = []helper.ProbeDef{
+	// A reset is received.
+	//
+	//  " tcp_reset(sock=0xffff9f1ddc5eb780) "
+	{
+		Probe: tracing.Probe{
+			Name:      "tcp_reset_call",
+			Address:   "tcp_reset",
+			Fetchargs: "sock={{.P1}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpReset) }),
+	},
+
+	// A reset is sent.
+	//
+	//  " tcp_send_active_reset(sock=0xffff9f1ddc5eb780) "
+	{
+		Probe: tracing.Probe{
+			Name:      "tcp_send_active_reset_call",
+			Address:   "tcp_send_active_reset",
+			Fetchargs: "sock={{.P1}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return &tcpReset{sent: true} }),
+	},
+}
+
+// KProbes used to tell which side initiated the close of TCP connections,
+// installed when socket.report_close_initiator is set. tcp_send_fin is called
+// when a FIN is sent and tcp_fin when one is received. The state of the sock
+// when a FIN is received tells a simultaneous close, where it's still in
+// FIN_WAIT1 because the peer sent its FIN before acknowledging ours.
+var closeInitiatorKProbes = []helper.ProbeDef{
+	// A FIN is sent.
+	//
+	//  " tcp_send_fin(sock=0xffff9f1ddc5eb780, state=4) "
+	{
+		Probe: tracing.Probe{
+			Name:      "tcp_send_fin_call",
+			Address:   "tcp_send_fin",
+			Fetchargs: "sock={{.P1}} state=+{{.SOCK_COMMON_STATE}}({{.P1}}):u8",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return &tcpFin{sent: true} }),
+	},
+
+	// A FIN is received.
+	//
+	//  " tcp_fin(sock=0xffff9f1ddc5eb780, state=1) "
+	{
+		Probe: tracing.Probe{
+			Name:      "tcp_fin_call",
+			Address:   "tcp_fin",
+			Fetchargs: "sock={{.P1}} state=+{{.SOCK_COMMON_STATE}}({{.P1}}):u8",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpFin) }),
+	},
+}
+
+// KProbes used to correlate the subflows of MPTCP connections, installed when
+// socket.enable_mptcp is set. Subflows are correlated by the token of their
+// MPTCP connection, whose offset in struct mptcp_sock is guessed.
+//
+// mptcp_event is called by the MPTCP path manager with the MPTCP socket and
+// one of its subflows when a connection is created and when subflows are
+// established, even when nobody listens to the netlink events. It's available
+// since Linux 5.12.
+//
+// __mptcp_close_ssk is called with the MPTCP socket and one of its subflows
+// each time a subflow is closed. It's used as a fallback on older kernels, as
+// it's static and often inlined in recent ones.
+var mptcpKProbes = []helper.ProbeDef{
+	// An MPTCP path manager event.
+	//
+	//  " mptcp_event(type=10, sock=0xffff9f1ddc5eb780, subflow=0xffff9f1ddc5e9a00, token=0x5c1a3e07) "
+	{
+		Probe: tracing.Probe{
+			Name:      "mptcp_event_call",
+			Address:   "mptcp_event",
+			Fetchargs: "type={{.P1}}:s32 sock={{.P2}} subflow={{.P3}} token=+{{.MPTCP_SOCK_TOKEN}}({{.P2}}):u32",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(mptcpEvent) }),
+	},
+
+	// A subflow of an MPTCP connection is closed.
+	//
+	//  " __mptcp_close_ssk(sock=0xffff9f1ddc5eb780, subflow=0xffff9f1ddc5e9a00, token=0x5c1a3e07) "
+	{
+		Probe: tracing.Probe{
+			Name:      "mptcp_close_ssk_call",
+			Address:   "__mptcp_close_ssk",
+			Fetchargs: "sock={{.P1}} subflow={{.P2}} token=+{{.MPTCP_SOCK_TOKEN}}({{.P1}}):u32",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(mptcpCloseSubflow) }),
+	},
+}
+
+// KProbes used to report the active IPv4 tunnels, installed when
+// socket.enable_tunnels is set. They're on the transmit and receive paths
+// shared by the ipip, gre and sit drivers, and only see the outer IPv4
+// header. The inner flows aren't reconstructed.
+var tunnelKProbes = []helper.ProbeDef{
+	// A packet is encapsulated by a tunnel. tnl_params is the outer IPv4
+	// header of the tunnel, and size is the length of the inner packet.
+	//
+	//  " ip_tunnel_xmit(10.0.0.1 -> 10.0.0.2, proto=47, size=84) "
+	{
+		Probe: tracing.Probe{
+			Name:      "ip_tunnel_xmit_call",
+			Address:   "ip_tunnel_xmit",
+			Fetchargs: "saddr=+12({{.P3}}):u32 daddr=+16({{.P3}}):u32 proto={{.P4}}:u8 size=+{{.SK_BUFF_LEN}}({{.P1}}):u32",
+			Filter:    "proto=={{.IPPROTO_IPIP}} || proto=={{.IPPROTO_IPV6}} || proto=={{.IPPROTO_GRE}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(ipTunnelXmit) }),
+	},
+
+	// A packet is decapsulated by a tunnel. The network header of the skb is
+	// still the outer IPv4 header, while its data is the inner packet.
+	//
+	//  " ip_tunnel_rcv(10.0.0.1 <- 10.0.0.2, proto=47, size=84) "
+	{
+		Probe: tracing.Probe{
+			Name:      "ip_tunnel_rcv_call",
+			Address:   "ip_tunnel_rcv",
+			Fetchargs: "size=+{{.SK_BUFF_LEN}}({{.P2}}):u32 iphdr=+{{.SK_BUFF_NETWORK}}({{.P2}}):u16 base=+{{.SK_BUFF_HEAD}}({{.P2}}) packet=" + helper.MakeMemoryDump("+{{.SK_BUFF_HEAD}}({{.P2}})", 0, skBuffDataDumpBytes),
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(ipTunnelRcv) }),
+	},
+}
+
+// KProbes used to report the activity of netlink sockets, installed when
+// socket.enable_netlink is set. The struct socket* identifies the socket, and
+// its netlink family is the protocol it was created with, so no offset has to
+// be guessed. Sockets created before the dataset started aren't tracked.
+var netlinkKProbes = []helper.ProbeDef{
+	// A process creates a netlink socket. Sockets created by the kernel
+	// don't go through netlink_create.
+	//
+	//  " netlink_create(sock=0xffff9f1ddadb8080, protocol=NETLINK_ROUTE) "
+	{
+		Probe: tracing.Probe{
+			Name:      "netlink_create_call",
+			Address:   "netlink_create",
+			Fetchargs: "sock={{.P2}} protocol={{.P3}}:s32",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(netlinkCreate) }),
+	},
+
+	// A message is sent on a netlink socket, with send, sendto, sendmsg or
+	// write.
+	//
+	//  " netlink_sendmsg(sock=0xffff9f1ddadb8080, size=36) "
+	{
+		Probe: tracing.Probe{
+			Name:      "netlink_sendmsg_call",
+			Address:   "netlink_sendmsg",
+			Fetchargs: "sock={{.P1}} size={{.P3}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(netlinkSendMsg) }),
+	},
+
+	// A netlink socket is closed.
+	//
+	//  " netlink_release(sock=0xffff9f1ddadb8080) "
+	{
+		Probe: tracing.Probe{
+			Name:      "netlink_release_call",
+			Address:   "netlink_release",
+			Fetchargs: "sock={{.P1}}",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(netlinkRelease) }),
+	},
+}
+
+// KProbes used to report the inode number of accepted sockets, which are
+// created without a call to sock_init_data. The struct sock is grafted to the
+// struct socket returned by accept, whose inode is already allocated.
+// security_sock_graft requires a kernel built with CONFIG_SECURITY_NETWORK.
+var socketInodeKProbes = []helper.ProbeDef{
+	//  " sock_graft(sock=0xffff9f1ddc5eb780, ino=734812) "
+	{
+		Probe: tracing.Probe{
+			Name:      "security_sock_graft_call",
+			Address:   "security_sock_graft",
+			Fetchargs: "sock={{.P1}} ino=+{{.SOCKET_INODE_INO}}({{.P2}})",
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return new(sockGraft) }),
+	},
+}
+
+// KProbes that depend on variables discovered by optional guesses or on
+// functions not present in all kernels. They are only installed when all the
+// required variables and the traced function are available.
+var optionalKProbes = []struct {
+	requires []string
+	probes   []helper.ProbeDef
+}{
+	{
+		probes: []helper.ProbeDef{
+			// A client sends data in the SYN, either with MSG_FASTOPEN or
+			// with the TCP_FASTOPEN_CONNECT socket option.
+			//
+			//  " tcp_fastopen(sock=0xffff9f1ddd216040) "
+			{
+				Probe: tracing.Probe{
+					Name:      "tcp_sendmsg_fastopen_call",
+					Address:   "tcp_sendmsg_fastopen",
+					Fetchargs: "sock={{.P1}}",
+				},
+				Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpFastOpen) }),
+			},
+
+			// A server accepts data in the SYN. Returns the child sock that
+			// will be returned by accept(), or NULL if Fast Open wasn't used.
+			//
+			//  " tcp_fastopen(sock=0xffff9f1ddc5eb780) "
+			{
+				Probe: tracing.Probe{
+					Type:      tracing.TypeKRetProbe,
+					Name:      "tcp_try_fastopen_ret",
+					Address:   "tcp_try_fastopen",
+					Fetchargs: "sock={{.RET}}",
+					Filter:    "sock!=0",
+				},
+				Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpFastOpen) }),
+			},
+		},
+	},
+	{
+		requires: []string{"TCP_SOCK_TSTAMP_OK"},
+		probes: []helper.ProbeDef{
+			// A TCP connection is established, either by connect() or by
+			// the handshake of a listening socket. The byte at
+			// TCP_SOCK_TSTAMP_OK holds the negotiated options.
+			//
+			//  " tcp_init_transfer(sock=0xffff9f1ddc5eb780, timestamps=true) "
+			{
+				Probe: tracing.Probe{
+					Name:      "tcp_init_transfer_call",
+					Address:   "tcp_init_transfer",
+					Fetchargs: "sock={{.P1}} rxopt=+{{.TCP_SOCK_TSTAMP_OK}}({{.P1}}):u8",
+				},
+				Decoder: helper.NewStructDecoder(func() interface{} { return new(tcpInitTransfer) }),
+			},
+		},
+	},
+}
+
+// Name of the probe that takes a snapshot of a TCP socket's state when it's
+// closed.
+const tcpCloseProbeName = "tcp_close_call"
+
+// Values fetched by the tcp_close probe when the offsets they require have
+// been guessed.
+var tcpCloseFetchargs = []struct {
+	field     tcpCloseFields
+	requires  []string
+	fetchargs string
+}{
+	// RTT estimator state at the end of the flow.
+	{
+		field:     tcpCloseRTT,
+		requires:  []string{"TCP_SOCK_SRTT", "INET_CSK_RTO"},
+		fetchargs: "srtt=+{{.TCP_SOCK_SRTT}}({{.P1}}):u32 rto=+{{.INET_CSK_RTO}}({{.P1}}):u32",
+	},
+	// Duplicate segments reported by the peer (tcp_sock.dsack_dups).
+	{
+		field:     tcpCloseDSACKDups,
+		requires:  []string{"TCP_SOCK_DSACK_DUPS"},
+		fetchargs: "dsack=+{{.TCP_SOCK_DSACK_DUPS}}({{.P1}}):u32",
+	},
+	// Last path MTU seen by the socket (icsk_pmtu_cookie).
+	{
+		field:     tcpClosePathMTU,
+		requires:  []string{"INET_CSK_PMTU"},
+		fetchargs: "pmtu=+{{.INET_CSK_PMTU}}({{.P1}}):u32",
+	},
+	// Send and receive buffer sizes (sk_sndbuf and sk_rcvbuf).
+	{
+		field:     tcpCloseBuffers,
+		requires:  []string{"SOCK_SNDBUF", "SOCK_RCVBUF"},
+		fetchargs: "sndbuf=+{{.SOCK_SNDBUF}}({{.P1}}):u32 rcvbuf=+{{.SOCK_RCVBUF}}({{.P1}}):u32",
+	},
+	// Congestion window, in segments (tcp_sock.snd_cwnd).
+	{
+		field:     tcpCloseCwnd,
+		requires:  []string{"TCP_SOCK_SND_CWND"},
+		fetchargs: "cwnd=+{{.TCP_SOCK_SND_CWND}}({{.P1}}):u32",
+	},
+}
+
+// getTCPCloseKProbe returns the probe that takes a snapshot of a TCP socket's
+// state when it's closed, fetching the values whose offsets are available.
+// It returns false when none is.
+//
+//	" tcp_close(sock=0xffff9f1ddd216040, srtt=1344, rto=50, dsack_dups=3, pmtu=1400, sndbuf=87040, rcvbuf=131072, cwnd=10) "
+func getTCPCloseKProbe(vars mapstr.M) (helper.ProbeDef, bool) {
+	var fields tcpCloseFields
+	fetchargs := []string{"sock={{.P1}}"}
+	for _, opt := range tcpCloseFetchargs {
+		if hasAllVars(vars, opt.requires) {
+			fields |= opt.field
+			fetchargs = append(fetchargs, opt.fetchargs)
+		}
+	}
+	if fields == 0 {
+		return helper.ProbeDef{}, false
+	}
+	return helper.ProbeDef{
+		Probe: tracing.Probe{
+			Name:      tcpCloseProbeName,
+			Address:   "tcp_close",
+			Fetchargs: strings.Join(fetchargs, " "),
+		},
+		Decoder: helper.NewStructDecoder(func() interface{} { return &tcpCloseCall{fields: fields} }),
+	}, true
+}
+
+// getKProbes returns the probes always installed. In IPv6-only mode, the
+// probes for IPv4 sockets are skipped.
+func getKProbes(hasIPv6, ipv6Only bool) (list []helper.ProbeDef) {
 	list = append(list, sharedKProbes...)
+	if !ipv6Only {
+		list = append(list, ipv4KProbes...)
+	}
 	if hasIPv6 {
 		list = append(list, ipv6KProbes...)
 	} else {
@@ -524,9 +1328,275 @@ func getKProbes(hasIPv6 bool) (list []helper.ProbeDef) {
 	return list
 }
 
+// getOptionalKProbes returns the optional probes whose required variables
+// are all available.
+func getOptionalKProbes(vars mapstr.M) (list []helper.ProbeDef) {
+	for _, opt := range optionalKProbes {
+		if hasAllVars(vars, opt.requires) {
+			list = append(list, opt.probes...)
+		}
+	}
+	if probe, ok := getTCPCloseKProbe(vars); ok {
+		list = append(list, probe)
+	}
+	return list
+}
+
+// hasAllVars returns whether all the given template variables are defined.
+func hasAllVars(vars mapstr.M, names []string) bool {
+	for _, name := range names {
+		if _, found := vars[name]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// kprobeGroup is a set of optional probes that are installed together or not
+// at all.
+type kprobeGroup struct {
+	// name of the feature or probe, used in logs.
+	name   string
+	probes []helper.ProbeDef
+}
+
+// limitKProbes selects, in priority order, the groups of optional probes that
+// can be installed along the given number of required probes without
+// exceeding max probes. A group that doesn't fit is skipped, and the
+// following, lower priority, groups are still considered. Zero means no
+// limit. It fails when the required probes alone exceed the limit.
+func limitKProbes(max, required int, groups []kprobeGroup) (selected, skipped []kprobeGroup, err error) {
+	if max == 0 {
+		return groups, nil, nil
+	}
+	if required > max {
+		return nil, nil, fmt.Errorf("socket.max_kprobes (%d) is lower than the %d kprobes required by the dataset", max, required)
+	}
+	left := max - required
+	for _, g := range groups {
+		if len(g.probes) > left {
+			skipped = append(skipped, g)
+			continue
+		}
+		left -= len(g.probes)
+		selected = append(selected, g)
+	}
+	return selected, skipped, nil
+}
+
+// featureKProbes are the kprobes installed for an optional feature of the
+// dataset that is enabled in the configuration.
+type featureKProbes struct {
+	// name of the feature, used in logs.
+	name string
+	// probes installed when their kernel functions are available.
+	probes []helper.ProbeDef
+	// requires lists the guessed variables that the probes depend on. The
+	// feature is disabled when they aren't available.
+	requires []string
+	// requiresWarning is logged when the required variables aren't
+	// available. The feature is silently disabled when it's empty.
+	requiresWarning string
+	// requireAll is set when the feature needs all of its probes, rather
+	// than one of them, to work as configured.
+	requireAll bool
+	// warning is logged when the required probes aren't available.
+	warning string
+}
+
+// Names of the features whose availability changes how flows are reported.
+const (
+	featureSCTPAssociation = "SCTP association"
+	featureMPTCP           = "MPTCP"
+)
+
+// getFeatureKProbes returns the probes of the optional features enabled in
+// the configuration. It's used both by Setup and the preflight report, so
+// that the report covers the probes that Setup would install.
+func getFeatureKProbes(config *Config, hasIPv6 bool) (list []featureKProbes) {
+	if config.EnableSCTP {
+		list = append(list,
+			featureKProbes{
+				name:    "SCTP",
+				probes:  getSCTPKProbes(hasIPv6, config.IPv6Only),
+				warning: "SCTP monitoring is enabled but no SCTP functions are available for tracing. Is the sctp kernel module loaded?",
+			},
+			featureKProbes{
+				name:     featureSCTPAssociation,
+				probes:   sctpAssocKProbes,
+				requires: sctpAssocVars,
+			})
+	}
+	if config.TrackZeroWindow {
+		list = append(list, featureKProbes{
+			name:    "Zero-window",
+			probes:  zeroWindowKProbes,
+			warning: "Zero-window tracking is enabled but no zero-window functions are available for tracing.",
+		})
+	}
+	if config.ReportConnectFailures {
+		list = append(list, featureKProbes{
+			name:    "Connect failure",
+			probes:  connectFailureKProbes,
+			warning: "Reporting connect failures is enabled but tcp_done is not available for tracing.",
+		})
+	}
+	if config.TrackUrgentData {
+		list = append(list, featureKProbes{
+			name:    "Urgent data",
+			probes:  urgentDataKProbes,
+			warning: "Urgent data tracking is enabled but sk_send_sigurg is not available for tracing.",
+		})
+	}
+	if config.DetectPortScans {
+		var probes []helper.ProbeDef
+		if !config.IPv6Only {
+			probes = append(probes, portScanKProbes...)
+		}
+		if hasIPv6 {
+			probes = append(probes, portScanIPv6KProbes...)
+		}
+		list = append(list, featureKProbes{
+			name:   "Port scan",
+			probes: probes,
+			warning: "Port scan detection is enabled but no TCP connection request functions are available for tracing. " +
+				"No port scans will be detected.",
+		})
+	}
+	if config.ReportOnEstablish {
+		list = append(list, featureKProbes{
+			name:   "Establish",
+			probes: establishKProbes,
+			warning: "Reporting on establish is enabled but tcp_finish_connect is not available for tracing. " +
+				"Only accepted connections will be reported when established.",
+		})
+	}
+	if config.EnableMPTCP {
+		list = append(list, featureKProbes{
+			name:     featureMPTCP,
+			probes:   mptcpKProbes,
+			requires: []string{"MPTCP_SOCK_TOKEN"},
+			requiresWarning: "MPTCP monitoring is enabled but the offset of the connection token couldn't be " +
+				"guessed. Is MPTCP enabled in the net.mptcp.enabled sysctl? MPTCP subflows won't be correlated.",
+			warning: "MPTCP monitoring is enabled but neither mptcp_event nor __mptcp_close_ssk are available " +
+				"for tracing. Is the kernel built with MPTCP support?",
+		})
+	}
+	if config.MinFlowBytes > 0 || config.ReportCloseInitiator {
+		warning := "Flows below socket.min_flow_bytes are dropped, but not all TCP reset functions " +
+			"are available for tracing. Some reset flows may not be reported."
+		if config.MinFlowBytes == 0 {
+			warning = "Reporting the close initiator is enabled but not all TCP reset functions are " +
+				"available for tracing. The initiator of reset connections may not be reported."
+		}
+		list = append(list, featureKProbes{
+			name:       "TCP reset",
+			probes:     tcpResetKProbes,
+			requireAll: true,
+			warning:    warning,
+		})
+	}
+	if config.ReportCloseInitiator {
+		list = append(list, featureKProbes{
+			name:       "Close initiator",
+			probes:     closeInitiatorKProbes,
+			requireAll: true,
+			warning: "Reporting the close initiator is enabled but tcp_fin or tcp_send_fin are not available " +
+				"for tracing. network.tcp.closed_by won't be reported.",
+		})
+	}
+	if config.EnableTunnels {
+		list = append(list, featureKProbes{
+			name:   "Tunnel",
+			probes: tunnelKProbes,
+			warning: "Tunnel monitoring is enabled but neither ip_tunnel_xmit nor ip_tunnel_rcv are available " +
+				"for tracing. Are the ipip, ip_gre or sit kernel modules loaded?",
+		})
+	}
+	if config.EnableNetlink {
+		list = append(list, featureKProbes{
+			name:       "Netlink",
+			probes:     netlinkKProbes,
+			requireAll: true,
+			warning: "Netlink monitoring is enabled but netlink_create, netlink_sendmsg or netlink_release are not " +
+				"available for tracing. Netlink activity won't be reported.",
+		})
+	}
+	if config.IncludeSocketInode {
+		list = append(list, featureKProbes{
+			name:     "Socket inode",
+			probes:   socketInodeKProbes,
+			requires: []string{"SOCKET_INODE_INO"},
+			requiresWarning: "Reporting the socket inode is enabled but its offset couldn't be guessed on this " +
+				"kernel. network.socket.inode won't be reported.",
+			warning: "Reporting the socket inode is enabled but security_sock_graft is not available for " +
+				"tracing. The inode of accepted sockets won't be reported.",
+		})
+	}
+	if config.InferListenerProcess {
+		probes := inetListenIPv4KProbes
+		if hasIPv6 {
+			probes = inetListenKProbes
+		}
+		list = append(list, featureKProbes{
+			name:   "Listener process",
+			probes: probes,
+			warning: "Inferring the listener process is enabled but inet_listen is not available for tracing. " +
+				"Only the listeners seen accepting connections will be known.",
+		})
+	}
+	return list
+}
+
+// getSCTPKProbes returns the probes used to monitor SCTP associations.
+func getSCTPKProbes(hasIPv6, ipv6Only bool) (list []helper.ProbeDef) {
+	list = append(list, sctpKProbes...)
+	if !ipv6Only {
+		list = append(list, sctpIPv4KProbes...)
+	}
+	if hasIPv6 {
+		list = append(list, sctpIPv6KProbes...)
+	} else {
+		list = append(list, sctpIPv4OnlyKProbes...)
+	}
+	return list
+}
+
 func getAllKProbes() (list []helper.ProbeDef) {
 	list = append(list, sharedKProbes...)
+	list = append(list, ipv4KProbes...)
 	list = append(list, ipv6KProbes...)
 	list = append(list, ipv4OnlyKProbes...)
+	list = append(list, sctpKProbes...)
+	list = append(list, sctpIPv4KProbes...)
+	list = append(list, sctpIPv6KProbes...)
+	list = append(list, sctpIPv4OnlyKProbes...)
+	list = append(list, sctpAssocKProbes...)
+	list = append(list, establishKProbes...)
+	list = append(list, zeroWindowKProbes...)
+	list = append(list, urgentDataKProbes...)
+	list = append(list, connectFailureKProbes...)
+	list = append(list, portScanKProbes...)
+	list = append(list, portScanIPv6KProbes...)
+	list = append(list, mptcpKProbes...)
+	list = append(list, tcpResetKProbes...)
+	list = append(list, closeInitiatorKProbes...)
+	list = append(list, tunnelKProbes...)
+	list = append(list, netlinkKProbes...)
+	list = append(list, socketInodeKProbes...)
+	list = append(list, inetListenKProbes...)
+	list = append(list, inetListenIPv4KProbes...)
+	for _, opt := range optionalKProbes {
+		list = append(list, opt.probes...)
+	}
+	allVars := mapstr.M{}
+	for _, opt := range tcpCloseFetchargs {
+		for _, name := range opt.requires {
+			allVars[name] = true
+		}
+	}
+	if probe, ok := getTCPCloseKProbe(allVars); ok {
+		list = append(list, probe)
+	}
 	return list
 }
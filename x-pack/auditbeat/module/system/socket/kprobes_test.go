@@ -8,12 +8,14 @@ package socket
 
 import (
 	"fmt"
+	"net"
 	"strings"
 	"testing"
 
 	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/guess"
 	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
 	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
 )
 
 func probeName(p tracing.Probe) string {
@@ -80,3 +82,331 @@ func TestGuessKProbesAreBackwardsCompatible(t *testing.T) {
 	}
 	validateProbeList(t, probes)
 }
+
+func TestPreflightProbeAddresses(t *testing.T) {
+	vars := mapstr.M{}
+	for varName, alternatives := range functionAlternatives {
+		vars[varName] = alternatives[0]
+	}
+	for _, probe := range getAllKProbes() {
+		address, err := addressOf(probe, vars)
+		if err != nil || address == "" || strings.Contains(address, "{{") {
+			t.Errorf("probe %s: unexpected address '%s' (err=%v)", probe.Probe.Name, address, err)
+		}
+		if _, err = addressOf(probe, mapstr.M{}); strings.Contains(probe.Probe.Address, "{{") && err == nil {
+			t.Errorf("probe %s: expected error for unresolved function alternative", probe.Probe.Name)
+		}
+	}
+}
+
+func TestFeatureKProbes(t *testing.T) {
+	config := defaultConfig
+	if list := getFeatureKProbes(&config, true); len(list) != 0 {
+		t.Errorf("expected no feature probes with the default config, got %d", len(list))
+	}
+
+	config.EnableSCTP = true
+	config.TrackZeroWindow = true
+	config.TrackUrgentData = true
+	config.ReportConnectFailures = true
+	config.DetectPortScans = true
+	config.ReportOnEstablish = true
+	config.EnableMPTCP = true
+	config.MinFlowBytes = 1
+	config.ReportCloseInitiator = true
+	config.IncludeSocketInode = true
+	config.InferListenerProcess = true
+	config.EnableNetlink = true
+	all := map[string]bool{}
+	for _, probe := range getAllKProbes() {
+		all[probe.Probe.Name] = true
+	}
+	var names []string
+	for _, feature := range getFeatureKProbes(&config, true) {
+		names = append(names, feature.name)
+		if len(feature.probes) == 0 {
+			t.Errorf("feature %s has no probes", feature.name)
+		}
+		for _, probe := range feature.probes {
+			if !all[probe.Probe.Name] {
+				t.Errorf("probe %s of feature %s is not in getAllKProbes", probe.Probe.Name, feature.name)
+			}
+		}
+	}
+	expected := []string{"SCTP", featureSCTPAssociation, "Zero-window", "Connect failure", "Urgent data", "Port scan", "Establish", featureMPTCP, "TCP reset", "Close initiator", "Netlink", "Socket inode", "Listener process"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected features %v, expected %v", names, expected)
+	}
+}
+
+func TestIPv6OnlyKProbes(t *testing.T) {
+	ipv4 := map[string]bool{}
+	for _, list := range [][]helper.ProbeDef{ipv4KProbes, ipv4OnlyKProbes, sctpIPv4KProbes, sctpIPv4OnlyKProbes, portScanKProbes} {
+		for _, probe := range list {
+			ipv4[probe.Probe.Name] = true
+		}
+	}
+	config := defaultConfig
+	config.IPv6Only = true
+	config.EnableSCTP = true
+	config.DetectPortScans = true
+	probes := getKProbes(true, true)
+	for _, feature := range getFeatureKProbes(&config, true) {
+		if len(feature.probes) == 0 {
+			t.Errorf("feature %s has no probes in IPv6-only mode", feature.name)
+		}
+		probes = append(probes, feature.probes...)
+	}
+	names := map[string]bool{}
+	for _, probe := range probes {
+		names[probe.Probe.Name] = true
+		if ipv4[probe.Probe.Name] {
+			t.Errorf("IPv4 probe %s installed in IPv6-only mode", probe.Probe.Name)
+		}
+	}
+	for _, name := range []string{"inet6_create", "tcp6_connect_in", "udpv6_sendmsg_in", "inet_release", "sctp6_connect_in", "tcp_v6_conn_request_call"} {
+		if !names[name] {
+			t.Errorf("probe %s not installed in IPv6-only mode", name)
+		}
+	}
+	if a, b := len(getKProbes(true, false)), len(getKProbes(true, true))+len(ipv4KProbes); a != b {
+		t.Errorf("expected %d probes with IPv4 enabled, got %d", b, a)
+	}
+}
+
+func TestTCPCloseKProbe(t *testing.T) {
+	if _, ok := getTCPCloseKProbe(mapstr.M{}); ok {
+		t.Error("expected no tcp_close probe without guessed offsets")
+	}
+	// Both buffer offsets are required.
+	if _, ok := getTCPCloseKProbe(mapstr.M{"SOCK_SNDBUF": 284}); ok {
+		t.Error("expected no tcp_close probe with only the send buffer offset")
+	}
+	for _, tc := range []struct {
+		vars     mapstr.M
+		expected string
+	}{
+		{
+			vars:     mapstr.M{"INET_CSK_PMTU": 1196, "TCP_SOCK_SRTT": 1628},
+			expected: "sock={{.P1}} pmtu=+{{.INET_CSK_PMTU}}({{.P1}}):u32",
+		},
+		{
+			vars: mapstr.M{"TCP_SOCK_SRTT": 1628, "INET_CSK_RTO": 1184, "TCP_SOCK_DSACK_DUPS": 1664},
+			expected: "sock={{.P1}} srtt=+{{.TCP_SOCK_SRTT}}({{.P1}}):u32 rto=+{{.INET_CSK_RTO}}({{.P1}}):u32 " +
+				"dsack=+{{.TCP_SOCK_DSACK_DUPS}}({{.P1}}):u32",
+		},
+		{
+			vars:     mapstr.M{"SOCK_SNDBUF": 284, "SOCK_RCVBUF": 244},
+			expected: "sock={{.P1}} sndbuf=+{{.SOCK_SNDBUF}}({{.P1}}):u32 rcvbuf=+{{.SOCK_RCVBUF}}({{.P1}}):u32",
+		},
+		{
+			vars:     mapstr.M{"TCP_SOCK_SND_CWND": 1612},
+			expected: "sock={{.P1}} cwnd=+{{.TCP_SOCK_SND_CWND}}({{.P1}}):u32",
+		},
+	} {
+		probe, ok := getTCPCloseKProbe(tc.vars)
+		if !ok {
+			t.Errorf("vars %v: expected a tcp_close probe", tc.vars)
+			continue
+		}
+		if probe.Probe.Fetchargs != tc.expected {
+			t.Errorf("vars %v: expected fetchargs '%s', got '%s'", tc.vars, tc.expected, probe.Probe.Fetchargs)
+		}
+	}
+}
+
+func TestCheckSharedProbe(t *testing.T) {
+	expected := tracing.Probe{
+		Type:      tracing.TypeKProbe,
+		Name:      "tcp_v4_connect_call",
+		Address:   "tcp_v4_connect",
+		Fetchargs: "sock=%di addr=+4(+8(%si)):u32 port=+2(%si):u16",
+	}
+	installed := expected
+	installed.Group = "auditbeat_1234"
+	installed.Fetchargs = "sock=%di:u64 addr=+4(+8(%si)):u32 port=+2(%si):u16"
+	otherAddress, otherType := installed, installed
+	otherAddress.Address = "tcp_v6_connect"
+	otherType.Type = tracing.TypeKRetProbe
+	for _, tc := range []struct {
+		name   string
+		probe  tracing.Probe
+		fields []string
+		valid  bool
+	}{
+		{"match", installed, []string{"sock", "addr", "port"}, true},
+		{"missing field", installed, []string{"sock", "addr"}, false},
+		{"other address", otherAddress, []string{"sock", "addr", "port"}, false},
+		{"other type", otherType, []string{"sock", "addr", "port"}, false},
+	} {
+		format := tracing.ProbeFormat{Probe: tc.probe, Fields: map[string]tracing.Field{}}
+		for _, name := range append([]string{"common_type", "__probe_ip"}, tc.fields...) {
+			format.Fields[name] = tracing.Field{Name: name}
+		}
+		if err := checkSharedProbe(expected, format); (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid=%v, got error %v", tc.name, tc.valid, err)
+		}
+	}
+}
+
+func TestFetchargNames(t *testing.T) {
+	names := fetchargNames("sock=%di size=%dx:u32  af=+16(%di):u16")
+	if strings.Join(names, ",") != "sock,size,af" {
+		t.Errorf("unexpected fetcharg names %v", names)
+	}
+	if names = fetchargNames(""); len(names) != 0 {
+		t.Errorf("expected no fetcharg names, got %v", names)
+	}
+}
+
+func TestWithExcludePorts(t *testing.T) {
+	port := func(p uint16) string {
+		return fmt.Sprintf("0x%x", be16(p))
+	}
+	transform := WithExcludePorts([]uint16{22, 8443})
+	for _, tc := range []struct {
+		probe    tracing.Probe
+		expected string
+	}{
+		{
+			probe:    tracing.Probe{Fetchargs: "sock={{.P1}} lport=+4({{.P1}}):u16 rport=+6({{.P1}}):u16"},
+			expected: "lport!=" + port(22) + " && lport!=" + port(8443) + " && rport!=" + port(22) + " && rport!=" + port(8443),
+		},
+		{
+			probe:    tracing.Probe{Fetchargs: "sock={{.P1}} lport=+4({{.P1}}):u16 port=+2({{.P2}}):u16", Filter: "af==2"},
+			expected: "lport!=" + port(22) + " && lport!=" + port(8443) + " && port!=" + port(22) + " && port!=" + port(8443) + " && (af==2)",
+		},
+		{
+			probe:    tracing.Probe{Fetchargs: "sock={{.P1}} lport=+4({{.P1}}):u16 rport=+2(+0({{.P2}})):u16 altrport=+6({{.P1}}):u16"},
+			expected: "lport!=" + port(22) + " && lport!=" + port(8443),
+		},
+		{
+			probe:    tracing.Probe{Fetchargs: "sock={{.P1}} size={{.P2}}"},
+			expected: "",
+		},
+	} {
+		if filter := transform(helper.ProbeDef{Probe: tc.probe}).Probe.Filter; filter != tc.expected {
+			t.Errorf("fetchargs '%s': expected filter '%s', got '%s'", tc.probe.Fetchargs, tc.expected, filter)
+		}
+	}
+}
+
+func TestWithExcludeRemoteAddrs(t *testing.T) {
+	addr := func(s string) string {
+		return fmt.Sprintf("0x%x", tracing.MachineEndian.Uint32(net.ParseIP(s).To4()))
+	}
+	transform := WithExcludeRemoteAddrs([]net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("192.0.2.10")})
+	for _, tc := range []struct {
+		probe    tracing.Probe
+		expected string
+	}{
+		{
+			probe:    tracing.Probe{Fetchargs: "sock={{.P1}} laddr=+0({{.P1}}):u32 raddr=+4({{.P1}}):u32"},
+			expected: "raddr!=" + addr("10.0.0.1") + " && raddr!=" + addr("192.0.2.10"),
+		},
+		{
+			probe:    tracing.Probe{Fetchargs: "sock={{.P1}} af=+0({{.P2}}):u16 addr=+4({{.P2}}):u32", Filter: "af==2"},
+			expected: "addr!=" + addr("10.0.0.1") + " && addr!=" + addr("192.0.2.10") + " && (af==2)",
+		},
+		{
+			probe:    tracing.Probe{Fetchargs: "sock={{.P1}} raddr=+4(+0({{.P2}})):u32 altraddr=+4({{.P1}}):u32"},
+			expected: "",
+		},
+		{
+			probe:    tracing.Probe{Fetchargs: "sock={{.P1}} raddr6a=+0({{.P1}}):u64 raddr6b=+8({{.P1}}):u64"},
+			expected: "",
+		},
+	} {
+		if filter := transform(helper.ProbeDef{Probe: tc.probe}).Probe.Filter; filter != tc.expected {
+			t.Errorf("fetchargs '%s': expected filter '%s', got '%s'", tc.probe.Fetchargs, tc.expected, filter)
+		}
+	}
+}
+
+func TestWithSocketInode(t *testing.T) {
+	vars := mapstr.M{}
+	transform := WithSocketInode(vars)
+	var sockInit helper.ProbeDef
+	for _, probe := range sharedKProbes {
+		if probe.Probe.Name == "sock_init_data" {
+			sockInit = probe
+		}
+	}
+	if sockInit.Probe.Name == "" {
+		t.Fatal("sock_init_data probe not found")
+	}
+	// The installer is created before the offset is guessed.
+	if fetchargs := transform(sockInit).Probe.Fetchargs; fetchargs != sockInit.Probe.Fetchargs {
+		t.Errorf("unexpected fetchargs without the offset: '%s'", fetchargs)
+	}
+	vars["SOCKET_INODE_INO"] = 192
+	if fetchargs := transform(sockInit).Probe.Fetchargs; !hasFetcharg(fetchargs, "ino") {
+		t.Errorf("expected the inode to be fetched, got '%s'", fetchargs)
+	}
+	other := helper.ProbeDef{Probe: tracing.Probe{Name: "inet_release", Fetchargs: "sock={{.P1}}"}}
+	if fetchargs := transform(other).Probe.Fetchargs; fetchargs != "sock={{.P1}}" {
+		t.Errorf("unexpected fetchargs for inet_release: '%s'", fetchargs)
+	}
+}
+
+func TestWithConnectError(t *testing.T) {
+	vars := mapstr.M{}
+	transform := WithConnectError(vars)
+	done := connectFailureKProbes[0]
+	// The installer is created before the offset is guessed.
+	if fetchargs := transform(done).Probe.Fetchargs; fetchargs != done.Probe.Fetchargs {
+		t.Errorf("unexpected fetchargs without the offset: '%s'", fetchargs)
+	}
+	vars["SOCK_ERR"] = 380
+	if fetchargs := transform(done).Probe.Fetchargs; !hasFetcharg(fetchargs, "err") {
+		t.Errorf("expected the error to be fetched, got '%s'", fetchargs)
+	}
+}
+
+func TestLimitKProbes(t *testing.T) {
+	group := func(name string, n int) kprobeGroup {
+		g := kprobeGroup{name: name}
+		for i := 0; i < n; i++ {
+			g.probes = append(g.probes, helper.ProbeDef{Probe: tracing.Probe{Name: fmt.Sprintf("%s_%d", name, i)}})
+		}
+		return g
+	}
+	names := func(groups []kprobeGroup) string {
+		list := make([]string, len(groups))
+		for i, g := range groups {
+			list[i] = g.name
+		}
+		return strings.Join(list, ",")
+	}
+	// Features first, then the probes that enrich flows.
+	groups := []kprobeGroup{group("SCTP", 6), group("MPTCP", 2), group(tcpCloseProbeName, 1), group("tcp_init_transfer_call", 1)}
+	for _, tc := range []struct {
+		max               int
+		selected, skipped string
+	}{
+		{max: 0, selected: "SCTP,MPTCP,tcp_close_call,tcp_init_transfer_call"},
+		{max: 40, selected: "SCTP,MPTCP,tcp_close_call,tcp_init_transfer_call"},
+		{max: 39, selected: "SCTP,MPTCP,tcp_close_call", skipped: "tcp_init_transfer_call"},
+		{max: 37, selected: "SCTP,tcp_close_call", skipped: "MPTCP,tcp_init_transfer_call"},
+		// A group that doesn't fit doesn't prevent smaller ones after it.
+		{max: 32, selected: "MPTCP", skipped: "SCTP,tcp_close_call,tcp_init_transfer_call"},
+		{max: 33, selected: "MPTCP,tcp_close_call", skipped: "SCTP,tcp_init_transfer_call"},
+		{max: 30, skipped: "SCTP,MPTCP,tcp_close_call,tcp_init_transfer_call"},
+	} {
+		selected, skipped, err := limitKProbes(tc.max, 30, groups)
+		if err != nil {
+			t.Errorf("max=%d: unexpected error: %v", tc.max, err)
+			continue
+		}
+		if got := names(selected); got != tc.selected {
+			t.Errorf("max=%d: expected selected '%s', got '%s'", tc.max, tc.selected, got)
+		}
+		if got := names(skipped); got != tc.skipped {
+			t.Errorf("max=%d: expected skipped '%s', got '%s'", tc.max, tc.skipped, got)
+		}
+	}
+
+	if _, _, err := limitKProbes(29, 30, groups); err == nil {
+		t.Error("expected an error when the required probes exceed the limit")
+	}
+}
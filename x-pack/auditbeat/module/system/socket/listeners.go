@@ -0,0 +1,188 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"net"
+	"sync"
+)
+
+// listenerSet holds the local TCP sockets known to listen, learned from the
+// accept calls made on them and, with socket.infer_listener_process, from
+// listen calls, so that outbound flows from a port that is also listened on
+// can be tagged. A listener is forgotten when its sock is released. It's used
+// when reporting flows, without the state's mutex, so it has its own.
+type listenerSet struct {
+	sync.RWMutex
+	// listening address of each sock.
+	bySock map[uintptr]net.TCPAddr
+	// listeners by port, and by sock so that listeners sharing a port
+	// through SO_REUSEPORT are kept apart.
+	byPort map[int]map[uintptr]*listener
+}
+
+// listener is a listening sock.
+type listener struct {
+	// ip is unspecified for wildcard listeners.
+	ip net.IP
+	// pid and process that listened, or last accepted, on the sock. Zero
+	// when unknown.
+	pid     uint32
+	process *process
+}
+
+func newListenerSet() *listenerSet {
+	return &listenerSet{
+		bySock: make(map[uintptr]net.TCPAddr),
+		byPort: make(map[int]map[uintptr]*listener),
+	}
+}
+
+// add records that a sock listens on the given address. A non-zero pid
+// replaces the process known for the sock.
+func (l *listenerSet) add(sock uintptr, addr net.TCPAddr, pid uint32, proc *process) {
+	if sock == 0 || addr.Port == 0 {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if prev, found := l.bySock[sock]; found {
+		if prev.Port == addr.Port && prev.IP.Equal(addr.IP) {
+			if ln := l.byPort[addr.Port][sock]; ln != nil && pid != 0 {
+				ln.pid, ln.process = pid, proc
+			}
+			return
+		}
+		l.removeLocked(sock)
+	}
+	l.bySock[sock] = addr
+	socks := l.byPort[addr.Port]
+	if socks == nil {
+		socks = make(map[uintptr]*listener)
+		l.byPort[addr.Port] = socks
+	}
+	socks[sock] = &listener{ip: addr.IP, pid: pid, process: proc}
+}
+
+// remove forgets the listener of a released sock, if any.
+func (l *listenerSet) remove(sock uintptr) {
+	l.RLock()
+	_, found := l.bySock[sock]
+	l.RUnlock()
+	if !found {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.removeLocked(sock)
+}
+
+func (l *listenerSet) removeLocked(sock uintptr) {
+	addr, found := l.bySock[sock]
+	if !found {
+		return
+	}
+	delete(l.bySock, sock)
+	if socks := l.byPort[addr.Port]; socks != nil {
+		delete(socks, sock)
+		if len(socks) == 0 {
+			delete(l.byPort, addr.Port)
+		}
+	}
+}
+
+// isListening returns whether a listener accepts connections to the given
+// local address. Outbound flows usually come from an ephemeral port that
+// nobody listens on, which is a single lookup.
+func (l *listenerSet) isListening(ip net.IP, port int) bool {
+	l.RLock()
+	defer l.RUnlock()
+	for _, ln := range l.byPort[port] {
+		if ln.accepts(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts returns whether the listener accepts connections to the given IP.
+func (ln *listener) accepts(ip net.IP) bool {
+	return ln.ip == nil || ln.ip.IsUnspecified() || ln.ip.Equal(ip)
+}
+
+// owner returns the process listening on the given local address. Listeners
+// bound to the address are preferred over wildcard ones. It's not found when
+// the process is unknown, or when listeners of different processes share the
+// port, as the one that would have accepted the connection can't be told.
+func (l *listenerSet) owner(ip net.IP, port int) (pid uint32, proc *process, found bool) {
+	l.RLock()
+	defer l.RUnlock()
+	var exact, wildcard []*listener
+	for _, ln := range l.byPort[port] {
+		switch {
+		case ln.ip != nil && !ln.ip.IsUnspecified() && ln.ip.Equal(ip):
+			exact = append(exact, ln)
+		case ln.accepts(ip):
+			wildcard = append(wildcard, ln)
+		}
+	}
+	candidates := exact
+	if len(candidates) == 0 {
+		candidates = wildcard
+	}
+	for _, ln := range candidates {
+		if ln.pid == 0 || (pid != 0 && ln.pid != pid) {
+			return 0, nil, false
+		}
+		pid = ln.pid
+		if proc == nil {
+			proc = ln.process
+		}
+	}
+	return pid, proc, pid != 0
+}
+
+// OnListenerSeen records the address a listening sock is bound to, as
+// captured by a listen or accept call made by the given process.
+func (s *state) OnListenerSeen(sock uintptr, addr net.TCPAddr, pid uint32) {
+	s.listeners.add(sock, addr, pid, s.processOf(pid))
+}
+
+// processOf returns the process with the given pid, if known.
+func (s *state) processOf(pid uint32) *process {
+	if pid == 0 {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.processes[pid]
+}
+
+// inferListenerProcess attributes an inbound TCP flow without a process, as
+// happens when its accept call wasn't captured, to the process listening on
+// its local port.
+func (s *state) inferListenerProcess(f *flow) {
+	if !s.inferListener || f.proto != protoTCP || f.pid != 0 || f.dir == directionEgress || f.local.addr.IP == nil {
+		return
+	}
+	pid, proc, found := s.listeners.owner(f.local.addr.IP, f.local.addr.Port)
+	if !found {
+		return
+	}
+	f.pid, f.process, f.processInferred = pid, proc, true
+	if f.dir == directionUnknown {
+		f.dir = directionIngress
+	}
+}
+
+// withInferListenerProcess attributes inbound TCP flows without a process to
+// the process listening on their local port.
+func withInferListenerProcess(enabled bool) stateOption {
+	return func(s *state) {
+		s.inferListener = enabled
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+)
+
+func TestListenerSet(t *testing.T) {
+	l := newListenerSet()
+	l.add(0x1000, net.TCPAddr{IP: net.IPv4zero, Port: 22}, 0, nil)
+	l.add(0x2000, net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, 0, nil)
+	// Another process listening on the same port with SO_REUSEPORT.
+	l.add(0x3000, net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443}, 0, nil)
+
+	assert.True(t, l.isListening(net.ParseIP("192.168.1.1"), 22))
+	assert.True(t, l.isListening(net.ParseIP("10.0.0.1"), 443))
+	assert.True(t, l.isListening(net.ParseIP("10.0.0.2"), 443))
+	assert.False(t, l.isListening(net.ParseIP("10.0.0.3"), 443))
+	assert.False(t, l.isListening(net.ParseIP("10.0.0.1"), 40000))
+
+	l.remove(0x2000)
+	assert.False(t, l.isListening(net.ParseIP("10.0.0.1"), 443))
+	assert.True(t, l.isListening(net.ParseIP("10.0.0.2"), 443))
+	l.remove(0x3000)
+	assert.Empty(t, l.byPort)
+
+	// A reused sock replaces its previous address.
+	l.add(0x1000, net.TCPAddr{IP: net.IPv4zero, Port: 2222}, 0, nil)
+	assert.False(t, l.isListening(net.ParseIP("192.168.1.1"), 22))
+	assert.True(t, l.isListening(net.ParseIP("192.168.1.1"), 2222))
+	l.remove(0x4000)
+	assert.Len(t, l.bySock, 1)
+}
+
+func TestAlsoListening(t *testing.T) {
+	const (
+		listenSock   uintptr = 0xff0000
+		acceptedSock uintptr = 0xff2222
+	)
+	accept := []event{
+		&tcpAcceptCall4{Meta: meta(1234, 1234, 2), Sock: listenSock, LPort: be16(testLocalPort), Af: unix.AF_INET},
+		&tcpAcceptResult4{
+			Meta:  meta(1234, 1234, 3),
+			Sock:  acceptedSock,
+			LAddr: ipv4(testLocalIP),
+			LPort: be16(testLocalPort),
+			RAddr: ipv4("192.168.1.1"),
+			RPort: be16(50000),
+			Af:    unix.AF_INET,
+		},
+	}
+	for _, tc := range []struct {
+		name     string
+		evs      []event
+		expected bool
+	}{
+		{
+			name: "no listener",
+			evs:  tcpConnectEvents(1234, 5, 6),
+		},
+		{
+			name:     "listener",
+			evs:      append(accept, tcpConnectEvents(1234, 5, 6)...),
+			expected: true,
+		},
+		{
+			name: "listener released",
+			evs: append(append(accept,
+				&inetReleaseCall{Meta: meta(1234, 1234, 4), Sock: listenSock}),
+				tcpConnectEvents(1234, 5, 6)...),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			st.feedEvents(append([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/sbin/server"}),
+			}, tc.evs...))
+			st.ExpireFlows()
+			var outbound []beat.Event
+			for _, ev := range st.getFlows() {
+				if dir, _ := ev.GetValue("network.direction"); dir == "egress" {
+					outbound = append(outbound, ev)
+				}
+			}
+			if !assert.Len(t, outbound, 1) {
+				t.FailNow()
+			}
+			_, err := outbound[0].GetValue("network.local.also_listening")
+			if !tc.expected {
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, outbound[0], true, "network.local.also_listening")
+		})
+	}
+}
+
+func TestListenerOwner(t *testing.T) {
+	server := &process{pid: 100, name: "server"}
+	l := newListenerSet()
+	l.add(0x1000, net.TCPAddr{IP: net.IPv4zero, Port: 80}, 100, server)
+	l.add(0x2000, net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}, 200, nil)
+	// Workers of the same process sharing the port with SO_REUSEPORT.
+	l.add(0x3000, net.TCPAddr{IP: net.IPv4zero, Port: 443}, 100, server)
+	l.add(0x4000, net.TCPAddr{IP: net.IPv4zero, Port: 443}, 100, nil)
+	// Different processes sharing the port.
+	l.add(0x5000, net.TCPAddr{IP: net.IPv4zero, Port: 8080}, 100, server)
+	l.add(0x6000, net.TCPAddr{IP: net.IPv4zero, Port: 8080}, 300, nil)
+	// Listener of an unknown process.
+	l.add(0x7000, net.TCPAddr{IP: net.IPv4zero, Port: 9090}, 0, nil)
+
+	for _, tc := range []struct {
+		ip    string
+		port  int
+		pid   uint32
+		proc  *process
+		found bool
+	}{
+		{ip: "10.0.0.2", port: 80, pid: 100, proc: server, found: true},
+		{ip: "10.0.0.1", port: 80, pid: 200, found: true},
+		{ip: "10.0.0.1", port: 443, pid: 100, proc: server, found: true},
+		{ip: "10.0.0.1", port: 8080},
+		{ip: "10.0.0.1", port: 9090},
+		{ip: "10.0.0.1", port: 22},
+	} {
+		pid, proc, found := l.owner(net.ParseIP(tc.ip), tc.port)
+		assert.Equal(t, tc.found, found, "%s:%d", tc.ip, tc.port)
+		assert.Equal(t, tc.pid, pid, "%s:%d", tc.ip, tc.port)
+		assert.Equal(t, tc.proc, proc, "%s:%d", tc.ip, tc.port)
+	}
+
+	// The process that accepts on a listener replaces the known one.
+	l.add(0x7000, net.TCPAddr{IP: net.IPv4zero, Port: 9090}, 400, nil)
+	pid, _, found := l.owner(net.ParseIP("10.0.0.1"), 9090)
+	assert.True(t, found)
+	assert.EqualValues(t, 400, pid)
+}
+
+func TestInferListenerProcess(t *testing.T) {
+	const (
+		listenSock   uintptr = 0xff0000
+		acceptedSock uintptr = 0xff2222
+		listenPort           = 8080
+	)
+	listen := &inetListenCall4{Meta: meta(1234, 1234, 2), Sock: listenSock, LPort: be16(listenPort), Af: unix.AF_INET}
+	accept := &tcpAcceptCall4{Meta: meta(1234, 1234, 3), Sock: listenSock, LPort: be16(listenPort), Af: unix.AF_INET}
+	accepted := &tcpAcceptResult4{
+		Meta:  meta(1234, 1234, 4),
+		Sock:  acceptedSock,
+		LAddr: ipv4(testLocalIP),
+		LPort: be16(listenPort),
+		RAddr: ipv4("192.168.1.1"),
+		RPort: be16(50000),
+		Af:    unix.AF_INET,
+	}
+	// A packet received in softirq context, without a process.
+	received := []event{
+		&tcpV4DoRcv{
+			Meta:  meta(0, 0, 5),
+			Sock:  acceptedSock,
+			Size:  12,
+			LAddr: ipv4(testLocalIP),
+			LPort: be16(listenPort),
+			RAddr: ipv4("192.168.1.1"),
+			RPort: be16(50000),
+		},
+	}
+	for _, tc := range []struct {
+		name     string
+		disabled bool
+		evs      []event
+		pid      int
+		inferred bool
+	}{
+		{
+			name:     "disabled",
+			disabled: true,
+			evs:      append([]event{listen}, received...),
+		},
+		{
+			name:     "accept missed",
+			evs:      append([]event{listen}, received...),
+			pid:      1234,
+			inferred: true,
+		},
+		{
+			name: "accepted",
+			evs:  append([]event{listen, accept, accepted}, received...),
+			pid:  1234,
+		},
+		{
+			name: "listener released",
+			evs: append([]event{listen,
+				&inetReleaseCall{Meta: meta(1234, 1234, 4), Sock: listenSock}},
+				received...),
+		},
+		{
+			name: "other port",
+			evs: append([]event{
+				&inetListenCall4{Meta: meta(1234, 1234, 2), Sock: listenSock, LPort: be16(listenPort + 1), Af: unix.AF_INET},
+			}, received...),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withInferListenerProcess(!tc.disabled)(&st.state)
+			st.feedEvents(append([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/sbin/server"}),
+				&execveRet{Meta: meta(1234, 1234, 1), Retval: 1234},
+			}, tc.evs...))
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			flow := flows[0]
+			attribution, _ := flow.GetValue("process.attribution")
+			if tc.pid == 0 {
+				_, err := flow.GetValue("process.pid")
+				assert.Error(t, err)
+				assert.Nil(t, attribution)
+				return
+			}
+			assertValue(t, flow, tc.pid, "process.pid")
+			assertValue(t, flow, "server", "process.name")
+			assertValue(t, flow, "ingress", "network.direction")
+			if tc.inferred {
+				assert.Equal(t, "inferred", attribution)
+			} else {
+				assert.Nil(t, attribution)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+)
+
+// Default time a flow between local processes is held waiting for the flow
+// for the other end.
+const defaultLocalFlowHoldTime = 2 * time.Second
+
+// localFlows holds the flows between two local processes until the flow for
+// the other end of the connection is reported, so that both are merged into
+// a single event. Flows are only matched within the same network namespace,
+// as the same loopback addresses are used in every namespace. It's accessed
+// when flows are reported, outside the state's mutex.
+type localFlows struct {
+	sync.Mutex
+	// wait is how long a flow is held waiting for the other end.
+	wait time.Duration
+	// pending flows by their network namespace, and local and remote address.
+	pending map[string]*pendingLocalFlow
+}
+
+type pendingLocalFlow struct {
+	f     *flow
+	since time.Time
+}
+
+func newLocalFlows(wait time.Duration) *localFlows {
+	return &localFlows{
+		wait:    wait,
+		pending: make(map[string]*pendingLocalFlow),
+	}
+}
+
+// readNetNS returns the inode number of the network namespace of the given
+// process.
+func readNetNS(pid uint32) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(fmt.Sprintf("/proc/%d/ns/net", pid), &st); err != nil {
+		return 0, err
+	}
+	return st.Ino, nil
+}
+
+// isLocal returns whether both ends of the flow are in this host.
+func (f *flow) isLocal() bool {
+	if (f.proto != protoTCP && f.proto != protoUDP) || !f.hasCompleteTuple() {
+		return false
+	}
+	return f.remote.addr.IP.IsLoopback() || f.remote.addr.IP.Equal(f.local.addr.IP)
+}
+
+// netNS returns the network namespace of the process of the flow, or zero if
+// it's unknown.
+func (f *flow) netNS() uint64 {
+	if f.process == nil {
+		return 0
+	}
+	return f.process.netns
+}
+
+func localFlowKey(netns uint64, proto flowProto, local, remote string) string {
+	return fmt.Sprintf("%d|%s|%s|%s", netns, proto.String(), local, remote)
+}
+
+// match returns the flow for the other end of f in the same network
+// namespace, if it was already reported. Otherwise f is held and a previous
+// flow for the same end, if any, is returned as displaced so that it's
+// reported on its own.
+func (l *localFlows) match(f *flow, now time.Time) (peer, displaced *flow) {
+	netns, local, remote := f.netNS(), f.local.addr.String(), f.remote.addr.String()
+	l.Lock()
+	defer l.Unlock()
+	peerKey := localFlowKey(netns, f.proto, remote, local)
+	if p, found := l.pending[peerKey]; found {
+		delete(l.pending, peerKey)
+		return p.f, nil
+	}
+	key := localFlowKey(netns, f.proto, local, remote)
+	if p, found := l.pending[key]; found {
+		displaced = p.f
+	}
+	l.pending[key] = &pendingLocalFlow{f: f, since: now}
+	return nil, displaced
+}
+
+// expire returns the flows that have been waiting for the other end for too
+// long.
+func (l *localFlows) expire(now time.Time) (flows []*flow) {
+	l.Lock()
+	defer l.Unlock()
+	deadline := now.Add(-l.wait)
+	for key, p := range l.pending {
+		if p.since.Before(deadline) {
+			delete(l.pending, key)
+			flows = append(flows, p.f)
+		}
+	}
+	return flows
+}
+
+// drain returns all the flows waiting for the other end.
+func (l *localFlows) drain() (flows []*flow) {
+	l.Lock()
+	defer l.Unlock()
+	for key, p := range l.pending {
+		delete(l.pending, key)
+		flows = append(flows, p.f)
+	}
+	return flows
+}
+
+// mergeLocalFlows returns a single event for the two ends of a connection
+// between local processes. The event is built from the client's flow, with
+// the processes of both ends as source.process and destination.process.
+func mergeLocalFlows(a, b *flow) (mb.Event, error) {
+	client, server := a, b
+	if a.isInbound() {
+		client, server = b, a
+	}
+	ev, err := client.toEvent(true)
+	if err != nil {
+		return ev, err
+	}
+	for key, f := range map[string]*flow{
+		"source.process":      client,
+		"destination.process": server,
+	} {
+		if process := f.processFields(); process != nil {
+			if _, err = ev.RootFields.Put(key, process); err != nil {
+				return ev, err
+			}
+		}
+	}
+	return ev, nil
+}
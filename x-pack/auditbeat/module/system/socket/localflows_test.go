@@ -0,0 +1,183 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestDedupLocalFlows(t *testing.T) {
+	const (
+		loopback           = "127.0.0.1"
+		clientPort         = 38842
+		serverPort         = 8080
+		clientSock uintptr = 0xff1234
+		serverSock uintptr = 0xff5678
+		clientPID          = 1234
+		serverPID          = 5678
+	)
+	addr := ipv4(loopback)
+	cPort, sPort := be16(clientPort), be16(serverPort)
+	processes := []event{
+		callExecve(meta(clientPID, clientPID, 1), []string{"/usr/bin/curl", "http://localhost:8080/"}),
+		&execveRet{Meta: meta(clientPID, clientPID, 2), Retval: clientPID},
+		callExecve(meta(serverPID, serverPID, 1), []string{"/usr/sbin/nginx"}),
+		&execveRet{Meta: meta(serverPID, serverPID, 2), Retval: serverPID},
+	}
+	client := []event{
+		&inetCreate{Meta: meta(clientPID, clientPID, 5), Proto: 0},
+		&sockInitData{Meta: meta(clientPID, clientPID, 5), Sock: clientSock},
+		&tcpIPv4ConnectCall{Meta: meta(clientPID, clientPID, 8), Sock: clientSock, LAddr: addr, LPort: cPort, RAddr: addr, RPort: sPort},
+		&tcpConnectResult{Meta: meta(clientPID, clientPID, 9), Retval: 0},
+		&inetReleaseCall{Meta: meta(clientPID, clientPID, 15), Sock: clientSock},
+	}
+	server := []event{
+		&tcpAcceptResult4{
+			Meta:  meta(serverPID, serverPID, 10),
+			Sock:  serverSock,
+			LAddr: addr,
+			LPort: sPort,
+			RAddr: addr,
+			RPort: cPort,
+			Af:    unix.AF_INET,
+		},
+		&inetReleaseCall{Meta: meta(serverPID, serverPID, 16), Sock: serverSock},
+	}
+	sameNS := map[uint32]uint64{clientPID: 4026531992, serverPID: 4026531992}
+	for _, tc := range []struct {
+		name    string
+		evs     [][]event
+		netns   map[uint32]uint64
+		enabled bool
+		merged  bool
+		held    bool
+	}{
+		{"connect before accept", [][]event{processes, client, server}, sameNS, true, true, true},
+		{"accept before connect", [][]event{processes, server, client}, sameNS, true, true, true},
+		{"only client", [][]event{processes, client}, sameNS, true, false, true},
+		{
+			"different namespaces", [][]event{processes, client, server},
+			map[uint32]uint64{clientPID: 4026531992, serverPID: 4026532281}, true, false, true,
+		},
+		{"unknown namespace", [][]event{processes, client, server}, nil, true, false, false},
+		{"disabled", [][]event{processes, client, server}, sameNS, false, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withLocalFlowDedup(tc.enabled, 500*time.Millisecond)(&st.state)
+			if tc.enabled {
+				st.readNetNS = func(pid uint32) (uint64, error) {
+					if netns, found := tc.netns[pid]; found {
+						return netns, nil
+					}
+					return 0, os.ErrNotExist
+				}
+			}
+			for _, evs := range tc.evs {
+				st.feedEvents(evs)
+				st.ExpireFlows()
+			}
+			flows := st.getFlows()
+			if !tc.merged {
+				if tc.held {
+					assert.Empty(t, flows)
+					// Reported on its own once the wait for the other end expires.
+					now := time.Now().Add(time.Second)
+					st.clock = func() time.Time { return now }
+					st.ExpireFlows()
+					flows = st.getFlows()
+				}
+				expected := len(tc.evs) - 1
+				if !assert.Len(t, flows, expected) {
+					t.FailNow()
+				}
+				for _, flow := range flows {
+					for _, key := range []string{"source.process", "destination.process"} {
+						_, err := flow.GetValue(key)
+						assert.Error(t, err, key)
+					}
+				}
+				return
+			}
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			flow := flows[0]
+			for field, expected := range map[string]interface{}{
+				"source.port":              clientPort,
+				"destination.port":         serverPort,
+				"network.direction":        "egress",
+				"process.pid":              clientPID,
+				"source.process.pid":       clientPID,
+				"source.process.name":      "curl",
+				"destination.process.pid":  serverPID,
+				"destination.process.name": "nginx",
+			} {
+				assertValue(t, flow, expected, field)
+			}
+			// Nothing is left waiting.
+			now := time.Now().Add(time.Second)
+			st.clock = func() time.Time { return now }
+			st.ExpireFlows()
+			assert.Empty(t, st.getFlows())
+		})
+	}
+}
+
+func TestFlushLocalFlows(t *testing.T) {
+	const sock uintptr = 0xff1234
+	addr := ipv4("127.0.0.1")
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withLocalFlowDedup(true, time.Minute)(&st.state)
+	st.readNetNS = func(uint32) (uint64, error) { return 4026531992, nil }
+	st.feedEvents([]event{
+		callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl"}),
+		&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+		&inetCreate{Meta: meta(1234, 1234, 5), Proto: 0},
+		&sockInitData{Meta: meta(1234, 1234, 5), Sock: sock},
+		&tcpIPv4ConnectCall{Meta: meta(1234, 1234, 8), Sock: sock, LAddr: addr, LPort: be16(38842), RAddr: addr, RPort: be16(8080)},
+		&tcpConnectResult{Meta: meta(1234, 1234, 9), Retval: 0},
+		&inetReleaseCall{Meta: meta(1234, 1234, 15), Sock: sock},
+	})
+	st.ExpireFlows()
+	assert.Empty(t, st.getFlows())
+
+	// Held flows are reported on their own when the dataset stops.
+	st.flushLocalFlows()
+	assert.Len(t, st.getFlows(), 1)
+	assert.Empty(t, st.localFlows.pending)
+}
+
+func TestStopFlushesLocalFlows(t *testing.T) {
+	const sock uintptr = 0xff1234
+	addr := ipv4("127.0.0.1")
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withLocalFlowDedup(true, time.Minute)(&st.state)
+	st.readNetNS = func(uint32) (uint64, error) { return 4026531992, nil }
+	st.feedEvents([]event{
+		callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl"}),
+		&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+		&inetCreate{Meta: meta(1234, 1234, 5), Proto: 0},
+		&sockInitData{Meta: meta(1234, 1234, 5), Sock: sock},
+		&tcpIPv4ConnectCall{Meta: meta(1234, 1234, 8), Sock: sock, LAddr: addr, LPort: be16(38842), RAddr: addr, RPort: be16(8080)},
+		&tcpConnectResult{Meta: meta(1234, 1234, 9), Retval: 0},
+		&inetReleaseCall{Meta: meta(1234, 1234, 15), Sock: sock},
+	})
+	st.runLoop(st.expireLoop)
+
+	// The reporter isn't done, yet held flows are reported by the time Stop
+	// returns, and nothing is reported afterwards.
+	st.Stop()
+	assert.Len(t, st.getFlows(), 1)
+	assert.Empty(t, st.localFlows.pending)
+	st.Stop()
+}
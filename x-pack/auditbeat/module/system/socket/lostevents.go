@@ -0,0 +1,107 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// lostEventsByCPU accumulates the events lost in the ring buffer of each CPU,
+// across the perf channels used by the dataset as it's reopened. Exposed
+// through the monitoring endpoint as system.socket.lost_events_per_cpu.
+type lostEventsByCPU struct {
+	sync.Mutex
+	// counts of the perf channels already closed, by CPU.
+	closed map[int]tracing.LostSamples
+	// perf channel in use. Nil when not running.
+	current *tracing.PerfChannel
+}
+
+var lostEvents lostEventsByCPU
+
+func init() {
+	monitoring.NewFunc(monitoringRegistry, "lost_events_per_cpu", reportLostEvents)
+}
+
+// track starts accounting the events lost by a new perf channel. With
+// replace, the counts of the previous channel are kept, as happens when the
+// channel is reopened. Otherwise the counts are reset.
+func (l *lostEventsByCPU) track(channel *tracing.PerfChannel, replace bool) {
+	l.Lock()
+	defer l.Unlock()
+	if !replace || l.closed == nil {
+		l.closed = make(map[int]tracing.LostSamples)
+	} else {
+		l.foldLocked()
+	}
+	l.current = channel
+}
+
+// stop stops accounting the events lost by the current channel, keeping its
+// counts.
+func (l *lostEventsByCPU) stop() {
+	l.Lock()
+	defer l.Unlock()
+	l.foldLocked()
+	l.current = nil
+}
+
+func (l *lostEventsByCPU) foldLocked() {
+	if l.current != nil {
+		addLostSamples(l.closed, l.current.LostPerCPU())
+	}
+}
+
+func addLostSamples(byCPU map[int]tracing.LostSamples, list []tracing.LostSamples) {
+	for _, lost := range list {
+		total := byCPU[lost.CPU]
+		total.CPU = lost.CPU
+		total.Samples += lost.Samples
+		total.Overflows += lost.Overflows
+		byCPU[lost.CPU] = total
+	}
+}
+
+// counts returns the events lost so far in the ring buffer of each CPU that
+// lost any, ordered by CPU number.
+func (l *lostEventsByCPU) counts() []tracing.LostSamples {
+	l.Lock()
+	defer l.Unlock()
+	byCPU := make(map[int]tracing.LostSamples, len(l.closed))
+	for cpu, lost := range l.closed {
+		byCPU[cpu] = lost
+	}
+	if l.current != nil {
+		addLostSamples(byCPU, l.current.LostPerCPU())
+	}
+	result := make([]tracing.LostSamples, 0, len(byCPU))
+	for _, lost := range byCPU {
+		if lost.Samples > 0 || lost.Overflows > 0 {
+			result = append(result, lost)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CPU < result[j].CPU
+	})
+	return result
+}
+
+func reportLostEvents(_ monitoring.Mode, V monitoring.Visitor) {
+	V.OnRegistryStart()
+	defer V.OnRegistryFinished()
+	for _, lost := range lostEvents.counts() {
+		monitoring.ReportNamespace(V, strconv.Itoa(lost.CPU), func() {
+			monitoring.ReportInt(V, "events", int64(lost.Samples))
+			monitoring.ReportInt(V, "ring_buffers", int64(lost.Overflows))
+		})
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+)
+
+func TestLostEventsByCPU(t *testing.T) {
+	var l lostEventsByCPU
+	l.track(nil, false)
+	// Counts of two channels, as when the perf channel is reopened.
+	addLostSamples(l.closed, []tracing.LostSamples{{CPU: 0}, {CPU: 1, Samples: 10}, {CPU: 5, Overflows: 1}})
+	addLostSamples(l.closed, []tracing.LostSamples{{CPU: 0}, {CPU: 1, Samples: 5}, {CPU: 5}})
+	assert.Equal(t, []tracing.LostSamples{
+		{CPU: 1, Samples: 15},
+		{CPU: 5, Overflows: 1},
+	}, l.counts())
+
+	// A new dataset starts from zero.
+	l.track(nil, false)
+	assert.Empty(t, l.counts())
+}
@@ -0,0 +1,115 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"fmt"
+	"time"
+)
+
+// mptcpSubflow is a subflow of an MPTCP connection whose sock hasn't been
+// seen yet.
+type mptcpSubflow struct {
+	// identifier of the MPTCP connection.
+	id       string
+	lastSeen time.Time
+}
+
+// withMPTCP enables correlating the subflows of MPTCP connections.
+func withMPTCP(enabled bool) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.mptcp = make(map[uintptr]*mptcpSubflow)
+		}
+	}
+}
+
+// Types of the MPTCP path manager events, from include/uapi/linux/mptcp.h,
+// that are reported for a subflow.
+const (
+	mptcpEventCreated        = 1
+	mptcpEventEstablished    = 2
+	mptcpEventSubEstablished = 10
+	mptcpEventSubClosed      = 11
+)
+
+// OnMPTCPEvent associates the subflow ssk with the MPTCP connection msk, of
+// the given token, when the kernel reports an event for one of its subflows.
+// The path manager reports the first subflow before any of its packets is
+// seen, so the association is kept until the subflow's sock is tracked.
+func (s *state) OnMPTCPEvent(typ int32, msk, ssk uintptr, token uint32) error {
+	switch typ {
+	case mptcpEventCreated, mptcpEventEstablished, mptcpEventSubEstablished, mptcpEventSubClosed:
+	default:
+		return nil
+	}
+	if msk == 0 || ssk == 0 || token == 0 {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.mptcp == nil {
+		return nil
+	}
+	id := mptcpConnectionID(token)
+	if sock, found := s.socks[ssk]; found {
+		s.setMPTCPConnection(sock, id)
+		return nil
+	}
+	s.mptcp[ssk] = &mptcpSubflow{id: id, lastSeen: s.clock()}
+	return nil
+}
+
+// OnMPTCPSubflow associates the subflow ssk with the MPTCP connection msk, of
+// the given token, when the subflow is closed. Used when the path manager
+// events aren't available.
+func (s *state) OnMPTCPSubflow(msk, ssk uintptr, token uint32) error {
+	if msk == 0 || ssk == 0 || token == 0 {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.mptcp == nil {
+		return nil
+	}
+	if sock, found := s.socks[ssk]; found {
+		s.setMPTCPConnection(sock, mptcpConnectionID(token))
+	}
+	return nil
+}
+
+// onMPTCPSocket sets the MPTCP connection of a newly tracked sock, when it was
+// reported as a subflow before.
+func (s *state) onMPTCPSocket(sock *socket) {
+	if subflow, found := s.mptcp[sock.sock]; found {
+		sock.mptcpID = subflow.id
+		delete(s.mptcp, sock.sock)
+	}
+}
+
+func (s *state) setMPTCPConnection(sock *socket, id string) {
+	sock.mptcpID = id
+	for _, f := range sock.flows {
+		f.mptcpID = id
+	}
+}
+
+// expireMPTCP forgets the subflows whose sock wasn't seen since the deadline.
+func (s *state) expireMPTCP(deadline time.Time) {
+	for ssk, subflow := range s.mptcp {
+		if subflow.lastSeen.Before(deadline) {
+			delete(s.mptcp, ssk)
+		}
+	}
+}
+
+// mptcpConnectionID returns the identifier of an MPTCP connection, its token
+// in hexadecimal, as shown by ip mptcp monitor. The token is unique among the
+// MPTCP connections of a host.
+func mptcpConnectionID(token uint32) string {
+	return fmt.Sprintf("%08x", token)
+}
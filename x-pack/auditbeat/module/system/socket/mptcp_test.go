@@ -0,0 +1,164 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMPTCPSubflows(t *testing.T) {
+	const (
+		msk  uintptr = 0xff1000
+		ssk1 uintptr = 0xff1234
+		ssk2 uintptr = 0xff5678
+		ssk3 uintptr = 0xff9abc
+
+		token uint32 = 0x5c1a3e07
+	)
+	rAddr, rPort := ipv4("172.19.12.13"), be16(443)
+	subflow := func(sock uintptr, localIP string, localPort uint16, ts uint64) []event {
+		return []event{
+			&tcpIPv4ConnectCall{Meta: meta(1234, 1235, ts), Sock: sock, RAddr: rAddr, RPort: rPort},
+			&ipLocalOutCall{
+				Meta:  meta(1234, 1235, ts),
+				Sock:  sock,
+				Size:  20,
+				LAddr: ipv4(localIP),
+				LPort: be16(localPort),
+				RAddr: rAddr,
+				RPort: rPort,
+			},
+			&tcpConnectResult{Meta: meta(1234, 1235, ts+1), Retval: 0},
+		}
+	}
+	for _, enabled := range []bool{true, false} {
+		st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+		withMPTCP(enabled)(&st.state)
+		var evs []event
+		evs = append(evs, subflow(ssk1, "192.168.33.10", 38842, 10)...)
+		evs = append(evs, subflow(ssk2, "10.0.0.10", 41000, 20)...)
+		evs = append(evs, subflow(ssk3, "192.168.33.10", 38900, 30)...)
+		evs = append(evs,
+			&mptcpCloseSubflow{Meta: meta(1234, 1235, 40), Sock: msk, Subflow: ssk1, Token: token},
+			&mptcpCloseSubflow{Meta: meta(1234, 1235, 41), Sock: msk, Subflow: ssk2, Token: token},
+			// Subflows are only associated with a valid connection.
+			&mptcpCloseSubflow{Meta: meta(1234, 1235, 41), Sock: 0, Subflow: ssk3, Token: token},
+			&mptcpCloseSubflow{Meta: meta(1234, 1235, 41), Sock: msk, Subflow: ssk3, Token: 0},
+			&inetReleaseCall{Meta: meta(1234, 1235, 42), Sock: ssk1},
+			&inetReleaseCall{Meta: meta(1234, 1235, 43), Sock: ssk2},
+			&inetReleaseCall{Meta: meta(1234, 1235, 44), Sock: ssk3},
+		)
+		st.feedEvents(evs)
+		st.ExpireFlows()
+		flows := st.getFlows()
+		if !assert.Len(t, flows, 3) {
+			t.FailNow()
+		}
+		ids := map[string]interface{}{}
+		for _, f := range flows {
+			port, err := f.GetValue("source.port")
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			id, err := f.GetValue("network.mptcp.connection_id")
+			if !enabled || port == 38900 {
+				assert.Error(t, err, port)
+				continue
+			}
+			if assert.NoError(t, err, port) {
+				ids[id.(string)] = port
+			}
+		}
+		if enabled {
+			assert.Len(t, ids, 1)
+			assert.Contains(t, ids, "5c1a3e07")
+		} else {
+			assert.Empty(t, ids)
+		}
+	}
+}
+
+func TestMPTCPSubflowsCreated(t *testing.T) {
+	const (
+		msk  uintptr = 0xff1000
+		ssk1 uintptr = 0xff1234
+		ssk2 uintptr = 0xff5678
+		ssk3 uintptr = 0xff9abc
+		ssk4 uintptr = 0xffdef0
+
+		token uint32 = 0x5c1a3e07
+	)
+	lAddr, lPort := ipv4("192.168.33.10"), be16(443)
+	inbound := func(sock uintptr, remoteIP string, remotePort uint16, ts uint64) event {
+		return &tcpV4DoRcv{
+			Meta:  meta(0, 0, ts),
+			Sock:  sock,
+			Size:  40,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: ipv4(remoteIP),
+			RPort: be16(remotePort),
+		}
+	}
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withMPTCP(true)(&st.state)
+	now := time.Now()
+	st.clock = func() time.Time { return now }
+	// The subflows are created before any of their packets is seen, and are
+	// never closed.
+	st.feedEvents([]event{
+		&mptcpEvent{Meta: meta(0, 0, 10), Type: mptcpEventCreated, Sock: msk, Subflow: ssk1, Token: token},
+		&mptcpEvent{Meta: meta(0, 0, 11), Type: mptcpEventSubEstablished, Sock: msk, Subflow: ssk2, Token: token},
+		// Not an event for a subflow.
+		&mptcpEvent{Meta: meta(0, 0, 12), Type: 3, Sock: msk, Subflow: ssk3, Token: token},
+		// Invalid connections.
+		&mptcpEvent{Meta: meta(0, 0, 12), Type: mptcpEventSubEstablished, Sock: 0, Subflow: ssk3, Token: token},
+		&mptcpEvent{Meta: meta(0, 0, 12), Type: mptcpEventSubEstablished, Sock: msk, Subflow: ssk3, Token: 0},
+		// A subflow whose sock is never seen.
+		&mptcpEvent{Meta: meta(0, 0, 13), Type: mptcpEventSubEstablished, Sock: msk, Subflow: ssk4, Token: token},
+	})
+	// The events don't create sockets.
+	assert.Empty(t, st.socks)
+	st.feedEvents([]event{
+		inbound(ssk1, "172.19.12.13", 38842, 20),
+		inbound(ssk2, "10.0.0.13", 41000, 21),
+		inbound(ssk3, "172.19.12.13", 38900, 22),
+	})
+	now = now.Add(2 * time.Second)
+	st.ExpireFlows()
+	flows := st.getFlows()
+	if !assert.Len(t, flows, 3) {
+		t.FailNow()
+	}
+	ids := map[string]interface{}{}
+	for _, f := range flows {
+		port, err := f.GetValue("source.port")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		id, err := f.GetValue("network.mptcp.connection_id")
+		if port == 38900 {
+			assert.Error(t, err, port)
+			continue
+		}
+		if assert.NoError(t, err, port) {
+			ids[id.(string)] = port
+		}
+	}
+	assert.Len(t, ids, 1)
+	assert.Contains(t, ids, "5c1a3e07")
+	// The subflow that was never seen is forgotten.
+	assert.Empty(t, st.mptcp)
+}
+
+func TestMPTCPConnectionID(t *testing.T) {
+	assert.Equal(t, "5c1a3e07", mptcpConnectionID(0x5c1a3e07))
+	assert.Equal(t, "0000beef", mptcpConnectionID(0xbeef))
+}
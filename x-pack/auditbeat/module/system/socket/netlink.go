@@ -0,0 +1,220 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// maxNetlinkSockets bounds the netlink sockets tracked, in case their release
+// is missed. Sockets created past the limit aren't reported.
+const maxNetlinkSockets = 65536
+
+// netlinkFamilies are the names of the netlink families, which are the
+// protocols of AF_NETLINK sockets, from include/uapi/linux/netlink.h.
+var netlinkFamilies = map[int32]string{
+	0:  "NETLINK_ROUTE",
+	1:  "NETLINK_UNUSED",
+	2:  "NETLINK_USERSOCK",
+	3:  "NETLINK_FIREWALL",
+	4:  "NETLINK_SOCK_DIAG",
+	5:  "NETLINK_NFLOG",
+	6:  "NETLINK_XFRM",
+	7:  "NETLINK_SELINUX",
+	8:  "NETLINK_ISCSI",
+	9:  "NETLINK_AUDIT",
+	10: "NETLINK_FIB_LOOKUP",
+	11: "NETLINK_CONNECTOR",
+	12: "NETLINK_NETFILTER",
+	13: "NETLINK_IP6_FW",
+	14: "NETLINK_DNRTMSG",
+	15: "NETLINK_KOBJECT_UEVENT",
+	16: "NETLINK_GENERIC",
+	18: "NETLINK_SCSITRANSPORT",
+	19: "NETLINK_ECRYPTFS",
+	20: "NETLINK_RDMA",
+	21: "NETLINK_CRYPTO",
+	22: "NETLINK_SMC",
+}
+
+// netlinkFamilyName returns the name of a netlink family.
+func netlinkFamilyName(protocol int32) string {
+	if name, found := netlinkFamilies[protocol]; found {
+		return name
+	}
+	return strconv.Itoa(int(protocol))
+}
+
+// netlinkKey identifies the activity of a process in a netlink family.
+type netlinkKey struct {
+	pid      uint32
+	protocol int32
+}
+
+// netlinkActivity holds the netlink sockets created and the messages sent by
+// a process in a family since it was last reported.
+type netlinkActivity struct {
+	key netlinkKey
+	// process as last seen, nil when unknown.
+	process             *process
+	firstSeen, lastSeen time.Time
+	sockets             uint64
+	messages, bytes     uint64
+}
+
+// netlinkTable accounts the activity of netlink sockets between reports. It's
+// protected by the state's mutex.
+type netlinkTable struct {
+	// protocols of the tracked sockets, by struct socket*.
+	socks    map[uintptr]int32
+	activity map[netlinkKey]*netlinkActivity
+}
+
+func newNetlinkTable() *netlinkTable {
+	return &netlinkTable{
+		socks:    make(map[uintptr]int32),
+		activity: make(map[netlinkKey]*netlinkActivity),
+	}
+}
+
+// get returns the activity of a process in a family, created if needed.
+func (t *netlinkTable) get(pid uint32, protocol int32, proc *process, now time.Time) *netlinkActivity {
+	key := netlinkKey{pid: pid, protocol: protocol}
+	a, found := t.activity[key]
+	if !found {
+		a = &netlinkActivity{key: key, firstSeen: now}
+		t.activity[key] = a
+	}
+	if proc != nil {
+		a.process = proc
+	}
+	a.lastSeen = now
+	return a
+}
+
+// collect returns the activity since the last call and resets the table, so
+// that idle processes aren't reported. The tracked sockets are kept.
+func (t *netlinkTable) collect() []*netlinkActivity {
+	list := make([]*netlinkActivity, 0, len(t.activity))
+	for _, a := range t.activity {
+		list = append(list, a)
+	}
+	t.activity = make(map[netlinkKey]*netlinkActivity)
+	return list
+}
+
+// withNetlink enables reporting the activity of netlink sockets.
+func withNetlink(enabled bool) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.netlink = newNetlinkTable()
+		}
+	}
+}
+
+// OnNetlinkCreate records a netlink socket created by a process.
+func (s *state) OnNetlinkCreate(sock uintptr, protocol int32, pid uint32, ts kernelTime) error {
+	if s.netlink == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	t := s.netlink
+	if _, found := t.socks[sock]; !found && len(t.socks) >= maxNetlinkSockets {
+		return nil
+	}
+	t.socks[sock] = protocol
+	t.get(pid, protocol, s.processes[pid], s.kernTimestampToTime(ts)).sockets++
+	return nil
+}
+
+// OnNetlinkSend accounts a message sent on a netlink socket. The process is
+// the sender, which can differ from the creator of an inherited socket.
+// Messages sent on sockets that aren't tracked are ignored, as their family
+// is unknown.
+func (s *state) OnNetlinkSend(sock uintptr, size uint64, pid uint32, ts kernelTime) error {
+	if s.netlink == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	protocol, found := s.netlink.socks[sock]
+	if !found {
+		return nil
+	}
+	a := s.netlink.get(pid, protocol, s.processes[pid], s.kernTimestampToTime(ts))
+	a.messages++
+	a.bytes += size
+	return nil
+}
+
+// OnNetlinkRelease forgets a netlink socket once it's closed.
+func (s *state) OnNetlinkRelease(sock uintptr) error {
+	if s.netlink == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	delete(s.netlink.socks, sock)
+	return nil
+}
+
+func (s *state) netlinkLoop() {
+	ticker := time.NewTicker(s.inactiveTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.reporter.Done():
+			return
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.reportNetlink()
+		}
+	}
+}
+
+// reportNetlink sends an event for each process and netlink family that saw
+// activity since the last report.
+func (s *state) reportNetlink() {
+	s.Lock()
+	activity := s.netlink.collect()
+	s.Unlock()
+	for _, a := range activity {
+		s.reporter.Event(netlinkEvent(a))
+	}
+}
+
+func netlinkEvent(a *netlinkActivity) mb.Event {
+	f := flow{pid: a.key.pid, process: a.process}
+	return mb.Event{
+		RootFields: mapstr.M{
+			"event": mapstr.M{
+				"kind":     "event",
+				"action":   "netlink_activity",
+				"category": []string{"network"},
+				"type":     []string{"info"},
+				"start":    a.firstSeen,
+				"end":      a.lastSeen,
+			},
+			"process": f.processFields(),
+		},
+		MetricSetFields: mapstr.M{
+			"netlink": mapstr.M{
+				"family":   netlinkFamilyName(a.key.protocol),
+				"protocol": a.key.protocol,
+				"sockets":  a.sockets,
+				"messages": a.messages,
+				"bytes":    a.bytes,
+			},
+		},
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+)
+
+func TestNetlink(t *testing.T) {
+	const (
+		routeSock   uintptr = 0xff1000
+		nfSock      uintptr = 0xff2000
+		unknownSock uintptr = 0xff3000
+	)
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withNetlink(true)(&st.state)
+
+	st.feedEvents([]event{
+		callExecve(meta(1234, 1234, 1), []string{"/usr/sbin/ip", "route", "add", "10.0.0.0/8"}),
+		&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+		&netlinkCreate{Meta: meta(1234, 1234, 3), Sock: routeSock, Protocol: 0},
+		&netlinkSendMsg{Meta: meta(1234, 1234, 4), Sock: routeSock, Size: 36},
+		&netlinkSendMsg{Meta: meta(1234, 1234, 5), Sock: routeSock, Size: 52},
+		&netlinkRelease{Meta: meta(1234, 1234, 6), Sock: routeSock},
+		// Not tracked anymore.
+		&netlinkSendMsg{Meta: meta(1234, 1234, 7), Sock: routeSock, Size: 1000},
+		// Created before the dataset started.
+		&netlinkSendMsg{Meta: meta(1234, 1234, 8), Sock: unknownSock, Size: 1000},
+		// A process that isn't known.
+		&netlinkCreate{Meta: meta(4321, 4321, 9), Sock: nfSock, Protocol: 12},
+		&netlinkSendMsg{Meta: meta(4321, 4321, 10), Sock: nfSock, Size: 20},
+	})
+
+	netlinkEvents := func() map[string]beat.Event {
+		st.getFlows()
+		st.reportNetlink()
+		evs := make(map[string]beat.Event)
+		for _, ev := range st.getFlows() {
+			family, _ := ev.GetValue("system.socket.netlink.family")
+			evs[family.(string)] = ev
+		}
+		return evs
+	}
+	evs := netlinkEvents()
+	if !assert.Len(t, evs, 2) {
+		t.FailNow()
+	}
+	for field, expected := range map[string]interface{}{
+		"event.action":                   "netlink_activity",
+		"event.kind":                     "event",
+		"process.pid":                    1234,
+		"process.name":                   "ip",
+		"system.socket.netlink.protocol": int32(0),
+		"system.socket.netlink.sockets":  uint64(1),
+		"system.socket.netlink.messages": uint64(2),
+		"system.socket.netlink.bytes":    uint64(88),
+		"system.socket.netlink.family":   "NETLINK_ROUTE",
+		"event.category":                 []string{"network"},
+	} {
+		assertValue(t, evs["NETLINK_ROUTE"], expected, field)
+	}
+	nf := evs["NETLINK_NETFILTER"]
+	assertValue(t, nf, 4321, "process.pid")
+	assertValue(t, nf, uint64(20), "system.socket.netlink.bytes")
+	_, err := nf.GetValue("process.name")
+	assert.Error(t, err)
+
+	// Idle processes aren't reported again, but open sockets are still
+	// tracked.
+	assert.Empty(t, netlinkEvents())
+	st.feedEvents([]event{
+		&netlinkSendMsg{Meta: meta(4321, 4321, 11), Sock: nfSock, Size: 40},
+	})
+	evs = netlinkEvents()
+	if assert.Len(t, evs, 1) {
+		assertValue(t, evs["NETLINK_NETFILTER"], uint64(0), "system.socket.netlink.sockets")
+		assertValue(t, evs["NETLINK_NETFILTER"], uint64(1), "system.socket.netlink.messages")
+	}
+	assert.Equal(t, "NETLINK_GENERIC", netlinkFamilyName(16))
+	assert.Equal(t, "99", netlinkFamilyName(99))
+}
@@ -0,0 +1,33 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseNSpid parses the value of the NSpid field of /proc/<pid>/status and
+// returns its last PID, which is the PID in the innermost namespace. The
+// first one is the PID in the namespace of procfs, so zero is returned when
+// there is only one.
+func parseNSpid(value string) (uint32, error) {
+	pids := strings.Fields(value)
+	if len(pids) == 0 {
+		return 0, errors.New("empty NSpid field")
+	}
+	if len(pids) == 1 {
+		return 0, nil
+	}
+	pid, err := strconv.ParseUint(pids[len(pids)-1], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid NSpid field '%s': %w", value, err)
+	}
+	return uint32(pid), nil
+}
@@ -0,0 +1,39 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNSpid(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		value    string
+		expected uint32
+		err      bool
+	}{
+		{"host namespace", "\t4242", 0, false},
+		{"container", "\t4242\t7", 7, false},
+		{"nested", "\t4242\t310\t1", 1, false},
+		{"empty", "", 0, true},
+		{"invalid", "\t4242\tabc", 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pid, err := parseNSpid(tc.value)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.expected, pid)
+			}
+		})
+	}
+}
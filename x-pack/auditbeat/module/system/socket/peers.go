@@ -0,0 +1,173 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"time"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// listenerKey identifies a local service that accepts flows.
+type listenerKey struct {
+	proto flowProto
+	port  int
+	pid   uint32
+}
+
+// listenerPeers holds the remote addresses seen by a service within the
+// window.
+type listenerPeers struct {
+	process *process
+	// last time each remote IP was seen.
+	peers map[string]time.Time
+	// last time a new peer was dropped because the cap was reached.
+	cappedAt time.Time
+}
+
+// peerCounter counts the distinct remote IPs of the inbound flows of each
+// local service over a sliding window. Memory is bounded by keeping at most
+// maxPeers addresses per service. It's protected by the state's mutex.
+type peerCounter struct {
+	window    time.Duration
+	maxPeers  int
+	listeners map[listenerKey]*listenerPeers
+}
+
+// peerCount is the number of distinct peers of a service.
+type peerCount struct {
+	key     listenerKey
+	process *process
+	count   int
+	capped  bool
+}
+
+func newPeerCounter(window time.Duration, maxPeers int) *peerCounter {
+	return &peerCounter{
+		window:    window,
+		maxPeers:  maxPeers,
+		listeners: make(map[listenerKey]*listenerPeers),
+	}
+}
+
+// add records the remote address of an inbound flow.
+func (c *peerCounter) add(f *flow, now time.Time) {
+	if f.remote.addr.IP == nil || f.local.addr.Port == 0 {
+		return
+	}
+	key := listenerKey{proto: f.proto, port: f.local.addr.Port, pid: f.pid}
+	l, found := c.listeners[key]
+	if !found {
+		l = &listenerPeers{peers: make(map[string]time.Time)}
+		c.listeners[key] = l
+	}
+	if f.process != nil {
+		l.process = f.process
+	}
+	ip := f.remote.addr.IP.String()
+	if _, found := l.peers[ip]; !found && len(l.peers) >= c.maxPeers {
+		l.cappedAt = now
+		return
+	}
+	l.peers[ip] = now
+}
+
+// collect returns the number of distinct peers seen by each service within
+// the window ending at now. Peers and services not seen within the window are
+// removed.
+func (c *peerCounter) collect(now time.Time) (counts []peerCount) {
+	deadline := now.Add(-c.window)
+	for key, l := range c.listeners {
+		for ip, lastSeen := range l.peers {
+			if lastSeen.Before(deadline) {
+				delete(l.peers, ip)
+			}
+		}
+		if len(l.peers) == 0 {
+			delete(c.listeners, key)
+			continue
+		}
+		counts = append(counts, peerCount{
+			key:     key,
+			process: l.process,
+			count:   len(l.peers),
+			capped:  !l.cappedAt.Before(deadline),
+		})
+	}
+	return counts
+}
+
+// withPeerCounting enables counting the distinct remote IPs of each local
+// service over the given window.
+func withPeerCounting(window time.Duration, maxPeers int) stateOption {
+	return func(s *state) {
+		if window > 0 {
+			s.peers = newPeerCounter(window, maxPeers)
+		}
+	}
+}
+
+func (s *state) peerCountLoop() {
+	ticker := time.NewTicker(s.peers.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.reporter.Done():
+			return
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.reportPeerCounts()
+		}
+	}
+}
+
+// reportPeerCounts sends an event with the number of distinct peers of each
+// local service seen within the window.
+func (s *state) reportPeerCounts() {
+	s.Lock()
+	counts := s.peers.collect(s.clock())
+	events := make([]mb.Event, 0, len(counts))
+	for _, c := range counts {
+		events = append(events, s.peerCountEvent(c))
+	}
+	s.Unlock()
+	for _, ev := range events {
+		s.reporter.Event(ev)
+	}
+}
+
+func (s *state) peerCountEvent(c peerCount) mb.Event {
+	root := mapstr.M{
+		"event": mapstr.M{
+			"kind":     "metric",
+			"action":   "network_peer_count",
+			"category": []string{"network"},
+			"type":     []string{"info"},
+		},
+		"network": mapstr.M{
+			"transport": c.key.proto.String(),
+		},
+		"server": mapstr.M{
+			"port": c.key.port,
+		},
+	}
+	owner := flow{pid: c.key.pid, process: c.process}
+	if process := owner.processFields(); process != nil {
+		root["process"] = process
+	}
+	return mb.Event{
+		RootFields: root,
+		MetricSetFields: mapstr.M{
+			"peers": mapstr.M{
+				"count":  c.count,
+				"capped": c.capped,
+			},
+		},
+	}
+}
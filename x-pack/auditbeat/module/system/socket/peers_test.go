@@ -0,0 +1,85 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+)
+
+func TestPeerCount(t *testing.T) {
+	const (
+		serverPID = 5678
+		port      = 8080
+		window    = time.Minute
+	)
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withPeerCounting(window, 2)(&st.state)
+	now := time.Now()
+	st.clock = func() time.Time { return now }
+
+	accept := func(sock uintptr, remote string, ts uint64) []event {
+		return []event{
+			&tcpAcceptResult4{
+				Meta:  meta(serverPID, serverPID, ts),
+				Sock:  sock,
+				LAddr: ipv4("10.0.0.1"),
+				LPort: be16(port),
+				RAddr: ipv4(remote),
+				RPort: be16(40000 + uint16(sock&0xff)),
+				Af:    unix.AF_INET,
+			},
+		}
+	}
+	st.feedEvents([]event{
+		callExecve(meta(serverPID, serverPID, 1), []string{"/usr/sbin/nginx"}),
+		&execveRet{Meta: meta(serverPID, serverPID, 2), Retval: serverPID},
+	})
+	st.feedEvents(accept(0xff01, "192.168.1.1", 3))
+	st.feedEvents(accept(0xff02, "192.168.1.1", 4))
+	st.feedEvents(accept(0xff03, "192.168.1.2", 5))
+
+	peerEvents := func() []beat.Event {
+		st.getFlows()
+		st.reportPeerCounts()
+		return st.getFlows()
+	}
+	evs := peerEvents()
+	if !assert.Len(t, evs, 1) {
+		t.FailNow()
+	}
+	for field, expected := range map[string]interface{}{
+		"event.action":               "network_peer_count",
+		"event.kind":                 "metric",
+		"network.transport":          "tcp",
+		"server.port":                port,
+		"process.pid":                serverPID,
+		"process.name":               "nginx",
+		"system.socket.peers.count":  2,
+		"system.socket.peers.capped": false,
+	} {
+		assertValue(t, evs[0], expected, field)
+	}
+
+	// A third distinct peer exceeds the cap.
+	st.feedEvents(accept(0xff04, "192.168.1.3", 6))
+	evs = peerEvents()
+	if assert.Len(t, evs, 1) {
+		assertValue(t, evs[0], 2, "system.socket.peers.count")
+		assertValue(t, evs[0], true, "system.socket.peers.capped")
+	}
+
+	// Peers not seen within the window are forgotten.
+	now = now.Add(2 * window)
+	assert.Empty(t, peerEvents())
+	assert.Empty(t, st.state.peers.listeners)
+}
@@ -0,0 +1,129 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+	"github.com/elastic/go-perf"
+)
+
+var (
+	// Attempts to reopen the perf channel after an error, and those of them
+	// that failed.
+	perfReopenAttempts = monitoring.NewUint(monitoringRegistry, "perf_reopen_attempts")
+	perfReopenFailures = monitoring.NewUint(monitoringRegistry, "perf_reopen_failures")
+)
+
+// monitoredProbe is a probe monitored by the perf channel, kept so that it
+// can be monitored again by a reopened channel.
+type monitoredProbe struct {
+	format  tracing.ProbeFormat
+	decoder tracing.Decoder
+}
+
+// newPerfChannel creates a perf channel with the configured settings.
+func (m *MetricSet) newPerfChannel() (*tracing.PerfChannel, error) {
+	return tracing.NewPerfChannel(
+		tracing.WithBufferSize(m.config.PerfQueueSize),
+		tracing.WithErrBufferSize(m.config.ErrQueueSize),
+		tracing.WithLostBufferSize(m.config.LostQueueSize),
+		tracing.WithRingSizeExponent(m.config.ringSizeExponent()),
+		tracing.WithTID(perf.AllThreads),
+		tracing.WithTimestamp())
+}
+
+// reopenPerfChannel replaces the perf channel with a new one monitoring the
+// same probes. The kprobes themselves are left installed. On failure, the
+// closed channel is kept.
+func (m *MetricSet) reopenPerfChannel() error {
+	if err := m.perfChannel.Close(); err != nil {
+		m.log.Warnf("Failed to close perf channel: %v", err)
+	}
+	channel, err := m.newPerfChannel()
+	if err != nil {
+		return fmt.Errorf("unable to create perf channel: %w", err)
+	}
+	for _, probe := range m.monitored {
+		if err = channel.MonitorProbe(probe.format, probe.decoder); err != nil {
+			channel.Close()
+			return fmt.Errorf("unable to monitor probe %s: %w", probe.format.Probe.String(), err)
+		}
+	}
+	if err = channel.Run(); err != nil {
+		channel.Close()
+		return fmt.Errorf("unable to start perf channel: %w", err)
+	}
+	m.perfChannel = channel
+	lostEvents.track(channel, true)
+	return nil
+}
+
+// perfReopener bounds the attempts to reopen the perf channel after errors.
+// The budget is for consecutive attempts: it's restored once the reopened
+// channel delivers an event.
+type perfReopener struct {
+	log      helper.Logger
+	retries  int
+	backoff  time.Duration
+	attempts int
+	// wait waits for the given time, returning false if done is closed first.
+	wait func(d time.Duration, done <-chan struct{}) bool
+}
+
+func newPerfReopener(log helper.Logger, retries int, backoff time.Duration) *perfReopener {
+	return &perfReopener{
+		log:     log,
+		retries: retries,
+		backoff: backoff,
+		wait:    waitOrDone,
+	}
+}
+
+func waitOrDone(d time.Duration, done <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// reopen calls open until it succeeds, waiting an exponentially increasing
+// time before every attempt. It returns false when the budget is exhausted or
+// done is closed.
+func (r *perfReopener) reopen(done <-chan struct{}, open func() error) bool {
+	for r.attempts < r.retries {
+		backoff := r.backoff << r.attempts
+		r.attempts++
+		perfReopenAttempts.Inc()
+		r.log.Warnf("Reopening perf channel in %v (attempt %d of %d)", backoff, r.attempts, r.retries)
+		if !r.wait(backoff, done) {
+			return false
+		}
+		if err := open(); err != nil {
+			perfReopenFailures.Inc()
+			r.log.Errorf("Failed to reopen perf channel: %v", err)
+			continue
+		}
+		r.log.Infof("Perf channel reopened")
+		return true
+	}
+	r.log.Errorf("Giving up after %d attempts to reopen the perf channel", r.retries)
+	return false
+}
+
+// received restores the budget once the channel is working.
+func (r *perfReopener) received() {
+	r.attempts = 0
+}
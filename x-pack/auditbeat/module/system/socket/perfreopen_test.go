@@ -0,0 +1,59 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPerfReopener(t *testing.T) {
+	var waits []time.Duration
+	r := newPerfReopener((*logWrapper)(t), 3, 10*time.Millisecond)
+	r.wait = func(d time.Duration, _ <-chan struct{}) bool {
+		waits = append(waits, d)
+		return true
+	}
+	fails := 0
+	open := func() error {
+		if fails > 0 {
+			fails--
+			return errors.New("perf_event_open: too many open files")
+		}
+		return nil
+	}
+	done := make(chan struct{})
+
+	// Succeeds on the second attempt.
+	fails = 1
+	assert.True(t, r.reopen(done, open))
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, waits)
+
+	// The remaining attempt of the budget.
+	waits = nil
+	fails = 1
+	assert.False(t, r.reopen(done, open))
+	assert.Equal(t, []time.Duration{40 * time.Millisecond}, waits)
+
+	// The budget is restored once events are received.
+	r.received()
+	waits = nil
+	assert.True(t, r.reopen(done, open))
+	assert.Equal(t, []time.Duration{10 * time.Millisecond}, waits)
+
+	// Terminated while waiting.
+	r.received()
+	r.wait = waitOrDone
+	close(done)
+	assert.False(t, r.reopen(done, func() error {
+		t.Fatal("reopened after termination")
+		return nil
+	}))
+}
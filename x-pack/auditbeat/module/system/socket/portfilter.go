@@ -0,0 +1,126 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package socket
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Maximum number of excluded ports that are filtered in the kernel. Each one
+// adds conditions to the filter of every probe that fetches ports, which has
+// a limited size.
+const maxKernelExcludedPorts = 8
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	first, last uint16
+}
+
+func (r portRange) contains(port int) bool {
+	return port >= int(r.first) && port <= int(r.last)
+}
+
+// parsePortRange parses a port ("80") or a range of ports ("8000-9000").
+func parsePortRange(s string) (r portRange, err error) {
+	first, last, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if r.first, err = parsePort(strings.TrimSpace(first)); err != nil {
+		return r, err
+	}
+	r.last = r.first
+	if isRange {
+		if r.last, err = parsePort(strings.TrimSpace(last)); err != nil {
+			return r, err
+		}
+		if r.last < r.first {
+			return r, fmt.Errorf("invalid port range '%s': %d is lower than %d", s, r.last, r.first)
+		}
+	}
+	return r, nil
+}
+
+func parsePortRanges(list []string) ([]portRange, error) {
+	ranges := make([]portRange, 0, len(list))
+	for _, s := range list {
+		r, err := parsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// portFilter selects flows by their local or remote port.
+type portFilter struct {
+	include, exclude []portRange
+}
+
+// newPortFilter returns a filter for the given include and exclude lists, or
+// nil if both are empty.
+func newPortFilter(include, exclude []string) (*portFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	var (
+		f   portFilter
+		err error
+	)
+	if f.include, err = parsePortRanges(include); err != nil {
+		return nil, fmt.Errorf("invalid socket.include_ports: %w", err)
+	}
+	if f.exclude, err = parsePortRanges(exclude); err != nil {
+		return nil, fmt.Errorf("invalid socket.exclude_ports: %w", err)
+	}
+	return &f, nil
+}
+
+// matches returns if a flow with the given ports must be reported. A flow
+// matches a range when either of its ports is in the range. Zero is used
+// for an unknown port.
+func (f *portFilter) matches(local, remote int) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.include) > 0 && !anyContains(f.include, local, remote) {
+		return false
+	}
+	return !anyContains(f.exclude, local, remote)
+}
+
+func anyContains(ranges []portRange, ports ...int) bool {
+	for _, r := range ranges {
+		for _, port := range ports {
+			if port != 0 && r.contains(port) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// kernelExcludedPorts returns the excluded ports that can be filtered in the
+// kernel. Ports are fetched in network byte order, so ranges can't be
+// compared and only single ports are returned.
+func (f *portFilter) kernelExcludedPorts() (ports []uint16) {
+	if f == nil {
+		return nil
+	}
+	for _, r := range f.exclude {
+		if r.first == r.last && len(ports) < maxKernelExcludedPorts {
+			ports = append(ports, r.first)
+		}
+	}
+	return ports
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port number '%s'", s)
+	}
+	return uint16(port), nil
+}
@@ -0,0 +1,80 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package socket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortRange(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected portRange
+		err      bool
+	}{
+		{input: "80", expected: portRange{80, 80}},
+		{input: "8000-9000", expected: portRange{8000, 9000}},
+		{input: " 1 - 1024 ", expected: portRange{1, 1024}},
+		{input: "443-443", expected: portRange{443, 443}},
+		{input: "9000-8000", err: true},
+		{input: "0", err: true},
+		{input: "65536", err: true},
+		{input: "http", err: true},
+		{input: "80-", err: true},
+		{input: "", err: true},
+	} {
+		r, err := parsePortRange(tc.input)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+			continue
+		}
+		assert.NoError(t, err, tc.input)
+		assert.Equal(t, tc.expected, r, tc.input)
+	}
+}
+
+func TestPortFilter(t *testing.T) {
+	f, err := newPortFilter(nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+	assert.True(t, f.matches(38842, 443))
+	assert.Empty(t, f.kernelExcludedPorts())
+
+	_, err = newPortFilter([]string{"80", "x"}, nil)
+	assert.Error(t, err)
+
+	f, err = newPortFilter([]string{"443", "8000-9000"}, []string{"8443", "8080-8089"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, tc := range []struct {
+		local, remote int
+		expected      bool
+	}{
+		{38842, 443, true},
+		{443, 38842, true},
+		{38842, 8500, true},
+		{0, 443, true},
+		{38842, 80, false},
+		{38842, 8443, false},
+		{38842, 8085, false},
+		// Excluded takes precedence over included.
+		{8443, 8500, false},
+		{0, 0, false},
+	} {
+		assert.Equal(t, tc.expected, f.matches(tc.local, tc.remote), "local=%d remote=%d", tc.local, tc.remote)
+	}
+	// Ranges can't be filtered in the kernel.
+	assert.Equal(t, []uint16{8443}, f.kernelExcludedPorts())
+
+	f, err = newPortFilter(nil, []string{"22"})
+	if assert.NoError(t, err) {
+		assert.True(t, f.matches(38842, 443))
+		assert.True(t, f.matches(0, 0))
+		assert.False(t, f.matches(22, 38842))
+	}
+}
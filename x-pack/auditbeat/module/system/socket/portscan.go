@@ -0,0 +1,209 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// portScans counts the inbound connection requests (SYNs) from each remote
+// address over a window, and holds the inbound half-open flows from the
+// addresses that sent them until the window ends. When a remote address
+// attempted connections to enough distinct local ports within the window, a
+// single event is sent instead of its flows. Flows from addresses that sent no
+// SYN within the window, such as connections established before the dataset
+// started, are never held. Memory is bounded by tracking at most maxSources
+// remote addresses and holding at most maxHeld flows. It's accessed when flows
+// are reported, outside the state's mutex.
+type portScans struct {
+	sync.Mutex
+	window              time.Duration
+	minPorts            int
+	maxSources, maxHeld int
+	// number of flows held across all the remote addresses.
+	held    int
+	sources map[string]*scanSource
+}
+
+// scanSource holds the connection requests and inbound half-open flows from a
+// remote address.
+type scanSource struct {
+	first, last time.Time
+	localIP     string
+	ports       map[int]struct{}
+	attempts    int
+	// flows held until the window ends. Discarded once the address is
+	// considered to be scanning.
+	held []*flow
+}
+
+// portScan is a suspected port scan from a remote address.
+type portScan struct {
+	remoteIP, localIP string
+	first, last       time.Time
+	ports, attempts   int
+}
+
+func newPortScans(window time.Duration, minPorts, maxSources, maxHeld int) *portScans {
+	return &portScans{
+		window:     window,
+		minPorts:   minPorts,
+		maxSources: maxSources,
+		maxHeld:    maxHeld,
+		sources:    make(map[string]*scanSource),
+	}
+}
+
+// isHalfOpenInbound returns whether the flow is an inbound TCP connection
+// attempt that was never accepted.
+func (f *flow) isHalfOpenInbound() bool {
+	return f.proto == protoTCP && !f.complete && f.isInbound() &&
+		f.remote.addr.IP != nil && f.local.addr.Port != 0
+}
+
+// request records a connection request from a remote address to a local
+// port. Requests from new addresses are ignored once maxSources addresses are
+// tracked.
+func (p *portScans) request(local, remote endpoint, now time.Time) {
+	key := remote.addr.IP.String()
+	p.Lock()
+	defer p.Unlock()
+	src, found := p.sources[key]
+	if !found {
+		if len(p.sources) >= p.maxSources {
+			return
+		}
+		src = &scanSource{
+			first: now,
+			ports: make(map[int]struct{}),
+		}
+		if local.addr.IP != nil {
+			src.localIP = local.addr.IP.String()
+		}
+		p.sources[key] = src
+	}
+	src.last = now
+	src.attempts++
+	src.ports[local.addr.Port] = struct{}{}
+	if len(src.ports) >= p.minPorts {
+		p.held -= len(src.held)
+		src.held = nil
+	}
+}
+
+// hold keeps a half-open flow until the window for its remote address ends.
+// It returns false when the flow isn't held, because its remote address sent
+// no connection request within the window or maxHeld was reached, and it must
+// be reported right away.
+func (p *portScans) hold(f *flow) bool {
+	p.Lock()
+	defer p.Unlock()
+	src, found := p.sources[f.remote.addr.IP.String()]
+	if !found {
+		return false
+	}
+	if len(src.ports) >= p.minPorts {
+		// Part of a scan, discarded.
+		return true
+	}
+	if p.held >= p.maxHeld {
+		return false
+	}
+	src.held = append(src.held, f)
+	p.held++
+	return true
+}
+
+// expire returns the suspected port scans whose window has ended, and the
+// flows held for remote addresses that didn't reach the threshold.
+func (p *portScans) expire(now time.Time) (scans []portScan, flows []*flow) {
+	p.Lock()
+	defer p.Unlock()
+	deadline := now.Add(-p.window)
+	for key, src := range p.sources {
+		if src.first.After(deadline) {
+			continue
+		}
+		delete(p.sources, key)
+		p.held -= len(src.held)
+		if len(src.ports) < p.minPorts {
+			flows = append(flows, src.held...)
+			continue
+		}
+		scans = append(scans, portScan{
+			remoteIP: key,
+			localIP:  src.localIP,
+			first:    src.first,
+			last:     src.last,
+			ports:    len(src.ports),
+			attempts: src.attempts,
+		})
+	}
+	return scans, flows
+}
+
+func (s portScan) toEvent() mb.Event {
+	root := mapstr.M{
+		"event": mapstr.M{
+			"kind":     "alert",
+			"action":   "port_scan_suspected",
+			"category": []string{"network", "intrusion_detection"},
+			"type":     []string{"info"},
+			"start":    s.first,
+			"end":      s.last,
+			"duration": s.last.Sub(s.first).Nanoseconds(),
+		},
+		"source": mapstr.M{
+			"ip": s.remoteIP,
+		},
+		"network": mapstr.M{
+			"direction": directionIngress.String(),
+			"transport": protoTCP.String(),
+		},
+		"related": mapstr.M{
+			"ip": []string{s.remoteIP},
+		},
+	}
+	if s.localIP != "" {
+		root["destination"] = mapstr.M{"ip": s.localIP}
+		root["related"] = mapstr.M{"ip": []string{s.remoteIP, s.localIP}}
+	}
+	return mb.Event{
+		RootFields: root,
+		MetricSetFields: mapstr.M{
+			"port_scan": mapstr.M{
+				"ports":    s.ports,
+				"attempts": s.attempts,
+			},
+		},
+	}
+}
+
+// OnConnRequest records an inbound TCP connection request, to detect port
+// scans.
+func (s *state) OnConnRequest(local, remote endpoint) error {
+	if s.portScans != nil && remote.addr.IP != nil && local.addr.Port != 0 {
+		s.portScans.request(local, remote, s.clock())
+	}
+	return nil
+}
+
+// withPortScanDetection enables grouping the inbound half-open flows from
+// remote addresses that attempt connections to at least minPorts distinct
+// local ports within the window. At most maxSources remote addresses are
+// tracked and maxHeld flows held at a time.
+func withPortScanDetection(enabled bool, window time.Duration, minPorts, maxSources, maxHeld int) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.portScans = newPortScans(window, minPorts, maxSources, maxHeld)
+		}
+	}
+}
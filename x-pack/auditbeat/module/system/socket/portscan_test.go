@@ -0,0 +1,213 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	scanLocalIP    = "192.168.33.10"
+	scanRemotePort = 51234
+	scanListener   = uintptr(0xff00)
+)
+
+// scanSYN returns the event for a SYN received from remote to a local port.
+// The packet has an Ethernet header in front of the IP header.
+func scanSYN(remote string, localPort uint16, ts uint64) event {
+	const ipHdr, tcpHdr = 14, 34
+	e := &tcpV4ConnRequest{
+		Meta:   meta(0, 0, ts),
+		Sock:   scanListener,
+		IPHdr:  ipHdr,
+		TCPHdr: tcpHdr,
+	}
+	e.Packet[ipHdr] = 0x45
+	copy(e.Packet[ipHdr+12:], net.ParseIP(remote).To4())
+	copy(e.Packet[ipHdr+16:], net.ParseIP(scanLocalIP).To4())
+	binary.BigEndian.PutUint16(e.Packet[tcpHdr:], scanRemotePort)
+	binary.BigEndian.PutUint16(e.Packet[tcpHdr+2:], localPort)
+	return e
+}
+
+// scanPacket returns the event for a packet received on a sock from remote
+// that was never accepted.
+func scanPacket(sock uintptr, remote string, localPort uint16, ts uint64) event {
+	return &tcpV4DoRcv{
+		Meta:  meta(0, 0, ts),
+		Sock:  sock,
+		Size:  40,
+		LAddr: ipv4(scanLocalIP),
+		LPort: be16(localPort),
+		RAddr: ipv4(remote),
+		RPort: be16(scanRemotePort),
+	}
+}
+
+func TestPortScanDetection(t *testing.T) {
+	const (
+		scannerIP = "10.0.0.66"
+		clientIP  = "10.0.0.7"
+		window    = 10 * time.Second
+	)
+	for _, enabled := range []bool{true, false} {
+		st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+		withPortScanDetection(enabled, window, 3, 100, 100)(&st.state)
+		now := time.Now()
+		st.clock = func() time.Time { return now }
+		st.feedEvents([]event{
+			scanSYN(scannerIP, 22, 10),
+			scanPacket(0xff01, scannerIP, 22, 10),
+			scanSYN(scannerIP, 80, 11),
+			scanPacket(0xff02, scannerIP, 80, 11),
+			scanSYN(scannerIP, 443, 12),
+			scanPacket(0xff03, scannerIP, 443, 12),
+			scanSYN(scannerIP, 8080, 14),
+			scanPacket(0xff04, scannerIP, 8080, 14),
+			scanSYN(clientIP, 22, 15),
+			scanPacket(0xff06, clientIP, 22, 15),
+			// An accepted connection is never held.
+			&tcpAcceptResult4{
+				Meta:  meta(1234, 1234, 16),
+				Sock:  0xff05,
+				LAddr: ipv4(scanLocalIP),
+				LPort: be16(22),
+				RAddr: ipv4(clientIP),
+				RPort: be16(40000),
+				Af:    unix.AF_INET,
+			},
+			&inetReleaseCall{Meta: meta(1234, 1234, 17), Sock: 0xff05},
+		})
+		st.ExpireFlows()
+		now = now.Add(window / 2)
+		st.ExpireFlows()
+		flows := st.getFlows()
+		if !enabled {
+			assert.Len(t, flows, 6)
+			continue
+		}
+		// Only the accepted connection is reported within the window.
+		if !assert.Len(t, flows, 1) {
+			t.FailNow()
+		}
+		assertValue(t, flows[0], true, "flow.complete")
+
+		now = now.Add(window)
+		st.ExpireFlows()
+		evs := st.getFlows()
+		if !assert.Len(t, evs, 2) {
+			t.FailNow()
+		}
+		var scan, flow = evs[0], evs[1]
+		if action, _ := scan.GetValue("event.action"); action != "port_scan_suspected" {
+			scan, flow = flow, scan
+		}
+		for field, expected := range map[string]interface{}{
+			"event.action":                     "port_scan_suspected",
+			"event.kind":                       "alert",
+			"source.ip":                        scannerIP,
+			"destination.ip":                   scanLocalIP,
+			"network.transport":                "tcp",
+			"system.socket.port_scan.ports":    4,
+			"system.socket.port_scan.attempts": 4,
+		} {
+			assertValue(t, scan, expected, field)
+		}
+		// Below the threshold, the flow is reported once the window ends.
+		assertValue(t, flow, "network_flow", "event.action")
+		assertValue(t, flow, clientIP, "source.ip")
+		assertValue(t, flow, 22, "destination.port")
+		assert.Empty(t, st.state.portScans.sources)
+	}
+}
+
+func TestPortScanPreexistingConnections(t *testing.T) {
+	const remoteIP = "10.0.0.7"
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withPortScanDetection(true, 10*time.Second, 3, 100, 100)(&st.state)
+	now := time.Now()
+	st.clock = func() time.Time { return now }
+	// Connections established before the dataset started look like inbound
+	// flows that were never accepted, but no SYN is seen for them.
+	var evs []event
+	for i, port := range []uint16{22, 80, 443, 5432, 8080} {
+		evs = append(evs, scanPacket(uintptr(0xff01+i), remoteIP, port, uint64(10+i)))
+	}
+	st.feedEvents(evs)
+	now = now.Add(2 * time.Second)
+	st.ExpireFlows()
+	flows := st.getFlows()
+	assert.Len(t, flows, 5)
+	for _, flow := range flows {
+		assertValue(t, flow, "network_flow", "event.action")
+	}
+	assert.Empty(t, st.state.portScans.sources)
+}
+
+func TestPortScanLimits(t *testing.T) {
+	const window = 10 * time.Second
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withPortScanDetection(true, window, 5, 2, 3)(&st.state)
+	now := time.Now()
+	st.clock = func() time.Time { return now }
+	st.feedEvents([]event{
+		scanSYN("10.0.0.1", 22, 10),
+		scanSYN("10.0.0.1", 80, 10),
+		scanSYN("10.0.0.2", 22, 10),
+		scanSYN("10.0.0.2", 80, 10),
+		// Too many remote addresses.
+		scanSYN("10.0.0.3", 22, 10),
+		scanPacket(0xff01, "10.0.0.1", 22, 10),
+		scanPacket(0xff02, "10.0.0.1", 80, 11),
+		scanPacket(0xff03, "10.0.0.2", 22, 12),
+		scanPacket(0xff04, "10.0.0.3", 22, 13),
+		// Too many flows held.
+		scanPacket(0xff05, "10.0.0.2", 80, 14),
+	})
+	st.ExpireFlows()
+	now = now.Add(window / 2)
+	st.ExpireFlows()
+	flows := st.getFlows()
+	if !assert.Len(t, flows, 2) {
+		t.FailNow()
+	}
+	assertValue(t, flows[0], "10.0.0.3", "source.ip")
+	assertValue(t, flows[1], "10.0.0.2", "source.ip")
+	assertValue(t, flows[1], 80, "destination.port")
+
+	now = now.Add(window)
+	st.ExpireFlows()
+	assert.Len(t, st.getFlows(), 3)
+	assert.Empty(t, st.state.portScans.sources)
+	assert.Zero(t, st.state.portScans.held)
+}
+
+func TestConnRequestEndpoints(t *testing.T) {
+	e := scanSYN("10.0.0.66", 8080, 10).(*tcpV4ConnRequest)
+	local, remote, ok := e.endpoints()
+	if assert.True(t, ok) {
+		assert.Equal(t, scanLocalIP+":8080", local.addr.String())
+		assert.Equal(t, "10.0.0.66:51234", remote.addr.String())
+	}
+	// Headers given as pointers.
+	e.Base = 0xffff9f1d00001000
+	e.IPHdr, e.TCPHdr = 0x1000+14, 0x1000+34
+	local, remote, ok = e.endpoints()
+	if assert.True(t, ok) {
+		assert.Equal(t, scanLocalIP+":8080", local.addr.String())
+		assert.Equal(t, "10.0.0.66:51234", remote.addr.String())
+	}
+	e.IPHdr = 0
+	_, _, ok = e.endpoints()
+	assert.False(t, ok)
+}
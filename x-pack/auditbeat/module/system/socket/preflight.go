@@ -0,0 +1,209 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	conf "github.com/elastic/elastic-agent-libs/config"
+	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// preflightReport describes how the dataset's kprobes map to the running
+// kernel. It's output as JSON.
+type preflightReport struct {
+	Kernel       string                          `json:"kernel"`
+	IPv6         bool                            `json:"ipv6"`
+	Compatible   bool                            `json:"compatible"`
+	Alternatives map[string]preflightAlternative `json:"function_alternatives"`
+	Probes       []preflightProbe                `json:"probes"`
+	Error        string                          `json:"error,omitempty"`
+	Warnings     []string                        `json:"warnings,omitempty"`
+}
+
+type preflightAlternative struct {
+	Selected   string   `json:"selected,omitempty"`
+	Candidates []string `json:"candidates"`
+}
+
+type preflightProbe struct {
+	Name     string `json:"name"`
+	Function string `json:"function,omitempty"`
+	Install  bool   `json:"install"`
+	Optional bool   `json:"optional,omitempty"`
+	Feature  string `json:"feature,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Preflight writes a JSON report of how the kprobes that the dataset would
+// install map to the running kernel, using the same logic as Setup but without
+// installing the probes or running the guesses. The configuration is the one
+// of the system module running the dataset, and can be nil to use the
+// defaults. A non-empty traceFSPath overrides socket.tracefs_path. It returns
+// whether the dataset can be started on this kernel with this configuration.
+func Preflight(out io.Writer, cfg *conf.C, traceFSPath string) (compatible bool, err error) {
+	config := defaultConfig
+	if cfg != nil {
+		if err = cfg.Unpack(&config); err != nil {
+			return false, fmt.Errorf("failed to unpack the %s config: %w", fullName, err)
+		}
+	}
+	if traceFSPath != "" {
+		config.TraceFSPath = &traceFSPath
+	}
+	report, err := runPreflight(config)
+	if err != nil {
+		return false, err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return report.Compatible, enc.Encode(report)
+}
+
+// runPreflight resolves the kernel functions used by the dataset's kprobes
+// for the given configuration.
+func runPreflight(config Config) (*preflightReport, error) {
+	var traceFS *tracing.TraceFS
+	var err error
+	if config.TraceFSPath == nil {
+		traceFS, err = tracing.NewTraceFS()
+	} else {
+		traceFS, err = tracing.NewTraceFSWithPath(*config.TraceFSPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tracefs/debugfs is not mounted or not writeable: %w", err)
+	}
+	m := &MetricSet{
+		config:       config,
+		templateVars: make(mapstr.M),
+		log:          logp.NewLogger(metricsetName),
+	}
+	m.templateVars.Update(baseTemplateVars)
+	m.templateVars.Update(archVariables)
+	m.installer = newProbeInstaller(traceFS,
+		WithGroup(groupName),
+		WithTemplates(m.templateVars))
+
+	report := &preflightReport{
+		Kernel:       kernelVersion,
+		Compatible:   true,
+		Alternatives: make(map[string]preflightAlternative, len(functionAlternatives)),
+	}
+	hasIPv6, err := m.hasIPv6()
+	if err != nil {
+		report.Compatible = false
+		report.Error = err.Error()
+	}
+	report.IPv6 = hasIPv6
+
+	// Without a list of available functions, isKernelFunctionAvailable falls
+	// back to installing a test probe for every function.
+	functions, err := m.tracingFunctions(traceFS)
+	if err != nil {
+		m.log.Debugf("Can't load available_tracing_functions. Using alternative. err=%v", err)
+	}
+
+	selected, missing := m.selectFunctionAlternatives(functions)
+	for varName, candidates := range functionAlternatives {
+		report.Alternatives[varName] = preflightAlternative{
+			Selected:   selected[varName],
+			Candidates: candidates,
+		}
+		if name, found := selected[varName]; found {
+			m.templateVars[varName] = name
+		}
+	}
+	if len(missing) > 0 {
+		report.Compatible = false
+	}
+
+	addProbe := func(pdef helper.ProbeDef, optional bool, reason string) *preflightProbe {
+		probe := preflightProbe{
+			Name:     pdef.Probe.Name,
+			Optional: optional,
+			Reason:   reason,
+		}
+		var err error
+		if probe.Function, err = addressOf(pdef, m.templateVars); err != nil {
+			probe.Reason = err.Error()
+		} else if reason == "" {
+			probe.Install = m.isKernelFunctionAvailable(probe.Function, functions)
+			if !probe.Install {
+				probe.Reason = "function not available for tracing"
+			}
+		}
+		if !probe.Install && !optional && reason == "" {
+			report.Compatible = false
+		}
+		report.Probes = append(report.Probes, probe)
+		return &report.Probes[len(report.Probes)-1]
+	}
+	for _, pdef := range getKProbes(hasIPv6, m.config.IPv6Only) {
+		addProbe(pdef, false, "")
+	}
+	skipped, reason := ipv6KProbes, "IPv6 is disabled"
+	if hasIPv6 {
+		skipped, reason = ipv4OnlyKProbes, "replaced by IPv6 probes"
+	}
+	for _, pdef := range skipped {
+		addProbe(pdef, false, reason)
+	}
+	if m.config.IPv6Only {
+		for _, pdef := range ipv4KProbes {
+			addProbe(pdef, false, "IPv6-only mode")
+		}
+	}
+	for _, opt := range optionalKProbes {
+		for _, pdef := range opt.probes {
+			// Optional probes depend on guessed variables, so only the
+			// function is checked.
+			if probe := addProbe(pdef, true, ""); probe.Install && len(opt.requires) > 0 {
+				probe.Reason = "requires guessing " + strings.Join(opt.requires, ", ")
+			}
+		}
+	}
+	// The probes of the features enabled in the configuration. Setup only
+	// warns when they're missing, so they don't make the kernel incompatible.
+	for _, feature := range getFeatureKProbes(&m.config, hasIPv6) {
+		installed := 0
+		for _, pdef := range feature.probes {
+			probe := addProbe(pdef, true, "")
+			probe.Feature = feature.name
+			if probe.Install {
+				installed++
+				if len(feature.requires) > 0 {
+					probe.Reason = "requires guessing " + strings.Join(feature.requires, ", ")
+				}
+			}
+		}
+		if feature.warning != "" && (installed == 0 || (feature.requireAll && installed < len(feature.probes))) {
+			report.Warnings = append(report.Warnings, feature.warning)
+		}
+	}
+	return report, nil
+}
+
+// addressOf returns the kernel function a probe is attached to, or an error
+// when it depends on a function alternative that couldn't be resolved.
+func addressOf(pdef helper.ProbeDef, vars mapstr.M) (string, error) {
+	address := pdef.Probe.Address
+	if !strings.Contains(address, "{{") {
+		return address, nil
+	}
+	address = helper.ProbeDef{Probe: tracing.Probe{Address: address}}.ApplyTemplate(vars).Probe.Address
+	if strings.Contains(address, "<no value>") {
+		return "", errors.New("no function alternative available")
+	}
+	return address, nil
+}
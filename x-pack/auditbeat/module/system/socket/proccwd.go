@@ -0,0 +1,35 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"fmt"
+	"os"
+)
+
+// readProcessCWD returns the working directory of the given process from
+// /proc/<pid>/cwd, and whether the directory has been removed. Reading it
+// requires the same permissions as ptrace, so it fails for the processes of
+// other users without CAP_SYS_PTRACE.
+func readProcessCWD(pid uint32) (cwd string, deleted bool, err error) {
+	link, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	if err != nil {
+		return "", false, err
+	}
+	cwd, deleted = splitDeletedPath(link)
+	return cwd, deleted, nil
+}
+
+// withProcessWorkingDirectory enables reporting the working directory of
+// processes, read when they're created.
+func withProcessWorkingDirectory(enabled bool) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.readCWD = readProcessCWD
+		}
+	}
+}
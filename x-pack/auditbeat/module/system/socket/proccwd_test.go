@@ -0,0 +1,126 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadProcessCWD(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwd, deleted, err := readProcessCWD(uint32(os.Getpid()))
+	if assert.NoError(t, err) {
+		assert.Equal(t, wd, cwd)
+		assert.False(t, deleted)
+	}
+
+	// A process whose working directory was removed.
+	dir := filepath.Join(t.TempDir(), "removed")
+	if err = os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sleep", "10")
+	cmd.Dir = dir
+	if err = cmd.Start(); err != nil {
+		t.Skipf("unable to start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	if err = os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	cwd, deleted, err = readProcessCWD(uint32(cmd.Process.Pid))
+	if assert.NoError(t, err) {
+		assert.Equal(t, dir, cwd)
+		assert.True(t, deleted)
+	}
+
+	_, _, err = readProcessCWD(0)
+	assert.Error(t, err)
+}
+
+func TestProcessWorkingDirectory(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cwd      string
+		deleted  bool
+		err      error
+		expected map[string]interface{}
+	}{
+		{
+			name:     "readable",
+			cwd:      "/home/alice/scripts",
+			expected: map[string]interface{}{"working_directory": "/home/alice/scripts"},
+		},
+		{
+			name:    "deleted",
+			cwd:     "/tmp/build",
+			deleted: true,
+			expected: map[string]interface{}{
+				"working_directory":         "/tmp/build",
+				"working_directory_deleted": true,
+			},
+		},
+		{
+			name: "unreadable",
+			err:  os.ErrPermission,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withProcessWorkingDirectory(true)(&st.state)
+			st.readCWD = func(pid uint32) (string, bool, error) {
+				assert.EqualValues(t, 1234, pid)
+				return tc.cwd, tc.deleted, tc.err
+			}
+			if err := st.CreateProcess(&process{pid: 1234, name: "deploy.sh"}); err != nil {
+				t.Fatal(err)
+			}
+			// Inherited by children.
+			if err := st.ForkProcess(1234, 1240, 10); err != nil {
+				t.Fatal(err)
+			}
+			for _, pid := range []uint32{1234, 1240} {
+				p := st.getProcess(pid)
+				if !assert.NotNil(t, p) {
+					t.FailNow()
+				}
+				f := flow{pid: pid, process: p}
+				fields := f.processFields()
+				for _, name := range []string{"working_directory", "working_directory_deleted"} {
+					value, found := fields[name]
+					if expected, ok := tc.expected[name]; ok {
+						assert.Equal(t, expected, value, name)
+					} else {
+						assert.False(t, found, name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestProcessWorkingDirectoryDisabled(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	assert.Nil(t, st.readCWD)
+	if err := st.CreateProcess(&process{pid: 1234, name: "bash"}); err != nil {
+		t.Fatal(err)
+	}
+	_, found := (&flow{pid: 1234, process: st.getProcess(1234)}).processFields()["working_directory"]
+	assert.False(t, found)
+}
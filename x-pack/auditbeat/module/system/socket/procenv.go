@@ -0,0 +1,77 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// envLabelReader reads an allowlist of environment variables of processes,
+// to report them as labels on their flows. Only the allowed variables are
+// kept, so that secrets in the environment aren't captured.
+type envLabelReader struct {
+	names map[string]struct{}
+}
+
+func newEnvLabelReader(names []string) *envLabelReader {
+	r := &envLabelReader{names: make(map[string]struct{}, len(names))}
+	for _, name := range names {
+		r.names[name] = struct{}{}
+	}
+	return r
+}
+
+// read returns the allowed variables in /proc/<pid>/environ. It fails when
+// the process has exited or its environment can't be read.
+func (r *envLabelReader) read(pid uint32) (map[string]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return nil, err
+	}
+	return r.parse(data), nil
+}
+
+// parse extracts the allowed variables from the NUL-separated contents of
+// /proc/<pid>/environ. It returns nil when none is found.
+func (r *envLabelReader) parse(environ []byte) map[string]string {
+	var labels map[string]string
+	for len(environ) > 0 {
+		var entry []byte
+		if end := bytes.IndexByte(environ, 0); end >= 0 {
+			entry, environ = environ[:end], environ[end+1:]
+		} else {
+			entry, environ = environ, nil
+		}
+		name, value, found := bytes.Cut(entry, []byte{'='})
+		if !found {
+			continue
+		}
+		if _, allowed := r.names[string(name)]; !allowed {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		// The first definition is the one seen by getenv(3).
+		if _, dup := labels[string(name)]; !dup {
+			labels[string(name)] = string(value)
+		}
+	}
+	return labels
+}
+
+// withProcessEnvLabels enables reporting the given environment variables of
+// processes as labels on their flows.
+func withProcessEnvLabels(names []string) stateOption {
+	return func(s *state) {
+		if len(names) > 0 {
+			s.readEnvLabels = newEnvLabelReader(names).read
+		}
+	}
+}
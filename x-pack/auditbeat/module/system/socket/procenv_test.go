@@ -0,0 +1,103 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEnvLabels(t *testing.T) {
+	r := newEnvLabelReader([]string{"OTEL_SERVICE_NAME", "APP_ENV", "EMPTY"})
+	for _, tc := range []struct {
+		name     string
+		environ  string
+		expected map[string]string
+	}{
+		{
+			name:     "allowed variables",
+			environ:  "PATH=/usr/bin\x00OTEL_SERVICE_NAME=checkout\x00DB_PASSWORD=secret\x00APP_ENV=prod=eu\x00",
+			expected: map[string]string{"OTEL_SERVICE_NAME": "checkout", "APP_ENV": "prod=eu"},
+		},
+		{
+			name:     "no trailing NUL",
+			environ:  "HOME=/root\x00OTEL_SERVICE_NAME=checkout",
+			expected: map[string]string{"OTEL_SERVICE_NAME": "checkout"},
+		},
+		{
+			name:     "first definition wins",
+			environ:  "APP_ENV=prod\x00APP_ENV=dev\x00",
+			expected: map[string]string{"APP_ENV": "prod"},
+		},
+		{
+			name:     "empty value",
+			environ:  "EMPTY=\x00",
+			expected: map[string]string{"EMPTY": ""},
+		},
+		{
+			name:    "malformed and prefixed entries",
+			environ: "OTEL_SERVICE_NAME\x00OTEL_SERVICE_NAME_X=a\x00\x00",
+		},
+		{
+			name: "empty environment",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, r.parse([]byte(tc.environ)))
+		})
+	}
+}
+
+func TestProcessEnvLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		labels map[string]string
+		err    error
+	}{
+		{"found", map[string]string{"OTEL_SERVICE_NAME": "checkout"}, nil},
+		{"not found", nil, nil},
+		{"unreadable", nil, errors.New("permission denied")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withProcessEnvLabels([]string{"OTEL_SERVICE_NAME"})(&st.state)
+			reads := 0
+			st.readEnvLabels = func(pid uint32) (map[string]string, error) {
+				reads++
+				assert.EqualValues(t, 1234, pid)
+				return tc.labels, tc.err
+			}
+			st.feedEvents([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/bin/checkout"}),
+				&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+				// The child inherits the environment of its parent.
+				&forkRet{Meta: meta(1234, 1234, 3), Retval: 1235},
+			})
+			assert.Equal(t, tc.labels, st.processes[1235].envLabels)
+			st.feedEvents(tcpConnectEvents(1234, 5, 8))
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1234, 20), Sock: testSock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			assert.Equal(t, 1, reads)
+			assertValue(t, flows[0], 1234, "process.pid")
+			if tc.labels == nil {
+				_, err := flows[0].GetValue("labels")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], "checkout", "labels.OTEL_SERVICE_NAME")
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Values of event.action for process events.
+const (
+	processStarted = "process_started"
+	processStopped = "process_stopped"
+)
+
+// withProcessEvents enables reporting an event when a process is created by
+// execve and when it exits.
+func withProcessEvents(enabled bool) stateOption {
+	return func(s *state) {
+		s.processEvents = enabled
+	}
+}
+
+// reportsStart returns whether the creation of the process is reported. Only
+// the processes seen by execve are, which have a kernel timestamp. The ones
+// read from /proc at startup were created before the dataset started, even
+// when execve was seen for them too while the table was bootstrapped.
+func (p *process) reportsStart() bool {
+	return p.created != 0
+}
+
+// processEvent returns the event sent when a process is created or exits.
+// ts is the time of the execve or of the exit.
+func processEvent(p *process, action string, ts time.Time) mb.Event {
+	eventType := "start"
+	if action == processStopped {
+		eventType = "end"
+	}
+	f := flow{pid: p.pid, process: p}
+	process := f.processFields()
+	if p.ppid != 0 {
+		process["parent"] = mapstr.M{"pid": int(p.ppid)}
+	}
+	if action == processStopped {
+		process["end"] = ts
+	}
+	root := mapstr.M{
+		"event": mapstr.M{
+			"kind":     "event",
+			"action":   action,
+			"category": []string{"process"},
+			"type":     []string{eventType},
+		},
+		"process": process,
+	}
+	metricset := mapstr.M{}
+	if p.hasCreds {
+		if p.credFields.has(credUID) {
+			root["user"] = mapstr.M{"id": strconv.Itoa(int(p.uid))}
+			metricset["uid"] = p.uid
+		}
+		if p.credFields.has(credGID) {
+			root["group"] = mapstr.M{"id": strconv.Itoa(int(p.gid))}
+			metricset["gid"] = p.gid
+		}
+		if p.credFields.has(credEUID) {
+			metricset["euid"] = p.euid
+		}
+		if p.credFields.has(credEGID) {
+			metricset["egid"] = p.egid
+		}
+	}
+	return mb.Event{
+		Timestamp:       ts,
+		RootFields:      root,
+		MetricSetFields: metricset,
+	}
+}
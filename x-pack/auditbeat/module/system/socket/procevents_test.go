@@ -0,0 +1,96 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessEvents(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withProcessEvents(true)(&st.state)
+	if err := st.CreateProcess(&process{pid: 1000, name: "bash"}); err != nil {
+		t.Fatal(err)
+	}
+	st.feedEvents([]event{
+		&forkRet{Meta: meta(1000, 1000, 1), Retval: 1234},
+		callExecve(meta(1234, 1234, 2), []string{"/usr/bin/curl", "https://example.net/"}),
+		&commitCreds{Meta: meta(1234, 1234, 3), UID: 501, GID: 20, EUID: 0, EGID: 0},
+		&execveRet{Meta: meta(1234, 1234, 4), Retval: 0},
+		&doExit{Meta: meta(1234, 1235, 5)},
+		&doExit{Meta: meta(1234, 1234, 6)},
+	})
+	evs := st.getFlows()
+	if !assert.Len(t, evs, 2) {
+		t.FailNow()
+	}
+	for field, expected := range map[string]interface{}{
+		"event.kind":         "event",
+		"event.action":       "process_started",
+		"event.category":     []string{"process"},
+		"event.type":         []string{"start"},
+		"process.pid":        1234,
+		"process.parent.pid": 1000,
+		"process.name":       "curl",
+		"process.args":       []string{"/usr/bin/curl", "https://example.net/"},
+		"user.id":            "501",
+		"group.id":           "20",
+	} {
+		assertValue(t, evs[0], expected, field)
+	}
+	for field, expected := range map[string]interface{}{
+		"event.action":       "process_stopped",
+		"event.type":         []string{"end"},
+		"process.pid":        1234,
+		"process.parent.pid": 1000,
+		"process.name":       "curl",
+		"user.id":            "501",
+		"group.id":           "20",
+	} {
+		assertValue(t, evs[1], expected, field)
+	}
+	hasEnd, _ := evs[1].Fields.HasKey("process.end")
+	assert.True(t, hasEnd)
+}
+
+func TestProcessEventsBootstrap(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withProcessEvents(true)(&st.state)
+	// Read from /proc at startup.
+	if err := st.CreateProcess(&process{
+		pid:         1234,
+		ppid:        1,
+		name:        "sshd",
+		createdTime: time.Now().Add(-time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, st.getFlows())
+	st.feedEvents([]event{
+		&doExit{Meta: meta(1234, 1234, 5)},
+	})
+	evs := st.getFlows()
+	if !assert.Len(t, evs, 1) {
+		t.FailNow()
+	}
+	assertValue(t, evs[0], "process_stopped", "event.action")
+	assertValue(t, evs[0], 1, "process.parent.pid")
+	assertValue(t, evs[0], "sshd", "process.name")
+}
+
+func TestProcessEventsDisabled(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	st.feedEvents([]event{
+		callExecve(meta(1234, 1234, 2), []string{"/usr/bin/curl"}),
+		&execveRet{Meta: meta(1234, 1234, 3), Retval: 0},
+		&doExit{Meta: meta(1234, 1234, 6)},
+	})
+	assert.Empty(t, st.getFlows())
+}
@@ -0,0 +1,70 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import "time"
+
+// exitedProcess is a process kept in the process table after it exited.
+type exitedProcess struct {
+	proc   *process
+	exited time.Time
+}
+
+// processRetention keeps exited processes in the process table for a grace
+// period, so that the events that arrive after the exit, such as the final
+// FIN of a connection, are still attributed to them.
+type processRetention struct {
+	period time.Duration
+	max    int
+	// exited processes, oldest first.
+	exited []exitedProcess
+}
+
+// withProcessRetention keeps up to max exited processes for the given
+// period. A zero period removes processes as soon as they exit.
+func withProcessRetention(period time.Duration, max int) stateOption {
+	return func(s *state) {
+		if period > 0 && max > 0 {
+			s.retention = &processRetention{period: period, max: max}
+		}
+	}
+}
+
+// retainProcess records that a process exited. The oldest exited process is
+// removed when too many are retained.
+func (s *state) retainProcess(proc *process) {
+	r := s.retention
+	proc.exited = true
+	r.exited = append(r.exited, exitedProcess{proc: proc, exited: s.clock()})
+	if len(r.exited) > r.max {
+		s.forgetProcess(r.exited[0].proc)
+		r.exited[0] = exitedProcess{}
+		r.exited = r.exited[1:]
+	}
+}
+
+// expireProcesses removes the exited processes retained for longer than
+// the retention period.
+func (s *state) expireProcesses(now time.Time) {
+	r := s.retention
+	deadline := now.Add(-r.period)
+	n := 0
+	for n < len(r.exited) && !r.exited[n].exited.After(deadline) {
+		s.forgetProcess(r.exited[n].proc)
+		r.exited[n] = exitedProcess{}
+		n++
+	}
+	r.exited = r.exited[n:]
+}
+
+// forgetProcess removes an exited process from the process table, unless
+// its PID was reused by a new process.
+func (s *state) forgetProcess(proc *process) {
+	if s.processes[proc.pid] == proc {
+		delete(s.processes, proc.pid)
+	}
+}
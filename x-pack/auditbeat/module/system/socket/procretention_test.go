@@ -0,0 +1,94 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestProcessExitMidFlow(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		retention time.Duration
+		process   bool
+	}{
+		{"removed on exit", 0, false},
+		{"retained", time.Minute, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withProcessRetention(tc.retention, 10)(&st.state)
+			// The connection was established before the dataset started. The
+			// process exits and the kernel sends its last data and closes
+			// the socket on its behalf.
+			st.feedEvents([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl"}),
+				&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+				&doExit{Meta: meta(1234, 1234, 10)},
+				&tcpSendMsgCall4{
+					Meta:  meta(1234, 1234, 11),
+					Sock:  testSock,
+					Size:  10,
+					LAddr: ipv4(testLocalIP),
+					LPort: be16(testLocalPort),
+					RAddr: ipv4(testRemoteIP),
+					RPort: be16(testRemotePort),
+					Af:    unix.AF_INET,
+				},
+				&inetReleaseCall{Meta: meta(1234, 1234, 12), Sock: testSock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			assertValue(t, flows[0], 1234, "process.pid")
+			if !tc.process {
+				_, err := flows[0].GetValue("process.name")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], "curl", "process.name")
+		})
+	}
+}
+
+func TestProcessRetentionExpiration(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withProcessRetention(time.Minute, 2)(&st.state)
+	now := time.Now()
+	st.clock = func() time.Time { return now }
+	for _, pid := range []uint32{1, 2, 3} {
+		if err := st.CreateProcess(&process{pid: pid, startTime: now}); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.TerminateProcess(pid, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The oldest one is evicted to make room.
+	assert.Nil(t, st.getProcess(1))
+	assert.NotNil(t, st.getProcess(2))
+	assert.NotNil(t, st.getProcess(3))
+
+	// A new process reusing a retained PID isn't removed with the old one,
+	// nor does it inherit its start time.
+	reused := &process{pid: 2}
+	if err := st.CreateProcess(reused); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, reused.startTime.IsZero())
+	now = now.Add(time.Minute)
+	st.ExpireFlows()
+	assert.Equal(t, reused, st.getProcess(2))
+	assert.Nil(t, st.getProcess(3))
+	assert.Empty(t, st.retention.exited)
+}
@@ -0,0 +1,58 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// procStatus holds the fields of /proc/<pid>/status reported for processes.
+type procStatus struct {
+	// names of the effective capabilities (CapEff). Nil when not found.
+	capabilities []string
+	// PID in the innermost PID namespace (NSpid), zero when the process is
+	// in the namespace of procfs or the field isn't found.
+	namespacedPID uint32
+}
+
+// readProcStatus reads the status of the given process from
+// /proc/<pid>/status.
+func readProcStatus(pid uint32) (procStatus, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return procStatus{}, err
+	}
+	defer f.Close()
+	return parseProcStatus(f)
+}
+
+// parseProcStatus parses the contents of /proc/<pid>/status. Missing fields
+// are left unset, as kernels before 4.1 lack NSpid.
+func parseProcStatus(r io.Reader) (status procStatus, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		switch key {
+		case "CapEff":
+			if status.capabilities, err = capabilitiesFromMask(strings.TrimSpace(value)); err != nil {
+				return procStatus{}, err
+			}
+		case "NSpid":
+			if status.namespacedPID, err = parseNSpid(value); err != nil {
+				return procStatus{}, err
+			}
+		}
+	}
+	return status, scanner.Err()
+}
@@ -0,0 +1,55 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProcStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		status   string
+		expected procStatus
+		err      bool
+	}{
+		{
+			name:     "container",
+			status:   "Name:\tnginx\nPid:\t4242\nNSpid:\t4242\t7\nCapInh:\t0000000000000000\nCapEff:\t0000000000003000\n",
+			expected: procStatus{capabilities: []string{"net_admin", "net_raw"}, namespacedPID: 7},
+		},
+		{
+			name:     "old kernel",
+			status:   "Pid:\t4242\nPPid:\t4200\nCapEff:\t0000000000000000\n",
+			expected: procStatus{capabilities: []string{}},
+		},
+		{
+			name:   "invalid NSpid",
+			status: "NSpid:\t4242\tabc\n",
+			err:    true,
+		},
+		{
+			name:   "invalid CapEff",
+			status: "CapEff:\tnothex\n",
+			err:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, err := parseProcStatus(strings.NewReader(tc.status))
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.expected, status)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// processSync periodically removes from the process table the processes that
+// no longer exist in /proc. Their exit was missed, usually because events
+// were lost, and they would otherwise be kept until their PID is reused.
+type processSync struct {
+	period time.Duration
+	// pidExists tells whether a process is still running. It returns true
+	// when that can't be determined, so that processes are only removed
+	// when they are known to be gone.
+	pidExists func(pid uint32) bool
+}
+
+// withProcessTableSync cross-checks the process table against /proc every
+// period. A zero period disables it.
+func withProcessTableSync(period time.Duration) stateOption {
+	return func(s *state) {
+		if period > 0 {
+			s.procSync = &processSync{period: period, pidExists: procPIDExists}
+		}
+	}
+}
+
+// procPIDExists returns whether /proc/<pid> exists.
+func procPIDExists(pid uint32) bool {
+	_, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+func (s *state) processSyncLoop() {
+	ticker := time.NewTicker(s.procSync.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.reporter.Done():
+			return
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.syncProcessTable()
+		}
+	}
+}
+
+// syncProcessTable removes the processes that are gone from /proc. /proc is
+// read without holding the lock, so a process is only removed when the table
+// still holds the same one afterwards, and not one created or forked with
+// the same PID in the meantime. Processes created less than a period ago
+// are skipped, as their events can still be in flight. Removed processes are
+// retained like exited ones when socket.process_retention is set.
+func (s *state) syncProcessTable() (removed int) {
+	s.Lock()
+	deadline := s.clock().Add(-s.procSync.period)
+	candidates := make(map[uint32]*process)
+	for pid, proc := range s.processes {
+		if !proc.exited && !proc.createdTime.After(deadline) {
+			candidates[pid] = proc
+		}
+	}
+	s.Unlock()
+
+	for pid := range candidates {
+		if s.procSync.pidExists(pid) {
+			delete(candidates, pid)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0
+	}
+
+	s.Lock()
+	for pid, proc := range candidates {
+		if s.processes[pid] != proc || proc.exited {
+			continue
+		}
+		if s.retention != nil {
+			s.retainProcess(proc)
+		} else {
+			delete(s.processes, pid)
+		}
+		s.releaseSockets(pid)
+		removed++
+	}
+	s.Unlock()
+	if removed > 0 {
+		s.log.Debugf("Removed %d processes whose exit was missed from the process table", removed)
+	}
+	return removed
+}
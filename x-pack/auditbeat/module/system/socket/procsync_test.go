@@ -0,0 +1,77 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncProcessTable(t *testing.T) {
+	const (
+		running  = 1
+		gone     = 2
+		recent   = 3
+		replaced = 4
+	)
+	for _, tc := range []struct {
+		name      string
+		retention time.Duration
+	}{
+		{"removed", 0},
+		{"retained", time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withProcessRetention(tc.retention, 10)(&st.state)
+			withProcessTableSync(time.Minute)(&st.state)
+			now := time.Now()
+			st.clock = func() time.Time { return now }
+			for pid, created := range map[uint32]time.Time{
+				running:  now.Add(-time.Hour),
+				gone:     now.Add(-time.Hour),
+				recent:   now.Add(-time.Second),
+				replaced: now.Add(-time.Hour),
+			} {
+				if err := st.CreateProcess(&process{pid: pid, name: "old", createdTime: created}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var checked []uint32
+			st.procSync.pidExists = func(pid uint32) bool {
+				checked = append(checked, pid)
+				if pid == replaced {
+					// The PID is reused while /proc is read.
+					if err := st.CreateProcess(&process{pid: pid, name: "new", createdTime: now}); err != nil {
+						t.Fatal(err)
+					}
+					return false
+				}
+				return pid == running
+			}
+
+			assert.Equal(t, 1, st.syncProcessTable())
+			assert.ElementsMatch(t, []uint32{running, gone, replaced}, checked)
+			assert.NotNil(t, st.getProcess(running))
+			assert.NotNil(t, st.getProcess(recent))
+			if p := st.getProcess(replaced); assert.NotNil(t, p) {
+				assert.Equal(t, "new", p.name)
+			}
+			if tc.retention == 0 {
+				assert.Nil(t, st.getProcess(gone))
+			} else if p := st.getProcess(gone); assert.NotNil(t, p) {
+				assert.True(t, p.exited)
+				// Retained processes aren't checked again.
+				checked = nil
+				st.syncProcessTable()
+				assert.NotContains(t, checked, uint32(gone))
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build linux
+// +build linux
+
+package quic
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+// Timeout of the reads from the socket, so that the capture goroutine wakes
+// up periodically to check for termination.
+const readTimeout = 500 * time.Millisecond
+
+// longHeaderFilter is a classic BPF program for a cooked AF_PACKET socket that
+// only accepts IPv4 or IPv6 UDP packets to port 443 whose payload starts with
+// a QUIC long header. Packets of established connections use short headers
+// and are dropped by the kernel.
+var longHeaderFilter = mustAssemble([]bpf.Instruction{
+	/*  0 */ bpf.LoadExtension{Num: bpf.ExtProto},
+	/*  1 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.ETH_P_IPV6, SkipTrue: 6},
+	// IPv6: next header is UDP, destination port is 443 and long header.
+	/*  2 */ bpf.LoadAbsolute{Off: 6, Size: 1},
+	/*  3 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.IPPROTO_UDP, SkipTrue: 15},
+	/*  4 */ bpf.LoadAbsolute{Off: 42, Size: 2},
+	/*  5 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: Port, SkipTrue: 13},
+	/*  6 */ bpf.LoadAbsolute{Off: 48, Size: 1},
+	/*  7 */ bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x80, SkipTrue: 10, SkipFalse: 11},
+	// IPv4: protocol is UDP, first fragment, destination port is 443 and
+	// long header.
+	/*  8 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.ETH_P_IP, SkipTrue: 10},
+	/*  9 */ bpf.LoadAbsolute{Off: 9, Size: 1},
+	/* 10 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.IPPROTO_UDP, SkipTrue: 8},
+	/* 11 */ bpf.LoadAbsolute{Off: 6, Size: 2},
+	/* 12 */ bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 6},
+	/* 13 */ bpf.LoadMemShift{Off: 0},
+	/* 14 */ bpf.LoadIndirect{Off: 2, Size: 2},
+	/* 15 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: Port, SkipTrue: 3},
+	/* 16 */ bpf.LoadIndirect{Off: 8, Size: 1},
+	/* 17 */ bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x80, SkipFalse: 1},
+	/* 18 */ bpf.RetConstant{Val: 0xffff},
+	/* 19 */ bpf.RetConstant{Val: 0},
+})
+
+func mustAssemble(insns []bpf.Instruction) []bpf.RawInstruction {
+	filter, err := bpf.Assemble(insns)
+	if err != nil {
+		panic(err)
+	}
+	return filter
+}
+
+type capture struct {
+	fd      int
+	snaplen int
+	log     *logp.Logger
+}
+
+func newCapture(config config, log *logp.Logger) (c *capture, err error) {
+	if config.Snaplen <= 0 {
+		return nil, fmt.Errorf("invalid snaplen %d", config.Snaplen)
+	}
+	// The socket doesn't receive packets until it's bound, so that none
+	// gets through before the filter is attached.
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating raw socket: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			unix.Close(fd)
+		}
+	}()
+	if err = attachFilter(fd, longHeaderFilter); err != nil {
+		return nil, fmt.Errorf("failed setting BPF filter: %w", err)
+	}
+	tv := unix.NsecToTimeval(readTimeout.Nanoseconds())
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return nil, fmt.Errorf("failed setting read timeout: %w", err)
+	}
+	addr := unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL)}
+	if config.Interface != "any" {
+		iface, err := net.InterfaceByName(config.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find interface '%s': %w", config.Interface, err)
+		}
+		addr.Ifindex = iface.Index
+	}
+	if err = unix.Bind(fd, &addr); err != nil {
+		return nil, fmt.Errorf("failed binding raw socket: %w", err)
+	}
+	return &capture{
+		fd:      fd,
+		snaplen: config.Snaplen,
+		log:     log,
+	}, nil
+}
+
+func attachFilter(fd int, filter []bpf.RawInstruction) error {
+	prog := make([]unix.SockFilter, len(filter))
+	for i, ins := range filter {
+		prog[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	})
+}
+
+// htons converts a short from host to network byte order.
+func htons(v uint16) uint16 {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	return *(*uint16)(unsafe.Pointer(&buf[0]))
+}
+
+// ntohs converts a short from network to host byte order.
+func ntohs(v uint16) uint16 {
+	return binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&v))[:])
+}
+
+// networkLayerType returns the layer type that a cooked packet starts with,
+// from the link-layer address it was received from.
+func networkLayerType(from unix.Sockaddr) (gopacket.LayerType, bool) {
+	ll, ok := from.(*unix.SockaddrLinklayer)
+	if !ok {
+		return 0, false
+	}
+	switch ntohs(ll.Protocol) {
+	case unix.ETH_P_IP:
+		return layers.LayerTypeIPv4, true
+	case unix.ETH_P_IPV6:
+		return layers.LayerTypeIPv6, true
+	}
+	return 0, false
+}
+
+// Monitor starts monitoring for QUIC ClientHellos in the background.
+func (c *capture) Monitor(ctx context.Context, consumer Consumer) error {
+	go c.run(ctx, consumer)
+	return nil
+}
+
+func (c *capture) run(ctx context.Context, consumer Consumer) {
+	defer unix.Close(c.fd)
+	buf := make([]byte, c.snaplen)
+	parser := newParser()
+	c.log.Info("Starting QUIC capture.")
+	defer c.log.Info("Stopping QUIC capture.")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		n, from, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+			c.log.Error("QUIC capture error", err)
+			return
+		}
+		first, ok := networkLayerType(from)
+		if !ok {
+			continue
+		}
+
+		hello, ok, err := parser.parse(buf[:n], first, time.Now())
+		if err != nil {
+			// Other long header packets, and versions that can't be
+			// decrypted, are expected.
+			if c.log.IsDebug() {
+				c.log.Debugf("Ignored QUIC packet: %v", err)
+			}
+			continue
+		}
+		if ok {
+			if c.log.IsDebug() {
+				c.log.Debugf("Got QUIC ClientHello client=%s server=%s version=0x%x server_name=%s alpn=%v",
+					hello.Client.String(),
+					hello.Server.String(),
+					hello.Version,
+					hello.ServerName,
+					hello.ALPN)
+			}
+			consumer(hello)
+		}
+	}
+}
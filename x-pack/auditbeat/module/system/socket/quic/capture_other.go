@@ -0,0 +1,18 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !linux
+// +build !linux
+
+package quic
+
+import (
+	"errors"
+
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+func newCapture(config, *logp.Logger) (Sniffer, error) {
+	return nil, errors.New("QUIC monitoring is only supported on Linux")
+}
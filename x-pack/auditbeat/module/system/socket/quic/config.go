@@ -0,0 +1,23 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package quic
+
+type config struct {
+	// Enabled toggles the QUIC monitoring feature.
+	Enabled bool `config:"socket.quic.enabled"`
+	// Interface to listen on. Defaults to "any".
+	Interface string `config:"socket.quic.interface"`
+	// Snaplen is the packet snapshot size. Initial packets must be captured
+	// whole to be decrypted, and are padded to at least 1200 bytes.
+	Snaplen int `config:"socket.quic.snaplen"`
+}
+
+func defaultConfig() config {
+	return config{
+		Enabled:   false,
+		Interface: "any",
+		Snaplen:   65535,
+	}
+}
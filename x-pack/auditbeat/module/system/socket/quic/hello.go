@@ -0,0 +1,169 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package quic
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// maxHelloSize is the maximum size of a ClientHello that's reassembled.
+	// Those carrying post-quantum key shares span a few Initial packets.
+	maxHelloSize = 16 << 10
+
+	// maxPending is the maximum number of connections for which a ClientHello
+	// is being reassembled at the same time.
+	maxPending = 1024
+
+	// pendingTimeout is how long the CRYPTO frames of a connection are kept
+	// waiting for the rest of the ClientHello.
+	pendingTimeout = 10 * time.Second
+)
+
+var errNotClientHello = errors.New("not a TLS ClientHello")
+
+// clientHello holds the fields of interest of a TLS ClientHello.
+type clientHello struct {
+	serverName string
+	alpn       []string
+}
+
+// parseClientHello parses a TLS ClientHello handshake message, as sent in the
+// CRYPTO frames of Initial packets (RFC 8446 section 4.1.2).
+func parseClientHello(msg []byte) (hello clientHello, err error) {
+	r := reader{buf: msg}
+	if r.uint8() != 1 {
+		return hello, errNotClientHello
+	}
+	body := reader{buf: r.bytes(int(r.uint24()))}
+	body.bytes(2 + 32)             // Legacy version and random.
+	body.bytes(int(body.uint8()))  // Legacy session ID.
+	body.bytes(int(body.uint16())) // Cipher suites.
+	body.bytes(int(body.uint8()))  // Legacy compression methods.
+	exts := reader{buf: body.bytes(int(body.uint16()))}
+	if r.err != nil || body.err != nil {
+		return hello, errTruncated
+	}
+	for exts.err == nil && exts.remaining() > 0 {
+		typ := exts.uint16()
+		ext := reader{buf: exts.bytes(int(exts.uint16()))}
+		switch typ {
+		case 0: // server_name
+			names := reader{buf: ext.bytes(int(ext.uint16()))}
+			for names.err == nil && names.remaining() > 0 {
+				nameType := names.uint8()
+				name := names.bytes(int(names.uint16()))
+				if nameType == 0 && names.err == nil {
+					hello.serverName = string(name)
+				}
+			}
+			if names.err != nil {
+				return hello, names.err
+			}
+		case 16: // application_layer_protocol_negotiation
+			protos := reader{buf: ext.bytes(int(ext.uint16()))}
+			for protos.err == nil && protos.remaining() > 0 {
+				if proto := protos.bytes(int(protos.uint8())); protos.err == nil {
+					hello.alpn = append(hello.alpn, string(proto))
+				}
+			}
+			if protos.err != nil {
+				return hello, protos.err
+			}
+		}
+		if ext.err != nil {
+			return hello, ext.err
+		}
+	}
+	return hello, exts.err
+}
+
+// assembler reassembles the ClientHello sent in the CRYPTO frames of the
+// Initial packets of a connection, which can span several packets and be
+// sent out of order or retransmitted.
+type assembler struct {
+	pending map[string]*pendingHello
+}
+
+type pendingHello struct {
+	data    []byte
+	have    []bool
+	done    bool
+	expires time.Time
+}
+
+func newAssembler() *assembler {
+	return &assembler{pending: make(map[string]*pendingHello)}
+}
+
+// add records the CRYPTO frames of an Initial packet of the connection
+// identified by key. It returns the ClientHello message once all of it has
+// been received, only once per connection.
+func (a *assembler) add(key string, frames []cryptoFrame, now time.Time) (msg []byte, complete bool) {
+	p, found := a.pending[key]
+	if !found {
+		a.expire(now)
+		if len(a.pending) >= maxPending {
+			return nil, false
+		}
+		p = &pendingHello{expires: now.Add(pendingTimeout)}
+		a.pending[key] = p
+	}
+	if p.done {
+		return nil, false
+	}
+	for _, f := range frames {
+		if f.offset+uint64(len(f.data)) > maxHelloSize {
+			continue
+		}
+		end := int(f.offset) + len(f.data)
+		if end > len(p.data) {
+			p.data = append(p.data, make([]byte, end-len(p.data))...)
+			p.have = append(p.have, make([]bool, end-len(p.have))...)
+		}
+		copy(p.data[f.offset:], f.data)
+		for i := int(f.offset); i < end; i++ {
+			p.have[i] = true
+		}
+	}
+	if !p.covers(4) {
+		return nil, false
+	}
+	size := 4 + (int(p.data[1])<<16 | int(p.data[2])<<8 | int(p.data[3]))
+	if size > maxHelloSize {
+		// Keep the entry so that the connection's retransmissions are
+		// ignored until it expires.
+		p.done, p.data, p.have = true, nil, nil
+		return nil, false
+	}
+	if !p.covers(size) {
+		return nil, false
+	}
+	msg = p.data[:size]
+	p.done, p.data, p.have = true, nil, nil
+	return msg, true
+}
+
+// covers returns whether the first n bytes have been received.
+func (p *pendingHello) covers(n int) bool {
+	if len(p.have) < n {
+		return false
+	}
+	for _, have := range p.have[:n] {
+		if !have {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *assembler) expire(now time.Time) {
+	for key, p := range a.pending {
+		if now.After(p.expires) {
+			delete(a.pending, key)
+		}
+	}
+}
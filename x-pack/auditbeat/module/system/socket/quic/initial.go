@@ -0,0 +1,307 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package quic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+var (
+	errNotInitial         = errors.New("not a QUIC Initial packet")
+	errUnsupportedVersion = errors.New("unsupported QUIC version")
+	errTruncated          = errors.New("truncated QUIC packet")
+)
+
+// versionParams holds the version-specific constants used to protect Initial
+// packets (RFC 9001 section 5.2, RFC 9369 section 3.3).
+type versionParams struct {
+	salt        []byte
+	labelPrefix string
+	initialType byte
+}
+
+var versions = map[uint32]versionParams{
+	// QUIC v1 (RFC 9000).
+	0x00000001: {
+		salt:        []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+		labelPrefix: "quic ",
+		initialType: 0,
+	},
+	// QUIC v2 (RFC 9369).
+	0x6b3343cf: {
+		salt:        []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+		labelPrefix: "quicv2 ",
+		initialType: 1,
+	},
+	// draft-29, still sent by some older clients.
+	0xff00001d: {
+		salt:        []byte{0xaf, 0xbf, 0xec, 0x28, 0x99, 0x93, 0xd2, 0x4c, 0x9e, 0x97, 0x86, 0xf1, 0x9c, 0x61, 0x11, 0xe0, 0x43, 0x90, 0xa8, 0x99},
+		labelPrefix: "quic ",
+		initialType: 0,
+	},
+}
+
+// initialKeys are the packet protection keys of the client's Initial packets.
+type initialKeys struct {
+	key, iv, hp []byte
+}
+
+// clientInitialKeys derives the client's Initial keys from the destination
+// connection ID of its first Initial packet.
+func (v versionParams) clientInitialKeys(dcid []byte) initialKeys {
+	initialSecret := hkdfExtract(sha256.New, v.salt, dcid)
+	secret := hkdfExpandLabel(sha256.New, initialSecret, "client in", sha256.Size)
+	return initialKeys{
+		key: hkdfExpandLabel(sha256.New, secret, v.labelPrefix+"key", 16),
+		iv:  hkdfExpandLabel(sha256.New, secret, v.labelPrefix+"iv", 12),
+		hp:  hkdfExpandLabel(sha256.New, secret, v.labelPrefix+"hp", 16),
+	}
+}
+
+func hkdfExtract(h func() hash.Hash, salt, ikm []byte) []byte {
+	mac := hmac.New(h, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label from RFC 8446 section 7.1,
+// with an empty context.
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	fullLabel := "tls13 " + label
+	info := make([]byte, 0, 4+len(fullLabel))
+	info = append(info, byte(length>>8), byte(length), byte(len(fullLabel)))
+	info = append(info, fullLabel...)
+	info = append(info, 0)
+
+	mac := hmac.New(h, secret)
+	var out, block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac.Reset()
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		block = mac.Sum(block[:0])
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// initialPacket is a decrypted client Initial packet.
+type initialPacket struct {
+	version uint32
+	dcid    []byte
+	crypto  []cryptoFrame
+}
+
+// cryptoFrame is a fragment of the TLS handshake carried in a CRYPTO frame.
+type cryptoFrame struct {
+	offset uint64
+	data   []byte
+}
+
+// parseClientInitial decrypts a client Initial packet at the start of a UDP
+// payload and returns the CRYPTO frames it carries. Coalesced packets that
+// follow the Initial packet are ignored. The payload isn't modified and the
+// result doesn't reference it.
+func parseClientInitial(payload []byte) (*initialPacket, error) {
+	if len(payload) < 7 || payload[0]&0x80 == 0 {
+		return nil, errNotInitial
+	}
+	version := binary.BigEndian.Uint32(payload[1:5])
+	params, found := versions[version]
+	if !found {
+		// Includes version negotiation packets, which have version 0.
+		return nil, errUnsupportedVersion
+	}
+	if payload[0]&0x40 == 0 || (payload[0]>>4)&0x03 != params.initialType {
+		return nil, errNotInitial
+	}
+	r := reader{buf: payload, off: 5}
+	dcid := r.bytes(int(r.uint8()))
+	r.bytes(int(r.uint8())) // Source connection ID.
+	r.varintBytes()         // Token.
+	length := r.varint()
+	if r.err != nil || len(dcid) > 20 {
+		return nil, errTruncated
+	}
+	pnOffset := r.off
+	// The header protection sample starts 4 bytes after the packet number,
+	// as if it was 4 bytes long, and must be followed by the AEAD tag.
+	if length < 4+aes.BlockSize || length > uint64(len(payload)-pnOffset) {
+		return nil, errTruncated
+	}
+	end := pnOffset + int(length)
+
+	keys := params.clientInitialKeys(dcid)
+	hp, err := aes.NewCipher(keys.hp)
+	if err != nil {
+		return nil, err
+	}
+	var mask [aes.BlockSize]byte
+	hp.Encrypt(mask[:], payload[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	header := make([]byte, pnOffset+4)
+	copy(header, payload)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+
+	// The packet number is truncated, but a client's first Initial packets
+	// have small packet numbers that fit in their encoding.
+	nonce := make([]byte, len(keys.iv))
+	copy(nonce, keys.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	block, err := aes.NewCipher(keys.key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, payload[pnOffset+pnLen:end], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt QUIC Initial packet: %w", err)
+	}
+	frames, err := parseCryptoFrames(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &initialPacket{
+		version: version,
+		dcid:    append([]byte(nil), dcid...),
+		crypto:  frames,
+	}, nil
+}
+
+// parseCryptoFrames returns the CRYPTO frames in the plaintext payload of an
+// Initial packet. Only the frame types allowed in Initial packets are
+// expected (RFC 9000 section 12.4).
+func parseCryptoFrames(payload []byte) (frames []cryptoFrame, err error) {
+	r := reader{buf: payload}
+	for r.err == nil && r.remaining() > 0 {
+		switch typ := r.varint(); typ {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			r.varint() // Largest acknowledged.
+			r.varint() // ACK delay.
+			ranges := r.varint()
+			r.varint() // First ACK range.
+			for i := uint64(0); i < ranges && r.err == nil; i++ {
+				r.varint() // Gap.
+				r.varint() // ACK range length.
+			}
+			if typ == 0x03 {
+				r.varint() // ECT0 count.
+				r.varint() // ECT1 count.
+				r.varint() // ECN-CE count.
+			}
+		case 0x06: // CRYPTO
+			offset := r.varint()
+			data := r.varintBytes()
+			if r.err == nil {
+				frames = append(frames, cryptoFrame{offset: offset, data: data})
+			}
+		case 0x1c: // CONNECTION_CLOSE
+			r.varint() // Error code.
+			r.varint() // Frame type.
+			r.varintBytes()
+		default:
+			return nil, fmt.Errorf("unexpected frame type 0x%x in QUIC Initial packet", typ)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return frames, nil
+}
+
+// reader decodes big-endian integers, QUIC variable-length integers and
+// length-prefixed fields from a buffer. Once a read goes past the end of the
+// buffer, err is set and all further reads return zero values.
+type reader struct {
+	buf []byte
+	off int
+	err error
+}
+
+func (r *reader) remaining() int {
+	return len(r.buf) - r.off
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > r.remaining() {
+		r.err = errTruncated
+		return nil
+	}
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+// varintBytes reads a field prefixed by its length as a variable-length
+// integer.
+func (r *reader) varintBytes() []byte {
+	n := r.varint()
+	if r.err == nil && n > uint64(r.remaining()) {
+		r.err = errTruncated
+	}
+	return r.bytes(int(n))
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint24() uint32 {
+	if b := r.bytes(3); b != nil {
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	}
+	return 0
+}
+
+// varint decodes a variable-length integer (RFC 9000 section 16).
+func (r *reader) varint() uint64 {
+	if r.err != nil || r.remaining() == 0 {
+		r.err = errTruncated
+		return 0
+	}
+	b := r.bytes(1 << (r.buf[r.off] >> 6))
+	if b == nil {
+		return 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:] {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
@@ -0,0 +1,140 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+// Package quic extracts the TLS ClientHello of QUIC connections from the
+// Initial packets that clients send to UDP port 443. Initial packets are
+// encrypted with keys derived from the connection ID in their header (RFC
+// 9001 section 5.2), so that the server name (SNI) and the ALPN protocols
+// can be read without any secret.
+package quic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+// Port is the UDP port of the QUIC connections that are monitored.
+const Port = 443
+
+// Hello is the TLS ClientHello sent by a client in the Initial packets of a
+// QUIC connection.
+type Hello struct {
+	// Client is the address the Initial packets were sent from.
+	Client net.UDPAddr
+
+	// Server is the address the Initial packets were sent to.
+	Server net.UDPAddr
+
+	// Version is the QUIC version of the Initial packets.
+	Version uint32
+
+	// ServerName is the host name from the server_name extension, if any.
+	ServerName string
+
+	// ALPN is the list of application protocols offered by the client, in
+	// order of preference.
+	ALPN []string
+}
+
+// Consumer is a function that consumes QUIC ClientHellos. It's safe to call
+// from any goroutine.
+type Consumer func(Hello)
+
+// Sniffer is the interface implemented by QUIC ClientHello sniffers.
+type Sniffer interface {
+	// Monitor starts monitoring for QUIC ClientHellos in the background. It
+	// must return once monitoring has started, with an error if it couldn't
+	// be started. Hellos are passed to the consumer until the context is
+	// cancelled, after which the sniffer must release its resources.
+	Monitor(ctx context.Context, consumer Consumer) error
+}
+
+type noopSniffer struct{}
+
+// Monitor is a no-op.
+func (noopSniffer) Monitor(context.Context, Consumer) error {
+	return nil
+}
+
+// NewSniffer creates a new sniffer based on the metricset's config. It's a
+// no-op unless socket.quic.enabled is set.
+func NewSniffer(base mb.BaseMetricSet, log *logp.Logger) (Sniffer, error) {
+	config := defaultConfig()
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, fmt.Errorf("failed to unpack quic config: %w", err)
+	}
+	if !config.Enabled {
+		return noopSniffer{}, nil
+	}
+	return newCapture(config, log)
+}
+
+var (
+	errNotIP  = errors.New("network is not IP")
+	errNotUDP = errors.New("transport is not UDP")
+)
+
+// parser extracts the ClientHello of QUIC connections from captured packets,
+// reassembling it when it spans several Initial packets. It isn't safe for
+// concurrent use.
+type parser struct {
+	assembler *assembler
+}
+
+func newParser() *parser {
+	return &parser{assembler: newAssembler()}
+}
+
+// parse decodes a captured UDP datagram. The first layer is the packet's link
+// type, as in dns.ParseResponse. It returns false until the whole ClientHello
+// of a connection has been received, and an error when the packet isn't a
+// client Initial packet of a supported QUIC version. The packet isn't
+// referenced by the returned Hello.
+func (p *parser) parse(data []byte, first gopacket.LayerType, now time.Time) (hello Hello, ok bool, err error) {
+	pkt := gopacket.NewPacket(data, first, gopacket.NoCopy)
+	switch v := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		hello.Client.IP = append(net.IP(nil), v.SrcIP...)
+		hello.Server.IP = append(net.IP(nil), v.DstIP...)
+	case *layers.IPv6:
+		hello.Client.IP = append(net.IP(nil), v.SrcIP...)
+		hello.Server.IP = append(net.IP(nil), v.DstIP...)
+	default:
+		return hello, false, errNotIP
+	}
+	udp, isUDP := pkt.TransportLayer().(*layers.UDP)
+	if !isUDP {
+		return hello, false, errNotUDP
+	}
+	hello.Client.Port = int(udp.SrcPort)
+	hello.Server.Port = int(udp.DstPort)
+
+	initial, err := parseClientInitial(udp.Payload)
+	if err != nil {
+		return hello, false, err
+	}
+	// Connection IDs are only unique per client.
+	key := hello.Client.String() + "/" + string(initial.dcid)
+	msg, complete := p.assembler.add(key, initial.crypto, now)
+	if !complete {
+		return hello, false, nil
+	}
+	ch, err := parseClientHello(msg)
+	if err != nil {
+		return hello, false, fmt.Errorf("failed to parse QUIC ClientHello: %w", err)
+	}
+	hello.Version = initial.version
+	hello.ServerName = ch.serverName
+	hello.ALPN = ch.alpn
+	return hello, true, nil
+}
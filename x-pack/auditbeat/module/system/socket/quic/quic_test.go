@@ -0,0 +1,239 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package quic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientInitialKeys(t *testing.T) {
+	// Test vectors from RFC 9001 appendix A.1 and RFC 9369 appendix A.1.
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	for _, tc := range []struct {
+		version     uint32
+		key, iv, hp string
+	}{
+		{
+			version: 0x00000001,
+			key:     "1f369613dd76d5467730efcbe3b1a22d",
+			iv:      "fa044b2f42a3fd3b46fb255c",
+			hp:      "9f50449e04a0e810283a1e9933adedd2",
+		},
+		{
+			version: 0x6b3343cf,
+			key:     "8b1a0bc121284290a29e0971b5cd045d",
+			iv:      "91f73e2351d8fa91660e909f",
+			hp:      "45b95e15235d6f45a6b19cbcb0294ba9",
+		},
+	} {
+		keys := versions[tc.version].clientInitialKeys(dcid)
+		assert.Equal(t, tc.key, hex.EncodeToString(keys.key), "version 0x%x", tc.version)
+		assert.Equal(t, tc.iv, hex.EncodeToString(keys.iv), "version 0x%x", tc.version)
+		assert.Equal(t, tc.hp, hex.EncodeToString(keys.hp), "version 0x%x", tc.version)
+	}
+}
+
+func makeClientHello(serverName string, alpn ...string) []byte {
+	var sni, protos []byte
+	sni = append(sni, 0, byte(len(serverName)))
+	sni = append(sni, serverName...)
+	sni = append([]byte{0, byte(len(sni) + 1), 0}, sni...)
+	for _, p := range alpn {
+		protos = append(protos, byte(len(p)))
+		protos = append(protos, p...)
+	}
+	protos = append([]byte{0, byte(len(protos))}, protos...)
+
+	var exts []byte
+	exts = append(exts, 0, 0, 0, byte(len(sni)))
+	exts = append(exts, sni...)
+	exts = append(exts, 0, 16, 0, byte(len(protos)))
+	exts = append(exts, protos...)
+
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0)                  // Session ID.
+	body = append(body, 0, 2, 0x13, 0x01)   // Cipher suites.
+	body = append(body, 1, 0)               // Compression methods.
+	body = append(body, 0, byte(len(exts))) // Extensions.
+	body = append(body, exts...)
+
+	msg := []byte{1, 0, byte(len(body) >> 8), byte(len(body))}
+	return append(msg, body...)
+}
+
+func makeCryptoFrame(offset int, data []byte) []byte {
+	frame := []byte{0x06, 0x40 | byte(offset>>8), byte(offset), 0x40 | byte(len(data)>>8), byte(len(data))}
+	return append(frame, data...)
+}
+
+// sealInitial builds a client Initial packet carrying the given frames, padded
+// to 1200 bytes, as described in RFC 9001 section 5.
+func sealInitial(t testing.TB, version uint32, dcid []byte, pn uint16, frames []byte) []byte {
+	params := versions[version]
+	keys := params.clientInitialKeys(dcid)
+
+	header := []byte{0xc0 | params.initialType<<4 | 0x01}
+	header = binary.BigEndian.AppendUint32(header, version)
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, 0) // Source connection ID.
+	header = append(header, 0) // Token.
+	plaintext := append([]byte(nil), frames...)
+	if pad := 1200 - len(header) - 2 - 2 - len(plaintext) - 16; pad > 0 {
+		plaintext = append(plaintext, make([]byte, pad)...)
+	}
+	length := 2 + len(plaintext) + 16
+	header = append(header, 0x40|byte(length>>8), byte(length))
+	pnOffset := len(header)
+	header = append(header, byte(pn>>8), byte(pn))
+
+	nonce := append([]byte(nil), keys.iv...)
+	nonce[len(nonce)-2] ^= byte(pn >> 8)
+	nonce[len(nonce)-1] ^= byte(pn)
+	block, err := aes.NewCipher(keys.key)
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	pkt := aead.Seal(append([]byte(nil), header...), nonce, plaintext, header)
+
+	hp, err := aes.NewCipher(keys.hp)
+	require.NoError(t, err)
+	var mask [aes.BlockSize]byte
+	hp.Encrypt(mask[:], pkt[pnOffset+4:pnOffset+4+aes.BlockSize])
+	pkt[0] ^= mask[0] & 0x0f
+	pkt[pnOffset] ^= mask[1]
+	pkt[pnOffset+1] ^= mask[2]
+	return pkt
+}
+
+func makeDatagram(t testing.TB, payload []byte) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(192, 168, 0, 2).To4(),
+		DstIP:    net.IPv4(192, 168, 0, 1).To4(),
+	}
+	udp := &layers.UDP{SrcPort: 34567, DstPort: Port}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(payload)))
+	return buf.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	dcid := []byte{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+	hello := makeClientHello("www.example.net", "h3", "h3-29")
+	now := time.Now()
+
+	for _, version := range []uint32{0x00000001, 0x6b3343cf, 0xff00001d} {
+		p := newParser()
+		pkt := makeDatagram(t, sealInitial(t, version, dcid, 0, makeCryptoFrame(0, hello)))
+		h, ok, err := p.parse(pkt, layers.LayerTypeIPv4, now)
+		require.NoError(t, err, "version 0x%x", version)
+		require.True(t, ok, "version 0x%x", version)
+		// The hello mustn't reference the packet.
+		for i := range pkt {
+			pkt[i] = 0
+		}
+		assert.Equal(t, version, h.Version)
+		assert.Equal(t, "192.168.0.2:34567", h.Client.String())
+		assert.Equal(t, "192.168.0.1:443", h.Server.String())
+		assert.Equal(t, "www.example.net", h.ServerName)
+		assert.Equal(t, []string{"h3", "h3-29"}, h.ALPN)
+	}
+}
+
+func TestParseReassembly(t *testing.T) {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	hello := makeClientHello("www.example.net", "h3")
+	now := time.Now()
+	p := newParser()
+
+	// The second half of the ClientHello is received first.
+	second := makeDatagram(t, sealInitial(t, 1, dcid, 1, makeCryptoFrame(40, hello[40:])))
+	first := makeDatagram(t, sealInitial(t, 1, dcid, 0, makeCryptoFrame(0, hello[:40])))
+
+	_, ok, err := p.parse(second, layers.LayerTypeIPv4, now)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	h, ok, err := p.parse(first, layers.LayerTypeIPv4, now)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "www.example.net", h.ServerName)
+
+	// Retransmissions aren't reported again.
+	_, ok, err = p.parse(first, layers.LayerTypeIPv4, now)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// Incomplete hellos expire.
+	other := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	_, ok, _ = p.parse(makeDatagram(t, sealInitial(t, 1, other, 0, makeCryptoFrame(0, hello[:40]))), layers.LayerTypeIPv4, now)
+	assert.False(t, ok)
+	p.assembler.expire(now.Add(2 * pendingTimeout))
+	assert.Empty(t, p.assembler.pending)
+}
+
+func TestParseErrors(t *testing.T) {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	initial := sealInitial(t, 1, dcid, 0, makeCryptoFrame(0, makeClientHello("www.example.net")))
+	p := newParser()
+
+	// Version negotiation packet.
+	vn := []byte{0x80, 0, 0, 0, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0, 1}
+	_, _, err := p.parse(makeDatagram(t, vn), layers.LayerTypeIPv4, time.Now())
+	assert.ErrorIs(t, err, errUnsupportedVersion)
+
+	// Unknown version.
+	unknown := append([]byte(nil), initial...)
+	binary.BigEndian.PutUint32(unknown[1:], 0x1a2a3a4a)
+	_, _, err = p.parse(makeDatagram(t, unknown), layers.LayerTypeIPv4, time.Now())
+	assert.ErrorIs(t, err, errUnsupportedVersion)
+
+	// Short header packet.
+	_, _, err = p.parse(makeDatagram(t, []byte{0x40, 1, 2, 3, 4, 5, 6, 7, 8}), layers.LayerTypeIPv4, time.Now())
+	assert.ErrorIs(t, err, errNotInitial)
+
+	// Truncated packet.
+	_, _, err = p.parse(makeDatagram(t, initial[:100]), layers.LayerTypeIPv4, time.Now())
+	assert.ErrorIs(t, err, errTruncated)
+
+	// Corrupted packet.
+	corrupted := append([]byte(nil), initial...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	_, _, err = p.parse(makeDatagram(t, corrupted), layers.LayerTypeIPv4, time.Now())
+	assert.Error(t, err)
+
+	_, _, err = p.parse([]byte{1, 2, 3}, layers.LayerTypeIPv4, time.Now())
+	assert.Error(t, err)
+}
+
+func BenchmarkParse(b *testing.B) {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	pkt := makeDatagram(b, sealInitial(b, 1, dcid, 0, makeCryptoFrame(0, makeClientHello("www.example.net", "h3"))))
+	now := time.Now()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// A new parser each time, so that the hello isn't a retransmission.
+		if _, ok, err := newParser().parse(pkt, layers.LayerTypeIPv4, now); err != nil || !ok {
+			b.Fatal(ok, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+)
+
+// isTransientError returns whether an error installing or monitoring a probe
+// can go away by retrying, as happens when the kprobe_events file is being
+// modified by another process. Other errors, like a missing kernel symbol
+// (ENOENT) or an invalid probe (EINVAL), are permanent.
+func isTransientError(err error) bool {
+	return errors.Is(err, unix.EBUSY) || errors.Is(err, unix.EAGAIN)
+}
+
+// retrier retries operations that fail with a transient error, waiting an
+// exponentially increasing time between attempts.
+type retrier struct {
+	log     helper.Logger
+	retries int
+	backoff time.Duration
+	sleep   func(time.Duration)
+}
+
+func newRetrier(log helper.Logger, retries int, backoff time.Duration) retrier {
+	return retrier{
+		log:     log,
+		retries: retries,
+		backoff: backoff,
+		sleep:   time.Sleep,
+	}
+}
+
+// do runs fn until it succeeds, fails with a permanent error or the retries
+// are exhausted. Returns the last error.
+func (r retrier) do(what string, fn func() error) error {
+	backoff := r.backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= r.retries || !isTransientError(err) {
+			return err
+		}
+		r.log.Warnf("Transient error trying to %s (retry %d of %d in %v): %v", what, attempt+1, r.retries, backoff, err)
+		r.sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestRetrier(t *testing.T) {
+	// Errors as returned when writing to kprobe_events.
+	writeErr := func(errno unix.Errno) error {
+		return fmt.Errorf("failed installing probe: %w", &os.PathError{Op: "write", Path: "kprobe_events", Err: errno})
+	}
+	for _, tc := range []struct {
+		name     string
+		errs     []error
+		calls    int
+		expected error
+		sleeps   []time.Duration
+	}{
+		{
+			name:  "success",
+			calls: 1,
+		},
+		{
+			name:   "transient",
+			errs:   []error{writeErr(unix.EBUSY), writeErr(unix.EAGAIN)},
+			calls:  3,
+			sleeps: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+		},
+		{
+			name:     "permanent",
+			errs:     []error{writeErr(unix.ENOENT)},
+			calls:    1,
+			expected: writeErr(unix.ENOENT),
+		},
+		{
+			name:     "transient then permanent",
+			errs:     []error{writeErr(unix.EBUSY), writeErr(unix.EINVAL)},
+			calls:    2,
+			expected: writeErr(unix.EINVAL),
+			sleeps:   []time.Duration{10 * time.Millisecond},
+		},
+		{
+			name:     "exhausted",
+			errs:     []error{unix.EBUSY, unix.EBUSY, unix.EBUSY, unix.EBUSY, unix.EBUSY},
+			calls:    4,
+			expected: unix.EBUSY,
+			sleeps:   []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sleeps []time.Duration
+			r := newRetrier((*logWrapper)(t), 3, 10*time.Millisecond)
+			r.sleep = func(d time.Duration) {
+				sleeps = append(sleeps, d)
+			}
+			calls := 0
+			err := r.do("test", func() error {
+				calls++
+				if calls <= len(tc.errs) {
+					return tc.errs[calls-1]
+				}
+				return nil
+			})
+			assert.Equal(t, tc.expected, err)
+			assert.Equal(t, tc.calls, calls)
+			assert.Equal(t, tc.sleeps, sleeps)
+		})
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	servicesPath = "/etc/services"
+
+	// Ports at or above this value are considered ephemeral (Linux's default
+	// ip_local_port_range starts at 32768) and are never resolved from the
+	// services table, only from user-supplied overrides.
+	minEphemeralPort = 32768
+)
+
+// builtinServices is used when the system's services database is not
+// available. Names follow the IANA service name registry, except for the ones
+// in commonServiceNames.
+var builtinServices = map[flowProto]map[uint16]string{
+	protoTCP: {
+		20:    "ftp-data",
+		21:    "ftp",
+		22:    "ssh",
+		23:    "telnet",
+		25:    "smtp",
+		53:    "dns",
+		80:    "http",
+		88:    "kerberos",
+		110:   "pop3",
+		111:   "sunrpc",
+		143:   "imap",
+		179:   "bgp",
+		389:   "ldap",
+		443:   "https",
+		445:   "smb",
+		465:   "submissions",
+		587:   "submission",
+		636:   "ldaps",
+		873:   "rsync",
+		993:   "imaps",
+		995:   "pop3s",
+		1433:  "mssql",
+		1521:  "oracle",
+		2049:  "nfs",
+		2181:  "zookeeper",
+		2379:  "etcd-client",
+		3306:  "mysql",
+		3389:  "rdp",
+		5432:  "postgresql",
+		5672:  "amqp",
+		6379:  "redis",
+		8080:  "http-alt",
+		9092:  "kafka",
+		9200:  "elasticsearch",
+		11211: "memcache",
+		27017: "mongodb",
+	},
+	protoUDP: {
+		53:   "dns",
+		67:   "dhcp",
+		68:   "dhcp",
+		69:   "tftp",
+		88:   "kerberos",
+		111:  "sunrpc",
+		123:  "ntp",
+		137:  "netbios-ns",
+		161:  "snmp",
+		162:  "snmp-trap",
+		443:  "https",
+		500:  "isakmp",
+		514:  "syslog",
+		1812: "radius",
+		4789: "vxlan",
+		5353: "mdns",
+	},
+}
+
+// commonServiceNames maps legacy IANA names, as found in services(5), to the
+// names commonly used for the protocols in ECS and by other Beats.
+var commonServiceNames = map[string]string{
+	"domain":        "dns",
+	"imap2":         "imap",
+	"ms-wbt-server": "rdp",
+	"ms-sql-s":      "mssql",
+	"microsoft-ds":  "smb",
+	"ncube-lm":      "oracle",
+	"bootps":        "dhcp",
+	"bootpc":        "dhcp",
+}
+
+// serviceTable resolves destination ports to service names.
+type serviceTable struct {
+	byProto   map[flowProto]map[uint16]string
+	overrides map[uint16]string
+}
+
+// newServiceTable creates a service table from the system's services database,
+// falling back to a built-in table when it can't be read. The overrides take
+// precedence and are applied regardless of the transport protocol.
+func newServiceTable(overrides map[string]string) (*serviceTable, error) {
+	t := &serviceTable{
+		overrides: make(map[uint16]string, len(overrides)),
+	}
+	for key, name := range overrides {
+		port, err := parsePort(key)
+		if err != nil {
+			return nil, err
+		}
+		t.overrides[port] = name
+	}
+	f, err := os.Open(servicesPath)
+	if err != nil {
+		t.byProto = builtinServices
+		return t, fmt.Errorf("unable to read %s, using built-in table: %w", servicesPath, err)
+	}
+	defer f.Close()
+	if t.byProto, err = parseServices(f); err != nil {
+		t.byProto = builtinServices
+		return t, fmt.Errorf("unable to parse %s, using built-in table: %w", servicesPath, err)
+	}
+	return t, nil
+}
+
+// parseServices parses a services(5) database.
+func parseServices(r io.Reader) (map[flowProto]map[uint16]string, error) {
+	table := map[flowProto]map[uint16]string{
+		protoTCP:  make(map[uint16]string),
+		protoUDP:  make(map[uint16]string),
+		protoSCTP: make(map[uint16]string),
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if pos := strings.IndexByte(line, '#'); pos != -1 {
+			line = line[:pos]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		portStr, protoStr, found := strings.Cut(fields[1], "/")
+		if !found {
+			continue
+		}
+		var proto flowProto
+		switch protoStr {
+		case "tcp":
+			proto = protoTCP
+		case "udp":
+			proto = protoUDP
+		case "sctp":
+			proto = protoSCTP
+		default:
+			continue
+		}
+		port, err := parsePort(portStr)
+		if err != nil {
+			continue
+		}
+		// Keep the first entry for a port, as services(5) lists the
+		// canonical name first.
+		if _, exists := table[proto][port]; !exists {
+			name := fields[0]
+			if common, found := commonServiceNames[name]; found {
+				name = common
+			}
+			table[proto][port] = name
+		}
+	}
+	return table, scanner.Err()
+}
+
+// Lookup returns the service name for the given destination port, or an
+// empty string when it's unknown or ephemeral.
+func (t *serviceTable) Lookup(proto flowProto, port int) string {
+	if t == nil || port <= 0 || port > 0xFFFF {
+		return ""
+	}
+	if name, found := t.overrides[uint16(port)]; found {
+		return name
+	}
+	if port >= minEphemeralPort {
+		return ""
+	}
+	return t.byProto[proto][uint16(port)]
+}
@@ -0,0 +1,38 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+// detectSimultaneousOpen flags the TCP flows connected by both of their ends,
+// which happens with a simultaneous open. Only connections between local
+// processes are detected, as both connect calls must be seen. A sock connected
+// to its own address, a TCP self-connect, is also a simultaneous open.
+func (s *state) detectSimultaneousOpen(f *flow) {
+	if f.connectingKey != "" || !f.connectAttempt || f.proto != protoTCP || !f.isLocal() {
+		return
+	}
+	netns, local, remote := f.netNS(), f.local.addr.String(), f.remote.addr.String()
+	if local == remote {
+		f.tcp.simultaneousOpen = true
+		return
+	}
+	if s.connecting == nil {
+		s.connecting = make(map[string]*flow)
+	}
+	f.connectingKey = localFlowKey(netns, f.proto, local, remote)
+	if peer, found := s.connecting[localFlowKey(netns, f.proto, remote, local)]; found && peer.sock != f.sock {
+		peer.tcp.simultaneousOpen = true
+		f.tcp.simultaneousOpen = true
+	}
+	s.connecting[f.connectingKey] = f
+}
+
+// forgetConnecting removes a terminated flow from the connecting flows.
+func (s *state) forgetConnecting(f *flow) {
+	if f.connectingKey != "" && s.connecting[f.connectingKey] == f {
+		delete(s.connecting, f.connectingKey)
+	}
+}
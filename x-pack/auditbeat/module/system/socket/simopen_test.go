@@ -0,0 +1,84 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSimultaneousOpen(t *testing.T) {
+	const (
+		sockA uintptr = 0xff1234
+		sockB uintptr = 0xff5678
+	)
+	loopback := ipv4("127.0.0.1")
+	connect := func(pid uint32, sock uintptr, lPort, rPort uint16, ts uint64) []event {
+		return []event{
+			&inetCreate{Meta: meta(pid, pid, ts), Proto: 0},
+			&sockInitData{Meta: meta(pid, pid, ts), Sock: sock},
+			&tcpIPv4ConnectCall{Meta: meta(pid, pid, ts+1), Sock: sock, LAddr: loopback, LPort: be16(lPort), RAddr: loopback, RPort: be16(rPort)},
+			&tcpConnectResult{Meta: meta(pid, pid, ts+2), Retval: 0},
+		}
+	}
+	release := func(pid uint32, sock uintptr, ts uint64) event {
+		return &inetReleaseCall{Meta: meta(pid, pid, ts), Sock: sock}
+	}
+	var simultaneous, regular, self []event
+	simultaneous = append(simultaneous, connect(1234, sockA, 5000, 6000, 5)...)
+	simultaneous = append(simultaneous, connect(1235, sockB, 6000, 5000, 6)...)
+	simultaneous = append(simultaneous, release(1234, sockA, 20), release(1235, sockB, 21))
+
+	regular = append(regular, connect(1234, sockA, 5000, 6000, 5)...)
+	regular = append(regular,
+		&tcpAcceptResult4{
+			Meta:  meta(1235, 1235, 9),
+			Sock:  sockB,
+			LAddr: loopback,
+			LPort: be16(6000),
+			RAddr: loopback,
+			RPort: be16(5000),
+			Af:    unix.AF_INET,
+		},
+		release(1234, sockA, 20), release(1235, sockB, 21))
+
+	self = append(self, connect(1234, sockA, 5000, 5000, 5)...)
+	self = append(self, release(1234, sockA, 20))
+
+	for _, tc := range []struct {
+		name     string
+		evs      []event
+		flows    int
+		expected bool
+	}{
+		{"simultaneous open", simultaneous, 2, true},
+		{"connect and accept", regular, 2, false},
+		{"self connect", self, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			st.feedEvents(tc.evs)
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, tc.flows) {
+				t.FailNow()
+			}
+			for _, f := range flows {
+				if tc.expected {
+					assertValue(t, f, true, "network.tcp.simultaneous_open")
+					continue
+				}
+				_, err := f.GetValue("network.tcp.simultaneous_open")
+				assert.Error(t, err)
+			}
+			assert.Empty(t, st.connecting)
+		})
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"net"
+	"time"
+)
+
+// Snapshot is a read-only copy of the flows and processes tracked by the
+// dataset at a given time.
+type Snapshot struct {
+	Time      time.Time
+	Flows     []FlowSnapshot
+	Processes []ProcessSnapshot
+}
+
+// FlowSnapshot is a copy of a flow that hasn't been reported yet.
+type FlowSnapshot struct {
+	Transport string
+	Direction string
+	Local     EndpointSnapshot
+	Remote    EndpointSnapshot
+	PID       uint32
+	Created   time.Time
+	LastSeen  time.Time
+	Complete  bool
+}
+
+// EndpointSnapshot is a copy of one end of a flow. IP is nil when the address
+// is unknown.
+type EndpointSnapshot struct {
+	IP      net.IP
+	Port    int
+	Packets uint64
+	Bytes   uint64
+}
+
+// ProcessSnapshot is a copy of a process table entry.
+type ProcessSnapshot struct {
+	PID           uint32
+	Name          string
+	Path          string
+	Args          []string
+	Created       time.Time
+	EntityID      string
+	NamespacedPID uint32 // Zero in the host's PID namespace.
+}
+
+// Snapshot returns a copy of the current flows and process table. It's safe
+// to call concurrently with event processing. The state lock is only held to
+// copy the entries, which are converted afterwards.
+func (s *state) Snapshot() Snapshot {
+	s.Lock()
+	now := s.clock()
+	flows := make([]flow, 0, s.numFlows+uint64(len(s.sctp)))
+	for _, sock := range s.socks {
+		for _, f := range sock.flows {
+			flows = append(flows, *f)
+		}
+	}
+	for _, assoc := range s.sctp {
+		flows = append(flows, *assoc)
+	}
+	processes := make([]ProcessSnapshot, 0, len(s.processes))
+	for _, p := range s.processes {
+		processes = append(processes, ProcessSnapshot{
+			PID:           p.pid,
+			NamespacedPID: p.namespacedPID,
+			Name:          p.name,
+			Path:          p.path,
+			Args:          p.args,
+			Created:       p.createdTime,
+			EntityID:      p.entityID,
+		})
+	}
+	s.Unlock()
+
+	snap := Snapshot{
+		Time:      now,
+		Flows:     make([]FlowSnapshot, len(flows)),
+		Processes: processes,
+	}
+	for idx := range flows {
+		f := &flows[idx]
+		snap.Flows[idx] = FlowSnapshot{
+			Transport: f.proto.String(),
+			Direction: f.dir.String(),
+			Local:     f.local.snapshot(),
+			Remote:    f.remote.snapshot(),
+			PID:       f.pid,
+			Created:   f.createdTime,
+			LastSeen:  f.lastSeenTime,
+			Complete:  f.complete,
+		}
+	}
+	for idx := range processes {
+		processes[idx].Args = append([]string(nil), processes[idx].Args...)
+	}
+	return snap
+}
+
+func (e *endpoint) snapshot() EndpointSnapshot {
+	var ip net.IP
+	if e.addr.IP != nil {
+		ip = append(net.IP(nil), e.addr.IP...)
+	}
+	return EndpointSnapshot{
+		IP:      ip,
+		Port:    e.addr.Port,
+		Packets: e.packets,
+		Bytes:   e.bytes,
+	}
+}
+
+// Snapshot returns a copy of the flows and processes currently tracked by the
+// dataset. The second return value is false when the dataset isn't running.
+func (m *MetricSet) Snapshot() (Snapshot, bool) {
+	m.stateMutex.Lock()
+	st := m.state
+	m.stateMutex.Unlock()
+	if st == nil {
+		return Snapshot{}, false
+	}
+	return st.Snapshot(), true
+}
+
+func (m *MetricSet) setState(st *state) {
+	m.stateMutex.Lock()
+	m.state = st
+	m.stateMutex.Unlock()
+}
@@ -0,0 +1,92 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	st.feedEvents([]event{
+		callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl", "https://example.net/"}),
+		&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+		&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+		&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock},
+		&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+		&ipLocalOutCall{
+			Meta:  meta(1234, 1235, 8),
+			Sock:  sock,
+			Size:  20,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+		},
+		&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+	})
+
+	snap := st.Snapshot()
+	if !assert.Len(t, snap.Flows, 1) {
+		t.FailNow()
+	}
+	f := snap.Flows[0]
+	assert.Equal(t, "tcp", f.Transport)
+	assert.Equal(t, "egress", f.Direction)
+	assert.Equal(t, uint32(1234), f.PID)
+	assert.True(t, net.ParseIP(localIP).Equal(f.Local.IP))
+	assert.Equal(t, localPort, f.Local.Port)
+	assert.Equal(t, uint64(1), f.Local.Packets)
+	assert.Equal(t, uint64(20), f.Local.Bytes)
+	assert.True(t, net.ParseIP(remoteIP).Equal(f.Remote.IP))
+	assert.Equal(t, remotePort, f.Remote.Port)
+
+	if assert.Len(t, snap.Processes, 1) {
+		p := snap.Processes[0]
+		assert.Equal(t, uint32(1234), p.PID)
+		assert.Equal(t, "curl", p.Name)
+		assert.Equal(t, []string{"/usr/bin/curl", "https://example.net/"}, p.Args)
+	}
+
+	// The snapshot isn't affected by later changes to the state.
+	f.Local.IP[len(f.Local.IP)-1] = 0
+	st.feedEvents([]event{
+		&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock},
+	})
+	st.ExpireFlows()
+	flows := st.getFlows()
+	if assert.Len(t, flows, 1) {
+		assertValue(t, flows[0], localIP, "source.ip")
+	}
+	assert.Len(t, snap.Flows, 1)
+	assert.Empty(t, st.Snapshot().Flows)
+}
+
+func TestMetricSetSnapshot(t *testing.T) {
+	var m MetricSet
+	_, running := m.Snapshot()
+	assert.False(t, running)
+
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	m.setState(&st.state)
+	snap, running := m.Snapshot()
+	assert.True(t, running)
+	assert.Empty(t, snap.Flows)
+}
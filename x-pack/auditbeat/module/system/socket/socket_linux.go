@@ -8,7 +8,6 @@ package socket
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
@@ -29,16 +28,18 @@ import (
 	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system"
 	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/guess"
 	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/quic"
 	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
 	"github.com/elastic/elastic-agent-libs/logp"
 	"github.com/elastic/elastic-agent-libs/mapstr"
-	"github.com/elastic/go-perf"
 	"github.com/elastic/go-sysinfo"
 	"github.com/elastic/go-sysinfo/providers/linux"
 
 	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns"
 	// Register dns capture implementations
 	_ "github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns/afpacket"
+	_ "github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns/rawsocket"
+	_ "github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns/uprobe"
 )
 
 const (
@@ -58,9 +59,9 @@ var (
 	eventCount    uint64
 )
 
-var defaultMounts = []*mountPoint{
-	{fsType: "tracefs", path: "/sys/kernel/tracing"},
-	{fsType: "debugfs", path: "/sys/kernel/debug"},
+var defaultMounts = []fsMounter{
+	&mountPoint{fsType: "tracefs", path: "/sys/kernel/tracing"},
+	&mountPoint{fsType: "debugfs", path: "/sys/kernel/debug"},
 }
 
 // MetricSet for system/socket.
@@ -72,11 +73,40 @@ type MetricSet struct {
 	detailLog    *logp.Logger
 	installer    helper.ProbeInstaller
 	sniffer      dns.Sniffer
+	quicSniffer  quic.Sniffer
 	perfChannel  *tracing.PerfChannel
-	mountedFS    *mountPoint
+	traceFS      *traceFSMount
+	ports        *portFilter
+	remoteCIDRs  *cidrFilter
+	special      *specialAddrClassifier
+	zones        *zoneClassifier
+	bgp          *bgpRIB
+	symbols      *symbolMap
 	isDebug      bool
 	isDetailed   bool
+	detailed     *detailSampler
 	terminated   sync.WaitGroup
+
+	// monitored are the probes monitored by the perf channel, to monitor
+	// them again when it's reopened.
+	monitored []monitoredProbe
+
+	// traceFSInstance is the tracing instance created for this dataset. Nil
+	// when the global instance is used.
+	traceFSInstance *tracing.TraceFS
+
+	// flowExporter writes completed flows to socket.flow_export_socket.
+	flowExporter *flowExporter
+
+	// hasPathMTU is set when the probe that captures the path MTU is installed.
+	hasPathMTU bool
+	// hasSCTPDetails is set when the probe that captures the verification
+	// tags and streams of SCTP associations is installed.
+	hasSCTPDetails bool
+
+	// state of the running dataset, for Snapshot. Nil when not running.
+	stateMutex sync.Mutex
+	state      *state
 }
 
 func init() {
@@ -125,10 +155,41 @@ func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
 func newSocketMetricset(config Config, base mb.BaseMetricSet) (*MetricSet, error) {
 	cfgwarn.Beta("The %s dataset is beta.", fullName)
 	logger := logp.NewLogger(metricsetName)
+	for _, warning := range config.Warnings() {
+		logger.Warn(warning)
+	}
 	sniffer, err := dns.NewSniffer(base, logger)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create DNS sniffer: %w", err)
 	}
+	quicSniffer, err := quic.NewSniffer(base, logger)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create QUIC sniffer: %w", err)
+	}
+	ports, err := newPortFilter(config.IncludePorts, config.ExcludePorts)
+	if err != nil {
+		return nil, err
+	}
+	remoteCIDRs, err := newCIDRFilter(config.RemoteCIDRFilter)
+	if err != nil {
+		return nil, err
+	}
+	special, err := newSpecialAddrClassifier(config.SpecialDestinations)
+	if err != nil {
+		return nil, err
+	}
+	zones, err := newZoneClassifier(config.NetworkZones)
+	if err != nil {
+		return nil, err
+	}
+	bgp, err := newBGPRIB(config.BGPRIBPath, logger)
+	if err != nil {
+		return nil, err
+	}
+	symbols, err := loadSymbolMap(config.SymbolMapPath)
+	if err != nil {
+		return nil, err
+	}
 	ms := &MetricSet{
 		SystemMetricSet: system.NewSystemMetricSet(base),
 		templateVars:    make(mapstr.M),
@@ -137,7 +198,15 @@ func newSocketMetricset(config Config, base mb.BaseMetricSet) (*MetricSet, error
 		isDebug:         logp.IsDebug(metricsetName),
 		detailLog:       logp.NewLogger(detailSelector),
 		isDetailed:      logp.HasSelector(detailSelector),
+		detailed:        newDetailSampler(config.DetailedSampleRate),
 		sniffer:         sniffer,
+		quicSniffer:     quicSniffer,
+		ports:           ports,
+		remoteCIDRs:     remoteCIDRs,
+		special:         special,
+		zones:           zones,
+		bgp:             bgp,
+		symbols:         symbols,
 	}
 	// Setup the metricset before Run() so that startup can be halted in case of
 	// error.
@@ -154,12 +223,126 @@ func (m *MetricSet) Run(r mb.PushReporterV2) {
 	defer m.terminated.Done()
 	defer m.Cleanup()
 
+	services, err := newServiceTable(m.config.PortServiceOverrides)
+	if err != nil {
+		m.log.Warnf("Loading service names: %v", err)
+	}
+
+	if m.config.DebugEventFile != "" {
+		debugFile, err := newDebugEventFile(r, m.config.DebugEventFile, m.log)
+		if err != nil {
+			m.log.Errorf("Unable to open debug event file: %v", err)
+		} else {
+			m.log.Warnf("Writing events to debug event file %s. This is a development option and must not be used in production.", m.config.DebugEventFile)
+			defer debugFile.Close()
+			r = debugFile
+		}
+	}
+
+	if m.config.FlowExportSocket != "" {
+		if m.flowExporter, err = newFlowExporter(m.config.FlowExportSocket, m.config.FlowExportFormat, m.log); err != nil {
+			m.log.Errorf("Unable to export flows to %s: %v", m.config.FlowExportSocket, err)
+		}
+	}
+
+	var interfaces *interfaceResolver
+	if m.config.IncludeInterfaceName {
+		interfaces = newInterfaceResolver()
+		go interfaces.MonitorLinks(r.Done(), m.log)
+	}
+
+	// The path MTU is only reported when it differs from the MTU of the
+	// interface, which is resolved the same way as interface names.
+	var mtus *interfaceResolver
+	if m.hasPathMTU {
+		if mtus = interfaces; mtus == nil {
+			mtus = newInterfaceResolver()
+			go mtus.MonitorLinks(r.Done(), m.log)
+		}
+	}
+
+	var hosts *hostsResolver
+	if m.config.ResolveHostsFile {
+		hosts = newHostsResolver(hostsPath)
+	}
+
+	var epoch time.Time
+	if !m.config.EnableClockSync {
+		if epoch, err = bootTime(time.Now()); err != nil {
+			m.log.Warnf("Unable to determine the boot time with clock synchronization disabled: %v. "+
+				"Timestamps will be relative to the first event received.", err)
+		}
+	}
+	var (
+		clockSync         *adaptiveClockSync
+		clockSyncObserver func(drift time.Duration, adjusted bool)
+	)
+	if m.config.EnableClockSync && m.config.AdaptiveClockSync {
+		clockSync = newAdaptiveClockSync(m.log, m.config.ClockMaxDrift, m.config.ClockSyncPeriod,
+			m.config.ClockSyncMinPeriod, m.config.ClockSyncMaxPeriod)
+		clockSyncObserver = clockSync.Observe
+	}
+
 	st := NewState(r,
 		m.log,
 		m.config.FlowInactiveTimeout,
 		m.config.SocketInactiveTimeout,
 		m.config.FlowTerminationTimeout,
-		m.config.ClockMaxDrift)
+		m.config.ClockMaxDrift,
+		withServiceTable(services),
+		withKernelHZ(m.kernelHZ()),
+		withProcessAttribution(m.config.FlowProcessAttribution),
+		withFlowKey(m.config.FlowKey),
+		withCGroupFilter(m.config.CGroupFilter, m.config.ReportUnknownCGroup),
+		withInterfaceResolver(interfaces),
+		withSCTP(m.config.EnableSCTP),
+		withSCTPDetails(m.hasSCTPDetails),
+		withPortFilter(m.ports),
+		withRemoteCIDRFilter(m.remoteCIDRs),
+		withSpecialDestinations(m.special),
+		withAddressTypes(newAddressTypeClassifier(m.config.MulticastGroupNames)),
+		withNetworkZones(m.zones),
+		withDNSCoalescing(m.config.CoalesceDNSQueries),
+		withDNSEvents(m.config.EmitDNSEvents, m.config.MaxDNSAnswers),
+		withProcessEvents(m.config.EmitProcessEvents),
+		withTopProcesses(m.config.TopProcessesCount),
+		withProcessCredFields(newCredFields(m.config.ProcessCredFields)),
+		withLocalFlowDedup(m.config.DedupLocalFlows, m.config.LocalFlowHoldTime),
+		withProcessCapabilities(m.config.IncludeProcessCapabilities),
+		withProcessWorkingDirectory(m.config.IncludeProcessWorkingDirectory),
+		withKernelEpoch(epoch),
+		withZeroWindowThreshold(m.config.ZeroWindowThreshold),
+		withReportOnEstablish(m.config.ReportOnEstablish),
+		withInterimByteRates(m.config.InterimByteRates),
+		withReportEmptyFlows(m.config.ReportEmptyFlows),
+		withConnectFailures(m.config.ReportConnectFailures),
+		withInferListenerProcess(m.config.InferListenerProcess),
+		withPeerCounting(m.config.PeerCountWindow, m.config.PeerCountMaxPeers),
+		withNamespacedPIDs(m.config.IncludeNamespacedPID),
+		withProcessEnvLabels(m.config.ProcessEnvLabels),
+		withMaxArgsLength(m.config.ProcessMaxArgsLength),
+		withMPTCP(m.config.EnableMPTCP),
+		withQUIC(m.config.EnableQUIC),
+		withHostsResolver(hosts),
+		withBGPRIB(m.bgp),
+		withDeletedExecutableCheck(m.config.DetectDeletedExecutable),
+		withProcessFDCount(m.config.ReportProcessFDCount),
+		withMainThreadID(m.config.ReportMainThreadID),
+		withProcessRetention(m.config.ProcessRetention, m.config.ProcessRetentionMaxEntries),
+		withProcessTableSync(m.config.ProcessTableSyncPeriod),
+		withTupleHash(m.config.FlowTupleHash, m.config.HashOnlyMode, m.config.FlowTupleHashKey),
+		withPortScanDetection(m.config.DetectPortScans, m.config.PortScanWindow, m.config.PortScanMinPorts,
+			m.config.PortScanMaxSources, m.config.PortScanMaxHeldFlows),
+		withMTUResolver(mtus),
+		withMinFlowBytes(uint64(m.config.MinFlowBytes)),
+		withCloseInitiator(m.config.ReportCloseInitiator),
+		withTunnels(m.config.EnableTunnels),
+		withNetlink(m.config.EnableNetlink),
+		withFlowExporter(m.flowExporter),
+		withFlowEnrichers(registeredFlowEnrichers()),
+		withClockSyncObserver(clockSyncObserver))
+	// The state is stopped by Cleanup.
+	m.setState(st)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -173,6 +356,16 @@ func (m *MetricSet) Run(r mb.PushReporterV2) {
 		m.log.Error(err)
 		return
 	}
+	if err := m.quicSniffer.Monitor(ctx, func(h quic.Hello) {
+		if err := st.OnQUICHello(h); err != nil {
+			m.log.Errorf("Unable to store QUIC ClientHello %+v: %v", h, err)
+		}
+	}); err != nil {
+		err = fmt.Errorf("unable to start QUIC sniffer: %w", err)
+		r.Error(err)
+		m.log.Error(err)
+		return
+	}
 
 	if err := m.perfChannel.Run(); err != nil {
 		err = fmt.Errorf("unable to start perf channel: %w", err)
@@ -180,12 +373,20 @@ func (m *MetricSet) Run(r mb.PushReporterV2) {
 		m.log.Error(err)
 		return
 	}
-	// Launch the clock-synchronization ticker.
-	go m.clockSyncLoop(m.config.ClockSyncPeriod, r.Done())
+	lostEvents.track(m.perfChannel, false)
+	if m.config.EnableClockSync {
+		// Launch the clock-synchronization ticker.
+		go m.clockSyncLoop(m.config.ClockSyncPeriod, clockSync, r.Done())
+	}
+	if m.config.CaptureIdleTimeout > 0 {
+		health := newCaptureHealth(m.log, m.config.CaptureIdleTimeout, m.config.CaptureIdleMinPackets)
+		go m.captureHealthLoop(health, r.Done())
+	}
 
 	if procs, err := sysinfo.Processes(); err != nil {
 		m.log.Error("Failed to bootstrap process table using /proc", err)
 	} else {
+		credFields := newCredFields(m.config.ProcessCredFields)
 		for _, p := range procs {
 			if i, err := p.Info(); err == nil {
 				if len(i.Name) == 16 && len(i.Args) != 0 {
@@ -200,22 +401,14 @@ func (m *MetricSet) Run(r mb.PushReporterV2) {
 				process := &process{
 					name:        i.Name,
 					pid:         uint32(i.PID),
+					ppid:        uint32(i.PPID),
 					args:        i.Args,
 					createdTime: i.StartTime,
-					path:        i.Exe,
+					startTime:   i.StartTime,
 				}
+				process.path, process.exeDeleted = splitDeletedPath(i.Exe)
 
-				if user, err := p.User(); err == nil {
-					toUint32 := func(id string) uint32 {
-						num, _ := strconv.Atoi(id)
-						return uint32(num)
-					}
-					process.uid = toUint32(user.UID)
-					process.euid = toUint32(user.EUID)
-					process.gid = toUint32(user.GID)
-					process.egid = toUint32(user.EGID)
-					process.hasCreds = true
-				}
+				readProcessCreds(p, credFields, process)
 
 				st.CreateProcess(process)
 
@@ -227,6 +420,7 @@ func (m *MetricSet) Run(r mb.PushReporterV2) {
 		m.log.Info("Bootstrapped process table using /proc")
 	}
 
+	reopener := newPerfReopener(m.log, m.config.PerfReopenRetries, m.config.PerfReopenBackoff)
 	m.log.Infof("%s dataset is running.", fullName)
 	// Dispatch loop.
 	for running := true; running; {
@@ -244,20 +438,25 @@ func (m *MetricSet) Run(r mb.PushReporterV2) {
 				m.log.Errorf("Received an event of wrong type: %T", iface)
 				continue
 			}
-			if m.isDetailed {
+			isDetailed := m.isDetailed && m.detailed.sampled(v)
+			if isDetailed {
 				m.detailLog.Debug(v.String())
 			}
-			if err := v.Update(st); err != nil && m.isDetailed {
+			if err := v.Update(st); err != nil && isDetailed {
 				// These errors are seldom interesting, as the flow state engine
 				// doesn't have many error conditions and all benign enough to
 				// not be worth logging them by default.
 				m.detailLog.Warnf("Issue while processing event '%s': %v", v.String(), err)
 			}
 			atomic.AddUint64(&eventCount, 1)
+			if _, isClockSync := v.(*clockSyncCall); !isClockSync {
+				atomic.AddUint64(&captureEventCount, 1)
+			}
+			reopener.received()
 
 		case err := <-m.perfChannel.ErrC():
 			m.log.Errorf("Error received from perf channel: %v", err)
-			running = false
+			running = reopener.reopen(r.Done(), m.reopenPerfChannel)
 
 		case numLost := <-m.perfChannel.LostC():
 			if numLost != ^uint64(0) {
@@ -271,39 +470,23 @@ func (m *MetricSet) Run(r mb.PushReporterV2) {
 
 // entityID creates an ID that uniquely identifies this process across machines.
 func entityID(hostID string, p *process) string {
-	h := system.NewEntityHash()
-	h.Write([]byte(hostID))
-	binary.Write(h, binary.LittleEndian, int64(p.pid))
-	binary.Write(h, binary.LittleEndian, int64(p.createdTime.Nanosecond()))
-	return h.Sum()
+	return system.ProcessEntityID(hostID, int(p.pid), p.createdTime)
 }
 
 // Setup performs all the initialisations required for KProbes monitoring.
 func (m *MetricSet) Setup() (err error) {
-	m.log.Infof("Setting up %s for kernel %s", fullName, kernelVersion)
+	// The byte order of the kernel's events matters when analyzing them on
+	// another machine.
+	endianness := tracing.EndianName(tracing.MachineEndian)
+	machineEndianness.Set(endianness)
+	m.log.Infof("Setting up %s for kernel %s (%s-endian)", fullName, kernelVersion, endianness)
 
 	//
 	// Validate that tracefs / debugfs is present and kprobes are available
 	//
 	var traceFS *tracing.TraceFS
 	if m.config.TraceFSPath == nil {
-		if err := tracing.IsTraceFSAvailable(); err != nil {
-			m.log.Debugf("tracefs/debugfs not found. Attempting to mount")
-			for _, mount := range defaultMounts {
-				if err = mount.mount(); err != nil {
-					m.log.Debugf("Mount %s returned %v", mount, err)
-					continue
-				}
-				if tracing.IsTraceFSAvailable() != nil {
-					m.log.Warnf("Mounted %s but no kprobes available", mount, err)
-					mount.unmount()
-					continue
-				}
-				m.log.Debugf("Mounted %s", mount)
-				m.mountedFS = mount
-				break
-			}
-		}
+		m.traceFS = setupTraceFS(traceFSLockPath(), defaultMounts, tracing.IsTraceFSAvailable, m.log)
 		traceFS, err = tracing.NewTraceFS()
 	} else {
 		traceFS, err = tracing.NewTraceFSWithPath(*m.config.TraceFSPath)
@@ -311,6 +494,16 @@ func (m *MetricSet) Setup() (err error) {
 	if err != nil {
 		return fmt.Errorf("tracefs/debugfs is not mounted or not writeable: %w", err)
 	}
+	if name := m.config.TraceFSInstanceName; name != "" {
+		instance, err := traceFS.CreateInstance(name)
+		if err != nil {
+			m.log.Warnf("Unable to create tracing instance %s, using the global instance: %v", name, err)
+		} else {
+			m.log.Debugf("Using tracing instance %s", instance.InstancePath())
+			m.traceFSInstance = instance
+			traceFS = instance
+		}
+	}
 
 	//
 	// Setup initial template variables
@@ -322,20 +515,15 @@ func (m *MetricSet) Setup() (err error) {
 	// Detect IPv6 support
 	//
 
-	hasIPv6, err := detectIPv6()
+	hasIPv6, err := m.hasIPv6()
 	if err != nil {
-		m.log.Debugf("Error detecting IPv6 support: %v", err)
-		hasIPv6 = false
-	}
-	m.log.Debugf("IPv6 supported: %v", hasIPv6)
-	if m.config.EnableIPv6 != nil {
-		if *m.config.EnableIPv6 && !hasIPv6 {
-			return errors.New("requested IPv6 support but IPv6 is disabled in the system")
-		}
-		hasIPv6 = *m.config.EnableIPv6
+		return err
 	}
 	m.log.Debugf("IPv6 enabled: %v", hasIPv6)
-	m.templateVars["HAS_IPV6"] = hasIPv6
+	if m.config.IPv6Only {
+		m.log.Info("IPv6-only mode enabled. The flows of IPv4 sockets won't be monitored.")
+	}
+	m.templateVars.Update(configTemplateVars(&m.config, hasIPv6))
 
 	//
 	// Create probe installer
@@ -344,10 +532,30 @@ func (m *MetricSet) Setup() (err error) {
 	if m.config.DevelopmentMode {
 		extra = WithFilterPort(22)
 	}
+	portFilter := WithNoOp()
+	if excluded := m.ports.kernelExcludedPorts(); len(excluded) > 0 {
+		portFilter = WithExcludePorts(excluded)
+	}
+	addrFilter := WithNoOp()
+	if excluded := m.remoteCIDRs.kernelExcludedAddrs(); len(excluded) > 0 {
+		addrFilter = WithExcludeRemoteAddrs(excluded)
+	}
+	inodeFetch := WithNoOp()
+	if m.config.IncludeSocketInode {
+		inodeFetch = WithSocketInode(m.templateVars)
+	}
+	connectErrFetch := WithNoOp()
+	if m.config.ReportConnectFailures {
+		connectErrFetch = WithConnectError(m.templateVars)
+	}
 	m.installer = newProbeInstaller(traceFS,
 		WithGroup(groupName),
+		inodeFetch,
+		connectErrFetch,
 		WithTemplates(m.templateVars),
-		extra)
+		extra,
+		portFilter,
+		addrFilter)
 	defer func() {
 		if err != nil {
 			m.installer.UninstallInstalled()
@@ -369,10 +577,149 @@ func (m *MetricSet) Setup() (err error) {
 		return fmt.Errorf("unable to delete existing KProbes for group %s: %w", groupName, err)
 	}
 
+	functions, err := m.resolveTemplateVars(traceFS, hasIPv6)
+	if err != nil {
+		return err
+	}
+
+	publishTemplateVars(m.templateVars)
+
+	if m.isDebug {
+		names := make([]string, 0, len(m.templateVars))
+		for name := range m.templateVars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		m.log.Debugf("%d template variables in use:", len(m.templateVars))
+		for _, key := range names {
+			m.log.Debugf("  %s = %v", key, m.templateVars[key])
+		}
+	}
+
+	//
+	// Create perf channel
+	//
+	m.perfChannel, err = m.newPerfChannel()
+	if err != nil {
+		return fmt.Errorf("unable to create perf channel: %w", err)
+	}
+	m.monitored = nil
+
+	//
+	// Register Kprobes
+	//
+	// Optional probes are installed in priority order when their number is
+	// limited: the features enabled in the configuration first, then the
+	// probes that only enrich flows.
+	var features, enrichment []kprobeGroup
+	for _, probeDef := range getOptionalKProbes(m.templateVars) {
+		name := probeDef.ApplyTemplate(m.templateVars).Probe.Address
+		if !m.isKernelFunctionAvailable(name, functions) {
+			m.log.Debugf("Optional probe %s disabled: function '%s' is not available", probeDef.Probe.Name, name)
+			continue
+		}
+		enrichment = append(enrichment, kprobeGroup{name: probeDef.Probe.Name, probes: []helper.ProbeDef{probeDef}})
+	}
+	if !hasAllVars(m.templateVars, []string{"TCP_SOCK_SRTT", "INET_CSK_RTO"}) {
+		m.log.Infof("TCP round-trip time and retransmit timeout won't be reported, " +
+			"as their offsets in struct tcp_sock couldn't be guessed on this kernel.")
+	}
+	if !hasAllVars(m.templateVars, []string{"TCP_SOCK_TSTAMP_OK"}) {
+		m.log.Infof("TCP timestamps status won't be reported, " +
+			"as its offset in struct tcp_sock couldn't be guessed on this kernel.")
+	}
+	for _, feature := range getFeatureKProbes(&m.config, hasIPv6) {
+		if !hasAllVars(m.templateVars, feature.requires) {
+			if feature.requiresWarning != "" {
+				m.log.Warn(feature.requiresWarning)
+			}
+			m.log.Debugf("%s probes disabled: required variables are not available", feature.name)
+			continue
+		}
+		probes := m.availableKProbes(feature.name, feature.probes, functions)
+		if feature.warning != "" && (len(probes) == 0 || (feature.requireAll && len(probes) < len(feature.probes))) {
+			m.log.Warn(feature.warning)
+		}
+		if len(probes) == 0 {
+			continue
+		}
+		if feature.name == featureMPTCP && !m.isKernelFunctionAvailable("mptcp_event", functions) {
+			m.log.Infof("MPTCP subflows will only be correlated when they're closed, as mptcp_event " +
+				"is not available for tracing.")
+		}
+		features = append(features, kprobeGroup{name: feature.name, probes: probes})
+	}
+	required := getKProbes(hasIPv6, m.config.IPv6Only)
+	groups, skipped, err := limitKProbes(m.config.MaxKProbes, len(required), append(features, enrichment...))
+	if err != nil {
+		return err
+	}
+	for _, group := range skipped {
+		names := make([]string, len(group.probes))
+		for i, probeDef := range group.probes {
+			names[i] = probeDef.Probe.Name
+		}
+		m.log.Warnf("%s probes skipped to stay within socket.max_kprobes (%d): %s",
+			group.name, m.config.MaxKProbes, strings.Join(names, ", "))
+	}
+	var optional []helper.ProbeDef
+	for _, group := range groups {
+		switch group.name {
+		case featureSCTPAssociation:
+			m.hasSCTPDetails = true
+		case tcpCloseProbeName:
+			m.hasPathMTU = hasAllVars(m.templateVars, []string{"INET_CSK_PMTU"})
+		}
+		optional = append(optional, group.probes...)
+	}
+	if m.isDebug {
+		m.log.Debugf("%d optional probes enabled", len(optional))
+	}
+	installer := m.installer
+	if m.config.SharedProbeGroup != "" {
+		// Kernel filters, like the excluded ports, are set by the owner of
+		// the shared group.
+		m.log.Infof("Attaching to the kprobes of shared group %s", m.config.SharedProbeGroup)
+		installer = newSharedProbeInstaller(traceFS, m.config.SharedProbeGroup, WithTemplates(m.templateVars))
+	}
+	var attached []attachedProbe
+	retry := newRetrier(m.log, m.config.ProbeInstallRetries, m.config.ProbeInstallBackoff)
+	for _, probeDef := range append(required, optional...) {
+		var (
+			format  tracing.ProbeFormat
+			decoder tracing.Decoder
+		)
+		err = retry.do("register probe "+probeDef.Probe.Name, func() (err error) {
+			format, decoder, err = installer.Install(probeDef)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("unable to register probe %s: %w", probeDef.Probe.String(), err)
+		}
+		err = retry.do("monitor probe "+probeDef.Probe.Name, func() error {
+			return m.perfChannel.MonitorProbe(format, decoder)
+		})
+		if err != nil {
+			return fmt.Errorf("unable to monitor probe %s: %w", probeDef.Probe.String(), err)
+		}
+		m.monitored = append(m.monitored, monitoredProbe{format: format, decoder: decoder})
+		attached = append(attached, attachedProbe{
+			probe:       format.Probe,
+			alternative: functionAlternativeOf(probeDef.Probe.Address),
+		})
+	}
+	m.logAttachedProbes(attached)
+	return nil
+}
+
+// resolveTemplateVars selects the kernel functions used by the probes and
+// runs the guesses, or takes their results from socket.guess_artifact_path. It
+// returns the functions available for tracing.
+func (m *MetricSet) resolveTemplateVars(traceFS *tracing.TraceFS, hasIPv6 bool) (common.StringSet, error) {
 	//
 	// Load available kernel functions for tracing
 	//
-	functions, err := LoadTracingFunctions(traceFS)
+	functions, err := m.tracingFunctions(traceFS)
 	if err != nil {
 		m.log.Debugf("Can't load available_tracing_functions. Using alternative. err=%v", err)
 	}
@@ -380,86 +727,65 @@ func (m *MetricSet) Setup() (err error) {
 	//
 	// Resolve function names from alternatives
 	//
-	for varName, alternatives := range functionAlternatives {
+	selected, missing := m.selectFunctionAlternatives(functions)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("none of the required functions for %s is found. One of %v is required", missing[0], functionAlternatives[missing[0]])
+	}
+	for varName, name := range selected {
 		if exists, _ := m.templateVars.HasKey(varName); exists {
-			return fmt.Errorf("variable %s overwrites existing key", varName)
-		}
-		found := false
-		var selected string
-		for _, selected = range alternatives {
-			if found = m.isKernelFunctionAvailable(selected, functions); found {
-				break
-			}
-		}
-		if !found {
-			return fmt.Errorf("none of the required functions for %s is found. One of %v is required", varName, alternatives)
+			return nil, fmt.Errorf("variable %s overwrites existing key", varName)
 		}
 		if m.isDebug {
-			m.log.Debugf("Selected kernel function %s for %s", selected, varName)
+			m.log.Debugf("Selected kernel function %s for %s", name, varName)
 		}
-		m.templateVars[varName] = selected
+		m.templateVars[varName] = name
 	}
 
 	//
 	// Make sure all the required kernel functions are available
 	//
-	for _, probeDef := range getKProbes(hasIPv6) {
+	for _, probeDef := range getKProbes(hasIPv6, m.config.IPv6Only) {
 		probeDef = probeDef.ApplyTemplate(m.templateVars)
 		name := probeDef.Probe.Address
 		if !m.isKernelFunctionAvailable(name, functions) {
-			return fmt.Errorf("required function '%s' is not available for tracing in the current kernel (%s)", name, kernelVersion)
+			return nil, fmt.Errorf("required function '%s' is not available for tracing in the current kernel (%s)", name, kernelVersion)
 		}
 	}
 
 	//
 	// Guess all the required parameters
 	//
-	if err = guess.GuessAll(m.installer,
+	if m.config.GuessArtifactPath != "" {
+		vars, err := m.loadGuessArtifact(selected)
+		if err == nil {
+			m.templateVars.Update(vars)
+			m.log.Infof("Using %d guessed variables from %s, guesses skipped", len(vars), m.config.GuessArtifactPath)
+			return functions, nil
+		}
+		m.log.Warnf("Not using the guess artifact %s, running the guesses: %v", m.config.GuessArtifactPath, err)
+	}
+	return functions, m.guessTemplateVars()
+}
+
+// guessTemplateVars runs all the guesses.
+func (m *MetricSet) guessTemplateVars() error {
+	var guessStats guess.Stats
+	err := guess.GuessAll(m.installer,
 		guess.Context{
 			Log:     m.log,
 			Vars:    m.templateVars,
 			Timeout: m.config.GuessTimeout,
-		}); err != nil {
-		return fmt.Errorf("unable to guess one or more required parameters: %w", err)
-	}
-
-	if m.isDebug {
-		names := make([]string, 0, len(m.templateVars))
-		for name := range m.templateVars {
-			names = append(names, name)
-		}
-		sort.Strings(names)
-		m.log.Debugf("%d template variables in use:", len(m.templateVars))
-		for _, key := range names {
-			m.log.Debugf("  %s = %v", key, m.templateVars[key])
-		}
-	}
-
-	//
-	// Create perf channel
-	//
-	m.perfChannel, err = tracing.NewPerfChannel(
-		tracing.WithBufferSize(m.config.PerfQueueSize),
-		tracing.WithErrBufferSize(m.config.ErrQueueSize),
-		tracing.WithLostBufferSize(m.config.LostQueueSize),
-		tracing.WithRingSizeExponent(m.config.RingSizeExp),
-		tracing.WithTID(perf.AllThreads),
-		tracing.WithTimestamp())
+			Stats:   &guessStats,
+		})
+	m.logGuessStats(guessStats)
 	if err != nil {
-		return fmt.Errorf("unable to create perf channel: %w", err)
-	}
-
-	//
-	// Register Kprobes
-	//
-	for _, probeDef := range getKProbes(hasIPv6) {
-		format, decoder, err := m.installer.Install(probeDef)
-		if err != nil {
-			return fmt.Errorf("unable to register probe %s: %w", probeDef.Probe.String(), err)
-		}
-		if err = m.perfChannel.MonitorProbe(format, decoder); err != nil {
-			return fmt.Errorf("unable to monitor probe %s: %w", probeDef.Probe.String(), err)
+		var guessErr *guess.Error
+		if errors.As(err, &guessErr) {
+			m.log.Errorw("Guess failed", "kernel", kernelVersion, "guess", guessErr.Guess,
+				"variables", guessErr.Variables, "attempts", guessErr.Attempts,
+				"results", guessErr.Results, "error", guessErr.Err.Error())
 		}
+		return fmt.Errorf("unable to guess one or more required parameters: %w", err)
 	}
 	return nil
 }
@@ -467,6 +793,10 @@ func (m *MetricSet) Setup() (err error) {
 // Cleanup must be called so that kprobes are not left around after exit.
 func (m *MetricSet) Cleanup() {
 	if m.perfChannel != nil {
+		lostEvents.stop()
+		for _, lost := range lostEvents.counts() {
+			m.log.Infof("Lost %d events and %d whole ring buffers on CPU %d", lost.Samples, lost.Overflows, lost.CPU)
+		}
 		if err := m.perfChannel.Close(); err != nil {
 			m.log.Warnf("Failed to close perf channel on exit: %v", err)
 		}
@@ -476,27 +806,119 @@ func (m *MetricSet) Cleanup() {
 			m.log.Warnf("Failed to remove KProbes on exit: %v", err)
 		}
 	}
-	if m.mountedFS != nil {
-		if err := m.mountedFS.unmount(); err != nil {
-			m.log.Errorf("Failed to umount %s: %v", m.mountedFS, err)
-		} else {
-			m.log.Debugf("Unmounted %s", m.mountedFS)
+	if m.traceFSInstance != nil {
+		if err := m.traceFSInstance.RemoveInstance(); err != nil {
+			m.log.Warnf("Failed to remove tracing instance %s on exit: %v", m.traceFSInstance.InstancePath(), err)
+		}
+		m.traceFSInstance = nil
+	}
+	if m.traceFS != nil {
+		m.traceFS.release(m.log)
+	}
+	// The state's loops can still be reporting flows, so they must return
+	// before the flow exporter is closed.
+	m.stateMutex.Lock()
+	st := m.state
+	m.state = nil
+	m.stateMutex.Unlock()
+	if st != nil {
+		st.Stop()
+	}
+	if m.flowExporter != nil {
+		if dropped := m.flowExporter.Dropped(); dropped > 0 {
+			m.log.Infof("%d flows couldn't be written to %s", dropped, m.config.FlowExportSocket)
 		}
+		if err := m.flowExporter.Close(); err != nil {
+			m.log.Warnf("Failed to close flow export socket on exit: %v", err)
+		}
+		m.flowExporter = nil
 	}
 }
 
-func (m *MetricSet) clockSyncLoop(interval time.Duration, done <-chan struct{}) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	triggerClockSync()
-	for {
-		select {
-		case <-done:
-			return
-		case <-ticker.C:
-			triggerClockSync()
+// logGuessStats logs the duration and outcome of every guess as structured
+// fields, to help identify slow or unreliable guesses on specific kernels.
+func (m *MetricSet) logGuessStats(stats guess.Stats) {
+	guesses := make([]mapstr.M, 0, len(stats.Results))
+	for _, r := range stats.Results {
+		entry := mapstr.M{
+			"name":        r.Name,
+			"duration_ms": r.Duration.Milliseconds(),
+			"attempts":    r.Attempts,
+			"succeeded":   r.Err == nil,
+			// Eventual guesses may need several runs to succeed.
+			"first_attempt": r.Err == nil && r.Attempts == 1,
+		}
+		if r.Err != nil {
+			entry["error"] = r.Err.Error()
+		}
+		guesses = append(guesses, entry)
+	}
+	m.log.Infow("Guess statistics", "kernel", kernelVersion, "guesses", guesses)
+}
+
+// kernelHZ returns the kernel's timer frequency if it has been guessed, or
+// zero otherwise.
+func (m *MetricSet) kernelHZ() int {
+	if hz, ok := m.templateVars["KERNEL_HZ"].(int); ok {
+		return hz
+	}
+	return 0
+}
+
+// hasIPv6 returns whether IPv6 is monitored, based on the system's support
+// and socket.enable_ipv6.
+func (m *MetricSet) hasIPv6() (bool, error) {
+	hasIPv6, err := detectIPv6()
+	if err != nil {
+		m.log.Debugf("Error detecting IPv6 support: %v", err)
+		hasIPv6 = false
+	}
+	m.log.Debugf("IPv6 supported: %v", hasIPv6)
+	if m.config.EnableIPv6 != nil {
+		if *m.config.EnableIPv6 && !hasIPv6 {
+			return false, errors.New("requested IPv6 support but IPv6 is disabled in the system")
+		}
+		hasIPv6 = *m.config.EnableIPv6
+	}
+	if m.config.IPv6Only && !hasIPv6 {
+		return false, errors.New("requested IPv6-only mode but IPv6 is disabled in the system")
+	}
+	return hasIPv6, nil
+}
+
+// availableKProbes returns the probes in the list whose kernel function is
+// available for tracing. kind is used to log the probes that are disabled.
+func (m *MetricSet) availableKProbes(kind string, probes []helper.ProbeDef, functions common.StringSet) (list []helper.ProbeDef) {
+	for _, probeDef := range probes {
+		name := probeDef.ApplyTemplate(m.templateVars).Probe.Address
+		if !m.isKernelFunctionAvailable(name, functions) {
+			m.log.Debugf("%s probe %s disabled: function '%s' is not available", kind, probeDef.Probe.Name, name)
+			continue
+		}
+		list = append(list, probeDef)
+	}
+	return list
+}
+
+// selectFunctionAlternatives returns the first available kernel function for
+// each of the functionAlternatives, and a sorted list of the variables for
+// which none of the alternatives is available.
+func (m *MetricSet) selectFunctionAlternatives(functions common.StringSet) (selected map[string]string, missing []string) {
+	selected = make(map[string]string, len(functionAlternatives))
+	for varName, alternatives := range functionAlternatives {
+		found := false
+		for _, name := range alternatives {
+			if found = m.isKernelFunctionAvailable(name, functions); found {
+				selected[varName] = name
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, varName)
 		}
 	}
+	sort.Strings(missing)
+	return selected, missing
 }
 
 func (m *MetricSet) isKernelFunctionAvailable(name string, tracingFns common.StringSet) bool {
@@ -0,0 +1,59 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+// socketOrigin is how the process of a flow got its socket.
+type socketOrigin uint8
+
+const (
+	// originUnknown is for sockets that existed before they were first seen.
+	originUnknown socketOrigin = iota
+	// originSocket is for sockets created by socket().
+	originSocket
+	// originAccept is for sockets returned by accept().
+	originAccept
+	// originInherited is for sockets used by a process other than the one
+	// that created or accepted them, as a child inherits them through fork.
+	originInherited
+)
+
+func (o socketOrigin) String() string {
+	switch o {
+	case originSocket:
+		return "socket"
+	case originAccept:
+		return "accept"
+	case originInherited:
+		return "inherited"
+	default:
+		return "unknown"
+	}
+}
+
+// setOrigin records that the socket was created by socket() or accept() in
+// the given process.
+func (sock *socket) setOrigin(origin socketOrigin, pid uint32) {
+	sock.origin, sock.originPID = origin, pid
+}
+
+// originFor returns how the given process got the socket.
+func (sock *socket) originFor(pid uint32) socketOrigin {
+	if pid == 0 {
+		return originUnknown
+	}
+	if sock.origin != originUnknown {
+		if pid == sock.originPID {
+			return sock.origin
+		}
+		return originInherited
+	}
+	// Created before it was first seen, but it was seen being inherited.
+	if _, found := sock.inheritedBy[pid]; found {
+		return originInherited
+	}
+	return originUnknown
+}
@@ -0,0 +1,110 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketOrigin(t *testing.T) {
+	sendMsg := func(pid uint32, ts uint64) *tcpSendMsgCall4 {
+		return &tcpSendMsgCall4{
+			Meta:  meta(pid, pid, ts),
+			Sock:  testSock,
+			Size:  10,
+			LAddr: ipv4(testLocalIP),
+			LPort: be16(testLocalPort),
+			RAddr: ipv4(testRemoteIP),
+			RPort: be16(testRemotePort),
+			Af:    unix.AF_INET,
+		}
+	}
+	for _, tc := range []struct {
+		name   string
+		evs    []event
+		pid    int
+		origin string
+	}{
+		{
+			name:   "socket",
+			evs:    tcpConnectEvents(1234, 5, 8),
+			pid:    1234,
+			origin: "socket",
+		},
+		{
+			name: "accept",
+			evs: []event{
+				&tcpAcceptResult4{
+					Meta:  meta(1234, 1234, 5),
+					Sock:  testSock,
+					LAddr: ipv4(testLocalIP),
+					LPort: be16(testLocalPort),
+					RAddr: ipv4(testRemoteIP),
+					RPort: be16(testRemotePort),
+					Af:    unix.AF_INET,
+				},
+			},
+			pid:    1234,
+			origin: "accept",
+		},
+		{
+			name: "inherited",
+			evs: append(tcpConnectEvents(1234, 5, 8),
+				&forkRet{Meta: meta(1234, 1234, 10), Retval: 1240},
+				callExecve(meta(1240, 1240, 11), []string{"/bin/sh"}),
+				&execveRet{Meta: meta(1240, 1240, 12), Retval: 0},
+				sendMsg(1240, 13),
+			),
+			pid:    1240,
+			origin: "inherited",
+		},
+		{
+			name:   "created before being seen",
+			evs:    []event{sendMsg(1234, 5)},
+			pid:    1234,
+			origin: "unknown",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withProcessAttribution(attributionActive)(&st.state)
+			st.feedEvents([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/sbin/server"}),
+				&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+			})
+			st.feedEvents(tc.evs)
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1234, 20), Sock: testSock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			assertValue(t, flows[0], tc.pid, "process.pid")
+			assertValue(t, flows[0], tc.origin, "network.socket.origin")
+		})
+	}
+}
+
+func TestSocketOriginFor(t *testing.T) {
+	sock := &socket{}
+	assert.Equal(t, originUnknown, sock.originFor(1234))
+
+	// Seen being inherited before its origin was known.
+	sock.inheritedBy = map[uint32]struct{}{1240: {}}
+	assert.Equal(t, originInherited, sock.originFor(1240))
+
+	sock.setOrigin(originAccept, 1234)
+	assert.Equal(t, originAccept, sock.originFor(1234))
+	assert.Equal(t, originInherited, sock.originFor(1240))
+	assert.Equal(t, originUnknown, sock.originFor(0))
+}
@@ -0,0 +1,103 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Classes of special destination addresses reported by default.
+const (
+	specialMetadata  = "metadata"
+	specialLinkLocal = "link_local"
+	specialMulticast = "multicast"
+)
+
+// builtinSpecialRanges are checked after the user-defined ranges, in order.
+var builtinSpecialRanges = []struct {
+	class string
+	cidrs []string
+}{
+	// Instance metadata services of cloud providers. fd00:ec2::254 is the
+	// IPv6 endpoint of AWS.
+	{specialMetadata, []string{"169.254.169.254/32", "fd00:ec2::254/128"}},
+	{specialLinkLocal, []string{"169.254.0.0/16", "fe80::/10"}},
+	{specialMulticast, []string{"224.0.0.0/4", "ff00::/8"}},
+}
+
+type specialRange struct {
+	class string
+	net   *net.IPNet
+}
+
+// specialAddrClassifier classifies the destination addresses of flows that
+// deserve attention, such as the metadata service of cloud providers, which
+// is a common target of SSRF attacks.
+type specialAddrClassifier struct {
+	ranges []specialRange
+}
+
+// newSpecialAddrClassifier returns a classifier for the built-in ranges and
+// the given extra ranges, a map of class names to lists of CIDRs. Extra ranges
+// take precedence over the built-in ones, and the most specific range matches
+// when they overlap.
+func newSpecialAddrClassifier(extra map[string][]string) (*specialAddrClassifier, error) {
+	var c specialAddrClassifier
+	for class, cidrs := range extra {
+		if class == "" {
+			return nil, errors.New("empty class name in socket.special_destinations")
+		}
+		ranges, err := parseSpecialRanges(class, cidrs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket.special_destinations: %w", err)
+		}
+		c.ranges = append(c.ranges, ranges...)
+	}
+	sort.SliceStable(c.ranges, func(i, j int) bool {
+		a, _ := c.ranges[i].net.Mask.Size()
+		b, _ := c.ranges[j].net.Mask.Size()
+		if a != b {
+			return a > b
+		}
+		return c.ranges[i].class < c.ranges[j].class
+	})
+	for _, builtin := range builtinSpecialRanges {
+		ranges, err := parseSpecialRanges(builtin.class, builtin.cidrs)
+		if err != nil {
+			panic(err)
+		}
+		c.ranges = append(c.ranges, ranges...)
+	}
+	return &c, nil
+}
+
+func parseSpecialRanges(class string, cidrs []string) ([]specialRange, error) {
+	ranges := make([]specialRange, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("class '%s': %w", class, err)
+		}
+		ranges = append(ranges, specialRange{class: class, net: ipNet})
+	}
+	return ranges, nil
+}
+
+// Classify returns the class of the given address, or an empty string when
+// it's not special.
+func (c *specialAddrClassifier) Classify(ip net.IP) string {
+	if c == nil || ip == nil {
+		return ""
+	}
+	for _, r := range c.ranges {
+		if r.net.Contains(ip) {
+			return r.class
+		}
+	}
+	return ""
+}
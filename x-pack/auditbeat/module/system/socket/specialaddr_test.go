@@ -0,0 +1,58 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package socket
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpecialAddrClassifier(t *testing.T) {
+	c, err := newSpecialAddrClassifier(map[string][]string{
+		"internal_api": {"10.1.0.0/16"},
+		"vault":        {"10.1.2.3/32"},
+		"dns":          {"fd00::53/128"},
+		// Overrides the built-in class of the AWS time service.
+		"time": {"169.254.169.123/32"},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for ip, expected := range map[string]string{
+		"169.254.169.254":    specialMetadata,
+		"fd00:ec2::254":      specialMetadata,
+		"169.254.1.1":        specialLinkLocal,
+		"fe80::1":            specialLinkLocal,
+		"224.0.0.251":        specialMulticast,
+		"239.255.255.250":    specialMulticast,
+		"ff02::fb":           specialMulticast,
+		"169.254.169.123":    "time",
+		"10.1.0.1":           "internal_api",
+		"10.1.2.3":           "vault",
+		"fd00::53":           "dns",
+		"10.2.0.1":           "",
+		"8.8.8.8":            "",
+		"2001:4860::8888":    "",
+		"::ffff:169.254.1.1": specialLinkLocal,
+	} {
+		assert.Equal(t, expected, c.Classify(net.ParseIP(ip)), ip)
+	}
+	assert.Empty(t, c.Classify(nil))
+
+	var disabled *specialAddrClassifier
+	assert.Empty(t, disabled.Classify(net.ParseIP("169.254.169.254")))
+}
+
+func TestSpecialAddrClassifierErrors(t *testing.T) {
+	for name, extra := range map[string]map[string][]string{
+		"invalid CIDR": {"internal": {"10.1.0.0"}},
+		"empty class":  {"": {"10.1.0.0/16"}},
+	} {
+		_, err := newSpecialAddrClassifier(extra)
+		assert.Error(t, err, name)
+	}
+}
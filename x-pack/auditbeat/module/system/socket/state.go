@@ -13,6 +13,7 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,8 +24,10 @@ import (
 	"github.com/elastic/beats/v7/libbeat/common"
 	"github.com/elastic/beats/v7/libbeat/common/flowhash"
 	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system"
 	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns"
 	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/quic"
 	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
 	"github.com/elastic/elastic-agent-libs/mapstr"
 	"github.com/elastic/go-libaudit/v2/aucoalesce"
@@ -36,6 +39,11 @@ const (
 
 	// how often the state log generated (only in debug mode).
 	logInterval = time.Second * 30
+
+	// zero-window probes are sent at least every TCP_RTO_MAX (120s) while
+	// the peer's window is zero. A longer gap between probes starts a new
+	// zero-window episode.
+	zeroWindowMaxGap = 2 * 120 * time.Second
 )
 
 var (
@@ -51,6 +59,7 @@ const (
 	protoUnknown flowProto = 0
 	protoTCP     flowProto = unix.IPPROTO_TCP
 	protoUDP     flowProto = unix.IPPROTO_UDP
+	protoSCTP    flowProto = unix.IPPROTO_SCTP
 )
 
 func (p flowProto) String() string {
@@ -59,6 +68,8 @@ func (p flowProto) String() string {
 		return "tcp"
 	case protoUDP:
 		return "udp"
+	case protoSCTP:
+		return "sctp"
 	}
 	return "unknown"
 }
@@ -156,10 +167,89 @@ func newEndpointIPv6(beIPa uint64, beIPb uint64, bePort uint16, pkts uint64, byt
 	return e
 }
 
+// tcpStats holds a snapshot of the kernel's TCP state for a flow.
+type tcpStats struct {
+	// smoothed RTT and retransmit timeout, in microseconds.
+	srttUS, rtoUS uint32
+	hasRTT        bool
+	// duplicate segments reported by the peer (tcp_sock.dsack_dups).
+	dsackDups    uint32
+	hasDSACKDups bool
+	// TCP Fast Open was requested (client) or accepted (server).
+	fastOpen bool
+	// TCP timestamps were negotiated at establishment (tstamp_ok).
+	timestamps, hasTimestamps bool
+	// last path MTU seen by the socket (icsk_pmtu_cookie).
+	pmtu uint32
+	// send and receive buffer sizes when the socket was closed (sk_sndbuf
+	// and sk_rcvbuf).
+	sndbuf, rcvbuf uint32
+	hasBuffers     bool
+	// congestion window when the socket was closed, in segments
+	// (snd_cwnd).
+	cwnd    uint32
+	hasCwnd bool
+	// zero-window probes sent, because the peer advertised a zero window.
+	zeroWindowCount uint32
+	// first and last probe of the current zero-window episode, and whether
+	// an event has been sent for it.
+	zeroWindowSince, zeroWindowLast time.Time
+	zeroWindowReported              bool
+	// urgent data (URG flag) was received.
+	urgentDataSeen bool
+	// time of the connect call of an outbound flow, and time and error of
+	// the failure of the connection attempt. The error is zero when unknown.
+	connectStart, connectEnd kernelTime
+	connectFailed            bool
+	connectErrno             int32
+	// side that sent the first FIN, or the first reset when it came before
+	// any FIN. Empty when unknown or ambiguous.
+	closedBy string
+	// both sides sent a FIN before receiving the other's.
+	simultaneousClose bool
+	// both sides connected, instead of one of them accepting.
+	simultaneousOpen bool
+}
+
+// setConnectFailure records the failure of the connection attempt, unless
+// it's already known.
+func (t *tcpStats) setConnectFailure(ts kernelTime, errno int32) {
+	if t.connectFailed {
+		return
+	}
+	t.connectFailed, t.connectEnd, t.connectErrno = true, ts, errno
+}
+
+// mergeConnect takes the connection attempt of another partial flow, as its
+// failure can be seen before the connect call returns.
+func (t *tcpStats) mergeConnect(other tcpStats) {
+	if t.connectStart == 0 {
+		t.connectStart = other.connectStart
+	}
+	if other.connectFailed {
+		t.setConnectFailure(other.connectEnd, other.connectErrno)
+	}
+}
+
+// Values of network.tcp.closed_by.
+const (
+	closedByLocal  = "local"
+	closedByRemote = "remote"
+)
+
+// setClosedBy records the side that initiated the close, unless it's
+// already known or ambiguous.
+func (t *tcpStats) setClosedBy(side string) {
+	if t.closedBy == "" && !t.simultaneousClose {
+		t.closedBy = side
+	}
+}
+
 type flow struct {
 	prev, next helper.LinkedElement
 
 	sock              uintptr
+	inode             uint64
 	inetType          inetType
 	proto             flowProto
 	dir               flowDirection
@@ -168,14 +258,150 @@ type flow struct {
 	process           *process
 	local, remote     endpoint
 	complete          bool
-	done              bool
+	// address family and type the socket was created with, when known.
+	socketFamily, socketType uint16
+	// created by connect, whose local address is never known when it fails
+	// before the socket is bound.
+	connectAttempt bool
+	// created by accept on a listening socket.
+	accepted bool
+	done     bool
+	// service name resolved from the destination port at report time.
+	service string
+	// name of the interface used to reach the remote address, resolved at
+	// report time.
+	iface string
+	// name of the destination address in the hosts file, resolved at report
+	// time.
+	hostsDomain string
+	// route of the destination address in the BGP RIB, resolved at report
+	// time. Nil when no RIB is loaded or the address isn't in it.
+	dstAS *asRoute
+	// class of the destination address, such as link_local, resolved at
+	// report time. Empty when it's not special.
+	specialDst string
+	// type of the destination address, broadcast or multicast, and the name
+	// of its multicast group, resolved at report time. Empty for unicast.
+	dstAddrType, dstGroup string
+	// zones of the source and destination addresses, resolved at report
+	// time. Empty when no zone is configured.
+	srcZone, dstZone string
+	// path MTU, set at report time only when it differs from the MTU of the
+	// interface used to reach the remote address.
+	pathMTU int
+	// identifier shared by all the events of the flow, computed when the
+	// flow is created.
+	id string
+	// thread that connected or accepted the flow. Zero when unknown, or when
+	// it's the main thread and that's not reported.
+	tid uint32
+	// identity of the connection of the flow, once indexed, and the socks
+	// other than sock coalesced into the flow, when flows are keyed by
+	// connection.
+	connKey    string
+	otherSocks []uintptr
+	// identity of a local connecting flow, once recorded to detect a
+	// simultaneous open.
+	connectingKey string
+	// set once the open event of the flow has been queued.
+	opened bool
+	// address of the listening socket that accepted an inbound flow. Can be
+	// a wildcard address.
+	listenAddr net.IP
+	// set at report time for an outbound TCP flow whose local port is also
+	// listened on.
+	alsoListening bool
+	// set at report time when the process is the one listening on the
+	// local port, as the flow's accept wasn't captured.
+	processInferred bool
+	// captured when the socket is closed.
+	tcp tcpStats
+	// identifier of the MPTCP connection this flow is a subflow of.
+	mptcpID string
+	// how the process of the flow got its socket.
+	origin socketOrigin
+	// TLS ClientHello of a QUIC connection, captured from its Initial
+	// packets.
+	quic *quic.Hello
+	// details of an SCTP association, captured when it's freed.
+	sctp *sctpAssocInfo
+	// the sock of the SCTP association has been released. It's reported
+	// once the association is freed.
+	released bool
+	// the executable of the process had been unlinked when the flow was
+	// reported.
+	exeDeleted bool
+	// number of file descriptors open by the process when the flow was
+	// reported, if known.
+	fdCount    int
+	hasFDCount bool
+	// a TCP reset was sent or received.
+	reset bool
 	// these are automatically calculated by state from kernelTimes above
 	createdTime, lastSeenTime time.Time
+	// first and last time data was sent and received.
+	inbound, outbound activity
+}
+
+// sctpAssocInfo holds the verification tags and the negotiated number of
+// streams of an SCTP association.
+type sctpAssocInfo struct {
+	localVTag, remoteVTag uint32
+	outStreams, inStreams uint16
+}
+
+// activity tracks the first and last time traffic was seen in one direction.
+type activity struct {
+	first, last time.Time
+}
+
+func (a *activity) update(ts time.Time) {
+	if ts.IsZero() {
+		return
+	}
+	if a.first.IsZero() || ts.Before(a.first) {
+		a.first = ts
+	}
+	if ts.After(a.last) {
+		a.last = ts
+	}
 }
 
-// If this flow should be reported or only captured partial data
+func (a *activity) merge(other activity) {
+	a.update(other.first)
+	a.update(other.last)
+}
+
+// recordActivity updates the per-direction activity of a partial flow from
+// the packets it carries.
+func (f *flow) recordActivity() {
+	if f.local.packets > 0 {
+		f.outbound.update(f.lastSeenTime)
+	}
+	if f.remote.packets > 0 {
+		f.inbound.update(f.lastSeenTime)
+	}
+}
+
+// If this flow should be reported or only captured partial data. Only
+// connection attempts are reported with an unknown local address, as a
+// connect that failed before the socket was bound never has one. Their tuple
+// is marked incomplete.
 func (f *flow) isValid() bool {
-	return f.inetType != inetTypeUnknown && f.proto != protoUnknown && f.local.addr.IP != nil && f.remote.addr.IP != nil
+	return f.inetType != inetTypeUnknown && f.proto != protoUnknown && f.remote.addr.IP != nil &&
+		(f.local.addr.IP != nil || f.connectAttempt)
+}
+
+// isEmpty returns whether no data was transferred in either direction.
+func (f *flow) isEmpty() bool {
+	return f.local.bytes == 0 && f.remote.bytes == 0
+}
+
+// hasCompleteTuple returns if both the local and remote address and port
+// are known.
+func (f *flow) hasCompleteTuple() bool {
+	return f.local.addr.IP != nil && f.local.addr.Port != 0 &&
+		f.remote.addr.IP != nil && f.remote.addr.Port != 0
 }
 
 // Prev returns the previous flow in a linked list of flows.
@@ -207,21 +433,70 @@ type process struct {
 	// RWMutex is used to arbitrate reads and writes to resolvedDomains.
 	sync.RWMutex
 
-	pid                  uint32
+	pid, ppid            uint32
 	name, path           string
 	args                 []string
+	argsTruncated        bool
 	created              kernelTime
 	uid, gid, euid, egid uint32
 	hasCreds             bool
+	// credentials among uid, gid, euid and egid that are known.
+	credFields credFields
 
 	// populated by state from created
 	createdTime time.Time
 
+	// time the process was started by fork, which execve doesn't change, or
+	// read from /proc. It's the time used for the entity ID of the processes
+	// found at startup. Zero when unknown.
+	startTime time.Time
+
 	// populated after createdTime is adjusted.
 	entityID string
 
 	// populated by DNS enrichment.
 	resolvedDomains map[string]string
+
+	// populated when filtering by cgroup. Empty if it couldn't be read.
+	cgroup         string
+	cgroupResolved bool
+
+	// effective capabilities, read when the process is created. Empty if
+	// they couldn't be read.
+	capabilities []string
+	// the executable has file capabilities, read along the effective
+	// capabilities. Only meaningful when hasFileCapsKnown is set.
+	hasFileCaps, hasFileCapsKnown bool
+
+	// PID in the innermost PID namespace, read when the process is created.
+	// Zero if it's in the host's namespace or couldn't be read.
+	namespacedPID uint32
+	// inode of the network namespace, read when the process is created if
+	// local flows are deduplicated. Zero if it couldn't be read.
+	netns uint64
+
+	// the executable has been unlinked, and when it was last checked. Only
+	// accessed with the process locked.
+	exeDeleted   bool
+	exeCheckedAt time.Time
+
+	// number of open file descriptors, whether it could be read, and when it
+	// was last read. Only accessed with the process locked.
+	fdCount     int
+	hasFDCount  bool
+	fdCountedAt time.Time
+
+	// allowed environment variables reported as labels, read when the
+	// process is created. Nil if none was found or they couldn't be read.
+	envLabels map[string]string
+
+	// working directory, read when the process is created, and whether it
+	// had been removed. Empty if it couldn't be read.
+	cwd        string
+	cwdDeleted bool
+
+	// the process exited and is only kept for the events that arrive late.
+	exited bool
 }
 
 func (p *process) addTransaction(tr dns.Transaction) {
@@ -251,6 +526,25 @@ type socket struct {
 	bound   bool
 	pid     uint32
 	process *process
+	// Other processes known to have access to this socket, because they
+	// inherited it (or the process above did) through fork.
+	inheritedBy map[uint32]struct{}
+	// TCP Fast Open is in use.
+	fastOpen bool
+	// TCP timestamps were negotiated, when known.
+	timestamps, hasTimestamps bool
+	// inode number of the socket file, when known.
+	inode uint64
+	// address family and type the socket was created with, when known.
+	socketFamily, socketType uint16
+	// identifier of the MPTCP connection this socket is a subflow of.
+	mptcpID string
+	// failure of a connection attempt seen before the flow was created.
+	connectFailure *tcpStats
+	// whether the socket was created by socket() or accept(), and by which
+	// process. Unknown for sockets that existed before they were first seen.
+	origin    socketOrigin
+	originPID uint32
 	// This signals that the socket is in the closeTimeout list.
 	closing    bool
 	prev, next helper.LinkedElement
@@ -258,6 +552,19 @@ type socket struct {
 	createdTime, lastSeenTime time.Time
 }
 
+// heldBy returns whether the given process is known to have access to the
+// socket, either because it's the owner or because it inherited it.
+func (s *socket) heldBy(pid uint32) bool {
+	if pid == 0 {
+		return false
+	}
+	if pid == s.pid {
+		return true
+	}
+	_, found := s.inheritedBy[pid]
+	return found
+}
+
 // Prev returns the previous socket in the linked list.
 func (s *socket) Prev() helper.LinkedElement {
 	return s.prev
@@ -283,12 +590,22 @@ func (s *socket) Timestamp() time.Time {
 	return s.lastSeenTime
 }
 
+// Time window during which A and AAAA transactions for the same question are
+// coalesced.
+const dnsCoalesceWindow = 2 * time.Second
+
+// Time a QUIC ClientHello is kept waiting for the flow of its connection.
+const quicHelloTimeout = time.Minute
+
 type dnsTracker struct {
 	// map[net.UDPAddr(string)][]dns.Transaction
 	transactionByClient *common.Cache
 
 	// map[net.UDPAddr(string)]*process
 	processByClient *common.Cache
+
+	// map[question(string)]dns.Transaction. Only set when coalescing.
+	recentByQuestion *common.Cache
 }
 
 func newDNSTracker(timeout time.Duration) dnsTracker {
@@ -300,6 +617,45 @@ func newDNSTracker(timeout time.Duration) dnsTracker {
 
 // AddTransaction registers a new DNS transaction.
 func (dt *dnsTracker) AddTransaction(tr dns.Transaction) {
+	if dt.recentByQuestion != nil {
+		tr = dt.coalesce(tr)
+	}
+	dt.addTransaction(tr)
+}
+
+// coalesce merges a transaction with a recent one for the same question sent
+// from a different client port, as resolvers send A and AAAA queries in
+// parallel and can use a different socket for each. The addresses in the
+// new transaction are registered for the client of the previous one, and the
+// returned transaction contains the addresses of both. As transactions are
+// registered when they arrive, a missing response only means that there's
+// nothing to merge.
+func (dt *dnsTracker) coalesce(tr dns.Transaction) dns.Transaction {
+	key := dnsQuestionKey(tr)
+	if prevIf := dt.recentByQuestion.Get(key); prevIf != nil {
+		if prev, ok := prevIf.(dns.Transaction); ok && prev.Client.String() != tr.Client.String() {
+			dt.addTransaction(dns.Transaction{
+				TXID:      prev.TXID,
+				Client:    prev.Client,
+				Server:    prev.Server,
+				Domain:    prev.Domain,
+				Addresses: tr.Addresses,
+			})
+			addrs := make([]net.IP, 0, len(prev.Addresses)+len(tr.Addresses))
+			tr.Addresses = append(append(addrs, prev.Addresses...), tr.Addresses...)
+		}
+	}
+	dt.recentByQuestion.Put(key, tr)
+	return tr
+}
+
+// dnsQuestionKey identifies the question of a transaction, regardless of the
+// client port used and the record type queried.
+func dnsQuestionKey(tr dns.Transaction) string {
+	return tr.Client.IP.String() + "|" + tr.Server.String() + "|" + strings.ToLower(tr.Domain)
+}
+
+func (dt *dnsTracker) addTransaction(tr dns.Transaction) {
 	clientAddr := tr.Client.String()
 	if procIf := dt.processByClient.Get(clientAddr); procIf != nil {
 		if proc, ok := procIf.(*process); ok {
@@ -315,6 +671,17 @@ func (dt *dnsTracker) AddTransaction(tr dns.Transaction) {
 	dt.transactionByClient.Put(clientAddr, list)
 }
 
+// processOf returns the process known to use the given client address for
+// DNS queries, or nil.
+func (dt *dnsTracker) processOf(addr net.UDPAddr) *process {
+	if procIf := dt.processByClient.Get(addr.String()); procIf != nil {
+		if proc, ok := procIf.(*process); ok {
+			return proc
+		}
+	}
+	return nil
+}
+
 // AddTransactionWithProcess registers a new DNS transaction for the given process.
 func (dt *dnsTracker) AddTransactionWithProcess(tr dns.Transaction, proc *process) {
 	proc.addTransaction(tr)
@@ -324,6 +691,9 @@ func (dt *dnsTracker) AddTransactionWithProcess(tr dns.Transaction, proc *proces
 func (dt *dnsTracker) CleanUp() {
 	dt.transactionByClient.CleanUp()
 	dt.processByClient.CleanUp()
+	if dt.recentByQuestion != nil {
+		dt.recentByQuestion.CleanUp()
+	}
 }
 
 // RegisterEndpoint registers a new local endpoint used for DNS queries
@@ -347,12 +717,34 @@ type state struct {
 	reporter mb.PushReporterV2
 	log      helper.Logger
 
+	// stop is closed by Stop to terminate the background loops, which are
+	// tracked by loops so that Stop can wait for them.
+	stop     chan struct{}
+	stopOnce sync.Once
+	loops    sync.WaitGroup
+
 	processes map[uint32]*process
 	socks     map[uintptr]*socket
 	threads   map[uint32]event
 
+	// retention keeps exited processes in processes for a while. Nil when
+	// they are removed as soon as they exit.
+	retention *processRetention
+
+	// procSync removes the processes whose exit was missed. Nil when
+	// disabled.
+	procSync *processSync
+
+	// socksByPID indexes the sockets in socks by the processes known to have
+	// access to them, either as owner or through inheritance.
+	socksByPID map[uint32]map[uintptr]*socket
+
 	numFlows uint64
 
+	// flowDurations counts the flows terminated since the state was last
+	// logged, by duration.
+	flowDurations durationHistogram
+
 	// configuration
 	inactiveTimeout, closeTimeout, socketTimeout time.Duration
 	clockMaxDrift                                time.Duration
@@ -369,11 +761,443 @@ type state struct {
 
 	dns dnsTracker
 
+	// dnsEvents holds the DNS transactions to report as their own events. Nil
+	// when they aren't reported.
+	dnsEvents *dnsEventQueue
+
+	// quic holds the ClientHellos of QUIC connections until they are matched
+	// to a flow, by client and server address. Nil when QUIC monitoring is
+	// disabled.
+	quic *common.Cache
+
 	// Decouple time.Now()
 	clock func() time.Time
 
+	// onClockSync is called with the drift measured by clock
+	// synchronizations. Nil when not observed.
+	onClockSync func(drift time.Duration, adjusted bool)
+
 	// currentPID is the PID of the beat.
 	currentPID int
+
+	// credFields are the process credential fields captured.
+	credFields credFields
+
+	// listeners are the local TCP sockets known to listen.
+	listeners *listenerSet
+	// inferListener enables attributing inbound flows without a process to
+	// the process listening on their local port.
+	inferListener bool
+
+	// topProcesses is the number of processes with the most open flows
+	// reported by logState. Zero disables it.
+	topProcesses int
+
+	// services resolves destination ports to service names.
+	services *serviceTable
+
+	// kernelHZ is the kernel's timer frequency, used to convert jiffies.
+	kernelHZ int
+
+	// reportFirstSeen causes flows to be reported with the first process seen
+	// instead of following the one that performed the most recent I/O.
+	reportFirstSeen bool
+
+	// cgroups restricts the flows reported to processes in a cgroup subtree.
+	cgroups *cgroupFilter
+
+	// interfaces resolves the outgoing interface of flows.
+	interfaces *interfaceResolver
+
+	// hosts resolves destination addresses from the hosts file. Nil when
+	// disabled.
+	hosts *hostsResolver
+
+	// bgp resolves destination addresses to their AS path. Nil when no RIB
+	// dump is configured.
+	bgp *bgpRIB
+
+	// mtus resolves the MTU of the interface used by flows, to tell when a
+	// path MTU was discovered.
+	mtus *interfaceResolver
+
+	// ports restricts the flows reported by their local or remote port.
+	ports *portFilter
+
+	// remoteCIDRs restricts the flows reported by their remote address.
+	remoteCIDRs *cidrFilter
+
+	// special classifies the destination addresses that deserve attention.
+	special *specialAddrClassifier
+
+	// addressTypes classifies broadcast and multicast destination addresses.
+	addressTypes *addressTypeClassifier
+
+	// zones assigns the addresses of flows to network zones. Nil when no
+	// zone is configured.
+	zones *zoneClassifier
+
+	// readProcStatus returns the status of a process, to report its effective
+	// capabilities and namespaced PID. Nil when neither is reported.
+	readProcStatus func(pid uint32) (procStatus, error)
+
+	// readFileCaps returns whether the executable of a process has file
+	// capabilities. Nil when capabilities aren't reported.
+	readFileCaps func(pid uint32) (bool, error)
+
+	// includeCapabilities and includeNamespacedPID enable reporting the
+	// effective capabilities and namespaced PID of processes.
+	includeCapabilities, includeNamespacedPID bool
+
+	// readEnvLabels returns the environment variables of a process reported
+	// as labels. Nil when none is reported.
+	readEnvLabels func(pid uint32) (map[string]string, error)
+
+	// readCWD returns the working directory of a process. Nil when it's not
+	// reported.
+	readCWD func(pid uint32) (string, bool, error)
+
+	// isExeDeleted returns whether the executable of a process has been
+	// unlinked. Nil when it's not checked.
+	isExeDeleted func(pid uint32) (bool, error)
+
+	// countFDs returns the number of file descriptors open by a process. Nil
+	// when they're not reported.
+	countFDs func(pid uint32) (int, error)
+
+	// maxArgsLength limits the total length of the arguments of processes.
+	// Zero when unlimited.
+	maxArgsLength int
+
+	// reportMainThreadID enables reporting the thread of flows connected or
+	// accepted by the main thread of their process.
+	reportMainThreadID bool
+
+	// connecting holds the active flows connected to a local address, to
+	// detect simultaneous opens.
+	connecting map[string]*flow
+
+	// connections holds the active flows by the identity of their
+	// connection. Nil when flows are keyed by socket.
+	connections map[string]*flow
+
+	// localFlows holds flows between local processes until the other end is
+	// reported. Nil when deduplication is disabled.
+	localFlows *localFlows
+	// readNetNS returns the network namespace of a process, to match local
+	// flows and to resolve interfaces. Nil when neither is enabled.
+	readNetNS func(pid uint32) (uint64, error)
+
+	// tupleHash computes flow.tuple_hash. Nil when it's not reported.
+	tupleHash *tupleHasher
+
+	// portScans holds inbound half-open flows to detect port scans. Nil when
+	// disabled.
+	portScans *portScans
+
+	// peers counts the distinct remote IPs of local services. Nil when
+	// disabled.
+	peers *peerCounter
+
+	// tunnels accounts the packets of the active IPv4 tunnels. Nil when
+	// disabled.
+	tunnels *tunnelTable
+
+	// netlink accounts the activity of netlink sockets. Nil when disabled.
+	netlink *netlinkTable
+
+	// mptcp holds the subflows of MPTCP connections reported before their
+	// sock was seen, by the address of the sock. Nil when MPTCP subflows are
+	// not correlated.
+	mptcp map[uintptr]*mptcpSubflow
+
+	// interimByteRates enables the byte rates in non-final flow events.
+	interimByteRates bool
+
+	// reportEmptyFlows enables recording failed connects and marks the flows
+	// that terminated without transferring any data.
+	reportEmptyFlows bool
+
+	// minFlowBytes is the number of bytes, in both directions, below which
+	// terminated flows are not reported. Zero when all flows are reported.
+	minFlowBytes uint64
+
+	// closeInitiator enables recording which side initiated the close of
+	// TCP flows.
+	closeInitiator bool
+
+	// connectFailures enables recording the duration and error of failed
+	// connection attempts.
+	connectFailures bool
+
+	// exporter receives a copy of the completed flows. Nil when disabled.
+	exporter *flowExporter
+
+	// enrichers add fields to the events of completed flows.
+	enrichers []*registeredEnricher
+
+	// opens holds the events for established flows until they are sent. Nil
+	// when flows are only reported when they terminate.
+	opens *openEvents
+
+	// processEvents enables an event when a process is created by execve
+	// and when it exits.
+	processEvents bool
+
+	// zeroWindowThreshold is how long a flow has to be in zero-window for an
+	// event to be sent. Zero disables the events.
+	zeroWindowThreshold time.Duration
+
+	// sctp holds the SCTP associations being tracked, by sock. Nil when SCTP
+	// monitoring is disabled.
+	sctp map[uintptr]*flow
+	// sctpDetails is set when associations are reported once freed, with
+	// their verification tags and streams.
+	sctpDetails bool
+}
+
+// stateOption configures optional features of the state.
+type stateOption func(*state)
+
+// withKernelHZ sets the kernel's timer frequency.
+func withKernelHZ(hz int) stateOption {
+	return func(s *state) {
+		s.kernelHZ = hz
+	}
+}
+
+// withProcessAttribution sets the attribution policy for flows whose socket
+// is shared between processes.
+func withProcessAttribution(policy string) stateOption {
+	return func(s *state) {
+		s.reportFirstSeen = policy == attributionFirstSeen
+	}
+}
+
+// withCGroupFilter only reports flows from processes in the given cgroup or
+// its descendants. Flows for which the cgroup can't be determined are
+// reported if reportUnknown is set.
+func withCGroupFilter(prefix string, reportUnknown bool) stateOption {
+	return func(s *state) {
+		if prefix != "" {
+			s.cgroups = &cgroupFilter{
+				prefix:        prefix,
+				reportUnknown: reportUnknown,
+				read:          readProcessCGroup,
+			}
+		}
+	}
+}
+
+// withInterfaceResolver enables reporting the outgoing interface of flows.
+// The network namespace of processes is read to only resolve the flows in the
+// same namespace as the Beat.
+func withInterfaceResolver(r *interfaceResolver) stateOption {
+	return func(s *state) {
+		s.interfaces = r
+		if r != nil {
+			s.readNetNS = readNetNS
+		}
+	}
+}
+
+// withMTUResolver enables reporting the path MTU of flows when it differs
+// from the MTU of their interface, which is resolved with r.
+func withMTUResolver(r *interfaceResolver) stateOption {
+	return func(s *state) {
+		s.mtus = r
+		if r != nil {
+			s.readNetNS = readNetNS
+		}
+	}
+}
+
+// withHostsResolver enables resolving destination addresses with no DNS name
+// from the hosts file.
+func withHostsResolver(r *hostsResolver) stateOption {
+	return func(s *state) {
+		s.hosts = r
+	}
+}
+
+// withBGPRIB enables reporting the AS path of the route to the destination
+// address of flows, from the given RIB.
+func withBGPRIB(r *bgpRIB) stateOption {
+	return func(s *state) {
+		s.bgp = r
+	}
+}
+
+// withPortFilter only reports flows accepted by the given port filter.
+func withPortFilter(f *portFilter) stateOption {
+	return func(s *state) {
+		s.ports = f
+	}
+}
+
+// withRemoteCIDRFilter only reports flows accepted by the given remote
+// address filter.
+func withRemoteCIDRFilter(f *cidrFilter) stateOption {
+	return func(s *state) {
+		s.remoteCIDRs = f
+	}
+}
+
+// withSpecialDestinations classifies the destination address of flows with
+// the given classifier.
+func withSpecialDestinations(c *specialAddrClassifier) stateOption {
+	return func(s *state) {
+		s.special = c
+	}
+}
+
+// withAddressTypes classifies the destination address of flows as broadcast
+// or multicast with the given classifier.
+func withAddressTypes(c *addressTypeClassifier) stateOption {
+	return func(s *state) {
+		s.addressTypes = c
+	}
+}
+
+// withNetworkZones assigns the source and destination addresses of flows to
+// the zones of the given classifier.
+func withNetworkZones(c *zoneClassifier) stateOption {
+	return func(s *state) {
+		s.zones = c
+	}
+}
+
+// withSCTP enables tracking of SCTP associations.
+func withSCTP(enabled bool) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.sctp = make(map[uintptr]*flow)
+		}
+	}
+}
+
+// withSCTPDetails defers reporting SCTP associations until they are freed,
+// to include their verification tags and streams.
+func withSCTPDetails(enabled bool) stateOption {
+	return func(s *state) {
+		s.sctpDetails = enabled
+	}
+}
+
+// withDNSCoalescing enables merging concurrent A and AAAA transactions for the
+// same question.
+func withDNSCoalescing(enabled bool) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.dns.recentByQuestion = common.NewCacheWithExpireOnAdd(dnsCoalesceWindow, 8)
+		}
+	}
+}
+
+// withQUIC enables matching the ClientHellos of QUIC connections to UDP flows.
+func withQUIC(enabled bool) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.quic = common.NewCache(quicHelloTimeout, 8)
+		}
+	}
+}
+
+// withLocalFlowDedup enables merging the flows for both ends of connections
+// between local processes. The first flow reported is held for up to
+// holdTime waiting for the other end.
+func withLocalFlowDedup(enabled bool, holdTime time.Duration) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.localFlows = newLocalFlows(holdTime)
+			s.readNetNS = readNetNS
+		}
+	}
+}
+
+// withInterimByteRates enables the byte rates in non-final flow events. They
+// are always included in final events.
+func withInterimByteRates(enabled bool) stateOption {
+	return func(s *state) {
+		s.interimByteRates = enabled
+	}
+}
+
+// withReportEmptyFlows enables reporting failed connects and marking the
+// flows that terminated without transferring any data with flow.empty.
+func withReportEmptyFlows(enabled bool) stateOption {
+	return func(s *state) {
+		s.reportEmptyFlows = enabled
+	}
+}
+
+// withMinFlowBytes drops the flows that transferred fewer bytes than the
+// given minimum, unless they were reset.
+func withMinFlowBytes(minBytes uint64) stateOption {
+	return func(s *state) {
+		s.minFlowBytes = minBytes
+	}
+}
+
+// withCloseInitiator enables reporting which side initiated the close of TCP
+// flows as network.tcp.closed_by.
+func withCloseInitiator(enabled bool) stateOption {
+	return func(s *state) {
+		s.closeInitiator = enabled
+	}
+}
+
+// withConnectFailures enables reporting how long failed connection attempts
+// lasted and why they failed.
+func withConnectFailures(enabled bool) stateOption {
+	return func(s *state) {
+		s.connectFailures = enabled
+	}
+}
+
+// withFlowExporter sends a copy of the completed flows to the given exporter.
+func withFlowExporter(exporter *flowExporter) stateOption {
+	return func(s *state) {
+		s.exporter = exporter
+	}
+}
+
+// withZeroWindowThreshold enables sending an event when a flow has been in
+// zero-window for longer than the given threshold.
+func withZeroWindowThreshold(threshold time.Duration) stateOption {
+	return func(s *state) {
+		s.zeroWindowThreshold = threshold
+	}
+}
+
+// withProcessCapabilities enables reporting the effective capabilities of
+// processes.
+func withProcessCapabilities(enabled bool) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.readProcStatus = readProcStatus
+			s.readFileCaps = readFileCapabilities
+			s.includeCapabilities = true
+		}
+	}
+}
+
+// withNamespacedPIDs enables reporting the PID of processes in their
+// innermost PID namespace.
+func withNamespacedPIDs(enabled bool) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.readProcStatus = readProcStatus
+			s.includeNamespacedPID = true
+		}
+	}
+}
+
+// withServiceTable enables resolution of destination ports to service names.
+func withServiceTable(t *serviceTable) stateOption {
+	return func(s *state) {
+		s.services = t
+	}
 }
 
 func (s *state) getSocket(sock uintptr) *socket {
@@ -388,6 +1212,7 @@ func (s *state) getSocket(sock uintptr) *socket {
 	}
 	s.socks[sock] = socket
 	s.socketLRU.Add(socket)
+	s.onMPTCPSocket(socket)
 	return socket
 }
 
@@ -396,28 +1221,66 @@ var kernelProcess = process{
 	name: "[kernel_task]",
 }
 
-func NewState(r mb.PushReporterV2, log helper.Logger, inactiveTimeout, socketTimeout, closeTimeout, clockMaxDrift time.Duration) *state {
-	s := makeState(r, log, inactiveTimeout, socketTimeout, closeTimeout, clockMaxDrift)
-	go s.expireLoop()
-	go s.logStateLoop()
+func NewState(r mb.PushReporterV2, log helper.Logger, inactiveTimeout, socketTimeout, closeTimeout, clockMaxDrift time.Duration, opts ...stateOption) *state {
+	s := makeState(r, log, inactiveTimeout, socketTimeout, closeTimeout, clockMaxDrift, opts...)
+	s.runLoop(s.expireLoop)
+	s.runLoop(s.logStateLoop)
+	if s.peers != nil {
+		s.runLoop(s.peerCountLoop)
+	}
+	if s.tunnels != nil {
+		s.runLoop(s.tunnelLoop)
+	}
+	if s.netlink != nil {
+		s.runLoop(s.netlinkLoop)
+	}
+	if s.procSync != nil {
+		s.runLoop(s.processSyncLoop)
+	}
 	return s
 }
 
-func makeState(r mb.PushReporterV2, log helper.Logger, inactiveTimeout, socketTimeout, closeTimeout, clockMaxDrift time.Duration) *state {
-	return &state{
+func (s *state) runLoop(loop func()) {
+	s.loops.Add(1)
+	go func() {
+		defer s.loops.Done()
+		loop()
+	}()
+}
+
+// Stop terminates the background loops and waits for them to return, so that
+// nothing is reported once it returns. Flows still held are flushed as when
+// the reporter is done.
+func (s *state) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	s.loops.Wait()
+}
+
+func makeState(r mb.PushReporterV2, log helper.Logger, inactiveTimeout, socketTimeout, closeTimeout, clockMaxDrift time.Duration, opts ...stateOption) *state {
+	s := &state{
 		reporter:        r,
 		log:             log,
+		stop:            make(chan struct{}),
 		processes:       make(map[uint32]*process),
 		socks:           make(map[uintptr]*socket),
+		socksByPID:      make(map[uint32]map[uintptr]*socket),
 		threads:         make(map[uint32]event),
 		inactiveTimeout: inactiveTimeout,
 		socketTimeout:   socketTimeout,
 		closeTimeout:    closeTimeout,
 		clockMaxDrift:   clockMaxDrift,
 		dns:             newDNSTracker(inactiveTimeout * 2),
+		listeners:       newListenerSet(),
+		credFields:      allCredFields,
 		clock:           time.Now,
 		currentPID:      os.Getpid(),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 var (
@@ -434,8 +1297,24 @@ func (s *state) logState() {
 	flowLRUSize := s.flowLRU.Size()
 	closingSize := s.closing.Size()
 	events := atomic.LoadUint64(&eventCount)
+	durations := s.flowDurations
+	s.flowDurations = durationHistogram{}
+	var (
+		flowCounts map[uint32]int
+		flowProcs  map[uint32]*process
+	)
+	if s.topProcesses > 0 {
+		flowCounts, flowProcs = s.flowCountsLocked()
+	}
 	s.Unlock()
 
+	publishFlowDurations(durations)
+	var top []processFlowCount
+	if s.topProcesses > 0 {
+		top = topProcesses(flowCounts, flowProcs, s.topProcesses)
+		publishTopProcesses(top)
+	}
+
 	now := s.clock()
 	took := now.Sub(lastTime)
 	newEvs := events - lastEvents
@@ -445,9 +1324,12 @@ func (s *state) logState() {
 	if uint64(flowLRUSize) != numFlows {
 		errs = append(errs, "flow count mismatch")
 	}
-	msg := fmt.Sprintf("state flows=%d sockets=%d procs=%d threads=%d lru=%d closing=%d events=%d eps=%.1f",
+	msg := fmt.Sprintf("state flows=%d sockets=%d procs=%d threads=%d lru=%d closing=%d events=%d eps=%.1f durations=[%s]",
 		numFlows, numSocks, numProcs, numThreads, flowLRUSize, closingSize, events,
-		float64(newEvs)*float64(time.Second)/float64(took))
+		float64(newEvs)*float64(time.Second)/float64(took), durations.String())
+	if len(top) > 0 {
+		msg += " top=[" + formatTopProcesses(top) + "]"
+	}
 	if errs == nil {
 		s.log.Debugf("%s", msg)
 	} else {
@@ -461,6 +1343,10 @@ func (s *state) expireLoop() {
 	for {
 		select {
 		case <-s.reporter.Done():
+			s.flushLocalFlows()
+			return
+		case <-s.stop:
+			s.flushLocalFlows()
 			return
 		case <-reportTicker.C:
 			s.ExpireFlows()
@@ -475,16 +1361,59 @@ func (s *state) logStateLoop() {
 		select {
 		case <-s.reporter.Done():
 			return
+		case <-s.stop:
+			return
 		case <-logTicker.C:
 			s.logState()
 		}
 	}
 }
 
+// flushLocalFlows reports on their own the local flows still waiting for the
+// other end, when the dataset stops. The output can be closing already, so
+// this is best effort.
+func (s *state) flushLocalFlows() {
+	if s.localFlows == nil {
+		return
+	}
+	for _, f := range s.localFlows.drain() {
+		s.publishFlow(f, nil)
+	}
+}
+
 func (s *state) ExpireFlows() {
 	start := s.clock()
+	if s.opens != nil {
+		s.publishOpenEvents()
+	}
+	sent := 0
+	if s.dnsEvents != nil {
+		// Before expiring flows, whose addresses rank the DNS answers.
+		sent += s.reportDNSEvents()
+	}
 	toReport := s.expireFlows()
-	if sent := s.reportFlows(&toReport); sent != 0 {
+	sent += s.reportFlows(&toReport)
+	if s.localFlows != nil {
+		for _, f := range s.localFlows.expire(start) {
+			if s.publishFlow(f, nil) {
+				sent++
+			}
+		}
+	}
+	if s.portScans != nil {
+		scans, flows := s.portScans.expire(start)
+		for _, scan := range scans {
+			if s.reporter.Event(scan.toEvent()) {
+				sent++
+			}
+		}
+		for _, f := range flows {
+			if s.publishFlow(f, nil) {
+				sent++
+			}
+		}
+	}
+	if sent != 0 {
 		s.log.Debugf("ExpireOlder took %v reported=%d", s.clock().Sub(start), sent)
 	}
 }
@@ -508,6 +1437,7 @@ func (s *state) expireFlows() (toReport helper.LinkedList) {
 		}
 		return ok
 	})
+	s.expireMPTCP(now.Add(-s.socketTimeout))
 	s.closing.RemoveOlder(now.Add(-s.closeTimeout), func(e helper.LinkedElement) bool {
 		sock, ok := e.(*socket)
 		if ok {
@@ -516,9 +1446,26 @@ func (s *state) expireFlows() (toReport helper.LinkedList) {
 		}
 		return ok
 	})
+	deadline := now.Add(-s.socketTimeout)
+	releasedDeadline := now.Add(-s.closeTimeout)
+	for ptr, assoc := range s.sctp {
+		if assoc.lastSeenTime.Before(deadline) ||
+			(assoc.released && assoc.lastSeenTime.Before(releasedDeadline)) {
+			delete(s.sctp, ptr)
+			s.recordFlowDuration(assoc)
+			toReport.Add(assoc)
+		}
+	}
 
 	// Expire cached DNS
 	s.dns.CleanUp()
+
+	if s.retention != nil {
+		s.expireProcesses(now)
+	}
+	if s.quic != nil {
+		s.quic.CleanUp()
+	}
 	return toReport
 }
 
@@ -526,12 +1473,62 @@ func (s *state) CreateProcess(p *process) error {
 	if p.pid == 0 {
 		return errors.New("can't create process with PID 0")
 	}
+	p.maskCreds(s.credFields)
+	// Read now, as the process can be gone by the time its flows are
+	// reported, and before locking, as it involves file I/O. Short-lived
+	// processes might be gone already.
+	if s.cgroups != nil {
+		s.cgroups.resolve(p)
+	}
+	if s.readProcStatus != nil {
+		if status, err := s.readProcStatus(p.pid); err == nil {
+			if s.includeCapabilities && p.capabilities == nil {
+				p.capabilities = status.capabilities
+			}
+			if s.includeNamespacedPID && p.namespacedPID == 0 {
+				p.namespacedPID = status.namespacedPID
+			}
+		}
+	}
+	if s.readNetNS != nil && p.netns == 0 {
+		p.netns, _ = s.readNetNS(p.pid)
+	}
+	if s.readFileCaps != nil && !p.hasFileCapsKnown {
+		hasFileCaps, err := s.readFileCaps(p.pid)
+		p.hasFileCaps, p.hasFileCapsKnown = hasFileCaps, err == nil
+	}
+	if s.maxArgsLength > 0 && !p.argsTruncated {
+		p.args, p.argsTruncated = truncateArgs(p.args, s.maxArgsLength)
+	}
+	if s.readEnvLabels != nil && p.envLabels == nil {
+		// The environment of other users' processes can't be read without
+		// CAP_SYS_PTRACE, and short-lived processes might be gone already.
+		p.envLabels, _ = s.readEnvLabels(p.pid)
+	}
+	if s.readCWD != nil && p.cwd == "" {
+		// Also needs CAP_SYS_PTRACE for other users' processes.
+		p.cwd, p.cwdDeleted, _ = s.readCWD(p.pid)
+	}
 	s.Lock()
-	defer s.Unlock()
+	if prev, found := s.processes[p.pid]; found && !prev.exited {
+		// execve replaces the program of a running process, which keeps
+		// its start time and parent. An exited one is a previous user of
+		// the PID.
+		if p.startTime.IsZero() {
+			p.startTime = prev.startTime
+		}
+		if p.ppid == 0 {
+			p.ppid = prev.ppid
+		}
+	}
 	s.processes[p.pid] = p
 	if p.createdTime == (time.Time{}) {
 		p.createdTime = s.kernTimestampToTime(p.created)
 	}
+	s.Unlock()
+	if s.processEvents && p.reportsStart() {
+		s.reporter.Event(processEvent(p, processStarted, p.createdTime))
+	}
 	return nil
 }
 
@@ -541,12 +1538,27 @@ func (s *state) ForkProcess(parentPID, childPID uint32, ts kernelTime) error {
 	}
 	s.Lock()
 	defer s.Unlock()
+	// Forget about a previous process with the same PID.
+	s.releaseSockets(childPID)
+	// The child inherits all the sockets held by the parent.
+	for _, sock := range s.socksByPID[parentPID] {
+		if sock.inheritedBy == nil {
+			sock.inheritedBy = make(map[uint32]struct{})
+		}
+		sock.inheritedBy[childPID] = struct{}{}
+		s.indexSocket(sock, childPID)
+	}
 	if _, found := s.processes[childPID]; found {
 		return errors.New("fork: child pid already registered to another process")
 	}
 	if parent, found := s.processes[parentPID]; found {
+		parent.RLock()
+		exeDeleted := parent.exeDeleted
+		cgroup, cgroupResolved := parent.cgroup, parent.cgroupResolved
+		parent.RUnlock()
 		child := &process{
 			pid:         childPID,
+			ppid:        parentPID,
 			name:        parent.name,
 			path:        parent.path,
 			args:        parent.args,
@@ -556,8 +1568,20 @@ func (s *state) ForkProcess(parentPID, childPID uint32, ts kernelTime) error {
 			euid:        parent.euid,
 			egid:        parent.egid,
 			hasCreds:    parent.hasCreds,
+			credFields:  parent.credFields,
+			netns:       parent.netns,
+			envLabels:   parent.envLabels,
+			cwd:         parent.cwd,
+			cwdDeleted:  parent.cwdDeleted,
+			exeDeleted:  exeDeleted,
 			createdTime: s.kernTimestampToTime(ts),
 		}
+		child.startTime = child.createdTime
+		child.argsTruncated = parent.argsTruncated
+		// The child runs the same executable until it calls execve.
+		child.hasFileCaps, child.hasFileCapsKnown = parent.hasFileCaps, parent.hasFileCapsKnown
+		// The child starts in the cgroup of its parent.
+		child.cgroup, child.cgroupResolved = cgroup, cgroupResolved
 		child.resolvedDomains = make(map[string]string, len(parent.resolvedDomains))
 		for k, v := range parent.resolvedDomains {
 			child.resolvedDomains[k] = v
@@ -567,14 +1591,69 @@ func (s *state) ForkProcess(parentPID, childPID uint32, ts kernelTime) error {
 	return nil
 }
 
-func (s *state) TerminateProcess(pid uint32) error {
+func (s *state) TerminateProcess(pid uint32, ts kernelTime) error {
 	if pid == 0 {
 		return errors.New("can't terminate process with PID 0")
 	}
 	s.Lock()
-	defer s.Unlock()
-	delete(s.processes, pid)
-	return nil
+	proc, found := s.processes[pid]
+	if found && s.retention != nil {
+		s.retainProcess(proc)
+	} else {
+		delete(s.processes, pid)
+	}
+	s.releaseSockets(pid)
+	exited := s.kernTimestampToTime(ts)
+	s.Unlock()
+	if s.processEvents && found {
+		s.reporter.Event(processEvent(proc, processStopped, exited))
+	}
+	return nil
+}
+
+// setSocketPID sets the process that owns a socket.
+func (s *state) setSocketPID(sock *socket, pid uint32) {
+	sock.pid = pid
+	s.indexSocket(sock, pid)
+}
+
+// indexSocket records that the process has access to the socket.
+func (s *state) indexSocket(sock *socket, pid uint32) {
+	if pid == 0 {
+		return
+	}
+	socks, found := s.socksByPID[pid]
+	if !found {
+		socks = make(map[uintptr]*socket)
+		s.socksByPID[pid] = socks
+	}
+	socks[sock.sock] = sock
+}
+
+// unindexSocket removes a terminated socket from the index.
+func (s *state) unindexSocket(sock *socket) {
+	for pid := range sock.inheritedBy {
+		s.unindexSocketPID(sock, pid)
+	}
+	s.unindexSocketPID(sock, sock.pid)
+}
+
+func (s *state) unindexSocketPID(sock *socket, pid uint32) {
+	if socks, found := s.socksByPID[pid]; found {
+		delete(socks, sock.sock)
+		if len(socks) == 0 {
+			delete(s.socksByPID, pid)
+		}
+	}
+}
+
+// releaseSockets forgets the sockets inherited by a process that exited. The
+// sockets it owns keep it as owner, as their flows are still attributed to it.
+func (s *state) releaseSockets(pid uint32) {
+	for _, sock := range s.socksByPID[pid] {
+		delete(sock.inheritedBy, pid)
+	}
+	delete(s.socksByPID, pid)
 }
 
 func (s *state) getProcess(pid uint32) *process {
@@ -619,10 +1698,14 @@ func (s *state) ThreadLeave(tid uint32) (ev event, found bool) {
 
 func (s *state) onSockTerminated(sock *socket) (toReport helper.LinkedList) {
 	for _, f := range sock.flows {
+		if s.releaseConnection(f, sock.sock) {
+			continue
+		}
 		flows := s.onFlowTerminated(f)
 		toReport.Append(&flows)
 	}
 	sock.flows = nil
+	s.unindexSocket(sock)
 	delete(s.socks, sock.sock)
 	if sock.closing {
 		s.closing.Remove(sock)
@@ -643,6 +1726,8 @@ func (s *state) CreateSocket(ref flow) error {
 	defer s.Unlock()
 	ref.createdTime = s.kernTimestampToTime(ref.created)
 	ref.lastSeenTime = s.kernTimestampToTime(ref.lastSeen)
+	ref.recordActivity()
+	ref.tid = s.threadID(ref.pid, ref.tid)
 	if prev, found := s.socks[ref.sock]; found {
 		// Fetch existing flow in case of TCP negotiation
 		if initial, found := prev.flows[ref.remote.String()]; found && ref.local.String() == initial.local.String() {
@@ -652,19 +1737,57 @@ func (s *state) CreateSocket(ref flow) error {
 			ref.updateWith(*initial, s)
 			delete(prev.flows, ref.remote.String())
 		}
+		// A server-side TCP Fast Open is seen before the sock is accepted.
+		ref.tcp.fastOpen = prev.fastOpen
+		// Also the options negotiated by the handshake.
+		ref.tcp.timestamps, ref.tcp.hasTimestamps = prev.timestamps, prev.hasTimestamps
 		// terminate existing if sock ptr is reused
 		toReport = s.onSockTerminated(prev)
 	}
+	origin := originSocket
+	if ref.accepted {
+		origin = originAccept
+	}
+	s.getSocket(ref.sock).setOrigin(origin, ref.pid)
 	return s.createFlow(ref)
 }
 
 func (s *state) OnDNSTransaction(tr dns.Transaction) error {
 	s.Lock()
 	defer s.Unlock()
+	if tr.PID != 0 {
+		// Backends that observe the resolver know the process, but not the
+		// local endpoint.
+		proc := s.processes[tr.PID]
+		if s.dnsEvents != nil {
+			s.dnsEvents.add(tr, proc, s.clock())
+		}
+		if proc != nil {
+			s.dns.AddTransactionWithProcess(tr, proc)
+		}
+		return nil
+	}
+	if s.dnsEvents != nil {
+		s.dnsEvents.add(tr, s.dns.processOf(tr.Client), s.clock())
+	}
 	s.dns.AddTransaction(tr)
 	return nil
 }
 
+// OnQUICHello stores the ClientHello of a QUIC connection, to tag its flow.
+func (s *state) OnQUICHello(h quic.Hello) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.quic != nil {
+		s.quic.Put(quicHelloKey(h.Client, h.Server), h)
+	}
+	return nil
+}
+
+func quicHelloKey(client, server net.UDPAddr) string {
+	return client.String() + "|" + server.String()
+}
+
 func (s *state) mutualEnrich(sock *socket, f *flow) {
 	// if the sock is not bound to a local address yet, update if possible
 	if !sock.bound && f.local.addr.IP != nil {
@@ -683,7 +1806,7 @@ func (s *state) mutualEnrich(sock *socket, f *flow) {
 		}
 	}
 	if sock.pid == 0 {
-		sock.pid = f.pid
+		s.setSocketPID(sock, f.pid)
 		sock.process = f.process
 	}
 	if sock.pid == f.pid && sock.pid != 0 {
@@ -710,31 +1833,134 @@ func (s *state) createFlow(ref flow) error {
 	sock := s.getSocket(ref.sock)
 	ref.createdTime = ref.lastSeenTime
 	s.mutualEnrich(sock, &ref)
+	ref.origin = sock.originFor(ref.pid)
+	if ref.tcp.fastOpen {
+		sock.fastOpen = true
+	}
+	ref.tcp.fastOpen = sock.fastOpen
+	if sock.hasTimestamps {
+		ref.tcp.timestamps, ref.tcp.hasTimestamps = sock.timestamps, true
+	}
+	if ref.inode != 0 {
+		sock.inode = ref.inode
+	}
+	ref.inode = sock.inode
+	if ref.socketType != 0 {
+		sock.socketFamily, sock.socketType = ref.socketFamily, ref.socketType
+	}
+	ref.socketFamily, ref.socketType = sock.socketFamily, sock.socketType
+	if ref.mptcpID == "" {
+		ref.mptcpID = sock.mptcpID
+	}
+	if sock.connectFailure != nil && ref.proto == protoTCP {
+		ref.tcp.mergeConnect(*sock.connectFailure)
+	}
 
 	// don't create the flow yet if it doesn't have a populated remote address
 	if ref.remote.addr.IP == nil {
 		return nil
 	}
-	ptr := new(flow)
-	*ptr = ref
 	if sock.flows == nil {
 		sock.flows = make(map[string]*flow, 1)
 	}
+	if s.coalesceConnection(sock, &ref) {
+		return nil
+	}
+	ptr := new(flow)
+	*ptr = ref
+	if ptr.id == "" {
+		ptr.id = ptr.computeID()
+	}
 	sock.flows[ref.remote.addr.String()] = ptr
+	s.indexConnection(ptr)
+	s.detectSimultaneousOpen(ptr)
+	s.enrichQUIC(ptr)
 	s.flowLRU.Add(ptr)
 	s.numFlows++
+	if s.peers != nil && ptr.dir == directionIngress {
+		s.peers.add(ptr, s.clock())
+	}
 	return nil
 }
 
 // OnSockDestroyed is called to signal that the given sock has been destroyed.
 func (s *state) OnSockDestroyed(ptr uintptr, pid uint32) error {
+	var toReport helper.LinkedList
+	defer s.reportFlows(&toReport)
+	s.listeners.remove(ptr)
+
 	s.Lock()
 	defer s.Unlock()
 
+	if assoc, found := s.sctp[ptr]; found {
+		assoc.lastSeenTime = s.clock()
+		if s.sctpDetails && assoc.sctp == nil {
+			// The association outlives the sock until the shutdown
+			// completes. It's reported when freed or after closeTimeout.
+			assoc.released = true
+			return nil
+		}
+		delete(s.sctp, ptr)
+		s.recordFlowDuration(assoc)
+		toReport.Add(assoc)
+		return nil
+	}
 	s.onSockDestroyed(ptr, nil, pid)
 	return nil
 }
 
+// OnSCTPAssociation records an SCTP association created by connect or
+// accept. It's reported when its sock is released.
+func (s *state) OnSCTPAssociation(ref flow) error {
+	var toReport helper.LinkedList
+	defer s.reportFlows(&toReport)
+
+	s.Lock()
+	defer s.Unlock()
+	if s.sctp == nil {
+		return nil
+	}
+	ref.createdTime = s.kernTimestampToTime(ref.created)
+	ref.lastSeenTime = s.kernTimestampToTime(ref.lastSeen)
+	ref.process = s.getProcess(ref.pid)
+	ref.tid = s.threadID(ref.pid, ref.tid)
+	if prev, found := s.sctp[ref.sock]; found {
+		// The sock is reused for a new association.
+		toReport.Add(prev)
+	}
+	ptr := new(flow)
+	*ptr = ref
+	ptr.id = ptr.computeID()
+	s.sctp[ref.sock] = ptr
+	return nil
+}
+
+// OnSCTPAssociationFree records the details of an SCTP association when it's
+// freed, and fills its local address if it wasn't known when it was created.
+// The association is reported if its sock has already been released.
+func (s *state) OnSCTPAssociationFree(ptr uintptr, info sctpAssocInfo, local endpoint) error {
+	var toReport helper.LinkedList
+	defer s.reportFlows(&toReport)
+
+	s.Lock()
+	defer s.Unlock()
+	assoc, found := s.sctp[ptr]
+	if !found {
+		return nil
+	}
+	assoc.sctp = &info
+	// Only the IPv4 local address is fetched from the sock.
+	if assoc.inetType == inetTypeIPv4 && assoc.local.addr.IP == nil {
+		assoc.local.addr = local.addr
+	}
+	if assoc.released {
+		delete(s.sctp, ptr)
+		s.recordFlowDuration(assoc)
+		toReport.Add(assoc)
+	}
+	return nil
+}
+
 func (s *state) onSockDestroyed(ptr uintptr, sock *socket, pid uint32) {
 	var found bool
 	if sock == nil {
@@ -744,7 +1970,7 @@ func (s *state) onSockDestroyed(ptr uintptr, sock *socket, pid uint32) {
 	}
 	// Enrich with pid
 	if sock.pid == 0 && pid != 0 {
-		sock.pid = pid
+		s.setSocketPID(sock, pid)
 	}
 	if sock.process == nil && sock.pid != 0 {
 		sock.process = s.getProcess(pid)
@@ -756,6 +1982,246 @@ func (s *state) onSockDestroyed(ptr uintptr, sock *socket, pid uint32) {
 	}
 }
 
+// OnTCPClose is called when a TCP socket is closed to capture the kernel's
+// RTT estimator state, the number of duplicate segments the peer reported
+// with DSACK, the last path MTU seen by the socket, its buffer sizes and its
+// congestion window. fields tells which of these values were fetched. srtt is
+// in microseconds << 3 and rto in jiffies.
+func (s *state) OnTCPClose(ptr uintptr, fields tcpCloseFields, srtt, rto, dsackDups, pmtu, sndbuf, rcvbuf, cwnd uint32) error {
+	s.Lock()
+	defer s.Unlock()
+	sock, found := s.socks[ptr]
+	if !found {
+		return nil
+	}
+	hasRTT := fields&tcpCloseRTT != 0 && s.kernelHZ > 0
+	srttUS := srtt >> 3
+	var rtoUS uint32
+	if hasRTT {
+		rtoUS = uint32(uint64(rto) * uint64(time.Second/time.Microsecond) / uint64(s.kernelHZ))
+	}
+	for _, f := range sock.flows {
+		if f.proto != protoTCP {
+			continue
+		}
+		if hasRTT {
+			f.tcp.srttUS, f.tcp.rtoUS, f.tcp.hasRTT = srttUS, rtoUS, true
+		}
+		if fields&tcpCloseDSACKDups != 0 {
+			f.tcp.dsackDups, f.tcp.hasDSACKDups = dsackDups, true
+		}
+		if fields&tcpClosePathMTU != 0 {
+			f.tcp.pmtu = pmtu
+		}
+		if fields&tcpCloseBuffers != 0 {
+			f.tcp.sndbuf, f.tcp.rcvbuf, f.tcp.hasBuffers = sndbuf, rcvbuf, true
+		}
+		if fields&tcpCloseCwnd != 0 {
+			f.tcp.cwnd, f.tcp.hasCwnd = cwnd, true
+		}
+	}
+	return nil
+}
+
+// discoveredPathMTU returns the path MTU of the flow when path MTU discovery
+// found a value different from the MTU of the interface used to reach the
+// remote address. Otherwise, or when either is unknown, it returns zero.
+func (s *state) discoveredPathMTU(f *flow) int {
+	if f.tcp.pmtu == 0 {
+		return 0
+	}
+	mtu := s.mtus.LookupMTU(f.netNS(), f.local.addr.IP, f.remote.addr.IP)
+	if mtu == 0 || mtu == int(f.tcp.pmtu) {
+		return 0
+	}
+	return int(f.tcp.pmtu)
+}
+
+// OnTCPReset is called when a reset is sent or received for the given sock.
+// A reset sent or received before any FIN closes the flow on that side.
+func (s *state) OnTCPReset(ptr uintptr, sent bool) error {
+	s.Lock()
+	defer s.Unlock()
+	if sock, found := s.socks[ptr]; found {
+		for _, f := range sock.flows {
+			f.reset = true
+			if s.closeInitiator {
+				f.tcp.setClosedBy(closeSide(sent))
+			}
+		}
+	}
+	return nil
+}
+
+// OnTCPFin is called when a FIN is sent or received for the given sock, with
+// the state of the sock at that time. A FIN received while the sock is still
+// in FIN_WAIT1 means that both sides started closing at the same time, so
+// that the initiator is ambiguous. A FIN sent in LAST_ACK follows a FIN
+// received, in case it wasn't seen.
+func (s *state) OnTCPFin(ptr uintptr, sent bool, sockState uint8) error {
+	if !s.closeInitiator {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	sock, found := s.socks[ptr]
+	if !found {
+		return nil
+	}
+	for _, f := range sock.flows {
+		if f.proto != protoTCP {
+			continue
+		}
+		switch {
+		case !sent && sockState == tcpStateFinWait1:
+			f.tcp.closedBy, f.tcp.simultaneousClose = "", true
+		case sent && sockState == tcpStateLastAck:
+			f.tcp.setClosedBy(closedByRemote)
+		default:
+			f.tcp.setClosedBy(closeSide(sent))
+		}
+	}
+	return nil
+}
+
+// closeSide returns the side that closed a flow by sending a FIN or reset.
+func closeSide(sent bool) string {
+	if sent {
+		return closedByLocal
+	}
+	return closedByRemote
+}
+
+// OnTCPZeroWindowProbe is called when a zero-window probe is sent because
+// the peer of the given sock advertised a zero receive window. When a
+// threshold is configured, an event is sent for flows that have been in
+// zero-window for longer than it.
+func (s *state) OnTCPZeroWindowProbe(ptr uintptr, ts kernelTime) error {
+	var events []mb.Event
+	defer func() {
+		for _, ev := range events {
+			s.reporter.Event(ev)
+		}
+	}()
+
+	s.Lock()
+	defer s.Unlock()
+	sock, found := s.socks[ptr]
+	if !found {
+		return nil
+	}
+	now := s.kernTimestampToTime(ts)
+	for _, f := range sock.flows {
+		if f.proto != protoTCP {
+			continue
+		}
+		tcp := &f.tcp
+		tcp.zeroWindowCount++
+		if tcp.zeroWindowSince.IsZero() || now.Sub(tcp.zeroWindowLast) > zeroWindowMaxGap {
+			tcp.zeroWindowSince, tcp.zeroWindowReported = now, false
+		}
+		tcp.zeroWindowLast = now
+		if s.zeroWindowThreshold <= 0 || tcp.zeroWindowReported || now.Sub(tcp.zeroWindowSince) < s.zeroWindowThreshold {
+			continue
+		}
+		tcp.zeroWindowReported = true
+		ev, err := s.zeroWindowEvent(f)
+		if err != nil {
+			s.log.Errorf("Failed to convert zero-window flow=%v err=%v", f, err)
+			continue
+		}
+		events = append(events, ev)
+	}
+	return nil
+}
+
+// OnTCPConnectFailed is called when a TCP sock is done while in SYN_SENT,
+// because its connection attempt timed out, was reset or got an ICMP error.
+// The error is the one reported to the process, zero when unknown.
+func (s *state) OnTCPConnectFailed(ptr uintptr, errno int32, ts kernelTime) error {
+	if !s.connectFailures {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	sock, found := s.socks[ptr]
+	if !found {
+		return nil
+	}
+	failed := false
+	for _, f := range sock.flows {
+		if f.proto == protoTCP {
+			f.tcp.setConnectFailure(ts, errno)
+			failed = true
+		}
+	}
+	if !failed {
+		sock.connectFailure = &tcpStats{}
+		sock.connectFailure.setConnectFailure(ts, errno)
+	}
+	return nil
+}
+
+// OnTCPUrgentData is called when the given sock receives a new TCP urgent
+// pointer, that is, out-of-band data.
+func (s *state) OnTCPUrgentData(ptr uintptr) error {
+	s.Lock()
+	defer s.Unlock()
+	sock, found := s.socks[ptr]
+	if !found {
+		return nil
+	}
+	for _, f := range sock.flows {
+		if f.proto == protoTCP {
+			f.tcp.urgentDataSeen = true
+		}
+	}
+	return nil
+}
+
+// OnTCPFastOpen is called when TCP Fast Open is used by the given sock, either
+// because a client sent data in the SYN or because a server accepted it.
+func (s *state) OnTCPFastOpen(ptr uintptr) error {
+	s.Lock()
+	defer s.Unlock()
+	sock := s.getSocket(ptr)
+	sock.fastOpen = true
+	for _, f := range sock.flows {
+		f.tcp.fastOpen = true
+	}
+	return nil
+}
+
+// OnTCPEstablishedOptions is called when a TCP connection is established
+// with the status of the options negotiated by the handshake.
+func (s *state) OnTCPEstablishedOptions(ptr uintptr, timestamps bool) error {
+	s.Lock()
+	defer s.Unlock()
+	sock := s.getSocket(ptr)
+	sock.timestamps, sock.hasTimestamps = timestamps, true
+	for _, f := range sock.flows {
+		f.tcp.timestamps, f.tcp.hasTimestamps = timestamps, true
+	}
+	return nil
+}
+
+// OnSocketInode records the inode number of the socket file of an accepted
+// socket, which is only known once it's grafted to the struct socket returned
+// by accept.
+func (s *state) OnSocketInode(ptr uintptr, inode uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	sock, found := s.socks[ptr]
+	if !found {
+		return nil
+	}
+	sock.inode = inode
+	for _, f := range sock.flows {
+		f.inode = inode
+	}
+	return nil
+}
+
 func (s *state) moveToClosing(sock *socket) {
 	sock.lastSeenTime = s.clock()
 	sock.closing = true
@@ -776,6 +2242,18 @@ func (s *state) UpdateFlowWithCondition(ref flow, cond func(*flow) bool) error {
 	defer s.Unlock()
 	ref.createdTime = s.kernTimestampToTime(ref.created)
 	ref.lastSeenTime = s.kernTimestampToTime(ref.lastSeen)
+	ref.recordActivity()
+	ref.tid = s.threadID(ref.pid, ref.tid)
+	if assoc, found := s.sctp[ref.sock]; found {
+		// Generic probes also see SCTP socks. Only keep the association
+		// alive, as the packet counts would be incomplete, and take the
+		// local address once the association is established.
+		assoc.lastSeenTime = ref.lastSeenTime
+		if assoc.local.addr.IP == nil {
+			assoc.local.addr = ref.local.addr
+		}
+		return nil
+	}
 	sock, found := s.socks[ref.sock]
 	if !found {
 		return s.createFlow(ref)
@@ -792,14 +2270,45 @@ func (s *state) UpdateFlowWithCondition(ref flow, cond func(*flow) bool) error {
 	if cond != nil && !cond(prev) {
 		return nil
 	}
+	s.followActiveProcess(sock, prev, ref.pid)
 	s.mutualEnrich(sock, &ref)
 	prev.updateWith(ref, s)
+	prev.origin = sock.originFor(prev.pid)
+	s.indexConnection(prev)
+	s.detectSimultaneousOpen(prev)
 	s.enrichDNS(prev)
+	s.enrichQUIC(prev)
 	s.flowLRU.Remove(prev)
 	s.flowLRU.Add(prev)
 	return nil
 }
 
+// followActiveProcess attributes the flow to the process performing the I/O
+// when the socket is shared with other processes that inherited it, and
+// updates the process information after an execve. With first_seen
+// attribution, the socket and its flows keep the process first seen.
+func (s *state) followActiveProcess(sock *socket, f *flow, pid uint32) {
+	if s.reportFirstSeen || !sock.heldBy(pid) {
+		return
+	}
+	current := s.processes[pid]
+	if pid == f.pid && (current == nil || current == f.process) {
+		return
+	}
+	if sock.pid != pid {
+		// Keep the previous owner, as it still has access to the socket.
+		if sock.inheritedBy == nil {
+			sock.inheritedBy = make(map[uint32]struct{})
+		}
+		sock.inheritedBy[sock.pid] = struct{}{}
+		delete(sock.inheritedBy, pid)
+		sock.pid = pid
+	}
+	sock.process = current
+	f.pid = pid
+	f.process = current
+}
+
 func (s *state) enrichDNS(f *flow) {
 	if f.remote.addr.Port == 53 && f.proto == protoUDP && f.pid != 0 && f.process != nil {
 		localUDP := net.UDPAddr{
@@ -807,6 +2316,26 @@ func (s *state) enrichDNS(f *flow) {
 			Port: f.local.addr.Port,
 		}
 		s.dns.RegisterEndpoint(localUDP, f.process)
+		if s.dnsEvents != nil {
+			s.dnsEvents.resolve(localUDP.String(), f.process)
+		}
+	}
+}
+
+// enrichQUIC attaches the ClientHello captured for a UDP flow. The sniffer
+// and the kprobes are not synchronized, so it's looked up until found. Both
+// directions are tried, as the local end can be the client or the server.
+func (s *state) enrichQUIC(f *flow) {
+	if s.quic == nil || f.quic != nil || f.proto != protoUDP || f.local.addr.IP == nil || f.remote.addr.IP == nil {
+		return
+	}
+	local := net.UDPAddr{IP: f.local.addr.IP, Port: f.local.addr.Port}
+	remote := net.UDPAddr{IP: f.remote.addr.IP, Port: f.remote.addr.Port}
+	for _, key := range []string{quicHelloKey(local, remote), quicHelloKey(remote, local)} {
+		if h, ok := s.quic.Get(key).(quic.Hello); ok {
+			f.quic = &h
+			return
+		}
 	}
 }
 
@@ -826,6 +2355,9 @@ func (f *flow) updateWith(ref flow, s *state) {
 		f.pid = ref.pid
 		f.process = ref.process
 	}
+	if f.tid == 0 && f.pid == ref.pid {
+		f.tid = ref.tid
+	}
 	if f.process == nil {
 		if ref.process != nil && f.pid == ref.pid {
 			f.process = ref.process
@@ -839,22 +2371,139 @@ func (f *flow) updateWith(ref flow, s *state) {
 	if ref.complete {
 		f.complete = true
 	}
+	if ref.connectAttempt {
+		f.connectAttempt = true
+	}
+	f.tcp.mergeConnect(ref.tcp)
+	if ref.accepted {
+		f.accepted = true
+	}
+	if f.id == "" {
+		f.id = ref.id
+	}
 	f.local.updateWith(ref.local)
 	f.remote.updateWith(ref.remote)
+	f.inbound.merge(ref.inbound)
+	f.outbound.merge(ref.outbound)
+}
+
+// computeID returns an identifier for the flow, shared by all its events. It's
+// computed once, when the flow is created, from its tuple as known then, its
+// creation time and the network namespace of its process, so that it doesn't
+// change during the flow's lifetime and flows in different namespaces or with
+// reused socks or PIDs get different identifiers.
+func (f *flow) computeID() string {
+	h := system.NewEntityHash()
+	binary.Write(h, binary.LittleEndian, f.netNS())
+	binary.Write(h, binary.LittleEndian, uint64(f.sock))
+	binary.Write(h, binary.LittleEndian, f.createdTime.UnixNano())
+	h.Write([]byte{byte(f.proto)})
+	h.Write([]byte(f.local.addr.String()))
+	h.Write([]byte(f.remote.addr.String()))
+	return h.Sum()
 }
 
 func (s *state) reportFlow(f *flow) (reported bool) {
 	if f != nil && f.isValid() && int(f.pid) != s.currentPID {
-		if ev, err := f.toEvent(true); err == nil {
-			reported = s.reporter.Event(ev)
-		} else {
-			s.log.Errorf("Failed to convert flow=%v err=%v", f, err)
+		s.inferListenerProcess(f)
+		if s.isFiltered(f) || s.isBelowMinBytes(f) {
+			return false
+		}
+		f.service = s.services.Lookup(f.proto, f.destination().addr.Port)
+		f.iface = s.interfaces.Lookup(f.netNS(), f.local.addr.IP, f.remote.addr.IP)
+		f.hostsDomain = s.hosts.Lookup(f.destination().addr.IP)
+		f.dstAS = s.bgp.Lookup(f.destination().addr.IP)
+		f.specialDst = s.special.Classify(f.destination().addr.IP)
+		f.dstAddrType, f.dstGroup = s.addressTypes.Classify(f.netNS(), f.local.addr.IP, f.destination().addr.IP)
+		f.srcZone = s.zones.Lookup(f.source().addr.IP)
+		if f.dir == directionEgress && f.proto == protoTCP {
+			f.alsoListening = s.listeners.isListening(f.local.addr.IP, f.local.addr.Port)
 		}
+		f.dstZone = s.zones.Lookup(f.destination().addr.IP)
+		f.pathMTU = s.discoveredPathMTU(f)
+		s.enrichQUIC(f)
+		f.exeDeleted = s.checkExecutableDeleted(f.process)
+		f.fdCount, f.hasFDCount = s.processFDCount(f.process)
+		if s.portScans != nil && f.isHalfOpenInbound() && s.portScans.hold(f) {
+			// Reported after the grace period, unless it's part of a scan.
+			return false
+		}
+		if s.localFlows != nil && f.isLocal() && f.netNS() != 0 {
+			peer, displaced := s.localFlows.match(f, s.clock())
+			if displaced != nil {
+				s.publishFlow(displaced, nil)
+			}
+			if peer == nil {
+				// Reported when the other end is, or after a timeout.
+				return false
+			}
+			return s.publishFlow(f, peer)
+		}
+		reported = s.publishFlow(f, nil)
 	}
 	return reported
 }
 
+// isFiltered returns whether the flow is excluded from reporting by its
+// ports, its remote address or the cgroup of its process.
+func (s *state) isFiltered(f *flow) bool {
+	if !s.ports.matches(f.local.addr.Port, f.remote.addr.Port) {
+		return true
+	}
+	if !s.remoteCIDRs.matches(f.remote.addr.IP) {
+		return true
+	}
+	return s.cgroups != nil && !s.cgroups.matches(f.process)
+}
+
+// isBelowMinBytes returns whether the flow transferred too few bytes to be
+// reported. Flows that were reset are always reported, as are empty flows when
+// they're explicitly requested.
+func (s *state) isBelowMinBytes(f *flow) bool {
+	if s.minFlowBytes == 0 || f.reset || (s.reportEmptyFlows && f.isEmpty()) {
+		return false
+	}
+	return f.local.bytes+f.remote.bytes < s.minFlowBytes
+}
+
+// publishFlow sends the event for a flow, merged with the flow for the other
+// end of the connection when peer is set.
+func (s *state) publishFlow(f, peer *flow) bool {
+	var (
+		ev  mb.Event
+		err error
+	)
+	if peer != nil {
+		ev, err = mergeLocalFlows(f, peer)
+	} else {
+		ev, err = f.toEvent(true)
+	}
+	if err != nil {
+		s.log.Errorf("Failed to convert flow=%v err=%v", f, err)
+		return false
+	}
+	if s.reportEmptyFlows && f.isEmpty() && (peer == nil || peer.isEmpty()) {
+		if _, err = ev.RootFields.Put("flow.empty", true); err != nil {
+			s.log.Errorf("Failed to mark empty flow=%v err=%v", f, err)
+		}
+	}
+	if err = s.putTupleHash(f, ev.RootFields); err != nil {
+		s.log.Errorf("Failed to hash the tuple of flow=%v err=%v", f, err)
+	}
+	s.enrichFlow(f, ev.RootFields)
+	if s.exporter != nil {
+		s.exporter.Export(ev)
+	}
+	return s.reporter.Event(ev)
+}
+
 func (s *state) reportFlows(l *helper.LinkedList) (count int) {
+	if s.opens != nil && l.Size() > 0 {
+		// Open events for these flows must be sent first.
+		s.opens.reporting.Lock()
+		defer s.opens.reporting.Unlock()
+		s.flushOpenEvents()
+	}
 	for item := l.Get(); item != nil; item = l.Get() {
 		if f, ok := item.(*flow); ok {
 			if s.reportFlow(f) {
@@ -875,40 +2524,75 @@ func (s *state) onFlowTerminated(f *flow) (toReport helper.LinkedList) {
 	if parent, found := s.socks[f.sock]; found {
 		delete(parent.flows, f.remote.addr.String())
 	}
+	s.unindexConnection(f)
+	s.forgetConnecting(f)
 	s.numFlows--
+	s.recordFlowDuration(f)
 	toReport.Add(f)
 	return toReport
 }
 
+// recordFlowDuration accounts a terminated flow in the duration histogram.
+func (s *state) recordFlowDuration(f *flow) {
+	s.flowDurations.add(f.lastSeenTime.Sub(f.createdTime))
+}
+
+// isInbound returns whether the local end of the flow is its destination.
+func (f *flow) isInbound() bool {
+	switch f.dir {
+	case directionIngress:
+		return true
+	case directionUnknown:
+		// For some flows we can miss information to determine the source (dir=unknown).
+		// As a last resort, assume that the client side uses a higher port number
+		// than the server.
+		return f.local.addr.Port < f.remote.addr.Port
+	}
+	return false
+}
+
+// destination returns the endpoint at the destination (server) side of the flow.
+func (f *flow) destination() *endpoint {
+	if f.isInbound() {
+		return &f.local
+	}
+	return &f.remote
+}
+
+// source returns the endpoint at the source (client) side of the flow.
+func (f *flow) source() *endpoint {
+	if f.isInbound() {
+		return &f.remote
+	}
+	return &f.local
+}
+
 func (f *flow) toEvent(final bool) (ev mb.Event, err error) {
 	localAddr := f.local.addr
 	remoteAddr := f.remote.addr
 
 	local := mapstr.M{
-		"ip":      localAddr.IP.String(),
-		"port":    localAddr.Port,
 		"packets": f.local.packets,
 		"bytes":   f.local.bytes,
 	}
+	if localAddr.IP != nil {
+		local["ip"] = localAddr.IP.String()
+		local["port"] = localAddr.Port
+	}
 
 	remote := mapstr.M{
-		"ip":      remoteAddr.IP.String(),
-		"port":    remoteAddr.Port,
 		"packets": f.remote.packets,
 		"bytes":   f.remote.bytes,
 	}
+	if remoteAddr.IP != nil {
+		remote["ip"] = remoteAddr.IP.String()
+		remote["port"] = remoteAddr.Port
+	}
+	completeTuple := f.hasCompleteTuple()
 
 	src, dst := local, remote
-	switch f.dir {
-	case directionIngress:
+	if f.isInbound() {
 		src, dst = dst, src
-	case directionUnknown:
-		// For some flows we can miss information to determine the source (dir=unknown).
-		// As a last resort, assume that the client side uses a higher port number
-		// than the server.
-		if localAddr.Port < remoteAddr.Port {
-			src, dst = dst, src
-		}
 	}
 
 	inetType := f.inetType
@@ -937,13 +2621,6 @@ func (f *flow) toEvent(final bool) (ev mb.Event, err error) {
 			"transport": f.proto.String(),
 			"packets":   f.local.packets + f.remote.packets,
 			"bytes":     f.local.bytes + f.remote.bytes,
-			"community_id": flowhash.CommunityID.Hash(flowhash.Flow{
-				SourceIP:        localAddr.IP,
-				SourcePort:      uint16(localAddr.Port),
-				DestinationIP:   remoteAddr.IP,
-				DestinationPort: uint16(remoteAddr.Port),
-				Protocol:        uint8(f.proto),
-			}),
 		},
 		"event": mapstr.M{
 			"kind":     "event",
@@ -966,52 +2643,212 @@ func (f *flow) toEvent(final bool) (ev mb.Event, err error) {
 		}
 	}
 
+	if f.id != "" {
+		rootPut("flow.id", f.id)
+	}
+	if f.opened && final {
+		rootPut("flow.event", "close")
+	}
+
+	// The community ID can't be computed without the full tuple.
+	if !completeTuple {
+		rootPut("network.tuple.complete", false)
+	} else {
+		rootPut("network.community_id", flowhash.CommunityID.Hash(flowhash.Flow{
+			SourceIP:        localAddr.IP,
+			SourcePort:      uint16(localAddr.Port),
+			DestinationIP:   remoteAddr.IP,
+			DestinationPort: uint16(remoteAddr.Port),
+			Protocol:        uint8(f.proto),
+		}))
+	}
+
 	relatedIPs := []string{}
 	if len(localAddr.IP) != 0 {
 		relatedIPs = append(relatedIPs, localAddr.IP.String())
 	}
-	if len(localAddr.IP) > 0 {
+	if len(remoteAddr.IP) != 0 {
 		relatedIPs = append(relatedIPs, remoteAddr.IP.String())
 	}
 	if len(relatedIPs) > 0 {
 		rootPut("related.ip", relatedIPs)
 	}
 
-	metricset := mapstr.M{
-		"kernel_sock_address": fmt.Sprintf("0x%x", f.sock),
+	if f.quic != nil {
+		rootPut("network.protocol", "quic")
+		if f.quic.ServerName != "" {
+			rootPut("tls.client.server_name", f.quic.ServerName)
+		}
+		if len(f.quic.ALPN) > 0 {
+			rootPut("tls.detailed.client_hello.extensions.application_layer_protocol_negotiation", f.quic.ALPN)
+		}
+	} else if f.service != "" {
+		rootPut("network.protocol", f.service)
+	}
+
+	if f.tcp.hasRTT {
+		rootPut("network.tcp.srtt_us", f.tcp.srttUS)
+		rootPut("network.tcp.rto_us", f.tcp.rtoUS)
+	}
+
+	if f.tcp.hasDSACKDups {
+		rootPut("network.tcp.dsack_dups", f.tcp.dsackDups)
+	}
+
+	if f.tcp.hasCwnd {
+		rootPut("network.tcp.congestion_window", f.tcp.cwnd)
+	}
+
+	if f.tcp.zeroWindowCount > 0 {
+		rootPut("network.tcp.zero_window_count", f.tcp.zeroWindowCount)
+	}
+
+	if f.tcp.urgentDataSeen {
+		rootPut("network.tcp.urgent_data_seen", true)
 	}
 
-	if f.pid != 0 {
-		process := mapstr.M{
-			"pid": int(f.pid),
+	if f.tcp.connectFailed {
+		if f.tcp.connectStart != 0 && f.tcp.connectEnd >= f.tcp.connectStart {
+			rootPut("network.tcp.connect_attempt_duration_ns", int64(f.tcp.connectEnd-f.tcp.connectStart))
 		}
-		if f.process != nil {
-			process["name"] = f.process.name
-			process["args"] = f.process.args
-			process["executable"] = f.process.path
-			if f.process.createdTime != (time.Time{}) {
-				process["created"] = f.process.createdTime
-			}
-			if f.process.entityID != "" {
-				process["entity_id"] = f.process.entityID
+		if f.tcp.connectErrno > 0 {
+			errno := unix.Errno(f.tcp.connectErrno)
+			rootPut("network.tcp.connect_errno", f.tcp.connectErrno)
+			if name := unix.ErrnoName(errno); name != "" {
+				rootPut("network.tcp.connect_error", name)
 			}
+		}
+	}
+
+	if f.tcp.closedBy != "" {
+		rootPut("network.tcp.closed_by", f.tcp.closedBy)
+	}
+
+	if f.tcp.simultaneousOpen {
+		rootPut("network.tcp.simultaneous_open", true)
+	}
+
+	rootPut("network.socket.origin", f.origin.String())
+
+	if f.tcp.hasBuffers {
+		rootPut("network.socket.send_buffer_bytes", f.tcp.sndbuf)
+		rootPut("network.socket.receive_buffer_bytes", f.tcp.rcvbuf)
+	}
+
+	if f.mptcpID != "" {
+		rootPut("network.mptcp.connection_id", f.mptcpID)
+	}
+
+	if f.sctp != nil {
+		rootPut("network.sctp.verification_tag.local", f.sctp.localVTag)
+		rootPut("network.sctp.verification_tag.remote", f.sctp.remoteVTag)
+		rootPut("network.sctp.streams.outbound", f.sctp.outStreams)
+		rootPut("network.sctp.streams.inbound", f.sctp.inStreams)
+	}
+
+	if f.pathMTU != 0 {
+		rootPut("network.path_mtu", f.pathMTU)
+	}
+
+	if f.iface != "" {
+		rootPut("network.interface.name", f.iface)
+	}
+
+	if f.dstAddrType != "" {
+		rootPut("network.destination.address_type", f.dstAddrType)
+	}
+	if f.dstGroup != "" {
+		rootPut("network.destination.multicast_group", f.dstGroup)
+	}
+	if f.specialDst != "" {
+		rootPut("network.destination.special", f.specialDst)
+	}
+
+	if f.srcZone != "" {
+		rootPut("network.source.zone", f.srcZone)
+		rootPut("network.destination.zone", f.dstZone)
+		if f.srcZone != f.dstZone {
+			rootPut("network.cross_zone", true)
+		}
+	}
+
+	if f.listenAddr != nil {
+		rootPut("network.local.listen_address", f.listenAddr.String())
+	}
+	if f.alsoListening {
+		rootPut("network.local.also_listening", true)
+	}
+
+	// Only set when the flow is known to originate from a connect or an
+	// accept, as the direction alone can't tell who initiated it.
+	if f.connectAttempt {
+		rootPut("network.initiated_locally", true)
+	} else if f.accepted {
+		rootPut("network.initiated_locally", false)
+	}
+
+	if f.tcp.fastOpen {
+		rootPut("network.tcp.fast_open", true)
+	}
+	if f.tcp.hasTimestamps {
+		rootPut("network.tcp.timestamps_enabled", f.tcp.timestamps)
+	}
+	if f.inode != 0 {
+		rootPut("network.socket.inode", f.inode)
+	}
+	if f.socketType != 0 {
+		rootPut("network.socket.family", socketFamilyName(f.socketFamily))
+		rootPut("network.socket.type", socketTypeName(f.socketType))
+	}
+
+	if final {
+		if err := f.putByteRates(root); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if !f.inbound.last.IsZero() {
+		rootPut("network.inbound.first_seen", f.inbound.first)
+		rootPut("network.inbound.last_seen", f.inbound.last)
+	}
+	if !f.outbound.last.IsZero() {
+		rootPut("network.outbound.first_seen", f.outbound.first)
+		rootPut("network.outbound.last_seen", f.outbound.last)
+	}
+
+	metricset := mapstr.M{
+		"kernel_sock_address": fmt.Sprintf("0x%x", f.sock),
+	}
 
-			if f.process.hasCreds {
-				uid := strconv.Itoa(int(f.process.uid))
-				gid := strconv.Itoa(int(f.process.gid))
-				rootPut("user.id", uid)
-				rootPut("group.id", gid)
-				if name := userCache.LookupID(uid); name != "" {
-					rootPut("user.name", name)
-					rootPut("related.user", []string{name})
+	if process := f.processFields(); process != nil {
+		if f.process != nil {
+			if creds := f.process.credFields; f.process.hasCreds {
+				if creds.has(credUID) {
+					uid := strconv.Itoa(int(f.process.uid))
+					rootPut("user.id", uid)
+					if name := userCache.LookupID(uid); name != "" {
+						rootPut("user.name", name)
+						rootPut("related.user", []string{name})
+					}
+					metricset["uid"] = f.process.uid
+				}
+				if creds.has(credGID) {
+					gid := strconv.Itoa(int(f.process.gid))
+					rootPut("group.id", gid)
+					if name := groupCache.LookupID(gid); name != "" {
+						rootPut("group.name", name)
+					}
+					metricset["gid"] = f.process.gid
+				}
+				if creds.has(credEUID) {
+					metricset["euid"] = f.process.euid
 				}
-				if name := groupCache.LookupID(gid); name != "" {
-					rootPut("group.name", name)
+				if creds.has(credEGID) {
+					metricset["egid"] = f.process.egid
 				}
-				metricset["uid"] = f.process.uid
-				metricset["gid"] = f.process.gid
-				metricset["euid"] = f.process.euid
-				metricset["egid"] = f.process.egid
+			}
+			for name, value := range f.process.envLabels {
+				rootPut("labels."+name, value)
 			}
 
 			if domain, found := f.process.ResolveIP(f.local.addr.IP); found {
@@ -1024,12 +2861,140 @@ func (f *flow) toEvent(final bool) (ev mb.Event, err error) {
 		root["process"] = process
 	}
 
+	// The hosts file is only used when DNS provided no name.
+	if f.hostsDomain != "" {
+		if _, found := dst["domain"]; !found {
+			dst["domain"] = f.hostsDomain
+		}
+	}
+
+	if f.dstAS != nil {
+		as := mapstr.M{"path": f.dstAS.path}
+		if f.dstAS.origin != 0 {
+			as["number"] = f.dstAS.origin
+		}
+		dst["as"] = as
+	}
+
 	return mb.Event{
 		RootFields:      root,
 		MetricSetFields: metricset,
 	}, errs.Err()
 }
 
+// processFields returns the process fields for the flow, or nil when the
+// process is unknown.
+func (f *flow) processFields() mapstr.M {
+	if f.pid == 0 {
+		return nil
+	}
+	process := mapstr.M{
+		"pid": int(f.pid),
+	}
+	if f.tid != 0 {
+		process["thread"] = mapstr.M{"id": int(f.tid)}
+	}
+	if f.processInferred {
+		process["attribution"] = "inferred"
+	}
+	if f.process != nil {
+		process["name"] = f.process.name
+		process["args"] = f.process.args
+		if f.process.argsTruncated {
+			process["args_truncated"] = true
+		}
+		process["executable"] = f.process.path
+		if f.exeDeleted {
+			process["executable_deleted"] = true
+		}
+		if f.process.cwd != "" {
+			process["working_directory"] = f.process.cwd
+			if f.process.cwdDeleted {
+				process["working_directory_deleted"] = true
+			}
+		}
+		if f.hasFDCount {
+			process["fd_count"] = f.fdCount
+		}
+		if f.process.createdTime != (time.Time{}) {
+			process["created"] = f.process.createdTime
+		}
+		if !f.process.startTime.IsZero() {
+			process["start"] = f.process.startTime
+		}
+		if f.process.entityID != "" {
+			process["entity_id"] = f.process.entityID
+		}
+		if f.process.hasFileCaps {
+			process["executable_has_file_capabilities"] = true
+		}
+		if len(f.process.capabilities) > 0 {
+			process["capabilities"] = mapstr.M{
+				"effective": f.process.capabilities,
+			}
+		}
+		if f.process.namespacedPID != 0 {
+			process["namespaced_pid"] = int(f.process.namespacedPID)
+		}
+	}
+	return process
+}
+
+// putByteRates adds the average inbound and outbound byte rates of the flow,
+// computed over the same duration reported as event.duration. They are
+// omitted for flows whose duration is zero, and for a direction in which no
+// data was seen.
+func (f *flow) putByteRates(fields mapstr.M) error {
+	duration := f.lastSeenTime.Sub(f.createdTime)
+	if duration <= 0 {
+		return nil
+	}
+	secs := duration.Seconds()
+	for key, bytes := range map[string]uint64{
+		"network.inbound.bytes_per_second":  f.remote.bytes,
+		"network.outbound.bytes_per_second": f.local.bytes,
+	} {
+		if bytes == 0 {
+			continue
+		}
+		if _, err := fields.Put(key, float64(bytes)/secs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interimEvent returns a non-final event for a flow that's still active.
+func (s *state) interimEvent(f *flow) (mb.Event, error) {
+	ev, err := f.toEvent(false)
+	if err == nil {
+		err = s.putTupleHash(f, ev.RootFields)
+	}
+	if err != nil || !s.interimByteRates {
+		return ev, err
+	}
+	return ev, f.putByteRates(ev.RootFields)
+}
+
+// zeroWindowEvent returns the event sent when a flow has been in zero-window
+// for longer than the configured threshold. It's a non-final flow event with
+// its own action and the time spent in zero-window so far.
+func (s *state) zeroWindowEvent(f *flow) (mb.Event, error) {
+	ev, err := s.interimEvent(f)
+	if err != nil {
+		return ev, err
+	}
+	for key, value := range map[string]interface{}{
+		"event.action":                     "network_zero_window",
+		"network.tcp.zero_window_duration": f.tcp.zeroWindowLast.Sub(f.tcp.zeroWindowSince).Nanoseconds(),
+	} {
+		if _, err = ev.RootFields.Put(key, value); err != nil {
+			return ev, err
+		}
+	}
+	return ev, nil
+}
+
 func (s *state) SyncClocks(kernelNanos, userNanos uint64) error {
 	userTime := time.Unix(int64(time.Duration(userNanos)/time.Second), int64(time.Duration(userNanos)%time.Second))
 	bootTime := userTime.Add(-time.Duration(kernelNanos))
@@ -1048,6 +3013,9 @@ func (s *state) SyncClocks(kernelNanos, userNanos uint64) error {
 	if adjusted {
 		s.log.Debugf("adjusted internal clock drift=%s", drift)
 	}
+	if s.onClockSync != nil {
+		s.onClockSync(drift, adjusted)
+	}
 	return nil
 }
 
@@ -8,9 +8,11 @@ package socket
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -20,7 +22,9 @@ import (
 
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system"
 	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/quic"
 	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
 )
 
@@ -87,6 +91,50 @@ func makeTestingState(t *testing.T, inactiveTimeout, socketTimeout, closeTimeout
 	return ts
 }
 
+// Endpoints of the outbound TCP connection created by tcpConnectEvents.
+const (
+	testLocalIP            = "192.168.33.10"
+	testRemoteIP           = "172.19.12.13"
+	testLocalPort          = 38842
+	testRemotePort         = 443
+	testSock       uintptr = 0xff1234
+)
+
+// tcpConnectEvents returns the events for thread tid of process 1234
+// creating testSock at time created, and connecting it from
+// testLocalIP:testLocalPort to testRemoteIP:testRemotePort at time connected.
+func tcpConnectEvents(tid uint32, created, connected uint64) []event {
+	return []event{
+		&inetCreate{Meta: meta(1234, tid, created), Proto: 0},
+		&sockInitData{Meta: meta(1234, tid, created), Sock: testSock},
+		&tcpIPv4ConnectCall{
+			Meta:  meta(1234, tid, connected),
+			Sock:  testSock,
+			LAddr: ipv4(testLocalIP),
+			LPort: be16(testLocalPort),
+			RAddr: ipv4(testRemoteIP),
+			RPort: be16(testRemotePort),
+		},
+		&tcpConnectResult{Meta: meta(1234, tid, connected), Retval: 0},
+	}
+}
+
+func TestEntityID(t *testing.T) {
+	const hostID = "f0a8d5c0f3e74b2e9bb8c6c6e5f6a7b8"
+	start := time.Date(2019, 1, 1, 0, 0, 1, 0, time.UTC)
+	p := &process{pid: 1234, createdTime: start}
+	// Same PID, started at the same nanosecond within a different second.
+	restarted := &process{pid: 1234, createdTime: start.Add(time.Minute)}
+	other := &process{pid: 1235, createdTime: start}
+
+	assert.Equal(t, entityID(hostID, p), entityID(hostID, &process{pid: 1234, createdTime: start}))
+	assert.NotEqual(t, entityID(hostID, p), entityID(hostID, restarted))
+	assert.NotEqual(t, entityID(hostID, p), entityID(hostID, other))
+	assert.NotEqual(t, entityID(hostID, p), entityID("other-host", p))
+	// Same as the process dataset.
+	assert.Equal(t, system.ProcessEntityID(hostID, 1234, start), entityID(hostID, p))
+}
+
 func TestTCPConnWithProcess(t *testing.T) {
 	const (
 		localIP            = "192.168.33.10"
@@ -173,6 +221,109 @@ func TestTCPConnWithProcess(t *testing.T) {
 	}
 }
 
+// TestIPv6OnlyFlows checks that flows and DNS correlation don't depend on any
+// IPv4 event, as in IPv6-only mode.
+func TestIPv6OnlyFlows(t *testing.T) {
+	const (
+		udpSock uintptr = 0xff1000
+		tcpSock uintptr = 0xff2000
+	)
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	lAddrA, lAddrB := ipv6("fd00::10")
+	dnsAddrA, dnsAddrB := ipv6("fd00::53")
+	rAddrA, rAddrB := ipv6("2001:db8::80")
+	st.feedEvents([]event{
+		callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl", "https://example.net/"}),
+		&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+		&inetCreate{Meta: meta(1234, 1234, 3), Proto: 0},
+		&sockInitData{Meta: meta(1234, 1234, 3), Sock: udpSock},
+		&udpv6SendMsgCall{
+			Meta:   meta(1234, 1234, 4),
+			Sock:   udpSock,
+			Size:   40,
+			LAddrA: lAddrA,
+			LAddrB: lAddrB,
+			LPort:  be16(40000),
+			RAddrA: dnsAddrA,
+			RAddrB: dnsAddrB,
+			RPort:  be16(53),
+			SI6Ptr: 1,
+			SI6AF:  unix.AF_INET6,
+		},
+	})
+	if err := st.OnDNSTransaction(dns.Transaction{
+		TXID:      1234,
+		Client:    net.UDPAddr{IP: net.ParseIP("fd00::10"), Port: 40000},
+		Server:    net.UDPAddr{IP: net.ParseIP("fd00::53"), Port: 53},
+		Domain:    "example.net",
+		Addresses: []net.IP{net.ParseIP("2001:db8::80")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	st.feedEvents([]event{
+		&inetCreate{Meta: meta(1234, 1234, 5), Proto: 0},
+		&sockInitData{Meta: meta(1234, 1234, 5), Sock: tcpSock},
+		&tcpIPv6ConnectCall{
+			Meta:   meta(1234, 1234, 6),
+			Sock:   tcpSock,
+			LAddrA: lAddrA,
+			LAddrB: lAddrB,
+			LPort:  be16(38842),
+			RAddrA: rAddrA,
+			RAddrB: rAddrB,
+			RPort:  be16(443),
+		},
+		&tcpConnectResult{Meta: meta(1234, 1234, 7), Retval: 0},
+		&inet6CskXmitCall{
+			Meta:    meta(1234, 1234, 8),
+			Sock:    tcpSock,
+			LAddr6a: lAddrA,
+			LAddr6b: lAddrB,
+			LPort:   be16(38842),
+			RAddr6a: rAddrA,
+			RAddr6b: rAddrB,
+			RPort:   be16(443),
+			Size:    100,
+		},
+		&tcpV6DoRcv{
+			Meta:    meta(0, 0, 9),
+			Sock:    tcpSock,
+			LAddr6a: lAddrA,
+			LAddr6b: lAddrB,
+			LPort:   be16(38842),
+			RAddr6a: rAddrA,
+			RAddr6b: rAddrB,
+			RPort:   be16(443),
+			Size:    200,
+		},
+		&inetReleaseCall{Meta: meta(1234, 1234, 10), Sock: tcpSock},
+		&inetReleaseCall{Meta: meta(1234, 1234, 11), Sock: udpSock},
+	})
+	st.ExpireFlows()
+	flows := st.getFlows()
+	if !assert.Len(t, flows, 2) {
+		t.FailNow()
+	}
+	for _, flow := range flows {
+		assertValue(t, flow, "ipv6", "network.type")
+		assertValue(t, flow, "curl", "process.name")
+		transport, _ := flow.GetValue("network.transport")
+		if transport != "tcp" {
+			continue
+		}
+		for field, expected := range map[string]interface{}{
+			"source.ip":          "fd00::10",
+			"source.port":        38842,
+			"destination.ip":     "2001:db8::80",
+			"destination.port":   443,
+			"destination.domain": "example.net",
+			"destination.bytes":  uint64(200),
+		} {
+			assertValue(t, flow, expected, field)
+		}
+	}
+}
+
 func TestTCPConnWithProcessSocketTimeouts(t *testing.T) {
 	const (
 		localIP               = "192.168.33.10"
@@ -477,6 +628,1883 @@ func TestUDPIncomingSinglePacketWithProcess(t *testing.T) {
 	}
 }
 
+func TestForkInheritedSocketAttribution(t *testing.T) {
+	lPort, rPort := be16(testLocalPort), be16(testRemotePort)
+	lAddr, rAddr := ipv4(testLocalIP), ipv4(testRemoteIP)
+	sendMsg := func(pid uint32, ts uint64) *tcpSendMsgCall4 {
+		return &tcpSendMsgCall4{
+			Meta:  meta(pid, pid, ts),
+			Sock:  testSock,
+			Size:  10,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+			Af:    unix.AF_INET,
+		}
+	}
+	for _, tc := range []struct {
+		name    string
+		evs     []event
+		pid     int
+		process string
+	}{
+		{
+			name:    "parent only",
+			evs:     []event{sendMsg(1234, 10)},
+			pid:     1234,
+			process: "server",
+		},
+		{
+			name: "child after fork",
+			evs: []event{
+				&forkRet{Meta: meta(1234, 1234, 10), Retval: 1240},
+				sendMsg(1240, 11),
+			},
+			pid:     1240,
+			process: "server",
+		},
+		{
+			name: "child after fork and execve",
+			evs: []event{
+				&forkRet{Meta: meta(1234, 1234, 10), Retval: 1240},
+				callExecve(meta(1240, 1240, 11), []string{"/usr/bin/worker"}),
+				&execveRet{Meta: meta(1240, 1240, 12), Retval: 0},
+				sendMsg(1240, 13),
+			},
+			pid:     1240,
+			process: "worker",
+		},
+		{
+			name: "back to parent",
+			evs: []event{
+				&forkRet{Meta: meta(1234, 1234, 10), Retval: 1240},
+				sendMsg(1240, 11),
+				sendMsg(1234, 12),
+			},
+			pid:     1234,
+			process: "server",
+		},
+		{
+			name: "unrelated process",
+			evs: []event{
+				&forkRet{Meta: meta(1234, 1234, 10), Retval: 1240},
+				sendMsg(999, 11),
+			},
+			pid:     1234,
+			process: "server",
+		},
+		{
+			name: "child PID reused after exit",
+			evs: []event{
+				&forkRet{Meta: meta(1234, 1234, 10), Retval: 1240},
+				&doExit{Meta: meta(1240, 1240, 11)},
+				sendMsg(1240, 12),
+			},
+			pid:     1234,
+			process: "server",
+		},
+		{
+			name: "forked before socket creation",
+			evs: []event{
+				&forkRet{Meta: meta(1, 1, 0), Retval: 1240},
+				sendMsg(1240, 11),
+			},
+			pid:     1234,
+			process: "server",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			st.feedEvents([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/sbin/server"}),
+				&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+			})
+			st.feedEvents(tcpConnectEvents(1234, 5, 8))
+			st.feedEvents(tc.evs)
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1234, 20), Sock: testSock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			assertValue(t, flows[0], tc.pid, "process.pid")
+			assertValue(t, flows[0], tc.process, "process.name")
+		})
+	}
+}
+
+func TestFlowProcessAttribution(t *testing.T) {
+	for _, tc := range []struct {
+		policy  string
+		pid     int
+		process string
+	}{
+		{attributionActive, 1240, "worker"},
+		{attributionFirstSeen, 1234, "server"},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withProcessAttribution(tc.policy)(&st.state)
+			st.feedEvents([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/sbin/server"}),
+				&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+			})
+			st.feedEvents(tcpConnectEvents(1234, 5, 8))
+			st.feedEvents([]event{
+				&forkRet{Meta: meta(1234, 1234, 10), Retval: 1240},
+				callExecve(meta(1240, 1240, 11), []string{"/usr/bin/worker"}),
+				&execveRet{Meta: meta(1240, 1240, 12), Retval: 0},
+				&tcpSendMsgCall4{
+					Meta:  meta(1240, 1240, 13),
+					Sock:  testSock,
+					Size:  10,
+					LAddr: ipv4(testLocalIP),
+					LPort: be16(testLocalPort),
+					RAddr: ipv4(testRemoteIP),
+					RPort: be16(testRemotePort),
+					Af:    unix.AF_INET,
+				},
+			})
+			// The socket is only handed to the worker when following the
+			// active process.
+			if sock := st.socks[testSock]; assert.NotNil(t, sock) {
+				assert.EqualValues(t, tc.pid, sock.pid)
+			}
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1240, 1240, 20), Sock: testSock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			assertValue(t, flows[0], tc.pid, "process.pid")
+			assertValue(t, flows[0], tc.process, "process.name")
+		})
+	}
+}
+
+func TestProcessCapabilities(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		caps []string
+		err  error
+	}{
+		{"readable", []string{"net_admin", "net_raw"}, nil},
+		{"empty", []string{}, nil},
+		{"unreadable", nil, errors.New("permission denied")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withProcessCapabilities(true)(&st.state)
+			reads := 0
+			st.readProcStatus = func(pid uint32) (procStatus, error) {
+				reads++
+				assert.EqualValues(t, 1234, pid)
+				return procStatus{capabilities: tc.caps}, tc.err
+			}
+			st.feedEvents([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/bin/ping"}),
+				&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+			})
+			st.feedEvents(tcpConnectEvents(1234, 5, 8))
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1234, 20), Sock: testSock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			assert.Equal(t, 1, reads)
+			assertValue(t, flows[0], "ping", "process.name")
+			if len(tc.caps) == 0 {
+				_, err := flows[0].GetValue("process.capabilities")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], tc.caps, "process.capabilities.effective")
+		})
+	}
+}
+
+func TestNamespacedPID(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		pid  uint32
+		err  error
+	}{
+		{"namespaced", 7, nil},
+		{"host namespace", 0, nil},
+		{"unreadable", 0, errors.New("no such file or directory")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withNamespacedPIDs(true)(&st.state)
+			st.readProcStatus = func(pid uint32) (procStatus, error) {
+				assert.EqualValues(t, 1234, pid)
+				return procStatus{namespacedPID: tc.pid}, tc.err
+			}
+			st.feedEvents([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/sbin/nginx"}),
+				&execveRet{Meta: meta(1234, 1234, 2), Retval: 0},
+			})
+			st.feedEvents(tcpConnectEvents(1234, 5, 8))
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1234, 20), Sock: testSock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			assertValue(t, flows[0], 1234, "process.pid")
+			if tc.pid == 0 {
+				_, err := flows[0].GetValue("process.namespaced_pid")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], int(tc.pid), "process.namespaced_pid")
+		})
+	}
+}
+
+func TestProcessStart(t *testing.T) {
+	t.Run("forked", func(t *testing.T) {
+		st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+		started := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+		st.CreateProcess(&process{pid: 1000, name: "bash", createdTime: started, startTime: started})
+		st.feedEvents([]event{
+			&forkRet{Meta: meta(1000, 1000, 1), Retval: 1234},
+			callExecve(meta(1234, 1234, 3), []string{"/usr/bin/curl"}),
+			&execveRet{Meta: meta(1234, 1234, 4), Retval: 0},
+		})
+		st.feedEvents(tcpConnectEvents(1234, 5, 8))
+		st.feedEvents([]event{
+			&inetReleaseCall{Meta: meta(1234, 1234, 20), Sock: testSock},
+		})
+		st.ExpireFlows()
+		flows := st.getFlows()
+		if !assert.Len(t, flows, 1) {
+			t.FailNow()
+		}
+		// The start time is the fork's, the creation time is the execve's.
+		assertValue(t, flows[0], "curl", "process.name")
+		assertValue(t, flows[0], st.kernTimestampToTime(1), "process.start")
+		assertValue(t, flows[0], st.kernTimestampToTime(3), "process.created")
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+		st.feedEvents([]event{
+			callExecve(meta(1234, 1234, 3), []string{"/usr/bin/curl"}),
+			&execveRet{Meta: meta(1234, 1234, 4), Retval: 0},
+		})
+		st.feedEvents(tcpConnectEvents(1234, 5, 8))
+		st.feedEvents([]event{
+			&inetReleaseCall{Meta: meta(1234, 1234, 20), Sock: testSock},
+		})
+		st.ExpireFlows()
+		flows := st.getFlows()
+		if !assert.Len(t, flows, 1) {
+			t.FailNow()
+		}
+		_, err := flows[0].GetValue("process.start")
+		assert.Error(t, err)
+	})
+}
+
+func TestNetworkZones(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		zones    map[string][]string
+		src, dst string
+	}{
+		{"cross zone", map[string][]string{"dev": {"192.168.0.0/16"}, "prod": {"172.16.0.0/12"}}, "dev", "prod"},
+		{"same zone", map[string][]string{"internal": {"192.168.0.0/16", "172.16.0.0/12"}}, "internal", "internal"},
+		{"unknown destination", map[string][]string{"dev": {"192.168.0.0/16"}}, "dev", unknownZone},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			zones, err := newZoneClassifier(tc.zones)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withNetworkZones(zones)(&st.state)
+			st.feedEvents(tcpConnectEvents(1234, 5, 8))
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1234, 20), Sock: testSock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			assertValue(t, flows[0], tc.src, "network.source.zone")
+			assertValue(t, flows[0], tc.dst, "network.destination.zone")
+			if tc.src == tc.dst {
+				_, err := flows[0].GetValue("network.cross_zone")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], true, "network.cross_zone")
+		})
+	}
+}
+
+func TestHalfOpenFlowTuple(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	for _, tc := range []struct {
+		name     string
+		evs      []event
+		complete bool
+	}{
+		{
+			name: "no response to SYN",
+			evs: []event{
+				&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+				&ipLocalOutCall{
+					Meta:  meta(1234, 1235, 8),
+					Sock:  sock,
+					Size:  20,
+					LAddr: lAddr,
+					LPort: lPort,
+					RAddr: rAddr,
+					RPort: rPort,
+				},
+				&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+			},
+			complete: true,
+		},
+		{
+			name: "failed connect",
+			evs: []event{
+				&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+				&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: -int32(unix.ENETUNREACH)},
+			},
+			complete: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			// Needed for failed connects to be reported.
+			withReportEmptyFlows(true)(&st.state)
+			st.feedEvents(append([]event{
+				&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+				&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock},
+			}, tc.evs...))
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			flow := flows[0]
+			assertValue(t, flow, remoteIP, "destination.ip")
+			assertValue(t, flow, remotePort, "destination.port")
+			// Only incomplete tuples are marked.
+			if tc.complete {
+				hasTuple, _ := flow.Fields.HasKey("network.tuple")
+				assert.False(t, hasTuple)
+			} else {
+				assertValue(t, flow, false, "network.tuple.complete")
+			}
+			hasSource, _ := flow.Fields.HasKey("source.port")
+			hasCommunityID, _ := flow.Fields.HasKey("network.community_id")
+			assert.Equal(t, tc.complete, hasSource)
+			assert.Equal(t, tc.complete, hasCommunityID)
+		})
+	}
+}
+
+func TestReportEmptyFlows(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	failedConnect := []event{
+		&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+		&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: -int32(unix.EHOSTUNREACH)},
+	}
+	withData := []event{
+		&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+		&ipLocalOutCall{
+			Meta:  meta(1234, 1235, 8),
+			Sock:  sock,
+			Size:  20,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+		},
+		&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+	}
+	for _, tc := range []struct {
+		name     string
+		evs      []event
+		enabled  bool
+		reported bool
+		empty    bool
+	}{
+		{"empty", failedConnect, true, true, true},
+		{"with data", withData, true, true, false},
+		{"disabled", failedConnect, false, false, false},
+		{"with data disabled", withData, false, true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withReportEmptyFlows(tc.enabled)(&st.state)
+			st.feedEvents(append([]event{
+				&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+				&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock},
+			}, tc.evs...))
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !tc.reported {
+				// Failed connects are only reported with empty flows.
+				assert.Empty(t, flows)
+				return
+			}
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			if !tc.empty {
+				_, err := flows[0].GetValue("flow.empty")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], true, "flow.empty")
+			assertValue(t, flows[0], remoteIP, "destination.ip")
+		})
+	}
+}
+
+func TestMinFlowBytes(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	failedConnect := []event{
+		&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+		&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: -int32(unix.EHOSTUNREACH)},
+	}
+	// Transfers 20 bytes.
+	withData := []event{
+		&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+		&ipLocalOutCall{
+			Meta:  meta(1234, 1235, 8),
+			Sock:  sock,
+			Size:  20,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+		},
+		&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+	}
+	withReset := append(withData[:len(withData):len(withData)],
+		&tcpReset{Meta: meta(1234, 1235, 10), Sock: sock})
+	for _, tc := range []struct {
+		name       string
+		evs        []event
+		minBytes   uint64
+		emptyFlows bool
+		reported   bool
+	}{
+		{"disabled", withData, 0, false, true},
+		{"below", withData, 21, false, false},
+		{"at threshold", withData, 20, false, true},
+		{"reset", withReset, 21, false, true},
+		{"empty", failedConnect, 21, true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withMinFlowBytes(tc.minBytes)(&st.state)
+			withReportEmptyFlows(tc.emptyFlows)(&st.state)
+			st.feedEvents(append([]event{
+				&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+				&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock},
+			}, tc.evs...))
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !tc.reported {
+				assert.Empty(t, flows)
+				return
+			}
+			if assert.Len(t, flows, 1) {
+				assertValue(t, flows[0], remoteIP, "destination.ip")
+			}
+		})
+	}
+}
+
+func TestTCPFastOpen(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	connect := []event{
+		&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+		&ipLocalOutCall{
+			Meta:  meta(1234, 1235, 8),
+			Sock:  sock,
+			Size:  20,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+		},
+		&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+	}
+	accept := []event{
+		&tcpAcceptResult4{
+			Meta:  meta(1234, 1235, 8),
+			Sock:  sock,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+			Af:    unix.AF_INET,
+		},
+		&tcpV4DoRcv{
+			Meta:  meta(0, 0, 9),
+			Sock:  sock,
+			Size:  12,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+		},
+	}
+	for _, tc := range []struct {
+		name     string
+		evs      []event
+		fastOpen bool
+	}{
+		{
+			name:     "connect",
+			evs:      append([]event{}, connect...),
+			fastOpen: false,
+		},
+		{
+			name: "connect with fast open",
+			evs: append([]event{
+				&tcpFastOpen{Meta: meta(1234, 1235, 7), Sock: sock},
+			}, connect...),
+			fastOpen: true,
+		},
+		{
+			name:     "accept",
+			evs:      append([]event{}, accept...),
+			fastOpen: false,
+		},
+		{
+			name: "accept with fast open",
+			evs: append([]event{
+				&tcpFastOpen{Meta: meta(0, 0, 7), Sock: sock},
+			}, accept...),
+			fastOpen: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			st.feedEvents(append([]event{
+				&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+				&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock},
+			}, tc.evs...))
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			if tc.fastOpen {
+				assertValue(t, flows[0], true, "network.tcp.fast_open")
+			} else {
+				hasKey, _ := flows[0].Fields.HasKey("network.tcp.fast_open")
+				assert.False(t, hasKey)
+			}
+		})
+	}
+}
+
+func TestTCPTimestamps(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	connect := []event{
+		&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+		&ipLocalOutCall{
+			Meta:  meta(1234, 1235, 8),
+			Sock:  sock,
+			Size:  20,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+		},
+		&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+	}
+	accept := []event{
+		&tcpAcceptResult4{
+			Meta:  meta(1234, 1235, 8),
+			Sock:  sock,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+			Af:    unix.AF_INET,
+		},
+	}
+	for _, tc := range []struct {
+		name     string
+		evs      []event
+		expected interface{}
+	}{
+		{
+			name: "unknown",
+			evs:  append([]event{}, connect...),
+		},
+		{
+			name: "connect with timestamps",
+			evs: append(append([]event{}, connect...),
+				&tcpInitTransfer{Meta: meta(1234, 1235, 10), Sock: sock, RxOpt: 0x7a},
+			),
+			expected: true,
+		},
+		{
+			name: "connect without timestamps",
+			evs: append(append([]event{}, connect...),
+				&tcpInitTransfer{Meta: meta(1234, 1235, 10), Sock: sock, RxOpt: 0x78},
+			),
+			expected: false,
+		},
+		{
+			name: "accept with timestamps",
+			evs: append([]event{
+				&tcpInitTransfer{Meta: meta(0, 0, 7), Sock: sock, RxOpt: 0x0a},
+			}, accept...),
+			expected: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			st.feedEvents(append([]event{
+				&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+				&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock},
+			}, tc.evs...))
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			if tc.expected != nil {
+				assertValue(t, flows[0], tc.expected, "network.tcp.timestamps_enabled")
+			} else {
+				hasKey, _ := flows[0].Fields.HasKey("network.tcp.timestamps_enabled")
+				assert.False(t, hasKey)
+			}
+		})
+	}
+}
+
+func TestSocketInode(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+		inode              = 734812
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	for _, tc := range []struct {
+		name     string
+		evs      []event
+		expected interface{}
+	}{
+		{
+			name: "unknown",
+			evs: []event{
+				&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+				&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock},
+				&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+				&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+			},
+		},
+		{
+			name: "connect",
+			evs: []event{
+				&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+				&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock, Inode: inode},
+				&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+				&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+			},
+			expected: uint64(inode),
+		},
+		{
+			name: "accept",
+			evs: []event{
+				&tcpAcceptResult4{
+					Meta:  meta(1234, 1235, 8),
+					Sock:  sock,
+					LAddr: lAddr,
+					LPort: lPort,
+					RAddr: rAddr,
+					RPort: rPort,
+					Af:    unix.AF_INET,
+				},
+				&sockGraft{Meta: meta(1234, 1235, 9), Sock: sock, Inode: inode},
+			},
+			expected: uint64(inode),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			st.feedEvents(append(tc.evs,
+				&ipLocalOutCall{
+					Meta:  meta(1234, 1235, 10),
+					Sock:  sock,
+					Size:  20,
+					LAddr: lAddr,
+					LPort: lPort,
+					RAddr: rAddr,
+					RPort: rPort,
+				},
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock},
+			))
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			if tc.expected != nil {
+				assertValue(t, flows[0], tc.expected, "network.socket.inode")
+			} else {
+				hasKey, _ := flows[0].Fields.HasKey("network.socket.inode")
+				assert.False(t, hasKey)
+			}
+		})
+	}
+}
+
+func TestAcceptListenAddress(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 22
+		remotePort         = 38842
+		listen     uintptr = 0xff0000
+		sock       uintptr = 0xff1234
+		wildcard4          = "0.0.0.0"
+		wildcard6          = "::"
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	for _, tc := range []struct {
+		name     string
+		call     event
+		expected string
+	}{
+		{
+			name: "no call",
+		},
+		{
+			name:     "wildcard",
+			call:     &tcpAcceptCall4{Meta: meta(1234, 1235, 7), Sock: listen, LPort: lPort, Af: unix.AF_INET},
+			expected: wildcard4,
+		},
+		{
+			name:     "specific",
+			call:     &tcpAcceptCall4{Meta: meta(1234, 1235, 7), Sock: listen, LAddr: lAddr, LPort: lPort, Af: unix.AF_INET},
+			expected: localIP,
+		},
+		{
+			name:     "IPv6 wildcard",
+			call:     &tcpAcceptCall{Meta: meta(1234, 1235, 7), Sock: listen, LPort: lPort, Af: unix.AF_INET6},
+			expected: wildcard6,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			var evs []event
+			if tc.call != nil {
+				evs = append(evs, tc.call)
+			}
+			evs = append(evs,
+				&tcpAcceptResult4{
+					Meta:  meta(1234, 1235, 8),
+					Sock:  sock,
+					LAddr: lAddr,
+					LPort: lPort,
+					RAddr: rAddr,
+					RPort: rPort,
+					Af:    unix.AF_INET,
+				},
+				&tcpV4DoRcv{
+					Meta:  meta(0, 0, 9),
+					Sock:  sock,
+					Size:  12,
+					LAddr: lAddr,
+					LPort: lPort,
+					RAddr: rAddr,
+					RPort: rPort,
+				},
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock},
+			)
+			st.feedEvents(evs)
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			assert.Empty(t, st.threads)
+			assertValue(t, flows[0], localIP, "destination.ip")
+			if tc.expected == "" {
+				_, err := flows[0].GetValue("network.local.listen_address")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], tc.expected, "network.local.listen_address")
+		})
+	}
+}
+
+func TestSocketFamilyAndType(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localIP6           = "fd00::10"
+		remoteIP6          = "2001:db8::80"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	lAddrA, lAddrB := ipv6(localIP6)
+	rAddrA, rAddrB := ipv6(remoteIP6)
+	created := func(call event, evs ...event) []event {
+		return append([]event{call, &sockInitData{Meta: meta(1234, 1235, 5), Sock: sock}}, evs...)
+	}
+	tcp4 := func(ts uint64) []event {
+		return []event{
+			&tcpIPv4ConnectCall{Meta: meta(1234, 1235, ts), Sock: sock, RAddr: rAddr, RPort: rPort},
+			&ipLocalOutCall{Meta: meta(1234, 1235, ts), Sock: sock, Size: 20, LAddr: lAddr, LPort: lPort, RAddr: rAddr, RPort: rPort},
+			&tcpConnectResult{Meta: meta(1234, 1235, ts), Retval: 0},
+		}
+	}
+	udp4 := &udpSendMsgCall{Meta: meta(1234, 1235, 6), Sock: sock, Size: 20, LAddr: lAddr, AltRAddr: rAddr, LPort: lPort, AltRPort: rPort}
+	for _, tc := range []struct {
+		name           string
+		evs            []event
+		family, sockTy string
+	}{
+		{
+			name:   "IPv4 stream",
+			evs:    created(&inetCreate{Meta: meta(1234, 1235, 5), Type: unix.SOCK_STREAM}, tcp4(6)...),
+			family: "AF_INET",
+			sockTy: "SOCK_STREAM",
+		},
+		{
+			name:   "IPv4 datagram",
+			evs:    created(&inetCreate{Meta: meta(1234, 1235, 5), Type: unix.SOCK_DGRAM}, udp4),
+			family: "AF_INET",
+			sockTy: "SOCK_DGRAM",
+		},
+		{
+			name:   "IPv4 raw",
+			evs:    created(&inetCreate{Meta: meta(1234, 1235, 5), Proto: unix.IPPROTO_TCP, Type: unix.SOCK_RAW}, tcp4(6)...),
+			family: "AF_INET",
+			sockTy: "SOCK_RAW",
+		},
+		{
+			name: "IPv6 stream",
+			evs: created(&inet6Create{Meta: meta(1234, 1235, 5), Type: unix.SOCK_STREAM},
+				&tcpIPv6ConnectCall{Meta: meta(1234, 1235, 6), Sock: sock, LAddrA: lAddrA, LAddrB: lAddrB, LPort: lPort, RAddrA: rAddrA, RAddrB: rAddrB, RPort: rPort},
+				&tcpConnectResult{Meta: meta(1234, 1235, 7), Retval: 0},
+				&inet6CskXmitCall{Meta: meta(1234, 1235, 8), Sock: sock, LAddr6a: lAddrA, LAddr6b: lAddrB, LPort: lPort, RAddr6a: rAddrA, RAddr6b: rAddrB, RPort: rPort, Size: 20},
+			),
+			family: "AF_INET6",
+			sockTy: "SOCK_STREAM",
+		},
+		{
+			name: "IPv6 datagram",
+			evs: created(&inet6Create{Meta: meta(1234, 1235, 5), Type: unix.SOCK_DGRAM},
+				&udpv6SendMsgCall{Meta: meta(1234, 1235, 6), Sock: sock, Size: 20, LAddrA: lAddrA, LAddrB: lAddrB, LPort: lPort, RAddrA: rAddrA, RAddrB: rAddrB, RPort: rPort, SI6Ptr: 1, SI6AF: unix.AF_INET6},
+			),
+			family: "AF_INET6",
+			sockTy: "SOCK_DGRAM",
+		},
+		{
+			name: "IPv4 accepted",
+			evs: []event{
+				&tcpAcceptResult4{Meta: meta(1234, 1235, 5), Sock: sock, LAddr: lAddr, LPort: lPort, RAddr: rAddr, RPort: rPort, Af: unix.AF_INET},
+				&tcpV4DoRcv{Meta: meta(0, 0, 6), Sock: sock, Size: 20, LAddr: lAddr, LPort: lPort, RAddr: rAddr, RPort: rPort},
+			},
+			family: "AF_INET",
+			sockTy: "SOCK_STREAM",
+		},
+		{
+			name: "IPv6 accepted",
+			evs: []event{
+				&tcpAcceptResult{Meta: meta(1234, 1235, 5), Sock: sock, LAddr6a: lAddrA, LAddr6b: lAddrB, LPort: lPort, RAddr6a: rAddrA, RAddr6b: rAddrB, RPort: rPort, Af: unix.AF_INET6},
+				&tcpV6DoRcv{Meta: meta(0, 0, 6), Sock: sock, Size: 20, LAddr6a: lAddrA, LAddr6b: lAddrB, LPort: lPort, RAddr6a: rAddrA, RAddr6b: rAddrB, RPort: rPort},
+			},
+			family: "AF_INET6",
+			sockTy: "SOCK_STREAM",
+		},
+		{
+			name: "unknown type",
+			evs:  created(&inetCreate{Meta: meta(1234, 1235, 5)}, udp4),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			evs := append(tc.evs, &inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock})
+			st.feedEvents(evs)
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			if tc.sockTy == "" {
+				for _, field := range []string{"network.socket.family", "network.socket.type"} {
+					_, err := flows[0].GetValue(field)
+					assert.Error(t, err, field)
+				}
+				return
+			}
+			assertValue(t, flows[0], tc.family, "network.socket.family")
+			assertValue(t, flows[0], tc.sockTy, "network.socket.type")
+		})
+	}
+}
+
+func TestFlowInitiatedLocally(t *testing.T) {
+	const (
+		localIP          = "192.168.33.10"
+		remoteIP         = "172.19.12.13"
+		sock     uintptr = 0xff1234
+	)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	for _, tc := range []struct {
+		name     string
+		evs      []event
+		expected interface{}
+	}{
+		{
+			name: "connect",
+			evs: []event{
+				&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: be16(443)},
+				&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+				&tcpV4DoRcv{
+					Meta:  meta(0, 0, 12),
+					Sock:  sock,
+					Size:  12,
+					LAddr: lAddr,
+					LPort: be16(38842),
+					RAddr: rAddr,
+					RPort: be16(443),
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "accept",
+			evs: []event{
+				&tcpAcceptResult4{
+					Meta:  meta(1234, 1235, 8),
+					Sock:  sock,
+					LAddr: lAddr,
+					LPort: be16(22),
+					RAddr: rAddr,
+					RPort: be16(38842),
+					Af:    unix.AF_INET,
+				},
+				&tcpV4DoRcv{
+					Meta:  meta(0, 0, 9),
+					Sock:  sock,
+					Size:  12,
+					LAddr: lAddr,
+					LPort: be16(22),
+					RAddr: rAddr,
+					RPort: be16(38842),
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "unknown",
+			evs: []event{
+				&tcpV4DoRcv{
+					Meta:  meta(0, 0, 9),
+					Sock:  sock,
+					Size:  12,
+					LAddr: lAddr,
+					LPort: be16(22),
+					RAddr: rAddr,
+					RPort: be16(38842),
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			st.feedEvents(append(tc.evs, &inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock}))
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			if tc.expected == nil {
+				_, err := flows[0].GetValue("network.initiated_locally")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], tc.expected, "network.initiated_locally")
+		})
+	}
+}
+
+func TestFlowDirectionActivity(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 443
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	send := func(ts uint64) event {
+		return &ipLocalOutCall{
+			Meta:  meta(1234, 1235, ts),
+			Sock:  sock,
+			Size:  20,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+		}
+	}
+	recv := func(ts uint64) event {
+		return &tcpV4DoRcv{
+			Meta:  meta(0, 0, ts),
+			Sock:  sock,
+			Size:  12,
+			LAddr: lAddr,
+			LPort: lPort,
+			RAddr: rAddr,
+			RPort: rPort,
+		}
+	}
+	for _, tc := range []struct {
+		name              string
+		evs               []event
+		inbound, outbound []uint64
+	}{
+		{
+			name:     "bidirectional",
+			evs:      []event{send(10), send(11), recv(12), recv(17)},
+			outbound: []uint64{10, 11},
+			inbound:  []uint64{12, 17},
+		},
+		{
+			name:     "no reply",
+			evs:      []event{send(10), send(11), send(14)},
+			outbound: []uint64{10, 14},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			st.feedEvents(append([]event{
+				&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+				&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock},
+				&tcpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+				&tcpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+			}, append(tc.evs, &inetReleaseCall{Meta: meta(1234, 1235, 20), Sock: sock})...))
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			flow := flows[0]
+			start, err := flow.GetValue("event.start")
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			// The flow starts with the connect call at timestamp 8.
+			at := func(ts uint64) time.Time {
+				return start.(time.Time).Add(time.Duration(ts - 8))
+			}
+			for dir, expected := range map[string][]uint64{
+				"inbound":  tc.inbound,
+				"outbound": tc.outbound,
+			} {
+				if expected == nil {
+					hasField, _ := flow.Fields.HasKey("network." + dir)
+					assert.False(t, hasField, dir)
+					continue
+				}
+				assertValue(t, flow, at(expected[0]), "network."+dir+".first_seen")
+				assertValue(t, flow, at(expected[1]), "network."+dir+".last_seen")
+			}
+		})
+	}
+}
+
+func TestSCTPAssociation(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 3868
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	for _, tc := range []struct {
+		name      string
+		evs       []event
+		direction string
+		client    string
+	}{
+		{
+			name: "connect",
+			evs: []event{
+				&sctpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, LAddr: lAddr, LPort: lPort, RAddr: rAddr, RPort: rPort},
+				&sctpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+			},
+			direction: "egress",
+			client:    localIP,
+		},
+		{
+			name: "accept",
+			evs: []event{
+				&sctpAcceptResult4{Meta: meta(1234, 1235, 9), Sock: sock, LAddr: lAddr, LPort: rPort, RAddr: rAddr, RPort: lPort, Af: unix.AF_INET},
+			},
+			direction: "ingress",
+			client:    remoteIP,
+		},
+	} {
+		for _, enabled := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s enabled=%v", tc.name, enabled), func(t *testing.T) {
+				st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+				withSCTP(enabled)(&st.state)
+				st.feedEvents(append([]event{
+					callExecve(meta(1234, 1234, 1), []string{"/usr/sbin/freeDiameterd"}),
+					&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+				}, tc.evs...))
+				st.feedEvents([]event{
+					// SCTP packets are also seen by the generic probes.
+					&ipLocalOutCall{
+						Meta:  meta(1234, 1235, 10),
+						Sock:  sock,
+						Size:  20,
+						LAddr: lAddr,
+						LPort: lPort,
+						RAddr: rAddr,
+						RPort: rPort,
+					},
+					&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock},
+				})
+				st.ExpireFlows()
+				flows := st.getFlows()
+				if !enabled {
+					assert.Empty(t, flows)
+					return
+				}
+				if !assert.Len(t, flows, 1) {
+					t.FailNow()
+				}
+				flow := flows[0]
+				assertValue(t, flow, "sctp", "network.transport")
+				assertValue(t, flow, tc.direction, "network.direction")
+				assertValue(t, flow, tc.client, "client.ip")
+				assertValue(t, flow, remotePort, "destination.port")
+				assertValue(t, flow, "freeDiameterd", "process.name")
+				assert.Empty(t, st.sctp)
+			})
+		}
+	}
+}
+
+func TestSCTPAssociationDetails(t *testing.T) {
+	const (
+		localIP            = "192.168.33.10"
+		remoteIP           = "172.19.12.13"
+		localPort          = 38842
+		remotePort         = 3868
+		sock       uintptr = 0xff1234
+	)
+	lPort, rPort := be16(localPort), be16(remotePort)
+	lAddr, rAddr := ipv4(localIP), ipv4(remoteIP)
+	for _, tc := range []struct {
+		name  string
+		freed bool
+	}{
+		{name: "freed after release", freed: true},
+		{name: "never freed", freed: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Minute, time.Second, time.Second)
+			withSCTP(true)(&st.state)
+			withSCTPDetails(true)(&st.state)
+			now := time.Now()
+			st.clock = func() time.Time { return now }
+			st.feedEvents([]event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/sbin/freeDiameterd"}),
+				&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+				// connect on an unbound socket.
+				&sctpIPv4ConnectCall{Meta: meta(1234, 1235, 8), Sock: sock, RAddr: rAddr, RPort: rPort},
+				&sctpConnectResult{Meta: meta(1234, 1235, 9), Retval: 0},
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: sock},
+			})
+			st.ExpireFlows()
+			assert.Empty(t, st.getFlows(), "association reported before it's freed")
+
+			if tc.freed {
+				st.feedEvents([]event{
+					&sctpAssociationFree{
+						Meta:     meta(1234, 1235, 20),
+						Sock:     sock,
+						MyVTag:   0x1f2e3d4c,
+						PeerVTag: 0x5a6b7c8d,
+						OStreams: 10,
+						IStreams: 5,
+						LAddr:    lAddr,
+						LPort:    lPort,
+					},
+				})
+			} else {
+				now = now.Add(2 * time.Second)
+				st.ExpireFlows()
+			}
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			flow := flows[0]
+			assertValue(t, flow, "sctp", "network.transport")
+			assertValue(t, flow, remotePort, "destination.port")
+			if !tc.freed {
+				_, err := flow.GetValue("network.sctp")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flow, localIP, "source.ip")
+			assertValue(t, flow, localPort, "source.port")
+			assertValue(t, flow, uint32(0x1f2e3d4c), "network.sctp.verification_tag.local")
+			assertValue(t, flow, uint32(0x5a6b7c8d), "network.sctp.verification_tag.remote")
+			assertValue(t, flow, uint16(10), "network.sctp.streams.outbound")
+			assertValue(t, flow, uint16(5), "network.sctp.streams.inbound")
+			assert.Empty(t, st.sctp)
+		})
+	}
+}
+
+func TestTCPCloseRTT(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		hz       int
+		expected bool
+	}{
+		{"with HZ", 250, true},
+		{"without HZ", 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			st.kernelHZ = tc.hz
+			st.feedEvents(tcpConnectEvents(1235, 5, 8))
+			st.feedEvents([]event{
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: testSock},
+				&tcpCloseCall{Meta: meta(1234, 1235, 15), Sock: testSock, SRTT: 8 * 1500, RTO: 51, fields: tcpCloseRTT},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			if !tc.expected {
+				_, err := flows[0].GetValue("network.tcp")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], uint32(1500), "network.tcp.srtt_us")
+			assertValue(t, flows[0], uint32(204000), "network.tcp.rto_us")
+		})
+	}
+}
+
+func TestTCPCloseDSACKDups(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		closed bool
+	}{
+		{"closed", true},
+		{"not closed", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			evs := append(tcpConnectEvents(1235, 5, 8),
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: testSock})
+			if tc.closed {
+				evs = append(evs, &tcpCloseCall{Meta: meta(1234, 1235, 15), Sock: testSock, DSACK: 3, fields: tcpCloseDSACKDups})
+			}
+			st.feedEvents(evs)
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			if !tc.closed {
+				_, err := flows[0].GetValue("network.tcp.dsack_dups")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], uint32(3), "network.tcp.dsack_dups")
+		})
+	}
+}
+
+func TestTCPCloseBuffers(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		fields tcpCloseFields
+	}{
+		{"resolved", tcpCloseBuffers},
+		{"unresolved", tcpCloseDSACKDups},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			st.feedEvents(append(tcpConnectEvents(1235, 5, 8),
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: testSock},
+				&tcpCloseCall{Meta: meta(1234, 1235, 15), Sock: testSock, SndBuf: 87040, RcvBuf: 131072, fields: tc.fields}))
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			if tc.fields&tcpCloseBuffers == 0 {
+				_, err := flows[0].GetValue("network.socket")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], uint32(87040), "network.socket.send_buffer_bytes")
+			assertValue(t, flows[0], uint32(131072), "network.socket.receive_buffer_bytes")
+		})
+	}
+}
+
+func TestTCPCloseCwnd(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		fields tcpCloseFields
+	}{
+		{"resolved", tcpCloseCwnd},
+		{"unresolved", tcpCloseBuffers},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			st.feedEvents(append(tcpConnectEvents(1235, 5, 8),
+				&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: testSock},
+				&tcpCloseCall{Meta: meta(1234, 1235, 15), Sock: testSock, Cwnd: 42, fields: tc.fields}))
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			if tc.fields&tcpCloseCwnd == 0 {
+				_, err := flows[0].GetValue("network.tcp.congestion_window")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], uint32(42), "network.tcp.congestion_window")
+		})
+	}
+}
+
+func TestTCPCloseInitiator(t *testing.T) {
+	fin := func(ts uint64, sent bool, state uint8) event {
+		return &tcpFin{Meta: meta(1234, 1235, ts), Sock: testSock, State: state, sent: sent}
+	}
+	reset := func(ts uint64, sent bool) event {
+		return &tcpReset{Meta: meta(1234, 1235, ts), Sock: testSock, sent: sent}
+	}
+	for _, tc := range []struct {
+		name     string
+		disabled bool
+		evs      []event
+		// empty when the field isn't expected.
+		closedBy string
+	}{
+		{"local", false, []event{fin(10, true, tcpStateFinWait1), fin(11, false, 5 /* FIN_WAIT2 */)}, closedByLocal},
+		{"remote", false, []event{fin(10, false, 1 /* ESTABLISHED */), fin(11, true, tcpStateLastAck)}, closedByRemote},
+		{"remote fin missed", false, []event{fin(11, true, tcpStateLastAck)}, closedByRemote},
+		{"simultaneous", false, []event{fin(10, true, tcpStateFinWait1), fin(11, false, tcpStateFinWait1)}, ""},
+		{"reset sent", false, []event{reset(10, true)}, closedByLocal},
+		{"reset received", false, []event{reset(10, false)}, closedByRemote},
+		{"reset after fin", false, []event{fin(10, false, 1 /* ESTABLISHED */), reset(11, true)}, closedByRemote},
+		{"none", false, nil, ""},
+		{"disabled", true, []event{fin(10, true, tcpStateFinWait1), reset(11, false)}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withCloseInitiator(!tc.disabled)(&st.state)
+			evs := append(tcpConnectEvents(1235, 5, 8), tc.evs...)
+			st.feedEvents(append(evs, &inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: testSock}))
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			if tc.closedBy == "" {
+				_, err := flows[0].GetValue("network.tcp.closed_by")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], tc.closedBy, "network.tcp.closed_by")
+		})
+	}
+}
+
+func TestTCPZeroWindow(t *testing.T) {
+	sec := func(n uint64) uint64 { return n * uint64(time.Second) }
+	for _, tc := range []struct {
+		name      string
+		threshold time.Duration
+		// durations of the zero-window events sent.
+		events []time.Duration
+	}{
+		{"count only", 0, nil},
+		{"threshold", 5 * time.Second, []time.Duration{6 * time.Second, 6 * time.Second}},
+		{"threshold not reached", time.Minute, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Hour, time.Hour, 0, time.Second)
+			withZeroWindowThreshold(tc.threshold)(&st.state)
+			evs := tcpConnectEvents(1235, sec(1), sec(2))
+			// Two episodes, separated by a gap longer than zeroWindowMaxGap.
+			for _, ts := range []uint64{10, 12, 14, 16, 18, 300, 303, 306} {
+				evs = append(evs, &tcpZeroWindowProbe{Meta: meta(0, 0, sec(ts)), Sock: testSock})
+			}
+			evs = append(evs, &inetReleaseCall{Meta: meta(1234, 1235, sec(310)), Sock: testSock})
+			st.feedEvents(evs)
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, len(tc.events)+1) {
+				t.FailNow()
+			}
+			for i, duration := range tc.events {
+				assertValue(t, flows[i], "network_zero_window", "event.action")
+				assertValue(t, flows[i], false, "flow.final")
+				assertValue(t, flows[i], duration.Nanoseconds(), "network.tcp.zero_window_duration")
+			}
+			final := flows[len(tc.events)]
+			assertValue(t, final, "network_flow", "event.action")
+			assertValue(t, final, uint32(8), "network.tcp.zero_window_count")
+			_, err := final.GetValue("network.tcp.zero_window_duration")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTCPConnectFailure(t *testing.T) {
+	ms := func(n uint64) uint64 { return n * uint64(time.Millisecond) }
+	// connect returns the events of a connect call at 2s that returns 5ms
+	// later, followed or preceded by the given events.
+	connect := func(retval int32, before bool, done ...event) []event {
+		evs := []event{
+			&inetCreate{Meta: meta(1234, 1235, ms(1000)), Proto: 0},
+			&sockInitData{Meta: meta(1234, 1235, ms(1000)), Sock: testSock},
+			&tcpIPv4ConnectCall{
+				Meta:  meta(1234, 1235, ms(2000)),
+				Sock:  testSock,
+				LAddr: ipv4(testLocalIP),
+				LPort: be16(testLocalPort),
+				RAddr: ipv4(testRemoteIP),
+				RPort: be16(testRemotePort),
+			},
+		}
+		result := &tcpConnectResult{Meta: meta(1234, 1235, ms(2005)), Retval: retval}
+		if before {
+			evs = append(append(evs, done...), result)
+		} else {
+			evs = append(append(evs, result), done...)
+		}
+		return append(evs, &inetReleaseCall{Meta: meta(1234, 1235, ms(9000)), Sock: testSock})
+	}
+	tcpDoneAt := func(at uint64, state uint8, err int32) event {
+		return &tcpDone{Meta: meta(0, 0, ms(at)), Sock: testSock, State: state, Err: err}
+	}
+	for _, tc := range []struct {
+		name     string
+		disabled bool
+		events   []event
+		// zero values when not reported.
+		duration time.Duration
+		errno    int32
+		errName  string
+	}{
+		{
+			name:     "timeout",
+			events:   connect(0, false, tcpDoneAt(5000, tcpStateSynSent, 110)),
+			duration: 3 * time.Second,
+			errno:    110,
+			errName:  "ETIMEDOUT",
+		},
+		{
+			// The reset of a local connection is processed before connect
+			// returns.
+			name:     "refused before connect returns",
+			events:   connect(0, true, tcpDoneAt(2001, tcpStateSynSent, 111)),
+			duration: time.Millisecond,
+			errno:    111,
+			errName:  "ECONNREFUSED",
+		},
+		{
+			name:     "immediate failure",
+			events:   connect(-101, false),
+			duration: 5 * time.Millisecond,
+			errno:    101,
+			errName:  "ENETUNREACH",
+		},
+		{
+			name:     "unknown error",
+			events:   connect(0, false, tcpDoneAt(4000, tcpStateSynSent, 0)),
+			duration: 2 * time.Second,
+		},
+		{
+			name:   "established",
+			events: connect(0, false, tcpDoneAt(8000, 7 /* CLOSE */, 0)),
+		},
+		{
+			name:     "disabled",
+			disabled: true,
+			events:   connect(0, false, tcpDoneAt(5000, tcpStateSynSent, 110)),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Hour, time.Hour, 0, time.Second)
+			withConnectFailures(!tc.disabled)(&st.state)
+			withReportEmptyFlows(true)(&st.state)
+			st.feedEvents(tc.events)
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			check := func(field string, expected interface{}, reported bool) {
+				value, err := flows[0].GetValue(field)
+				if !reported {
+					assert.Error(t, err, field)
+				} else if assert.NoError(t, err, field) {
+					assert.Equal(t, expected, value, field)
+				}
+			}
+			check("network.tcp.connect_attempt_duration_ns", tc.duration.Nanoseconds(), tc.duration != 0)
+			check("network.tcp.connect_errno", tc.errno, tc.errno != 0)
+			check("network.tcp.connect_error", tc.errName, tc.errName != "")
+		})
+	}
+}
+
+func TestTCPUrgentData(t *testing.T) {
+	sec := func(n uint64) uint64 { return n * uint64(time.Second) }
+	for _, seen := range []bool{false, true} {
+		t.Run(fmt.Sprint(seen), func(t *testing.T) {
+			st := makeTestingState(t, time.Hour, time.Hour, 0, time.Second)
+			evs := tcpConnectEvents(1235, sec(1), sec(2))
+			if seen {
+				evs = append(evs, &tcpUrgentData{Meta: meta(0, 0, sec(3)), Sock: testSock})
+			}
+			// Unknown sockets are ignored.
+			evs = append(evs, &tcpUrgentData{Meta: meta(0, 0, sec(4)), Sock: testSock + 1})
+			evs = append(evs, &inetReleaseCall{Meta: meta(1234, 1235, sec(5)), Sock: testSock})
+			st.feedEvents(evs)
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			value, err := flows[0].GetValue("network.tcp.urgent_data_seen")
+			if seen {
+				assert.NoError(t, err)
+				assert.Equal(t, true, value)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestFlowByteRates(t *testing.T) {
+	lPort, rPort := be16(testLocalPort), be16(testRemotePort)
+	lAddr, rAddr := ipv4(testLocalIP), ipv4(testRemoteIP)
+	sec := func(n uint64) uint64 { return n * uint64(time.Second) }
+	flowEvents := func(end uint64) []event {
+		return append(tcpConnectEvents(1235, sec(1), sec(1)),
+			&ipLocalOutCall{Meta: meta(1234, 1235, sec(1)), Sock: testSock, Size: 1000, LAddr: lAddr, LPort: lPort, RAddr: rAddr, RPort: rPort},
+			&tcpV4DoRcv{Meta: meta(0, 0, sec(end)), Sock: testSock, Size: 4000, LAddr: lAddr, LPort: lPort, RAddr: rAddr, RPort: rPort},
+			&tcpFinishConnect{Meta: meta(0, 0, sec(end)), Sock: testSock},
+			&inetReleaseCall{Meta: meta(1234, 1235, sec(end)), Sock: testSock},
+		)
+	}
+	for _, tc := range []struct {
+		name    string
+		end     uint64
+		interim bool
+		// expected rates, nil when omitted.
+		inbound, outbound interface{}
+	}{
+		{"final only", 3, false, 2000.0, 500.0},
+		{"interim", 3, true, 2000.0, 500.0},
+		{"instantaneous", 1, true, nil, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Hour, time.Hour, 0, time.Second)
+			withReportOnEstablish(true)(&st.state)
+			withInterimByteRates(tc.interim)(&st.state)
+			st.feedEvents(flowEvents(tc.end))
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 2) {
+				t.FailNow()
+			}
+			interim, final := flows[0], flows[1]
+			for key, expected := range map[string]interface{}{
+				"network.inbound.bytes_per_second":  tc.inbound,
+				"network.outbound.bytes_per_second": tc.outbound,
+			} {
+				if expected == nil {
+					_, err := final.GetValue(key)
+					assert.Error(t, err, key)
+					continue
+				}
+				assertValue(t, final, expected, key)
+				if tc.interim {
+					assertValue(t, interim, expected, key)
+				} else {
+					_, err := interim.GetValue(key)
+					assert.Error(t, err, key)
+				}
+			}
+		})
+	}
+}
+
+func TestTCPClosePathMTU(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		pmtu     uint32
+		ifaceMTU int
+		expected int
+	}{
+		{"discovered", 1400, 1500, 1400},
+		{"same as interface", 1500, 1500, 0},
+		{"unknown interface", 1400, 0, 0},
+		{"not closed", 0, 1500, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			mtus := newInterfaceResolver()
+			mtus.netns = 4026531992
+			st.readNetNS = func(pid uint32) (uint64, error) {
+				return mtus.netns, nil
+			}
+			mtus.lookupRoute = func(src, dst net.IP) (int, error) {
+				return 2, nil
+			}
+			mtus.interfaceMTU = func(ifindex int) (int, error) {
+				if tc.ifaceMTU == 0 {
+					return 0, errors.New("no such network interface")
+				}
+				return tc.ifaceMTU, nil
+			}
+			st.mtus = mtus
+			evs := []event{
+				callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl"}),
+				&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+			}
+			evs = append(evs, tcpConnectEvents(1235, 5, 8)...)
+			evs = append(evs, &inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: testSock})
+			if tc.pmtu != 0 {
+				evs = append(evs, &tcpCloseCall{Meta: meta(1234, 1235, 15), Sock: testSock, PMTU: tc.pmtu, fields: tcpClosePathMTU})
+			}
+			st.feedEvents(evs)
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			if tc.expected == 0 {
+				_, err := flows[0].GetValue("network.path_mtu")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], tc.expected, "network.path_mtu")
+		})
+	}
+}
+
+func TestFlowServiceName(t *testing.T) {
+	const (
+		localIP           = "192.168.33.10"
+		remoteIP          = "172.19.12.13"
+		localPort         = 38842
+		sock      uintptr = 0xff1234
+	)
+	services, err := parseServices(strings.NewReader(`
+# comment
+domain		53/tcp				# Domain Name Server
+domain		53/udp
+postgresql	5432/tcp	postgres	# PostgreSQL Database
+highport	40000/udp
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &serviceTable{
+		byProto:   services,
+		overrides: map[uint16]string{8443: "internal-api"},
+	}
+	for _, tc := range []struct {
+		name     string
+		port     uint16
+		expected string
+	}{
+		{"known", 53, "dns"},
+		{"override", 8443, "internal-api"},
+		{"unknown", 1234, ""},
+		{"ephemeral", 40000, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			st.services = table
+			st.feedEvents([]event{
+				&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+				&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock},
+				&udpSendMsgCall{
+					Meta:     meta(1234, 1235, 6),
+					Sock:     sock,
+					Size:     123,
+					LAddr:    ipv4(localIP),
+					AltRAddr: ipv4(remoteIP),
+					LPort:    be16(localPort),
+					AltRPort: be16(tc.port),
+				},
+				&inetReleaseCall{Meta: meta(1234, 1235, 17), Sock: sock},
+			})
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			value, err := flows[0].GetValue("network.protocol")
+			if tc.expected == "" {
+				assert.Error(t, err, "network.protocol should be omitted")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, value)
+		})
+	}
+}
+
+func TestQUICHello(t *testing.T) {
+	const (
+		localIP           = "192.168.33.10"
+		remoteIP          = "172.19.12.13"
+		localPort         = 38842
+		sock      uintptr = 0xff1234
+	)
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withQUIC(true)(&st.state)
+	st.services = &serviceTable{byProto: map[flowProto]map[uint16]string{protoUDP: {443: "https"}}}
+	send := &udpSendMsgCall{
+		Meta:     meta(1234, 1235, 6),
+		Sock:     sock,
+		Size:     1200,
+		LAddr:    ipv4(localIP),
+		AltRAddr: ipv4(remoteIP),
+		LPort:    be16(localPort),
+		AltRPort: be16(443),
+	}
+	st.feedEvents([]event{
+		&inetCreate{Meta: meta(1234, 1235, 5), Proto: 0},
+		&sockInitData{Meta: meta(1234, 1235, 5), Sock: sock},
+		// The ClientHello is captured after the first packet is sent.
+		send,
+	})
+	assert.NoError(t, st.OnQUICHello(quic.Hello{
+		Client:     net.UDPAddr{IP: net.ParseIP(localIP), Port: localPort},
+		Server:     net.UDPAddr{IP: net.ParseIP(remoteIP), Port: 443},
+		Version:    1,
+		ServerName: "www.example.net",
+		ALPN:       []string{"h3"},
+	}))
+	send.Meta = meta(1234, 1235, 7)
+	st.feedEvents([]event{
+		send,
+		&inetReleaseCall{Meta: meta(1234, 1235, 17), Sock: sock},
+	})
+	st.ExpireFlows()
+	flows := st.getFlows()
+	if !assert.Len(t, flows, 1) {
+		t.FailNow()
+	}
+	assertValue(t, flows[0], "quic", "network.protocol")
+	assertValue(t, flows[0], "www.example.net", "tls.client.server_name")
+	assertValue(t, flows[0], []string{"h3"}, "tls.detailed.client_hello.extensions.application_layer_protocol_negotiation")
+}
+
 func assertValue(t *testing.T, ev beat.Event, expected interface{}, field string) bool {
 	value, err := ev.GetValue(field)
 	return assert.Nil(t, err, field) && assert.Equal(t, expected, value, field)
@@ -683,6 +2711,65 @@ func TestDNSTracker(t *testing.T) {
 			{true, proc2, "192.0.2.12", "example.com"},
 		}.Run(t)
 	})
+	coalescingTracker := func(enabled bool) dnsTracker {
+		st := &state{dns: newDNSTracker(infiniteExpiration)}
+		withDNSCoalescing(enabled)(st)
+		return st.dns
+	}
+	trAAAA := dns.Transaction{
+		TXID:      1236,
+		Client:    local2,
+		Server:    net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 53},
+		Domain:    "Example.NET",
+		Addresses: []net.IP{net.ParseIP("2001:db8::1111")},
+	}
+	t.Run("coalesce A and AAAA", func(t *testing.T) {
+		proc1 := &process{pid: 123}
+		proc2 := &process{pid: 124}
+		tracker := coalescingTracker(true)
+		tracker.RegisterEndpoint(local1, proc1)
+		tracker.AddTransaction(trV4)
+		tracker.AddTransaction(trAAAA)
+		tracker.RegisterEndpoint(local2, proc2)
+		dnsTestCases{
+			{true, proc1, "192.0.2.12", "example.net"},
+			{true, proc1, "2001:db8::1111", "example.net"},
+			{true, proc2, "192.0.2.13", "Example.NET"},
+			{true, proc2, "2001:db8::1111", "Example.NET"},
+		}.Run(t)
+	})
+	t.Run("coalesce single response", func(t *testing.T) {
+		proc1 := &process{pid: 123}
+		tracker := coalescingTracker(true)
+		tracker.RegisterEndpoint(local1, proc1)
+		tracker.AddTransaction(trV4)
+		dnsTestCases{
+			{true, proc1, "192.0.2.12", "example.net"},
+			{false, proc1, "2001:db8::1111", ""},
+		}.Run(t)
+	})
+	t.Run("coalesce different question", func(t *testing.T) {
+		proc1 := &process{pid: 123}
+		tracker := coalescingTracker(true)
+		tracker.RegisterEndpoint(local1, proc1)
+		tracker.AddTransaction(trV4)
+		tracker.AddTransaction(trV6)
+		dnsTestCases{
+			{true, proc1, "192.0.2.12", "example.net"},
+			{false, proc1, "2001:db8::1111", ""},
+		}.Run(t)
+	})
+	t.Run("coalescing disabled", func(t *testing.T) {
+		proc1 := &process{pid: 123}
+		tracker := coalescingTracker(false)
+		tracker.RegisterEndpoint(local1, proc1)
+		tracker.AddTransaction(trV4)
+		tracker.AddTransaction(trAAAA)
+		dnsTestCases{
+			{true, proc1, "192.0.2.12", "example.net"},
+			{false, proc1, "2001:db8::1111", ""},
+		}.Run(t)
+	})
 }
 
 func TestUDPSendMsgAltLogic(t *testing.T) {
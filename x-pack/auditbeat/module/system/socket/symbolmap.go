@@ -0,0 +1,214 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+)
+
+// Maximum number of function names listed in a symbol map warning.
+const symbolMapMaxListed = 5
+
+// symbolMap is a list of kernel functions supplied by the operator with
+// socket.symbol_map_path. It replaces the functions available for tracing
+// read from tracefs when selecting the functions to probe.
+type symbolMap struct {
+	functions common.StringSet
+	// addrs are the addresses of the functions, when the map has them.
+	addrs map[string]uint64
+}
+
+// loadSymbolMap reads a symbol map. An empty path returns a nil map.
+func loadSymbolMap(path string) (*symbolMap, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open socket.symbol_map_path: %w", err)
+	}
+	defer f.Close()
+	m, err := parseSymbolMap(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse socket.symbol_map_path %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// parseSymbolMap parses a symbol map. Each line is either a function name,
+// as in available_filter_functions:
+//
+//	tcp_v4_connect
+//	sctp_connect [sctp]
+//
+// or a symbol with its address, as in /proc/kallsyms or System.map, where
+// only the text symbols are kept:
+//
+//	ffffffff81a4c0e0 T tcp_v4_connect
+//
+// Empty lines and lines starting with # are ignored.
+func parseSymbolMap(r io.Reader) (*symbolMap, error) {
+	m := &symbolMap{
+		functions: common.StringSet(make(map[string]struct{})),
+		addrs:     make(map[string]uint64),
+	}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) == 1 || (len(fields) == 2 && strings.HasPrefix(fields[1], "[")) {
+			m.functions.Add(fields[0])
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil || len(fields) < 3 || len(fields[1]) != 1 {
+			return nil, fmt.Errorf("invalid line %d: %q", line, scanner.Text())
+		}
+		if fields[1] != "t" && fields[1] != "T" {
+			continue
+		}
+		name := fields[2]
+		m.functions.Add(name)
+		if _, found := m.addrs[name]; !found && addr != 0 {
+			m.addrs[name] = addr
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if m.functions.Count() == 0 {
+		return nil, errors.New("no functions found")
+	}
+	return m, nil
+}
+
+// validate compares the given functions of the symbol map with what the
+// running kernel exposes: the functions available for tracing and the
+// addresses in /proc/kallsyms. Either can be nil when it couldn't be read. It
+// returns a warning for each kind of mismatch.
+//
+// With KASLR the kernel text is loaded at a random offset, so the addresses
+// of the map are expected to differ from the kernel's by the same amount for
+// all the functions. Functions that don't share the most common difference
+// point to a map of a different kernel build.
+func (m *symbolMap) validate(names, available common.StringSet, kallsyms map[string][]uint64) (warnings []string) {
+	if available.Count() != 0 {
+		var missing []string
+		for name := range names {
+			if m.functions.Has(name) && !available.Has(name) {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d functions of the symbol map are not available for "+
+				"tracing in the running kernel: %s", len(missing), listSymbols(missing)))
+		}
+	}
+
+	deltas := make(map[uint64]int)
+	for name := range names {
+		addr, found := m.addrs[name]
+		if !found {
+			continue
+		}
+		for _, kaddr := range kallsyms[name] {
+			deltas[kaddr-addr]++
+		}
+	}
+	var delta uint64
+	best := 0
+	for d, count := range deltas {
+		if count > best || (count == best && d < delta) {
+			delta, best = d, count
+		}
+	}
+	var mismatched []string
+	for name := range names {
+		addr, found := m.addrs[name]
+		kaddrs := kallsyms[name]
+		if !found || len(kaddrs) == 0 {
+			continue
+		}
+		matches := false
+		for _, kaddr := range kaddrs {
+			matches = matches || kaddr-addr == delta
+		}
+		if !matches {
+			mismatched = append(mismatched, name)
+		}
+	}
+	if len(mismatched) > 0 {
+		warnings = append(warnings, fmt.Sprintf("the addresses of %d functions of the symbol map don't match "+
+			"the running kernel, the map is probably stale: %s", len(mismatched), listSymbols(mismatched)))
+	}
+	return warnings
+}
+
+// listSymbols formats a list of function names for a warning.
+func listSymbols(names []string) string {
+	sort.Strings(names)
+	if len(names) > symbolMapMaxListed {
+		return strings.Join(names[:symbolMapMaxListed], ", ") + ", ..."
+	}
+	return strings.Join(names, ", ")
+}
+
+// probedFunctions returns the names of the kernel functions that can be
+// probed, except for the ones only used by guesses.
+func probedFunctions() common.StringSet {
+	names := common.StringSet{}
+	for _, candidates := range functionAlternatives {
+		for _, name := range candidates {
+			names.Add(name)
+		}
+	}
+	for _, probe := range getAllKProbes() {
+		if functionAlternativeOf(probe.Probe.Address) == "" {
+			names.Add(probe.Probe.Address)
+		}
+	}
+	return names
+}
+
+// tracingFunctions returns the kernel functions available for tracing. When
+// socket.symbol_map_path is set, the functions of the map are returned after
+// validating the ones that can be probed against the running kernel. The map
+// can list many more functions, like the ones that can't be traced when it
+// comes from /proc/kallsyms.
+func (m *MetricSet) tracingFunctions(traceFS *tracing.TraceFS) (common.StringSet, error) {
+	if m.symbols == nil {
+		return LoadTracingFunctions(traceFS)
+	}
+	available, err := LoadTracingFunctions(traceFS)
+	if err != nil {
+		m.log.Debugf("Can't load available_tracing_functions to validate the symbol map. err=%v", err)
+	}
+	names := probedFunctions()
+	var kallsyms map[string][]uint64
+	if len(m.symbols.addrs) > 0 {
+		if kallsyms, err = readKernelSymbols(names); err != nil {
+			m.log.Debugf("Unable to read kernel symbols to validate the symbol map: %v", err)
+		}
+	}
+	for _, warning := range m.symbols.validate(names, available, kallsyms) {
+		m.log.Warnf("Symbol map %s: %s", m.config.SymbolMapPath, warning)
+	}
+	m.log.Infof("Using %d kernel functions from symbol map %s", m.symbols.functions.Count(), m.config.SymbolMapPath)
+	return m.symbols.functions, nil
+}
@@ -0,0 +1,79 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+const testSymbolMap = `# staged kernel 6.1.0-13
+tcp_v4_connect
+sctp_connect [sctp]
+ffffffff81a30b10 t tcp_close
+ffffffff81a5f2a0 d tcp_v4_connect_data
+ffffffff81234560 T __x64_sys_newuname
+0000000000000000 T udp_sendmsg
+
+`
+
+func TestParseSymbolMap(t *testing.T) {
+	m, err := parseSymbolMap(strings.NewReader(testSymbolMap))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, common.MakeStringSet("tcp_v4_connect", "sctp_connect", "tcp_close", "__x64_sys_newuname", "udp_sendmsg"), m.functions)
+	assert.Equal(t, map[string]uint64{
+		"tcp_close":          0xffffffff81a30b10,
+		"__x64_sys_newuname": 0xffffffff81234560,
+	}, m.addrs)
+
+	for _, invalid := range []string{
+		"tcp_close tcp_v4_connect\n",
+		"ffffffff81a30b10 text tcp_close\n",
+		"ffffffff81a30b10 T\n",
+		"# nothing\n",
+	} {
+		_, err = parseSymbolMap(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestValidateSymbolMap(t *testing.T) {
+	m, err := parseSymbolMap(strings.NewReader(`ffffffff81000100 T tcp_v4_connect
+ffffffff81000200 t tcp_close
+ffffffff81000300 T inet_release
+ffffffff81000400 T udp_sendmsg
+ffffffff81000500 T not_probed
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	names := common.MakeStringSet("tcp_v4_connect", "tcp_close", "inet_release", "udp_sendmsg", "sctp_connect")
+	// Shifted by KASLR, tcp_close has a duplicate.
+	const offset = 0x2a00000
+	kallsyms := map[string][]uint64{
+		"tcp_v4_connect": {0xffffffff81000100 + offset},
+		"tcp_close":      {0xffffffff91000000, 0xffffffff81000200 + offset},
+		"inet_release":   {0xffffffff81000300 + offset},
+	}
+	available := common.MakeStringSet("tcp_v4_connect", "tcp_close", "inet_release", "udp_sendmsg", "not_probed")
+	assert.Empty(t, m.validate(names, available, kallsyms))
+	assert.Empty(t, m.validate(names, nil, nil))
+
+	// Stale addresses and functions missing in the running kernel.
+	kallsyms["udp_sendmsg"] = []uint64{0xffffffff81000480 + offset}
+	available = common.MakeStringSet("tcp_v4_connect", "tcp_close")
+	assert.Equal(t, []string{
+		"2 functions of the symbol map are not available for tracing in the running kernel: inet_release, udp_sendmsg",
+		"the addresses of 1 functions of the symbol map don't match the running kernel, the map is probably stale: udp_sendmsg",
+	}, m.validate(names, available, kallsyms))
+}
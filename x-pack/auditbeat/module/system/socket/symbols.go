@@ -0,0 +1,119 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+const kallsymsPath = "/proc/kallsyms"
+
+// readKernelSymbols returns the addresses of the given kernel functions.
+func readKernelSymbols(names common.StringSet) (map[string][]uint64, error) {
+	f, err := os.Open(kallsymsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseKernelSymbols(f, names)
+}
+
+// parseKernelSymbols parses the contents of /proc/kallsyms, returning the
+// addresses of the text symbols with the given names. A name can have more
+// than one address when different compilation units define static functions
+// with the same name. Symbols with a zero address, which is what unprivileged
+// readers or kernel.kptr_restrict get, are ignored.
+func parseKernelSymbols(r io.Reader, names common.StringSet) (map[string][]uint64, error) {
+	symbols := make(map[string][]uint64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Format is address type name [module]
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || (fields[1] != "t" && fields[1] != "T") || !names.Has(fields[2]) {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil || addr == 0 {
+			continue
+		}
+		symbols[fields[2]] = append(symbols[fields[2]], addr)
+	}
+	return symbols, scanner.Err()
+}
+
+// attachedProbe is a probe installed during Setup.
+type attachedProbe struct {
+	// Probe with templates applied, as returned by the installer.
+	probe tracing.Probe
+	// alternative is the function alternative variable used as the probe
+	// address, if any.
+	alternative string
+}
+
+// functionAlternativeOf returns the function alternative variable used as
+// the address of a probe definition, or an empty string.
+func functionAlternativeOf(address string) string {
+	if !strings.HasPrefix(address, "{{.") || !strings.HasSuffix(address, "}}") {
+		return ""
+	}
+	varName := strings.TrimSuffix(strings.TrimPrefix(address, "{{."), "}}")
+	if _, found := functionAlternatives[varName]; !found {
+		return ""
+	}
+	return varName
+}
+
+// logAttachedProbes logs the kernel symbol each probe is attached to, so
+// that it can be correlated with /proc/kallsyms.
+func (m *MetricSet) logAttachedProbes(attached []attachedProbe) {
+	names := common.StringSet{}
+	for _, p := range attached {
+		names.Add(p.probe.Address)
+	}
+	symbols, err := readKernelSymbols(names)
+	if err != nil {
+		m.log.Debugf("Unable to read kernel symbols: %v", err)
+	}
+	probes := make([]mapstr.M, 0, len(attached))
+	for _, p := range attached {
+		kind := "kprobe"
+		if p.probe.Type == tracing.TypeKRetProbe {
+			kind = "kretprobe"
+		}
+		entry := mapstr.M{
+			"name":     p.probe.Name,
+			"type":     kind,
+			"function": p.probe.Address,
+		}
+		if addrs := symbols[p.probe.Address]; len(addrs) > 0 {
+			list := make([]string, len(addrs))
+			for idx, addr := range addrs {
+				list[idx] = fmt.Sprintf("0x%x", addr)
+			}
+			entry["addresses"] = list
+			// The kernel attaches to the first symbol with the given name.
+			entry["ambiguous"] = len(addrs) > 1
+		}
+		if p.alternative != "" {
+			entry["alternative"] = mapstr.M{
+				"variable":   p.alternative,
+				"candidates": functionAlternatives[p.alternative],
+			}
+		}
+		probes = append(probes, entry)
+	}
+	m.log.Infow("Attached probes", "kernel", kernelVersion, "probes", probes)
+}
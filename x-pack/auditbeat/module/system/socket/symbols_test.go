@@ -0,0 +1,42 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+func TestParseKernelSymbols(t *testing.T) {
+	const kallsyms = `ffffffff81a4c0e0 T tcp_v4_connect
+ffffffff81a30b10 t tcp_close
+ffffffff81234560 t __do_sys_newuname
+ffffffff81a5f2a0 d tcp_v4_connect_data
+ffffffffc0a1b2c0 t sctp_connect	[sctp]
+ffffffff81a3bb00 t ip_local_out
+ffffffff81b3bb00 t ip_local_out
+0000000000000000 T udp_sendmsg
+`
+	symbols, err := parseKernelSymbols(strings.NewReader(kallsyms),
+		common.MakeStringSet("tcp_v4_connect", "sctp_connect", "ip_local_out", "udp_sendmsg", "inet_release"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]uint64{
+		"tcp_v4_connect": {0xffffffff81a4c0e0},
+		"sctp_connect":   {0xffffffffc0a1b2c0},
+		"ip_local_out":   {0xffffffff81a3bb00, 0xffffffff81b3bb00},
+	}, symbols)
+}
+
+func TestFunctionAlternativeOf(t *testing.T) {
+	assert.Equal(t, "SYS_UNAME", functionAlternativeOf("{{.SYS_UNAME}}"))
+	assert.Equal(t, "", functionAlternativeOf("tcp_v4_connect"))
+	assert.Equal(t, "", functionAlternativeOf("{{.UNKNOWN}}"))
+}
@@ -7,12 +7,17 @@
 package socket
 
 import (
+	"fmt"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"unsafe"
 
 	"github.com/elastic/beats/v7/libbeat/common"
 	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
 	"github.com/elastic/elastic-agent-libs/mapstr"
+	"github.com/elastic/elastic-agent-libs/monitoring"
 )
 
 // baseTemplateVars contains the substitution variables useful to write KProbes
@@ -20,12 +25,23 @@ import (
 // variables and guessed offsets.
 var baseTemplateVars = mapstr.M{
 	// Constants to make KProbes more readable
-	"AF_INET":     2,
-	"AF_INET6":    10,
-	"IPPROTO_TCP": 6,
-	"IPPROTO_UDP": 17,
-	"SOCK_STREAM": 2,
-	"TCP_CLOSED":  7,
+	"AF_INET":      2,
+	"AF_INET6":     10,
+	"IPPROTO_IPIP": 4,
+	"IPPROTO_TCP":  6,
+	"IPPROTO_UDP":  17,
+	"IPPROTO_IPV6": 41,
+	"IPPROTO_GRE":  47,
+	"SOCK_STREAM":  2,
+	"TCP_CLOSED":   7,
+
+	// Offset of skc_state in struct sock_common, after the addresses, hash,
+	// ports and family. It hasn't changed since Linux 3.x.
+	"SOCK_COMMON_STATE": 18,
+
+	// Offset of type in struct socket, after its state. It hasn't changed
+	// since Linux 2.6.
+	"SOCKET_TYPE": 4,
 
 	// Offset of the ith element on an array of pointers
 	"POINTER_INDEX": func(index int) int {
@@ -33,6 +49,16 @@ var baseTemplateVars = mapstr.M{
 	},
 }
 
+// configTemplateVars returns the template variables that depend on the
+// configuration and on whether IPv6 is enabled.
+func configTemplateVars(config *Config, hasIPv6 bool) mapstr.M {
+	return mapstr.M{
+		"HAS_IPV6":     hasIPv6,
+		"ENABLE_SCTP":  config.EnableSCTP,
+		"ENABLE_MPTCP": config.EnableMPTCP,
+	}
+}
+
 // These functions names vary between kernel versions. The first available one
 // will be selected during setup.
 var functionAlternatives = map[string][]string{
@@ -70,3 +96,67 @@ func LoadTracingFunctions(tfs *tracing.TraceFS) (common.StringSet, error) {
 	}
 	return functions, nil
 }
+
+// redactedTemplateVars lists the template variables whose value must not be
+// exposed outside of debug logging.
+var redactedTemplateVars = common.StringSet{}
+
+// Resolved template variables, exposed through the monitoring endpoint as
+// system.socket.template_vars so that the offsets and functions in use can
+// be inspected without debug logging.
+var publishedTemplateVars struct {
+	sync.RWMutex
+	vars map[string]string
+}
+
+// Monitoring registry of the dataset, system.socket.
+var monitoringRegistry = monitoring.Default.NewRegistry(moduleName + "." + metricsetName)
+
+// machineEndianness is the byte order of the events decoded by the dataset,
+// big or little, for support diagnostics.
+var machineEndianness = monitoring.NewString(monitoringRegistry, "machine_endianness")
+
+func init() {
+	monitoring.NewFunc(monitoringRegistry, "template_vars", reportTemplateVars, monitoring.DoNotReport)
+}
+
+func reportTemplateVars(_ monitoring.Mode, V monitoring.Visitor) {
+	publishedTemplateVars.RLock()
+	defer publishedTemplateVars.RUnlock()
+	V.OnRegistryStart()
+	defer V.OnRegistryFinished()
+	names := make([]string, 0, len(publishedTemplateVars.vars))
+	for name := range publishedTemplateVars.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		monitoring.ReportString(V, name, publishedTemplateVars.vars[name])
+	}
+}
+
+// publishTemplateVars makes the given template variables available through
+// the monitoring endpoint.
+func publishTemplateVars(vars mapstr.M) {
+	sanitized := sanitizeTemplateVars(vars)
+	publishedTemplateVars.Lock()
+	defer publishedTemplateVars.Unlock()
+	publishedTemplateVars.vars = sanitized
+}
+
+// sanitizeTemplateVars returns the template variables as strings. Functions
+// are omitted and the value of redacted variables is replaced.
+func sanitizeTemplateVars(vars mapstr.M) map[string]string {
+	result := make(map[string]string, len(vars))
+	for name, value := range vars {
+		switch {
+		case value == nil || reflect.TypeOf(value).Kind() == reflect.Func:
+			continue
+		case redactedTemplateVars.Has(name):
+			result[name] = "<redacted>"
+		default:
+			result[name] = fmt.Sprint(value)
+		}
+	}
+	return result
+}
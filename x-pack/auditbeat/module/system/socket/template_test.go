@@ -0,0 +1,48 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elastic-agent-libs/mapstr"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+func TestPublishTemplateVars(t *testing.T) {
+	defer func(prev map[string]string) {
+		publishedTemplateVars.vars = prev
+	}(publishedTemplateVars.vars)
+	redactedTemplateVars.Add("SECRET")
+	defer delete(redactedTemplateVars, "SECRET")
+
+	publishTemplateVars(mapstr.M{
+		"AF_INET":           2,
+		"HAS_IPV6":          true,
+		"IP_LOCAL_OUT":      "ip_local_out_sk",
+		"SECRET":            "hunter2",
+		"POINTER_INDEX":     func(index int) int { return index },
+		"INET_SOCK_LADDR":   600,
+		"NIL":               nil,
+		"TCP_SOCK_SRTT":     1628,
+		"SYS_P1":            "%di",
+		"INET_SOCK_V6_TERM": ":u64",
+	})
+	snapshot := monitoring.CollectFlatSnapshot(monitoring.Default.GetRegistry(moduleName+"."+metricsetName), monitoring.Full, false)
+	assert.Equal(t, map[string]string{
+		"template_vars.AF_INET":           "2",
+		"template_vars.HAS_IPV6":          "true",
+		"template_vars.IP_LOCAL_OUT":      "ip_local_out_sk",
+		"template_vars.SECRET":            "<redacted>",
+		"template_vars.INET_SOCK_LADDR":   "600",
+		"template_vars.TCP_SOCK_SRTT":     "1628",
+		"template_vars.SYS_P1":            "%di",
+		"template_vars.INET_SOCK_V6_TERM": ":u64",
+	}, snapshot.Strings)
+}
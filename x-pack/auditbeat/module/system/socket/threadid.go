@@ -0,0 +1,24 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+// withMainThreadID sets whether the thread of a flow is reported when it's
+// the main thread of its process, whose thread ID is the PID.
+func withMainThreadID(enabled bool) stateOption {
+	return func(s *state) {
+		s.reportMainThreadID = enabled
+	}
+}
+
+// threadID returns the thread ID to record for a flow connected or accepted
+// by the given thread, or zero when it's not reported.
+func (s *state) threadID(pid, tid uint32) uint32 {
+	if tid == pid && !s.reportMainThreadID {
+		return 0
+	}
+	return tid
+}
@@ -0,0 +1,65 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestThreadID(t *testing.T) {
+	accept := func(tid uint32) []event {
+		return []event{
+			callExecve(meta(1234, 1234, 1), []string{"/usr/sbin/nginx"}),
+			&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+			&tcpAcceptResult4{
+				Meta:  meta(1234, tid, 10),
+				Sock:  testSock,
+				LAddr: ipv4(testLocalIP),
+				LPort: be16(testLocalPort),
+				RAddr: ipv4(testRemoteIP),
+				RPort: be16(testRemotePort),
+				Af:    unix.AF_INET,
+			},
+			&inetReleaseCall{Meta: meta(1234, 1234, 15), Sock: testSock},
+		}
+	}
+	connect := append(tcpConnectEvents(1235, 5, 8),
+		&inetReleaseCall{Meta: meta(1234, 1235, 15), Sock: testSock})
+	for _, tc := range []struct {
+		name       string
+		evs        []event
+		mainThread bool
+		expected   int
+	}{
+		{"threaded accept", accept(1240), false, 1240},
+		{"main thread accept", accept(1234), false, 0},
+		{"main thread reported", accept(1234), true, 1234},
+		{"threaded connect", connect, false, 1235},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+			withMainThreadID(tc.mainThread)(&st.state)
+			st.feedEvents(tc.evs)
+			st.ExpireFlows()
+			flows := st.getFlows()
+			if !assert.Len(t, flows, 1) {
+				t.FailNow()
+			}
+			assertValue(t, flows[0], 1234, "process.pid")
+			if tc.expected == 0 {
+				_, err := flows[0].GetValue("process.thread.id")
+				assert.Error(t, err)
+				return
+			}
+			assertValue(t, flows[0], tc.expected, "process.thread.id")
+		})
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// processFlowCount is the number of open flows of a process.
+type processFlowCount struct {
+	pid   uint32
+	name  string
+	flows int
+}
+
+// Processes with the most open flows at the last log interval, exposed
+// through the monitoring endpoint as system.socket.top_processes.
+var publishedTopProcesses struct {
+	sync.RWMutex
+	top []processFlowCount
+}
+
+func init() {
+	monitoring.NewFunc(monitoringRegistry, "top_processes", reportTopProcesses)
+}
+
+func reportTopProcesses(_ monitoring.Mode, V monitoring.Visitor) {
+	publishedTopProcesses.RLock()
+	defer publishedTopProcesses.RUnlock()
+	V.OnRegistryStart()
+	defer V.OnRegistryFinished()
+	for _, p := range publishedTopProcesses.top {
+		monitoring.ReportNamespace(V, strconv.Itoa(int(p.pid)), func() {
+			monitoring.ReportString(V, "name", p.name)
+			monitoring.ReportInt(V, "flows", int64(p.flows))
+		})
+	}
+}
+
+func publishTopProcesses(top []processFlowCount) {
+	publishedTopProcesses.Lock()
+	defer publishedTopProcesses.Unlock()
+	publishedTopProcesses.top = top
+}
+
+// withTopProcesses sets the number of processes with the most open flows
+// that are reported in the periodic state log and the monitoring endpoint.
+// Zero disables it.
+func withTopProcesses(n int) stateOption {
+	return func(s *state) {
+		s.topProcesses = n
+	}
+}
+
+// flowCountsLocked counts the open flows of each process, by the owner of
+// their socket. It only walks the sockets, so that the state lock isn't held
+// for long. The process of each PID is returned so that its name can be read
+// once the lock is released.
+func (s *state) flowCountsLocked() (counts map[uint32]int, procs map[uint32]*process) {
+	counts = make(map[uint32]int)
+	procs = make(map[uint32]*process)
+	for _, sock := range s.socks {
+		if sock.pid == 0 || len(sock.flows) == 0 {
+			continue
+		}
+		counts[sock.pid] += len(sock.flows)
+		if sock.process != nil {
+			procs[sock.pid] = sock.process
+		}
+	}
+	return counts, procs
+}
+
+// topProcesses returns the n processes with the most flows, by decreasing
+// number of flows and then by PID.
+func topProcesses(counts map[uint32]int, procs map[uint32]*process, n int) []processFlowCount {
+	all := make([]processFlowCount, 0, len(counts))
+	for pid, flows := range counts {
+		all = append(all, processFlowCount{pid: pid, flows: flows})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].flows != all[j].flows {
+			return all[i].flows > all[j].flows
+		}
+		return all[i].pid < all[j].pid
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	for i := range all {
+		if proc := procs[all[i].pid]; proc != nil {
+			all[i].name = proc.name
+		}
+	}
+	return all
+}
+
+// formatTopProcesses formats the top processes for the state log, as
+// name(pid):flows.
+func formatTopProcesses(top []processFlowCount) string {
+	var sb strings.Builder
+	for i, p := range top {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(p.name)
+		sb.WriteByte('(')
+		sb.WriteString(strconv.Itoa(int(p.pid)))
+		sb.WriteString("):")
+		sb.WriteString(strconv.Itoa(p.flows))
+	}
+	return sb.String()
+}
@@ -0,0 +1,53 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopProcesses(t *testing.T) {
+	counts := map[uint32]int{10: 3, 20: 7, 30: 3, 40: 1}
+	procs := map[uint32]*process{
+		10: {pid: 10, name: "nginx"},
+		20: {pid: 20, name: "java"},
+		30: {pid: 30, name: "curl"},
+	}
+	top := topProcesses(counts, procs, 3)
+	assert.Equal(t, []processFlowCount{
+		{pid: 20, name: "java", flows: 7},
+		{pid: 10, name: "nginx", flows: 3},
+		{pid: 30, name: "curl", flows: 3},
+	}, top)
+	assert.Equal(t, "java(20):7 nginx(10):3 curl(30):3", formatTopProcesses(top))
+
+	// Processes that aren't tracked have no name.
+	assert.Equal(t, []processFlowCount{
+		{pid: 20, name: "java", flows: 7},
+		{pid: 10, name: "nginx", flows: 3},
+		{pid: 30, name: "curl", flows: 3},
+		{pid: 40, flows: 1},
+	}, topProcesses(counts, procs, 10))
+}
+
+func TestFlowCounts(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withTopProcesses(10)(&st.state)
+	st.feedEvents(append([]event{
+		callExecve(meta(1234, 1234, 1), []string{"/usr/bin/curl", "https://example.net/"}),
+		&execveRet{Meta: meta(1234, 1234, 2), Retval: 1234},
+	}, tcpConnectEvents(1234, 3, 4)...))
+
+	st.Lock()
+	counts, procs := st.flowCountsLocked()
+	st.Unlock()
+	assert.Equal(t, map[uint32]int{1234: 1}, counts)
+	assert.Equal(t, []processFlowCount{{pid: 1234, name: "curl", flows: 1}}, topProcesses(counts, procs, 10))
+}
@@ -0,0 +1,170 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/helper"
+)
+
+const (
+	// Name of the lock file used to synchronize tracefs mounting between
+	// Auditbeat instances.
+	traceFSLockName = "auditbeat-tracefs.lock"
+	// Number of times tracefs availability is checked before giving up.
+	traceFSMountAttempts = 10
+)
+
+// Time to wait between tracefs availability checks. A variable so that tests
+// don't have to wait.
+var traceFSRetryInterval = 100 * time.Millisecond
+
+// fsMounter mounts and unmounts a filesystem.
+type fsMounter interface {
+	mount() error
+	unmount() error
+	String() string
+}
+
+// traceFSMount tracks this instance's use of tracefs/debugfs. Mounting and
+// unmounting is serialized between instances with an exclusive lock on the
+// lock file, while a shared lock on the users file is held for as long as the
+// filesystem is in use, so that the instance that mounted it doesn't unmount
+// it while other instances still depend on it.
+type traceFSMount struct {
+	lockPath string
+	users    *os.File
+	// mounted is the filesystem mounted by this instance, or nil if it was
+	// already mounted.
+	mounted fsMounter
+}
+
+// traceFSLockPath returns the path of the lock file used to synchronize
+// tracefs mounting.
+func traceFSLockPath() string {
+	if info, err := os.Stat("/run"); err == nil && info.IsDir() {
+		return filepath.Join("/run", traceFSLockName)
+	}
+	return filepath.Join(os.TempDir(), traceFSLockName)
+}
+
+// setupTraceFS makes sure that tracefs is available, mounting one of the
+// given filesystems if necessary. Instances starting concurrently are
+// serialized, so that none of them sees a filesystem that is still being
+// mounted by another.
+func setupTraceFS(lockPath string, mounts []fsMounter, isAvailable func() error, log helper.Logger) *traceFSMount {
+	t := &traceFSMount{lockPath: lockPath}
+	lock, err := openLock(lockPath, unix.LOCK_EX)
+	if err != nil {
+		log.Debugf("Unable to lock %s: %v", lockPath, err)
+	} else {
+		defer lock.Close()
+		if t.users, err = openLock(lockPath+".users", unix.LOCK_SH); err != nil {
+			log.Debugf("Unable to lock %s.users: %v", lockPath, err)
+		}
+	}
+	t.mount(mounts, isAvailable, log)
+	return t
+}
+
+func (t *traceFSMount) mount(mounts []fsMounter, isAvailable func() error, log helper.Logger) {
+	for attempt := 0; attempt < traceFSMountAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(traceFSRetryInterval)
+		}
+		if isAvailable() == nil {
+			return
+		}
+		if attempt == 0 {
+			log.Debugf("tracefs/debugfs not found. Attempting to mount")
+		}
+		busy := false
+		for _, mount := range mounts {
+			if err := mount.mount(); err != nil {
+				log.Debugf("Mount %s returned %v", mount, err)
+				// Another process is mounting it, check again later.
+				busy = busy || errors.Is(err, unix.EBUSY)
+				continue
+			}
+			if err := isAvailable(); err != nil {
+				log.Warnf("Mounted %s but no kprobes available: %v", mount, err)
+				mount.unmount()
+				continue
+			}
+			log.Debugf("Mounted %s", mount)
+			t.mounted = mount
+			return
+		}
+		if !busy {
+			return
+		}
+	}
+}
+
+// release unmounts the filesystem if it was mounted by this instance and no
+// other instance is using it.
+func (t *traceFSMount) release(log helper.Logger) {
+	if t.users == nil {
+		// No coordination with other instances was possible.
+		t.unmount(log)
+		return
+	}
+	defer t.users.Close()
+	if t.mounted == nil {
+		return
+	}
+	lock, err := openLock(t.lockPath, unix.LOCK_EX)
+	if err != nil {
+		log.Debugf("Not unmounting %s: unable to lock %s: %v", t.mounted, t.lockPath, err)
+		return
+	}
+	defer lock.Close()
+	if err = flock(t.users, unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		log.Debugf("Not unmounting %s: in use by another instance", t.mounted)
+		return
+	}
+	t.unmount(log)
+}
+
+func (t *traceFSMount) unmount(log helper.Logger) {
+	if t.mounted == nil {
+		return
+	}
+	if err := t.mounted.unmount(); err != nil {
+		log.Errorf("Failed to umount %s: %v", t.mounted, err)
+	} else {
+		log.Debugf("Unmounted %s", t.mounted)
+	}
+}
+
+// openLock opens or creates the given file and locks it.
+func openLock(path string, how int) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err = flock(f, how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func flock(f *os.File, how int) error {
+	for {
+		err := unix.Flock(int(f.Fd()), how)
+		if !errors.Is(err, unix.EINTR) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+// fakeTraceFS simulates a filesystem that takes some time to mount, during
+// which it's reported as busy but not yet available.
+type fakeTraceFS struct {
+	sync.Mutex
+	mounting, mounted bool
+	mounts, unmounts  int
+}
+
+func (f *fakeTraceFS) mount() error {
+	f.Lock()
+	if f.mounting || f.mounted {
+		f.Unlock()
+		return unix.EBUSY
+	}
+	f.mounting = true
+	f.mounts++
+	f.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	f.Lock()
+	f.mounting, f.mounted = false, true
+	f.Unlock()
+	return nil
+}
+
+func (f *fakeTraceFS) unmount() error {
+	f.Lock()
+	defer f.Unlock()
+	f.mounted = false
+	f.unmounts++
+	return nil
+}
+
+func (f *fakeTraceFS) isAvailable() error {
+	f.Lock()
+	defer f.Unlock()
+	if !f.mounted {
+		return errors.New("tracefs not mounted")
+	}
+	return nil
+}
+
+func (f *fakeTraceFS) String() string {
+	return "fake tracefs"
+}
+
+func TestConcurrentTraceFSSetup(t *testing.T) {
+	defer func(interval time.Duration) {
+		traceFSRetryInterval = interval
+	}(traceFSRetryInterval)
+	traceFSRetryInterval = time.Millisecond
+
+	const numInstances = 8
+	lockPath := filepath.Join(t.TempDir(), traceFSLockName)
+	log := logp.NewLogger("test")
+	fs := &fakeTraceFS{}
+
+	var wg sync.WaitGroup
+	instances := make([]*traceFSMount, numInstances)
+	for i := range instances {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			instances[i] = setupTraceFS(lockPath, []fsMounter{fs}, fs.isAvailable, log)
+			assert.NoError(t, fs.isAvailable())
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, fs.mounts)
+
+	var owner *traceFSMount
+	for _, inst := range instances {
+		if inst.mounted != nil {
+			assert.Nil(t, owner, "more than one instance mounted tracefs")
+			owner = inst
+		}
+	}
+	if !assert.NotNil(t, owner) {
+		return
+	}
+
+	// An instance started later uses the existing mount.
+	late := setupTraceFS(lockPath, []fsMounter{fs}, fs.isAvailable, log)
+	assert.Nil(t, late.mounted)
+	instances = append(instances, late)
+
+	// The owner doesn't unmount while other instances are running.
+	owner.release(log)
+	assert.Equal(t, 0, fs.unmounts)
+	for _, inst := range instances {
+		if inst != owner {
+			inst.release(log)
+		}
+	}
+	assert.Equal(t, 0, fs.unmounts)
+	assert.NoError(t, fs.isAvailable())
+
+	// An instance that's the only user unmounts what it mounted.
+	fs = &fakeTraceFS{}
+	single := setupTraceFS(lockPath, []fsMounter{fs}, fs.isAvailable, log)
+	assert.Equal(t, fs, single.mounted)
+	single.release(log)
+	assert.Equal(t, 1, fs.unmounts)
+
+	// A preexisting mount is never unmounted.
+	preexisting := setupTraceFS(lockPath, []fsMounter{fs}, func() error { return nil }, log)
+	assert.Nil(t, preexisting.mounted)
+	preexisting.release(log)
+	assert.Equal(t, 1, fs.unmounts)
+}
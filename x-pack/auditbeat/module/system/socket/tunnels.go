@@ -0,0 +1,214 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// IP protocols of the encapsulated packets of the tunnels that are monitored.
+const (
+	ipprotoIPIP = 4
+	ipprotoIPv6 = 41
+	ipprotoGRE  = 47
+)
+
+// tunnelKey identifies a tunnel by its remote endpoint and encapsulation. The
+// local endpoint isn't part of it, as it's unknown when transmitting on a
+// tunnel without a local address.
+type tunnelKey struct {
+	remote uint32
+	proto  uint8
+}
+
+// tunnelCounters holds the traffic of a tunnel in one direction.
+type tunnelCounters struct {
+	packets uint64
+	bytes   uint64
+}
+
+// tunnel holds the traffic of a tunnel since it was last reported.
+type tunnel struct {
+	key tunnelKey
+	// local address, zero when unknown.
+	local               uint32
+	firstSeen, lastSeen time.Time
+	sent, received      tunnelCounters
+}
+
+// tunnelTable accounts the packets of the active tunnels between reports. It's
+// protected by the state's mutex.
+type tunnelTable struct {
+	tunnels map[tunnelKey]*tunnel
+}
+
+func newTunnelTable() *tunnelTable {
+	return &tunnelTable{tunnels: make(map[tunnelKey]*tunnel)}
+}
+
+// add accounts a packet encapsulated (egress) or decapsulated (ingress) by a
+// tunnel.
+func (t *tunnelTable) add(local, remote uint32, proto uint8, dir flowDirection, size uint32, now time.Time) {
+	key := tunnelKey{remote: remote, proto: proto}
+	tun, found := t.tunnels[key]
+	if !found {
+		tun = &tunnel{key: key, firstSeen: now}
+		t.tunnels[key] = tun
+	}
+	if local != 0 {
+		tun.local = local
+	}
+	tun.lastSeen = now
+	counters := &tun.sent
+	if dir == directionIngress {
+		counters = &tun.received
+	}
+	counters.packets++
+	counters.bytes += uint64(size)
+}
+
+// collect returns the tunnels that saw traffic since the last call and resets
+// the table, so that idle tunnels aren't reported.
+func (t *tunnelTable) collect() []*tunnel {
+	list := make([]*tunnel, 0, len(t.tunnels))
+	for _, tun := range t.tunnels {
+		list = append(list, tun)
+	}
+	t.tunnels = make(map[tunnelKey]*tunnel)
+	return list
+}
+
+// withTunnels enables reporting the active tunnels.
+func withTunnels(enabled bool) stateOption {
+	return func(s *state) {
+		if enabled {
+			s.tunnels = newTunnelTable()
+		}
+	}
+}
+
+// OnTunnelPacket accounts a packet encapsulated or decapsulated by an IPv4
+// tunnel. Packets of tunnels without a remote address aren't accounted.
+func (s *state) OnTunnelPacket(ts kernelTime, local, remote uint32, proto uint8, dir flowDirection, size uint32) error {
+	if s.tunnels == nil || remote == 0 {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.tunnels.add(local, remote, proto, dir, size, s.kernTimestampToTime(ts))
+	return nil
+}
+
+func (s *state) tunnelLoop() {
+	ticker := time.NewTicker(s.inactiveTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.reporter.Done():
+			return
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.reportTunnels()
+		}
+	}
+}
+
+// reportTunnels sends an event for each tunnel that saw traffic since the
+// last report.
+func (s *state) reportTunnels() {
+	s.Lock()
+	tunnels := s.tunnels.collect()
+	s.Unlock()
+	for _, tun := range tunnels {
+		s.reporter.Event(tunnelEvent(tun))
+	}
+}
+
+func tunnelEvent(tun *tunnel) mb.Event {
+	source := mapstr.M{
+		"packets": tun.sent.packets,
+		"bytes":   tun.sent.bytes,
+	}
+	if tun.local != 0 {
+		source["ip"] = kernelIPv4(tun.local).String()
+	}
+	root := mapstr.M{
+		"event": mapstr.M{
+			"kind":     "event",
+			"action":   "network_tunnel",
+			"category": []string{"network"},
+			"type":     []string{"info", "connection"},
+			"start":    tun.firstSeen,
+			"end":      tun.lastSeen,
+		},
+		"network": mapstr.M{
+			"type":        "ipv4",
+			"iana_number": strconv.Itoa(int(tun.key.proto)),
+			"transport":   tunnelTransport(tun.key.proto),
+			"packets":     tun.sent.packets + tun.received.packets,
+			"bytes":       tun.sent.bytes + tun.received.bytes,
+		},
+		"source": source,
+		"destination": mapstr.M{
+			"ip":      kernelIPv4(tun.key.remote).String(),
+			"packets": tun.received.packets,
+			"bytes":   tun.received.bytes,
+		},
+	}
+	return mb.Event{
+		RootFields: root,
+		MetricSetFields: mapstr.M{
+			"tunnel": mapstr.M{
+				"type": tunnelType(tun.key.proto),
+			},
+		},
+	}
+}
+
+// tunnelTransport returns the IANA keyword of the protocol of the packets of a
+// tunnel.
+func tunnelTransport(proto uint8) string {
+	switch proto {
+	case ipprotoIPIP:
+		return "ipv4"
+	case ipprotoIPv6:
+		return "ipv6"
+	case ipprotoGRE:
+		return "gre"
+	default:
+		return strconv.Itoa(int(proto))
+	}
+}
+
+// tunnelType returns the name of the Linux tunnel driver for a protocol.
+func tunnelType(proto uint8) string {
+	switch proto {
+	case ipprotoIPIP:
+		return "ipip"
+	case ipprotoIPv6:
+		return "sit"
+	case ipprotoGRE:
+		return "gre"
+	default:
+		return "unknown"
+	}
+}
+
+// kernelIPv4 returns the IPv4 address for an address read from the kernel,
+// in network byte order.
+func kernelIPv4(addr uint32) net.IP {
+	var buf [4]byte
+	tracing.MachineEndian.PutUint32(buf[:], addr)
+	return net.IPv4(buf[0], buf[1], buf[2], buf[3])
+}
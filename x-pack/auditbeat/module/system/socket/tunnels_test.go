@@ -0,0 +1,100 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/tracing"
+)
+
+func tunnelRcv(ts uint64, local, remote string, proto uint8, size uint32, pointers bool) *ipTunnelRcv {
+	const ipHdr = 64
+	ev := &ipTunnelRcv{
+		Meta:  meta(0, 0, ts),
+		Size:  size,
+		IPHdr: ipHdr,
+		Base:  0xffff9f1d00001000,
+	}
+	if pointers {
+		ev.IPHdr += uint16(ev.Base)
+	}
+	ev.Packet[ipHdr] = 0x45
+	ev.Packet[ipHdr+9] = proto
+	tracing.MachineEndian.PutUint32(ev.Packet[ipHdr+12:], ipv4(remote))
+	tracing.MachineEndian.PutUint32(ev.Packet[ipHdr+16:], ipv4(local))
+	return ev
+}
+
+func TestTunnels(t *testing.T) {
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withTunnels(true)(&st.state)
+
+	st.feedEvents([]event{
+		&ipTunnelXmit{Meta: meta(0, 0, 1), SAddr: ipv4("10.0.0.1"), DAddr: ipv4("10.0.0.2"), Proto: ipprotoGRE, Size: 84},
+		&ipTunnelXmit{Meta: meta(0, 0, 2), SAddr: ipv4("10.0.0.1"), DAddr: ipv4("10.0.0.2"), Proto: ipprotoGRE, Size: 100},
+		tunnelRcv(3, "10.0.0.1", "10.0.0.2", ipprotoGRE, 60, false),
+		tunnelRcv(4, "10.0.0.1", "10.0.0.2", ipprotoGRE, 40, true),
+		// An IPIP tunnel without a local address.
+		&ipTunnelXmit{Meta: meta(0, 0, 5), DAddr: ipv4("10.0.0.3"), Proto: ipprotoIPIP, Size: 1000},
+		// A tunnel without a remote address isn't accounted.
+		&ipTunnelXmit{Meta: meta(0, 0, 6), SAddr: ipv4("10.0.0.1"), Proto: ipprotoGRE, Size: 1000},
+	})
+
+	tunnelEvents := func() map[string]beat.Event {
+		st.getFlows()
+		st.reportTunnels()
+		evs := make(map[string]beat.Event)
+		for _, ev := range st.getFlows() {
+			ip, _ := ev.GetValue("destination.ip")
+			evs[ip.(string)] = ev
+		}
+		return evs
+	}
+	evs := tunnelEvents()
+	if !assert.Len(t, evs, 2) {
+		t.FailNow()
+	}
+	for field, expected := range map[string]interface{}{
+		"event.action":              "network_tunnel",
+		"event.kind":                "event",
+		"network.type":              "ipv4",
+		"network.transport":         "gre",
+		"network.iana_number":       "47",
+		"network.packets":           uint64(4),
+		"network.bytes":             uint64(284),
+		"source.ip":                 "10.0.0.1",
+		"source.packets":            uint64(2),
+		"source.bytes":              uint64(184),
+		"destination.packets":       uint64(2),
+		"destination.bytes":         uint64(100),
+		"system.socket.tunnel.type": "gre",
+	} {
+		assertValue(t, evs["10.0.0.2"], expected, field)
+	}
+	ipip := evs["10.0.0.3"]
+	assertValue(t, ipip, "ipv4", "network.transport")
+	assertValue(t, ipip, "ipip", "system.socket.tunnel.type")
+	assertValue(t, ipip, uint64(0), "destination.packets")
+	_, err := ipip.GetValue("source.ip")
+	assert.Error(t, err)
+
+	// Idle tunnels aren't reported.
+	assert.Empty(t, tunnelEvents())
+	st.feedEvents([]event{
+		tunnelRcv(7, "10.0.0.1", "10.0.0.2", ipprotoGRE, 60, false),
+	})
+	evs = tunnelEvents()
+	if assert.Len(t, evs, 1) {
+		assertValue(t, evs["10.0.0.2"], uint64(1), "destination.packets")
+		assertValue(t, evs["10.0.0.2"], uint64(0), "source.packets")
+	}
+}
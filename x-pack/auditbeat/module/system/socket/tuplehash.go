@@ -0,0 +1,137 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"net"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// addressFields are the fields of events that hold addresses, removed in
+// hash-only mode. The community ID is also removed, as it's an unkeyed hash of
+// the addresses, and so are the answers of DNS events, which are addresses.
+var addressFields = []string{
+	"source.ip",
+	"destination.ip",
+	"client.ip",
+	"server.ip",
+	"related.ip",
+	"network.community_id",
+	"network.local.listen_address",
+	"dns.answers",
+	"dns.resolved_ip",
+}
+
+// tupleHasher computes flow.tuple_hash, a hash of the network namespace,
+// transport and addresses of a flow that's the same for both ends of a
+// connection.
+type tupleHasher struct {
+	// key makes the hash an HMAC, so that addresses can't be recovered by
+	// hashing every possible tuple. Empty for a plain SHA-256.
+	key []byte
+	// hashOnly removes the addresses from all events.
+	hashOnly bool
+}
+
+// withTupleHash reports flow.tuple_hash. The network namespace of processes
+// is read, as it's part of the hash. In hash-only mode, the reporter is
+// wrapped so that no event published by the state holds an address.
+func withTupleHash(enabled, hashOnly bool, key string) stateOption {
+	return func(s *state) {
+		if !enabled {
+			return
+		}
+		s.tupleHash = &tupleHasher{key: []byte(key), hashOnly: hashOnly}
+		if s.readNetNS == nil {
+			s.readNetNS = readNetNS
+		}
+		if hashOnly {
+			s.reporter = hashOnlyReporter{PushReporterV2: s.reporter}
+		}
+	}
+}
+
+// hash returns the hash of the tuple of a flow, or an empty string when the
+// tuple isn't complete. The endpoints are sorted, so that the flows of both
+// ends of a connection have the same hash.
+func (h *tupleHasher) hash(f *flow) string {
+	if !f.hasCompleteTuple() {
+		return ""
+	}
+	a, b := tupleEndpoint(f.local.addr), tupleEndpoint(f.remote.addr)
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	var sum hash.Hash
+	if len(h.key) > 0 {
+		sum = hmac.New(sha256.New, h.key)
+	} else {
+		sum = sha256.New()
+	}
+	var header [9]byte
+	binary.BigEndian.PutUint64(header[:8], f.netNS())
+	header[8] = uint8(f.proto)
+	sum.Write(header[:])
+	sum.Write(a[:])
+	sum.Write(b[:])
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// tupleEndpoint returns the canonical encoding of an endpoint: its address as
+// 16 bytes, so that IPv4 and IPv4-mapped IPv6 addresses are the same, and its
+// port.
+func tupleEndpoint(addr net.TCPAddr) (ep [18]byte) {
+	copy(ep[:16], addr.IP.To16())
+	binary.BigEndian.PutUint16(ep[16:], uint16(addr.Port))
+	return ep
+}
+
+// putTupleHash sets flow.tuple_hash in the fields of a flow event, and
+// removes its addresses in hash-only mode.
+func (s *state) putTupleHash(f *flow, fields mapstr.M) error {
+	h := s.tupleHash
+	if h == nil {
+		return nil
+	}
+	if sum := h.hash(f); sum != "" {
+		if _, err := fields.Put("flow.tuple_hash", sum); err != nil {
+			return err
+		}
+	}
+	if h.hashOnly {
+		removeAddresses(fields)
+	}
+	return nil
+}
+
+// removeAddresses deletes the addressFields of an event.
+func removeAddresses(fields mapstr.M) {
+	for _, key := range addressFields {
+		// Not found when the event doesn't have the field.
+		_ = fields.Delete(key)
+	}
+}
+
+// hashOnlyReporter removes the addresses from the events of all kinds, like
+// port scans, tunnels and DNS transactions, before publishing them. Flows are
+// handled by putTupleHash, as they're also sent to the flow exporter.
+type hashOnlyReporter struct {
+	mb.PushReporterV2
+}
+
+func (r hashOnlyReporter) Event(event mb.Event) bool {
+	removeAddresses(event.RootFields)
+	return r.PushReporterV2.Event(event)
+}
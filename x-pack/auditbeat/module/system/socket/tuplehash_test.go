@@ -0,0 +1,154 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build (linux && 386) || (linux && amd64)
+
+package socket
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/beats/v7/x-pack/auditbeat/module/system/socket/dns"
+)
+
+func TestTupleHash(t *testing.T) {
+	tuple := func(proto flowProto, netns uint64, local, remote string, localPort, remotePort int) *flow {
+		f := &flow{
+			proto:  proto,
+			local:  endpoint{addr: net.TCPAddr{IP: net.ParseIP(local), Port: localPort}},
+			remote: endpoint{addr: net.TCPAddr{IP: net.ParseIP(remote), Port: remotePort}},
+		}
+		if netns != 0 {
+			f.process = &process{pid: 1234, netns: netns}
+		}
+		return f
+	}
+	h := &tupleHasher{}
+	client := h.hash(tuple(protoTCP, 1, "10.0.0.1", "10.0.0.2", 38842, 443))
+	assert.Len(t, client, 64)
+	// Both ends of the connection.
+	assert.Equal(t, client, h.hash(tuple(protoTCP, 1, "10.0.0.2", "10.0.0.1", 443, 38842)))
+	// IPv4-mapped addresses of an IPv6 socket.
+	assert.Equal(t, client, h.hash(tuple(protoTCP, 1, "::ffff:10.0.0.1", "::ffff:10.0.0.2", 38842, 443)))
+
+	for name, other := range map[string]*flow{
+		"transport":   tuple(protoUDP, 1, "10.0.0.1", "10.0.0.2", 38842, 443),
+		"namespace":   tuple(protoTCP, 2, "10.0.0.1", "10.0.0.2", 38842, 443),
+		"no process":  tuple(protoTCP, 0, "10.0.0.1", "10.0.0.2", 38842, 443),
+		"port":        tuple(protoTCP, 1, "10.0.0.1", "10.0.0.2", 38843, 443),
+		"swapped ips": tuple(protoTCP, 1, "10.0.0.2", "10.0.0.1", 38842, 443),
+	} {
+		assert.NotEqual(t, client, h.hash(other), name)
+	}
+
+	keyed := &tupleHasher{key: []byte("secret")}
+	assert.NotEqual(t, client, keyed.hash(tuple(protoTCP, 1, "10.0.0.1", "10.0.0.2", 38842, 443)))
+	assert.Equal(t, keyed.hash(tuple(protoTCP, 1, "10.0.0.1", "10.0.0.2", 38842, 443)),
+		keyed.hash(tuple(protoTCP, 1, "10.0.0.2", "10.0.0.1", 443, 38842)))
+
+	incomplete := tuple(protoTCP, 1, "10.0.0.1", "10.0.0.2", 38842, 443)
+	incomplete.local = endpoint{}
+	assert.Empty(t, h.hash(incomplete))
+}
+
+func TestTupleHashOnlyMode(t *testing.T) {
+	for _, hashOnly := range []bool{false, true} {
+		st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+		withTupleHash(true, hashOnly, "secret")(&st.state)
+		f := &flow{
+			proto:    protoTCP,
+			dir:      directionEgress,
+			local:    endpoint{addr: net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 38842}},
+			remote:   endpoint{addr: net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443}},
+			complete: true,
+		}
+		ev, err := f.toEvent(true)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if !assert.NoError(t, st.putTupleHash(f, ev.RootFields)) {
+			return
+		}
+		fields := ev.RootFields
+		hash, err := fields.GetValue("flow.tuple_hash")
+		assert.NoError(t, err)
+		assert.Equal(t, st.tupleHash.hash(f), hash)
+		port, err := fields.GetValue("destination.port")
+		assert.NoError(t, err)
+		assert.Equal(t, 443, port)
+		for _, field := range addressFields {
+			if field == "network.local.listen_address" {
+				continue
+			}
+			_, err = fields.GetValue(field)
+			if hashOnly {
+				assert.Error(t, err, field)
+			} else {
+				assert.NoError(t, err, field)
+			}
+		}
+	}
+}
+
+func TestHashOnlyModeEvents(t *testing.T) {
+	const (
+		localIP  = "10.0.0.1"
+		remoteIP = "10.0.0.2"
+		answerIP = "10.0.0.3"
+	)
+	st := makeTestingState(t, time.Second, time.Second, 0, time.Second)
+	withTupleHash(true, true, "secret")(&st.state)
+
+	f := &flow{
+		proto:    protoTCP,
+		dir:      directionEgress,
+		local:    endpoint{addr: net.TCPAddr{IP: net.ParseIP(localIP), Port: 38842}},
+		remote:   endpoint{addr: net.TCPAddr{IP: net.ParseIP(remoteIP), Port: 443}},
+		complete: true,
+	}
+	flowEvent, err := f.toEvent(true)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if !assert.NoError(t, st.putTupleHash(f, flowEvent.RootFields)) {
+		t.FailNow()
+	}
+	for name, ev := range map[string]mb.Event{
+		"flow":      flowEvent,
+		"port scan": portScan{remoteIP: remoteIP, localIP: localIP, ports: 20, attempts: 20}.toEvent(),
+		"tunnel": tunnelEvent(&tunnel{
+			key:   tunnelKey{remote: 0x0200000a, proto: ipprotoIPIP},
+			local: 0x0100000a,
+		}),
+		"dns": dnsEvent{tr: dns.Transaction{
+			Client:    net.UDPAddr{IP: net.ParseIP(localIP), Port: 40000},
+			Server:    net.UDPAddr{IP: net.ParseIP(remoteIP), Port: 53},
+			Domain:    "example.net",
+			Addresses: []net.IP{net.ParseIP(answerIP)},
+		}}.toEvent(),
+	} {
+		st.reporter.Event(ev)
+		evs := st.getFlows()
+		if !assert.Len(t, evs, 1, name) {
+			continue
+		}
+		fields := evs[0].Fields.Flatten()
+		for key, value := range fields {
+			for _, ip := range []string{localIP, remoteIP, answerIP} {
+				assert.NotContains(t, fmt.Sprint(value), ip, "%s: %s", name, key)
+			}
+		}
+		for _, key := range addressFields {
+			_, found := fields[key]
+			assert.False(t, found, "%s: %s", name, key)
+		}
+		assert.Contains(t, fields, "event.action", name)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Zone of the addresses that don't belong to any of the configured zones.
+const unknownZone = "unknown"
+
+// zoneNode is a node of a binary trie of network prefixes, indexed by the
+// bits of the address from the most significant one. The zone is set on the
+// nodes at the end of a configured prefix.
+type zoneNode struct {
+	children [2]*zoneNode
+	zone     string
+}
+
+// zoneClassifier assigns addresses to named zones, such as prod and dev
+// subnets, to tag the flows that cross from one zone to another. When the
+// prefixes of several zones overlap, the most specific one wins.
+type zoneClassifier struct {
+	v4, v6 zoneNode
+}
+
+// newZoneClassifier returns a classifier for the given zones, a map of zone
+// names to lists of CIDRs. It returns nil when no zone is configured.
+func newZoneClassifier(zones map[string][]string) (*zoneClassifier, error) {
+	if len(zones) == 0 {
+		return nil, nil
+	}
+	// Sorted so that the zone named in errors doesn't change between runs.
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var c zoneClassifier
+	for _, name := range names {
+		if name == "" {
+			return nil, errors.New("empty zone name in socket.network_zones")
+		}
+		if name == unknownZone {
+			return nil, fmt.Errorf("invalid socket.network_zones: zone name '%s' is reserved", unknownZone)
+		}
+		for _, cidr := range zones[name] {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid socket.network_zones: zone '%s': %w", name, err)
+			}
+			if err = c.insert(ipNet, name); err != nil {
+				return nil, fmt.Errorf("invalid socket.network_zones: %w", err)
+			}
+		}
+	}
+	return &c, nil
+}
+
+func (c *zoneClassifier) root(ip net.IP) (*zoneNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &c.v4, ip4
+	}
+	return &c.v6, ip.To16()
+}
+
+func (c *zoneClassifier) insert(ipNet *net.IPNet, zone string) error {
+	node, ip := c.root(ipNet.IP)
+	ones, bits := ipNet.Mask.Size()
+	if bits == 8*net.IPv6len && len(ip) == net.IPv4len {
+		// An IPv4-mapped IPv6 prefix, as addresses are looked up as IPv4.
+		if ones < 96 {
+			node, ip = &c.v6, ipNet.IP.To16()
+		} else {
+			ones -= 96
+		}
+	}
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &zoneNode{}
+		}
+		node = node.children[bit]
+	}
+	if node.zone != "" && node.zone != zone {
+		return fmt.Errorf("%s is in zones '%s' and '%s'", ipNet, node.zone, zone)
+	}
+	node.zone = zone
+	return nil
+}
+
+// Lookup returns the zone of the given address, from its longest matching
+// prefix, or unknownZone when it isn't in any zone.
+func (c *zoneClassifier) Lookup(ip net.IP) string {
+	if c == nil || ip == nil {
+		return ""
+	}
+	node, ip := c.root(ip)
+	zone := unknownZone
+	for i := 0; node != nil; i++ {
+		if node.zone != "" {
+			zone = node.zone
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[ip[i/8]>>(7-i%8)&1]
+	}
+	return zone
+}
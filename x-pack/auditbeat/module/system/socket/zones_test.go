@@ -0,0 +1,74 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package socket
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZoneClassifier(t *testing.T) {
+	c, err := newZoneClassifier(map[string][]string{
+		"prod":     {"10.0.0.0/8", "2001:db8:1::/48"},
+		"dev":      {"10.20.0.0/16", "2001:db8:1:2::/64"},
+		"bastion":  {"10.20.30.40/32"},
+		"mapped":   {"::ffff:192.168.0.0/112"},
+		"default6": {"::/0"},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for ip, expected := range map[string]string{
+		"10.1.2.3":            "prod",
+		"10.20.1.1":           "dev",
+		"10.20.30.40":         "bastion",
+		"10.20.30.41":         "dev",
+		"11.0.0.1":            unknownZone,
+		"192.168.1.1":         "mapped",
+		"::ffff:10.20.1.1":    "dev",
+		"2001:db8:1::1":       "prod",
+		"2001:db8:1:2::1":     "dev",
+		"2001:db8:2::1":       "default6",
+		"fe80::1":             "default6",
+		"::ffff:172.16.0.1":   unknownZone,
+		"255.255.255.255":     unknownZone,
+		"2001:db8:1:2:ffff::": "dev",
+	} {
+		assert.Equal(t, expected, c.Lookup(net.ParseIP(ip)), ip)
+	}
+	assert.Empty(t, c.Lookup(nil))
+
+	var disabled *zoneClassifier
+	assert.Empty(t, disabled.Lookup(net.ParseIP("10.1.2.3")))
+}
+
+func TestZoneClassifierWholeFamily(t *testing.T) {
+	c, err := newZoneClassifier(map[string][]string{
+		"any": {"0.0.0.0/0"},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "any", c.Lookup(net.ParseIP("8.8.8.8")))
+	assert.Equal(t, unknownZone, c.Lookup(net.ParseIP("2001:db8::1")))
+}
+
+func TestZoneClassifierErrors(t *testing.T) {
+	for name, zones := range map[string]map[string][]string{
+		"invalid CIDR":   {"prod": {"10.0.0.0"}},
+		"empty zone":     {"": {"10.0.0.0/8"}},
+		"reserved zone":  {unknownZone: {"10.0.0.0/8"}},
+		"duplicate CIDR": {"prod": {"10.0.0.0/8"}, "dev": {"10.0.0.0/8"}},
+	} {
+		_, err := newZoneClassifier(zones)
+		assert.Error(t, err, name)
+	}
+
+	c, err := newZoneClassifier(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+}
@@ -95,6 +95,20 @@ class Test(AuditbeatXPackTest):
         self.with_runner(TCP4TestCase(),
                          extra_conf={'socket.enable_ipv6': False})
 
+    def test_tcp_urgent_data(self):
+        """
+        test TCP urgent data
+        """
+        self.with_runner(TCPUrgentDataTestCase(),
+                         extra_conf={'socket.track_urgent_data': True})
+
+    def test_tcp_connect_timeout(self):
+        """
+        test TCP connect failure
+        """
+        self.with_runner(TCPConnectTimeoutTestCase(),
+                         extra_conf={'socket.report_connect_failures': True})
+
     def test_dns_enrichment(self):
         """
         test DNS enrichment
@@ -249,6 +263,76 @@ class TCP4TestCase:
         })
 
 
+class TCPUrgentDataTestCase:
+    def __init__(self):
+        pass
+
+    def run(self):
+        client, self.client_addr = socket_ipv4(socket.SOCK_STREAM, socket.IPPROTO_TCP)
+        server, self.server_addr = socket_ipv4(socket.SOCK_STREAM, socket.IPPROTO_TCP)
+        server.listen(8)
+        client.connect(self.server_addr)
+        acc, _ = server.accept()
+        client.send(b'Hello there\n')
+        acc.recv(64)
+        client.send(b'!', socket.MSG_OOB)
+        acc.recv(1, socket.MSG_OOB)
+        acc.close()
+        server.close()
+        client.close()
+
+    def expected(self):
+        # Urgent data is detected by the receiving socket, the accepted one.
+        return HasEvent({
+            "source.ip": self.client_addr[0],
+            "source.port": self.client_addr[1],
+            "destination.ip": self.server_addr[0],
+            "destination.port": self.server_addr[1],
+            "network.transport": "tcp",
+            "network.tcp.urgent_data_seen": True,
+        })
+
+
+class TCPConnectTimeoutTestCase:
+    def __init__(self):
+        # Routed through loopback, but not local: packets sent to it are
+        # dropped.
+        self.server_addr = ('198.18.{}.{}'.format(random.randint(0, 255), random.randint(1, 254)), 80)
+
+    def setup(self):
+        rv = os.system('/sbin/ip route add {}/32 dev lo'.format(self.server_addr[0]))
+        if rv != 0:
+            raise Exception("add route returned {}".format(rv))
+
+    def cleanup(self):
+        os.system('/sbin/ip route delete {}/32 dev lo'.format(self.server_addr[0]))
+
+    def run(self):
+        client = socket.socket(socket.AF_INET, socket.SOCK_STREAM, socket.IPPROTO_TCP)
+        # Give up after a single SYN retransmission, 3 seconds.
+        client.setsockopt(socket.IPPROTO_TCP, socket.TCP_SYNCNT, 1)
+        client.settimeout(10)
+        try:
+            client.connect(self.server_addr)
+            raise Exception("connect to a blackholed address succeeded")
+        except socket.timeout:
+            raise Exception("connect to a blackholed address didn't time out in the kernel")
+        except OSError:
+            pass
+        finally:
+            client.close()
+
+    def expected(self):
+        return HasEvent({
+            "destination.ip": self.server_addr[0],
+            "destination.port": self.server_addr[1],
+            "network.transport": "tcp",
+            "network.tcp.connect_error": "ETIMEDOUT",
+            "network.tcp.connect_errno": 110,
+            "network.tcp.connect_attempt_duration_ns": Comparison(operator.ge, 2000000000),
+        })
+
+
 class UDP4TestCase:
     def __init__(self):
         pass
@@ -150,6 +150,10 @@ const maxIntSizeBytes = 8
 // This allows to dump chunks of memory by concatenating successive fetchargs
 // arguments.
 //
+// The special optional modifier allows a field to be missing from the kprobe's
+// format, in which case it's left untouched. This allows the same struct to be
+// used for probes whose fetchargs depend on the available offsets.
+//
 // The custom allocator has to return a pointer to the struct. There's no actual
 // need to allocate a new struct each time, as long as the consumer of a perf
 // event channel manages the lifetime of the returned structs. This allows for
@@ -183,11 +187,13 @@ func NewStructDecoder(desc ProbeFormat, allocFn AllocateFn) (Decoder, error) {
 		}
 
 		var name string
-		var greedy bool
+		var greedy, optional bool
 		for idx, param := range strings.Split(values, ",") {
 			switch param {
 			case "greedy":
 				greedy = true
+			case "optional":
+				optional = true
 			default:
 				if idx != 0 {
 					return nil, fmt.Errorf("bad parameter '%s' in kprobe tag for field '%s'", param, outField.Name)
@@ -213,6 +219,9 @@ func NewStructDecoder(desc ProbeFormat, allocFn AllocateFn) (Decoder, error) {
 		}
 
 		inField, found := desc.Fields[name]
+		if !found && optional {
+			continue
+		}
 		if !found {
 			return nil, fmt.Errorf("field '%s' not found in kprobe format description", name)
 		}
@@ -15,10 +15,19 @@ import (
 // on the current architecture.
 var MachineEndian = getCPUEndianness()
 
+// Bytes whose value as a native uint32 gives away the byte order.
+var endiannessMarker = [4]byte{0x12, 0x34, 0x56, 0x78}
+
 func getCPUEndianness() binary.ByteOrder {
 	myInt32 := new(uint32)
-	copy((*[4]byte)(unsafe.Pointer(myInt32))[:], []byte{0x12, 0x34, 0x56, 0x78})
-	switch *myInt32 {
+	copy((*[4]byte)(unsafe.Pointer(myInt32))[:], endiannessMarker[:])
+	return endiannessOf(*myInt32)
+}
+
+// endiannessOf returns the byte order of a machine that reads the marker
+// bytes as the given value.
+func endiannessOf(value uint32) binary.ByteOrder {
+	switch value {
 	case 0x12345678:
 		return binary.BigEndian
 	case 0x78563412:
@@ -27,3 +36,12 @@ func getCPUEndianness() binary.ByteOrder {
 		panic("cannot determine endianness")
 	}
 }
+
+// EndianName returns "big" or "little" for the given byte order, to report
+// it in logs and metrics.
+func EndianName(order binary.ByteOrder) string {
+	if order == binary.BigEndian {
+		return "big"
+	}
+	return "little"
+}
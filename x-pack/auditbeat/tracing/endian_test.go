@@ -0,0 +1,41 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build linux
+
+package tracing
+
+import (
+	"encoding/binary"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndiannessOf(t *testing.T) {
+	for name, order := range map[string]binary.ByteOrder{
+		"big":    binary.BigEndian,
+		"little": binary.LittleEndian,
+	} {
+		t.Run(name, func(t *testing.T) {
+			// The marker as read by a machine with this byte order.
+			value := order.Uint32(endiannessMarker[:])
+			assert.Equal(t, order, endiannessOf(value))
+			assert.Equal(t, name, EndianName(order))
+		})
+	}
+	assert.Panics(t, func() { endiannessOf(0x34127856) })
+}
+
+func TestMachineEndian(t *testing.T) {
+	// A field written by the kernel in a raw sample is decoded as written.
+	value := uint32(0xdeadbeef)
+	raw := (*[4]byte)(unsafe.Pointer(&value))[:]
+	assert.Equal(t, value, MachineEndian.Uint32(raw))
+
+	var buf [4]byte
+	MachineEndian.PutUint32(buf[:], value)
+	assert.Equal(t, raw, buf[:])
+}
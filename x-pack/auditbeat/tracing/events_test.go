@@ -407,3 +407,65 @@ r:myretprobe 0xffffff123456 +0(%di) +8(%di) +16(%di)
 `)...)
 	assert.Equal(t, strings.Split(string(expected), "\n"), strings.Split(string(contents), "\n"))
 }
+
+func TestTraceFSInstance(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "events_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "kprobe_events"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	evs, err := NewTraceFSWithPath(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = evs.CreateInstance("auditbeat")
+	assert.ErrorIs(t, err, ErrInstancesNotSupported)
+
+	if err := os.Mkdir(filepath.Join(tmpDir, "instances"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		_, err = evs.CreateInstance(name)
+		assert.Error(t, err, name)
+	}
+	instance, err := evs.CreateInstance("auditbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmpDir, "instances", "auditbeat")
+	assert.Equal(t, path, instance.InstancePath())
+	assert.Empty(t, evs.InstancePath())
+	// Attaches to an existing instance.
+	if _, err = evs.CreateInstance("auditbeat"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Probes are defined globally, and their format read from the instance.
+	probe := Probe{Group: "kprobe", Name: "myprobe", Address: "sys_open", Fetchargs: "fd=%di"}
+	assert.NoError(t, instance.AddKProbe(probe))
+	contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "kprobe_events"))
+	assert.NoError(t, err)
+	assert.Equal(t, "p:kprobe/myprobe sys_open fd=%di\n", string(contents))
+	formatDir := filepath.Join(path, "events", "kprobe", "myprobe")
+	if err := os.MkdirAll(formatDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(formatDir, "format"), []byte("name: myprobe\nID: 1234\nformat:\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	format, err := instance.LoadProbeFormat(probe)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1234, format.ID)
+	}
+	_, err = evs.LoadProbeFormat(probe)
+	assert.Error(t, err)
+
+	assert.NoError(t, os.RemoveAll(filepath.Join(path, "events")))
+	assert.NoError(t, instance.RemoveInstance())
+	assert.NoDirExists(t, path)
+	assert.NoError(t, evs.RemoveInstance())
+}
@@ -56,6 +56,9 @@ type PerfChannel struct {
 	wg      sync.WaitGroup
 	cpus    CPUSet
 
+	// lost samples, by index in the list of CPUs.
+	lost []lostCounter
+
 	// Settings
 	attr        perf.Attr
 	mappedPages int
@@ -67,6 +70,24 @@ type PerfChannel struct {
 	withTime    bool
 }
 
+// lostCounter counts the samples lost in the ring buffer of a CPU. Updated
+// atomically.
+type lostCounter struct {
+	samples   uint64
+	overflows uint64
+}
+
+// LostSamples is the count of samples lost in the ring buffer of a CPU.
+type LostSamples struct {
+	// CPU is the number of the CPU.
+	CPU int
+	// Samples is the number of samples reported lost by the kernel.
+	Samples uint64
+	// Overflows is the number of times the whole ring buffer was lost, in
+	// which case the number of samples lost is unknown.
+	Overflows uint64
+}
+
 // PerfChannelConf instances change the configuration of a perf channel.
 type PerfChannelConf func(*PerfChannel) error
 
@@ -124,6 +145,7 @@ func NewPerfChannel(cfg ...PerfChannelConf) (channel *PerfChannel, err error) {
 	if channel.cpus.NumCPU() < 1 {
 		return nil, errors.New("couldn't list online CPUs")
 	}
+	channel.lost = make([]lostCounter, channel.cpus.NumCPU())
 	// Set configuration
 	for _, fun := range cfg {
 		if err = fun(channel); err != nil {
@@ -219,9 +241,24 @@ func WithPollTimeout(timeout time.Duration) PerfChannelConf {
 // generated by this probe will be received. A probe is identified by its
 // ProbeFormat. The Decoder is used to decode events from this probe and
 // will determine the types and contents of the returned events.
-func (c *PerfChannel) MonitorProbe(format ProbeFormat, decoder Decoder) error {
+// On error, the events opened for the probe are closed, so that the call can
+// be retried.
+func (c *PerfChannel) MonitorProbe(format ProbeFormat, decoder Decoder) (err error) {
 	c.attr.Config = uint64(format.ID)
 	doGroup := len(c.events) > 0
+	numEvents := len(c.events)
+	var ids []uint64
+	defer func() {
+		if err != nil {
+			for _, ev := range c.events[numEvents:] {
+				ev.Close()
+			}
+			c.events = c.events[:numEvents]
+			for _, cid := range ids {
+				delete(c.streams, cid)
+			}
+		}
+	}()
 	cpuList := c.cpus.AsList()
 	for idx, cpu := range cpuList {
 		var group *perf.Event
@@ -236,21 +273,25 @@ func (c *PerfChannel) MonitorProbe(format ProbeFormat, decoder Decoder) error {
 		}
 		cid, err := ev.ID()
 		if err != nil {
+			ev.Close()
 			return err
 		}
 		if len(format.Probe.Filter) > 0 {
 			fd, err := ev.FD()
 			if err != nil {
+				ev.Close()
 				return err
 			}
 			fbytes := []byte(format.Probe.Filter + "\x00")
 			_, _, errNo := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.PERF_EVENT_IOC_SET_FILTER, uintptr(unsafe.Pointer(&fbytes[0])))
 			if errNo != 0 {
+				ev.Close()
 				return fmt.Errorf("unable to set filter '%s': %w", format.Probe.Filter, errNo)
 			}
 		}
 		c.streams[cid] = stream{probeID: format.ID, decoder: decoder}
 		c.events = append(c.events, ev)
+		ids = append(ids, cid)
 
 		if !doGroup {
 			if err := ev.MapRingNumPages(c.mappedPages); err != nil {
@@ -276,6 +317,21 @@ func (c *PerfChannel) LostC() <-chan uint64 {
 	return c.lostC
 }
 
+// LostPerCPU returns the number of samples lost so far in the ring buffer of
+// each CPU, ordered by CPU number. The total is also notified through LostC.
+func (c *PerfChannel) LostPerCPU() []LostSamples {
+	cpuList := c.cpus.AsList()
+	result := make([]LostSamples, len(c.lost))
+	for idx := range c.lost {
+		result[idx] = LostSamples{
+			CPU:       cpuList[idx],
+			Samples:   atomic.LoadUint64(&c.lost[idx].samples),
+			Overflows: atomic.LoadUint64(&c.lost[idx].overflows),
+		}
+	}
+	return result
+}
+
 // Run enables the configured probe and starts receiving perf events.
 // sampleC is the channel where decoded perf events are received.
 // errC is the channel where errors are received.
@@ -428,7 +484,7 @@ func (m *recordMerger) nextSample(ctx context.Context) (sr *perf.SampleRecord, o
 		var selIdx int
 		for i := 0; i < len(m.records); i++ {
 			if m.records[i] == nil {
-				if m.records[i], ok = m.readSampleNonBlock(m.evs[i], ctx); !ok {
+				if m.records[i], ok = m.readSampleNonBlock(i, ctx); !ok {
 					return nil, false
 				}
 			}
@@ -455,7 +511,10 @@ func (m *recordMerger) nextSample(ctx context.Context) (sr *perf.SampleRecord, o
 	}
 }
 
-func (m *recordMerger) readSampleNonBlock(ev *perf.Event, ctx context.Context) (sr *perf.SampleRecord, ok bool) {
+// readSampleNonBlock reads the next sample from the ring buffer of the CPU at
+// the given index in the list of CPUs.
+func (m *recordMerger) readSampleNonBlock(cpuIdx int, ctx context.Context) (sr *perf.SampleRecord, ok bool) {
+	ev := m.evs[cpuIdx]
 	for ev.HasRecord() {
 		rec, err := ev.ReadRecord(ctx)
 		if ctx.Err() != nil {
@@ -463,6 +522,7 @@ func (m *recordMerger) readSampleNonBlock(ev *perf.Event, ctx context.Context) (
 		}
 		if err != nil {
 			if err == perf.ErrBadRecord {
+				atomic.AddUint64(&m.channel.lost[cpuIdx].overflows, 1)
 				m.channel.lostC <- ^uint64(0)
 				continue
 			}
@@ -477,6 +537,7 @@ func (m *recordMerger) readSampleNonBlock(ev *perf.Event, ctx context.Context) (
 				m.channel.errC <- errors.New("PERF_RECORD_LOST is not a *perf.LostRecord")
 				return nil, false
 			}
+			atomic.AddUint64(&m.channel.lost[cpuIdx].samples, lost.Lost)
 			m.channel.lostC <- lost.Lost
 			continue
 
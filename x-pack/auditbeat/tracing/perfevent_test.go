@@ -0,0 +1,32 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build linux
+
+package tracing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLostPerCPU(t *testing.T) {
+	cpus, err := NewCPUSetFromExpression("0,2-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &PerfChannel{
+		cpus: cpus,
+		lost: make([]lostCounter, cpus.NumCPU()),
+	}
+	// Counters are indexed by position in the list of CPUs.
+	c.lost[1].samples = 120
+	c.lost[2].overflows = 1
+	assert.Equal(t, []LostSamples{
+		{CPU: 0},
+		{CPU: 2, Samples: 120},
+		{CPU: 3, Overflows: 1},
+	}, c.LostPerCPU())
+}
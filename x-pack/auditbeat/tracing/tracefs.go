@@ -8,6 +8,7 @@ package tracing
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -31,9 +32,16 @@ var (
 	formatRegexp *regexp.Regexp = regexp.MustCompile("\\s+([^:]+):([^;]*);")
 )
 
+// ErrInstancesNotSupported is returned when creating an instance in a tracefs
+// or debugfs that doesn't support them.
+var ErrInstancesNotSupported = errors.New("tracing instances are not supported")
+
 // TraceFS is an accessor to manage event tracing via tracefs or debugfs.
 type TraceFS struct {
 	basePath string
+	// instancePath is the directory of the instance through which events are
+	// accessed. Empty for the global instance.
+	instancePath string
 }
 
 // NewTraceFS creates a new accessor for the event tracing feature.
@@ -63,6 +71,53 @@ func NewTraceFSWithPath(path string) (*TraceFS, error) {
 	return &TraceFS{basePath: path}, nil
 }
 
+// CreateInstance creates a tracing instance with the given name, under
+// instances/, or attaches to it if it already exists. Probes are still
+// defined globally, as the kernel only supports defining them in the
+// top-level directory, but the returned accessor reads their format from
+// the instance. It returns ErrInstancesNotSupported when instances aren't
+// available.
+func (dfs *TraceFS) CreateInstance(name string) (*TraceFS, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return nil, fmt.Errorf("invalid tracing instance name '%s'", name)
+	}
+	instances := filepath.Join(dfs.basePath, "instances")
+	if _, err := os.Stat(instances); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrInstancesNotSupported
+		}
+		return nil, err
+	}
+	path := filepath.Join(instances, name)
+	if err := os.Mkdir(path, 0o750); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	return &TraceFS{basePath: dfs.basePath, instancePath: path}, nil
+}
+
+// RemoveInstance removes the instance of an accessor returned by
+// CreateInstance. It does nothing for the global instance.
+func (dfs *TraceFS) RemoveInstance() error {
+	if dfs.instancePath == "" {
+		return nil
+	}
+	return os.Remove(dfs.instancePath)
+}
+
+// InstancePath returns the directory of the instance used by this accessor,
+// or an empty string for the global instance.
+func (dfs *TraceFS) InstancePath() string {
+	return dfs.instancePath
+}
+
+// eventsPath returns the directory that holds the events directory.
+func (dfs *TraceFS) eventsPath() string {
+	if dfs.instancePath != "" {
+		return dfs.instancePath
+	}
+	return dfs.basePath
+}
+
 // IsTraceFSAvailableAt returns nil if the path passed is a mounted tracefs
 // or debugfs that supports KProbes. Otherwise returns an error.
 func IsTraceFSAvailableAt(path string) error {
@@ -237,7 +292,7 @@ var integerTypes = map[string]uint8{
 // kprobe/kretprobe into a tracing event. The probe needs to be installed
 // for the kernel to provide its format.
 func (dfs *TraceFS) LoadProbeFormat(probe Probe) (format ProbeFormat, err error) {
-	path := filepath.Join(dfs.basePath, "events", probe.EffectiveGroup(), probe.Name, "format")
+	path := filepath.Join(dfs.eventsPath(), "events", probe.EffectiveGroup(), probe.Name, "format")
 	file, err := os.Open(path)
 	if err != nil {
 		return format, err